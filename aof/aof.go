@@ -6,76 +6,266 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nazeeeef007/redis-clone/store"
 )
 
 // AOF represents the Append-Only File. It now includes a mutex for thread-safe operations.
+// Besides the file, every command written is passed to the registered feeds,
+// which is how in-process standbys follow the write stream.
 type AOF struct {
-	file  *os.File
-	store *store.Store
-	mu    sync.Mutex
+	file     *os.File
+	path     string
+	dir      string
+	manifest *manifest
+	store    *store.Store
+	mu       sync.Mutex
+	feeds    map[int]Feed
+	nextFeed int
+
+	// rewriting is set while a rewrite writes a new base file, and
+	// rewriteErr holds the outcome of the last rewrite.
+	rewriting  bool
+	rewriteErr error
+
+	// fsync is the fsync policy, empty for FsyncNo, and unsynced is set
+	// when the file has writes it hasn't synced. syncing is set once the
+	// background sync of FsyncEverySec runs.
+	fsync    string
+	unsynced bool
+	syncing  bool
+	// written counts the commands written, including the MULTI and EXEC
+	// framing transactions, and fsynced how many of them were on disk as of
+	// the last fsync, for WAITAOF.
+	written int64
+	fsynced int64
+
+	// latency, when set, is told how long fsyncs and rewrite snapshots
+	// take. It is called with mu held.
+	latency func(event string, d time.Duration)
+
+	// transactions counts the transactions begun and not yet committed,
+	// which nest, as when EXEC runs a script, and framed is set once the
+	// MULTI that opens the outermost one is in the buffer.
+	transactions int
+	framed       bool
+
+	// buf holds the commands not yet written to the file, and spare the
+	// batch last written, for reuse. The writer goroutine, woken by kick,
+	// sets writing while it writes a batch outside mu; flushedTo counts the
+	// commands written as of the last batch, flushErr is its error, and
+	// flushed is broadcast after each batch.
+	buf       []byte
+	spare     []byte
+	kick      chan struct{}
+	writing   bool
+	flushedTo int64
+	flushErr  error
+	flushed   *sync.Cond
 }
 
-// NewAOF creates a new AOF instance and opens the file.
+// Feed receives each command written to the AOF, in write order. It runs while
+// the AOF lock is held, so it must not write to the AOF itself.
+type Feed func(args []string)
+
+// NewAOF creates a new AOF instance and opens its current incremental file.
+// The files live in an appendonlydir directory next to path and are named
+// after path's base name; a legacy single-file AOF at path is migrated into
+// that layout first. An empty path creates an AOF without a file, which only
+// delivers commands to its feeds.
 func NewAOF(path string, s *store.Store) (*AOF, error) {
-	// Use os.O_RDWR to allow both reading (for Load) and writing (for WriteCommand).
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if path == "" {
+		return newAOF(&AOF{store: s}), nil
+	}
+	dir := filepath.Join(filepath.Dir(path), dirName)
+	m, err := openManifest(dir, filepath.Base(path), path)
+	if err != nil {
+		return nil, err
+	}
+	incr, _ := m.lastIncr()
+	file, err := os.OpenFile(filepath.Join(dir, incr.name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open AOF file: %w", err)
 	}
-	return &AOF{file: file, store: s}, nil
+	return newAOF(&AOF{file: file, path: path, dir: dir, manifest: m, store: s}), nil
+}
+
+// NewDisabledAOF creates an AOF that only delivers commands to its feeds until
+// Enable is called, which puts the files where NewAOF(path) would.
+func NewDisabledAOF(path string, s *store.Store) *AOF {
+	return newAOF(&AOF{path: path, dir: filepath.Join(filepath.Dir(path), dirName), store: s})
 }
 
-// WriteCommand appends a command to the AOF file in RESP format.
+// WriteCommand appends a command to the AOF in RESP format.
 // This is a significant improvement as it can handle arguments with spaces or special characters.
+// The command is buffered for the writer goroutine, which logs the errors
+// writing it; callers that must know it is on disk use WaitSynced.
+// Calling it on a nil AOF is a no-op, which is how a server runs with persistence disabled.
 func (a *AOF) WriteCommand(command string, args ...string) error {
+	if a == nil {
+		return nil
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	// RESP format: *<number of arguments>\r\n$<length of arg1>\r\n<arg1>\r\n...
-	// We'll write the command and all its arguments as a single RESP array.
 	cmdParts := append([]string{command}, args...)
-	arrayLen := len(cmdParts)
-
-	// Build the RESP string
-	var b strings.Builder
-	b.WriteString(fmt.Sprintf("*%d\r\n", arrayLen))
-	for _, part := range cmdParts {
-		b.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(part), part))
+	a.written++
+	for _, feed := range a.feeds {
+		feed(cmdParts)
+	}
+	if a.file == nil {
+		return nil
 	}
 
-	_, err := a.file.WriteString(b.String())
-	if err != nil {
-		return fmt.Errorf("failed to write to AOF: %w", err)
+	if a.transactions > 0 && !a.framed {
+		a.buf = appendCommand(a.buf, []string{"MULTI"})
+		a.written++
+		a.framed = true
+	}
+	a.buf = appendCommand(a.buf, cmdParts)
+	select {
+	case a.kick <- struct{}{}:
+	default:
 	}
 	return nil
 }
 
-// Load reads the AOF file and rebuilds the store's state by parsing RESP commands.
-func (a *AOF) Load() error {
+// BeginTransaction frames the commands written until commit is called with
+// MULTI and EXEC in the file, so that loading the AOF restores all of them
+// or none. Nothing is framed if no command is written. A transaction begun
+// before the last is committed is part of it. Feeds get the commands alone,
+// while the offsets count MULTI and EXEC too, so a reply held until its
+// commands are synced waits for the EXEC. The caller must keep anyone else
+// from writing until it commits, as EXEC does by holding the server's
+// command lock.
+func (a *AOF) BeginTransaction() (commit func()) {
+	if a == nil {
+		return func() {}
+	}
+	a.mu.Lock()
+	a.transactions++
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.transactions--; a.transactions == 0 {
+			a.endFrame()
+		}
+	}
+}
+
+// endFrame closes the transaction frame of the current file with EXEC, if
+// one was opened. A transaction that continues in another file, as when it
+// enables or rewrites the AOF, is framed again there. The caller must hold
+// a.mu.
+func (a *AOF) endFrame() {
+	if !a.framed {
+		return
+	}
+	a.framed = false
+	if a.file == nil {
+		return
+	}
+	a.buf = appendCommand(a.buf, []string{"EXEC"})
+	a.written++
+	select {
+	case a.kick <- struct{}{}:
+	default:
+	}
+}
+
+// AddFeed registers f to receive every subsequent command and returns a
+// function that unregisters it.
+func (a *AOF) AddFeed(f Feed) (remove func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.feeds == nil {
+		a.feeds = make(map[int]Feed)
+	}
+	id := a.nextFeed
+	a.nextFeed++
+	a.feeds[id] = f
+	return func() {
+		a.mu.Lock()
+		delete(a.feeds, id)
+		a.mu.Unlock()
+	}
+}
+
+// Load replays every file listed in the manifest, in order, to rebuild the
+// store, passing each command to apply.
+func (a *AOF) Load(apply func(args []string)) error {
+	if a.file == nil {
+		return nil
+	}
 	log.Println("Loading data from AOF file...")
-	file, err := os.OpenFile(a.file.Name(), os.O_RDONLY, 0666)
+	for _, e := range a.manifest.entries {
+		if err := loadFile(filepath.Join(a.dir, e.name), apply); err != nil {
+			return err
+		}
+	}
+	log.Println("AOF load complete.")
+	return nil
+}
+
+// loadFile reads one AOF file and passes its RESP commands to apply. A
+// transaction cut short at the end of the file, by a crash during EXEC, is
+// reverted: its commands aren't applied, and they are truncated from the
+// file, so the commands appended after them aren't taken as its own.
+func loadFile(path string, apply func(args []string)) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open AOF file for loading: %w", err)
 	}
 	defer file.Close()
+	incomplete, err := replay(file, apply)
+	if err != nil || incomplete < 0 {
+		return err
+	}
+	log.Printf("Reverting an incomplete MULTI/EXEC transaction at the end of %s", path)
+	if err := os.Truncate(path, incomplete); err != nil {
+		return fmt.Errorf("failed to truncate the incomplete transaction: %w", err)
+	}
+	return nil
+}
+
+// Replay passes the RESP commands read from r to apply, as they are replayed
+// from an AOF file. apply is expected to run them as clients' commands are
+// run, so every command the AOF holds is restored, but without writing them
+// to the AOF again. The commands of a transaction are passed on once its
+// EXEC is read, without the MULTI and EXEC, and dropped if r ends first.
+func Replay(r io.Reader, apply func(args []string)) error {
+	_, err := replay(r, apply)
+	return err
+}
 
+// replay is Replay, returning the offset of the MULTI of a transaction r
+// ends in the middle of, or -1.
+func replay(r io.Reader, apply func(args []string)) (incomplete int64, err error) {
 	// We use a bufio.Reader for more efficient line-by-line reading.
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(r)
+	// offset counts the bytes read, and queued holds the commands of the
+	// transaction read since the MULTI at multiAt.
+	var offset, multiAt int64
+	var queued [][]string
+	inTransaction := false
 
 	for {
+		start := offset
 		// Read the array length line, e.g., "*3\r\n"
 		line, err := reader.ReadString('\n')
 		if err == io.EOF {
 			break // End of file
 		}
 		if err != nil {
-			return fmt.Errorf("error reading AOF array length: %w", err)
+			return -1, fmt.Errorf("error reading AOF array length: %w", err)
 		}
+		offset += int64(len(line))
 
 		if line[0] != '*' {
 			log.Printf("AOF load error: expected array, got %s", line)
@@ -85,7 +275,7 @@ func (a *AOF) Load() error {
 		// Parse the number of arguments.
 		arrayLen, err := strconv.Atoi(strings.TrimSpace(line[1:]))
 		if err != nil {
-			return fmt.Errorf("error parsing AOF array length: %w", err)
+			return -1, fmt.Errorf("error parsing AOF array length: %w", err)
 		}
 
 		var parts []string
@@ -93,8 +283,9 @@ func (a *AOF) Load() error {
 			// Read the bulk string length line, e.g., "$5\r\n"
 			lenLine, err := reader.ReadString('\n')
 			if err != nil {
-				return fmt.Errorf("error reading AOF bulk string length: %w", err)
+				return -1, fmt.Errorf("error reading AOF bulk string length: %w", err)
 			}
+			offset += int64(len(lenLine))
 			if lenLine[0] != '$' {
 				log.Printf("AOF load error: expected bulk string, got %s", lenLine)
 				break
@@ -103,57 +294,58 @@ func (a *AOF) Load() error {
 			// Parse the length and read the string
 			bulkLen, err := strconv.Atoi(strings.TrimSpace(lenLine[1:]))
 			if err != nil {
-				return fmt.Errorf("error parsing AOF bulk string length: %w", err)
+				return -1, fmt.Errorf("error parsing AOF bulk string length: %w", err)
 			}
 
 			// Read the actual string data
 			data := make([]byte, bulkLen+2) // +2 for "\r\n"
 			if _, err := io.ReadFull(reader, data); err != nil {
-				return fmt.Errorf("error reading AOF bulk string data: %w", err)
+				return -1, fmt.Errorf("error reading AOF bulk string data: %w", err)
 			}
+			offset += int64(len(data))
 
 			parts = append(parts, string(data[:bulkLen]))
 		}
+		if len(parts) == 0 {
+			continue
+		}
 
-		// Re-execute the commands to restore the state.
-		if len(parts) > 0 {
-			command := strings.ToUpper(parts[0])
-			args := parts[1:]
-
-			switch command {
-			case "SET":
-				if len(args) >= 2 {
-					a.store.Set(args[0], args[1], 0)
-				}
-			case "DEL":
-				if len(args) >= 1 {
-					a.store.Del(args[0])
-				}
-			case "LPUSH":
-				if len(args) >= 2 {
-					a.store.Lpush(args[0], args[1:])
-				}
-			case "RPUSH":
-				if len(args) >= 2 {
-					a.store.Rpush(args[0], args[1:])
-				}
-			case "SADD":
-				if len(args) >= 2 {
-					a.store.Sadd(args[0], args[1:])
-				}
-			case "SREM":
-				if len(args) >= 2 {
-					a.store.Srem(args[0], args[1:])
-				}
+		switch {
+		case len(parts) == 1 && strings.EqualFold(parts[0], "MULTI"):
+			inTransaction, multiAt, queued = true, start, nil
+		case len(parts) == 1 && strings.EqualFold(parts[0], "EXEC") && inTransaction:
+			for _, cmd := range queued {
+				apply(cmd)
 			}
+			inTransaction, queued = false, nil
+		case inTransaction:
+			queued = append(queued, parts)
+		default:
+			// Re-execute the commands to restore the state.
+			apply(parts)
 		}
 	}
 
-	log.Println("AOF load complete.")
-	return nil
+	if inTransaction {
+		return multiAt, nil
+	}
+	return -1, nil
 }
 
-// Close closes the AOF file.
+// Close writes the buffered commands and closes the AOF file.
 func (a *AOF) Close() error {
-	return a.file.Close()
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.flush(true)
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file = nil
+	return err
 }
@@ -0,0 +1,50 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// commands encodes cmds as an AOF holds them.
+func commands(cmds ...[]string) []byte {
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = appendCommand(buf, cmd)
+	}
+	return buf
+}
+
+func TestLoadFileTransactions(t *testing.T) {
+	complete := commands(
+		[]string{"SET", "a", "1"},
+		[]string{"MULTI"},
+		[]string{"SET", "b", "2"},
+		[]string{"SET", "c", "3"},
+		[]string{"EXEC"},
+	)
+	// A crash during EXEC leaves the transaction without its EXEC.
+	cut := commands(
+		[]string{"MULTI"},
+		[]string{"SET", "d", "4"},
+	)
+	path := filepath.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(path, append(complete, cut...), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied [][]string
+	if err := loadFile(path, func(args []string) { applied = append(applied, args) }); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"SET", "a", "1"}, {"SET", "b", "2"}, {"SET", "c", "3"}}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %q, want %q", applied, want)
+	}
+	// The incomplete transaction is truncated, so commands appended later
+	// aren't taken as part of it.
+	if b, err := os.ReadFile(path); err != nil || string(b) != string(complete) {
+		t.Errorf("file after loading = %q, %v, want %q", b, err, complete)
+	}
+}
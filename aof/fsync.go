@@ -0,0 +1,121 @@
+package aof
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// The fsync policies, named as appendfsync names them. Without fsync, writes
+// reach the disk when the operating system flushes them, so a crash of the
+// machine, rather than of the server, can lose them.
+const (
+	// FsyncAlways syncs the file after every command, so no acknowledged
+	// write is lost.
+	FsyncAlways = "always"
+	// FsyncEverySec syncs the file once a second in the background, losing at
+	// most about a second of writes.
+	FsyncEverySec = "everysec"
+	// FsyncNo leaves flushing to the operating system.
+	FsyncNo = "no"
+)
+
+// SetFsync sets the fsync policy, one of FsyncAlways, FsyncEverySec and
+// FsyncNo. AOFs start with FsyncNo.
+func (a *AOF) SetFsync(policy string) error {
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return fmt.Errorf("unknown fsync policy '%s'", policy)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fsync = policy
+	if policy == FsyncEverySec && !a.syncing {
+		a.syncing = true
+		go a.syncEverySecond()
+	}
+	return nil
+}
+
+// Fsync returns the fsync policy.
+func (a *AOF) Fsync() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fsync == "" {
+		return FsyncNo
+	}
+	return a.fsync
+}
+
+// syncEverySecond syncs the file once a second while the policy is
+// FsyncEverySec and there are writes to sync. It runs for the life of the
+// AOF once the policy was first set.
+func (a *AOF) syncEverySecond() {
+	for range time.Tick(time.Second) {
+		a.mu.Lock()
+		if a.fsync == FsyncEverySec && a.file != nil {
+			if err := a.flush(true); err != nil {
+				log.Printf("Failed to write to AOF: %v", err)
+			}
+		}
+		if a.fsync == FsyncEverySec && a.unsynced && a.file != nil {
+			start := time.Now()
+			if err := a.file.Sync(); err != nil {
+				log.Printf("Failed to fsync AOF: %v", err)
+			} else {
+				a.fsynced = a.written
+			}
+			a.observe("aof-fsync-sec", time.Since(start))
+			a.unsynced = false
+		}
+		a.mu.Unlock()
+	}
+}
+
+// SetLatencyMonitor has the AOF report how long its fsyncs and the dataset
+// copies of its rewrites take to fn, which must not use the AOF.
+func (a *AOF) SetLatencyMonitor(fn func(event string, d time.Duration)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.latency = fn
+}
+
+// observe reports the duration of an event to the latency monitor, if any.
+// It is called with a.mu held.
+func (a *AOF) observe(event string, d time.Duration) {
+	if a.latency != nil {
+		a.latency(event, d)
+	}
+}
+
+// Offsets returns the number of commands written to the AOF so far, and how
+// many of them were on disk as of the last fsync. Both are zero for a nil
+// AOF.
+func (a *AOF) Offsets() (written, synced int64) {
+	if a == nil {
+		return 0, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.written, a.fsynced
+}
+
+// Sync writes the buffered commands and fsyncs the file now, whatever the
+// policy.
+func (a *AOF) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	if err := a.flush(true); err != nil {
+		return fmt.Errorf("failed to write to AOF: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync AOF: %w", err)
+	}
+	a.fsynced = a.written
+	a.unsynced = false
+	return nil
+}
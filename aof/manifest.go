@@ -0,0 +1,128 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The AOF is kept as a directory of files described by a manifest, like
+// Redis 7's multi-part AOF: at most one base file holding a snapshot of the
+// dataset, followed by incremental files of commands appended since.
+const (
+	dirName  = "appendonlydir"
+	typeBase = "b"
+	typeIncr = "i"
+)
+
+// manifestEntry describes one file of the AOF.
+type manifestEntry struct {
+	name string
+	seq  int
+	typ  string
+}
+
+// manifest lists the AOF files in replay order: the base file first, then
+// the incremental files by sequence number.
+type manifest struct {
+	entries []manifestEntry
+}
+
+// readManifest parses a manifest with one "file <name> seq <n> type <b|i>"
+// line per AOF file.
+func readManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &manifest{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var e manifestEntry
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				e.name = fields[i+1]
+			case "seq":
+				e.seq, err = strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid AOF manifest line %q", scanner.Text())
+				}
+			case "type":
+				e.typ = fields[i+1]
+			}
+		}
+		if e.name == "" || (e.typ != typeBase && e.typ != typeIncr) {
+			return nil, fmt.Errorf("invalid AOF manifest line %q", scanner.Text())
+		}
+		m.entries = append(m.entries, e)
+	}
+	return m, scanner.Err()
+}
+
+// write atomically replaces the manifest at path.
+func (m *manifest) write(path string) error {
+	var b strings.Builder
+	for _, e := range m.entries {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", e.name, e.seq, e.typ)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lastIncr returns the incremental file new commands are appended to.
+func (m *manifest) lastIncr() (manifestEntry, bool) {
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].typ == typeIncr {
+			return m.entries[i], true
+		}
+	}
+	return manifestEntry{}, false
+}
+
+// openManifest loads the manifest for the AOF named base inside dir, creating
+// the directory and a manifest with a first incremental file if needed, and
+// migrating a legacy single-file AOF at legacyPath into the new layout.
+func openManifest(dir, base, legacyPath string) (*manifest, error) {
+	manifestPath := filepath.Join(dir, base+".manifest")
+	if m, err := readManifest(manifestPath); err == nil {
+		if _, ok := m.lastIncr(); ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("AOF manifest %s has no incremental file", manifestPath)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read AOF manifest: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create AOF directory: %w", err)
+	}
+	if _, err := os.Stat(legacyPath); err == nil {
+		if err := migrateLegacy(dir, base, legacyPath); err != nil {
+			return nil, err
+		}
+	}
+	// The base file is picked up even when the manifest was never written,
+	// so a migration interrupted after moving the legacy file loses nothing.
+	m := &manifest{}
+	if _, err := os.Stat(filepath.Join(dir, baseFileName(base))); err == nil {
+		m.entries = append(m.entries, manifestEntry{name: baseFileName(base), seq: 1, typ: typeBase})
+	}
+	m.entries = append(m.entries, manifestEntry{name: base + ".1.incr.aof", seq: 1, typ: typeIncr})
+	if err := m.write(manifestPath); err != nil {
+		return nil, fmt.Errorf("failed to write AOF manifest: %w", err)
+	}
+	return m, nil
+}
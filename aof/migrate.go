@@ -0,0 +1,55 @@
+package aof
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// migrateLegacy converts a single-file AOF written by earlier versions into
+// the base file of the multi-part layout. The legacy file is first copied to
+// legacyPath+".bak" so the original data survives a failed or unwanted
+// upgrade; it is then moved into dir. Its RESP commands are replayed as they
+// were, since the base format is the same command stream.
+func migrateLegacy(dir, base, legacyPath string) error {
+	target := filepath.Join(dir, baseFileName(base))
+	backup := legacyPath + ".bak"
+	if err := copyFile(legacyPath, backup); err != nil {
+		return fmt.Errorf("failed to back up legacy AOF: %w", err)
+	}
+	if err := os.Rename(legacyPath, target); err != nil {
+		return fmt.Errorf("failed to migrate legacy AOF: %w", err)
+	}
+	log.Printf("Migrated legacy AOF %s to %s (backup kept at %s)", legacyPath, target, backup)
+	return nil
+}
+
+// baseFileName is the name of the first base file, which a migrated legacy
+// AOF becomes.
+func baseFileName(base string) string {
+	return base + ".1.base.aof"
+}
+
+// copyFile copies src to dst and syncs dst to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
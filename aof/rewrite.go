@@ -0,0 +1,241 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Status describes the state of the AOF, for INFO persistence.
+type Status struct {
+	Enabled bool
+	// Rewriting is set while a rewrite writes a new base file.
+	Rewriting bool
+	// LastRewriteErr is the error of the last rewrite, or nil if it succeeded
+	// or none has run.
+	LastRewriteErr error
+}
+
+// Status returns the current state of the AOF.
+func (a *AOF) Status() Status {
+	if a == nil {
+		return Status{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return Status{Enabled: a.file != nil, Rewriting: a.rewriting, LastRewriteErr: a.rewriteErr}
+}
+
+// Enable starts appending commands to the AOF files. The files are seeded by
+// a rewrite of the current dataset, which runs in the background; until it
+// completes, the manifest still describes the files as they were when the AOF
+// was last disabled. The caller must keep the dataset from changing while
+// Enable runs, so the rewrite and the commands that follow it line up.
+func (a *AOF) Enable() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		return nil
+	}
+	if a.path == "" {
+		return errors.New("no AOF path configured")
+	}
+	if a.rewriting {
+		return errors.New("background AOF rewrite already in progress")
+	}
+	m, err := openManifest(a.dir, filepath.Base(a.path), a.path)
+	if err != nil {
+		return err
+	}
+	a.manifest = m
+	return a.startRewrite()
+}
+
+// Rewrite starts a background rewrite of the enabled AOF from the current
+// dataset, which becomes its new base file. The caller must keep the dataset
+// from changing while Rewrite runs.
+func (a *AOF) Rewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return errors.New("AOF is disabled")
+	}
+	if a.rewriting {
+		return errors.New("background AOF rewrite already in progress")
+	}
+	return a.startRewrite()
+}
+
+// HasData reports whether the enabled AOF holds anything to replay: a base
+// file or commands in an incremental file.
+func (a *AOF) HasData() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return false
+	}
+	for _, e := range a.manifest.entries {
+		if e.typ == typeBase {
+			return true
+		}
+		if info, err := os.Stat(filepath.Join(a.dir, e.name)); err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Disable syncs and closes the current AOF file. Commands are still delivered
+// to the feeds, and the files on disk keep describing the dataset as of this
+// call.
+func (a *AOF) Disable() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	a.endFrame()
+	err := a.flush(true)
+	if serr := a.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close AOF file: %w", err)
+	}
+	return nil
+}
+
+// startRewrite switches appends to a new incremental file and writes a new
+// base file from a copy of the dataset in the background. Once the base file
+// is complete, the manifest is replaced with the new base and incremental
+// files and the old files are removed. When the AOF was already enabled, the
+// new incremental file is added to the current manifest right away, so a
+// failed or interrupted rewrite loses nothing. The caller must hold a.mu and
+// keep the dataset from changing.
+func (a *AOF) startRewrite() error {
+	base := filepath.Base(a.path)
+	baseSeq, incrSeq := 1, 1
+	for _, e := range a.manifest.entries {
+		if e.typ == typeBase {
+			baseSeq = max(baseSeq, e.seq+1)
+		} else {
+			incrSeq = max(incrSeq, e.seq+1)
+		}
+	}
+	baseEntry := manifestEntry{name: fmt.Sprintf("%s.%d.base.aof", base, baseSeq), seq: baseSeq, typ: typeBase}
+	incrEntry := manifestEntry{name: fmt.Sprintf("%s.%d.incr.aof", base, incrSeq), seq: incrSeq, typ: typeIncr}
+
+	// The buffered commands belong in the current file, ahead of the
+	// snapshot.
+	a.endFrame()
+	if err := a.flush(true); err != nil {
+		return fmt.Errorf("failed to write to AOF: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(a.dir, incrEntry.name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open AOF file: %w", err)
+	}
+	tracked := a.file != nil
+	if tracked {
+		a.manifest.entries = append(a.manifest.entries, incrEntry)
+		if err := a.manifest.write(a.manifestPath()); err != nil {
+			file.Close()
+			a.manifest.entries = a.manifest.entries[:len(a.manifest.entries)-1]
+			return fmt.Errorf("failed to write AOF manifest: %w", err)
+		}
+		// Writes to the old file are only counted as synced once they
+		// are on disk.
+		if a.unsynced && a.file.Sync() == nil {
+			a.fsynced = a.written
+		}
+		a.file.Close()
+	}
+	a.file = file
+
+	start := time.Now()
+	snapshot := store.NewStore()
+	a.store.CopyTo(snapshot)
+	a.observe("fork", time.Since(start))
+	a.rewriting = true
+	go a.finishRewrite(snapshot, baseEntry, incrEntry, tracked)
+	return nil
+}
+
+// finishRewrite writes the base file of a rewrite and installs the new manifest.
+func (a *AOF) finishRewrite(snapshot *store.Store, baseEntry, incrEntry manifestEntry, tracked bool) {
+	err := writeBase(filepath.Join(a.dir, baseEntry.name), snapshot)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = false
+	if err == nil {
+		m := &manifest{entries: []manifestEntry{baseEntry, incrEntry}}
+		if err = m.write(a.manifestPath()); err == nil {
+			for _, e := range a.manifest.entries {
+				if e.name != baseEntry.name && e.name != incrEntry.name {
+					os.Remove(filepath.Join(a.dir, e.name))
+				}
+			}
+			a.manifest = m
+		}
+	}
+	a.rewriteErr = err
+	if err != nil {
+		log.Printf("AOF rewrite failed: %v", err)
+		// An AOF being enabled stays off, since nothing on disk refers to
+		// the file it was appending to.
+		if !tracked && a.file != nil {
+			a.flush(true)
+			a.file.Close()
+			a.file = nil
+		}
+		return
+	}
+	log.Printf("AOF rewrite complete, new base file %s", baseEntry.name)
+}
+
+// writeBase writes the commands that rebuild snapshot to a new base file at path.
+func writeBase(path string, snapshot *store.Store) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = snapshot.RewriteCommands(func(args []string) error {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// manifestPath returns the path of the manifest file.
+func (a *AOF) manifestPath() string {
+	return filepath.Join(a.dir, filepath.Base(a.path)+".manifest")
+}
@@ -0,0 +1,108 @@
+package aof
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Commands aren't written to the file by the handlers that run them: they
+// are appended to an in-memory buffer, which a writer goroutine flushes to
+// the file in a single write per batch, with a single fsync per batch under
+// FsyncAlways. Handlers never wait for the disk; under FsyncAlways, the
+// server holds their replies until WaitSynced reports their commands
+// fsynced, so clients share the fsync of every command buffered alongside
+// theirs.
+
+// newAOF creates an AOF and starts its writer.
+func newAOF(a *AOF) *AOF {
+	a.flushed = sync.NewCond(&a.mu)
+	a.kick = make(chan struct{}, 1)
+	go a.writeLoop()
+	return a
+}
+
+// appendCommand appends a command to buf in RESP format.
+func appendCommand(buf []byte, parts []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(parts)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, part := range parts {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(part)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, part...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// writeLoop flushes the buffer whenever commands are added to it. It runs for
+// the life of the AOF.
+func (a *AOF) writeLoop() {
+	for range a.kick {
+		a.mu.Lock()
+		if err := a.flush(false); err != nil {
+			log.Printf("Failed to write to AOF: %v", err)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// WaitSynced blocks until the first offset commands written, as Offsets
+// counts them, are written to the file, and fsynced under FsyncAlways, and
+// returns the error of the last batch written. It returns right away when
+// the AOF has no file.
+func (a *AOF) WaitSynced(offset int64) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.flushedTo < offset && a.file != nil {
+		a.flushed.Wait()
+	}
+	return a.flushErr
+}
+
+// flush writes the buffered commands to the file in one write, then fsyncs
+// it under FsyncAlways. It is called with a.mu held; unless hold is set, it
+// releases the lock during the write so commands keep being buffered. With
+// hold set, the file holds every command written once it returns, so the
+// caller may sync, close or replace the file.
+func (a *AOF) flush(hold bool) error {
+	for a.writing {
+		a.flushed.Wait()
+	}
+	if len(a.buf) == 0 || a.file == nil {
+		return nil
+	}
+	batch, file, upto, always := a.buf, a.file, a.written, a.fsync == FsyncAlways
+	a.buf, a.spare = a.spare[:0], nil
+	a.writing = true
+	if !hold {
+		a.mu.Unlock()
+	}
+	start := time.Now()
+	_, err := file.Write(batch)
+	if err == nil && always {
+		err = file.Sync()
+	}
+	if !hold {
+		a.mu.Lock()
+	}
+	a.spare = batch
+	a.writing = false
+	a.flushedTo, a.flushErr = upto, err
+	if err == nil {
+		if always {
+			a.observe("aof-fsync-always", time.Since(start))
+			a.fsynced = upto
+		} else {
+			a.unsynced = true
+		}
+	}
+	a.flushed.Broadcast()
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// noScripting is the reply of servers that can't run scripts.
+const noScripting = "(error) ERR unknown command 'EVAL'"
+
+// scriptLine matches the position in a Lua error, like "user_script:3:".
+var scriptLine = regexp.MustCompile(`user_script:(\d+):`)
+
+// evalArgs splits the arguments after --eval into keys and arguments, which
+// are separated by a lone comma as with redis-cli: key1 key2 , arg1 arg2.
+func evalArgs(args []string) (keys, argv []string) {
+	for i, arg := range args {
+		if arg == "," {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// runEval sends the script in path to the server with EVAL and prints the
+// reply, or reports that the server can't run scripts. With debug set, the
+// script's output is printed with a header and an error is shown along with
+// the script line it points at, which makes iterating on a script from the
+// shell quicker.
+func runEval(conn net.Conn, path string, args []string, debug bool) int {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading script: %v\n", err)
+		return 1
+	}
+	keys, argv := evalArgs(args)
+	cmd := append([]string{"EVAL", string(script), strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, argv...)
+	if _, err := conn.Write([]byte(formatRESP(cmd))); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to server: %v\n", err)
+		return 1
+	}
+	resp, err := readRESP(bufio.NewReader(conn))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading response: %v\n", err)
+		return 1
+	}
+
+	if resp == noScripting {
+		fmt.Fprintln(os.Stderr, "Error: the server can't run scripts, as it has no EVAL command")
+		return 1
+	}
+	failed := strings.HasPrefix(resp, "(error) ")
+	if !debug {
+		fmt.Println(resp)
+		if failed {
+			return 1
+		}
+		return 0
+	}
+	fmt.Printf("--- %s (keys: %s, args: %s)\n", path, strings.Join(keys, " "), strings.Join(argv, " "))
+	if !failed {
+		fmt.Println(resp)
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, resp)
+	if m := scriptLine.FindStringSubmatch(resp); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		lines := strings.Split(string(script), "\n")
+		if n >= 1 && n <= len(lines) {
+			fmt.Fprintf(os.Stderr, "  at line %d: %s\n", n, strings.TrimSpace(lines[n-1]))
+		}
+	}
+	return 1
+}
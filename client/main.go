@@ -3,6 +3,7 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -12,12 +13,21 @@ import (
 )
 
 func main() {
+	eval := flag.String("eval", "", "run the Lua script in this file with EVAL; the remaining arguments are keys, then a lone ',', then arguments")
+	debug := flag.Bool("debug-script", false, "with -eval, print the script's output with a header and point errors at the script line")
+	flag.Parse()
+
 	conn, err := net.Dial("tcp", "127.0.0.1:6379")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error connecting: %v\n", err)
 		os.Exit(1)
 	}
 	defer conn.Close()
+	if *eval != "" {
+		code := runEval(conn, *eval, flag.Args(), *debug)
+		conn.Close()
+		os.Exit(code)
+	}
 	fmt.Println("Connected to myredis. Type 'quit' to exit.")
 
 	reader := bufio.NewReader(os.Stdin)
@@ -0,0 +1,360 @@
+package command
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// User is an ACL user. A user bound to a namespace only sees keys under that
+// prefix: the prefix is prepended to every key argument it sends and stripped
+// from keys returned to it, so several applications can share one server
+// without key collisions or code changes.
+type User struct {
+	Name      string
+	Enabled   bool
+	NoPass    bool
+	Namespace string
+	// Quotas limit how much the user may use the server per period.
+	Quotas []Quota
+	// passwords holds the SHA-256 hashes of the accepted passwords.
+	passwords map[string]struct{}
+}
+
+// users is the ACL user table. It always contains the "default" user, which
+// new connections are authenticated as while it is enabled and passwordless.
+var users = struct {
+	sync.RWMutex
+	byName map[string]*User
+}{byName: map[string]*User{
+	"default": {Name: "default", Enabled: true, NoPass: true, passwords: map[string]struct{}{}},
+}}
+
+// hashPassword returns the hex SHA-256 digest stored for a password.
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupUser returns the named user. setUser replaces users instead of
+// modifying them, so the result can be read without holding the lock.
+func lookupUser(name string) (*User, bool) {
+	users.RLock()
+	defer users.RUnlock()
+	u, ok := users.byName[name]
+	return u, ok
+}
+
+// defaultUser returns the user new connections are logged in as, or nil when
+// connections must authenticate first.
+func defaultUser() *User {
+	u, _ := lookupUser("default")
+	if u != nil && u.Enabled && u.NoPass {
+		return u
+	}
+	return nil
+}
+
+// authenticate checks a username/password pair.
+func authenticate(name, password string) (*User, bool) {
+	u, ok := lookupUser(name)
+	if !ok || !u.Enabled {
+		return nil, false
+	}
+	if u.NoPass {
+		return u, true
+	}
+	_, ok = u.passwords[hashPassword(password)]
+	return u, ok
+}
+
+// setUser creates or updates a user by applying ACL SETUSER rules.
+func setUser(name string, rules []string) error {
+	users.Lock()
+	defer users.Unlock()
+
+	u, ok := users.byName[name]
+	if ok {
+		// Rules are applied to a copy so a bad rule leaves the user untouched.
+		copied := *u
+		copied.passwords = make(map[string]struct{}, len(u.passwords))
+		for p := range u.passwords {
+			copied.passwords[p] = struct{}{}
+		}
+		copied.Quotas = slices.Clone(u.Quotas)
+		u = &copied
+	} else {
+		u = &User{Name: name, passwords: map[string]struct{}{}}
+	}
+	if err := u.applyRules(rules); err != nil {
+		return err
+	}
+	users.byName[name] = u
+	return nil
+}
+
+// applyRules applies ACL SETUSER rules to u, stopping at the first invalid
+// one.
+func (u *User) applyRules(rules []string) error {
+	for _, rule := range rules {
+		lower := strings.ToLower(rule)
+		switch {
+		case lower == "on":
+			u.Enabled = true
+		case lower == "off":
+			u.Enabled = false
+		case lower == "nopass":
+			u.NoPass = true
+			u.passwords = map[string]struct{}{}
+		case lower == "resetpass":
+			u.NoPass = false
+			u.passwords = map[string]struct{}{}
+		case strings.HasPrefix(rule, ">"):
+			u.passwords[hashPassword(rule[1:])] = struct{}{}
+			u.NoPass = false
+		case strings.HasPrefix(rule, "<"):
+			delete(u.passwords, hashPassword(rule[1:]))
+		case strings.HasPrefix(lower, "namespace:"):
+			u.Namespace = rule[len("namespace:"):]
+		case strings.HasPrefix(lower, "quota:"):
+			q, err := parseQuota(rule[len("quota:"):])
+			if err != nil {
+				return fmt.Errorf("Error in ACL SETUSER modifier '%s': %v", rule, err)
+			}
+			u.Quotas = slices.DeleteFunc(u.Quotas, func(old Quota) bool { return old.Scope == q.Scope })
+			u.Quotas = append(u.Quotas, q)
+		case lower == "resetquotas":
+			u.Quotas = nil
+		case lower == "reset":
+			*u = User{Name: u.Name, passwords: map[string]struct{}{}}
+		default:
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+		}
+	}
+	return nil
+}
+
+// describe formats the user as an ACL LIST entry.
+func (u *User) describe() string {
+	parts := []string{"user", u.Name}
+	if u.Enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.NoPass {
+		parts = append(parts, "nopass")
+	}
+	hashes := make([]string, 0, len(u.passwords))
+	for h := range u.passwords {
+		hashes = append(hashes, "#"+h)
+	}
+	sort.Strings(hashes)
+	parts = append(parts, hashes...)
+	if u.Namespace != "" {
+		parts = append(parts, "namespace:"+u.Namespace)
+	}
+	for _, q := range u.Quotas {
+		parts = append(parts, q.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// LoadACLFile reads users from a file with one "user <name> <rules...>" line
+// per user, using the same rules as ACL SETUSER. Blank lines and lines
+// starting with '#' are ignored.
+func LoadACLFile(path string) error {
+	errs := readACLFile(path, setUser, true)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// CheckACLFile reports every error LoadACLFile would stop at the first of,
+// without changing any user.
+func CheckACLFile(path string) []error {
+	users := map[string]*User{}
+	return readACLFile(path, func(name string, rules []string) error {
+		u, ok := users[name]
+		if !ok {
+			u = &User{Name: name, passwords: map[string]struct{}{}}
+			users[name] = u
+		}
+		return u.applyRules(rules)
+	}, false)
+}
+
+// readACLFile passes the users in an ACL file to set, returning the errors
+// in the file, or only the first if stop is set.
+func readACLFile(path string, set func(name string, rules []string) error, stop bool) []error {
+	file, err := os.Open(path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to open ACL file: %w", err)}
+	}
+	defer file.Close()
+
+	var errs []error
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for (!stop || len(errs) == 0) && scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			errs = append(errs, fmt.Errorf("%s:%d: expected 'user <name> <rules...>'", path, lineNo))
+			continue
+		}
+		if err := set(fields[1], fields[2:]); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, lineNo, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// checkAccess applies the client's authentication and namespace rules to a
+// command. It returns the arguments the handler should run with, or the error
+// reply (without the leading '-') when the command is refused.
+func checkAccess(c *Client, cmd string, args []string) ([]string, string) {
+	if c.User == nil && cmd != "AUTH" && cmd != "HELLO" {
+		return args, "NOAUTH Authentication required."
+	}
+	if ns := c.namespace(); ns != "" {
+		// Keys are rewritten before dispatch, so handlers, the store and
+		// the AOF all see the fully qualified key names.
+		rewritten, ok := applyNamespace(cmd, args, ns)
+		if !ok {
+			return args, fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", c.User.Name, strings.ToLower(cmd))
+		}
+		args = rewritten
+	}
+	if c.User != nil {
+		if denied := admitQuota(c.User, cmd, args); denied != "" {
+			return args, denied
+		}
+	}
+	return args, ""
+}
+
+// auth handles the AUTH command: AUTH <password> for the default user, or
+// AUTH <username> <password>.
+func auth(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	name, password := "default", args[1]
+	if len(args) == 3 {
+		name, password = args[1], args[2]
+	}
+	login(clientOf(conn), conn, name, password, func() {
+		fmt.Fprintf(conn, "+OK\r\n")
+	})
+}
+
+// login authenticates the connection as name and then calls done to write
+// the success reply, or writes the error reply itself. c may be nil when the
+// command isn't running on a client connection.
+func login(c *Client, conn net.Conn, name, password string, done func()) {
+	if c != nil && c.AuthProvider != nil {
+		// The provider may be slow, so it is asked once the server lock is
+		// released; the client's next command waits for the reply anyway.
+		c.deferred = func() {
+			u, err := c.AuthProvider.Authenticate(name, password)
+			switch {
+			case err == nil:
+				c.User = u
+				done()
+			case errors.Is(err, ErrInvalidCredentials):
+				fmt.Fprintf(conn, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			default:
+				log.Printf("Auth provider error for user %q: %v", name, err)
+				fmt.Fprintf(conn, "-ERR authentication provider unavailable\r\n")
+			}
+		}
+		return
+	}
+	u, ok := authenticate(name, password)
+	if !ok {
+		fmt.Fprintf(conn, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+		return
+	}
+	if c != nil {
+		c.User = u
+	}
+	done()
+}
+
+// acl handles the ACL command family.
+func acl(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	switch strings.ToUpper(args[1]) {
+	case "SETUSER":
+		if len(args) < 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'acl|setuser' command\r\n")
+			return
+		}
+		if err := setUser(args[2], args[3:]); err != nil {
+			fmt.Fprintf(conn, "-ERR %v\r\n", err)
+			return
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "DELUSER":
+		if len(args) < 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'acl|deluser' command\r\n")
+			return
+		}
+		users.Lock()
+		deleted := 0
+		for _, name := range args[2:] {
+			if name == "default" {
+				users.Unlock()
+				fmt.Fprintf(conn, "-ERR The 'default' user cannot be removed\r\n")
+				return
+			}
+			if _, ok := users.byName[name]; ok {
+				delete(users.byName, name)
+				deleted++
+			}
+		}
+		users.Unlock()
+		fmt.Fprintf(conn, ":%d\r\n", deleted)
+	case "LIST", "USERS":
+		users.RLock()
+		names := make([]string, 0, len(users.byName))
+		for name := range users.byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(conn, "*%d\r\n", len(names))
+		for _, name := range names {
+			line := name
+			if strings.ToUpper(args[1]) == "LIST" {
+				line = users.byName[name].describe()
+			}
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(line), line)
+		}
+		users.RUnlock()
+	case "WHOAMI":
+		c := clientOf(conn)
+		if c == nil || c.User == nil {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return
+		}
+		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(c.User.Name), c.User.Name)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,311 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// argSpec describes the arguments a command accepts. They are checked once
+// before the command runs or is queued in a transaction, so handlers can
+// rely on them, and every command refuses bad arguments with the same
+// errors.
+type argSpec struct {
+	// arity is the number of arguments, counting the command name, or the
+	// least number, negated, for variadic commands, as in COMMAND INFO.
+	arity int
+	// max, when set, is the most arguments a variadic command takes.
+	max int
+	// pairsFrom, when set, is the position from which the arguments come
+	// in pairs, such as HSET's field-value pairs.
+	pairsFrom int
+	// ints are the positions of the arguments that must be integers.
+	ints []int
+	// options is the grammar of the arguments from position optionsFrom on,
+	// when set.
+	optionsFrom int
+	options     map[string]argOption
+}
+
+// argOption is an option of a command's grammar.
+type argOption struct {
+	// values is the number of arguments following the option that are its
+	// values.
+	values int
+	// group, when set, names the options that exclude each other, such as
+	// the ways to give an expiration.
+	group string
+	// check, when set, returns the error the values of the option are
+	// refused with, or "" if they are valid.
+	check func(cmd string, values []string) string
+}
+
+// setOptions is the grammar of the options of SET.
+var setOptions = map[string]argOption{
+	"EX":      {values: 1, group: "expiration", check: positiveExpire},
+	"PX":      {values: 1, group: "expiration", check: positiveExpire},
+	"KEEPTTL": {group: "expiration"},
+	"NX":      {group: "condition"},
+	"XX":      {group: "condition"},
+	"GET":     {},
+}
+
+// withScore is the grammar of commands taking a WITHSCORE flag.
+var withScore = map[string]argOption{"WITHSCORE": {}}
+
+// positiveExpire checks the relative expiration of a command's option.
+func positiveExpire(cmd string, values []string) string {
+	n, err := strconv.ParseInt(values[0], 10, 64)
+	switch {
+	case err != nil:
+		return "ERR value is not an integer or out of range"
+	case n <= 0:
+		return fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(cmd))
+	}
+	return ""
+}
+
+// argSpecs lists the arguments of every command. Commands added with
+// RegisterCommand have theirs added too. Handlers only check what the
+// specs can't express, such as arguments that come in pairs or the
+// arguments of subcommands.
+var argSpecs = map[string]argSpec{
+	"PING":             {arity: -1, max: 2},
+	"AUTH":             {arity: -2, max: 3},
+	"HELLO":            {arity: -1},
+	"QUOTA":            {arity: -1},
+	"SUBSCRIBE":        {arity: -2},
+	"PSUBSCRIBE":       {arity: -2},
+	"UNSUBSCRIBE":      {arity: -1},
+	"PUNSUBSCRIBE":     {arity: -1},
+	"PUBLISH":          {arity: 3},
+	"PUBSUB":           {arity: -2},
+	"MONITOR":          {arity: 1},
+	"SLOWLOG":          {arity: -2},
+	"LATENCY":          {arity: -2},
+	"WAITAOF":          {arity: 4, ints: []int{1, 2, 3}},
+	"ACL":              {arity: -2},
+	"CLIENT":           {arity: -2},
+	"INFO":             {arity: -1},
+	"STATS":            {arity: -1, max: 2},
+	"CONFIG":           {arity: -2},
+	"SET":              {arity: -3, optionsFrom: 3, options: setOptions},
+	"SETSEALED":        {arity: 3},
+	"GET":              {arity: 2},
+	"DEL":              {arity: -2},
+	"EXISTS":           {arity: -2},
+	"FLUSHALL":         {arity: -1},
+	"FLUSHDB":          {arity: -1},
+	"EXPIRE":           {arity: 3, ints: []int{2}},
+	"PEXPIRE":          {arity: 3, ints: []int{2}},
+	"EXPIREAT":         {arity: 3, ints: []int{2}},
+	"PEXPIREAT":        {arity: 3, ints: []int{2}},
+	"PERSIST":          {arity: 2},
+	"TTLSWEEP":         {arity: -2},
+	"TTLREPORT":        {arity: -1},
+	"MIGRATION":        {arity: -2},
+	"XADD":             {arity: -5},
+	"XLEN":             {arity: 2},
+	"XRANGE":           {arity: -4, max: 6},
+	"XREVRANGE":        {arity: -4, max: 6},
+	"XREAD":            {arity: -4},
+	"XSETID":           {arity: -3},
+	"INCR":             {arity: 2},
+	"DECR":             {arity: 2},
+	"INCRBY":           {arity: 3, ints: []int{2}},
+	"DECRBY":           {arity: 3, ints: []int{2}},
+	"SCAN":             {arity: -2},
+	"BACKUP":           {arity: 1},
+	"SAVE":             {arity: 1},
+	"BGSAVE":           {arity: 1},
+	"LASTSAVE":         {arity: 1},
+	"BGREWRITEAOF":     {arity: 1},
+	"REPLCONF":         {arity: -3},
+	"PSYNC":            {arity: 3},
+	"REPLICAOF":        {arity: 3},
+	"SLAVEOF":          {arity: 3},
+	"LPUSH":            {arity: -3},
+	"LPOP":             {arity: 2},
+	"RPUSH":            {arity: -3},
+	"RPOP":             {arity: 2},
+	"LRANGE":           {arity: 4, ints: []int{2, 3}},
+	"SADD":             {arity: -3},
+	"SREM":             {arity: -3},
+	"SMEMBERS":         {arity: 2},
+	"SMOVE":            {arity: 4},
+	"SSCAN":            {arity: -3},
+	"HSET":             {arity: -4, pairsFrom: 2},
+	"HSETNX":           {arity: 4},
+	"HGET":             {arity: 3},
+	"HDEL":             {arity: -3},
+	"HGETALL":          {arity: 2},
+	"HEXISTS":          {arity: 3},
+	"HLEN":             {arity: 2},
+	"HKEYS":            {arity: 2},
+	"HVALS":            {arity: 2},
+	"HSCAN":            {arity: -3},
+	"HEXPIRE":          {arity: -6},
+	"HPEXPIRE":         {arity: -6},
+	"HEXPIREAT":        {arity: -6},
+	"HPEXPIREAT":       {arity: -6},
+	"HTTL":             {arity: -5},
+	"HPTTL":            {arity: -5},
+	"HPERSIST":         {arity: -5},
+	"ZADD":             {arity: -4},
+	"ZSCORE":           {arity: 3},
+	"ZMSCORE":          {arity: -3},
+	"ZRANDMEMBER":      {arity: -2, max: 4},
+	"ZCARD":            {arity: 2},
+	"ZREM":             {arity: -3},
+	"ZRANGE":           {arity: -4},
+	"ZREVRANGE":        {arity: -4},
+	"ZRANGEBYSCORE":    {arity: -4},
+	"ZREVRANGEBYSCORE": {arity: -4},
+	"ZCOUNT":           {arity: 4},
+	"ZREMRANGEBYSCORE": {arity: 4},
+	"ZRANGEBYLEX":      {arity: -4},
+	"ZREVRANGEBYLEX":   {arity: -4},
+	"ZRANGESTORE":      {arity: -5},
+	"ZLEXCOUNT":        {arity: 4},
+	"ZREMRANGEBYLEX":   {arity: 4},
+	"ZRANK":            {arity: -3, max: 4, optionsFrom: 3, options: withScore},
+	"ZREVRANK":         {arity: -3, max: 4, optionsFrom: 3, options: withScore},
+	"ZINCRBY":          {arity: 4},
+	"ZSCAN":            {arity: -3},
+	"ZPOPMIN":          {arity: -2, max: 3},
+	"ZPOPMAX":          {arity: -2, max: 3},
+	"BZPOPMIN":         {arity: -3},
+	"BZPOPMAX":         {arity: -3},
+	"GEOADD":           {arity: -5},
+	"GEOPOS":           {arity: -2},
+	"GEODIST":          {arity: -4, max: 5},
+	"GEOSEARCH":        {arity: -7},
+	"GEOSEARCHSTORE":   {arity: -8},
+	"BF.RESERVE":       {arity: -4},
+	"BF.ADD":           {arity: 3},
+	"BF.MADD":          {arity: -3},
+	"BF.EXISTS":        {arity: 3},
+	"BF.MEXISTS":       {arity: -3},
+	"BF.INFO":          {arity: -2, max: 3},
+	"BF.SCANDUMP":      {arity: 3},
+	"BF.LOADCHUNK":     {arity: 4},
+	"CF.RESERVE":       {arity: -3},
+	"CF.ADD":           {arity: 3},
+	"CF.ADDNX":         {arity: 3},
+	"CF.EXISTS":        {arity: 3},
+	"CF.MEXISTS":       {arity: -3},
+	"CF.COUNT":         {arity: 3},
+	"CF.DEL":           {arity: 3},
+	"CF.INFO":          {arity: 2},
+	"CF.SCANDUMP":      {arity: 3},
+	"CF.LOADCHUNK":     {arity: 4},
+	"CMS.INITBYDIM":    {arity: 4},
+	"CMS.INITBYPROB":   {arity: 4},
+	"CMS.INCRBY":       {arity: -4},
+	"CMS.QUERY":        {arity: -3},
+	"CMS.MERGE":        {arity: -4},
+	"CMS.INFO":         {arity: 2},
+	"CMS.SCANDUMP":     {arity: 3},
+	"CMS.LOADCHUNK":    {arity: 4},
+	"TOPK.RESERVE":     {arity: -3, max: 6},
+	"TOPK.ADD":         {arity: -3},
+	"TOPK.INCRBY":      {arity: -3},
+	"TOPK.QUERY":       {arity: -3},
+	"TOPK.COUNT":       {arity: -3},
+	"TOPK.LIST":        {arity: -2, max: 3},
+	"TOPK.INFO":        {arity: 2},
+	"TOPK.SCANDUMP":    {arity: 3},
+	"TOPK.LOADCHUNK":   {arity: 4},
+	"JSON.SET":         {arity: -4, max: 5},
+	"JSON.GET":         {arity: -2},
+	"JSON.DEL":         {arity: -2, max: 3},
+	"JSON.FORGET":      {arity: -2, max: 3},
+	"JSON.NUMINCRBY":   {arity: 4},
+	"JSON.ARRAPPEND":   {arity: -4},
+	"JSON.ARRINSERT":   {arity: -5, ints: []int{3}},
+	"JSON.ARRLEN":      {arity: -2, max: 3},
+	"JSON.TYPE":        {arity: -2, max: 3},
+	"JSON.RESP":        {arity: -2, max: 3},
+	"TS.CREATE":        {arity: -2},
+	"TS.ADD":           {arity: -4},
+	"TS.MADD":          {arity: -4},
+	"TS.DEL":           {arity: 4},
+	"TS.GET":           {arity: 2},
+	"TS.RANGE":         {arity: -4},
+	"TS.REVRANGE":      {arity: -4},
+	"TS.MRANGE":        {arity: -5},
+	"TS.MREVRANGE":     {arity: -5},
+	"TS.CREATERULE":    {arity: 6},
+	"TS.DELETERULE":    {arity: 3},
+	"TS.INFO":          {arity: 2},
+	"TS.SCANDUMP":      {arity: 3},
+	"TS.LOADCHUNK":     {arity: 4},
+	"FT.CREATE":        {arity: -5},
+	"FT.SEARCH":        {arity: -3},
+	"FT.DROPINDEX":     {arity: -2, max: 3},
+	"FT.INFO":          {arity: 2},
+	"FT._LIST":         {arity: 1},
+	"FT.TAGVALS":       {arity: 3},
+	"MODULE":           {arity: -2},
+	"HSCHEMA":          {arity: -2},
+	"OFFLINE":          {arity: -2},
+	"DELAYPUSH":        {arity: 4},
+	"DELAYLEN":         {arity: 2},
+	"DEBUG":            {arity: -2},
+	"EXPLAIN":          {arity: -2},
+	"MULTI":            {arity: 1},
+	"EXEC":             {arity: 1},
+	"DISCARD":          {arity: 1},
+	"WATCH":            {arity: -2},
+	"UNWATCH":          {arity: 1},
+	"PREPARE":          {arity: -2},
+	"EXECUTE":          {arity: -2},
+	"DEALLOCATE":       {arity: -2},
+	"EVAL":             {arity: -3, ints: []int{2}},
+	"EVALSHA":          {arity: -3, ints: []int{2}},
+	"EVAL_RO":          {arity: -3, ints: []int{2}},
+	"EVALSHA_RO":       {arity: -3, ints: []int{2}},
+	"SCRIPT":           {arity: -2},
+	"FUNCTION":         {arity: -2},
+	"FCALL":            {arity: -3, ints: []int{2}},
+	"FCALL_RO":         {arity: -3, ints: []int{2}},
+}
+
+// checkArgs returns the error a command is refused with if its arguments
+// don't match its spec, or "" if they do or it has none.
+func checkArgs(cmd string, args []string) string {
+	spec, ok := argSpecs[cmd]
+	if !ok {
+		return ""
+	}
+	if spec.arity > 0 && len(args) != spec.arity || spec.arity < 0 && len(args) < -spec.arity || spec.max > 0 && len(args) > spec.max ||
+		spec.pairsFrom > 0 && (len(args)-spec.pairsFrom)%2 != 0 {
+		return fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+	}
+	for _, i := range spec.ints {
+		if _, err := strconv.ParseInt(args[i], 10, 64); err != nil {
+			return "ERR value is not an integer or out of range"
+		}
+	}
+	if spec.options == nil {
+		return ""
+	}
+	groups := make(map[string]bool)
+	for i := spec.optionsFrom; i < len(args); i++ {
+		opt, ok := spec.options[strings.ToUpper(args[i])]
+		if !ok || i+opt.values >= len(args) || opt.group != "" && groups[opt.group] {
+			return "ERR syntax error"
+		}
+		if opt.group != "" {
+			groups[opt.group] = true
+		}
+		values := args[i+1 : i+1+opt.values]
+		if opt.check != nil {
+			if refused := opt.check(cmd, values); refused != "" {
+				return refused
+			}
+		}
+		i += opt.values
+	}
+	return ""
+}
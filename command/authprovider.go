@@ -0,0 +1,158 @@
+package command
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrInvalidCredentials is returned by an AuthProvider that rejects the
+// credentials it was given.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// AuthProvider validates AUTH credentials against an external system, such as
+// a directory, a token issuer or a secrets store, in place of the static ACL
+// passwords. Authenticate returns the user the credentials identify, or
+// ErrInvalidCredentials; any other error means the credentials could not be
+// checked. It is called without the server lock held and may block.
+type AuthProvider interface {
+	Authenticate(username, password string) (*User, error)
+}
+
+// AuthProviderFunc adapts a function to the AuthProvider interface.
+type AuthProviderFunc func(username, password string) (*User, error)
+
+// Authenticate calls f.
+func (f AuthProviderFunc) Authenticate(username, password string) (*User, error) {
+	return f(username, password)
+}
+
+// CachedAuthProvider wraps an AuthProvider, remembering accepted credentials
+// for a while and backing off from a provider that is failing, so that
+// reconnect storms don't hammer the external system.
+type CachedAuthProvider struct {
+	provider AuthProvider
+	ttl      time.Duration
+	backoff  time.Duration
+
+	mu       sync.Mutex
+	accepted map[[sha256.Size]byte]cachedAuth
+	// failures counts consecutive provider errors; while retryAt is in the
+	// future, lookups fail without calling the provider.
+	failures int
+	retryAt  time.Time
+	lastErr  error
+}
+
+// cachedAuth is an accepted credential pair and when it must be rechecked.
+type cachedAuth struct {
+	user    *User
+	expires time.Time
+}
+
+// maxAuthBackoff caps the wait after repeated provider failures.
+const maxAuthBackoff = time.Minute
+
+// NewCachedAuthProvider caches the users p accepts for ttl, and after a
+// provider error stops calling it for backoff, doubling with each further
+// consecutive error up to a minute.
+func NewCachedAuthProvider(p AuthProvider, ttl, backoff time.Duration) *CachedAuthProvider {
+	return &CachedAuthProvider{
+		provider: p,
+		ttl:      ttl,
+		backoff:  backoff,
+		accepted: make(map[[sha256.Size]byte]cachedAuth),
+	}
+}
+
+// Authenticate implements AuthProvider.
+func (c *CachedAuthProvider) Authenticate(username, password string) (*User, error) {
+	// Credentials are only kept hashed, and the NUL keeps "a"+"bc" and
+	// "ab"+"c" apart.
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.accepted[key]; ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.user, nil
+	}
+	if now.Before(c.retryAt) {
+		err := c.lastErr
+		c.mu.Unlock()
+		return nil, fmt.Errorf("backing off after provider error: %w", err)
+	}
+	c.mu.Unlock()
+
+	u, err := c.provider.Authenticate(username, password)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err == nil:
+		c.failures = 0
+		c.accepted[key] = cachedAuth{user: u, expires: now.Add(c.ttl)}
+		// Drop expired entries now and then so the cache can't grow forever.
+		if len(c.accepted)%1024 == 0 {
+			for k, entry := range c.accepted {
+				if now.After(entry.expires) {
+					delete(c.accepted, k)
+				}
+			}
+		}
+	case errors.Is(err, ErrInvalidCredentials):
+		c.failures = 0
+		delete(c.accepted, key)
+	default:
+		c.failures++
+		wait := c.backoff << min(c.failures-1, 16)
+		c.retryAt = now.Add(min(wait, maxAuthBackoff))
+		c.lastErr = err
+	}
+	return u, err
+}
+
+// HTTPAuthProvider checks credentials by POSTing {"username", "password"} as
+// JSON to URL. A 200 response accepts them and may name the user's key
+// namespace as {"namespace": "..."}; a 401 or 403 rejects them.
+type HTTPAuthProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+// Authenticate implements AuthProvider.
+func (h *HTTPAuthProvider) Authenticate(username, password string) (*User, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return nil, err
+	}
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result struct {
+			Namespace string `json:"namespace"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid auth provider response: %w", err)
+		}
+		return &User{Name: username, Enabled: true, Namespace: result.Namespace}, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidCredentials
+	}
+	return nil, fmt.Errorf("auth provider returned %s", resp.Status)
+}
@@ -0,0 +1,38 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// backup handles the BACKUP command, which replies with an RDB snapshot of
+// the dataset as a single bulk string, so backups can be pulled over the
+// network. The dataset is copied while the command holds the server lock,
+// which makes the snapshot consistent; encoding and sending the copy happen
+// after the lock is released, so a slow reader doesn't stall other clients.
+func backup(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	snapshot := snapshotStore(s)
+
+	send := func() {
+		// The bulk length must precede the payload, so it is encoded in full first.
+		var payload bytes.Buffer
+		if err := snapshot.WriteRDB(&payload); err != nil {
+			log.Printf("BACKUP failed: %v", err)
+			fmt.Fprintf(conn, "-ERR backup failed: %v\r\n", err)
+			return
+		}
+		fmt.Fprintf(conn, "$%d\r\n", payload.Len())
+		payload.WriteString("\r\n")
+		payload.WriteTo(conn)
+	}
+	if c := clientOf(conn); c != nil {
+		c.deferred = send
+		return
+	}
+	send()
+}
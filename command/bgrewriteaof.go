@@ -0,0 +1,33 @@
+package command
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// bgrewriteaof handles the BGREWRITEAOF command, which compacts the AOF: a
+// copy of the dataset, made while the command holds the server lock, is
+// written in the background as a new base file of one command per key, or
+// per batch of elements, with absolute expirations. Commands that run
+// meanwhile go to a new incremental file, and once the base file is
+// complete the manifest is replaced to list just the two, so the swap is
+// atomic and an interrupted rewrite loses nothing.
+func bgrewriteaof(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	st := a.Status()
+	if !st.Enabled {
+		fmt.Fprintf(conn, "-ERR The AOF is disabled, enable it with CONFIG SET appendonly yes\r\n")
+		return
+	}
+	if st.Rewriting {
+		fmt.Fprintf(conn, "-ERR Background append only file rewriting already in progress\r\n")
+		return
+	}
+	if err := a.Rewrite(); err != nil {
+		fmt.Fprintf(conn, "-ERR %v\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+Background append only file rewriting started\r\n")
+}
@@ -0,0 +1,146 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+)
+
+// Blocking commands can't wait while holding the server's command lock, so
+// they register a waiter on their keys, release the lock by returning, and
+// wait in the client's deferred work. Every write to a key wakes its waiters,
+// which then retry under the command lock; whoever gets there first is served
+// and the others go back to waiting.
+
+// serverLock is the server's command lock, and blockingAOF its AOF, set by
+// SetupBlocking.
+var (
+	serverLock  sync.Locker
+	blockingAOF *aof.AOF
+)
+
+// waiters maps each key to the wake-up channels of the clients blocked on it.
+var waiters = struct {
+	sync.Mutex
+	byKey map[string]map[chan struct{}]struct{}
+}{byKey: make(map[string]map[chan struct{}]struct{})}
+
+// livenessInterval is how often a blocked client's connection is checked, so
+// the waits of clients that disconnected are abandoned.
+const livenessInterval = time.Second
+
+// SetupBlocking enables blocking commands. lock must be the lock the server
+// holds around every command, and a the AOF whose write stream wakes waiters.
+func SetupBlocking(lock sync.Locker, a *aof.AOF) {
+	serverLock, blockingAOF = lock, a
+	a.AddFeed(wakeWaiters)
+}
+
+// addWaiter registers a wake-up channel for keys and returns it along with a
+// function that unregisters it.
+func addWaiter(keys []string) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	waiters.Lock()
+	for _, key := range keys {
+		if waiters.byKey[key] == nil {
+			waiters.byKey[key] = make(map[chan struct{}]struct{})
+		}
+		waiters.byKey[key][ch] = struct{}{}
+	}
+	waiters.Unlock()
+	return ch, func() {
+		waiters.Lock()
+		for _, key := range keys {
+			delete(waiters.byKey[key], ch)
+			if len(waiters.byKey[key]) == 0 {
+				delete(waiters.byKey, key)
+			}
+		}
+		waiters.Unlock()
+	}
+}
+
+// wakeWaiters is the write-stream feed that wakes the clients blocked on the
+// keys a command wrote. Commands without a known key layout wake nobody.
+func wakeWaiters(args []string) {
+	spec, ok := keySpecs[strings.ToUpper(args[0])]
+	if !ok {
+		return
+	}
+	waiters.Lock()
+	defer waiters.Unlock()
+	if len(waiters.byKey) == 0 {
+		return
+	}
+	for _, i := range spec.keyIndexes(args) {
+		for ch := range waiters.byKey[args[i]] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// parseTimeout parses a blocking command timeout in seconds, which may be
+// fractional; 0 means wait forever.
+func parseTimeout(arg string) (time.Duration, bool) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+// block makes c wait until try succeeds or timeout passes. try runs under the
+// server's command lock and reports whether it served the client; onTimeout
+// writes the reply for an expired wait. Without a client or blocking support,
+// or inside EXEC, the wait is treated as timed out immediately.
+func block(c *Client, keys []string, timeout time.Duration, try func() bool, onTimeout func()) {
+	if c == nil || serverLock == nil || c.inExec {
+		onTimeout()
+		return
+	}
+	// Register while still holding the command lock, so no write can slip
+	// in between the failed attempt and the registration.
+	wake, remove := addWaiter(keys)
+	c.deferred = func() {
+		defer remove()
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		check := time.NewTicker(livenessInterval)
+		defer check.Stop()
+		for {
+			select {
+			case <-wake:
+				// Don't take data on behalf of a client that has gone away.
+				if !c.alive() {
+					return
+				}
+				serverLock.Lock()
+				stop := holdReplies(c, blockingAOF)
+				served := try()
+				stop()
+				serverLock.Unlock()
+				c.releaseReplies()
+				if served {
+					return
+				}
+			case <-check.C:
+				if !c.alive() {
+					return
+				}
+			case <-expired:
+				onTimeout()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The BF.* commands follow RedisBloom's, so clients written for it work
+// unchanged. BF.SCANDUMP and BF.LOADCHUNK move a whole filter in a single
+// chunk, in this server's own encoding, and are what AOF rewrites recreate
+// filters with.
+
+// writeBloomResults writes one integer per item, 1 for true, and the error
+// for the items past those with results.
+func writeBloomResults(conn net.Conn, results []bool, n int, err error) {
+	fmt.Fprintf(conn, "*%d\r\n", n)
+	for _, ok := range results {
+		if ok {
+			fmt.Fprintf(conn, ":1\r\n")
+		} else {
+			fmt.Fprintf(conn, ":0\r\n")
+		}
+	}
+	for i := len(results); i < n; i++ {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	}
+}
+
+// persistBloomAdds logs the items a BF.ADD or BF.MADD added, as the others
+// left the filter unchanged.
+func persistBloomAdds(a *aof.AOF, key string, items []string, added []bool) {
+	persisted := []string{key}
+	for i, ok := range added {
+		if ok {
+			persisted = append(persisted, items[i])
+		}
+	}
+	if len(persisted) > 1 {
+		LogEffects(a, "BF.MADD", persisted...)
+	}
+}
+
+// bfreserve handles BF.RESERVE key error_rate capacity [EXPANSION expansion]
+// [NONSCALING].
+func bfreserve(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	errorRate, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		fmt.Fprintf(conn, "-ERR (0 < error rate range < 1)\r\n")
+		return
+	}
+	capacity, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || capacity <= 0 {
+		fmt.Fprintf(conn, "-ERR (capacity should be larger than 0)\r\n")
+		return
+	}
+	expansion, nonScaling := store.DefaultBloomExpansion, false
+	for i := 4; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "EXPANSION" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				fmt.Fprintf(conn, "-ERR expansion should be greater or equal to 1\r\n")
+				return
+			}
+			expansion = n
+			i++
+		case opt == "NONSCALING":
+			nonScaling = true
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+	if nonScaling {
+		expansion = 0
+	}
+	if err := s.BFReserve(args[1], errorRate, capacity, expansion); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "BF.RESERVE", args[1:]...)
+}
+
+// bfadd handles BF.ADD key item.
+func bfadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	added, err := s.BFAdd(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if added[0] {
+		fmt.Fprintf(conn, ":1\r\n")
+	} else {
+		fmt.Fprintf(conn, ":0\r\n")
+	}
+	persistBloomAdds(a, args[1], args[2:], added)
+}
+
+// bfmadd handles BF.MADD key item [item ...].
+func bfmadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	added, err := s.BFAdd(args[1], args[2:])
+	if err == store.ErrWrongType {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeBloomResults(conn, added, len(args)-2, err)
+	persistBloomAdds(a, args[1], args[2:], added)
+}
+
+// bfexists handles BF.EXISTS key item.
+func bfexists(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	found, err := s.BFExists(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if found[0] {
+		fmt.Fprintf(conn, ":1\r\n")
+	} else {
+		fmt.Fprintf(conn, ":0\r\n")
+	}
+}
+
+// bfmexists handles BF.MEXISTS key item [item ...].
+func bfmexists(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	found, err := s.BFExists(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeBloomResults(conn, found, len(found), nil)
+}
+
+// bfinfo handles BF.INFO key [CAPACITY|SIZE|FILTERS|ITEMS|EXPANSION],
+// replying with every property and its value, or the value of the one asked
+// for. The expansion of a non-scaling filter is null.
+func bfinfo(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	info, ok, err := s.BFInfo(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if !ok {
+		fmt.Fprintf(conn, "-ERR not found\r\n")
+		return
+	}
+	props := []struct {
+		option, name string
+		value        int64
+	}{
+		{"CAPACITY", "Capacity", info.Capacity},
+		{"SIZE", "Size", info.Size},
+		{"FILTERS", "Number of filters", int64(info.Filters)},
+		{"ITEMS", "Number of items inserted", info.Items},
+		{"EXPANSION", "Expansion rate", int64(info.Expansion)},
+	}
+	writeValue := func(option string, value int64) {
+		if option == "EXPANSION" && value == 0 {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return
+		}
+		fmt.Fprintf(conn, ":%d\r\n", value)
+	}
+	if len(args) == 3 {
+		for _, p := range props {
+			if strings.EqualFold(args[2], p.option) {
+				fmt.Fprintf(conn, "*1\r\n")
+				writeValue(p.option, p.value)
+				return
+			}
+		}
+		fmt.Fprintf(conn, "-ERR Invalid information value\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", 2*len(props))
+	for _, p := range props {
+		writeBulk(conn, p.name)
+		writeValue(p.option, p.value)
+	}
+}
+
+// bfscandump handles BF.SCANDUMP key iterator.
+func bfscandump(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	scanDump(args, conn, s.BFDump)
+}
+
+// bfloadchunk handles BF.LOADCHUNK key iterator data.
+func bfloadchunk(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	loadChunk(args, conn, a, s.BFLoad)
+}
+
+// scanDump handles the SCANDUMP command of a filter type, whose filters
+// dump serializes. Iterator 0 replies with 1 and the whole filter, and any
+// other with 0 and an empty chunk, which ends the dump.
+func scanDump(args []string, conn net.Conn, dump func(key string) ([]byte, bool, error)) {
+	iter, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || iter < 0 {
+		fmt.Fprintf(conn, "-ERR invalid iterator\r\n")
+		return
+	}
+	data, ok, err := dump(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if !ok {
+		fmt.Fprintf(conn, "-ERR not found\r\n")
+		return
+	}
+	if iter != 0 {
+		fmt.Fprintf(conn, "*2\r\n:0\r\n$0\r\n\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "*2\r\n:1\r\n")
+	writeBulk(conn, string(data))
+}
+
+// loadChunk handles the LOADCHUNK command of a filter type, restoring a
+// filter with load from the chunk SCANDUMP returned with that iterator.
+func loadChunk(args []string, conn net.Conn, a *aof.AOF, load func(key string, data []byte) error) {
+	if iter, err := strconv.ParseInt(args[2], 10, 64); err != nil || iter != 1 {
+		fmt.Fprintf(conn, "-ERR invalid iterator\r\n")
+		return
+	}
+	if err := load(args[1], []byte(args[3])); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, strings.ToUpper(args[0]), args[1:]...)
+}
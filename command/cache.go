@@ -0,0 +1,187 @@
+package command
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// cachedCommands are the read commands whose replies may be cached. They are
+// deterministic and cost time proportional to the size of the value, so a
+// read storm on a large key is where the cache pays off.
+var cachedCommands = map[string]bool{
+	"LRANGE":           true,
+	"SMEMBERS":         true,
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HVALS":            true,
+	"ZRANGE":           true,
+	"ZREVRANGE":        true,
+	"ZRANGEBYSCORE":    true,
+	"ZREVRANGEBYSCORE": true,
+	"ZRANGEBYLEX":      true,
+	"ZREVRANGEBYLEX":   true,
+}
+
+// cacheEntry is one cached reply.
+type cacheEntry struct {
+	reply []byte
+	keys  []string
+	// expires is when a key or hash field involved expires, after which the
+	// reply may be stale even though no write touched the key.
+	expires time.Time
+}
+
+// resultCache holds cached replies for keys matching the configured patterns.
+// Entries are dropped when the write stream touches one of their keys.
+var resultCache = struct {
+	sync.Mutex
+	patterns     []string
+	maxEntries   int
+	entries      map[string]*cacheEntry
+	byKey        map[string]map[string]struct{}
+	hits, misses int64
+}{}
+
+// EnableResultCache turns on reply caching for keys matching any of patterns,
+// holding at most maxEntries replies, or any number when it is not positive. Entries are invalidated from a's write
+// stream, so every write must go through a.
+func EnableResultCache(patterns []string, maxEntries int, a *aof.AOF) {
+	resultCache.Lock()
+	resultCache.patterns = patterns
+	resultCache.maxEntries = maxEntries
+	resultCache.entries = make(map[string]*cacheEntry)
+	resultCache.byKey = make(map[string]map[string]struct{})
+	resultCache.Unlock()
+	a.AddFeed(invalidateCached)
+}
+
+// cacheable reports whether the reply for keys may be cached.
+func cacheable(keys []string) bool {
+	if resultCache.entries == nil || len(keys) == 0 {
+		return false
+	}
+	for _, key := range keys {
+		matched := false
+		for _, pattern := range resultCache.patterns {
+			if store.MatchPattern(pattern, key) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingConn copies everything written to the connection into buf.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	r.buf.Write(b)
+	return r.Conn.Write(b)
+}
+
+// serveCached answers a cacheable command from the cache, or runs handler and
+// caches its reply. It reports false, without running anything, when the
+// command's keys are not covered by the cache.
+func serveCached(cmd string, args []string, conn net.Conn, s *store.Store, a *aof.AOF, handler commandHandler) bool {
+	var keys []string
+	for _, i := range keySpecs[cmd].keyIndexes(args) {
+		keys = append(keys, args[i])
+	}
+	// Replies depend on the RESP version, as maps are arrays under RESP2.
+	id := strconv.Itoa(protoOf(conn)) + "\x00" + cmd + "\x00" + strings.Join(args[1:], "\x00")
+
+	resultCache.Lock()
+	if !cacheable(keys) {
+		resultCache.Unlock()
+		return false
+	}
+	if e, ok := resultCache.entries[id]; ok {
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			resultCache.hits++
+			resultCache.Unlock()
+			conn.Write(e.reply)
+			return true
+		}
+		removeCached(id)
+	}
+	resultCache.misses++
+	resultCache.Unlock()
+
+	rec := &recordingConn{Conn: conn}
+	handler(args, rec, s, a)
+	if rec.buf.Len() == 0 || rec.buf.Bytes()[0] == '-' {
+		return true
+	}
+	e := &cacheEntry{reply: rec.buf.Bytes(), keys: keys}
+	for _, key := range keys {
+		if at := s.NextExpiration(key); !at.IsZero() && (e.expires.IsZero() || at.Before(e.expires)) {
+			e.expires = at
+		}
+	}
+
+	resultCache.Lock()
+	defer resultCache.Unlock()
+	if resultCache.maxEntries > 0 && len(resultCache.entries) >= resultCache.maxEntries {
+		// Evict an arbitrary entry; map iteration order is random enough.
+		for victim := range resultCache.entries {
+			removeCached(victim)
+			break
+		}
+	}
+	resultCache.entries[id] = e
+	for _, key := range keys {
+		if resultCache.byKey[key] == nil {
+			resultCache.byKey[key] = make(map[string]struct{})
+		}
+		resultCache.byKey[key][id] = struct{}{}
+	}
+	return true
+}
+
+// removeCached drops one entry. The caller must hold the cache lock.
+func removeCached(id string) {
+	e, ok := resultCache.entries[id]
+	if !ok {
+		return
+	}
+	delete(resultCache.entries, id)
+	for _, key := range e.keys {
+		delete(resultCache.byKey[key], id)
+		if len(resultCache.byKey[key]) == 0 {
+			delete(resultCache.byKey, key)
+		}
+	}
+}
+
+// invalidateCached is the write-stream feed that drops the entries involving
+// the keys a command wrote. Writes whose keys are unknown clear the cache.
+func invalidateCached(args []string) {
+	cmd := strings.ToUpper(args[0])
+	resultCache.Lock()
+	defer resultCache.Unlock()
+	spec, ok := keySpecs[cmd]
+	if !ok {
+		resultCache.entries = make(map[string]*cacheEntry)
+		resultCache.byKey = make(map[string]map[string]struct{})
+		return
+	}
+	for _, i := range spec.keyIndexes(args) {
+		for id := range resultCache.byKey[args[i]] {
+			removeCached(id)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Client holds the state of a single client connection. It embeds the network
+// connection, so handlers keep writing replies to it exactly as before, while
+// commands that need connection-scoped state can recover it with clientOf.
+type Client struct {
+	net.Conn
+	// ID is a unique, monotonically increasing connection identifier.
+	ID int64
+	// TraceID is an application-supplied identifier used to correlate the
+	// commands of this connection with the request that issued them.
+	TraceID string
+	// Name is the connection name set with CLIENT SETNAME.
+	Name string
+	// LibName and LibVer identify the client library, as reported by CLIENT SETINFO.
+	LibName string
+	LibVer  string
+	// noEvict and noTouch are set with CLIENT NO-EVICT and NO-TOUCH.
+	// noEvict keeps the client from being evicted by maxmemory-clients;
+	// noTouch keeps the client's lookups from counting as accesses of the
+	// keys.
+	noEvict bool
+	noTouch bool
+	// created is when the connection was accepted, and lastCmd the last
+	// command it sent, at lastActive.
+	created    time.Time
+	lastCmd    string
+	lastActive time.Time
+	// User is the ACL user the connection is authenticated as, or nil when
+	// it still has to AUTH.
+	User *User
+	// AuthProvider, when set, checks the credentials of AUTH instead of the
+	// ACL passwords. The server sets it from the listener's configuration.
+	AuthProvider AuthProvider
+	// deferred is work a handler left to run once the server's command lock
+	// is released, such as streaming a large reply.
+	deferred func()
+	// replicaPort is the listening port a replica announced with REPLCONF.
+	replicaPort string
+	// peeked holds bytes read off the connection by a liveness check, which
+	// Read returns before reading from the connection again.
+	peeked []byte
+	// proto is the RESP version negotiated with HELLO, 2 until then, and
+	// hints whether replies carry routing hints as RESP3 attributes.
+	proto int
+	hints bool
+	// replyBuf, when set, collects the replies written to the client
+	// instead of sending them.
+	replyBuf *bytes.Buffer
+	// holding is set while the replies written to the client are held in
+	// held until the AOF is fsynced past the command's writes, and release,
+	// when set, sends them once it is.
+	holding bool
+	held    []byte
+	release func()
+	// channels and patterns are the client's Pub/Sub subscriptions, guarded
+	// by the pubsub lock. Once the client has subscribed, its output goes
+	// through outbox.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	outbox   *outbox
+	// goroutine is the ID of the goroutine serving the connection, which
+	// the watchdog checks is still alive.
+	goroutine int64
+	// offline is the snapshot file selected with OFFLINE SELECT, which the
+	// client's reads are served from.
+	offline *offlineSnapshot
+	// prepared holds the commands registered with PREPARE by ID, the last
+	// of which was lastPrepared.
+	prepared     map[int64]*preparedCommand
+	lastPrepared int64
+	// tx is the open transaction between MULTI and EXEC, and inExec is set
+	// while EXEC runs its commands.
+	tx     *transaction
+	inExec bool
+	// watched maps the keys watched with WATCH to whether they existed
+	// then, and watchTouched is set once one is written to. Both are
+	// guarded by the watches lock.
+	watched      map[string]bool
+	watchTouched bool
+	// reply tracks the reply of the running command, for its statistics.
+	reply replyState
+	// aofOffset and replOffset are how far the AOF and the replication
+	// stream were written after the client's last write, which WAITAOF
+	// waits for.
+	aofOffset  int64
+	replOffset int64
+}
+
+// replyState tracks whether a command started its reply, and whether the
+// reply is an error.
+type replyState struct {
+	started, failed bool
+}
+
+// nextClientID is the last client ID handed out.
+var nextClientID int64
+
+// clients is the registry of connected clients, keyed by ID.
+var clients = struct {
+	sync.Mutex
+	byID map[int64]*Client
+}{byID: make(map[int64]*Client)}
+
+// NewClient wraps a newly accepted connection in a Client and registers it.
+func NewClient(conn net.Conn) *Client {
+	now := time.Now()
+	c := &Client{
+		Conn:       conn,
+		ID:         atomic.AddInt64(&nextClientID, 1),
+		User:       defaultUser(),
+		proto:      2,
+		created:    now,
+		lastActive: now,
+	}
+	registerConnection(c)
+	clients.Lock()
+	clients.byID[c.ID] = c
+	clients.Unlock()
+	return c
+}
+
+// Close unregisters the client and closes its connection.
+func (c *Client) Close() error {
+	clients.Lock()
+	delete(clients.byID, c.ID)
+	clients.Unlock()
+	c.unsubscribeAll()
+	c.stopMonitoring()
+	c.unwatchAll(nil)
+	if c.outbox != nil {
+		c.outbox.close()
+	}
+	return c.Conn.Close()
+}
+
+// Read reads from the connection, starting with any bytes a liveness check
+// already consumed. The server reads commands through the Client rather than
+// the raw connection so those bytes aren't lost.
+func (c *Client) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// Write sends a reply to the client, or collects it while replyBuf is set.
+func (c *Client) Write(p []byte) (int, error) {
+	if !c.reply.started {
+		c.reply = replyState{started: true, failed: len(p) > 0 && p[0] == '-'}
+	}
+	if c.replyBuf != nil {
+		return c.replyBuf.Write(p)
+	}
+	if c.holding {
+		c.held = append(c.held, p...)
+		return len(p), nil
+	}
+	if c.User != nil && len(c.User.Quotas) > 0 {
+		chargeQuotaBytes(c.User, len(p))
+	}
+	if c.outbox != nil {
+		return c.outbox.write(c, p)
+	}
+	return c.Conn.Write(p)
+}
+
+// alive reports whether the client is still connected. It must only be called
+// while the server isn't reading from the connection, such as during a
+// blocking command's wait; anything the client sent meanwhile is kept for Read.
+func (c *Client) alive() bool {
+	c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 512)
+	n, err := c.Conn.Read(buf)
+	c.peeked = append(c.peeked, buf[:n]...)
+	var netErr net.Error
+	return err == nil || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// RunDeferred sends the replies of the last command held until the AOF is
+// fsynced, then runs the work it deferred, if any. The server calls it after
+// releasing the command lock and before reading the next command, so
+// deferred replies still arrive in order.
+func (c *Client) RunDeferred() {
+	c.releaseReplies()
+	if fn := c.deferred; fn != nil {
+		c.deferred = nil
+		fn()
+	}
+}
+
+// releaseReplies sends the replies held until the AOF is fsynced, once it
+// is.
+func (c *Client) releaseReplies() {
+	if release := c.release; release != nil {
+		c.release = nil
+		release()
+	}
+}
+
+// connectedClients returns a snapshot of the registered clients ordered by ID.
+func connectedClients() []*Client {
+	clients.Lock()
+	list := make([]*Client, 0, len(clients.byID))
+	for _, c := range clients.byID {
+		list = append(list, c)
+	}
+	clients.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// namespace returns the key prefix the client is confined to, if any.
+func (c *Client) namespace() string {
+	if c.User == nil {
+		return ""
+	}
+	return c.User.Namespace
+}
+
+// listEntry formats the client as a CLIENT LIST line. Its flags are N for
+// a plain connection, or any of x for an open transaction, P for a Pub/Sub
+// subscriber, S for a replica, e for NO-EVICT and T for NO-TOUCH.
+func (c *Client) listEntry() string {
+	user := ""
+	if c.User != nil {
+		user = c.User.Name
+	}
+	pubsub.Lock()
+	sub, psub := len(c.channels), len(c.patterns)
+	pubsub.Unlock()
+	flags, multi := "", -1
+	if c.tx != nil {
+		flags += "x"
+		multi = len(c.tx.queued)
+	}
+	if sub+psub > 0 {
+		flags += "P"
+	}
+	if replicaOf(c) != nil {
+		flags += "S"
+	}
+	if c.noEvict {
+		flags += "e"
+	}
+	if c.noTouch {
+		flags += "T"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=%d multi=%d cmd=%s user=%s lib-name=%s lib-ver=%s",
+		c.ID, c.RemoteAddr(), c.LocalAddr(), c.Name, int64(now.Sub(c.created).Seconds()), int64(now.Sub(c.lastActive).Seconds()),
+		flags, sub, psub, multi, c.lastCmd, user, c.LibName, c.LibVer)
+}
+
+// clientOf returns the client state behind conn, or nil when the command is
+// not running on a server connection.
+func clientOf(conn net.Conn) *Client {
+	c, _ := conn.(*Client)
+	return c
+}
+
+// clientCmd handles the CLIENT command family.
+func clientCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR CLIENT is only available on client connections\r\n")
+		return
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "TRACEID":
+		// CLIENT TRACEID returns the current trace ID; CLIENT TRACEID <id> sets it
+		// and an empty id clears it.
+		switch len(args) {
+		case 2:
+			if c.TraceID == "" {
+				fmt.Fprintf(conn, "$-1\r\n")
+				return
+			}
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(c.TraceID), c.TraceID)
+		case 3:
+			// Trace IDs go into MONITOR lines, which they mustn't break.
+			if strings.ContainsAny(args[2], " \r\n") {
+				fmt.Fprintf(conn, "-ERR trace-id cannot contain spaces, newlines or special characters.\r\n")
+				return
+			}
+			c.TraceID = args[2]
+			fmt.Fprintf(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'client|traceid' command\r\n")
+		}
+	case "SETINFO":
+		if len(args) != 4 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'client|setinfo' command\r\n")
+			return
+		}
+		if strings.ContainsAny(args[3], " \r\n") {
+			fmt.Fprintf(conn, "-ERR %s cannot contain spaces, newlines or special characters.\r\n", args[2])
+			return
+		}
+		switch strings.ToUpper(args[2]) {
+		case "LIB-NAME":
+			c.LibName = args[3]
+		case "LIB-VER":
+			c.LibVer = args[3]
+		case "TRACE-ID":
+			c.TraceID = args[3]
+		default:
+			fmt.Fprintf(conn, "-ERR Unrecognized option '%s'\r\n", args[2])
+			return
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "ID":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'client|id' command\r\n")
+			return
+		}
+		fmt.Fprintf(conn, ":%d\r\n", c.ID)
+	case "GETNAME":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'client|getname' command\r\n")
+			return
+		}
+		if c.Name == "" {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return
+		}
+		writeBulk(conn, c.Name)
+	case "SETNAME":
+		// An empty name removes the connection's name.
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'client|setname' command\r\n")
+			return
+		}
+		if strings.ContainsFunc(args[2], func(r rune) bool { return r <= ' ' || r > '~' }) {
+			fmt.Fprintf(conn, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+			return
+		}
+		c.Name = args[2]
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "NO-EVICT", "NO-TOUCH":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'client|%s' command\r\n", strings.ToLower(args[1]))
+			return
+		}
+		var on bool
+		switch strings.ToUpper(args[2]) {
+		case "ON":
+			on = true
+		case "OFF":
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		if strings.EqualFold(args[1], "NO-EVICT") {
+			c.noEvict = on
+		} else {
+			c.noTouch = on
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "LIST":
+		// CLIENT LIST [ID id [id ...]] lists every client, or those given.
+		var ids map[int64]bool
+		if len(args) > 2 {
+			if !strings.EqualFold(args[2], "ID") || len(args) == 3 {
+				fmt.Fprintf(conn, "-ERR syntax error\r\n")
+				return
+			}
+			ids = make(map[int64]bool)
+			for _, arg := range args[3:] {
+				id, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || id <= 0 {
+					fmt.Fprintf(conn, "-ERR Invalid client ID\r\n")
+					return
+				}
+				ids[id] = true
+			}
+		}
+		var b strings.Builder
+		for _, other := range connectedClients() {
+			if ids != nil && !ids[other.ID] {
+				continue
+			}
+			b.WriteString(other.listEntry())
+			b.WriteString("\n")
+		}
+		list := b.String()
+		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(list), list)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,100 @@
+package command
+
+import (
+	"log"
+	"sync"
+)
+
+// Client eviction disconnects the clients whose buffers use the most memory
+// once all clients together use more than maxmemory-clients, as Redis does,
+// so a few slow subscribers or huge transactions can't take the server down.
+// Clients that set CLIENT NO-EVICT are never evicted, nor are replicas, whose
+// stream has a limit of its own. The buffers counted are the output waiting
+// for a subscriber and the commands of an open transaction.
+
+// clientEviction is the state of client eviction.
+var clientEviction struct {
+	sync.Mutex
+	// limit is maxmemory-clients, in bytes; zero disables client eviction.
+	limit int64
+	// evicted counts the clients evicted, for INFO.
+	evicted int64
+}
+
+// SetupClientEviction sets maxmemory-clients, in bytes. Zero disables client
+// eviction.
+func SetupClientEviction(limit int64) {
+	clientEviction.Lock()
+	defer clientEviction.Unlock()
+	clientEviction.limit = limit
+}
+
+// memory returns the bytes used by the buffers of c. The caller must hold
+// the server lock.
+func (c *Client) memory() int64 {
+	var n int64
+	if o := c.outbox; o != nil {
+		o.mu.Lock()
+		n += int64(len(o.buf))
+		o.mu.Unlock()
+	}
+	if c.tx != nil {
+		for _, q := range c.tx.queued {
+			for _, arg := range q.args {
+				n += int64(len(arg))
+			}
+		}
+	}
+	return n
+}
+
+// ClientEvictionCycle evicts clients, the largest first, until the clients
+// that may be evicted fit in maxmemory-clients together with the others. It
+// runs as a background cycle of the server, which must have called
+// SetupBlocking first, as it takes the server lock.
+func ClientEvictionCycle() {
+	clientEviction.Lock()
+	limit := clientEviction.limit
+	clientEviction.Unlock()
+	if limit == 0 {
+		return
+	}
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	var total int64
+	var candidates []*Client
+	var sizes []int64
+	for _, c := range connectedClients() {
+		n := c.memory()
+		total += n
+		if n > 0 && !c.noEvict && replicaOf(c) == nil {
+			candidates = append(candidates, c)
+			sizes = append(sizes, n)
+		}
+	}
+	for total > limit && len(candidates) > 0 {
+		largest := 0
+		for i := range candidates {
+			if sizes[i] > sizes[largest] {
+				largest = i
+			}
+		}
+		c := candidates[largest]
+		log.Printf("Evicting client %s using %d bytes, as clients use %d bytes over maxmemory-clients %d", c.RemoteAddr(), sizes[largest], total, limit)
+		c.Conn.Close()
+		total -= sizes[largest]
+		candidates = append(candidates[:largest], candidates[largest+1:]...)
+		sizes = append(sizes[:largest], sizes[largest+1:]...)
+		clientEviction.Lock()
+		clientEviction.evicted++
+		clientEviction.Unlock()
+	}
+}
+
+// evictedClients returns the number of clients evicted.
+func evictedClients() int64 {
+	clientEviction.Lock()
+	defer clientEviction.Unlock()
+	return clientEviction.evicted
+}
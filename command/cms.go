@@ -0,0 +1,174 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The CMS.* commands follow RedisBloom's, with CMS.SCANDUMP and
+// CMS.LOADCHUNK added to copy sketches the way Bloom and cuckoo filters are.
+
+// maxCMSCounters caps the counters of a sketch, width times depth.
+const maxCMSCounters = 1 << 28
+
+// cmsinitbydim handles CMS.INITBYDIM key width depth.
+func cmsinitbydim(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	width, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil || width == 0 || width > maxCMSCounters {
+		fmt.Fprintf(conn, "-CMS: invalid width\r\n")
+		return
+	}
+	depth, err := strconv.ParseUint(args[3], 10, 64)
+	if err != nil || depth == 0 || depth > maxCMSCounters/width {
+		fmt.Fprintf(conn, "-CMS: invalid depth\r\n")
+		return
+	}
+	initCMS(conn, s, a, args[1], width, depth)
+}
+
+// cmsinitbyprob handles CMS.INITBYPROB key error probability, sizing the
+// sketch so estimates overshoot by more than error times the total count
+// with at most the given probability.
+func cmsinitbyprob(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	errorRate, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		fmt.Fprintf(conn, "-CMS: invalid overestimation value\r\n")
+		return
+	}
+	probability, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || probability <= 0 || probability >= 1 {
+		fmt.Fprintf(conn, "-CMS: invalid prob value\r\n")
+		return
+	}
+	width, depth := store.CMSDimensions(errorRate, probability)
+	if width > maxCMSCounters/depth {
+		fmt.Fprintf(conn, "-CMS: invalid overestimation value\r\n")
+		return
+	}
+	initCMS(conn, s, a, args[1], width, depth)
+}
+
+// initCMS creates a sketch for CMS.INITBYDIM and CMS.INITBYPROB, which is
+// written to the AOF as the former.
+func initCMS(conn net.Conn, s *store.Store, a *aof.AOF, key string, width, depth uint64) {
+	if err := s.CMSInit(key, width, depth); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "CMS.INITBYDIM", key, strconv.FormatUint(width, 10), strconv.FormatUint(depth, 10))
+}
+
+// cmsincrby handles CMS.INCRBY key item increment [item increment ...],
+// replying with the new estimated count of each item.
+func cmsincrby(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args)%2 != 0 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'cms.incrby' command\r\n")
+		return
+	}
+	items := make([]string, 0, len(args)/2-1)
+	increments := make([]uint64, 0, len(args)/2-1)
+	for i := 2; i < len(args); i += 2 {
+		n, err := strconv.ParseUint(args[i+1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(conn, "-CMS: Cannot parse number\r\n")
+			return
+		}
+		items = append(items, args[i])
+		increments = append(increments, n)
+	}
+	counts, err := s.CMSIncrBy(args[1], items, increments)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeCounts(conn, counts)
+	LogEffects(a, "CMS.INCRBY", args[1:]...)
+}
+
+// cmsquery handles CMS.QUERY key item [item ...].
+func cmsquery(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	counts, err := s.CMSQuery(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeCounts(conn, counts)
+}
+
+// writeCounts writes estimated counts as an array of integers.
+func writeCounts(conn net.Conn, counts []uint64) {
+	fmt.Fprintf(conn, "*%d\r\n", len(counts))
+	for _, n := range counts {
+		fmt.Fprintf(conn, ":%d\r\n", n)
+	}
+}
+
+// cmsmerge handles CMS.MERGE destination numkeys source [source ...]
+// [WEIGHTS weight [weight ...]], replacing the counts of destination, which
+// must exist, with the weighted sum of those of the sources.
+func cmsmerge(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	srcs, weights, errMsg := parseCMSMerge(args[2:])
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-%s\r\n", errMsg)
+		return
+	}
+	if err := s.CMSMerge(args[1], srcs, weights); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "CMS.MERGE", args[1:]...)
+}
+
+// parseCMSMerge parses the arguments of CMS.MERGE after the destination,
+// returning the sources and their weights, which default to 1, or the error
+// reply (without the leading '-') for invalid ones.
+func parseCMSMerge(args []string) ([]string, []uint64, string) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys < 1 || numKeys > len(args)-1 {
+		return nil, nil, "CMS: invalid numkeys"
+	}
+	srcs, rest := args[1:1+numKeys], args[1+numKeys:]
+	weights := make([]uint64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if len(rest) > 0 {
+		if !strings.EqualFold(rest[0], "WEIGHTS") || len(rest) != 1+numKeys {
+			return nil, nil, "ERR syntax error"
+		}
+		for i, arg := range rest[1:] {
+			if weights[i], err = strconv.ParseUint(arg, 10, 64); err != nil {
+				return nil, nil, "CMS: invalid weight value"
+			}
+		}
+	}
+	return srcs, weights, ""
+}
+
+// cmsinfo handles CMS.INFO key.
+func cmsinfo(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	info, err := s.CMSInfo(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*6\r\n$5\r\nwidth\r\n:%d\r\n$5\r\ndepth\r\n:%d\r\n$5\r\ncount\r\n:%d\r\n",
+		info.Width, info.Depth, info.Count)
+}
+
+// cmsscandump handles CMS.SCANDUMP key iterator.
+func cmsscandump(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	scanDump(args, conn, s.CMSDump)
+}
+
+// cmsloadchunk handles CMS.LOADCHUNK key iterator data.
+func cmsloadchunk(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	loadChunk(args, conn, a, s.CMSLoad)
+}
@@ -0,0 +1,174 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// commandStat holds the statistics of a command since the server started,
+// or since CONFIG RESETSTAT.
+type commandStat struct {
+	calls int64
+	time  time.Duration
+	// rejected counts the calls refused before running, by access checks,
+	// and failed those that ran and replied with an error.
+	rejected int64
+	failed   int64
+	// histogram counts the calls by run time.
+	histogram latencyHistogram
+}
+
+// latencyBuckets is the number of buckets of a latencyHistogram.
+const latencyBuckets = 36
+
+// latencyHistogram counts run times in buckets growing exponentially:
+// bucket 0 counts those of up to 1µs and bucket i those over 2^(i-1)µs and
+// up to 2^iµs, the last one counting everything longer, over 9 hours.
+type latencyHistogram [latencyBuckets]int64
+
+// add counts a run time of d.
+func (h *latencyHistogram) add(d time.Duration) {
+	i := 0
+	if usec := d.Microseconds(); usec > 1 {
+		i = min(bits.Len64(uint64(usec-1)), latencyBuckets-1)
+	}
+	h[i]++
+}
+
+// percentile returns the upper bound, in microseconds, of the bucket the
+// p-th percentile of the calls falls in, or 0 if there were none.
+func (h *latencyHistogram) percentile(p float64) int64 {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	rank := int64(math.Ceil(p / 100 * float64(total)))
+	var seen int64
+	for i, n := range h {
+		seen += n
+		if n > 0 && seen >= rank {
+			return 1 << i
+		}
+	}
+	return 0
+}
+
+// commandStats holds the statistics of the commands clients ran, by name.
+var commandStats = struct {
+	sync.Mutex
+	byName map[string]*commandStat
+}{byName: make(map[string]*commandStat)}
+
+// statOf returns the statistics of cmd, with commandStats locked.
+func statOf(cmd string) *commandStat {
+	st := commandStats.byName[cmd]
+	if st == nil {
+		st = &commandStat{}
+		commandStats.byName[cmd] = st
+	}
+	return st
+}
+
+// ranCommand records a call of cmd that ran for d, and whether it failed.
+func ranCommand(cmd string, d time.Duration, failed bool) {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	st := statOf(cmd)
+	st.calls++
+	st.time += d
+	st.histogram.add(d)
+	if failed {
+		st.failed++
+	}
+}
+
+// rejectedCommand records a call of cmd refused before it ran.
+func rejectedCommand(cmd string) {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	statOf(cmd).rejected++
+}
+
+// resetStats zeroes the statistics CONFIG RESETSTAT resets.
+func resetStats(s *store.Store) {
+	commandStats.Lock()
+	commandStats.byName = make(map[string]*commandStat)
+	commandStats.Unlock()
+
+	resultCache.Lock()
+	resultCache.hits, resultCache.misses = 0, 0
+	resultCache.Unlock()
+
+	s.ResetKeyspaceStats()
+}
+
+// infoCommandStats renders the commandstats section, a line per command
+// called since the statistics were reset.
+func infoCommandStats(s *store.Store, a *aof.AOF) string {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	names := make([]string, 0, len(commandStats.byName))
+	for name := range commandStats.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		st := commandStats.byName[name]
+		usec := st.time.Microseconds()
+		perCall := 0.0
+		if st.calls > 0 {
+			perCall = float64(st.time) / float64(st.calls) / float64(time.Microsecond)
+		}
+		fmt.Fprintf(&b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			strings.ToLower(name), st.calls, usec, perCall, st.rejected, st.failed)
+	}
+	return b.String()
+}
+
+// calledCommands returns the names of the commands that ran since the
+// statistics were reset, sorted. The caller must hold the commandStats
+// lock.
+func calledCommands() []string {
+	var names []string
+	for name, st := range commandStats.byName {
+		if st.calls > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// latencyPercentiles are the percentiles INFO latencystats reports.
+var latencyPercentiles = []float64{50, 99, 99.9}
+
+// infoLatencyStats renders the latencystats section, the percentiles of the
+// run times of each command called since the statistics were reset.
+func infoLatencyStats(s *store.Store, a *aof.AOF) string {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	var b strings.Builder
+	for _, name := range calledCommands() {
+		st := commandStats.byName[name]
+		fmt.Fprintf(&b, "latency_percentiles_usec_%s:", strings.ToLower(name))
+		for i, p := range latencyPercentiles {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64), float64(st.histogram.percentile(p)))
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,440 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// configParam is a parameter that CONFIG GET and CONFIG SET can read and change
+// at runtime. check validates a value, against the rest of the configuration
+// too, without applying it, so CONFIG SET can check every value before
+// changing anything and CONFIG VALIDATE can report every problem; set only
+// fails if applying a valid value does. file, when set, returns the value as
+// the configuration file takes it, if that differs from what get returns.
+type configParam struct {
+	get   func(s *store.Store, a *aof.AOF) string
+	check func(s *store.Store, a *aof.AOF, value string) error
+	set   func(s *store.Store, a *aof.AOF, value string) error
+	file  func(s *store.Store, a *aof.AOF) string
+}
+
+// SetMaxMemory, when set by the server, changes maxmemory at runtime.
+var SetMaxMemory func(bytes int64)
+
+// ConnTimeouts and SetConnTimeouts, when set by the server, read and change
+// the handshake and command timeouts of connections.
+var (
+	ConnTimeouts    func() (handshake, command time.Duration)
+	SetConnTimeouts func(handshake, command time.Duration)
+)
+
+// ParseMemory parses a memory size such as "100mb", "1gb" or "4096" into bytes.
+func ParseMemory(v string) (int64, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			factor = u.factor
+			v = strings.TrimSuffix(v, u.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size '%s'", v)
+	}
+	return n * factor, nil
+}
+
+// configParams lists the runtime parameters by lowercase name.
+var configParams = map[string]configParam{
+	"appendonly": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			if a.Status().Enabled {
+				return "yes"
+			}
+			return "no"
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			if v := strings.ToLower(value); v != "yes" && v != "no" {
+				return fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			if strings.EqualFold(value, "yes") {
+				return a.Enable()
+			}
+			return a.Disable()
+		},
+	},
+	"appendfsync": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			return a.Fsync()
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			switch strings.ToLower(value) {
+			case aof.FsyncAlways, aof.FsyncEverySec, aof.FsyncNo:
+				return nil
+			}
+			return fmt.Errorf("argument must be 'always', 'everysec' or 'no'")
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			return a.SetFsync(strings.ToLower(value))
+		},
+	},
+	"dbfilename": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			return SnapshotFile
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			return CheckSnapshotFile(value)
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			SnapshotFile = value
+			return nil
+		},
+	},
+	"save": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			bgsave.Lock()
+			defer bgsave.Unlock()
+			return formatSaveRules(bgsave.rules)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			_, err := ParseSaveRules(value)
+			return err
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			rules, _ := ParseSaveRules(value)
+			bgsave.Lock()
+			bgsave.rules = rules
+			bgsave.Unlock()
+			return nil
+		},
+	},
+	"handshake-timeout": timeoutParam(func(handshake, command *time.Duration) *time.Duration { return handshake }),
+	"command-timeout":   timeoutParam(func(handshake, command *time.Duration) *time.Duration { return command }),
+	"maxmemory": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			memoryPressure.Lock()
+			defer memoryPressure.Unlock()
+			return strconv.FormatInt(memoryPressure.maxMemory, 10)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			n, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			if SetMaxMemory == nil {
+				return fmt.Errorf("maxmemory can't be changed at runtime")
+			}
+			memoryPressure.Lock()
+			defer memoryPressure.Unlock()
+			// With nothing to evict, a budget below the memory in use would
+			// only be exceeded from the start.
+			if n > 0 && n < memoryPressure.used {
+				return fmt.Errorf("below the memory in use (%d bytes)", memoryPressure.used)
+			}
+			if n == 0 && len(memoryPressure.watermarks) > 0 {
+				return fmt.Errorf("memory watermarks are percentages of it, so it can't be unlimited")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			n, _ := ParseMemory(value)
+			SetMaxMemory(n)
+			memoryPressure.Lock()
+			memoryPressure.maxMemory = n
+			memoryPressure.Unlock()
+			return nil
+		},
+	},
+	"maxmemory-clients": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			clientEviction.Lock()
+			defer clientEviction.Unlock()
+			return strconv.FormatInt(clientEviction.limit, 10)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			_, err := ParseMemory(value)
+			return err
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			n, _ := ParseMemory(value)
+			SetupClientEviction(n)
+			return nil
+		},
+	},
+	"slowlog-log-slower-than": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			slowlog.Lock()
+			defer slowlog.Unlock()
+			if slowlog.slowerThan < 0 {
+				return "-1"
+			}
+			return strconv.FormatInt(slowlog.slowerThan.Microseconds(), 10)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < -1 {
+				return fmt.Errorf("argument must be a number of microseconds or -1")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			slowlog.Lock()
+			maxLen := slowlog.maxLen
+			slowlog.Unlock()
+			SetupSlowlog(time.Duration(n)*time.Microsecond, maxLen)
+			return nil
+		},
+	},
+	"slowlog-max-len": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			slowlog.Lock()
+			defer slowlog.Unlock()
+			return strconv.Itoa(slowlog.maxLen)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				return fmt.Errorf("argument must be a non-negative integer")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			n, _ := strconv.Atoi(value)
+			slowlog.Lock()
+			slowerThan := slowlog.slowerThan
+			slowlog.Unlock()
+			SetupSlowlog(slowerThan, n)
+			return nil
+		},
+	},
+	"latency-monitor-threshold": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			latency.Lock()
+			defer latency.Unlock()
+			return strconv.FormatInt(latency.threshold.Milliseconds(), 10)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+				return fmt.Errorf("argument must be a number of milliseconds, or 0 to disable")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			latency.Lock()
+			latency.threshold = time.Duration(n) * time.Millisecond
+			latency.Unlock()
+			return nil
+		},
+	},
+	"watchdog-threshold": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			watchdog.Lock()
+			defer watchdog.Unlock()
+			return strconv.FormatInt(watchdog.threshold.Milliseconds(), 10)
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+				return fmt.Errorf("argument must be a number of milliseconds, or 0 to disable")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			watchdog.Lock()
+			period := watchdog.auditPeriod
+			watchdog.Unlock()
+			SetupWatchdog(time.Duration(n)*time.Millisecond, period)
+			return nil
+		},
+		// The server's flag takes a duration rather than milliseconds.
+		file: func(s *store.Store, a *aof.AOF) string {
+			watchdog.Lock()
+			defer watchdog.Unlock()
+			return watchdog.threshold.String()
+		},
+	},
+	"redact-commands": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			commands, _ := redactionRules()
+			return commands
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			_, keys := redactionRules()
+			SetupRedaction(splitList(value), splitList(keys))
+			return nil
+		},
+	},
+	"redact-keys": {
+		get: func(s *store.Store, a *aof.AOF) string {
+			_, keys := redactionRules()
+			return keys
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			commands, _ := redactionRules()
+			SetupRedaction(splitList(commands), splitList(value))
+			return nil
+		},
+	},
+}
+
+// timeoutParam returns the parameter of the connection timeout which field
+// picks, a duration such as "10s", or 0 to disable it.
+func timeoutParam(field func(handshake, command *time.Duration) *time.Duration) configParam {
+	return configParam{
+		get: func(s *store.Store, a *aof.AOF) string {
+			if ConnTimeouts == nil {
+				return "0s"
+			}
+			handshake, command := ConnTimeouts()
+			return field(&handshake, &command).String()
+		},
+		check: func(s *store.Store, a *aof.AOF, value string) error {
+			if d, err := time.ParseDuration(value); err != nil || d < 0 {
+				return fmt.Errorf("argument must be a duration such as '10s', or 0 to disable")
+			}
+			if SetConnTimeouts == nil {
+				return fmt.Errorf("connection timeouts can't be changed at runtime")
+			}
+			return nil
+		},
+		set: func(s *store.Store, a *aof.AOF, value string) error {
+			d, _ := time.ParseDuration(value)
+			handshake, command := ConnTimeouts()
+			*field(&handshake, &command) = d
+			SetConnTimeouts(handshake, command)
+			return nil
+		},
+	}
+}
+
+// splitList splits a comma-separated parameter value, which may be empty.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// config handles the CONFIG command family.
+func config(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		if len(args) < 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'config|get' command\r\n")
+			return
+		}
+		var names []string
+		for name := range configParams {
+			for _, pattern := range args[2:] {
+				if store.MatchPattern(strings.ToLower(pattern), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprint(conn, mapHeader(conn, len(names)))
+		for _, name := range names {
+			writeBulk(conn, name)
+			writeBulk(conn, configParams[name].get(s, a))
+		}
+	case "SET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'config|set' command\r\n")
+			return
+		}
+		// Every name and value is checked before anything is changed.
+		for i := 2; i < len(args); i += 2 {
+			param, ok := configParams[strings.ToLower(args[i])]
+			if !ok {
+				fmt.Fprintf(conn, "-ERR Unknown option or number of arguments for CONFIG SET - '%s'\r\n", args[i])
+				return
+			}
+			if param.check == nil {
+				continue
+			}
+			if err := param.check(s, a, args[i+1]); err != nil {
+				fmt.Fprintf(conn, "-ERR CONFIG SET failed (possibly related to argument '%s') - %v\r\n", args[i], err)
+				return
+			}
+		}
+		for i := 2; i < len(args); i += 2 {
+			name := strings.ToLower(args[i])
+			if err := configParams[name].set(s, a, args[i+1]); err != nil {
+				fmt.Fprintf(conn, "-ERR CONFIG SET failed (possibly related to argument '%s') - %v\r\n", args[i], err)
+				return
+			}
+			configChanged.Lock()
+			configChanged.names[name] = true
+			configChanged.Unlock()
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "VALIDATE":
+		// CONFIG VALIDATE name value [name value ...] checks values as
+		// CONFIG SET would, replying with every problem found, so a change
+		// can be vetted before it is made.
+		if len(args) < 4 || len(args)%2 != 0 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'config|validate' command\r\n")
+			return
+		}
+		var problems []string
+		for i := 2; i < len(args); i += 2 {
+			param, ok := configParams[strings.ToLower(args[i])]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("'%s': unknown option", args[i]))
+			case param.check != nil:
+				if err := param.check(s, a, args[i+1]); err != nil {
+					problems = append(problems, fmt.Sprintf("'%s': %v", args[i], err))
+				}
+			}
+		}
+		fmt.Fprintf(conn, "*%d\r\n", len(problems))
+		for _, p := range problems {
+			writeBulk(conn, p)
+		}
+	case "RESETSTAT":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'config|resetstat' command\r\n")
+			return
+		}
+		resetStats(s)
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "REWRITE":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'config|rewrite' command\r\n")
+			return
+		}
+		if ConfigFile == "" {
+			fmt.Fprintf(conn, "-ERR The server is running without a config file\r\n")
+			return
+		}
+		if err := rewriteConfigFile(ConfigFile, s, a); err != nil {
+			fmt.Fprintf(conn, "-ERR Rewriting config file: %v\r\n", err)
+			return
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
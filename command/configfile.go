@@ -0,0 +1,166 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// ConfigFile, when set by the server, is the configuration file it was
+// started with, which CONFIG REWRITE updates.
+var ConfigFile string
+
+// configChanged holds the names of the parameters changed by CONFIG SET,
+// which CONFIG REWRITE adds to the configuration file if it doesn't set
+// them.
+var configChanged = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// ConfigDirective is an option set by a configuration file.
+type ConfigDirective struct {
+	Name, Value string
+	// Line is the line of the file that sets it.
+	Line int
+}
+
+// ReadConfigFile reads the directives of a configuration file. Each line
+// sets an option, named as the server's flags name them, to the rest of the
+// line, which is double quoted, Go style, if it is empty or has spaces.
+// Blank lines and lines starting with # are skipped.
+func ReadConfigFile(path string) ([]ConfigDirective, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var directives []ConfigDirective
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		name, value, ok, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		if ok {
+			directives = append(directives, ConfigDirective{Name: name, Value: value, Line: lineNo})
+		}
+	}
+	return directives, scanner.Err()
+}
+
+// parseConfigLine parses a line of a configuration file, reporting whether
+// it sets an option.
+func parseConfigLine(line string) (name, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	name, value = line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, value = line[:i], strings.TrimSpace(line[i:])
+	}
+	if strings.HasPrefix(value, `"`) {
+		if value, err = strconv.Unquote(value); err != nil {
+			return "", "", false, fmt.Errorf("malformed quoted value for %s", name)
+		}
+	}
+	return strings.ToLower(name), value, true, nil
+}
+
+// formatConfigLine formats the line of a configuration file setting name
+// to value.
+func formatConfigLine(name, value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\"#") {
+		value = strconv.Quote(value)
+	}
+	return name + " " + value
+}
+
+// rewriteConfigFile updates the configuration file at path to the running
+// configuration: lines setting a runtime parameter get its current value,
+// parameters changed by CONFIG SET that the file doesn't set are appended,
+// and everything else is kept as it is. The file is replaced atomically.
+func rewriteConfigFile(path string, s *store.Store, a *aof.AOF) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	current := func(name string) string {
+		if param := configParams[name]; param.file != nil {
+			return param.file(s, a)
+		}
+		return configParams[name].get(s, a)
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	// An option set more than once takes its last value, so that line is
+	// updated and the earlier ones are dropped.
+	written := make(map[string]bool)
+	var kept []string
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := lines[i]
+		if name, _, ok, _ := parseConfigLine(line); ok {
+			if _, runtime := configParams[name]; runtime {
+				if written[name] {
+					continue
+				}
+				written[name] = true
+				line = formatConfigLine(name, current(name))
+			}
+		}
+		kept = append(kept, line)
+	}
+	slices.Reverse(kept)
+	lines = kept
+
+	configChanged.Lock()
+	var added []string
+	for name := range configChanged.names {
+		if !written[name] {
+			added = append(added, name)
+		}
+	}
+	configChanged.Unlock()
+	sort.Strings(added)
+	for _, name := range added {
+		lines = append(lines, formatConfigLine(name, current(name)))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if info, serr := os.Stat(path); serr == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+	_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The CF.* commands follow RedisBloom's, like the BF.* ones.
+
+// cfreserve handles CF.RESERVE key capacity [BUCKETSIZE n]
+// [MAXITERATIONS n] [EXPANSION n].
+func cfreserve(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args)%2 != 1 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'cf.reserve' command\r\n")
+		return
+	}
+	capacity, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || capacity < 2 || capacity > 1<<40 {
+		fmt.Fprintf(conn, "-ERR Bad capacity\r\n")
+		return
+	}
+	bucketSize, maxIterations, expansion := store.DefaultCuckooBucketSize, store.DefaultCuckooMaxIterations, store.DefaultCuckooExpansion
+	for i := 3; i < len(args); i += 2 {
+		n, err := strconv.Atoi(args[i+1])
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "BUCKETSIZE":
+			if err != nil || n < 1 || n > 255 {
+				fmt.Fprintf(conn, "-ERR Bad bucket size\r\n")
+				return
+			}
+			bucketSize = n
+		case "MAXITERATIONS":
+			if err != nil || n < 1 || n > 65535 {
+				fmt.Fprintf(conn, "-ERR Bad max iterations\r\n")
+				return
+			}
+			maxIterations = n
+		case "EXPANSION":
+			if err != nil || n < 0 || n > 32768 {
+				fmt.Fprintf(conn, "-ERR Bad expansion\r\n")
+				return
+			}
+			expansion = n
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+	if err := s.CFReserve(args[1], capacity, bucketSize, maxIterations, expansion); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "CF.RESERVE", args[1:]...)
+}
+
+// cfadd handles CF.ADD key item and CF.ADDNX key item, which doesn't add
+// an item that may already be in the filter.
+func cfadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	added, err := s.CFAdd(args[1], args[2], cmd == "CF.ADDNX")
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if !added {
+		fmt.Fprintf(conn, ":0\r\n")
+		return
+	}
+	fmt.Fprintf(conn, ":1\r\n")
+	LogEffects(a, "CF.ADD", args[1:]...)
+}
+
+// cfexists handles CF.EXISTS key item and CF.MEXISTS key item [item ...].
+func cfexists(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	counts, err := s.CFCount(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if cmd == "CF.MEXISTS" {
+		fmt.Fprintf(conn, "*%d\r\n", len(counts))
+	}
+	for _, n := range counts {
+		fmt.Fprintf(conn, ":%d\r\n", min(n, 1))
+	}
+}
+
+// cfcount handles CF.COUNT key item, replying with how many times the item
+// may have been added, less the times it was deleted.
+func cfcount(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	counts, err := s.CFCount(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", counts[0])
+}
+
+// cfdel handles CF.DEL key item, deleting one addition of the item.
+func cfdel(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	deleted, ok, err := s.CFDel(args[1], args[2])
+	switch {
+	case err != nil:
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	case !ok:
+		fmt.Fprintf(conn, "-ERR Not found\r\n")
+	case !deleted:
+		fmt.Fprintf(conn, ":0\r\n")
+	default:
+		fmt.Fprintf(conn, ":1\r\n")
+		LogEffects(a, "CF.DEL", args[1:]...)
+	}
+}
+
+// cfinfo handles CF.INFO key.
+func cfinfo(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	info, ok, err := s.CFInfo(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if !ok {
+		fmt.Fprintf(conn, "-ERR not found\r\n")
+		return
+	}
+	props := []struct {
+		name  string
+		value int64
+	}{
+		{"Size", info.Size},
+		{"Number of buckets", info.Buckets},
+		{"Number of filters", int64(info.Filters)},
+		{"Number of items inserted", info.Items},
+		{"Number of items deleted", info.Deletes},
+		{"Bucket size", int64(info.BucketSize)},
+		{"Expansion rate", int64(info.Expansion)},
+		{"Max iterations", int64(info.MaxIterations)},
+	}
+	fmt.Fprintf(conn, "*%d\r\n", 2*len(props))
+	for _, p := range props {
+		writeBulk(conn, p.name)
+		fmt.Fprintf(conn, ":%d\r\n", p.value)
+	}
+}
+
+// cfscandump handles CF.SCANDUMP key iterator.
+func cfscandump(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	scanDump(args, conn, s.CFDump)
+}
+
+// cfloadchunk handles CF.LOADCHUNK key iterator data.
+func cfloadchunk(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	loadChunk(args, conn, a, s.CFLoad)
+}
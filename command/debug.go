@@ -0,0 +1,433 @@
+package command
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// writeCommands lists the commands that modify the dataset and are therefore
+// propagated to the AOF and to standbys.
+var writeCommands = map[string]bool{
+	"SET": true, "SETSEALED": true, "DEL": true, "EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true, "PERSIST": true,
+	"INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true,
+	"FLUSHALL": true, "FLUSHDB": true,
+	"LPUSH": true, "LPOP": true, "RPUSH": true, "RPOP": true,
+	"SADD": true, "SREM": true, "SMOVE": true,
+	"HSET": true, "HSETNX": true, "HDEL": true,
+	"HEXPIRE": true, "HPEXPIRE": true, "HEXPIREAT": true, "HPEXPIREAT": true, "HPERSIST": true,
+	"ZADD": true, "ZREM": true, "ZREMRANGEBYSCORE": true, "ZREMRANGEBYLEX": true, "ZINCRBY": true,
+	"ZRANGESTORE": true, "ZPOPMIN": true, "ZPOPMAX": true, "BZPOPMIN": true, "BZPOPMAX": true,
+	"XADD": true, "XSETID": true,
+	"GEOADD": true, "GEOSEARCHSTORE": true,
+	"BF.RESERVE": true, "BF.ADD": true, "BF.MADD": true, "BF.LOADCHUNK": true,
+	"CF.RESERVE": true, "CF.ADD": true, "CF.ADDNX": true, "CF.DEL": true, "CF.LOADCHUNK": true,
+	"CMS.INITBYDIM": true, "CMS.INITBYPROB": true, "CMS.INCRBY": true, "CMS.MERGE": true, "CMS.LOADCHUNK": true,
+	"TOPK.RESERVE": true, "TOPK.ADD": true, "TOPK.INCRBY": true, "TOPK.LOADCHUNK": true,
+	"JSON.SET": true, "JSON.DEL": true, "JSON.FORGET": true, "JSON.NUMINCRBY": true,
+	"JSON.ARRAPPEND": true, "JSON.ARRINSERT": true,
+	"TS.CREATE": true, "TS.ADD": true, "TS.MADD": true, "TS.DEL": true,
+	"TS.CREATERULE": true, "TS.DELETERULE": true, "TS.LOADCHUNK": true,
+	"FT.DROPINDEX": true,
+	"DELAYPUSH":    true,
+}
+
+// commandComplexity gives the time complexity of each command, as documented
+// by Redis. N is the size of the value (or keyspace), M the number of
+// elements returned or removed, and K the number of arguments. Commands not
+// listed are O(1).
+var commandComplexity = map[string]string{
+	"DEL":              "O(K)",
+	"EXISTS":           "O(K)",
+	"FLUSHALL":         "O(N)",
+	"FLUSHDB":          "O(N)",
+	"BACKUP":           "O(N)",
+	"SAVE":             "O(N)",
+	"BGSAVE":           "O(N) to copy the dataset, then in the background",
+	"BGREWRITEAOF":     "O(N) to copy the dataset, then in the background",
+	"TTLSWEEP":         "O(1) to start, O(N) in the background",
+	"TTLREPORT":        "O(N)",
+	"MIGRATION":        "O(1) to start, O(N) in the background",
+	"STATS":            "O(S), S being the number of shards",
+	"PUBLISH":          "O(N+M), N being the channel's subscribers and M the subscribed patterns",
+	"PUBSUB":           "O(N), N being the active channels or the channels asked about",
+	"SCAN":             "O(1) per call, O(N) for a full iteration",
+	"LPUSH":            "O(K)",
+	"RPUSH":            "O(K)",
+	"LRANGE":           "O(N)",
+	"SADD":             "O(K)",
+	"SREM":             "O(K)",
+	"SMEMBERS":         "O(N)",
+	"SSCAN":            "O(N)",
+	"HSET":             "O(1), O(N) while the hash uses the compact encoding",
+	"HGETALL":          "O(N)",
+	"HKEYS":            "O(N)",
+	"HVALS":            "O(N)",
+	"HSCAN":            "O(N)",
+	"HDEL":             "O(K)",
+	"HEXPIRE":          "O(K)",
+	"HPEXPIRE":         "O(K)",
+	"HEXPIREAT":        "O(K)",
+	"HPEXPIREAT":       "O(K)",
+	"HTTL":             "O(K)",
+	"HPTTL":            "O(K)",
+	"HPERSIST":         "O(K)",
+	"ZADD":             "O(K log(N))",
+	"ZREM":             "O(K log(N))",
+	"ZRANGE":           "O(log(N)+M)",
+	"ZREVRANGE":        "O(log(N)+M)",
+	"ZRANGEBYSCORE":    "O(log(N)+M)",
+	"ZREVRANGEBYSCORE": "O(log(N)+M)",
+	"ZCOUNT":           "O(log(N))",
+	"ZREMRANGEBYSCORE": "O(log(N)+M)",
+	"ZRANGEBYLEX":      "O(log(N)+M)",
+	"ZREVRANGEBYLEX":   "O(log(N)+M)",
+	"ZLEXCOUNT":        "O(log(N))",
+	"ZREMRANGEBYLEX":   "O(log(N)+M)",
+	"ZRANK":            "O(log(N))",
+	"ZREVRANK":         "O(log(N))",
+	"ZINCRBY":          "O(log(N))",
+	"ZSCAN":            "O(N)",
+	"ZMSCORE":          "O(K)",
+	"ZRANDMEMBER":      "O(M log(N))",
+	"ZRANGESTORE":      "O(log(N)+M)",
+	"ZPOPMIN":          "O(log(N)*M)",
+	"ZPOPMAX":          "O(log(N)*M)",
+	"GEOADD":           "O(K log(N))",
+	"GEOPOS":           "O(K log(N))",
+	"GEODIST":          "O(log(N))",
+	"GEOSEARCH":        "O(N+log(M)), N being the places in the searched cells and M the places in the set",
+	"GEOSEARCHSTORE":   "O(N+log(M)), N being the places in the searched cells and M the places in the set",
+	"BF.MADD":          "O(K*F), F being the number of sub-filters",
+	"BF.MEXISTS":       "O(K*F), F being the number of sub-filters",
+	"BF.SCANDUMP":      "O(N), N being the size of the filter",
+	"BF.LOADCHUNK":     "O(N), N being the size of the filter",
+	"CF.ADD":           "O(K), K being the kicks allowed by MAXITERATIONS",
+	"CF.MEXISTS":       "O(K*F), F being the number of sub-filters",
+	"CF.SCANDUMP":      "O(N), N being the size of the filter",
+	"CF.LOADCHUNK":     "O(N), N being the size of the filter",
+	"CMS.INITBYDIM":    "O(W*D), W and D being the width and depth",
+	"CMS.INITBYPROB":   "O(W*D), W and D being the width and depth",
+	"CMS.INCRBY":       "O(K*D), D being the depth",
+	"CMS.QUERY":        "O(K*D), D being the depth",
+	"CMS.MERGE":        "O(K*W*D), K being the number of sources",
+	"CMS.SCANDUMP":     "O(W*D), W and D being the width and depth",
+	"CMS.LOADCHUNK":    "O(W*D), W and D being the width and depth",
+	"BZPOPMIN":         "O(log(N))",
+	"XRANGE":           "O(log(N)+M)",
+	"XREVRANGE":        "O(log(N)+M)",
+	"XREAD":            "O(K*log(N)+M)",
+	"BZPOPMAX":         "O(log(N))",
+	"ACL":              "O(N) in the number of users",
+	"TOPK.RESERVE":     "O(W*D), W and D being the width and depth",
+	"TOPK.ADD":         "O(K*(D+log(T))), T being the size of the list",
+	"TOPK.INCRBY":      "O(K*(D*I+log(T))), I being the increment and T the size of the list",
+	"TOPK.COUNT":       "O(K*D), D being the depth",
+	"TOPK.LIST":        "O(T*log(T)), T being the size of the list",
+	"TOPK.SCANDUMP":    "O(W*D+T), W and D being the width and depth",
+	"TOPK.LOADCHUNK":   "O(W*D+T), W and D being the width and depth",
+	"JSON.SET":         "O(M+N), M being the size of the value and N the values the path matches",
+	"JSON.GET":         "O(N), N being the size of the values returned",
+	"JSON.DEL":         "O(N), N being the size of the document",
+	"JSON.FORGET":      "O(N), N being the size of the document",
+	"JSON.NUMINCRBY":   "O(N), N being the values the path matches",
+	"JSON.ARRAPPEND":   "O(K*N), N being the arrays the path matches",
+	"JSON.ARRINSERT":   "O(K*N+L), N being the arrays the path matches and L their length",
+	"JSON.ARRLEN":      "O(N), N being the values the path matches",
+	"JSON.TYPE":        "O(N), N being the values the path matches",
+	"JSON.RESP":        "O(N), N being the size of the values returned",
+	"TS.CREATE":        "O(1)",
+	"TS.ADD":           "O(M), M being the number of rules",
+	"TS.MADD":          "O(K*M), M being the number of rules",
+	"TS.DEL":           "O(N)",
+	"TS.GET":           "O(1)",
+	"TS.RANGE":         "O(log(N)+M)",
+	"TS.REVRANGE":      "O(log(N)+M)",
+	"TS.MRANGE":        "O(N), N being the number of keys",
+	"TS.MREVRANGE":     "O(N), N being the number of keys",
+	"TS.CREATERULE":    "O(1)",
+	"TS.DELETERULE":    "O(M), M being the number of rules",
+	"TS.INFO":          "O(L+M), L being the number of labels and M of rules",
+	"TS.SCANDUMP":      "O(N)",
+	"TS.LOADCHUNK":     "O(N)",
+	"FT.CREATE":        "O(N) in the number of hashes indexed",
+	"FT.SEARCH":        "O(N+M*log(M)), N being the candidates checked and M the matches",
+	"FT.DROPINDEX":     "O(1), or O(N) in the number of documents with DD",
+	"FT.INFO":          "O(N) in the number of keys written since the last query",
+	"FT._LIST":         "O(N) in the number of indexes",
+	"FT.TAGVALS":       "O(N) in the number of distinct tags",
+	"MODULE":           "O(N) in the number of loaded modules",
+	"HSCHEMA":          "O(N) in the number of schemas",
+	"EXEC":             "O(N), N being the commands queued",
+	"WATCH":            "O(1) for every key",
+	"DELAYPUSH":        "O(log(N))",
+	"CLIENT":           "O(N) in the number of clients",
+	"SLOWLOG":          "O(M)",
+	"LATENCY":          "O(N) in the number of samples returned",
+	"DEBUG":            "depends on the subcommand",
+	"EVAL":             "depends on the script",
+	"EVALSHA":          "depends on the script",
+	"EVAL_RO":          "depends on the script",
+	"EVALSHA_RO":       "depends on the script",
+	"SCRIPT":           "O(N) in the number of scripts",
+	"FUNCTION":         "O(N) in the number of functions",
+	"FCALL":            "depends on the function",
+	"FCALL_RO":         "depends on the function",
+}
+
+// DEBUG and EXPLAIN look up other commands in Handlers, so they are
+// registered here rather than in its initializer.
+func init() {
+	Handlers["DEBUG"] = debug
+	Handlers["EXPLAIN"] = explain
+}
+
+// EnableDebugCommand, set by the server, is whether the DEBUG subcommands
+// meant for operational testing, which can stall the server or change how it
+// behaves, may be run: "yes", "no", or "local" for connections from the
+// loopback interface only.
+var EnableDebugCommand = "no"
+
+// activeExpireOff is set by DEBUG SET-ACTIVE-EXPIRE 0 to stop the background
+// expiration of keys, leaving expired keys to be removed on access.
+var activeExpireOff atomic.Bool
+
+// ActiveExpireEnabled reports whether the server should expire keys in the
+// background.
+func ActiveExpireEnabled() bool {
+	return !activeExpireOff.Load()
+}
+
+// debugTesting lists the DEBUG subcommands gated by EnableDebugCommand.
+var debugTesting = map[string]bool{
+	"SLEEP": true, "OBJECT": true, "SET-ACTIVE-EXPIRE": true, "JMAP": true, "STRINGMATCH-LEN": true,
+}
+
+// debugAllowed reports whether conn may run the gated DEBUG subcommands.
+func debugAllowed(conn net.Conn) bool {
+	switch EnableDebugCommand {
+	case "yes":
+		return true
+	case "local":
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.IP.IsLoopback()
+		}
+		// Unix sockets and in-process connections are local.
+		return true
+	}
+	return false
+}
+
+// debug handles the DEBUG command family.
+func debug(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	sub := strings.ToUpper(args[1])
+	if debugTesting[sub] && !debugAllowed(conn) {
+		fmt.Fprintf(conn, "-ERR DEBUG %s not allowed. Start the server with -enable-debug-command set to 'yes', or to 'local' to run it from local connections\r\n", sub)
+		return
+	}
+	switch sub {
+	case "COMMANDPATH":
+		explainCommand(args[2:], conn)
+	case "SHARDS":
+		debugShards(conn, s)
+	case "RANDOM-SEED":
+		// DEBUG RANDOM-SEED <seed> makes randomized replies repeatable.
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'debug|random-seed' command\r\n")
+			return
+		}
+		seed, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+			return
+		}
+		store.Seed(seed)
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "SLEEP":
+		// DEBUG SLEEP <seconds> blocks the connection, to simulate a slow
+		// command. Fractions of a second are allowed.
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'debug|sleep' command\r\n")
+			return
+		}
+		secs, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || secs < 0 {
+			fmt.Fprintf(conn, "-ERR value is not a valid float\r\n")
+			return
+		}
+		time.Sleep(time.Duration(secs * float64(time.Second)))
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "OBJECT":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'debug|object' command\r\n")
+			return
+		}
+		debugObject(conn, s, args[2])
+	case "SET-ACTIVE-EXPIRE":
+		// DEBUG SET-ACTIVE-EXPIRE 0|1 stops or resumes background expiration.
+		if len(args) != 3 || (args[2] != "0" && args[2] != "1") {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		activeExpireOff.Store(args[2] == "0")
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "JMAP":
+		debugJmap(conn)
+	case "STRINGMATCH-LEN":
+		debugStringMatch(conn)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// debugShards replies with one line per store shard giving its key count,
+// lookups, contended lock acquisitions, total lock wait and sampled hot keys,
+// to check that keys are spread evenly and to find contended shards.
+func debugShards(conn net.Conn, s *store.Store) {
+	stats := s.ShardStats()
+	fmt.Fprintf(conn, "*%d\r\n", len(stats))
+	for i, st := range stats {
+		hot := make([]string, len(st.HotKeys))
+		for j, hk := range st.HotKeys {
+			hot[j] = fmt.Sprintf("%s:%d", hk.Key, hk.Samples)
+		}
+		writeBulk(conn, fmt.Sprintf("shard=%d keys=%d ops=%d contended=%d lock_wait_usec=%d hot=%s",
+			i, st.Keys, st.Ops, st.Contended, st.LockWait.Microseconds(), strings.Join(hot, ",")))
+	}
+}
+
+// debugObject replies with a line describing how key is stored, without
+// counting as an access to it.
+func debugObject(conn net.Conn, s *store.Store, key string) {
+	info, ok := s.Object(key)
+	if !ok {
+		fmt.Fprintf(conn, "-ERR no such key\r\n")
+		return
+	}
+	ttl := int64(-1)
+	if !info.Expiration.IsZero() {
+		ttl = max(time.Until(info.Expiration).Milliseconds(), 0)
+	}
+	idle := int64(-1)
+	if info.Idle >= 0 {
+		idle = int64(info.Idle.Seconds())
+	}
+	cold := 0
+	if info.Cold {
+		cold = 1
+	}
+	fmt.Fprintf(conn, "+type:%s encoding:%s serializedlength:%d lru_seconds_idle:%d pttl:%d cold:%d\r\n",
+		info.Type, info.Encoding, info.SerializedLength, idle, ttl, cold)
+}
+
+// debugJmap replies with a summary of the Go heap, the counterpart of a JVM
+// heap map, after a garbage collection so that it only counts live objects.
+func debugJmap(conn net.Conn) {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var b strings.Builder
+	fmt.Fprintf(&b, "heap_alloc:%d\r\n", m.HeapAlloc)
+	fmt.Fprintf(&b, "heap_inuse:%d\r\n", m.HeapInuse)
+	fmt.Fprintf(&b, "heap_idle:%d\r\n", m.HeapIdle)
+	fmt.Fprintf(&b, "heap_released:%d\r\n", m.HeapReleased)
+	fmt.Fprintf(&b, "heap_objects:%d\r\n", m.HeapObjects)
+	fmt.Fprintf(&b, "stack_inuse:%d\r\n", m.StackInuse)
+	fmt.Fprintf(&b, "sys:%d\r\n", m.Sys)
+	fmt.Fprintf(&b, "num_gc:%d\r\n", m.NumGC)
+	fmt.Fprintf(&b, "goroutines:%d\r\n", runtime.NumGoroutine())
+	writeBulk(conn, b.String())
+}
+
+// debugStringMatch matches random patterns against random strings, as Redis'
+// DEBUG STRINGMATCH-LEN does, to check that the glob matcher neither panics
+// nor hangs on malformed or pathological input.
+func debugStringMatch(conn net.Conn) {
+	const iterations = 100000
+	random := func() string {
+		b := make([]byte, rand.IntN(32))
+		for i := range b {
+			b[i] = byte(rand.IntN(256))
+		}
+		return string(b)
+	}
+	for range iterations {
+		store.MatchPattern(random(), random())
+	}
+	fmt.Fprintf(conn, "+Apparently the server did not crash: test passed\r\n")
+}
+
+// explain handles EXPLAIN <command> [args...], a shorthand for DEBUG COMMANDPATH.
+func explain(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	explainCommand(args[1:], conn)
+}
+
+// explainCommand reports, without running it, how a command line would be
+// executed for the calling client: the handler, the keys it would touch after
+// namespace rewriting, their cluster slots, the ACL decision, the complexity
+// class and whether the command is propagated.
+func explainCommand(line []string, conn net.Conn) {
+	if len(line) == 0 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'debug|commandpath' command\r\n")
+		return
+	}
+	cmd := strings.ToUpper(line[0])
+	handler, ok := Handlers[cmd]
+	if !ok {
+		fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		return
+	}
+
+	args, decision := line, "allowed"
+	if c := clientOf(conn); c != nil {
+		var denied string
+		if args, denied = checkAccess(c, cmd, line); denied != "" {
+			decision = "denied: " + denied
+		}
+	}
+	var keys []string
+	if spec, ok := keySpecs[cmd]; ok {
+		for _, i := range spec.keyIndexes(args) {
+			keys = append(keys, args[i])
+		}
+	}
+	complexity, ok := commandComplexity[cmd]
+	if !ok {
+		complexity = "O(1)"
+	}
+	propagated := "no"
+	if writeCommands[cmd] {
+		propagated = "yes"
+	}
+
+	fmt.Fprintf(conn, "*14\r\n")
+	writeBulk(conn, "command")
+	writeBulk(conn, strings.ToLower(cmd))
+	writeBulk(conn, "handler")
+	writeBulk(conn, runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name())
+	writeBulk(conn, "keys")
+	fmt.Fprintf(conn, "*%d\r\n", len(keys))
+	for _, key := range keys {
+		writeBulk(conn, key)
+	}
+	writeBulk(conn, "slots")
+	fmt.Fprintf(conn, "*%d\r\n", len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(conn, ":%d\r\n", keyHashSlot(key))
+	}
+	writeBulk(conn, "acl")
+	writeBulk(conn, decision)
+	writeBulk(conn, "complexity")
+	writeBulk(conn, complexity)
+	writeBulk(conn, "propagated")
+	writeBulk(conn, propagated)
+}
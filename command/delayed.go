@@ -0,0 +1,176 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Delayed pushes deliver a job to a queue, a list, once its time comes,
+// sparing clients the ZRANGEBYSCORE and ZREM polling they'd otherwise run
+// against a sorted set of their own. DELAYPUSH adds the job to a hidden
+// sorted set next to the queue, scored by its due time, and a background
+// mover pushes the jobs that are due onto the end of the queue in one step.
+// Both go through the AOF as plain ZADD, ZREM and RPUSH commands, so pending
+// jobs survive restarts.
+
+// delayedPrefix prefixes the key of the sorted set holding the pending jobs
+// of a queue.
+const delayedPrefix = "__delayed__:"
+
+// delayedInterval is how often the mover looks for jobs that are due, and
+// delayedBatch the most jobs it moves to one queue at a time.
+const (
+	delayedInterval = 100 * time.Millisecond
+	delayedBatch    = 1000
+)
+
+// delayedQueues holds the queues that may have pending jobs, which the mover
+// checks. Queues are dropped once their jobs are all delivered.
+var delayedQueues = struct {
+	sync.Mutex
+	keys    map[string]struct{}
+	started bool
+}{keys: make(map[string]struct{})}
+
+// lastDelayedID is the ID of the last job pushed. IDs keep jobs with the same
+// payload apart in the sorted set and deliver jobs due at the same time in
+// the order they were pushed.
+var lastDelayedID atomic.Int64
+
+// delayedKey returns the key of the sorted set of a queue's pending jobs.
+func delayedKey(queue string) string {
+	return delayedPrefix + queue
+}
+
+// nextDelayedID returns a job ID greater than any before it, from the clock
+// so IDs keep increasing across restarts.
+func nextDelayedID() int64 {
+	for {
+		last := lastDelayedID.Load()
+		id := max(time.Now().UnixNano(), last+1)
+		if lastDelayedID.CompareAndSwap(last, id) {
+			return id
+		}
+	}
+}
+
+// SetupDelayedQueues starts the mover delivering delayed jobs, finding the
+// queues with pending jobs in s. It must be called once the AOF was loaded.
+func SetupDelayedQueues(s *store.Store, a *aof.AOF) {
+	delayedQueues.Lock()
+	defer delayedQueues.Unlock()
+	for cursor := 0; ; {
+		var keys []string
+		keys, cursor = s.Scan(cursor, 1000, delayedPrefix+"*", "zset")
+		for _, key := range keys {
+			delayedQueues.keys[strings.TrimPrefix(key, delayedPrefix)] = struct{}{}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if !delayedQueues.started {
+		delayedQueues.started = true
+		go runDelayedMover(s, a)
+	}
+}
+
+// runDelayedMover delivers due jobs every delayedInterval.
+func runDelayedMover(s *store.Store, a *aof.AOF) {
+	for range time.Tick(delayedInterval) {
+		delayedQueues.Lock()
+		queues := make([]string, 0, len(delayedQueues.keys))
+		for queue := range delayedQueues.keys {
+			queues = append(queues, queue)
+		}
+		delayedQueues.Unlock()
+		for _, queue := range queues {
+			serverLock.Lock()
+			pending := moveDueJobs(s, a, queue, time.Now())
+			serverLock.Unlock()
+			if pending == 0 {
+				delayedQueues.Lock()
+				delete(delayedQueues.keys, queue)
+				delayedQueues.Unlock()
+			}
+		}
+	}
+}
+
+// moveDueJobs pushes the jobs of a queue due by now onto it and returns the
+// number of jobs still pending. The caller must hold the command lock, so
+// that clients see the jobs move at once.
+func moveDueJobs(s *store.Store, a *aof.AOF, queue string, now time.Time) int {
+	key := delayedKey(queue)
+	for {
+		due, err := s.ZRangeByScore(key, store.ScoreBound{Value: math.Inf(-1)},
+			store.ScoreBound{Value: float64(now.UnixMilli())}, false, 0, delayedBatch)
+		if err != nil {
+			log.Printf("Delayed jobs of queue '%s' can't be delivered: %v", queue, err)
+			return 0
+		}
+		if len(due) == 0 {
+			break
+		}
+		members := make([]string, len(due))
+		payloads := make([]string, len(due))
+		for i, m := range due {
+			members[i] = m.Member
+			_, payloads[i], _ = strings.Cut(m.Member, ":")
+		}
+		s.ZRem(key, members)
+		s.Rpush(queue, payloads)
+		LogEffects(a, "ZREM", append([]string{key}, members...)...)
+		LogEffects(a, "RPUSH", append([]string{queue}, payloads...)...)
+		if len(due) < delayedBatch {
+			break
+		}
+	}
+	pending, _ := s.ZCard(key)
+	return pending
+}
+
+// delaypush handles the DELAYPUSH command: DELAYPUSH queue payload
+// fire-at-timestamp. The timestamp is a Unix time in milliseconds; a job due
+// already is delivered by the mover's next pass. Replies with the number of
+// jobs pending for the queue.
+func delaypush(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	fireAt, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || fireAt < 0 || fireAt > 1<<53 {
+		fmt.Fprintf(conn, "-ERR invalid fire-at timestamp in 'delaypush' command\r\n")
+		return
+	}
+	key := delayedKey(args[1])
+	member := fmt.Sprintf("%016x:%s", nextDelayedID(), args[2])
+	if _, err := s.ZAdd(key, []store.ZMember{{Member: member, Score: float64(fireAt)}}); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	LogEffects(a, "ZADD", key, args[3], member)
+	delayedQueues.Lock()
+	delayedQueues.keys[args[1]] = struct{}{}
+	delayedQueues.Unlock()
+	pending, _ := s.ZCard(key)
+	fmt.Fprintf(conn, ":%d\r\n", pending)
+}
+
+// delaylen handles the DELAYLEN command: DELAYLEN queue. Replies with the
+// number of jobs pending for the queue.
+func delaylen(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	pending, err := s.ZCard(delayedKey(args[1]))
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", pending)
+}
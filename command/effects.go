@@ -0,0 +1,79 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+)
+
+// Writes are persisted and propagated as commands that are replayed later,
+// by AOF loading, replicas and standbys. Commands whose outcome depends on
+// when or where they run, like a TTL counted from now, are logged as their
+// effects instead, commands that replay to the same dataset whenever they
+// run. Handlers log their writes with LogEffects rather than with the AOF's
+// WriteCommand, so that they don't have to know which commands need it.
+
+// effectRewrites turn commands that would replay differently into their
+// effects, given the time they ran at.
+var effectRewrites = map[string]func(args []string, now time.Time) [][]string{
+	"SET":       setEffects,
+	"SETSEALED": setEffects,
+	"EXPIRE":    expireEffects,
+	"PEXPIRE":   expireEffects,
+	"EXPIREAT":  expireEffects,
+	"PEXPIREAT": expireEffects,
+}
+
+// LogEffects logs the write command, which ran just now, to a as its
+// effects. It takes the arguments WriteCommand does.
+func LogEffects(a *aof.AOF, command string, args ...string) error {
+	rewrite, ok := effectRewrites[strings.ToUpper(command)]
+	if !ok {
+		return a.WriteCommand(command, args...)
+	}
+	for _, effect := range rewrite(append([]string{command}, args...), time.Now()) {
+		if err := a.WriteCommand(effect[0], effect[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEffects logs SET key value EX|PX ttl as the SET and the PEXPIREAT it
+// amounts to. SET logs sealed values as SETSEALED, with the same options.
+func setEffects(args []string, now time.Time) [][]string {
+	if len(args) < 5 {
+		return [][]string{args}
+	}
+	n, _ := strconv.ParseInt(args[4], 10, 64)
+	at := expireAt(strings.ToUpper(args[3]), n, now)
+	return [][]string{args[:3], {"PEXPIREAT", args[1], strconv.FormatInt(at.UnixMilli(), 10)}}
+}
+
+// expireEffects logs EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT as PEXPIREAT,
+// or as a DEL when they expire the key right away.
+func expireEffects(args []string, now time.Time) [][]string {
+	n, _ := strconv.ParseInt(args[2], 10, 64)
+	at := expireAt(strings.ToUpper(args[0]), n, now)
+	if !at.After(now) {
+		return [][]string{{"DEL", args[1]}}
+	}
+	return [][]string{{"PEXPIREAT", args[1], strconv.FormatInt(at.UnixMilli(), 10)}}
+}
+
+// expireAt returns when the expiration n of cmd, an expiration command or
+// the EX or PX option of SET, falls.
+func expireAt(cmd string, n int64, now time.Time) time.Time {
+	switch cmd {
+	case "EXPIREAT":
+		return time.Unix(n, 0)
+	case "PEXPIREAT":
+		return time.UnixMilli(n)
+	case "PEXPIRE", "PX":
+		return now.Add(time.Duration(n) * time.Millisecond)
+	default:
+		return now.Add(time.Duration(n) * time.Second)
+	}
+}
@@ -0,0 +1,133 @@
+package command
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// FlushProtectionWindow guards FLUSHALL and FLUSHDB when non-zero. Plain flushes
+// are then rejected; instead a flush must be scheduled with FLUSHALL SCHEDULE,
+// which runs after this window unless cancelled with FLUSHALL ABORT <token>.
+// It is set by the server at startup.
+var FlushProtectionWindow time.Duration
+
+// pendingFlush is the flush scheduled while protection is enabled, if any.
+var pendingFlush struct {
+	sync.Mutex
+	token string
+	timer *time.Timer
+}
+
+// flushall handles the FLUSHALL and FLUSHDB commands. There is a single
+// database, so both remove every key.
+func flushall(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToLower(args[0])
+	if len(args) > 1 {
+		switch strings.ToUpper(args[1]) {
+		case "SYNC", "ASYNC":
+			if len(args) != 2 {
+				fmt.Fprintf(conn, "-ERR syntax error\r\n")
+				return
+			}
+		case "SCHEDULE":
+			scheduleFlush(args, conn, s, a)
+			return
+		case "ABORT":
+			abortFlush(args, conn)
+			return
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+
+	// Protection guards clients only: flushes replayed from the AOF or
+	// replicated, which is how a scheduled flush is logged, always apply.
+	if FlushProtectionWindow > 0 && clientOf(conn) != nil {
+		fmt.Fprintf(conn, "-ERR %s is protected, use '%s SCHEDULE' and abort within the window with '%s ABORT <token>'\r\n",
+			strings.ToUpper(cmd), strings.ToUpper(cmd), strings.ToUpper(cmd))
+		return
+	}
+	s.Flush()
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, args[0])
+}
+
+// scheduleFlush arms a protected flush and replies with its cancellation token.
+func scheduleFlush(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args) != 2 {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	if FlushProtectionWindow <= 0 {
+		fmt.Fprintf(conn, "-ERR flush protection is disabled, flush directly\r\n")
+		return
+	}
+
+	pendingFlush.Lock()
+	defer pendingFlush.Unlock()
+	if pendingFlush.timer != nil {
+		fmt.Fprintf(conn, "-ERR a flush is already scheduled\r\n")
+		return
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+	cmd := strings.ToUpper(args[0])
+	pendingFlush.token = token
+	pendingFlush.timer = time.AfterFunc(FlushProtectionWindow, func() {
+		// The flush runs as a command would, under the server lock, which is
+		// taken before pendingFlush's as dispatch takes it before ABORT does.
+		if serverLock != nil {
+			serverLock.Lock()
+			defer serverLock.Unlock()
+		}
+		pendingFlush.Lock()
+		if pendingFlush.token != token {
+			pendingFlush.Unlock()
+			return
+		}
+		pendingFlush.token = ""
+		pendingFlush.timer = nil
+		pendingFlush.Unlock()
+
+		removed := s.Flush()
+		LogEffects(a, cmd)
+		log.Printf("Scheduled %s executed: removed %d keys.", cmd, removed)
+	})
+	log.Printf("%s scheduled in %s (token %s).", cmd, FlushProtectionWindow, token)
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(token), token)
+}
+
+// abortFlush cancels the scheduled flush if the token matches.
+func abortFlush(args []string, conn net.Conn) {
+	if len(args) != 3 {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	pendingFlush.Lock()
+	defer pendingFlush.Unlock()
+	if pendingFlush.timer == nil {
+		fmt.Fprintf(conn, "-ERR no flush is scheduled\r\n")
+		return
+	}
+	if pendingFlush.token != args[2] {
+		fmt.Fprintf(conn, "-ERR invalid flush token\r\n")
+		return
+	}
+	pendingFlush.timer.Stop()
+	pendingFlush.token = ""
+	pendingFlush.timer = nil
+	log.Println("Scheduled flush aborted.")
+	fmt.Fprintf(conn, "+OK\r\n")
+}
@@ -0,0 +1,501 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/lua"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Function libraries are kept in the store as code, so they are persisted
+// and copied with the dataset, and FUNCTION's writes are logged as the
+// commands themselves. Each library is compiled, in a Lua state of its own,
+// when the libraries of a store are first called after they changed.
+
+// FCALL runs functions through redis.call like scripts do, so the function
+// commands are registered here rather than in its initializer.
+func init() {
+	Handlers["FUNCTION"] = function
+	Handlers["FCALL"] = fcall
+	Handlers["FCALL_RO"] = fcallRO
+}
+
+// functionFlags are the flags redis.register_function accepts. Only
+// no-writes changes how a function runs; the others are accepted for
+// libraries written for Redis.
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+// library is a compiled function library.
+type library struct {
+	name, engine, code string
+	functions          []*luaFunction
+	// views are the library's read-only computed keys, named by key.
+	views []*luaFunction
+}
+
+// luaFunction is a function or view a library registered.
+type luaFunction struct {
+	name, description string
+	flags             []string
+	fn                *lua.Function
+	L                 *lua.State
+	lib               *library
+}
+
+// noWrites reports whether the function is flagged as not writing.
+func (f *luaFunction) noWrites() bool {
+	return slices.Contains(f.flags, "no-writes")
+}
+
+// functionSet is what the libraries of a store compile to.
+type functionSet struct {
+	libraries map[string]*library
+	functions map[string]*luaFunction
+	views     map[string]*luaFunction
+}
+
+func newFunctionSet() *functionSet {
+	return &functionSet{
+		libraries: make(map[string]*library),
+		functions: make(map[string]*luaFunction),
+		views:     make(map[string]*luaFunction),
+	}
+}
+
+// add adds the functions and views of lib to the set, failing if another
+// library registered one of the same name.
+func (set *functionSet) add(lib *library) error {
+	for _, f := range lib.functions {
+		if other, taken := set.functions[f.name]; taken && other.lib.name != lib.name {
+			return fmt.Errorf("Function %s already exists", f.name)
+		}
+	}
+	for _, v := range lib.views {
+		if other, taken := set.views[v.name]; taken && other.lib.name != lib.name {
+			return fmt.Errorf("View '%s' already exists", v.name)
+		}
+	}
+	for _, f := range lib.functions {
+		set.functions[f.name] = f
+	}
+	for _, v := range lib.views {
+		set.views[v.name] = v
+	}
+	set.libraries[lib.name] = lib
+	return nil
+}
+
+// compileLibrary runs the code of a library, which registers its functions
+// with redis.register_function and its views with redis.register_view. The
+// caller holds scripting.
+func compileLibrary(code string) (*library, error) {
+	engine, name, err := store.ParseLibraryHeader(code)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(engine, "lua") {
+		return nil, fmt.Errorf("Engine '%s' not found", engine)
+	}
+	lib := &library{name: name, engine: "LUA", code: code}
+	L := newScriptState()
+	loading := true
+	register := func(L *lua.State, args []lua.Value) []lua.Value {
+		if !loading {
+			L.Errorf("redis.register_function can only be called on FUNCTION LOAD command")
+		}
+		f := &luaFunction{L: L, lib: lib}
+		switch {
+		case len(args) == 1:
+			t := L.CheckTable(args, 1, "register_function")
+			for k, v, _ := t.Next(nil); k != nil; k, v, _ = t.Next(k) {
+				switch k {
+				case "function_name":
+					f.name, _ = v.(string)
+				case "callback":
+					f.fn, _ = v.(*lua.Function)
+				case "description":
+					f.description, _ = v.(string)
+				case "flags":
+					flags, ok := v.(*lua.Table)
+					if !ok {
+						L.Errorf("flags argument to redis.register_function must be a table representing function flags")
+					}
+					for i := 1; flags.Get(float64(i)) != nil; i++ {
+						flag, _ := flags.Get(float64(i)).(string)
+						if !functionFlags[flag] {
+							L.Errorf("unknown flag given")
+						}
+						f.flags = append(f.flags, flag)
+					}
+				default:
+					L.Errorf("unknown argument given to redis.register_function")
+				}
+			}
+			if f.name == "" || f.fn == nil {
+				L.Errorf("redis.register_function must get a function name and a callback argument")
+			}
+		case len(args) == 2:
+			f.name = L.CheckString(args, 1, "register_function")
+			if f.fn, _ = args[1].(*lua.Function); f.fn == nil {
+				L.Errorf("callback argument given to redis.register_function must be a function")
+			}
+		default:
+			L.Errorf("wrong number of arguments to redis.register_function")
+		}
+		if !validFunctionName(f.name) {
+			L.Errorf("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		}
+		for _, other := range lib.functions {
+			if other.name == f.name {
+				L.Errorf("Function already exists in the library")
+			}
+		}
+		lib.functions = append(lib.functions, f)
+		return nil
+	}
+	registerView := func(L *lua.State, args []lua.Value) []lua.Value {
+		if !loading {
+			L.Errorf("redis.register_view can only be called on FUNCTION LOAD command")
+		}
+		if len(args) != 2 {
+			L.Errorf("wrong number of arguments to redis.register_view")
+		}
+		v := &luaFunction{name: L.CheckString(args, 1, "register_view"), L: L, lib: lib}
+		if v.fn, _ = args[1].(*lua.Function); v.fn == nil {
+			L.Errorf("callback argument given to redis.register_view must be a function")
+		}
+		if v.name == "" {
+			L.Errorf("View keys must be at least one character long")
+		}
+		for _, other := range lib.views {
+			if other.name == v.name {
+				L.Errorf("View already exists in the library")
+			}
+		}
+		lib.views = append(lib.views, v)
+		return nil
+	}
+	redis := L.Globals.GetString("redis").(*lua.Table)
+	redis.Set("register_function", lua.NewFunction("register_function", register))
+	redis.Set("register_view", lua.NewFunction("register_view", registerView))
+	chunk, err := L.Load(code, "user_function")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling function: %v", err)
+	}
+	L.SetDeadline(time.Now().Add(scriptTimeout))
+	_, err = L.Call(chunk)
+	L.SetDeadline(time.Time{})
+	loading = false
+	switch {
+	case lua.IsTimeout(err):
+		return nil, fmt.Errorf("FUNCTION LOAD ran longer than %v and was stopped", scriptTimeout)
+	case err != nil:
+		return nil, fmt.Errorf("Error registering functions: %v", err)
+	case len(lib.functions) == 0 && len(lib.views) == 0:
+		return nil, fmt.Errorf("No functions registered")
+	}
+	return lib, nil
+}
+
+func validFunctionName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// compileLibraries compiles the libraries given by code, by name, and
+// checks that no two register a function of the same name. The caller
+// holds scripting.
+func compileLibraries(code map[string]string) (*functionSet, error) {
+	set := newFunctionSet()
+	for _, name := range slices.Sorted(maps.Keys(code)) {
+		lib, err := compileLibrary(code[name])
+		if err != nil {
+			return nil, err
+		}
+		if err := set.add(lib); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// functionsOf returns the compiled libraries of s. Libraries that came from
+// a file and don't compile are left out, and logged. The caller holds
+// scripting.
+func functionsOf(s *store.Store) *functionSet {
+	return s.CompiledFunctions(func(code map[string]string) any {
+		set, err := compileLibraries(code)
+		if err == nil {
+			return set
+		}
+		log.Printf("Function libraries don't compile, loading them one at a time: %v", err)
+		set = newFunctionSet()
+		for _, name := range slices.Sorted(maps.Keys(code)) {
+			lib, err := compileLibrary(code[name])
+			if err == nil {
+				err = set.add(lib)
+			}
+			if err != nil {
+				log.Printf("Function library %s doesn't compile: %v", name, err)
+			}
+		}
+		return set
+	}).(*functionSet)
+}
+
+// function handles the FUNCTION command family.
+func function(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	sub := strings.ToUpper(args[1])
+	switch sub {
+	case "LOAD", "DELETE", "FLUSH", "RESTORE":
+		if clientOf(conn) != nil && isReplica.Load() {
+			fmt.Fprintf(conn, "-READONLY You can't write against a read only replica.\r\n")
+			return
+		}
+	}
+	scripting.Lock()
+	defer scripting.Unlock()
+	switch sub {
+	case "LOAD":
+		functionLoad(args, conn, s, a)
+	case "DELETE":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'function|delete' command\r\n")
+			return
+		}
+		if !s.DeleteFunctionLibrary(args[2]) {
+			fmt.Fprintf(conn, "-ERR Library not found\r\n")
+			return
+		}
+		LogEffects(a, "FUNCTION", args[1:]...)
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "FLUSH":
+		if len(args) > 3 || len(args) == 3 && !strings.EqualFold(args[2], "ASYNC") && !strings.EqualFold(args[2], "SYNC") {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		s.FlushFunctionLibraries()
+		LogEffects(a, "FUNCTION", "FLUSH")
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "LIST":
+		functionList(args, conn, s)
+	case "DUMP":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'function|dump' command\r\n")
+			return
+		}
+		writeBulk(conn, string(s.DumpFunctionLibraries()))
+	case "RESTORE":
+		functionRestore(args, conn, s, a)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// functionLoad handles FUNCTION LOAD [REPLACE] code, replying with the name
+// of the library loaded.
+func functionLoad(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	replace := len(args) == 4 && strings.EqualFold(args[2], "REPLACE")
+	if len(args) != 3 && !replace {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'function|load' command\r\n")
+		return
+	}
+	code := args[len(args)-1]
+	lib, err := compileLibrary(code)
+	if err != nil {
+		fmt.Fprintf(conn, "-ERR %s\r\n", replyLine.Replace(err.Error()))
+		return
+	}
+	libraries := s.FunctionLibraries()
+	if _, ok := libraries[lib.name]; ok && !replace {
+		fmt.Fprintf(conn, "-ERR Library '%s' already exists\r\n", lib.name)
+		return
+	}
+	current := functionsOf(s)
+	for _, f := range lib.functions {
+		if other, ok := current.functions[f.name]; ok && other.lib.name != lib.name {
+			fmt.Fprintf(conn, "-ERR Function %s already exists\r\n", f.name)
+			return
+		}
+	}
+	for _, v := range lib.views {
+		if other, ok := current.views[v.name]; ok && other.lib.name != lib.name {
+			fmt.Fprintf(conn, "-ERR View '%s' already exists\r\n", v.name)
+			return
+		}
+	}
+	s.SetFunctionLibrary(lib.name, code)
+	LogEffects(a, "FUNCTION", "LOAD", "REPLACE", code)
+	writeBulk(conn, lib.name)
+}
+
+// functionRestore handles FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE],
+// loading the libraries of a FUNCTION DUMP. APPEND, the default, refuses
+// libraries that exist, REPLACE replaces them and FLUSH removes every
+// library first.
+func functionRestore(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args) != 3 && len(args) != 4 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'function|restore' command\r\n")
+		return
+	}
+	policy := "APPEND"
+	if len(args) == 4 {
+		policy = strings.ToUpper(args[3])
+	}
+	if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+		fmt.Fprintf(conn, "-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.\r\n")
+		return
+	}
+	restored, err := store.ReadFunctionDump([]byte(args[2]))
+	if err != nil {
+		fmt.Fprintf(conn, "-ERR %s\r\n", err)
+		return
+	}
+	libraries := s.FunctionLibraries()
+	if policy == "FLUSH" {
+		libraries = make(map[string]string)
+	}
+	for name, code := range restored {
+		if _, ok := libraries[name]; ok && policy == "APPEND" {
+			fmt.Fprintf(conn, "-ERR Library '%s' already exists\r\n", name)
+			return
+		}
+		libraries[name] = code
+	}
+	if _, err := compileLibraries(libraries); err != nil {
+		fmt.Fprintf(conn, "-ERR %s\r\n", replyLine.Replace(err.Error()))
+		return
+	}
+	defer a.BeginTransaction()()
+	if policy == "FLUSH" {
+		s.FlushFunctionLibraries()
+		LogEffects(a, "FUNCTION", "FLUSH")
+	}
+	for name, code := range restored {
+		s.SetFunctionLibrary(name, code)
+		LogEffects(a, "FUNCTION", "LOAD", "REPLACE", code)
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// functionList handles FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE],
+// replying with the libraries matching pattern, their engine and
+// functions, the keys of their views if they have any, and their code if
+// asked for.
+func functionList(args []string, conn net.Conn, s *store.Store) {
+	pattern, withCode := "", false
+	for i := 2; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "WITHCODE") && !withCode:
+			withCode = true
+		case strings.EqualFold(args[i], "LIBRARYNAME") && pattern == "" && i+1 < len(args):
+			i++
+			pattern = args[i]
+		default:
+			fmt.Fprintf(conn, "-ERR Unknown argument %s\r\n", args[i])
+			return
+		}
+	}
+	set := functionsOf(s)
+	var libs []*library
+	for _, name := range slices.Sorted(maps.Keys(set.libraries)) {
+		if pattern == "" || store.MatchPattern(pattern, name) {
+			libs = append(libs, set.libraries[name])
+		}
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(libs))
+	for _, lib := range libs {
+		fields := 3
+		if len(lib.views) > 0 {
+			fields++
+		}
+		if withCode {
+			fields++
+		}
+		fmt.Fprint(conn, mapHeader(conn, fields))
+		writeBulk(conn, "library_name")
+		writeBulk(conn, lib.name)
+		writeBulk(conn, "engine")
+		writeBulk(conn, lib.engine)
+		writeBulk(conn, "functions")
+		fmt.Fprintf(conn, "*%d\r\n", len(lib.functions))
+		for _, f := range lib.functions {
+			fmt.Fprint(conn, mapHeader(conn, 3))
+			writeBulk(conn, "name")
+			writeBulk(conn, f.name)
+			writeBulk(conn, "description")
+			if f.description == "" {
+				fmt.Fprintf(conn, "$-1\r\n")
+			} else {
+				writeBulk(conn, f.description)
+			}
+			writeBulk(conn, "flags")
+			fmt.Fprintf(conn, "*%d\r\n", len(f.flags))
+			for _, flag := range f.flags {
+				writeBulk(conn, flag)
+			}
+		}
+		if len(lib.views) > 0 {
+			writeBulk(conn, "views")
+			fmt.Fprintf(conn, "*%d\r\n", len(lib.views))
+			for _, v := range lib.views {
+				writeBulk(conn, v.name)
+			}
+		}
+		if withCode {
+			writeBulk(conn, "library_code")
+			writeBulk(conn, lib.code)
+		}
+	}
+}
+
+// callFunction runs a function given by name, for FCALL function numkeys
+// [key ...] [arg ...] and FCALL_RO.
+func callFunction(args []string, conn net.Conn, s *store.Store, a *aof.AOF, readOnly bool) {
+	keys, argv, refused := scriptKeys(args[2:])
+	if refused != "" {
+		fmt.Fprintf(conn, "-%s\r\n", refused)
+		return
+	}
+	scripting.Lock()
+	defer scripting.Unlock()
+	f, ok := functionsOf(s).functions[args[1]]
+	if !ok {
+		fmt.Fprintf(conn, "-ERR Function not found\r\n")
+		return
+	}
+	if readOnly && !f.noWrites() {
+		fmt.Fprintf(conn, "-ERR Can not execute a script with write flag using *_ro command.\r\n")
+		return
+	}
+	run := &scriptRun{conn: conn, s: s, a: a, readOnly: readOnly || f.noWrites()}
+	runScript(f.L, f.fn, []lua.Value{stringsTable(keys), stringsTable(argv)}, run)
+}
+
+// fcall handles FCALL function numkeys [key ...] [arg ...], calling the
+// function with a table of the keys and one of the other arguments.
+func fcall(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	callFunction(args, conn, s, a, false)
+}
+
+// fcallRO handles FCALL_RO, which calls a function flagged no-writes.
+func fcallRO(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	callFunction(args, conn, s, a, true)
+}
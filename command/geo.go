@@ -0,0 +1,553 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Geo commands store places in a sorted set, scored by a 52-bit geohash of
+// their position exactly as Redis does, so the sets are interchangeable with
+// Redis' and can be read with the sorted set commands. A search scans the
+// score ranges of the geohash cell holding its center and of the eight cells
+// around it, at a precision where those cells cover the whole search area,
+// and then checks each place found against the area itself.
+
+// The bounds of positions a geohash can encode. Latitudes are limited as in
+// Web Mercator.
+const (
+	geoLonMin = -180.0
+	geoLonMax = 180.0
+	geoLatMin = -85.05112878
+	geoLatMax = 85.05112878
+)
+
+// geoStep is the number of bits of each coordinate in a geohash score.
+const geoStep = 26
+
+// geoEarthRadius is the Earth's radius in meters used for distances, the
+// same as Redis'.
+const geoEarthRadius = 6372797.560856
+
+// geoUnits converts distances in each unit to meters.
+var geoUnits = map[string]float64{
+	"m":  1,
+	"km": 1000,
+	"ft": 0.3048,
+	"mi": 1609.34,
+}
+
+// interleave spreads the bits of x over the even bits of the result and
+// those of y over the odd ones.
+func interleave(x, y uint32) uint64 {
+	spread := func(v uint32) uint64 {
+		b := uint64(v)
+		b = (b | b<<16) & 0x0000FFFF0000FFFF
+		b = (b | b<<8) & 0x00FF00FF00FF00FF
+		b = (b | b<<4) & 0x0F0F0F0F0F0F0F0F
+		b = (b | b<<2) & 0x3333333333333333
+		b = (b | b<<1) & 0x5555555555555555
+		return b
+	}
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave reverses interleave.
+func deinterleave(b uint64) (x, y uint32) {
+	squash := func(b uint64) uint32 {
+		b &= 0x5555555555555555
+		b = (b | b>>1) & 0x3333333333333333
+		b = (b | b>>2) & 0x0F0F0F0F0F0F0F0F
+		b = (b | b>>4) & 0x00FF00FF00FF00FF
+		b = (b | b>>8) & 0x0000FFFF0000FFFF
+		b = (b | b>>16) & 0x00000000FFFFFFFF
+		return uint32(b)
+	}
+	return squash(b), squash(b >> 1)
+}
+
+// geoEncode returns the geohash of a position with step bits per coordinate.
+func geoEncode(lon, lat float64, step uint) uint64 {
+	scale := float64(uint64(1) << step)
+	latOffset := (lat - geoLatMin) / (geoLatMax - geoLatMin) * scale
+	lonOffset := (lon - geoLonMin) / (geoLonMax - geoLonMin) * scale
+	return interleave(uint32(min(latOffset, scale-1)), uint32(min(lonOffset, scale-1)))
+}
+
+// geoDecode returns the center of the cell of a 52-bit geohash.
+func geoDecode(hash uint64) (lon, lat float64) {
+	latCell, lonCell := deinterleave(hash)
+	scale := float64(uint64(1) << geoStep)
+	latFrom := geoLatMin + float64(latCell)/scale*(geoLatMax-geoLatMin)
+	latTo := geoLatMin + float64(latCell+1)/scale*(geoLatMax-geoLatMin)
+	lonFrom := geoLonMin + float64(lonCell)/scale*(geoLonMax-geoLonMin)
+	lonTo := geoLonMin + float64(lonCell+1)/scale*(geoLonMax-geoLonMin)
+	lon = max(geoLonMin, min(geoLonMax, (lonFrom+lonTo)/2))
+	lat = max(geoLatMin, min(geoLatMax, (latFrom+latTo)/2))
+	return lon, lat
+}
+
+// geoDistance returns the distance in meters between two positions, by the
+// haversine formula.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	rad := math.Pi / 180
+	lat1r, lat2r := lat1*rad, lat2*rad
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2 - lon1) * rad / 2)
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// parseGeoPosition parses a longitude and latitude, writing an error reply
+// if they are invalid or out of range.
+func parseGeoPosition(lonArg, latArg string, conn net.Conn) (float64, float64, bool) {
+	lon, err1 := strconv.ParseFloat(lonArg, 64)
+	lat, err2 := strconv.ParseFloat(latArg, 64)
+	if err1 != nil || err2 != nil {
+		fmt.Fprintf(conn, "-ERR value is not a valid float\r\n")
+		return 0, 0, false
+	}
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		fmt.Fprintf(conn, "-ERR invalid longitude,latitude pair %f,%f\r\n", lon, lat)
+		return 0, 0, false
+	}
+	return lon, lat, true
+}
+
+// parseGeoUnit returns the meters in a unit, writing an error reply if it
+// isn't one.
+func parseGeoUnit(arg string, conn net.Conn) (float64, bool) {
+	meters, ok := geoUnits[strings.ToLower(arg)]
+	if !ok {
+		fmt.Fprintf(conn, "-ERR unsupported unit provided. please use M, KM, FT, MI\r\n")
+	}
+	return meters, ok
+}
+
+// writeGeoCoord writes a position as an array of two bulk strings.
+func writeGeoCoord(conn net.Conn, lon, lat float64) {
+	fmt.Fprintf(conn, "*2\r\n")
+	writeBulk(conn, strconv.FormatFloat(lon, 'f', 17, 64))
+	writeBulk(conn, strconv.FormatFloat(lat, 'f', 17, 64))
+}
+
+// geoadd handles GEOADD key [NX|XX] [CH] longitude latitude member
+// [longitude latitude member ...].
+func geoadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	var flags store.ZAddFlags
+	ch := false
+	triples := args[2:]
+options:
+	for len(triples) > 0 {
+		switch strings.ToUpper(triples[0]) {
+		case "NX":
+			flags.NX = true
+		case "XX":
+			flags.XX = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+		triples = triples[1:]
+	}
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	if flags.NX && flags.XX {
+		fmt.Fprintf(conn, "-ERR XX and NX options at the same time are not compatible\r\n")
+		return
+	}
+	members := make([]store.ZMember, 0, len(triples)/3)
+	for i := 0; i < len(triples); i += 3 {
+		lon, lat, ok := parseGeoPosition(triples[i], triples[i+1], conn)
+		if !ok {
+			return
+		}
+		members = append(members, store.ZMember{Member: triples[i+2], Score: float64(geoEncode(lon, lat, geoStep))})
+	}
+	added, written, err := s.ZAddIf(args[1], members, flags)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if ch {
+		fmt.Fprintf(conn, ":%d\r\n", len(written))
+	} else {
+		fmt.Fprintf(conn, ":%d\r\n", added)
+	}
+	if len(written) == 0 {
+		return
+	}
+	persisted := []string{args[1]}
+	for _, m := range written {
+		persisted = append(persisted, formatScore(m.Score), m.Member)
+	}
+	LogEffects(a, "ZADD", persisted...)
+}
+
+// geopos handles GEOPOS key member [member ...], replying with the position
+// of each member or a null for those that don't exist.
+func geopos(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if _, err := s.ZCard(args[1]); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(args)-2)
+	for _, member := range args[2:] {
+		score, ok, _ := s.ZScore(args[1], member)
+		if !ok {
+			fmt.Fprintf(conn, "*-1\r\n")
+			continue
+		}
+		lon, lat := geoDecode(uint64(score))
+		writeGeoCoord(conn, lon, lat)
+	}
+}
+
+// geodist handles GEODIST key member1 member2 [M|KM|FT|MI].
+func geodist(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	unit := 1.0
+	if len(args) == 5 {
+		var ok bool
+		if unit, ok = parseGeoUnit(args[4], conn); !ok {
+			return
+		}
+	}
+	score1, ok1, err := s.ZScore(args[1], args[2])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	score2, ok2, _ := s.ZScore(args[1], args[3])
+	if !ok1 || !ok2 {
+		fmt.Fprintf(conn, "$-1\r\n")
+		return
+	}
+	lon1, lat1 := geoDecode(uint64(score1))
+	lon2, lat2 := geoDecode(uint64(score2))
+	writeBulk(conn, strconv.FormatFloat(geoDistance(lon1, lat1, lon2, lat2)/unit, 'f', 4, 64))
+}
+
+// geoQuery is a parsed GEOSEARCH query.
+type geoQuery struct {
+	lon, lat float64
+	// radius is set for BYRADIUS, and width and height for BYBOX, all in
+	// meters.
+	radius, width, height float64
+	unit                  float64
+	// order is 1 for ASC, -1 for DESC and 0 for unsorted.
+	order int
+	count int
+	any   bool
+
+	withCoord, withDist, withHash bool
+	storeDist                     bool
+}
+
+// geoResult is a place found by a search.
+type geoResult struct {
+	member   string
+	score    float64
+	dist     float64
+	lon, lat float64
+}
+
+// parseGeoQuery parses the arguments of GEOSEARCH after the key, or of
+// GEOSEARCHSTORE after the source key when storing is set. It writes an error
+// reply and returns false on bad input.
+func parseGeoQuery(args []string, key string, storing bool, conn net.Conn, s *store.Store) (geoQuery, bool) {
+	q := geoQuery{}
+	hasFrom, hasBy := false, false
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "FROMMEMBER" && left >= 1:
+			score, ok, err := s.ZScore(key, args[i+1])
+			if err != nil {
+				fmt.Fprintf(conn, "-%s\r\n", err)
+				return q, false
+			}
+			if !ok {
+				fmt.Fprintf(conn, "-ERR could not decode requested zset member\r\n")
+				return q, false
+			}
+			q.lon, q.lat = geoDecode(uint64(score))
+			hasFrom = true
+			i++
+		case opt == "FROMLONLAT" && left >= 2:
+			var ok bool
+			if q.lon, q.lat, ok = parseGeoPosition(args[i+1], args[i+2], conn); !ok {
+				return q, false
+			}
+			hasFrom = true
+			i += 2
+		case opt == "BYRADIUS" && left >= 2:
+			radius, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || radius < 0 {
+				fmt.Fprintf(conn, "-ERR need numeric radius\r\n")
+				return q, false
+			}
+			var ok bool
+			if q.unit, ok = parseGeoUnit(args[i+2], conn); !ok {
+				return q, false
+			}
+			q.radius = radius * q.unit
+			hasBy = true
+			i += 2
+		case opt == "BYBOX" && left >= 3:
+			width, err1 := strconv.ParseFloat(args[i+1], 64)
+			height, err2 := strconv.ParseFloat(args[i+2], 64)
+			if err1 != nil || err2 != nil || width < 0 || height < 0 {
+				fmt.Fprintf(conn, "-ERR need numeric width and height\r\n")
+				return q, false
+			}
+			var ok bool
+			if q.unit, ok = parseGeoUnit(args[i+3], conn); !ok {
+				return q, false
+			}
+			q.width, q.height = width*q.unit, height*q.unit
+			hasBy = true
+			i += 3
+		case opt == "ASC":
+			q.order = 1
+		case opt == "DESC":
+			q.order = -1
+		case opt == "COUNT" && left >= 1:
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				fmt.Fprintf(conn, "-ERR COUNT must be > 0\r\n")
+				return q, false
+			}
+			q.count = n
+			i++
+			if i+1 < len(args) && strings.EqualFold(args[i+1], "ANY") {
+				q.any = true
+				i++
+			}
+		case opt == "WITHCOORD" && !storing:
+			q.withCoord = true
+		case opt == "WITHDIST" && !storing:
+			q.withDist = true
+		case opt == "WITHHASH" && !storing:
+			q.withHash = true
+		case opt == "STOREDIST" && storing:
+			q.storeDist = true
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return q, false
+		}
+	}
+	if !hasFrom {
+		fmt.Fprintf(conn, "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s\r\n", geoCommandName(storing))
+		return q, false
+	}
+	if !hasBy {
+		fmt.Fprintf(conn, "-ERR exactly one of BYRADIUS and BYBOX can be specified for %s\r\n", geoCommandName(storing))
+		return q, false
+	}
+	// Without ANY, COUNT returns the nearest places.
+	if q.count > 0 && !q.any && q.order == 0 {
+		q.order = 1
+	}
+	return q, true
+}
+
+// geoCommandName names the search command in errors.
+func geoCommandName(storing bool) string {
+	if storing {
+		return "geosearchstore"
+	}
+	return "geosearch"
+}
+
+// contains reports whether the area of q contains a position, and its
+// distance from the center in meters.
+func (q geoQuery) contains(lon, lat float64) (float64, bool) {
+	if q.width == 0 && q.height == 0 {
+		dist := geoDistance(q.lon, q.lat, lon, lat)
+		return dist, dist <= q.radius
+	}
+	// As in Redis, the height is measured along the meridian and the width
+	// along the place's parallel.
+	if geoDistance(q.lon, q.lat, q.lon, lat) > q.height/2 {
+		return 0, false
+	}
+	if geoDistance(q.lon, lat, lon, lat) > q.width/2 {
+		return 0, false
+	}
+	return geoDistance(q.lon, q.lat, lon, lat), true
+}
+
+// scoreRanges returns the geohash score ranges, as [from, to) pairs, of the
+// cells that together cover the area of q.
+func (q geoQuery) scoreRanges() [][2]float64 {
+	// How far the area reaches from its center, in degrees.
+	reachM := q.radius
+	reachLatM, reachLonM := reachM, reachM
+	if q.width != 0 || q.height != 0 {
+		reachLatM, reachLonM = q.height/2, q.width/2
+	}
+	dLat := reachLatM / geoEarthRadius * 180 / math.Pi
+	edgeLat := math.Min(math.Abs(q.lat)+dLat, 90)
+	dLon := 360.0
+	if cos := math.Cos(edgeLat * math.Pi / 180); cos > 1e-9 {
+		dLon = reachLonM / (geoEarthRadius * cos) * 180 / math.Pi
+	}
+
+	// The finest precision at which a cell is at least as large as the
+	// reach, so the eight cells around the center's cover the area.
+	step := uint(geoStep)
+	for step > 0 {
+		cells := float64(uint64(1) << step)
+		if (geoLatMax-geoLatMin)/cells >= dLat && (geoLonMax-geoLonMin)/cells >= dLon {
+			break
+		}
+		step--
+	}
+	if step == 0 {
+		return [][2]float64{{0, float64(uint64(1) << (2 * geoStep))}}
+	}
+
+	latCell, lonCell := deinterleave(geoEncode(q.lon, q.lat, step))
+	cells := int64(1) << step
+	shift := 2 * (geoStep - step)
+	seen := make(map[uint64]bool)
+	var ranges [][2]float64
+	for dy := int64(-1); dy <= 1; dy++ {
+		y := int64(latCell) + dy
+		if y < 0 || y >= cells {
+			continue
+		}
+		for dx := int64(-1); dx <= 1; dx++ {
+			x := (int64(lonCell) + dx + cells) % cells
+			hash := interleave(uint32(y), uint32(x))
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			ranges = append(ranges, [2]float64{float64(hash << shift), float64((hash + 1) << shift)})
+		}
+	}
+	return ranges
+}
+
+// search returns the places in key within the area of q, ordered and limited
+// as q asks.
+func (q geoQuery) search(s *store.Store, key string) ([]geoResult, error) {
+	var results []geoResult
+	for _, r := range q.scoreRanges() {
+		members, err := s.ZRangeByScore(key, store.ScoreBound{Value: r[0]}, store.ScoreBound{Value: r[1], Exclusive: true}, false, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			lon, lat := geoDecode(uint64(m.Score))
+			if dist, ok := q.contains(lon, lat); ok {
+				results = append(results, geoResult{member: m.Member, score: m.Score, dist: dist, lon: lon, lat: lat})
+			}
+		}
+		if q.any && q.count > 0 && len(results) >= q.count {
+			break
+		}
+	}
+	if q.order != 0 {
+		sort.SliceStable(results, func(i, j int) bool {
+			if q.order < 0 {
+				return results[i].dist > results[j].dist
+			}
+			return results[i].dist < results[j].dist
+		})
+	}
+	if q.count > 0 && len(results) > q.count {
+		results = results[:q.count]
+	}
+	return results, nil
+}
+
+// geosearch handles GEOSEARCH key FROMMEMBER member|FROMLONLAT lon lat
+// BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT n [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH].
+func geosearch(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if _, err := s.ZCard(args[1]); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	q, ok := parseGeoQuery(args[2:], args[1], false, conn, s)
+	if !ok {
+		return
+	}
+	results, err := q.search(s, args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(results))
+	extra := 0
+	for _, with := range []bool{q.withDist, q.withHash, q.withCoord} {
+		if with {
+			extra++
+		}
+	}
+	for _, r := range results {
+		if extra == 0 {
+			writeBulk(conn, r.member)
+			continue
+		}
+		fmt.Fprintf(conn, "*%d\r\n", 1+extra)
+		writeBulk(conn, r.member)
+		if q.withDist {
+			writeBulk(conn, strconv.FormatFloat(r.dist/q.unit, 'f', 4, 64))
+		}
+		if q.withHash {
+			fmt.Fprintf(conn, ":%d\r\n", uint64(r.score))
+		}
+		if q.withCoord {
+			writeGeoCoord(conn, r.lon, r.lat)
+		}
+	}
+}
+
+// geosearchstore handles GEOSEARCHSTORE destination source, followed by the
+// options of GEOSEARCH other than WITH*, and STOREDIST to store distances
+// instead of positions as the scores.
+func geosearchstore(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if _, err := s.ZCard(args[2]); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	q, ok := parseGeoQuery(args[3:], args[2], true, conn, s)
+	if !ok {
+		return
+	}
+	results, err := q.search(s, args[2])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	members := make([]store.ZMember, len(results))
+	for i, r := range results {
+		members[i] = store.ZMember{Member: r.member, Score: r.score}
+		if q.storeDist {
+			members[i].Score = r.dist / q.unit
+		}
+	}
+	s.ZReplace(args[1], members)
+	fmt.Fprintf(conn, ":%d\r\n", len(members))
+
+	LogEffects(a, "DEL", args[1])
+	if len(members) > 0 {
+		zaddArgs := make([]string, 0, 1+2*len(members))
+		zaddArgs = append(zaddArgs, args[1])
+		for _, m := range members {
+			zaddArgs = append(zaddArgs, formatScore(m.Score), m.Member)
+		}
+		LogEffects(a, "ZADD", zaddArgs...)
+	}
+}
@@ -1,7 +1,9 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -18,23 +20,185 @@ type commandHandler func(args []string, conn net.Conn, s *store.Store, a *aof.AO
 // Handlers is a map that associates a command name (string) with its corresponding handler function.
 // This design makes it easy to add new commands without modifying the core Handle function.
 var Handlers = map[string]commandHandler{
-	"PING":     ping,
-	"SET":      set,
-	"GET":      get,
-	"DEL":      del,
-	"EXISTS":   exists,
-	"LPUSH":    lpush,
-	"LPOP":     lpop,
-	"RPUSH":    rpush,
-	"RPOP":     rpop,
-	"LRANGE":   lrange,
-	"SADD":     sadd,
-	"SREM":     srem,
-	"SMEMBERS": smembers,
-	"HSET":     hset,
-	"HGET":     hget,
-	"HDEL":     hdel,
-	"HGETALL":  hgetall,
+	"PING":             ping,
+	"AUTH":             auth,
+	"HELLO":            hello,
+	"QUOTA":            quotaCmd,
+	"SUBSCRIBE":        subscribe,
+	"PSUBSCRIBE":       subscribe,
+	"UNSUBSCRIBE":      unsubscribe,
+	"PUNSUBSCRIBE":     unsubscribe,
+	"PUBLISH":          publish,
+	"PUBSUB":           pubsubCmd,
+	"MONITOR":          monitor,
+	"SLOWLOG":          slowlogCmd,
+	"LATENCY":          latencyCmd,
+	"WAITAOF":          waitAOF,
+	"ACL":              acl,
+	"CLIENT":           clientCmd,
+	"INFO":             info,
+	"STATS":            stats,
+	"CONFIG":           config,
+	"SET":              set,
+	"SETSEALED":        setSealed,
+	"GET":              get,
+	"DEL":              del,
+	"EXISTS":           exists,
+	"FLUSHALL":         flushall,
+	"FLUSHDB":          flushall,
+	"EXPIRE":           expire,
+	"PEXPIRE":          expire,
+	"EXPIREAT":         expire,
+	"PEXPIREAT":        expire,
+	"PERSIST":          persist,
+	"TTLSWEEP":         ttlsweep,
+	"TTLREPORT":        ttlreport,
+	"MIGRATION":        migrationCmd,
+	"XADD":             xadd,
+	"XLEN":             xlen,
+	"XRANGE":           xrange,
+	"XREVRANGE":        xrange,
+	"XREAD":            xread,
+	"XSETID":           xsetid,
+	"INCR":             incr,
+	"DECR":             incr,
+	"INCRBY":           incrby,
+	"DECRBY":           incrby,
+	"SCAN":             scan,
+	"BACKUP":           backup,
+	"SAVE":             save,
+	"BGSAVE":           bgsaveCmd,
+	"LASTSAVE":         lastsave,
+	"BGREWRITEAOF":     bgrewriteaof,
+	"REPLCONF":         replconf,
+	"PSYNC":            psync,
+	"LPUSH":            lpush,
+	"LPOP":             lpop,
+	"RPUSH":            rpush,
+	"RPOP":             rpop,
+	"LRANGE":           lrange,
+	"SADD":             sadd,
+	"SREM":             srem,
+	"SMEMBERS":         smembers,
+	"SMOVE":            smove,
+	"SSCAN":            sscan,
+	"HSET":             hset,
+	"HSETNX":           hsetnx,
+	"HGET":             hget,
+	"HDEL":             hdel,
+	"HGETALL":          hgetall,
+	"HEXISTS":          hexists,
+	"HLEN":             hlen,
+	"HKEYS":            hkeys,
+	"HVALS":            hvals,
+	"HSCAN":            hscan,
+	"HEXPIRE":          hexpire,
+	"HPEXPIRE":         hexpire,
+	"HEXPIREAT":        hexpire,
+	"HPEXPIREAT":       hexpire,
+	"HTTL":             httl,
+	"HPTTL":            httl,
+	"HPERSIST":         hpersist,
+	"ZADD":             zadd,
+	"ZSCORE":           zscore,
+	"ZMSCORE":          zmscore,
+	"ZRANDMEMBER":      zrandmember,
+	"ZCARD":            zcard,
+	"ZREM":             zrem,
+	"ZRANGE":           zrange,
+	"ZREVRANGE":        zrange,
+	"ZRANGEBYSCORE":    zrange,
+	"ZREVRANGEBYSCORE": zrange,
+	"ZCOUNT":           zcount,
+	"ZREMRANGEBYSCORE": zremrangebyscore,
+	"ZRANGEBYLEX":      zrange,
+	"ZREVRANGEBYLEX":   zrange,
+	"ZRANGESTORE":      zrangestore,
+	"ZLEXCOUNT":        zlexcount,
+	"ZREMRANGEBYLEX":   zremrangebylex,
+	"ZRANK":            zrank,
+	"ZREVRANK":         zrank,
+	"ZINCRBY":          zincrby,
+	"ZSCAN":            zscan,
+	"ZPOPMIN":          zpop,
+	"ZPOPMAX":          zpop,
+	"BZPOPMIN":         bzpop,
+	"BZPOPMAX":         bzpop,
+	"GEOADD":           geoadd,
+	"GEOPOS":           geopos,
+	"GEODIST":          geodist,
+	"GEOSEARCH":        geosearch,
+	"GEOSEARCHSTORE":   geosearchstore,
+	"BF.RESERVE":       bfreserve,
+	"BF.ADD":           bfadd,
+	"BF.MADD":          bfmadd,
+	"BF.EXISTS":        bfexists,
+	"BF.MEXISTS":       bfmexists,
+	"BF.INFO":          bfinfo,
+	"BF.SCANDUMP":      bfscandump,
+	"BF.LOADCHUNK":     bfloadchunk,
+	"CF.RESERVE":       cfreserve,
+	"CF.ADD":           cfadd,
+	"CF.ADDNX":         cfadd,
+	"CF.EXISTS":        cfexists,
+	"CF.MEXISTS":       cfexists,
+	"CF.COUNT":         cfcount,
+	"CF.DEL":           cfdel,
+	"CF.INFO":          cfinfo,
+	"CF.SCANDUMP":      cfscandump,
+	"CF.LOADCHUNK":     cfloadchunk,
+	"CMS.INITBYDIM":    cmsinitbydim,
+	"CMS.INITBYPROB":   cmsinitbyprob,
+	"CMS.INCRBY":       cmsincrby,
+	"CMS.QUERY":        cmsquery,
+	"CMS.MERGE":        cmsmerge,
+	"CMS.INFO":         cmsinfo,
+	"CMS.SCANDUMP":     cmsscandump,
+	"CMS.LOADCHUNK":    cmsloadchunk,
+	"TOPK.RESERVE":     topkreserve,
+	"TOPK.ADD":         topkadd,
+	"TOPK.INCRBY":      topkadd,
+	"TOPK.QUERY":       topkquery,
+	"TOPK.COUNT":       topkcount,
+	"TOPK.LIST":        topklist,
+	"TOPK.INFO":        topkinfo,
+	"TOPK.SCANDUMP":    topkscandump,
+	"TOPK.LOADCHUNK":   topkloadchunk,
+	"JSON.SET":         jsonset,
+	"JSON.GET":         jsonget,
+	"JSON.DEL":         jsondel,
+	"JSON.FORGET":      jsondel,
+	"JSON.NUMINCRBY":   jsonnumincrby,
+	"JSON.ARRAPPEND":   jsonarrappend,
+	"JSON.ARRINSERT":   jsonarrinsert,
+	"JSON.ARRLEN":      jsonarrlen,
+	"JSON.TYPE":        jsontype,
+	"JSON.RESP":        jsonresp,
+	"TS.CREATE":        tscreate,
+	"TS.ADD":           tsadd,
+	"TS.MADD":          tsmadd,
+	"TS.DEL":           tsdel,
+	"TS.GET":           tsget,
+	"TS.RANGE":         tsrange,
+	"TS.REVRANGE":      tsrange,
+	"TS.MRANGE":        tsmrange,
+	"TS.MREVRANGE":     tsmrange,
+	"TS.CREATERULE":    tscreaterule,
+	"TS.DELETERULE":    tsdeleterule,
+	"TS.INFO":          tsinfo,
+	"TS.SCANDUMP":      tsscandump,
+	"TS.LOADCHUNK":     tsloadchunk,
+	"FT.CREATE":        ftcreate,
+	"FT.SEARCH":        ftsearch,
+	"FT.DROPINDEX":     ftdropindex,
+	"FT.INFO":          ftinfo,
+	"FT._LIST":         ftlist,
+	"FT.TAGVALS":       fttagvals,
+	"MODULE":           module,
+	"HSCHEMA":          hschema,
+	"OFFLINE":          offline,
+	"DELAYPUSH":        delaypush,
+	"DELAYLEN":         delaylen,
 }
 
 // Handle routes the incoming command to the correct handler function.
@@ -45,12 +209,100 @@ func Handle(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	}
 
 	cmd := strings.ToUpper(args[0])
+	if c := clientOf(conn); c != nil {
+		c.lastCmd, c.lastActive = strings.ToLower(cmd), time.Now()
+		// Deferred first, so it holds the reply with its attributes.
+		defer holdReplies(c, a)()
+	}
+	if c := clientOf(conn); c != nil && (c.hints || c.proto == 3 && writeCommands[cmd] && memoryWarning() > 0) {
+		defer c.sendWithAttributes(replicationOffset(), writeCommands[cmd])
+		c.replyBuf = new(bytes.Buffer)
+	}
 	handler, ok := Handlers[cmd]
-	if !ok {
+	if c := clientOf(conn); c != nil && c.tx != nil && !transactionCommands[cmd] {
+		queueCommand(c, cmd, handler, args)
+		return
+	}
+	// Middleware may rename commands, so it sees unknown ones too.
+	if !ok && (len(middleware) == 0 || clientOf(conn) == nil) {
 		// If the command is not found, send an unknown command error to the client.
 		fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
 		return
 	}
+	dispatch(cmd, handler, args, conn, s, a)
+}
+
+// dispatch runs a command through the middleware, the client checks and
+// the alternative data sources before its handler. Only middleware sees
+// unknown commands, whose handler is nil. EXECUTE runs prepared commands
+// through it too.
+func dispatch(cmd string, handler func([]string, net.Conn, *store.Store, *aof.AOF), args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(middleware) > 0 && clientOf(conn) != nil {
+		withMiddleware(cmd, handler)(args, conn, s, a)
+		return
+	}
+	runCommand(cmd, handler, args, conn, s, a)
+}
+
+// runCommand runs a known command, once its arguments are checked against
+// its spec, through the client checks and the alternative data sources
+// before its handler.
+func runCommand(cmd string, handler func([]string, net.Conn, *store.Store, *aof.AOF), args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if refused := checkArgs(cmd, args); refused != "" {
+		fmt.Fprintf(conn, "-%s\r\n", refused)
+		rejectedCommand(cmd)
+		return
+	}
+	if c := clientOf(conn); c != nil {
+		if c.proto == 2 && !subscribedCommands[cmd] && c.subscriptions() > 0 {
+			fmt.Fprintf(conn, "-ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context\r\n", strings.ToLower(cmd))
+			rejectedCommand(cmd)
+			return
+		}
+		var denied string
+		if args, denied = checkAccess(c, cmd, args); denied != "" {
+			fmt.Fprintf(conn, "-%s\r\n", denied)
+			rejectedCommand(cmd)
+			return
+		}
+		if writeCommands[cmd] && isReplica.Load() {
+			fmt.Fprintf(conn, "-READONLY You can't write against a read only replica.\r\n")
+			rejectedCommand(cmd)
+			return
+		}
+		feedMonitors(c, args)
+		if c.noTouch {
+			s = s.WithoutTouch()
+		}
+		start := time.Now()
+		// Commands EXEC runs have replies of their own within EXEC's.
+		outer := c.reply
+		c.reply = replyState{}
+		defer func() {
+			d := time.Since(start)
+			ranCommand(cmd, d, c.reply.failed)
+			commandLatency(cmd, d)
+			recordSpan(c, cmd, start, d, c.reply.failed)
+			c.reply = outer
+		}()
+		defer func() { recordSlow(c, args, start, time.Since(start)) }()
+		written, _ := a.Offsets()
+		defer noteWrites(c, a, written)
+		defer watchCommand(c, args)()
+	}
+
+	if serveOffline(clientOf(conn), cmd, args, handler, a) {
+		return
+	}
+
+	if serveView(cmd, args, conn, s) {
+		return
+	}
+
+	// Replies to client reads of cached keys may come from the result cache.
+	if cachedCommands[cmd] && clientOf(conn) != nil && serveCached(cmd, args, conn, s, a, handler) {
+		return
+	}
 
 	// Call the handler function with the command arguments.
 	handler(args, conn, s, a)
@@ -63,46 +315,79 @@ func ping(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	fmt.Fprintf(conn, "+PONG\r\n")
 }
 
-// set handles the SET command, which stores a string key-value pair.
+// set handles the SET command, which stores a string key-value pair, with
+// the options checkArgs made sure are valid: an EX or PX TTL or KEEPTTL,
+// the NX or XX condition and GET, which replies with the previous value.
 func set(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'set' command\r\n")
-		return
-	}
 	key := args[1]
 	value := args[2]
 
-	// Handle optional TTL arguments (EX for seconds, PX for milliseconds)
-	var ttl time.Duration = 0
-	if len(args) > 3 {
-		option := strings.ToUpper(args[3])
-		if option == "EX" && len(args) > 4 {
-			seconds, err := strconv.Atoi(args[4])
-			if err == nil {
-				ttl = time.Duration(seconds) * time.Second
-			}
-		} else if option == "PX" && len(args) > 4 {
-			milliseconds, err := strconv.Atoi(args[4])
-			if err == nil {
-				ttl = time.Duration(milliseconds) * time.Millisecond
-			}
+	var ttl time.Duration
+	var opts store.SetOptions
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "EX", "PX":
+			n, _ := strconv.ParseInt(args[i+1], 10, 64)
+			now := time.Now()
+			ttl = expireAt(opt, n, now).Sub(now)
+			i++
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "KEEPTTL":
+			opts.KeepTTL = true
+		case "GET":
+			opts.Get = true
 		}
 	}
 
-	s.Set(key, value, ttl)
-	fmt.Fprintf(conn, "+OK\r\n")
+	// Values of encrypted keys are stored and logged sealed, with SETSEALED
+	// so that replaying them doesn't seal them again.
+	logged := args[0]
+	if sealed, ok := s.Seal(key, value); ok {
+		logged, value = "SETSEALED", sealed
+	}
+	res, err := s.SetWith(key, value, ttl, opts)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	switch {
+	case opts.Get && res.Existed:
+		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(res.Old), res.Old)
+	case opts.Get || !res.Set:
+		fmt.Fprintf(conn, "$-1\r\n")
+	default:
+		fmt.Fprintf(conn, "+OK\r\n")
+	}
+	if !res.Set {
+		return
+	}
 
-	// Persist the command to the AOF file.
-	// This uses a variadic function and the spread operator to pass all elements.
-	a.WriteCommand(args[0], args[1:]...)
+	// Persist the write to the AOF without its options, which don't replay
+	// the same, and with the expiration the key ended up with.
+	LogEffects(a, logged, key, value)
+	if !res.Expiration.IsZero() {
+		LogEffects(a, "PEXPIREAT", key, strconv.FormatInt(res.Expiration.UnixMilli(), 10))
+	}
 }
 
-// get handles the GET command, retrieving a string value by its key.
-func get(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'get' command\r\n")
+// setSealed handles the SETSEALED command, which SET and rewrites log the
+// sealed values of encrypted keys with, and which replays them as they are.
+// Clients can't send it, so every value they write is sealed.
+func setSealed(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if clientOf(conn) != nil {
+		fmt.Fprintf(conn, "-ERR SETSEALED is only replayed from the AOF\r\n")
 		return
 	}
+	s.SetSealed(args[1], args[2], 0)
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, args[0], args[1:]...)
+}
+
+// get handles the GET command, retrieving a string value by its key.
+func get(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	key := args[1]
 
 	val, ok := s.Get(key)
@@ -117,11 +402,6 @@ func get(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 
 // del handles the DEL command, removing one or more keys from the store.
 func del(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'del' command\r\n")
-		return
-	}
-
 	count := 0
 	for _, key := range args[1:] {
 		if s.Del(key) {
@@ -129,15 +409,11 @@ func del(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 		}
 	}
 	fmt.Fprintf(conn, ":%d\r\n", count) // RESP integer for the number of deleted keys.
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // exists handles the EXISTS command, checking for the existence of one or more keys.
 func exists(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'exists' command\r\n")
-		return
-	}
 	count := 0
 	for _, key := range args[1:] {
 		if s.Exists(key) {
@@ -147,14 +423,71 @@ func exists(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	fmt.Fprintf(conn, ":%d\r\n", count)
 }
 
+// expire handles the EXPIRE and PEXPIRE commands, which set a key's time-to-live
+// in seconds or milliseconds, and EXPIREAT and PEXPIREAT, which set the Unix
+// time it expires at. Expirations are logged as PEXPIREAT, so replaying them
+// doesn't extend them.
+func expire(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	n, _ := strconv.ParseInt(args[2], 10, 64)
+	if !s.Expire(args[1], time.Until(expireAt(cmd, n, time.Now()))) {
+		fmt.Fprintf(conn, ":0\r\n")
+		return
+	}
+	fmt.Fprintf(conn, ":1\r\n")
+	LogEffects(a, args[0], args[1:]...)
+}
+
+// persist handles the PERSIST command, which removes the expiration of a key.
+func persist(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if !s.Persist(args[1]) {
+		fmt.Fprintf(conn, ":0\r\n")
+		return
+	}
+	fmt.Fprintf(conn, ":1\r\n")
+	LogEffects(a, args[0], args[1:]...)
+}
+
+// incr handles the INCR and DECR commands, which add or subtract one from an integer value.
+func incr(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	delta := int64(1)
+	if cmd == "DECR" {
+		delta = -1
+	}
+	n, err := s.IncrBy(args[1], delta)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", n)
+	LogEffects(a, args[0], args[1:]...)
+}
+
+// incrby handles the INCRBY and DECRBY commands, which add or subtract a given amount.
+func incrby(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	delta, _ := strconv.ParseInt(args[2], 10, 64)
+	if cmd == "DECRBY" {
+		if delta == math.MinInt64 {
+			fmt.Fprintf(conn, "-ERR decrement would overflow\r\n")
+			return
+		}
+		delta = -delta
+	}
+	n, err := s.IncrBy(args[1], delta)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", n)
+	LogEffects(a, args[0], args[1:]...)
+}
+
 // --- List Commands ---
 
 // lpush handles the LPUSH command, adding one or more elements to the head of a list.
 func lpush(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'lpush' command\r\n")
-		return
-	}
 	key := args[1]
 	elements := args[2:]
 
@@ -162,15 +495,11 @@ func lpush(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	fmt.Fprintf(conn, ":%d\r\n", newLen)
 
 	// Persist the command to the AOF file.
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // lpop handles the LPOP command, removing and returning the first element of a list.
 func lpop(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'lpop' command\r\n")
-		return
-	}
 	key := args[1]
 
 	val, ok := s.Lpop(key)
@@ -180,30 +509,22 @@ func lpop(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	}
 
 	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(val), val)
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // rpush handles the RPUSH command, adding one or more elements to the tail of a list.
 func rpush(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'rpush' command\r\n")
-		return
-	}
 	key := args[1]
 	elements := args[2:]
 
 	newLen := s.Rpush(key, elements)
 	fmt.Fprintf(conn, ":%d\r\n", newLen)
 
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // rpop handles the RPOP command, removing and returning the last element of a list.
 func rpop(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'rpop' command\r\n")
-		return
-	}
 	key := args[1]
 
 	val, ok := s.Rpop(key)
@@ -213,25 +534,17 @@ func rpop(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	}
 
 	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(val), val)
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // lrange returns a range of elements from a list.
 func lrange(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) != 4 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'lrange' command\r\n")
-		return
-	}
 	key := args[1]
 
-	list := s.Lrange(key)
+	list := s.ListView(key)
 
-	start, err1 := strconv.Atoi(args[2])
-	end, err2 := strconv.Atoi(args[3])
-	if err1 != nil || err2 != nil {
-		fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
-		return
-	}
+	start, _ := strconv.Atoi(args[2])
+	end, _ := strconv.Atoi(args[3])
 
 	if list == nil {
 		fmt.Fprintf(conn, "*0\r\n")
@@ -258,78 +571,94 @@ func lrange(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 		end = len(list) - 1
 	}
 
-	// Get the sub-slice and return it in RESP array format.
+	// Get the sub-slice and return it in RESP array format. The list is
+	// read in place and streamed, so a huge range isn't copied first.
 	sublist := list[start : end+1]
-	fmt.Fprintf(conn, "*%d\r\n", len(sublist))
+	reply := newReplyStream(conn, len(sublist))
 	for _, item := range sublist {
-		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(item), item)
+		reply.bulk(item)
 	}
+	reply.end()
 }
 
 // --- Set Commands ---
 
 // sadd adds one or more members to a set.
 func sadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'sadd' command\r\n")
-		return
-	}
 	key := args[1]
 	members := args[2:]
 	count := s.Sadd(key, members)
 	fmt.Fprintf(conn, ":%d\r\n", count)
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // srem removes one or more members from a set.
 func srem(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'srem' command\r\n")
-		return
-	}
 	key := args[1]
 	members := args[2:]
 	count := s.Srem(key, members)
 	fmt.Fprintf(conn, ":%d\r\n", count)
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // smembers returns all members of the set.
 func smembers(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'smembers' command\r\n")
+	n, each := s.SetView(args[1])
+	reply := newReplyStream(conn, n)
+	each(reply.bulk)
+	reply.end()
+}
+
+// smove atomically moves a member from one set to another.
+func smove(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	moved, err := s.Smove(args[1], args[2], args[3])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
 		return
 	}
-	key := args[1]
-	members := s.Smembers(key)
-	fmt.Fprintf(conn, "*%d\r\n", len(members))
-	for _, member := range members {
-		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(member), member)
+	if !moved {
+		fmt.Fprintf(conn, ":0\r\n")
+		return
 	}
+	fmt.Fprintf(conn, ":1\r\n")
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // --- Hash Commands ---
 
-// hset handles the HSET command, which sets a field in a hash.
+// hset handles the HSET command, which sets one or more fields in a hash.
 func hset(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 4 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'hset' command\r\n")
+	key := args[1]
+	if violation := checkHashSchema(key, args[2:]); violation != "" {
+		fmt.Fprintf(conn, "-%s\r\n", violation)
 		return
 	}
-	key := args[1]
-	field := args[2]
-	value := args[3]
-	addedCount := s.HSet(key, field, value)
+	addedCount := s.HSet(key, args[2:])
 	fmt.Fprintf(conn, ":%d\r\n", addedCount)
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
-// hget handles the HGET command, which retrieves a value from a hash.
-func hget(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'hget' command\r\n")
+// hsetnx handles the HSETNX command, which sets a hash field only if it does not exist.
+func hsetnx(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if violation := checkHashSchema(args[1], args[2:]); violation != "" {
+		fmt.Fprintf(conn, "-%s\r\n", violation)
+		return
+	}
+	added, err := s.HSetNX(args[1], args[2], args[3])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
 		return
 	}
+	if !added {
+		fmt.Fprintf(conn, ":0\r\n")
+		return
+	}
+	fmt.Fprintf(conn, ":1\r\n")
+	LogEffects(a, args[0], args[1:]...)
+}
+
+// hget handles the HGET command, which retrieves a value from a hash.
+func hget(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 	key := args[1]
 	field := args[2]
 	val, ok := s.HGet(key, field)
@@ -342,32 +671,52 @@ func hget(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
 
 // hdel handles the HDEL command, which deletes a field from a hash.
 func hdel(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 3 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'hdel' command\r\n")
-		return
-	}
 	key := args[1]
 	fields := args[2:]
 	deletedCount := s.HDel(key, fields)
 	fmt.Fprintf(conn, ":%d\r\n", deletedCount)
-	a.WriteCommand(args[0], args[1:]...)
+	LogEffects(a, args[0], args[1:]...)
 }
 
 // hgetall handles the HGETALL command, which returns all fields and values of a hash.
 func hgetall(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
-	if len(args) < 2 {
-		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'hgetall' command\r\n")
-		return
-	}
-	key := args[1]
-	hash := s.HGetAll(key)
-	if hash == nil {
-		fmt.Fprintf(conn, "*0\r\n")
+	n, each := s.HashView(args[1])
+	reply := newMapReplyStream(conn, n)
+	each(func(field, value string) {
+		reply.bulk(field)
+		reply.bulk(value)
+	})
+	reply.end()
+}
+
+// hexists handles the HEXISTS command, which checks whether a field exists in a hash.
+func hexists(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if s.HExists(args[1], args[2]) {
+		fmt.Fprintf(conn, ":1\r\n")
 		return
 	}
-	fmt.Fprintf(conn, "*%d\r\n", len(hash)*2)
-	for field, value := range hash {
+	fmt.Fprintf(conn, ":0\r\n")
+}
+
+// hlen handles the HLEN command, which returns the number of fields in a hash.
+func hlen(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	fmt.Fprintf(conn, ":%d\r\n", s.HLen(args[1]))
+}
+
+// hkeys handles the HKEYS command, which returns all field names of a hash.
+func hkeys(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	fields := s.HKeys(args[1])
+	fmt.Fprintf(conn, "*%d\r\n", len(fields))
+	for _, field := range fields {
 		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(field), field)
+	}
+}
+
+// hvals handles the HVALS command, which returns all values of a hash.
+func hvals(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	values := s.HVals(args[1])
+	fmt.Fprintf(conn, "*%d\r\n", len(values))
+	for _, value := range values {
 		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
 	}
 }
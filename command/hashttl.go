@@ -0,0 +1,132 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// parseFieldsArg parses the "FIELDS numfields field [field ...]" tail shared by
+// the hash field TTL commands, writing an error reply on bad input.
+func parseFieldsArg(args []string, conn net.Conn) ([]string, bool) {
+	if len(args) < 3 || strings.ToUpper(args[0]) != "FIELDS" {
+		fmt.Fprintf(conn, "-ERR Mandatory argument FIELDS is missing or not at the right position\r\n")
+		return nil, false
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n <= 0 {
+		fmt.Fprintf(conn, "-ERR Parameter `numFields` should be greater than 0\r\n")
+		return nil, false
+	}
+	if n != len(args)-2 {
+		fmt.Fprintf(conn, "-ERR The `numfields` parameter must match the number of arguments\r\n")
+		return nil, false
+	}
+	return args[2:], true
+}
+
+// hexpire handles HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT, which set the
+// expiration of individual hash fields.
+func hexpire(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || n < 0 {
+		fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+		return
+	}
+	var at time.Time
+	switch cmd {
+	case "HEXPIRE":
+		at = time.Now().Add(time.Duration(n) * time.Second)
+	case "HPEXPIRE":
+		at = time.Now().Add(time.Duration(n) * time.Millisecond)
+	case "HEXPIREAT":
+		at = time.Unix(n, 0)
+	case "HPEXPIREAT":
+		at = time.UnixMilli(n)
+	}
+
+	rest := args[3:]
+	condition := ""
+	switch strings.ToUpper(rest[0]) {
+	case "NX", "XX", "GT", "LT":
+		condition = strings.ToUpper(rest[0])
+		rest = rest[1:]
+	}
+	fields, ok := parseFieldsArg(rest, conn)
+	if !ok {
+		return
+	}
+
+	results, err := s.HExpire(args[1], at, condition, fields)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(results))
+	var changed []string
+	for i, result := range results {
+		fmt.Fprintf(conn, ":%d\r\n", result)
+		if result == store.FieldUpdated || result == store.FieldDeleted {
+			changed = append(changed, fields[i])
+		}
+	}
+
+	// Persist the absolute expiration of the fields that actually changed, so
+	// replaying the AOF neither extends TTLs nor re-evaluates the condition.
+	if len(changed) > 0 {
+		aofArgs := []string{args[1], strconv.FormatInt(at.UnixMilli(), 10), "FIELDS", strconv.Itoa(len(changed))}
+		LogEffects(a, "HPEXPIREAT", append(aofArgs, changed...)...)
+	}
+}
+
+// httl handles HTTL and HPTTL, which return the remaining TTL of hash fields
+// in seconds or milliseconds.
+func httl(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	fields, ok := parseFieldsArg(args[2:], conn)
+	if !ok {
+		return
+	}
+	results, err := s.HTTL(args[1], fields)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(results))
+	for _, ms := range results {
+		if ms >= 0 && cmd == "HTTL" {
+			ms = (ms + 500) / 1000
+		}
+		fmt.Fprintf(conn, ":%d\r\n", ms)
+	}
+}
+
+// hpersist handles HPERSIST, which removes the expiration of hash fields.
+func hpersist(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	fields, ok := parseFieldsArg(args[2:], conn)
+	if !ok {
+		return
+	}
+	results, err := s.HPersist(args[1], fields)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(results))
+	persisted := false
+	for _, result := range results {
+		fmt.Fprintf(conn, ":%d\r\n", result)
+		if result == store.FieldUpdated {
+			persisted = true
+		}
+	}
+	if persisted {
+		LogEffects(a, args[0], args[1:]...)
+	}
+}
@@ -0,0 +1,159 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// serverVersion is the Redis version reported to clients by HELLO, whose
+// command set this server follows.
+const serverVersion = "7.2.0"
+
+// hello handles the HELLO command:
+// HELLO [protover [AUTH user pass] [HINTS] [TRACEID id]]. It switches the
+// connection to RESP2 or RESP3 and replies with the connection's
+// properties, as a map under RESP3. TRACEID sets the connection's trace ID,
+// as CLIENT TRACEID does.
+//
+// HINTS, a RESP3 extension, makes every reply that follows carry an
+// attribute with the replication offset after the command ran and whether
+// the command changed it. A proxy routing reads to replicas can send a read
+// to a replica once its offset caught up with the offset of the client's
+// last write, which gives the client read-your-writes consistency.
+func hello(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	proto, hints := 2, false
+	if c != nil {
+		proto, hints = c.proto, c.hints
+	}
+	var user, password, traceID string
+	authenticating, settingTrace := false, false
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(conn, "-ERR Protocol version is not an integer or out of range\r\n")
+			return
+		}
+		if v != 2 && v != 3 {
+			fmt.Fprintf(conn, "-NOPROTO unsupported protocol version\r\n")
+			return
+		}
+		proto, hints = v, false
+		for i := 2; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); {
+			case opt == "AUTH" && i+2 < len(args):
+				user, password, authenticating = args[i+1], args[i+2], true
+				i += 2
+			case opt == "HINTS":
+				hints = true
+			case opt == "TRACEID" && i+1 < len(args):
+				if strings.ContainsAny(args[i+1], " \r\n") {
+					fmt.Fprintf(conn, "-ERR trace-id cannot contain spaces, newlines or special characters.\r\n")
+					return
+				}
+				traceID, settingTrace = args[i+1], true
+				i++
+			default:
+				fmt.Fprintf(conn, "-ERR Syntax error in HELLO option '%s'\r\n", args[i])
+				return
+			}
+		}
+	}
+	if hints && proto != 3 {
+		fmt.Fprintf(conn, "-ERR HINTS requires protocol version 3\r\n")
+		return
+	}
+	if c != nil && c.User == nil && !authenticating {
+		fmt.Fprintf(conn, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n")
+		return
+	}
+
+	reply := func() {
+		var id int64
+		if c != nil {
+			c.proto, c.hints = proto, hints
+			if settingTrace {
+				c.TraceID = traceID
+			}
+			id = c.ID
+		}
+		writeHello(conn, proto, id)
+	}
+	if authenticating {
+		login(c, conn, user, password, reply)
+		return
+	}
+	reply()
+}
+
+// writeHello writes the HELLO reply.
+func writeHello(conn net.Conn, proto int, id int64) {
+	var b bytes.Buffer
+	if proto == 3 {
+		b.WriteString("%7\r\n")
+	} else {
+		b.WriteString("*14\r\n")
+	}
+	field := func(name, value string) {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(name), name, len(value), value)
+	}
+	field("server", "redis")
+	field("version", serverVersion)
+	fmt.Fprintf(&b, "$5\r\nproto\r\n:%d\r\n", proto)
+	fmt.Fprintf(&b, "$2\r\nid\r\n:%d\r\n", id)
+	field("mode", "standalone")
+	role := "master"
+	if isReplica.Load() {
+		role = "replica"
+	}
+	field("role", role)
+	b.WriteString("$7\r\nmodules\r\n*0\r\n")
+	conn.Write(b.Bytes())
+}
+
+// replicationOffset returns the current replication offset.
+func replicationOffset() int64 {
+	replication.Lock()
+	defer replication.Unlock()
+	return replication.offset
+}
+
+// sendWithAttributes sends the reply collected in replyBuf, preceded by an
+// attribute with the replication offset and whether the command changed it
+// from before, the offset when the command started, if the client asked for
+// hints, and with the memory pressure watermark for a write while memory
+// use is above one. Replies the command left to deferred work, such as those
+// of blocking commands, carry no attribute.
+func (c *Client) sendWithAttributes(before int64, write bool) {
+	reply := c.replyBuf
+	c.replyBuf = nil
+	if reply.Len() == 0 {
+		return
+	}
+	var attrs bytes.Buffer
+	n := 0
+	if c.hints {
+		offset := replicationOffset()
+		dirty := "f"
+		if offset != before {
+			dirty = "t"
+		}
+		fmt.Fprintf(&attrs, "+repl-offset\r\n:%d\r\n+dirty\r\n#%s\r\n", offset, dirty)
+		n += 2
+	}
+	if watermark := memoryWarning(); write && c.proto == 3 && watermark > 0 {
+		fmt.Fprintf(&attrs, "+memory-pressure\r\n:%d\r\n", watermark)
+		n++
+	}
+	if n > 0 {
+		fmt.Fprintf(c, "|%d\r\n", n)
+		c.Write(attrs.Bytes())
+	}
+	c.Write(reply.Bytes())
+}
@@ -0,0 +1,187 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Hash schemas guard hashes used as records against typos and bad values.
+// A schema declares the fields of the hashes at keys matching a pattern and
+// the type of each, and HSET and HSETNX refuse to write a field of the wrong
+// type or, for a strict schema, one it doesn't declare. Fields already in a
+// hash aren't checked, and like ACL users, schemas live in memory only, so
+// they are declared again when the server starts.
+
+// hashFieldTypes checks the values of each field type.
+var hashFieldTypes = map[string]func(string) bool{
+	"string": func(string) bool { return true },
+	"int": func(v string) bool {
+		_, err := strconv.ParseInt(v, 10, 64)
+		return err == nil
+	},
+	"float": func(v string) bool {
+		_, err := strconv.ParseFloat(v, 64)
+		return err == nil
+	},
+	"bool": func(v string) bool {
+		switch strings.ToLower(v) {
+		case "0", "1", "true", "false":
+			return true
+		}
+		return false
+	},
+}
+
+// hashSchema is the schema of the hashes at keys matching pattern.
+type hashSchema struct {
+	pattern string
+	strict  bool
+	// fields maps the declared fields to their types, in the order of
+	// order.
+	fields map[string]string
+	order  []string
+}
+
+// hashSchemas holds the declared schemas in the order they were declared,
+// which is the order they are matched in.
+var hashSchemas struct {
+	sync.RWMutex
+	list []*hashSchema
+}
+
+// String formats the schema as the arguments of HSCHEMA SET.
+func (hs *hashSchema) String() string {
+	parts := []string{hs.pattern}
+	if hs.strict {
+		parts = append(parts, "STRICT")
+	}
+	for _, field := range hs.order {
+		parts = append(parts, field, hs.fields[field])
+	}
+	return strings.Join(parts, " ")
+}
+
+// checkHashSchema checks field-value pairs about to be written to the hash
+// at key against the first schema matching it, returning the error reply
+// (without the leading '-') for the first violation.
+func checkHashSchema(key string, pairs []string) string {
+	hashSchemas.RLock()
+	defer hashSchemas.RUnlock()
+	for _, hs := range hashSchemas.list {
+		if !store.MatchPattern(hs.pattern, key) {
+			continue
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			field, value := pairs[i], pairs[i+1]
+			typ, declared := hs.fields[field]
+			if !declared {
+				if hs.strict {
+					return fmt.Sprintf("SCHEMA field '%s' is not in the schema for '%s'", field, hs.pattern)
+				}
+				continue
+			}
+			if !hashFieldTypes[typ](value) {
+				return fmt.Sprintf("SCHEMA field '%s' of the schema for '%s' must be of type %s", field, hs.pattern, typ)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// hschema handles the HSCHEMA command:
+//
+//	HSCHEMA SET pattern [STRICT] field type [field type ...]
+//	HSCHEMA DEL pattern
+//	HSCHEMA GET pattern
+//	HSCHEMA LIST
+//
+// The types are string, int, float and bool (0, 1, true or false). SET
+// replaces any schema for the same pattern, keeping its place in the order
+// schemas are matched in. GET and LIST describe schemas as the arguments of
+// SET.
+func hschema(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	switch sub := strings.ToUpper(args[1]); sub {
+	case "SET":
+		if len(args) < 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'hschema|set' command\r\n")
+			return
+		}
+		hs := &hashSchema{pattern: args[2], fields: make(map[string]string)}
+		rest := args[3:]
+		if len(rest) > 0 && strings.EqualFold(rest[0], "STRICT") {
+			hs.strict = true
+			rest = rest[1:]
+		}
+		if len(rest) == 0 || len(rest)%2 != 0 {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		for i := 0; i < len(rest); i += 2 {
+			field, typ := rest[i], strings.ToLower(rest[i+1])
+			if _, ok := hashFieldTypes[typ]; !ok {
+				fmt.Fprintf(conn, "-ERR unknown field type '%s', expected string, int, float or bool\r\n", rest[i+1])
+				return
+			}
+			if _, dup := hs.fields[field]; dup {
+				fmt.Fprintf(conn, "-ERR field '%s' is declared twice\r\n", field)
+				return
+			}
+			hs.fields[field] = typ
+			hs.order = append(hs.order, field)
+		}
+		hashSchemas.Lock()
+		replaced := false
+		for i, old := range hashSchemas.list {
+			if old.pattern == hs.pattern {
+				hashSchemas.list[i] = hs
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			hashSchemas.list = append(hashSchemas.list, hs)
+		}
+		hashSchemas.Unlock()
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "DEL", "GET":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'hschema|%s' command\r\n", strings.ToLower(sub))
+			return
+		}
+		hashSchemas.Lock()
+		defer hashSchemas.Unlock()
+		for i, hs := range hashSchemas.list {
+			if hs.pattern != args[2] {
+				continue
+			}
+			if sub == "GET" {
+				writeBulk(conn, hs.String())
+				return
+			}
+			hashSchemas.list = append(hashSchemas.list[:i], hashSchemas.list[i+1:]...)
+			fmt.Fprintf(conn, ":1\r\n")
+			return
+		}
+		if sub == "GET" {
+			fmt.Fprintf(conn, "$-1\r\n")
+		} else {
+			fmt.Fprintf(conn, ":0\r\n")
+		}
+	case "LIST":
+		hashSchemas.RLock()
+		defer hashSchemas.RUnlock()
+		fmt.Fprintf(conn, "*%d\r\n", len(hashSchemas.list))
+		for _, hs := range hashSchemas.list {
+			writeBulk(conn, hs.String())
+		}
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,176 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// infoSection renders one section of the INFO reply, without its header.
+// Sections that aren't default are only reported when asked for by name,
+// or with "all" or "everything".
+type infoSection struct {
+	name       string
+	render     func(s *store.Store, a *aof.AOF) string
+	notDefault bool
+}
+
+// infoSections lists the INFO sections in the order they are reported.
+var infoSections = []infoSection{
+	{"server", infoServer, false},
+	{"clients", infoClients, false},
+	{"memory", infoMemory, false},
+	{"stats", infoStats, false},
+	{"persistence", infoPersistence, false},
+	{"replication", infoReplication, false},
+	{"watchdog", infoWatchdog, false},
+	{"commandstats", infoCommandStats, true},
+	{"latencystats", infoLatencyStats, true},
+}
+
+// ServerInfo, when set by the server, returns extra lines for the server
+// section that only the server knows about, such as its scheduler settings.
+var ServerInfo func() string
+
+// startTime is when the process started, for uptime reporting.
+var startTime = time.Now()
+
+// info handles the INFO command. With no argument, or "default", the
+// default sections are returned, with "all" or "everything" every section
+// is; otherwise only the named sections are.
+func info(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	wanted := make(map[string]bool)
+	for _, arg := range args[1:] {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := wanted["all"] || wanted["everything"]
+	defaults := len(wanted) == 0 || wanted["default"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !(defaults && !section.notDefault) && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(section.name[:1]), section.name[1:])
+		b.WriteString(section.render(s, a))
+	}
+	reply := b.String()
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(reply), reply)
+}
+
+// infoServer renders the server section.
+func infoServer(s *store.Store, a *aof.AOF) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(time.Since(startTime).Seconds()))
+	if ServerInfo != nil {
+		b.WriteString(ServerInfo())
+	}
+	return b.String()
+}
+
+// infoClients renders the clients section, including how many connections
+// each client library and version accounts for.
+func infoClients(s *store.Store, a *aof.AOF) string {
+	connected := connectedClients()
+	libs := make(map[string]int)
+	for _, c := range connected {
+		if c.LibName == "" && c.LibVer == "" {
+			continue
+		}
+		libs[fmt.Sprintf("name=%s,ver=%s", c.LibName, c.LibVer)]++
+	}
+	names := make([]string, 0, len(libs))
+	for name := range libs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "connected_clients:%d\r\n", len(connected))
+	for i, name := range names {
+		fmt.Fprintf(&b, "client_lib%d:%s,connected=%d\r\n", i, name, libs[name])
+	}
+	return b.String()
+}
+
+// infoPersistence renders the persistence section.
+func infoPersistence(s *store.Store, a *aof.AOF) string {
+	st := a.Status()
+	enabled, rewriting, rewriteStatus := 0, 0, "ok"
+	if st.Enabled {
+		enabled = 1
+	}
+	if st.Rewriting {
+		rewriting = 1
+	}
+	if st.LastRewriteErr != nil {
+		rewriteStatus = "err"
+	}
+	snapshots := snapshotStatus(a)
+	bgsaving, bgsaveStatus := 0, "ok"
+	if snapshots.running {
+		bgsaving = 1
+	}
+	if snapshots.failed {
+		bgsaveStatus = "err"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", snapshots.changes)
+	fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", bgsaving)
+	fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", snapshots.lastSave.Unix())
+	fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", bgsaveStatus)
+	fmt.Fprintf(&b, "aof_enabled:%d\r\n", enabled)
+	fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", rewriting)
+	fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", rewriteStatus)
+	b.WriteString(infoWriteBehind())
+	return b.String()
+}
+
+// infoStats renders the stats section.
+func infoStats(s *store.Store, a *aof.AOF) string {
+	var b strings.Builder
+	keyspace := s.KeyspaceStats()
+	fmt.Fprintf(&b, "keyspace_hits:%d\r\n", keyspace.Hits)
+	fmt.Fprintf(&b, "keyspace_misses:%d\r\n", keyspace.Misses)
+	fmt.Fprintf(&b, "expired_keys:%d\r\n", keyspace.Expired)
+	// Keys are never evicted: maxmemory only sets the memory pressure
+	// watermarks. The field is there for tools that expect it.
+	fmt.Fprintf(&b, "evicted_keys:0\r\n")
+	fmt.Fprintf(&b, "evicted_clients:%d\r\n", evictedClients())
+	resultCache.Lock()
+	fmt.Fprintf(&b, "result_cache_entries:%d\r\n", len(resultCache.entries))
+	fmt.Fprintf(&b, "result_cache_hits:%d\r\n", resultCache.hits)
+	fmt.Fprintf(&b, "result_cache_misses:%d\r\n", resultCache.misses)
+	resultCache.Unlock()
+	b.WriteString(infoTracing())
+
+	// Shard balance and contention, detailed per shard by DEBUG SHARDS.
+	minKeys, maxKeys := -1, 0
+	var contended int64
+	var wait time.Duration
+	for _, st := range s.ShardStats() {
+		if minKeys < 0 || st.Keys < minKeys {
+			minKeys = st.Keys
+		}
+		maxKeys = max(maxKeys, st.Keys)
+		contended += st.Contended
+		wait += st.LockWait
+	}
+	fmt.Fprintf(&b, "shard_keys_min:%d\r\n", minKeys)
+	fmt.Fprintf(&b, "shard_keys_max:%d\r\n", maxKeys)
+	fmt.Fprintf(&b, "shard_lock_contended:%d\r\n", contended)
+	fmt.Fprintf(&b, "shard_lock_wait_usec:%d\r\n", wait.Microseconds())
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The JSON.* commands follow RedisJSON's. Paths starting with '$' are
+// JSONPath, supporting members (.a, ['a']), indexes ([0], [-1], [0,2]),
+// slices ([1:3]), wildcards (.*, [*]) and recursive descent (..a), and
+// commands reply with a result for each value they match. Other paths are
+// RedisJSON's legacy ones, which reply with a single result and fail if
+// nothing matches. Paths default to the legacy root, ".".
+
+// isLegacyJSONPath reports whether path is a legacy path.
+func isLegacyJSONPath(path string) bool {
+	return !strings.HasPrefix(path, "$")
+}
+
+// jsonPathArg returns the optional path argument at i, or the root.
+func jsonPathArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return "."
+}
+
+// jsonset handles JSON.SET key path value [NX|XX].
+func jsonset(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	var nx, xx bool
+	if len(args) == 5 {
+		switch strings.ToUpper(args[4]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+	set, err := s.JSONSet(args[1], args[2], args[3], nx, xx)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if !set {
+		fmt.Fprintf(conn, "$-1\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "JSON.SET", args[1:]...)
+}
+
+// jsonget handles JSON.GET key [INDENT indent] [NEWLINE newline]
+// [SPACE space] [path ...].
+func jsonget(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	var format store.JSONFormat
+	i := 2
+	for ; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "INDENT":
+			format.Indent = args[i+1]
+			continue
+		case "NEWLINE":
+			format.Newline = args[i+1]
+			continue
+		case "SPACE":
+			format.Space = args[i+1]
+			continue
+		}
+		break
+	}
+	paths := args[i:]
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	doc, ok, err := s.JSONGet(args[1], paths, format)
+	switch {
+	case err != nil:
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	case !ok:
+		fmt.Fprintf(conn, "$-1\r\n")
+	default:
+		writeBulk(conn, doc)
+	}
+}
+
+// jsondel handles JSON.DEL key [path] and its alias JSON.FORGET, replying
+// with the number of values deleted.
+func jsondel(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	n, err := s.JSONDel(args[1], jsonPathArg(args, 2))
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", n)
+	if n > 0 {
+		LogEffects(a, "JSON.DEL", args[1:]...)
+	}
+}
+
+// jsonnumincrby handles JSON.NUMINCRBY key path number, replying with the
+// new value, or a JSON array of the new values of a JSONPath, with null for
+// values that aren't numbers.
+func jsonnumincrby(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	results, err := s.JSONNumIncrBy(args[1], args[2], args[3])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if isLegacyJSONPath(args[2]) {
+		n, ok := results[0].(json.Number)
+		if !ok {
+			fmt.Fprintf(conn, "-WRONGTYPE wrong type of path value - expected a number\r\n")
+			return
+		}
+		writeBulk(conn, string(n))
+	} else {
+		var b strings.Builder
+		b.WriteByte('[')
+		for i, result := range results {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if n, ok := result.(json.Number); ok {
+				b.WriteString(string(n))
+			} else {
+				b.WriteString("null")
+			}
+		}
+		b.WriteByte(']')
+		writeBulk(conn, b.String())
+	}
+	LogEffects(a, "JSON.NUMINCRBY", args[1:]...)
+}
+
+// jsonarrappend handles JSON.ARRAPPEND key path value [value ...], replying
+// with the new length of each array.
+func jsonarrappend(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	results, err := s.JSONArrAppend(args[1], args[2], args[3:])
+	if writeJSONLengths(conn, args[2], results, err) {
+		LogEffects(a, "JSON.ARRAPPEND", args[1:]...)
+	}
+}
+
+// jsonarrinsert handles JSON.ARRINSERT key path index value [value ...],
+// inserting the values before index, which may count from the end when
+// negative, and replying with the new length of each array.
+func jsonarrinsert(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	index, _ := strconv.Atoi(args[3])
+	results, err := s.JSONArrInsert(args[1], args[2], index, args[4:])
+	if writeJSONLengths(conn, args[2], results, err) {
+		LogEffects(a, "JSON.ARRINSERT", args[1:]...)
+	}
+}
+
+// jsonarrlen handles JSON.ARRLEN key [path].
+func jsonarrlen(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	path := jsonPathArg(args, 2)
+	results, ok, err := s.JSONArrLen(args[1], path)
+	if err == nil && !ok {
+		fmt.Fprintf(conn, "$-1\r\n")
+		return
+	}
+	writeJSONLengths(conn, path, results, err)
+}
+
+// writeJSONLengths writes the array lengths the ARR commands return: the
+// first for a legacy path, which must be an array, or all of them, with nil
+// for values that aren't arrays. It reports whether they were written
+// rather than an error.
+func writeJSONLengths(conn net.Conn, path string, results []any, err error) bool {
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return false
+	}
+	if isLegacyJSONPath(path) {
+		n, ok := results[0].(int64)
+		if !ok {
+			fmt.Fprintf(conn, "-WRONGTYPE wrong type of path value - expected an array\r\n")
+			return false
+		}
+		fmt.Fprintf(conn, ":%d\r\n", n)
+		return true
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(results))
+	for _, result := range results {
+		if n, ok := result.(int64); ok {
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		} else {
+			fmt.Fprintf(conn, "$-1\r\n")
+		}
+	}
+	return true
+}
+
+// jsontype handles JSON.TYPE key [path].
+func jsontype(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	path := jsonPathArg(args, 2)
+	types, ok, err := s.JSONTypes(args[1], path)
+	switch {
+	case err != nil:
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	case !ok:
+		fmt.Fprintf(conn, "$-1\r\n")
+	case isLegacyJSONPath(path):
+		fmt.Fprintf(conn, "+%s\r\n", types[0])
+	default:
+		fmt.Fprintf(conn, "*%d\r\n", len(types))
+		for _, t := range types {
+			writeBulk(conn, t)
+		}
+	}
+}
+
+// jsonresp handles JSON.RESP key [path], replying with the value in RESP
+// form: null as nil, booleans as simple strings, integers as integers,
+// other numbers and strings as bulk strings, arrays as "[" followed by
+// their elements and objects as "{" followed by their members' keys and
+// values.
+func jsonresp(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	path := jsonPathArg(args, 2)
+	values, ok, err := s.JSONValues(args[1], path)
+	switch {
+	case err != nil:
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	case !ok:
+		fmt.Fprintf(conn, "$-1\r\n")
+	case isLegacyJSONPath(path):
+		writeJSONResp(conn, values[0])
+	default:
+		fmt.Fprintf(conn, "*%d\r\n", len(values))
+		for _, v := range values {
+			writeJSONResp(conn, v)
+		}
+	}
+}
+
+// writeJSONResp writes a value JSONValues returned as JSON.RESP does.
+func writeJSONResp(conn net.Conn, v any) {
+	switch v := v.(type) {
+	case bool:
+		fmt.Fprintf(conn, "+%t\r\n", v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		} else {
+			writeBulk(conn, string(v))
+		}
+	case string:
+		writeBulk(conn, v)
+	case []any:
+		fmt.Fprintf(conn, "*%d\r\n+[\r\n", len(v)+1)
+		for _, elem := range v {
+			writeJSONResp(conn, elem)
+		}
+	case []store.JSONMember:
+		fmt.Fprintf(conn, "*%d\r\n+{\r\n", 2*len(v)+1)
+		for _, m := range v {
+			writeBulk(conn, m.Key)
+			writeJSONResp(conn, m.Value)
+		}
+	default:
+		fmt.Fprintf(conn, "$-1\r\n")
+	}
+}
@@ -0,0 +1,268 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// latencyHistoryLen is the number of samples kept per event, as in Redis.
+const latencyHistoryLen = 160
+
+// latencySample is the worst latency of an event within one second.
+type latencySample struct {
+	time    time.Time
+	latency time.Duration
+}
+
+// latencyEvent is the history of the spikes of one kind of event, oldest
+// first, and the worst one recorded since the last reset.
+type latencyEvent struct {
+	samples []latencySample
+	max     time.Duration
+}
+
+// latency is the latency monitor. It records the events lasting threshold
+// or more; a zero threshold disables it, which is the default. The events
+// are:
+//
+//	command           commands with a complexity worse than O(1)
+//	fast-command      O(1) commands
+//	aof-fsync-always  fsyncs of the AOF after a command, with appendfsync always
+//	aof-fsync-sec     background fsyncs of the AOF, with appendfsync everysec
+//	expire-cycle      background expiration cycles
+//	fork              copies of the dataset made for snapshots, which other
+//	                  clients wait for the way a Redis fork makes them
+var latency = struct {
+	sync.Mutex
+	threshold time.Duration
+	events    map[string]*latencyEvent
+}{events: make(map[string]*latencyEvent)}
+
+// SetupLatencyMonitor sets the threshold of the latency monitor, zero
+// disabling it, and has the AOF report its fsyncs and rewrite snapshots.
+func SetupLatencyMonitor(a *aof.AOF, threshold time.Duration) {
+	latency.Lock()
+	latency.threshold = threshold
+	latency.Unlock()
+	a.SetLatencyMonitor(LatencyEvent)
+}
+
+// LatencyEvent records that event took d if that reaches the latency
+// monitor's threshold. Spikes within the same second are merged into one
+// sample of the worst of them.
+func LatencyEvent(event string, d time.Duration) {
+	latency.Lock()
+	defer latency.Unlock()
+	if latency.threshold <= 0 || d < latency.threshold {
+		return
+	}
+	e := latency.events[event]
+	if e == nil {
+		e = &latencyEvent{}
+		latency.events[event] = e
+	}
+	e.max = max(e.max, d)
+	now := time.Now().Truncate(time.Second)
+	if n := len(e.samples); n > 0 && e.samples[n-1].time.Equal(now) {
+		e.samples[n-1].latency = max(e.samples[n-1].latency, d)
+		return
+	}
+	e.samples = append(e.samples, latencySample{time: now, latency: d})
+	if len(e.samples) > latencyHistoryLen {
+		e.samples = e.samples[1:]
+	}
+}
+
+// commandLatency records the run time of a command with the latency monitor.
+func commandLatency(cmd string, d time.Duration) {
+	event := "command"
+	if _, ok := commandComplexity[cmd]; !ok {
+		event = "fast-command"
+	}
+	LatencyEvent(event, d)
+}
+
+// snapshotStore copies the dataset for a snapshot, recording the pause with
+// the latency monitor.
+func snapshotStore(s *store.Store) *store.Store {
+	start := time.Now()
+	snapshot := store.NewStore()
+	s.CopyTo(snapshot)
+	LatencyEvent("fork", time.Since(start))
+	return snapshot
+}
+
+// latencyCmd handles the LATENCY command:
+//
+//	LATENCY LATEST              the latest and worst spike of every event
+//	LATENCY HISTORY event       the spikes of an event, oldest first
+//	LATENCY RESET [event ...]   forget the spikes of the events, or all of them
+//	LATENCY DOCTOR              a report of the spikes, with advice
+//	LATENCY HISTOGRAM [cmd ...] the run times of the commands, or of all
+//	                            those called
+//
+// Latencies are reported in milliseconds and times as Unix timestamps,
+// except for histograms, whose buckets are in microseconds.
+func latencyCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	latency.Lock()
+	defer latency.Unlock()
+	switch strings.ToUpper(args[1]) {
+	case "LATEST":
+		names := latencyEventNames()
+		fmt.Fprintf(conn, "*%d\r\n", len(names))
+		for _, name := range names {
+			e := latency.events[name]
+			last := e.samples[len(e.samples)-1]
+			fmt.Fprintf(conn, "*4\r\n")
+			writeBulk(conn, name)
+			fmt.Fprintf(conn, ":%d\r\n:%d\r\n:%d\r\n", last.time.Unix(), last.latency.Milliseconds(), e.max.Milliseconds())
+		}
+	case "HISTORY":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'latency|history' command\r\n")
+			return
+		}
+		var samples []latencySample
+		if e := latency.events[args[2]]; e != nil {
+			samples = e.samples
+		}
+		fmt.Fprintf(conn, "*%d\r\n", len(samples))
+		for _, sample := range samples {
+			fmt.Fprintf(conn, "*2\r\n:%d\r\n:%d\r\n", sample.time.Unix(), sample.latency.Milliseconds())
+		}
+	case "RESET":
+		reset := 0
+		if len(args) == 2 {
+			reset = len(latency.events)
+			clear(latency.events)
+		}
+		for _, name := range args[2:] {
+			if _, ok := latency.events[name]; ok {
+				delete(latency.events, name)
+				reset++
+			}
+		}
+		fmt.Fprintf(conn, ":%d\r\n", reset)
+	case "DOCTOR":
+		writeBulk(conn, latencyDoctor())
+	case "HISTOGRAM":
+		latencyHistograms(conn, args[2:])
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// latencyEventNames returns the names of the events with spikes, sorted.
+// The caller must hold the latency lock.
+func latencyEventNames() []string {
+	names := make([]string, 0, len(latency.events))
+	for name := range latency.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// latencyAdvice suggests what to look into for the spikes of each event.
+var latencyAdvice = map[string]string{
+	"command":          "Check SLOWLOG GET for the slow commands. Commands of linear complexity on large values, such as SMEMBERS or LRANGE 0 -1, are better replaced by their incremental counterparts, SSCAN and the like.",
+	"fast-command":     "O(1) commands should never be slow: the server is likely starved of CPU, or paused by the garbage collector. Check the load of the host, and the gogc and background-cpu-percent settings.",
+	"aof-fsync-always": "The disk is slow to sync the AOF. With appendfsync always every write waits for it; appendfsync everysec bounds the loss to about a second of writes without that wait.",
+	"aof-fsync-sec":    "The disk is slow to sync the AOF. Check for other processes writing to the same disk, or move the AOF to faster storage.",
+	"expire-cycle":     "Many keys expire at the same time. Adding some randomness to their TTLs spreads the work.",
+	"fork":             "Snapshots for BACKUP, BGSAVE, replication and AOF rewrites copy the dataset while other clients wait, in time proportional to its size. Schedule them off-peak, or keep the dataset smaller.",
+}
+
+// latencyDoctor returns a human-readable analysis of the recorded spikes.
+// The caller must hold the latency lock.
+func latencyDoctor() string {
+	var b strings.Builder
+	if latency.threshold <= 0 {
+		b.WriteString("Latency monitoring is disabled. Enable it with CONFIG SET latency-monitor-threshold <milliseconds>, or the -latency-monitor-threshold option, to have spikes recorded.\n")
+		return b.String()
+	}
+	names := latencyEventNames()
+	if len(names) == 0 {
+		fmt.Fprintf(&b, "No latency spikes of %dms or more were observed.\n", latency.threshold.Milliseconds())
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Latency spikes of %dms or more were observed for %d event(s):\n\n", latency.threshold.Milliseconds(), len(names))
+	for i, name := range names {
+		e := latency.events[name]
+		var sum time.Duration
+		for _, sample := range e.samples {
+			sum += sample.latency
+		}
+		avg := sum / time.Duration(len(e.samples))
+		var dev time.Duration
+		for _, sample := range e.samples {
+			dev += (sample.latency - avg).Abs()
+		}
+		dev /= time.Duration(len(e.samples))
+		period := e.samples[len(e.samples)-1].time.Sub(e.samples[0].time) / time.Duration(len(e.samples))
+		fmt.Fprintf(&b, "%d. %s: %d latency spike(s) (average %dms, mean deviation %dms, period %s). Worst all time event %dms.\n",
+			i+1, name, len(e.samples), avg.Milliseconds(), dev.Milliseconds(), period.Round(time.Second), e.max.Milliseconds())
+	}
+	b.WriteString("\nAdvice:\n\n")
+	for _, name := range names {
+		if advice, ok := latencyAdvice[name]; ok {
+			fmt.Fprintf(&b, "- %s: %s\n", name, advice)
+		}
+	}
+	return b.String()
+}
+
+// latencyHistograms replies to LATENCY HISTOGRAM with, for each of the
+// commands named, or every command called if none are, that has run since
+// the statistics were reset, its name followed by
+//
+//	calls n histogram_usec [bucket count ...]
+//
+// where each bucket is the upper bound of run times it counts, and count
+// the calls that ran for that long or less. Empty buckets are left out.
+func latencyHistograms(conn net.Conn, names []string) {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+	if len(names) == 0 {
+		names = calledCommands()
+	}
+	var stats []*commandStat
+	var reported []string
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		if st := commandStats.byName[name]; st != nil && st.calls > 0 && !slices.Contains(reported, name) {
+			stats = append(stats, st)
+			reported = append(reported, name)
+		}
+	}
+	fmt.Fprintf(conn, "*%d\r\n", 2*len(stats))
+	for i, st := range stats {
+		writeBulk(conn, strings.ToLower(reported[i]))
+		buckets := 0
+		for _, n := range st.histogram {
+			if n > 0 {
+				buckets++
+			}
+		}
+		fmt.Fprintf(conn, "*4\r\n")
+		writeBulk(conn, "calls")
+		fmt.Fprintf(conn, ":%d\r\n", st.calls)
+		writeBulk(conn, "histogram_usec")
+		fmt.Fprintf(conn, "*%d\r\n", 2*buckets)
+		var cumulative int64
+		for bucket, n := range st.histogram {
+			cumulative += n
+			if n > 0 {
+				fmt.Fprintf(conn, ":%d\r\n:%d\r\n", int64(1)<<bucket, cumulative)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// MemoryPressureChannel is the channel memory pressure events are published
+// on. Each event is a line like
+//
+//	watermark=90,direction=up,used_memory=966367641,maxmemory=1073741824
+//
+// giving the highest watermark, as a percentage of maxmemory, that memory
+// use is now at or above (0 for none) and whether it rose or fell there.
+const MemoryPressureChannel = "__server__:memory-pressure"
+
+// memoryPressure tracks memory use against the configured watermarks, so
+// producers can be told to shed load before the server runs out of memory.
+var memoryPressure struct {
+	sync.Mutex
+	// watermarks are percentages of maxmemory in increasing order.
+	watermarks []int
+	// warnWrites adds the current watermark as an attribute to the replies
+	// of writes from RESP3 clients while memory use is above one.
+	warnWrites      bool
+	used, maxMemory int64
+	watermark       int
+	events          int64
+}
+
+// SetupMemoryPressure sets the watermarks, percentages of maxmemory, whose
+// crossing is published on MemoryPressureChannel, and whether writes are
+// warned about while memory use is above one.
+func SetupMemoryPressure(watermarks []int, warnWrites bool) {
+	memoryPressure.Lock()
+	defer memoryPressure.Unlock()
+	memoryPressure.watermarks = append([]int(nil), watermarks...)
+	sort.Ints(memoryPressure.watermarks)
+	memoryPressure.warnWrites = warnWrites
+}
+
+// UpdateMemoryPressure records the memory in use and the current maxmemory,
+// which is zero when unlimited, and publishes an event if memory use moved
+// to another watermark. The server calls it periodically, without holding
+// the command lock.
+func UpdateMemoryPressure(used, maxMemory int64) {
+	memoryPressure.Lock()
+	memoryPressure.used, memoryPressure.maxMemory = used, maxMemory
+	watermark := 0
+	if maxMemory > 0 {
+		for _, w := range memoryPressure.watermarks {
+			if used >= maxMemory*int64(w)/100 {
+				watermark = w
+			}
+		}
+	}
+	previous := memoryPressure.watermark
+	memoryPressure.watermark = watermark
+	if watermark != previous {
+		memoryPressure.events++
+	}
+	memoryPressure.Unlock()
+
+	if watermark == previous || serverLock == nil {
+		return
+	}
+	direction := "up"
+	if watermark < previous {
+		direction = "down"
+	}
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	publishMessage(MemoryPressureChannel, fmt.Sprintf("watermark=%d,direction=%s,used_memory=%d,maxmemory=%d",
+		watermark, direction, used, maxMemory))
+}
+
+// memoryWarning returns the watermark to warn writers about, or 0 if there
+// is none or warnings are off.
+func memoryWarning() int {
+	memoryPressure.Lock()
+	defer memoryPressure.Unlock()
+	if !memoryPressure.warnWrites {
+		return 0
+	}
+	return memoryPressure.watermark
+}
+
+// infoMemory renders the memory section.
+func infoMemory(s *store.Store, a *aof.AOF) string {
+	memoryPressure.Lock()
+	defer memoryPressure.Unlock()
+	var b strings.Builder
+	pressure := 0
+	if memoryPressure.watermark > 0 {
+		pressure = 1
+	}
+	fmt.Fprintf(&b, "used_memory:%d\r\n", memoryPressure.used)
+	fmt.Fprintf(&b, "maxmemory:%d\r\n", memoryPressure.maxMemory)
+	fmt.Fprintf(&b, "mem_pressure:%d\r\n", pressure)
+	fmt.Fprintf(&b, "mem_pressure_watermark:%d\r\n", memoryPressure.watermark)
+	fmt.Fprintf(&b, "mem_pressure_events:%d\r\n", memoryPressure.events)
+	if st, ok := s.TieringStats(); ok {
+		fmt.Fprintf(&b, "tiering_cold_keys:%d\r\n", st.ColdKeys)
+		fmt.Fprintf(&b, "tiering_file_bytes:%d\r\n", st.FileBytes)
+		fmt.Fprintf(&b, "tiering_live_bytes:%d\r\n", st.LiveBytes)
+		fmt.Fprintf(&b, "tiering_spilled:%d\r\n", st.Spilled)
+		fmt.Fprintf(&b, "tiering_loaded:%d\r\n", st.Loaded)
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Handler runs a command, replying on conn.
+type Handler func(args []string, conn net.Conn, s *store.Store, a *aof.AOF)
+
+// Middleware wraps the execution of every client command, for embedders to
+// audit, measure, limit or rewrite commands. It calls next to run the
+// command, possibly with other arguments, or replies itself without calling
+// it to refuse the command. Commands queued by a transaction go through it
+// when EXEC runs them. The command's access checks, including ACLs
+// and quotas, run inside next, on the arguments it is given. Middleware
+// runs under the server's command lock, so it must not block.
+type Middleware func(next Handler) Handler
+
+// middleware is the chain installed with Use, outermost first.
+var middleware []Middleware
+
+// Use appends mw to the middleware chain, inside the middleware already
+// installed. It must be called before the server starts serving.
+func Use(mw ...Middleware) {
+	middleware = append(middleware, mw...)
+}
+
+// withMiddleware returns the middleware chain around running the command
+// cmd with handler, nil for an unknown command. Middleware that renames the
+// command gets the renamed command's handler run.
+func withMiddleware(cmd string, handler func([]string, net.Conn, *store.Store, *aof.AOF)) Handler {
+	next := Handler(func(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+		if len(args) == 0 {
+			fmt.Fprintf(conn, "-ERR empty command\r\n")
+			return
+		}
+		if renamed := strings.ToUpper(args[0]); renamed != cmd || handler == nil {
+			var ok bool
+			if handler, ok = Handlers[renamed]; !ok {
+				fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", renamed)
+				return
+			}
+			cmd = renamed
+		}
+		runCommand(cmd, handler, args, conn, s, a)
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](next)
+	}
+	return next
+}
@@ -0,0 +1,363 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/redisclient"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Slot migration moves the keys of a range of hash slots to another server
+// for resharding. Like MIGRATE, each key is copied to the target and deleted
+// under the command lock, so clients see it in exactly one place. The
+// migration runs in the background, throttled to a rate of keys and bytes
+// per second that can be changed, paused and resumed while it runs, so a
+// large reshard doesn't saturate the network during business hours.
+
+// migration is a running or finished slot migration.
+type migration struct {
+	id          int64
+	target      string
+	first, last int
+
+	mu          sync.Mutex
+	keysPerSec  int64
+	bytesPerSec int64
+	state       string // running, paused, done, failed or cancelled
+	err         error
+	keysMoved   int64
+	bytesMoved  int64
+	// shardsDone and shards give the progress of the keyspace scan.
+	shardsDone, shards int
+	started, finished  time.Time
+	// The rate limit applies to what was moved since windowStart, which is
+	// reset whenever the limits change or the migration resumes.
+	windowStart             time.Time
+	windowKeys, windowBytes int64
+	resume                  chan struct{}
+}
+
+// migrations holds every migration since the server started.
+var migrations = struct {
+	sync.Mutex
+	byID   map[int64]*migration
+	nextID int64
+}{byID: make(map[int64]*migration)}
+
+// migrationCmd handles the MIGRATION command:
+//
+//	MIGRATION START host port first-slot last-slot [KEYSPERSEC n] [BYTESPERSEC n]
+//	MIGRATION LIMIT id [KEYSPERSEC n] [BYTESPERSEC n]
+//	MIGRATION PAUSE|RESUME|CANCEL id
+//	MIGRATION STATUS [id]
+//
+// A limit of 0 means unlimited.
+func migrationCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	sub := strings.ToUpper(args[1])
+	if sub == "START" {
+		migrationStart(args, conn, s, a)
+		return
+	}
+	if sub == "STATUS" && len(args) == 2 {
+		migrations.Lock()
+		list := make([]*migration, 0, len(migrations.byID))
+		for _, m := range migrations.byID {
+			list = append(list, m)
+		}
+		migrations.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+		var b strings.Builder
+		for _, m := range list {
+			b.WriteString(m.status())
+		}
+		writeBulk(conn, b.String())
+		return
+	}
+	if len(args) < 3 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'migration|%s' command\r\n", strings.ToLower(sub))
+		return
+	}
+	id, err := strconv.ParseInt(args[2], 10, 64)
+	migrations.Lock()
+	m := migrations.byID[id]
+	migrations.Unlock()
+	if err != nil || m == nil {
+		fmt.Fprintf(conn, "-ERR no such migration '%s'\r\n", args[2])
+		return
+	}
+
+	switch sub {
+	case "STATUS":
+		writeBulk(conn, m.status())
+		return
+	case "LIMIT":
+		m.mu.Lock()
+		keysPerSec, bytesPerSec, ok := parseMigrationLimits(args[3:], m.keysPerSec, m.bytesPerSec, conn)
+		if ok {
+			m.keysPerSec, m.bytesPerSec = keysPerSec, bytesPerSec
+			m.resetWindow()
+		}
+		m.mu.Unlock()
+		if !ok {
+			return
+		}
+	case "PAUSE", "RESUME", "CANCEL":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'migration|%s' command\r\n", strings.ToLower(sub))
+			return
+		}
+		m.mu.Lock()
+		if m.state != "running" && m.state != "paused" {
+			m.mu.Unlock()
+			fmt.Fprintf(conn, "-ERR migration %d is %s\r\n", m.id, m.state)
+			return
+		}
+		switch sub {
+		case "PAUSE":
+			m.state = "paused"
+		case "RESUME":
+			m.state = "running"
+			m.resetWindow()
+		case "CANCEL":
+			m.state = "cancelled"
+		}
+		// Wake a migration waiting while paused or throttled.
+		select {
+		case m.resume <- struct{}{}:
+		default:
+		}
+		m.mu.Unlock()
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// migrationStart handles MIGRATION START, replying with the new migration's ID.
+func migrationStart(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args) < 6 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'migration|start' command\r\n")
+		return
+	}
+	first, err1 := strconv.Atoi(args[4])
+	last, err2 := strconv.Atoi(args[5])
+	if err1 != nil || err2 != nil || first < 0 || last >= numSlots || first > last {
+		fmt.Fprintf(conn, "-ERR invalid slot range\r\n")
+		return
+	}
+	keysPerSec, bytesPerSec, ok := parseMigrationLimits(args[6:], 0, 0, conn)
+	if !ok {
+		return
+	}
+	m := &migration{
+		target:      net.JoinHostPort(args[2], args[3]),
+		first:       first,
+		last:        last,
+		keysPerSec:  keysPerSec,
+		bytesPerSec: bytesPerSec,
+		state:       "running",
+		shards:      s.ScanShards(),
+		started:     time.Now(),
+		resume:      make(chan struct{}, 1),
+	}
+	m.resetWindow()
+	migrations.Lock()
+	migrations.nextID++
+	m.id = migrations.nextID
+	migrations.byID[m.id] = m
+	migrations.Unlock()
+
+	go m.run(s, a)
+	fmt.Fprintf(conn, ":%d\r\n", m.id)
+}
+
+// parseMigrationLimits parses KEYSPERSEC and BYTESPERSEC options, starting
+// from the given limits, writing an error reply on bad input.
+func parseMigrationLimits(args []string, keysPerSec, bytesPerSec int64, conn net.Conn) (int64, int64, bool) {
+	if len(args)%2 != 0 {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return 0, 0, false
+	}
+	for i := 0; i < len(args); i += 2 {
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n < 0 {
+			fmt.Fprintf(conn, "-ERR rate limit must be a non-negative integer\r\n")
+			return 0, 0, false
+		}
+		switch strings.ToUpper(args[i]) {
+		case "KEYSPERSEC":
+			keysPerSec = n
+		case "BYTESPERSEC":
+			bytesPerSec = n
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return 0, 0, false
+		}
+	}
+	return keysPerSec, bytesPerSec, true
+}
+
+// resetWindow restarts rate limiting from now. The caller must hold m.mu.
+func (m *migration) resetWindow() {
+	m.windowStart = time.Now()
+	m.windowKeys, m.windowBytes = 0, 0
+}
+
+// status renders the migration as an INFO-style line.
+func (m *migration) status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	end := m.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	progress := 100 * float64(m.shardsDone) / float64(m.shards)
+	line := fmt.Sprintf("migration%d:target=%s,slots=%d-%d,state=%s,progress=%.1f%%,keys_moved=%d,bytes_moved=%d,keys_per_sec=%d,bytes_per_sec=%d,elapsed_sec=%d",
+		m.id, m.target, m.first, m.last, m.state, progress, m.keysMoved, m.bytesMoved,
+		m.keysPerSec, m.bytesPerSec, int64(end.Sub(m.started).Seconds()))
+	if m.err != nil {
+		line += ",error=" + strings.ReplaceAll(m.err.Error(), ",", ";")
+	}
+	return line + "\r\n"
+}
+
+// waitTurn blocks while the migration is paused or ahead of its rate limits,
+// and reports false once it was cancelled.
+func (m *migration) waitTurn() bool {
+	for {
+		m.mu.Lock()
+		state := m.state
+		var wait time.Duration
+		if state == "running" {
+			elapsed := time.Since(m.windowStart)
+			if m.keysPerSec > 0 {
+				wait = max(wait, time.Duration(m.windowKeys)*time.Second/time.Duration(m.keysPerSec)-elapsed)
+			}
+			if m.bytesPerSec > 0 {
+				wait = max(wait, time.Duration(float64(m.windowBytes)/float64(m.bytesPerSec)*float64(time.Second))-elapsed)
+			}
+		}
+		m.mu.Unlock()
+
+		switch {
+		case state == "cancelled":
+			return false
+		case state == "paused":
+			<-m.resume
+		case wait > 0:
+			select {
+			case <-time.After(wait):
+			case <-m.resume:
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// run scans the keyspace for keys in the migration's slots and moves them.
+func (m *migration) run(s *store.Store, a *aof.AOF) {
+	client, err := redisclient.Dial(m.target)
+	if err == nil {
+		defer client.Close()
+		err = m.scan(client, s, a)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished = time.Now()
+	switch {
+	case err != nil:
+		m.state, m.err = "failed", err
+		log.Printf("Migration %d to %s failed: %v", m.id, m.target, err)
+	case m.state != "cancelled":
+		m.state = "done"
+		log.Printf("Migration %d to %s done, %d keys moved", m.id, m.target, m.keysMoved)
+	}
+}
+
+// scan moves the keys of the migration's slots, a page of the keyspace at a
+// time.
+func (m *migration) scan(client *redisclient.Client, s *store.Store, a *aof.AOF) error {
+	cursor := 0
+	for {
+		keys, next := s.Scan(cursor, 100, "", "")
+		for _, key := range keys {
+			if slot := keyHashSlot(key); slot < m.first || slot > m.last {
+				continue
+			}
+			if !m.waitTurn() {
+				return nil
+			}
+			bytes, err := moveKey(client, s, a, key)
+			if err != nil {
+				return fmt.Errorf("moving key '%s': %w", key, err)
+			}
+			m.mu.Lock()
+			if bytes > 0 {
+				m.keysMoved++
+				m.windowKeys++
+			}
+			m.bytesMoved += bytes
+			m.windowBytes += bytes
+			m.mu.Unlock()
+		}
+		m.mu.Lock()
+		m.shardsDone = s.ScanShard(next)
+		m.mu.Unlock()
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// moveKey copies key to the target and deletes it locally, returning the
+// bytes of commands sent, or 0 if the key no longer exists.
+func moveKey(client *redisclient.Client, s *store.Store, a *aof.AOF, key string) (int64, error) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	cmds := [][]string{{"DEL", key}}
+	exists, err := s.RewriteKey(key, func(args []string) error {
+		if args[0] == "PEXPIREAT" {
+			// Commands have no PEXPIREAT, so the expiration is sent as a TTL.
+			at, _ := strconv.ParseInt(args[2], 10, 64)
+			ttl := max(time.Until(time.UnixMilli(at)).Milliseconds(), 1)
+			args = []string{"PEXPIRE", key, strconv.FormatInt(ttl, 10)}
+		}
+		cmds = append(cmds, args)
+		return nil
+	})
+	if !exists || err != nil {
+		return 0, err
+	}
+	for i, cmd := range cmds {
+		if cmd[0] == "SETSEALED" {
+			// The target only takes plaintext values, which it seals with
+			// its own key if it encrypts the key too.
+			value, _ := s.Get(key)
+			cmds[i] = []string{"SET", key, value}
+		}
+	}
+	var bytes int64
+	for _, cmd := range cmds {
+		if _, err := client.Do(cmd...); err != nil {
+			return 0, err
+		}
+		for _, arg := range cmd {
+			bytes += int64(len(arg))
+		}
+	}
+	s.Del(key)
+	LogEffects(a, "DEL", key)
+	return bytes, nil
+}
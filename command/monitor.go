@@ -0,0 +1,71 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// monitors are the clients that ran MONITOR, which are sent every command
+// the server processes from then on.
+var monitors = struct {
+	sync.Mutex
+	clients map[*Client]struct{}
+}{clients: make(map[*Client]struct{})}
+
+// monitor handles the MONITOR command. Like a subscriber, a monitoring
+// client is written to through its outbox, so it can't stall the server.
+func monitor(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR MONITOR is only available to client connections\r\n")
+		return
+	}
+	if c.outbox == nil {
+		c.outbox = newOutbox(c)
+	}
+	monitors.Lock()
+	monitors.clients[c] = struct{}{}
+	monitors.Unlock()
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// feedMonitors sends a command from c, redacted, to the monitoring clients,
+// in the format of Redis: +<unix time> [<db> <addr>] "arg" "arg" ..., with
+// the client's trace ID after its address if it set one, as
+// [<db> <addr> trace:<id>].
+func feedMonitors(c *Client, args []string) {
+	monitors.Lock()
+	defer monitors.Unlock()
+	if len(monitors.clients) == 0 {
+		return
+	}
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "+%d.%06d [0 %s", now.Unix(), now.Nanosecond()/1000, c.RemoteAddr())
+	if c.TraceID != "" {
+		fmt.Fprintf(&b, " trace:%s", c.TraceID)
+	}
+	b.WriteByte(']')
+	for _, arg := range redactArgs(args) {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Quote(arg))
+	}
+	b.WriteString("\r\n")
+	for m := range monitors.clients {
+		m.Write([]byte(b.String()))
+	}
+}
+
+// stopMonitoring removes a disconnecting client from the monitors.
+func (c *Client) stopMonitoring() {
+	monitors.Lock()
+	delete(monitors.clients, c)
+	monitors.Unlock()
+}
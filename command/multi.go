@@ -0,0 +1,243 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// EXEC runs queued commands through dispatch, which looks up Handlers, so
+// the transaction commands are registered here rather than in its
+// initializer.
+func init() {
+	Handlers["MULTI"] = multi
+	Handlers["EXEC"] = exec
+	Handlers["DISCARD"] = discard
+	Handlers["WATCH"] = watch
+	Handlers["UNWATCH"] = unwatch
+}
+
+// transaction is the state of a client between MULTI and EXEC.
+type transaction struct {
+	queued []queuedCommand
+	// aborted is set when a command was refused while queueing, so EXEC
+	// discards the transaction.
+	aborted bool
+}
+
+// queuedCommand is a command queued by a transaction.
+type queuedCommand struct {
+	cmd     string
+	handler func([]string, net.Conn, *store.Store, *aof.AOF)
+	args    []string
+}
+
+// transactionCommands run right away while a transaction is open rather
+// than being queued.
+var transactionCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+}
+
+// noTransactionCommands can't be queued, as they take over the connection
+// or change how it is served.
+var noTransactionCommands = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"MONITOR":    true,
+	"PSYNC":      true,
+}
+
+// queueCommand queues a command of an open transaction, replying +QUEUED,
+// or with the error that aborts the transaction if it can't run. Access is
+// checked again when EXEC runs it, and quotas are only charged then.
+func queueCommand(c *Client, cmd string, handler func([]string, net.Conn, *store.Store, *aof.AOF), args []string) {
+	var refused string
+	badArgs := checkArgs(cmd, args)
+	switch {
+	case handler == nil:
+		refused = fmt.Sprintf("ERR unknown command '%s'", cmd)
+	case noTransactionCommands[cmd]:
+		refused = fmt.Sprintf("ERR Command not allowed inside a transaction: '%s'", strings.ToLower(cmd))
+	case badArgs != "":
+		refused = badArgs
+	case c.namespace() != "":
+		if _, ok := applyNamespace(cmd, args, c.namespace()); !ok {
+			refused = fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", c.User.Name, strings.ToLower(cmd))
+		}
+	}
+	if refused != "" {
+		c.tx.aborted = true
+		fmt.Fprintf(c, "-%s\r\n", refused)
+		return
+	}
+	c.tx.queued = append(c.tx.queued, queuedCommand{cmd, handler, args})
+	fmt.Fprintf(c, "+QUEUED\r\n")
+}
+
+// multi handles MULTI, starting a transaction: the client's commands are
+// queued until EXEC runs them or DISCARD drops them.
+func multi(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR MULTI is only available on client connections\r\n")
+		return
+	}
+	if c.tx != nil {
+		fmt.Fprintf(conn, "-ERR MULTI calls can not be nested\r\n")
+		return
+	}
+	c.tx = &transaction{}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// exec handles EXEC, running the queued commands and replying with an
+// array of their replies. Commands run under the server's command lock,
+// so no other client's command runs in between, and blocking commands
+// don't block, as they would hold it. Their writes are framed by MULTI and
+// EXEC in the AOF, so a crash during EXEC can't leave half of them there.
+func exec(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil || c.tx == nil {
+		fmt.Fprintf(conn, "-ERR EXEC without MULTI\r\n")
+		return
+	}
+	tx := c.tx
+	c.tx = nil
+	touched := c.unwatchAll(s)
+	if tx.aborted {
+		fmt.Fprintf(conn, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+		return
+	}
+	if touched {
+		fmt.Fprintf(conn, "*-1\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(tx.queued))
+	c.inExec = true
+	defer func() { c.inExec = false }()
+	defer a.BeginTransaction()()
+	for _, q := range tx.queued {
+		dispatch(q.cmd, q.handler, q.args, conn, s, a)
+		// Work a command defers until the lock is released would reply
+		// after the next command, so it is done right away.
+		c.RunDeferred()
+	}
+}
+
+// discard handles DISCARD, dropping the queued commands.
+func discard(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil || c.tx == nil {
+		fmt.Fprintf(conn, "-ERR DISCARD without MULTI\r\n")
+		return
+	}
+	c.tx = nil
+	c.unwatchAll(s)
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// watches maps the keys watched with WATCH to the clients watching them.
+// It guards the watch state of the clients too, which the write stream
+// changes.
+var watches = struct {
+	sync.Mutex
+	byKey map[string]map[*Client]struct{}
+}{byKey: make(map[string]map[*Client]struct{})}
+
+// SetupWatch marks the clients watching the keys written to a as touched,
+// so their EXEC fails.
+func SetupWatch(a *aof.AOF) {
+	a.AddFeed(touchWatched)
+}
+
+// touchWatched is the write-stream feed that marks the clients watching
+// the keys a command wrote as touched. Commands without a known key layout,
+// like FLUSHALL, touch every watched key.
+func touchWatched(args []string) {
+	watches.Lock()
+	defer watches.Unlock()
+	if len(watches.byKey) == 0 {
+		return
+	}
+	spec, ok := keySpecs[strings.ToUpper(args[0])]
+	if !ok {
+		for _, watchers := range watches.byKey {
+			for c := range watchers {
+				c.watchTouched = true
+			}
+		}
+		return
+	}
+	for _, i := range spec.keyIndexes(args) {
+		for c := range watches.byKey[args[i]] {
+			c.watchTouched = true
+		}
+	}
+}
+
+// unwatchAll stops watching the client's keys, reporting whether any was
+// touched since it was watched. Expirations don't go through the write
+// stream, so a key that existed when watched and is gone counts as touched
+// too.
+func (c *Client) unwatchAll(s *store.Store) bool {
+	watches.Lock()
+	defer watches.Unlock()
+	touched := c.watchTouched
+	for key, existed := range c.watched {
+		if existed && s != nil && !s.Exists(key) {
+			touched = true
+		}
+		delete(watches.byKey[key], c)
+		if len(watches.byKey[key]) == 0 {
+			delete(watches.byKey, key)
+		}
+	}
+	c.watched = nil
+	c.watchTouched = false
+	return touched
+}
+
+// watch handles WATCH key [key ...], making the next EXEC fail if any of
+// the keys is written to before it.
+func watch(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR WATCH is only available on client connections\r\n")
+		return
+	}
+	if c.tx != nil {
+		fmt.Fprintf(conn, "-ERR WATCH inside MULTI is not allowed\r\n")
+		return
+	}
+	watches.Lock()
+	defer watches.Unlock()
+	if c.watched == nil {
+		c.watched = make(map[string]bool)
+	}
+	for _, key := range args[1:] {
+		if _, ok := c.watched[key]; ok {
+			continue
+		}
+		c.watched[key] = s.Exists(key)
+		if watches.byKey[key] == nil {
+			watches.byKey[key] = make(map[*Client]struct{})
+		}
+		watches.byKey[key][c] = struct{}{}
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// unwatch handles UNWATCH, forgetting the watched keys.
+func unwatch(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if c := clientOf(conn); c != nil {
+		c.unwatchAll(nil)
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
@@ -0,0 +1,250 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+)
+
+// keySpec describes which arguments of a command are keys: every step-th
+// argument from first to last, where a negative last counts from the end.
+type keySpec struct {
+	first, last, step int
+}
+
+// streamsKeys is the keySpec of commands like XREAD, whose keys are the first
+// half of the arguments following the STREAMS keyword.
+var streamsKeys = keySpec{}
+
+// numKeysKeys is the keySpec of commands like CMS.MERGE, whose keys are a
+// destination followed by a count of keys and that many keys.
+var numKeysKeys = keySpec{step: -1}
+
+// keySpecs lists the key positions of every command that takes keys.
+var keySpecs = map[string]keySpec{
+	"GET":              {1, 1, 1},
+	"SET":              {1, 1, 1},
+	"SETSEALED":        {1, 1, 1},
+	"DEL":              {1, -1, 1},
+	"EXISTS":           {1, -1, 1},
+	"EXPIRE":           {1, 1, 1},
+	"PEXPIRE":          {1, 1, 1},
+	"EXPIREAT":         {1, 1, 1},
+	"PEXPIREAT":        {1, 1, 1},
+	"PERSIST":          {1, 1, 1},
+	"INCR":             {1, 1, 1},
+	"DECR":             {1, 1, 1},
+	"INCRBY":           {1, 1, 1},
+	"DECRBY":           {1, 1, 1},
+	"LPUSH":            {1, 1, 1},
+	"LPOP":             {1, 1, 1},
+	"RPUSH":            {1, 1, 1},
+	"RPOP":             {1, 1, 1},
+	"LRANGE":           {1, 1, 1},
+	"SADD":             {1, 1, 1},
+	"SREM":             {1, 1, 1},
+	"SMEMBERS":         {1, 1, 1},
+	"SMOVE":            {1, 2, 1},
+	"SSCAN":            {1, 1, 1},
+	"HSET":             {1, 1, 1},
+	"HSETNX":           {1, 1, 1},
+	"HGET":             {1, 1, 1},
+	"HDEL":             {1, 1, 1},
+	"HGETALL":          {1, 1, 1},
+	"HEXISTS":          {1, 1, 1},
+	"HLEN":             {1, 1, 1},
+	"HKEYS":            {1, 1, 1},
+	"HVALS":            {1, 1, 1},
+	"HSCAN":            {1, 1, 1},
+	"HEXPIRE":          {1, 1, 1},
+	"HPEXPIRE":         {1, 1, 1},
+	"HEXPIREAT":        {1, 1, 1},
+	"HPEXPIREAT":       {1, 1, 1},
+	"HTTL":             {1, 1, 1},
+	"HPTTL":            {1, 1, 1},
+	"HPERSIST":         {1, 1, 1},
+	"ZADD":             {1, 1, 1},
+	"ZSCORE":           {1, 1, 1},
+	"ZCARD":            {1, 1, 1},
+	"ZREM":             {1, 1, 1},
+	"ZRANGE":           {1, 1, 1},
+	"ZREVRANGE":        {1, 1, 1},
+	"ZRANGEBYSCORE":    {1, 1, 1},
+	"ZREVRANGEBYSCORE": {1, 1, 1},
+	"ZCOUNT":           {1, 1, 1},
+	"ZREMRANGEBYSCORE": {1, 1, 1},
+	"ZRANGEBYLEX":      {1, 1, 1},
+	"ZREVRANGEBYLEX":   {1, 1, 1},
+	"ZLEXCOUNT":        {1, 1, 1},
+	"ZREMRANGEBYLEX":   {1, 1, 1},
+	"ZRANK":            {1, 1, 1},
+	"ZREVRANK":         {1, 1, 1},
+	"ZINCRBY":          {1, 1, 1},
+	"ZSCAN":            {1, 1, 1},
+	"ZMSCORE":          {1, 1, 1},
+	"ZRANDMEMBER":      {1, 1, 1},
+	"ZRANGESTORE":      {1, 2, 1},
+	"ZPOPMIN":          {1, 1, 1},
+	"ZPOPMAX":          {1, 1, 1},
+	"BZPOPMIN":         {1, -2, 1},
+	"BZPOPMAX":         {1, -2, 1},
+	"XADD":             {1, 1, 1},
+	"XSETID":           {1, 1, 1},
+	"XLEN":             {1, 1, 1},
+	"GEOADD":           {1, 1, 1},
+	"GEOPOS":           {1, 1, 1},
+	"GEODIST":          {1, 1, 1},
+	"GEOSEARCH":        {1, 1, 1},
+	"GEOSEARCHSTORE":   {1, 2, 1},
+	"BF.RESERVE":       {1, 1, 1},
+	"BF.ADD":           {1, 1, 1},
+	"BF.MADD":          {1, 1, 1},
+	"BF.EXISTS":        {1, 1, 1},
+	"BF.MEXISTS":       {1, 1, 1},
+	"BF.INFO":          {1, 1, 1},
+	"BF.SCANDUMP":      {1, 1, 1},
+	"BF.LOADCHUNK":     {1, 1, 1},
+	"CF.RESERVE":       {1, 1, 1},
+	"CF.ADD":           {1, 1, 1},
+	"CF.ADDNX":         {1, 1, 1},
+	"CF.EXISTS":        {1, 1, 1},
+	"CF.MEXISTS":       {1, 1, 1},
+	"CF.COUNT":         {1, 1, 1},
+	"CF.DEL":           {1, 1, 1},
+	"CF.INFO":          {1, 1, 1},
+	"CF.SCANDUMP":      {1, 1, 1},
+	"CF.LOADCHUNK":     {1, 1, 1},
+	"CMS.INITBYDIM":    {1, 1, 1},
+	"CMS.INITBYPROB":   {1, 1, 1},
+	"CMS.INCRBY":       {1, 1, 1},
+	"CMS.QUERY":        {1, 1, 1},
+	"CMS.MERGE":        numKeysKeys,
+	"CMS.INFO":         {1, 1, 1},
+	"CMS.SCANDUMP":     {1, 1, 1},
+	"CMS.LOADCHUNK":    {1, 1, 1},
+	"TOPK.RESERVE":     {1, 1, 1},
+	"TOPK.ADD":         {1, 1, 1},
+	"TOPK.INCRBY":      {1, 1, 1},
+	"TOPK.QUERY":       {1, 1, 1},
+	"TOPK.COUNT":       {1, 1, 1},
+	"TOPK.LIST":        {1, 1, 1},
+	"TOPK.INFO":        {1, 1, 1},
+	"TOPK.SCANDUMP":    {1, 1, 1},
+	"TOPK.LOADCHUNK":   {1, 1, 1},
+	"JSON.SET":         {1, 1, 1},
+	"JSON.GET":         {1, 1, 1},
+	"JSON.DEL":         {1, 1, 1},
+	"JSON.FORGET":      {1, 1, 1},
+	"JSON.NUMINCRBY":   {1, 1, 1},
+	"JSON.ARRAPPEND":   {1, 1, 1},
+	"JSON.ARRINSERT":   {1, 1, 1},
+	"JSON.ARRLEN":      {1, 1, 1},
+	"JSON.TYPE":        {1, 1, 1},
+	"JSON.RESP":        {1, 1, 1},
+	"TS.CREATE":        {1, 1, 1},
+	"TS.ADD":           {1, 1, 1},
+	"TS.MADD":          {1, -1, 3},
+	"TS.DEL":           {1, 1, 1},
+	"TS.GET":           {1, 1, 1},
+	"TS.RANGE":         {1, 1, 1},
+	"TS.REVRANGE":      {1, 1, 1},
+	"TS.CREATERULE":    {1, 2, 1},
+	"TS.DELETERULE":    {1, 2, 1},
+	"TS.INFO":          {1, 1, 1},
+	"TS.SCANDUMP":      {1, 1, 1},
+	"TS.LOADCHUNK":     {1, 1, 1},
+	"DELAYPUSH":        {1, 1, 1},
+	"DELAYLEN":         {1, 1, 1},
+	"XRANGE":           {1, 1, 1},
+	"XREVRANGE":        {1, 1, 1},
+	"XREAD":            streamsKeys,
+	"WATCH":            {1, -1, 1},
+}
+
+// namespaceSafe lists the keyless commands a namespaced user may run. SCAN is
+// included because its handler confines itself to the caller's namespace, and
+// EXPLAIN because it only describes a command without running it.
+var namespaceSafe = map[string]bool{
+	"PING":    true,
+	"EXPLAIN": true,
+	"AUTH":    true,
+	"HELLO":   true,
+	"CLIENT":  true,
+	"INFO":    true,
+	"STATS":   true,
+	"SCAN":    true,
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"UNWATCH": true,
+}
+
+// keyIndexes returns the positions of the key arguments in args.
+func (ks keySpec) keyIndexes(args []string) []int {
+	if ks == streamsKeys {
+		for i, arg := range args {
+			if strings.EqualFold(arg, "STREAMS") {
+				return keySpec{i + 1, i + (len(args)-i-1)/2, 1}.keyIndexes(args)
+			}
+		}
+		return nil
+	}
+	if ks == numKeysKeys {
+		if len(args) < 3 {
+			return nil
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return []int{1}
+		}
+		return append([]int{1}, keySpec{3, min(2+n, len(args)-1), 1}.keyIndexes(args)...)
+	}
+	last := ks.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	var indexes []int
+	for i := ks.first; i <= last; i += ks.step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// applyNamespace returns a copy of args with the namespace prepended to every
+// key. It reports false for commands a namespaced user may not run, because
+// their keys can't be located or they affect the whole keyspace.
+func applyNamespace(cmd string, args []string, namespace string) ([]string, bool) {
+	spec, ok := keySpecs[cmd]
+	if !ok {
+		// Users may always ask who they are, but not administer other users.
+		if cmd == "ACL" && len(args) == 2 && strings.EqualFold(args[1], "WHOAMI") {
+			return args, true
+		}
+		// Likewise for their own quotas.
+		if cmd == "QUOTA" && len(args) == 1 {
+			return args, true
+		}
+		return args, namespaceSafe[cmd]
+	}
+	rewritten := make([]string, len(args))
+	copy(rewritten, args)
+	for _, i := range spec.keyIndexes(args) {
+		rewritten[i] = namespace + rewritten[i]
+	}
+	return rewritten, true
+}
+
+// escapeGlob escapes the glob metacharacters in s so it matches literally.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,112 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// OfflineDir is the directory OFFLINE SELECT opens snapshot files in, or
+// empty to disable the command. Clients can only name files inside it.
+var OfflineDir string
+
+// offlineSnapshot is an RDB file a client selected with OFFLINE SELECT. It
+// is loaded into a store of its own, which the client's reads are served
+// from in place of the live dataset, and which nothing else ever writes to.
+type offlineSnapshot struct {
+	path   string
+	store  *store.Store
+	keys   int
+	loaded time.Time
+}
+
+// offline handles the OFFLINE command:
+//
+//	OFFLINE SELECT file   serve this connection's reads from an RDB file
+//	OFFLINE RESET         go back to the live dataset
+//	OFFLINE INFO          describe the selected file, nil if none is
+//
+// While a file is selected, commands reading keys see the snapshot, such as
+// a BACKUP taken the day before, and writes are refused. Commands without
+// keys still act on the server. The file is loaded once the command lock
+// is released, so loading a large one doesn't hold up other clients.
+func offline(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR OFFLINE is only available on client connections\r\n")
+		return
+	}
+	switch strings.ToUpper(args[1]) {
+	case "SELECT":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'offline|select' command\r\n")
+			return
+		}
+		if OfflineDir == "" {
+			fmt.Fprintf(conn, "-ERR OFFLINE is disabled, start the server with -offline-dir to enable it\r\n")
+			return
+		}
+		if !filepath.IsLocal(args[2]) {
+			fmt.Fprintf(conn, "-ERR snapshot files must be named relative to the offline directory\r\n")
+			return
+		}
+		path := filepath.Join(OfflineDir, args[2])
+		c.deferred = func() {
+			snapshot, err := loadOfflineSnapshot(path)
+			if err != nil {
+				fmt.Fprintf(conn, "-ERR can't load '%s': %v\r\n", args[2], err)
+				return
+			}
+			snapshot.path = args[2]
+			c.offline = snapshot
+			fmt.Fprintf(conn, "+OK\r\n")
+		}
+	case "RESET":
+		c.offline = nil
+		fmt.Fprintf(conn, "+OK\r\n")
+	case "INFO":
+		if c.offline == nil {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return
+		}
+		writeBulk(conn, fmt.Sprintf("file:%s\r\nkeys:%d\r\nloaded_at:%d\r\n",
+			c.offline.path, c.offline.keys, c.offline.loaded.Unix()))
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// loadOfflineSnapshot loads an RDB file into a store of its own.
+func loadOfflineSnapshot(path string) (*offlineSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snapshot := &offlineSnapshot{store: store.NewStore(), loaded: time.Now()}
+	if snapshot.keys, err = snapshot.store.ReadRDB(f); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// serveOffline runs a command of a client that selected a snapshot file
+// against it, refusing writes. It reports false for the commands that run
+// as usual: OFFLINE itself, and every command of other clients.
+func serveOffline(c *Client, cmd string, args []string, handler func([]string, net.Conn, *store.Store, *aof.AOF), a *aof.AOF) bool {
+	if c == nil || c.offline == nil || cmd == "OFFLINE" {
+		return false
+	}
+	if writeCommands[cmd] {
+		fmt.Fprintf(c, "-READONLY You can't write against an offline snapshot, use OFFLINE RESET to go back to the live dataset\r\n")
+		return true
+	}
+	handler(args, c, c.offline.store, a)
+	return true
+}
@@ -0,0 +1,204 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// maxPreparedCommands caps the commands a connection can have prepared,
+// and maxPreparedParams the parameters of each.
+const (
+	maxPreparedCommands = 1024
+	maxPreparedParams   = 1024
+)
+
+// PREPARE looks up other commands in Handlers, so the prepared command
+// family is registered here rather than in its initializer.
+func init() {
+	Handlers["PREPARE"] = prepare
+	Handlers["EXECUTE"] = execute
+	Handlers["DEALLOCATE"] = deallocate
+}
+
+// preparedCommand is a command template registered with PREPARE. The
+// command is looked up and the template split around its placeholders
+// once, so EXECUTE only has to fill them in.
+type preparedCommand struct {
+	cmd     string
+	handler func([]string, net.Conn, *store.Store, *aof.AOF)
+	// args are the template's arguments after the command name, each a
+	// sequence of literal text and placeholders.
+	args [][]preparedPart
+	// params is the number of parameters EXECUTE must bind, the highest
+	// placeholder in the template.
+	params int
+}
+
+// preparedPart is literal text, or the parameter param (from 1) if set.
+type preparedPart struct {
+	text  string
+	param int
+}
+
+// prepare handles PREPARE command [arg ...], registering a command template
+// for this connection and replying with the ID EXECUTE runs it by. In the
+// arguments, $1, $2 and so on are replaced by the parameters EXECUTE is
+// given, and $$ stands for a literal '$'; any other '$' is kept as is.
+// Placeholders can make up part of an argument, as in "user:$1".
+func prepare(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR PREPARE is only available on client connections\r\n")
+		return
+	}
+	cmd := strings.ToUpper(args[1])
+	handler, ok := Handlers[cmd]
+	if !ok {
+		fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		return
+	}
+	if cmd == "PREPARE" || cmd == "EXECUTE" || cmd == "DEALLOCATE" {
+		fmt.Fprintf(conn, "-ERR %s can't be prepared\r\n", cmd)
+		return
+	}
+	if len(c.prepared) >= maxPreparedCommands {
+		fmt.Fprintf(conn, "-ERR too many prepared commands, DEALLOCATE some first\r\n")
+		return
+	}
+	p := &preparedCommand{cmd: cmd, handler: handler, args: make([][]preparedPart, len(args)-2)}
+	for i, arg := range args[2:] {
+		parts, err := parsePreparedArg(arg)
+		if err != "" {
+			fmt.Fprintf(conn, "-ERR %s\r\n", err)
+			return
+		}
+		for _, part := range parts {
+			p.params = max(p.params, part.param)
+		}
+		p.args[i] = parts
+	}
+	if c.prepared == nil {
+		c.prepared = make(map[int64]*preparedCommand)
+	}
+	c.lastPrepared++
+	c.prepared[c.lastPrepared] = p
+	fmt.Fprintf(conn, ":%d\r\n", c.lastPrepared)
+}
+
+// parsePreparedArg splits a template argument around its placeholders,
+// returning an error message for invalid ones.
+func parsePreparedArg(arg string) ([]preparedPart, string) {
+	var parts []preparedPart
+	var text strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '$' || i+1 == len(arg) {
+			text.WriteByte(arg[i])
+			continue
+		}
+		if arg[i+1] == '$' {
+			text.WriteByte('$')
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(arg) && arg[end] >= '0' && arg[end] <= '9' {
+			end++
+		}
+		if end == i+1 {
+			text.WriteByte('$')
+			continue
+		}
+		n, err := strconv.Atoi(arg[i+1 : end])
+		if err != nil || n < 1 || n > maxPreparedParams {
+			return nil, fmt.Sprintf("invalid placeholder '%s'", arg[i:end])
+		}
+		if text.Len() > 0 {
+			parts = append(parts, preparedPart{text: text.String()})
+			text.Reset()
+		}
+		parts = append(parts, preparedPart{param: n})
+		i = end - 1
+	}
+	if text.Len() > 0 || len(parts) == 0 {
+		parts = append(parts, preparedPart{text: text.String()})
+	}
+	return parts, ""
+}
+
+// bind returns the command line with the placeholders replaced by params.
+func (p *preparedCommand) bind(params []string) []string {
+	args := make([]string, 1+len(p.args))
+	args[0] = p.cmd
+	for i, parts := range p.args {
+		if len(parts) == 1 {
+			if parts[0].param == 0 {
+				args[i+1] = parts[0].text
+			} else {
+				args[i+1] = params[parts[0].param-1]
+			}
+			continue
+		}
+		var b strings.Builder
+		for _, part := range parts {
+			if part.param == 0 {
+				b.WriteString(part.text)
+			} else {
+				b.WriteString(params[part.param-1])
+			}
+		}
+		args[i+1] = b.String()
+	}
+	return args
+}
+
+// execute handles EXECUTE id [param ...], running a prepared command with
+// its placeholders bound to the parameters. The command is checked against
+// the client's ACL and logged as if the client had sent it.
+func execute(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR EXECUTE is only available on client connections\r\n")
+		return
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	p, ok := c.prepared[id]
+	if err != nil || !ok {
+		fmt.Fprintf(conn, "-ERR unknown prepared command '%s'\r\n", args[1])
+		return
+	}
+	if params := len(args) - 2; params != p.params {
+		fmt.Fprintf(conn, "-ERR prepared command %d takes %d parameters, got %d\r\n", id, p.params, params)
+		return
+	}
+	dispatch(p.cmd, p.handler, p.bind(args[2:]), conn, s, a)
+}
+
+// deallocate handles DEALLOCATE id [id ...] and DEALLOCATE ALL, dropping
+// prepared commands and replying with how many were.
+func deallocate(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR DEALLOCATE is only available on client connections\r\n")
+		return
+	}
+	if len(args) == 2 && strings.EqualFold(args[1], "ALL") {
+		n := len(c.prepared)
+		c.prepared = nil
+		fmt.Fprintf(conn, ":%d\r\n", n)
+		return
+	}
+	n := 0
+	for _, arg := range args[1:] {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if _, ok := c.prepared[id]; err == nil && ok {
+			delete(c.prepared, id)
+			n++
+		}
+	}
+	fmt.Fprintf(conn, ":%d\r\n", n)
+}
@@ -0,0 +1,284 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Pub/Sub delivers published messages to the clients subscribed to their
+// channel, or to a pattern matching it. Messages are written to a subscriber
+// through its outbox, so a slow subscriber can't stall the publisher, which
+// holds the server's command lock.
+//
+// RESP3 clients get messages and subscription confirmations as push frames,
+// which can't be mistaken for replies, so they may keep running any command
+// on the same connection while subscribed.
+
+// pubsubBufferLimit is how many bytes of messages may wait for a subscriber
+// before it is disconnected.
+const pubsubBufferLimit = 32 << 20
+
+// pubsub maps channels and patterns to their subscribers.
+var pubsub = struct {
+	sync.Mutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{}
+}{
+	channels: make(map[string]map[*Client]struct{}),
+	patterns: make(map[string]map[*Client]struct{}),
+}
+
+// subscribedCommands are the commands a RESP2 client may run while
+// subscribed, when its connection only carries messages.
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+}
+
+// outbox queues the replies and messages of a subscribed client and writes
+// them to the connection in the background.
+type outbox struct {
+	mu     sync.Mutex
+	buf    []byte
+	wake   chan struct{}
+	closed bool
+}
+
+// newOutbox starts writing the queued output of c.
+func newOutbox(c *Client) *outbox {
+	o := &outbox{wake: make(chan struct{}, 1)}
+	openOutboxes.Add(1)
+	go func() {
+		for range o.wake {
+			o.mu.Lock()
+			buf := o.buf
+			o.buf = nil
+			o.mu.Unlock()
+			if _, err := c.Conn.Write(buf); err != nil {
+				c.Conn.Close()
+			}
+		}
+	}()
+	return o
+}
+
+// write queues p, disconnecting c once too much output is waiting.
+func (o *outbox) write(c *Client, p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, net.ErrClosed
+	}
+	if len(o.buf)+len(p) > pubsubBufferLimit {
+		log.Printf("Subscriber %s exceeded the output buffer limit, disconnecting", c.RemoteAddr())
+		o.closed = true
+		close(o.wake)
+		openOutboxes.Add(-1)
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	o.buf = append(o.buf, p...)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// close stops the writer once the queued output is written.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.wake)
+		openOutboxes.Add(-1)
+	}
+}
+
+// pushType returns the type byte of out-of-band messages to c: a push under
+// RESP3 and an array under RESP2.
+func (c *Client) pushType() byte {
+	if c.proto == 3 {
+		return '>'
+	}
+	return '*'
+}
+
+// subscriptions returns how many channels and patterns c is subscribed to.
+func (c *Client) subscriptions() int {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	return len(c.channels) + len(c.patterns)
+}
+
+// subscribe handles SUBSCRIBE channel [channel ...] and PSUBSCRIBE pattern
+// [pattern ...], confirming each subscription with the client's new count.
+func subscribe(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	name := strings.ToLower(args[0])
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR %s is only available to client connections\r\n", strings.ToUpper(name))
+		return
+	}
+	if c.outbox == nil {
+		c.outbox = newOutbox(c)
+	}
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	subs, mine := pubsub.channels, &c.channels
+	if name == "psubscribe" {
+		subs, mine = pubsub.patterns, &c.patterns
+	}
+	if *mine == nil {
+		*mine = make(map[string]struct{})
+	}
+	for _, target := range args[1:] {
+		if subs[target] == nil {
+			subs[target] = make(map[*Client]struct{})
+		}
+		subs[target][c] = struct{}{}
+		(*mine)[target] = struct{}{}
+		fmt.Fprintf(conn, "%c3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n",
+			c.pushType(), len(name), name, len(target), target, len(c.channels)+len(c.patterns))
+	}
+}
+
+// unsubscribe handles UNSUBSCRIBE [channel ...] and PUNSUBSCRIBE [pattern
+// ...]. Without arguments, the client leaves all its channels or patterns.
+func unsubscribe(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	name := strings.ToLower(args[0])
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR %s is only available to client connections\r\n", strings.ToUpper(name))
+		return
+	}
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	subs, mine := pubsub.channels, c.channels
+	if name == "punsubscribe" {
+		subs, mine = pubsub.patterns, c.patterns
+	}
+	targets := args[1:]
+	if len(targets) == 0 {
+		for target := range mine {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+	}
+	if len(targets) == 0 {
+		fmt.Fprintf(conn, "%c3\r\n$%d\r\n%s\r\n$-1\r\n:%d\r\n", c.pushType(), len(name), name, len(c.channels)+len(c.patterns))
+		return
+	}
+	for _, target := range targets {
+		delete(mine, target)
+		delete(subs[target], c)
+		if len(subs[target]) == 0 {
+			delete(subs, target)
+		}
+		fmt.Fprintf(conn, "%c3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n",
+			c.pushType(), len(name), name, len(target), target, len(c.channels)+len(c.patterns))
+	}
+}
+
+// unsubscribeAll drops every subscription of a disconnecting client.
+func (c *Client) unsubscribeAll() {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	for channel := range c.channels {
+		delete(pubsub.channels[channel], c)
+		if len(pubsub.channels[channel]) == 0 {
+			delete(pubsub.channels, channel)
+		}
+	}
+	for pattern := range c.patterns {
+		delete(pubsub.patterns[pattern], c)
+		if len(pubsub.patterns[pattern]) == 0 {
+			delete(pubsub.patterns, pattern)
+		}
+	}
+	c.channels, c.patterns = nil, nil
+}
+
+// publish handles the PUBLISH command: PUBLISH channel message. It replies
+// with the number of clients that received the message.
+func publish(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	fmt.Fprintf(conn, ":%d\r\n", publishMessage(args[1], args[2]))
+}
+
+// publishMessage sends message to the subscribers of channel and of the
+// patterns matching it, returning how many deliveries were made. It must be
+// called with the server's command lock held.
+func publishMessage(channel, message string) int {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	n := 0
+	for c := range pubsub.channels[channel] {
+		fmt.Fprintf(c, "%c3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+			c.pushType(), len(channel), channel, len(message), message)
+		n++
+	}
+	for pattern, subs := range pubsub.patterns {
+		if !store.MatchPattern(pattern, channel) {
+			continue
+		}
+		for c := range subs {
+			fmt.Fprintf(c, "%c4\r\n$8\r\npmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+				c.pushType(), len(pattern), pattern, len(channel), channel, len(message), message)
+			n++
+		}
+	}
+	return n
+}
+
+// pubsubCmd handles the PUBSUB command:
+//
+//	PUBSUB CHANNELS [pattern]          channels with at least one subscriber
+//	PUBSUB NUMSUB [channel ...]        subscribers of each channel
+//	PUBSUB NUMPAT                      patterns subscribed to by any client
+func pubsubCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	pubsub.Lock()
+	defer pubsub.Unlock()
+	switch strings.ToUpper(args[1]) {
+	case "CHANNELS":
+		if len(args) > 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'pubsub|channels' command\r\n")
+			return
+		}
+		var channels []string
+		for channel := range pubsub.channels {
+			if len(args) == 2 || store.MatchPattern(args[2], channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		fmt.Fprintf(conn, "*%d\r\n", len(channels))
+		for _, channel := range channels {
+			writeBulk(conn, channel)
+		}
+	case "NUMSUB":
+		fmt.Fprintf(conn, "*%d\r\n", 2*(len(args)-2))
+		for _, channel := range args[2:] {
+			writeBulk(conn, channel)
+			fmt.Fprintf(conn, ":%d\r\n", len(pubsub.channels[channel]))
+		}
+	case "NUMPAT":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'pubsub|numpat' command\r\n")
+			return
+		}
+		fmt.Fprintf(conn, ":%d\r\n", len(pubsub.patterns))
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
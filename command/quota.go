@@ -0,0 +1,225 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Quotas cap how much of the server an ACL user may use per period, so one
+// tenant of a shared instance can't monopolize it. They are set with ACL
+// rules of the form
+//
+//	quota:commands:<n>/<period>      commands of any kind
+//	quota:cmd:<name>:<n>/<period>    commands of one kind, like KEYS
+//	quota:bytes:<n>/<period>         bytes of commands and replies
+//
+// where the period is "second", "minute", "hour", "day" or a duration like
+// "10m". Periods are fixed windows aligned to multiples of their length, so
+// daily quotas reset at midnight UTC. Once a quota is used up, commands are
+// refused until its window ends; a command is allowed as long as some of
+// the quota is left, so the bytes of its reply may overshoot it.
+
+// Quota is a limit on a user's use of the server per period.
+type Quota struct {
+	// Scope is "commands", "bytes" or "cmd:<name>" with a lowercase
+	// command name.
+	Scope  string
+	Limit  int64
+	Period time.Duration
+}
+
+// quotaExempt lists the commands quotas don't apply to, so a user who ran
+// out can still log in and find out why.
+var quotaExempt = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"QUOTA": true,
+}
+
+// quotaWindow is the use of a quota in its current window.
+type quotaWindow struct {
+	start time.Time
+	used  int64
+}
+
+// quotaUsage holds the windows of every user's quotas, by user name and
+// scope, so it survives ACL SETUSER replacing the user.
+var quotaUsage = struct {
+	sync.Mutex
+	byUser map[string]map[string]*quotaWindow
+}{byUser: make(map[string]map[string]*quotaWindow)}
+
+// parseQuota parses the part of a quota rule after "quota:".
+func parseQuota(rule string) (Quota, error) {
+	spec, period, ok := strings.Cut(rule, "/")
+	i := strings.LastIndex(spec, ":")
+	if !ok || i < 0 {
+		return Quota{}, fmt.Errorf("quota must be <scope>:<limit>/<period>")
+	}
+	q := Quota{Scope: strings.ToLower(spec[:i])}
+	if q.Scope != "commands" && q.Scope != "bytes" && (!strings.HasPrefix(q.Scope, "cmd:") || q.Scope == "cmd:") {
+		return Quota{}, fmt.Errorf("unknown quota scope '%s'", spec[:i])
+	}
+	limit, err := strconv.ParseInt(spec[i+1:], 10, 64)
+	if err != nil || limit < 0 {
+		return Quota{}, fmt.Errorf("quota limit must be a non-negative integer")
+	}
+	q.Limit = limit
+	switch strings.ToLower(period) {
+	case "second":
+		q.Period = time.Second
+	case "minute":
+		q.Period = time.Minute
+	case "hour":
+		q.Period = time.Hour
+	case "day":
+		q.Period = 24 * time.Hour
+	default:
+		q.Period, err = time.ParseDuration(period)
+		if err != nil || q.Period < time.Second {
+			return Quota{}, fmt.Errorf("quota period must be second, minute, hour, day or a duration of at least 1s")
+		}
+	}
+	return q, nil
+}
+
+// String formats the quota as the ACL rule that sets it.
+func (q Quota) String() string {
+	return fmt.Sprintf("quota:%s:%d/%s", q.Scope, q.Limit, q.periodName())
+}
+
+// periodName names the quota's period as its ACL rule does.
+func (q Quota) periodName() string {
+	switch q.Period {
+	case time.Second:
+		return "second"
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	case 24 * time.Hour:
+		return "day"
+	}
+	return q.Period.String()
+}
+
+// quotaWindowOf returns the current window of a user's quota, starting a new one
+// if the last has ended. The caller must hold the quotaUsage lock.
+func quotaWindowOf(user string, q Quota, now time.Time) *quotaWindow {
+	windows := quotaUsage.byUser[user]
+	if windows == nil {
+		windows = make(map[string]*quotaWindow)
+		quotaUsage.byUser[user] = windows
+	}
+	start := now.Truncate(q.Period)
+	w := windows[q.Scope]
+	if w == nil || w.start != start {
+		w = &quotaWindow{start: start}
+		windows[q.Scope] = w
+	}
+	return w
+}
+
+// admitQuota charges a command to the quotas of u, or returns the error
+// reply (without the leading '-') if one of them is used up.
+func admitQuota(u *User, cmd string, args []string) string {
+	if len(u.Quotas) == 0 || quotaExempt[cmd] {
+		return ""
+	}
+	size := int64(0)
+	for _, arg := range args {
+		size += int64(len(arg))
+	}
+	scope := "cmd:" + strings.ToLower(cmd)
+	now := time.Now()
+	quotaUsage.Lock()
+	defer quotaUsage.Unlock()
+	for _, q := range u.Quotas {
+		if q.Scope != "commands" && q.Scope != "bytes" && q.Scope != scope {
+			continue
+		}
+		if w := quotaWindowOf(u.Name, q, now); w.used >= q.Limit {
+			resetsIn := w.start.Add(q.Period).Sub(now)
+			return fmt.Sprintf("QUOTA User %s used up its %s quota of %d per %s, which resets in %ds",
+				u.Name, q.Scope, q.Limit, q.periodName(), int64(resetsIn.Seconds()+1))
+		}
+	}
+	for _, q := range u.Quotas {
+		switch q.Scope {
+		case "commands", scope:
+			quotaWindowOf(u.Name, q, now).used++
+		case "bytes":
+			quotaWindowOf(u.Name, q, now).used += size
+		}
+	}
+	return ""
+}
+
+// chargeQuotaBytes charges n bytes of output to the bandwidth quota of u.
+func chargeQuotaBytes(u *User, n int) {
+	for _, q := range u.Quotas {
+		if q.Scope == "bytes" {
+			quotaUsage.Lock()
+			quotaWindowOf(u.Name, q, time.Now()).used += int64(n)
+			quotaUsage.Unlock()
+		}
+	}
+}
+
+// quotaCmd handles the QUOTA command:
+//
+//	QUOTA                 the quotas of the current user
+//	QUOTA GET user        the quotas of another user
+//	QUOTA RESET user      start the windows of a user's quotas afresh
+//
+// Quotas are reported one per line, with their use in the current window.
+func quotaCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	var u *User
+	switch {
+	case len(args) == 1:
+		if c := clientOf(conn); c != nil {
+			u = c.User
+		}
+		if u == nil {
+			fmt.Fprintf(conn, "-ERR no user to report quotas for\r\n")
+			return
+		}
+	case len(args) == 3 && (strings.EqualFold(args[1], "GET") || strings.EqualFold(args[1], "RESET")):
+		var ok bool
+		if u, ok = lookupUser(args[2]); !ok {
+			fmt.Fprintf(conn, "-ERR User '%s' not found\r\n", args[2])
+			return
+		}
+		if strings.EqualFold(args[1], "RESET") {
+			quotaUsage.Lock()
+			delete(quotaUsage.byUser, u.Name)
+			quotaUsage.Unlock()
+			fmt.Fprintf(conn, "+OK\r\n")
+			return
+		}
+	default:
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+
+	quotas := append([]Quota(nil), u.Quotas...)
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Scope < quotas[j].Scope })
+	now := time.Now()
+	var b strings.Builder
+	quotaUsage.Lock()
+	for _, q := range quotas {
+		w := quotaWindowOf(u.Name, q, now)
+		fmt.Fprintf(&b, "%s:limit=%d,used=%d,period_sec=%d,resets_in_sec=%d\r\n",
+			q.Scope, q.Limit, w.used, int64(q.Period.Seconds()), int64(w.start.Add(q.Period).Sub(now).Seconds()))
+	}
+	quotaUsage.Unlock()
+	writeBulk(conn, b.String())
+}
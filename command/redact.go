@@ -0,0 +1,123 @@
+package command
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Commands are redacted before they are shown in the slow log or a MONITOR
+// feed, so secrets sent to the server don't leak through observability. The
+// credentials of AUTH, HELLO AUTH and the password rules of ACL SETUSER are
+// always redacted. On top of that, the redact-commands and redact-keys
+// rules redact every argument but the keys of the listed commands and of
+// commands on matching keys.
+
+// redactedArg replaces a redacted argument.
+const redactedArg = "(redacted)"
+
+// redaction holds the configured rules.
+var redaction = struct {
+	sync.RWMutex
+	commands map[string]bool
+	keys     []string
+}{commands: make(map[string]bool)}
+
+// SetupRedaction sets the commands and key patterns whose arguments are
+// redacted.
+func SetupRedaction(commands, keyPatterns []string) {
+	redaction.Lock()
+	defer redaction.Unlock()
+	redaction.commands = make(map[string]bool)
+	for _, cmd := range commands {
+		if cmd = strings.ToUpper(strings.TrimSpace(cmd)); cmd != "" {
+			redaction.commands[cmd] = true
+		}
+	}
+	redaction.keys = nil
+	for _, pattern := range keyPatterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			redaction.keys = append(redaction.keys, pattern)
+		}
+	}
+}
+
+// redactionRules returns the configured rules as comma-separated lists, for
+// CONFIG GET.
+func redactionRules() (commands, keys string) {
+	redaction.RLock()
+	defer redaction.RUnlock()
+	var names []string
+	for cmd := range redaction.commands {
+		names = append(names, strings.ToLower(cmd))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ","), strings.Join(redaction.keys, ",")
+}
+
+// redactArgs returns args as they may be recorded, with redacted arguments
+// replaced. args itself is never modified.
+func redactArgs(args []string) []string {
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "AUTH":
+		return redactFrom(args, 1)
+	case cmd == "HELLO":
+		for i, arg := range args {
+			if strings.EqualFold(arg, "AUTH") {
+				return redactFrom(args, i+1)
+			}
+		}
+	case cmd == "ACL" && len(args) > 1 && strings.EqualFold(args[1], "SETUSER"):
+		redacted := append([]string(nil), args...)
+		for i := 3; i < len(redacted); i++ {
+			if strings.HasPrefix(redacted[i], ">") || strings.HasPrefix(redacted[i], "<") || strings.HasPrefix(redacted[i], "#") {
+				redacted[i] = redacted[i][:1] + redactedArg
+			}
+		}
+		return redacted
+	}
+
+	redaction.RLock()
+	defer redaction.RUnlock()
+	spec, hasKeys := keySpecs[cmd]
+	var keys []int
+	if hasKeys {
+		keys = spec.keyIndexes(args)
+	}
+	redact := redaction.commands[cmd]
+	for _, i := range keys {
+		if redact {
+			break
+		}
+		for _, pattern := range redaction.keys {
+			if store.MatchPattern(pattern, args[i]) {
+				redact = true
+				break
+			}
+		}
+	}
+	if !redact {
+		return args
+	}
+	redacted := make([]string, len(args))
+	redacted[0] = args[0]
+	for i := 1; i < len(args); i++ {
+		redacted[i] = redactedArg
+	}
+	for _, i := range keys {
+		redacted[i] = args[i]
+	}
+	return redacted
+}
+
+// redactFrom returns a copy of args with every argument from i on redacted.
+func redactFrom(args []string, i int) []string {
+	redacted := append([]string(nil), args...)
+	for ; i < len(redacted); i++ {
+		redacted[i] = redactedArg
+	}
+	return redacted
+}
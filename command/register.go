@@ -0,0 +1,188 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Commands can be added from outside the package with Register, so servers
+// built from this repository can carry their own commands without forking
+// it. Registration happens before the server starts, either from the init
+// function of a package linked into the binary, from a Go plugin loaded
+// with LoadModule, or from a WebAssembly module loaded with LoadWasmModule.
+
+// Flags describe what a registered command does, for the server's checks.
+type Flags uint
+
+const (
+	// FlagWrite marks a command that modifies the dataset. Its handler must
+	// log what it changed with LogEffects, as commands the AOF replays, like
+	// SET, which also propagates them to replicas and standbys. It is
+	// refused on offline snapshots.
+	FlagWrite Flags = 1 << iota
+	// FlagReadOnly marks a command that only reads the dataset.
+	FlagReadOnly
+	// FlagAdmin marks a command that administers the server, which users
+	// confined to a namespace can't run.
+	FlagAdmin
+	// FlagNoKeys marks a command that neither takes keys nor touches the
+	// dataset, which users confined to a namespace may then run. Commands
+	// with neither it nor key positions are refused to them, as their keys
+	// couldn't be confined.
+	FlagNoKeys
+)
+
+// Command describes a command added with RegisterCommand.
+type Command struct {
+	Name string
+	// Arity is the number of arguments, counting the command name, or the
+	// least number, negated, for variadic commands, as in COMMAND INFO.
+	Arity int
+	Flags Flags
+	// FirstKey, LastKey and KeyStep are the positions of the key arguments,
+	// LastKey counting from the end when negative, as in COMMAND INFO.
+	// FirstKey is 0 for commands that declare no keys. Commands taking keys
+	// have them confined to the namespace of users that have one.
+	FirstKey, LastKey, KeyStep int
+	Handler                    Handler
+}
+
+// modules holds the paths of the modules loaded, with the
+// commands each registered, and the path of the one being loaded.
+var modules = struct {
+	sync.Mutex
+	loaded  map[string][]string
+	loading string
+}{loaded: make(map[string][]string)}
+
+// ModuleInit is the name of the function a module built as a Go plugin
+// exports, with the signature func() error, to register its commands.
+const ModuleInit = "RegisterCommands"
+
+// LoadModule opens the Go plugin at path and calls its ModuleInit function.
+// Plugins must be built with the same Go version and package versions as
+// the server, and can't be unloaded.
+func LoadModule(path string) error {
+	modules.Lock()
+	if _, ok := modules.loaded[path]; ok {
+		modules.Unlock()
+		return fmt.Errorf("module %s is already loaded", path)
+	}
+	modules.Unlock()
+
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup(ModuleInit)
+	if err != nil {
+		return err
+	}
+	register, ok := sym.(func() error)
+	if !ok {
+		return fmt.Errorf("module %s: %s is not a func() error", path, ModuleInit)
+	}
+
+	return loadingModule(path, register)
+}
+
+// loadingModule calls register, recording the commands it registers as the
+// module at path's.
+func loadingModule(path string, register func() error) error {
+	modules.Lock()
+	modules.loading = path
+	modules.loaded[path] = []string{}
+	modules.Unlock()
+	defer func() {
+		modules.Lock()
+		modules.loading = ""
+		modules.Unlock()
+	}()
+	if err := register(); err != nil {
+		return fmt.Errorf("module %s: %w", path, err)
+	}
+	return nil
+}
+
+// Register adds a command that declares no key positions, checking its arity
+// before the handler runs. Users confined to a namespace can't run it unless
+// flags has FlagNoKeys; commands taking keys are added with RegisterCommand
+// to declare them. It must be called before the server starts serving, and
+// fails if name is taken.
+func Register(name string, arity int, flags Flags, handler Handler) error {
+	return RegisterCommand(Command{Name: name, Arity: arity, Flags: flags, Handler: handler})
+}
+
+// RegisterCommand adds a command described by cmd, like Register.
+func RegisterCommand(cmd Command) error {
+	name := strings.ToUpper(cmd.Name)
+	switch {
+	case name == "" || strings.ContainsAny(name, " \r\n"):
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	case cmd.Handler == nil:
+		return fmt.Errorf("command %s has no handler", name)
+	case cmd.Arity == 0 || cmd.Arity == -1 && cmd.FirstKey > 0:
+		return fmt.Errorf("command %s has an invalid arity", name)
+	case cmd.FirstKey < 0 || cmd.FirstKey > 0 && cmd.KeyStep <= 0:
+		return fmt.Errorf("command %s has invalid key positions", name)
+	case cmd.Flags&FlagWrite != 0 && cmd.Flags&FlagReadOnly != 0:
+		return fmt.Errorf("command %s can't be both a write and read-only", name)
+	case cmd.Flags&FlagNoKeys != 0 && (cmd.FirstKey > 0 || cmd.Flags&FlagWrite != 0):
+		return fmt.Errorf("command %s is flagged as taking no keys but takes keys or writes", name)
+	}
+	if _, taken := Handlers[name]; taken {
+		return fmt.Errorf("command %s already exists", name)
+	}
+	cmd.Name = name
+
+	modules.Lock()
+	if modules.loading != "" {
+		modules.loaded[modules.loading] = append(modules.loaded[modules.loading], name)
+	}
+	modules.Unlock()
+	Handlers[name] = commandHandler(cmd.Handler)
+	argSpecs[name] = argSpec{arity: cmd.Arity}
+	if cmd.Flags&FlagWrite != 0 {
+		writeCommands[name] = true
+	}
+	if cmd.FirstKey > 0 {
+		keySpecs[name] = keySpec{cmd.FirstKey, cmd.LastKey, cmd.KeyStep}
+	} else if cmd.Flags&(FlagNoKeys|FlagAdmin) == FlagNoKeys {
+		namespaceSafe[name] = true
+	}
+	return nil
+}
+
+// module handles MODULE LIST, replying with the modules loaded with
+// LoadModule or LoadWasmModule and the commands each registered.
+func module(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if !strings.EqualFold(args[1], "LIST") {
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+		return
+	}
+	modules.Lock()
+	defer modules.Unlock()
+	paths := make([]string, 0, len(modules.loaded))
+	for path := range modules.loaded {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	fmt.Fprintf(conn, "*%d\r\n", len(paths))
+	for _, path := range paths {
+		fmt.Fprintf(conn, "*4\r\n")
+		writeBulk(conn, "path")
+		writeBulk(conn, path)
+		writeBulk(conn, "commands")
+		fmt.Fprintf(conn, "*%d\r\n", len(modules.loaded[path]))
+		for _, name := range modules.loaded[path] {
+			writeBulk(conn, strings.ToLower(name))
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// A server becomes a replica with REPLICAOF host port, and a master again
+// with REPLICAOF NO ONE. A replica takes a full resynchronization from its
+// master, as the master side offers, then applies the write stream and
+// refuses writes from clients. The stream is passed on to its own replicas
+// byte for byte, under the master's replication ID and offsets, so replicas
+// serve full syncs to sub-replicas and an offset means the same point of
+// the stream all along the chain. Writes the replica applies go to its own
+// AOF only if its appendonly setting says so.
+
+// ListeningPort is the port the server accepts clients on, which a replica
+// announces to its master. It is set by the server.
+var ListeningPort string
+
+// Timings of the link to the master, as Redis' repl-timeout and the period
+// of its acknowledgements.
+const (
+	masterTimeout     = 60 * time.Second
+	masterAckPeriod   = time.Second
+	masterRetryPeriod = time.Second
+)
+
+// masterLink is a replica's link to its master. Its state is guarded by the
+// replication lock.
+type masterLink struct {
+	host, port string
+	// state is "connect" until the master is reached, "sync" during the
+	// full resynchronization and "connected" while the stream is applied.
+	state  string
+	lastIO time.Time
+	conn   net.Conn
+	// writeMu serializes the acknowledgements written to conn.
+	writeMu sync.Mutex
+	stopped bool
+}
+
+// isReplica is set while the server replicates a master, for the hot path
+// check that refuses client writes.
+var isReplica atomic.Bool
+
+// discardConn is the connection the master's stream is applied with. Its
+// replies are thrown away, and since it is not a Client the commands run
+// without client checks.
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// REPLICAOF applies the master's stream with Handle, which refers back to
+// Handlers.
+func init() {
+	Handlers["REPLICAOF"] = replicaof
+	Handlers["SLAVEOF"] = replicaof
+}
+
+// replicaof handles the REPLICAOF and SLAVEOF commands: REPLICAOF host port
+// or REPLICAOF NO ONE.
+func replicaof(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if strings.EqualFold(args[1], "NO") && strings.EqualFold(args[2], "ONE") {
+		replication.Lock()
+		link := replication.master
+		replication.master = nil
+		if link != nil {
+			// The stream the server now produces is its own: replicas that
+			// followed the old master's must not take it for the same one.
+			replication.id = newReplicationID()
+			link.stop()
+		}
+		replication.Unlock()
+		isReplica.Store(false)
+		if link != nil {
+			log.Printf("MASTER MODE enabled (user request)")
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+		return
+	}
+	if port, err := strconv.Atoi(args[2]); err != nil || port < 1 || port > 65535 {
+		fmt.Fprintf(conn, "-ERR Invalid master port\r\n")
+		return
+	}
+
+	replication.Lock()
+	if old := replication.master; old != nil {
+		if old.host == args[1] && old.port == args[2] {
+			replication.Unlock()
+			fmt.Fprintf(conn, "+OK Already connected to specified master\r\n")
+			return
+		}
+		old.stop()
+	}
+	link := &masterLink{host: args[1], port: args[2], state: "connect"}
+	replication.master = link
+	replication.Unlock()
+	isReplica.Store(true)
+	log.Printf("REPLICAOF %s:%s enabled (user request)", link.host, link.port)
+	go link.run(s, a)
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// newReplicationID returns a random replication ID.
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// stop closes the link for good. The caller must hold the replication lock.
+func (l *masterLink) stop() {
+	l.stopped = true
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// current reports whether the link is still the server's link to its
+// master. The caller must hold the replication lock.
+func (l *masterLink) current() bool {
+	return replication.master == l && !l.stopped
+}
+
+// run keeps the replica synchronized with the master, reconnecting until
+// the link is stopped.
+func (l *masterLink) run(s *store.Store, a *aof.AOF) {
+	for {
+		err := l.follow(s, a)
+		replication.Lock()
+		if !l.current() {
+			replication.Unlock()
+			return
+		}
+		l.state, l.conn = "connect", nil
+		replication.Unlock()
+		log.Printf("Connection with master %s:%s lost: %v", l.host, l.port, err)
+		time.Sleep(masterRetryPeriod)
+	}
+}
+
+// follow connects to the master, resynchronizes and applies its stream
+// until the connection fails or the link is stopped.
+func (l *masterLink) follow(s *store.Store, a *aof.AOF) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(l.host, l.port), masterTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	replication.Lock()
+	if !l.current() {
+		replication.Unlock()
+		return nil
+	}
+	l.conn, l.state, l.lastIO = conn, "sync", time.Now()
+	replication.Unlock()
+
+	r := bufio.NewReader(conn)
+	id, offset, err := l.handshake(conn, r)
+	if err != nil {
+		return err
+	}
+	payload, err := readRDBPayload(conn, r)
+	if err != nil {
+		return err
+	}
+	if err := l.load(s, a, payload, id, offset); err != nil {
+		return err
+	}
+	log.Printf("MASTER <-> REPLICA sync: Finished with success")
+
+	done := make(chan struct{})
+	defer close(done)
+	go l.acknowledge(done)
+	for {
+		conn.SetReadDeadline(time.Now().Add(masterTimeout))
+		args, raw, err := readStreamCommand(r)
+		if err != nil {
+			return err
+		}
+		if !l.apply(s, a, args, raw) {
+			return nil
+		}
+	}
+}
+
+// handshake introduces the replica to the master and asks it for a full
+// resynchronization, returning the master's replication ID and offset.
+func (l *masterLink) handshake(conn net.Conn, r *bufio.Reader) (string, int64, error) {
+	conn.SetDeadline(time.Now().Add(masterTimeout))
+	defer conn.SetDeadline(time.Time{})
+	steps := [][]string{{"PING"}, {"REPLCONF", "listening-port", ListeningPort}, {"REPLCONF", "capa", "psync2"}}
+	for _, step := range steps {
+		if step[len(step)-1] == "" {
+			continue
+		}
+		if _, err := conn.Write(encodeCommand(step)); err != nil {
+			return "", 0, err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", 0, err
+		}
+		if strings.HasPrefix(line, "-") {
+			return "", 0, fmt.Errorf("master refused %s: %s", step[0], strings.TrimSpace(line[1:]))
+		}
+	}
+	if _, err := conn.Write(encodeCommand([]string{"PSYNC", "?", "-1"})); err != nil {
+		return "", 0, err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return "", 0, fmt.Errorf("unexpected reply to PSYNC: %s", strings.TrimSpace(line))
+	}
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected reply to PSYNC: %s", strings.TrimSpace(line))
+	}
+	return fields[1], offset, nil
+}
+
+// readRDBPayload reads the RDB a master sends after +FULLRESYNC, a bulk
+// string without the trailing CRLF. Masters may send newlines to keep the
+// connection alive while they produce it.
+func readRDBPayload(conn net.Conn, r *bufio.Reader) ([]byte, error) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(masterTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if !strings.HasPrefix(line, "$") || err != nil || n < 0 {
+			return nil, fmt.Errorf("unexpected RDB payload header: %s", line)
+		}
+		payload := make([]byte, n)
+		conn.SetReadDeadline(time.Time{})
+		_, err = io.ReadFull(r, payload)
+		return payload, err
+	}
+}
+
+// load replaces the dataset with the master's RDB and takes on the master's
+// replication ID and offset. The replica's own replicas are disconnected to
+// resynchronize with the new dataset. The AOF is seeded with the dataset, so
+// it replays to what the master sent.
+func (l *masterLink) load(s *store.Store, a *aof.AOF, payload []byte, id string, offset int64) error {
+	// REPLICAOF runs under the server lock too, so the link stays current
+	// until the load is done.
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	replication.Lock()
+	current := l.current()
+	replication.Unlock()
+	if !current {
+		return nil
+	}
+	s.Flush()
+	s.FlushFunctionLibraries()
+	keys, err := s.ReadRDB(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to load the master's RDB: %w", err)
+	}
+	log.Printf("MASTER <-> REPLICA sync: Loaded %d keys (%d bytes) at offset %d", keys, len(payload), offset)
+	a.WriteCommand("FLUSHALL")
+	a.WriteCommand("FUNCTION", "FLUSH")
+	s.RewriteCommands(func(args []string) error {
+		return a.WriteCommand(args[0], args[1:]...)
+	})
+
+	replication.Lock()
+	defer replication.Unlock()
+	replication.id, replication.offset = id, offset
+	for r := range replication.replicas {
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+		r.c.Conn.Close()
+		delete(replication.replicas, r)
+	}
+	l.state, l.lastIO = "connected", time.Now()
+	return nil
+}
+
+// apply runs a command of the master's stream and passes it on to the
+// replica's own replicas. It reports false once the link is stopped.
+func (l *masterLink) apply(s *store.Store, a *aof.AOF, args []string, raw []byte) bool {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	replication.Lock()
+	current := l.current()
+	offset := replication.offset
+	l.lastIO = time.Now()
+	replication.Unlock()
+	if !current {
+		return false
+	}
+	if len(args) == 3 && strings.EqualFold(args[0], "REPLCONF") && strings.EqualFold(args[1], "GETACK") {
+		// The acknowledged offset excludes the GETACK itself, as in Redis.
+		l.ack(offset)
+	} else if len(args) > 0 {
+		Handle(args, discardConn{}, s, a)
+	}
+	replication.Lock()
+	defer replication.Unlock()
+	feedReplicas(raw)
+	return true
+}
+
+// acknowledge reports the replica's offset to the master every
+// masterAckPeriod until done is closed.
+func (l *masterLink) acknowledge(done chan struct{}) {
+	ticker := time.NewTicker(masterAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			l.ack(replicationOffset())
+		}
+	}
+}
+
+// ack sends REPLCONF ACK with offset to the master.
+func (l *masterLink) ack(offset int64) {
+	replication.Lock()
+	conn := l.conn
+	replication.Unlock()
+	if conn == nil {
+		return
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	conn.Write(encodeCommand([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}))
+}
+
+// readStreamCommand reads a command of the master's stream, returning its
+// arguments and the bytes it took in the stream, which the offsets count.
+// A bare newline, which masters may send to keep the link alive, is
+// returned as a command without arguments.
+func readStreamCommand(r *bufio.Reader) ([]string, []byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := []byte(line)
+	header := strings.TrimRight(line, "\r\n")
+	if header == "" {
+		return nil, raw, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(header, "*"))
+	if !strings.HasPrefix(header, "*") || err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("unexpected line in the replication stream: %q", header)
+	}
+	args := make([]string, 0, n)
+	for range n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = append(raw, line...)
+		size, err := strconv.Atoi(strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "$"))
+		if !strings.HasPrefix(line, "$") || err != nil || size < 0 {
+			return nil, nil, fmt.Errorf("unexpected bulk header in the replication stream: %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, nil, err
+		}
+		raw = append(raw, arg...)
+		args = append(args, string(arg[:size]))
+	}
+	return args, raw, nil
+}
+
+// encodeCommand encodes a command as a RESP array of bulk strings.
+func encodeCommand(args []string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.Bytes()
+}
+
+// infoMasterLink renders the fields of the replication section describing
+// the link to the master. The caller must hold the replication lock.
+func infoMasterLink(l *masterLink) string {
+	var b strings.Builder
+	status, syncing := "down", 0
+	switch l.state {
+	case "connected":
+		status = "up"
+	case "sync":
+		syncing = 1
+	}
+	fmt.Fprintf(&b, "role:slave\r\n")
+	fmt.Fprintf(&b, "master_host:%s\r\n", l.host)
+	fmt.Fprintf(&b, "master_port:%s\r\n", l.port)
+	fmt.Fprintf(&b, "master_link_status:%s\r\n", status)
+	if !l.lastIO.IsZero() {
+		fmt.Fprintf(&b, "master_last_io_seconds_ago:%d\r\n", int64(time.Since(l.lastIO).Seconds()))
+	} else {
+		fmt.Fprintf(&b, "master_last_io_seconds_ago:-1\r\n")
+	}
+	fmt.Fprintf(&b, "master_sync_in_progress:%d\r\n", syncing)
+	fmt.Fprintf(&b, "slave_repl_offset:%d\r\n", replication.offset)
+	fmt.Fprintf(&b, "slave_read_only:1\r\n")
+	return b.String()
+}
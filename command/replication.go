@@ -0,0 +1,269 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Replication speaks enough of the Redis master side of the REPLCONF/PSYNC
+// protocol that a real Redis server can replicate from this one: a replica
+// always gets a full resynchronization, an RDB snapshot followed by the write
+// stream. Partial resynchronization and dual-channel sync aren't offered, so
+// replicas that ask for them fall back to a full sync. The replica side,
+// REPLICAOF, is in replicaof.go.
+
+// replicaPingPeriod is how often replicas are pinged, so they don't time out
+// while the dataset isn't being written to.
+const replicaPingPeriod = 10 * time.Second
+
+// replicaBufferLimit is how much unsent write stream a replica may fall behind
+// before it is disconnected, like Redis' client-output-buffer-limit.
+const replicaBufferLimit = 256 << 20
+
+// replica is a connected replica and the write stream it hasn't been sent yet.
+type replica struct {
+	c         *Client
+	listening string
+	mu        sync.Mutex
+	pending   []byte
+	wake      chan struct{}
+	closed    bool
+	ackOffset int64
+	// fackOffset is the offset up to which the replica reported the write
+	// stream fsynced to its AOF, for WAITAOF.
+	fackOffset int64
+}
+
+// replication is the replication state: the replication ID, the number of
+// bytes of write stream produced so far, or received from the master on a
+// replica, the attached replicas and the link to the master, if any.
+var replication = struct {
+	sync.Mutex
+	id       string
+	offset   int64
+	replicas map[*replica]struct{}
+	master   *masterLink
+}{id: newReplicationID(), replicas: make(map[*replica]struct{})}
+
+// SetupReplication feeds the write stream of a to replicas and starts pinging
+// them.
+func SetupReplication(a *aof.AOF) {
+	a.AddFeed(propagate)
+	go func() {
+		for range time.Tick(replicaPingPeriod) {
+			replication.Lock()
+			attached := len(replication.replicas)
+			replication.Unlock()
+			if attached > 0 {
+				propagate([]string{"PING"})
+			}
+		}
+	}()
+}
+
+// propagate appends a command to the replication stream and queues it for
+// every replica. A replica passes on its master's stream instead, so the
+// commands it runs itself aren't propagated.
+func propagate(args []string) {
+	if isReplica.Load() {
+		return
+	}
+	b := encodeCommand(args)
+	replication.Lock()
+	defer replication.Unlock()
+	feedReplicas(b)
+}
+
+// feedReplicas appends b to the replication stream and queues it for every
+// replica. A replica that has fallen too far behind is dropped. The caller
+// must hold the replication lock.
+func feedReplicas(b []byte) {
+	replication.offset += int64(len(b))
+	for r := range replication.replicas {
+		r.mu.Lock()
+		if len(r.pending)+len(b) > replicaBufferLimit {
+			log.Printf("Replica %s exceeded the output buffer limit, disconnecting", r.c.RemoteAddr())
+			r.closed = true
+			delete(replication.replicas, r)
+			r.c.Conn.Close()
+		} else {
+			r.pending = append(r.pending, b...)
+		}
+		r.mu.Unlock()
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stream sends the replica its pending write stream until the connection fails.
+func (r *replica) stream() {
+	defer r.detach()
+	for range r.wake {
+		r.mu.Lock()
+		out, closed := r.pending, r.closed
+		r.pending = nil
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		if _, err := r.c.Conn.Write(out); err != nil {
+			log.Printf("Replica %s disconnected: %v", r.c.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// detach stops propagating the write stream to the replica.
+func (r *replica) detach() {
+	replication.Lock()
+	delete(replication.replicas, r)
+	replication.Unlock()
+}
+
+// replicaOf returns the replica state of c, or nil if c isn't a replica.
+func replicaOf(c *Client) *replica {
+	replication.Lock()
+	defer replication.Unlock()
+	for r := range replication.replicas {
+		if r.c == c {
+			return r
+		}
+	}
+	return nil
+}
+
+// replconf handles the REPLCONF command, which replicas use to describe
+// themselves during the handshake and to acknowledge the stream afterwards.
+func replconf(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args)%2 == 0 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'replconf' command\r\n")
+		return
+	}
+	c := clientOf(conn)
+	switch strings.ToLower(args[1]) {
+	case "ack":
+		// Acknowledgements, REPLCONF ACK <offset> [FACK <aofoffset>], are
+		// never replied to.
+		if r := replicaOf(c); r != nil {
+			if offset, err := strconv.ParseInt(args[2], 10, 64); err == nil {
+				r.mu.Lock()
+				r.ackOffset = offset
+				if len(args) == 5 && strings.EqualFold(args[3], "fack") {
+					if fack, err := strconv.ParseInt(args[4], 10, 64); err == nil {
+						r.fackOffset = fack
+					}
+				}
+				r.mu.Unlock()
+			}
+		}
+		return
+	case "listening-port", "ip-address", "capa", "rdb-only", "rdb-filter-only", "rdb-channel":
+		// Capabilities only matter for features that aren't offered, so
+		// they are accepted and ignored; the listening port is reported by
+		// INFO replication.
+		if strings.EqualFold(args[1], "listening-port") && c != nil {
+			c.replicaPort = args[2]
+		}
+	default:
+		fmt.Fprintf(conn, "-ERR Unrecognized REPLCONF option: %s\r\n", args[1])
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// psync handles the PSYNC command. The dataset is copied while the command
+// holds the server lock, at the same point in the write stream the replica is
+// attached, so the snapshot and the stream that follows it line up exactly.
+func psync(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	c := clientOf(conn)
+	if c == nil {
+		fmt.Fprintf(conn, "-ERR PSYNC is only available on client connections\r\n")
+		return
+	}
+	if replicaOf(c) != nil {
+		fmt.Fprintf(conn, "-ERR Replica already synchronizing\r\n")
+		return
+	}
+	replication.Lock()
+	if l := replication.master; l != nil && l.state != "connected" {
+		replication.Unlock()
+		fmt.Fprintf(conn, "-NOMASTERLINK Can't SYNC while not connected with my master\r\n")
+		return
+	}
+	replication.Unlock()
+	snapshot := snapshotStore(s)
+
+	// Replicas expect a SELECT before the first command of the stream. A
+	// replica's stream is its master's, which must be passed on unchanged.
+	r := &replica{c: c, listening: c.replicaPort, wake: make(chan struct{}, 1)}
+	if !isReplica.Load() {
+		r.pending = []byte("*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n")
+	}
+	replication.Lock()
+	id, offset := replication.id, replication.offset
+	replication.offset += int64(len(r.pending))
+	replication.replicas[r] = struct{}{}
+	replication.Unlock()
+	log.Printf("Replica %s asked for synchronization, starting full resync at offset %d", c.RemoteAddr(), offset)
+
+	c.deferred = func() {
+		fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n", id, offset)
+		// Unlike other bulk strings, the RDB payload isn't followed by CRLF.
+		var payload bytes.Buffer
+		if err := snapshot.WriteRDB(&payload); err != nil {
+			log.Printf("Full resync failed: %v", err)
+			r.detach()
+			c.Conn.Close()
+			return
+		}
+		fmt.Fprintf(conn, "$%d\r\n", payload.Len())
+		if _, err := payload.WriteTo(conn); err != nil {
+			r.detach()
+			return
+		}
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+		go r.stream()
+	}
+}
+
+// infoReplication renders the replication section.
+func infoReplication(s *store.Store, a *aof.AOF) string {
+	replication.Lock()
+	list := make([]*replica, 0, len(replication.replicas))
+	for r := range replication.replicas {
+		list = append(list, r)
+	}
+	id, offset := replication.id, replication.offset
+	var b strings.Builder
+	if l := replication.master; l != nil {
+		b.WriteString(infoMasterLink(l))
+	} else {
+		fmt.Fprintf(&b, "role:master\r\n")
+	}
+	replication.Unlock()
+
+	fmt.Fprintf(&b, "connected_slaves:%d\r\n", len(list))
+	for i, r := range list {
+		host, _, _ := net.SplitHostPort(r.c.RemoteAddr().String())
+		r.mu.Lock()
+		fmt.Fprintf(&b, "slave%d:ip=%s,port=%s,state=online,offset=%d\r\n", i, host, r.listening, r.ackOffset)
+		r.mu.Unlock()
+	}
+	fmt.Fprintf(&b, "master_replid:%s\r\n", id)
+	fmt.Fprintf(&b, "master_repl_offset:%d\r\n", offset)
+	return b.String()
+}
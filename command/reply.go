@@ -0,0 +1,68 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+)
+
+// replyChunkSize bounds the part of a large reply held in memory before it
+// is written to the connection.
+const replyChunkSize = 64 << 10
+
+// replyStream writes a large reply to a connection in chunks of at most
+// replyChunkSize, so replies of any size are sent with a bounded buffer and
+// few writes.
+type replyStream struct {
+	w *bufio.Writer
+}
+
+// newReplyStream starts a reply to conn with an array header of n elements.
+func newReplyStream(conn net.Conn, n int) *replyStream {
+	r := &replyStream{w: bufio.NewWriterSize(conn, replyChunkSize)}
+	fmt.Fprintf(r.w, "*%d\r\n", n)
+	return r
+}
+
+// newMapReplyStream starts a reply to conn with the header of a map of n
+// key-value pairs.
+func newMapReplyStream(conn net.Conn, n int) *replyStream {
+	r := &replyStream{w: bufio.NewWriterSize(conn, replyChunkSize)}
+	r.w.WriteString(mapHeader(conn, n))
+	return r
+}
+
+// mapHeader returns the header of a map of n key-value pairs: a RESP3 map
+// for clients that negotiated RESP3, and an array of alternating keys and
+// values otherwise.
+func mapHeader(conn net.Conn, n int) string {
+	if protoOf(conn) == 3 {
+		return fmt.Sprintf("%%%d\r\n", n)
+	}
+	return fmt.Sprintf("*%d\r\n", 2*n)
+}
+
+// protoOf returns the RESP version negotiated by the client behind conn,
+// which may be recording the reply for the result cache, or 2 if conn isn't
+// a client's.
+func protoOf(conn net.Conn) int {
+	if rec, ok := conn.(*recordingConn); ok {
+		conn = rec.Conn
+	}
+	if c := clientOf(conn); c != nil {
+		return c.proto
+	}
+	return 2
+}
+
+// bulk adds a bulk string to the reply.
+func (r *replyStream) bulk(s string) {
+	fmt.Fprintf(r.w, "$%d\r\n", len(s))
+	r.w.WriteString(s)
+	r.w.WriteString("\r\n")
+}
+
+// end writes the rest of the reply.
+func (r *replyStream) end() {
+	r.w.Flush()
+}
@@ -0,0 +1,277 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// SnapshotFile is the file SAVE and BGSAVE write the snapshot of the dataset
+// to, and the server loads it from at startup.
+var SnapshotFile = "dump.rdb"
+
+// CheckSnapshotFile checks that path can name the snapshot file: it isn't
+// empty and its directory exists.
+func CheckSnapshotFile(path string) error {
+	if path == "" {
+		return fmt.Errorf("the snapshot file name can't be empty")
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(path))
+	}
+	return nil
+}
+
+// saveRetryDelay is how long the save rules wait after a failed background
+// save before trying again, as Redis waits.
+const saveRetryDelay = 5 * time.Second
+
+// SaveRule triggers a background save once Changes write commands have run
+// and Seconds have passed since the last snapshot.
+type SaveRule struct {
+	Seconds int64
+	Changes int64
+}
+
+// ParseSaveRules parses save rules given as "seconds changes" pairs, such as
+// "900 1 300 10". An empty value means no rules.
+func ParseSaveRules(value string) ([]SaveRule, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save rules are 'seconds changes' pairs")
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid number of seconds '%s'", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 1 {
+			return nil, fmt.Errorf("invalid number of changes '%s'", fields[i+1])
+		}
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// formatSaveRules formats save rules as ParseSaveRules parses them.
+func formatSaveRules(rules []SaveRule) string {
+	parts := make([]string, 0, 2*len(rules))
+	for _, r := range rules {
+		parts = append(parts, strconv.FormatInt(r.Seconds, 10), strconv.FormatInt(r.Changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// bgsave is the state of snapshots.
+var bgsave struct {
+	sync.Mutex
+	// running is set while BGSAVE writes a snapshot.
+	running bool
+	// rules are the save rules SaveCycle applies.
+	rules []SaveRule
+	// savedOffset is the number of write commands that had run, as the AOF
+	// counts them, when the last successful snapshot was taken, and
+	// lastSave when it was, or when the server started if none was.
+	savedOffset int64
+	lastSave    time.Time
+	// lastTry is when the last background save started, and failed is set
+	// if it failed, until a snapshot succeeds.
+	lastTry time.Time
+	failed  bool
+}
+
+// snapshotInfo is the state of snapshots, as INFO persistence reports it.
+type snapshotInfo struct {
+	// changes counts the write commands run since the last snapshot.
+	changes  int64
+	lastSave time.Time
+	running  bool
+	// failed is set if the last background save failed.
+	failed bool
+}
+
+// snapshotStatus returns the state of snapshots.
+func snapshotStatus(a *aof.AOF) snapshotInfo {
+	written, _ := a.Offsets()
+	bgsave.Lock()
+	defer bgsave.Unlock()
+	return snapshotInfo{
+		changes:  written - bgsave.savedOffset,
+		lastSave: bgsave.lastSave,
+		running:  bgsave.running,
+		failed:   bgsave.failed,
+	}
+}
+
+// SetupSnapshots sets the save rules and starts counting the changes since
+// the last snapshot from now.
+func SetupSnapshots(rules []SaveRule) {
+	bgsave.Lock()
+	defer bgsave.Unlock()
+	bgsave.rules = rules
+	bgsave.lastSave = time.Now()
+}
+
+// SaveCycle starts a background save when a save rule's thresholds are hit.
+// It runs as a background cycle of the server and takes the server lock only
+// to start the save.
+func SaveCycle(s *store.Store, a *aof.AOF) {
+	bgsave.Lock()
+	rule, due := dueSaveRule(a)
+	bgsave.Unlock()
+	if !due || serverLock == nil {
+		return
+	}
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	bgsave.Lock()
+	defer bgsave.Unlock()
+	// The state may have changed while the lock was awaited.
+	if _, due := dueSaveRule(a); !due {
+		return
+	}
+	log.Printf("%d changes in %d seconds. Saving...", rule.Changes, rule.Seconds)
+	startBGSave(s, a)
+}
+
+// dueSaveRule returns the first save rule whose thresholds are hit, unless a
+// background save is running or failed too recently. The caller must hold
+// bgsave's lock.
+func dueSaveRule(a *aof.AOF) (SaveRule, bool) {
+	if bgsave.running || (bgsave.failed && time.Since(bgsave.lastTry) < saveRetryDelay) {
+		return SaveRule{}, false
+	}
+	written, _ := a.Offsets()
+	changes := written - bgsave.savedOffset
+	elapsed := time.Since(bgsave.lastSave)
+	for _, r := range bgsave.rules {
+		if changes >= r.Changes && elapsed >= time.Duration(r.Seconds)*time.Second {
+			return r, true
+		}
+	}
+	return SaveRule{}, false
+}
+
+// save handles the SAVE command, which writes the snapshot while holding the
+// server lock, so every other client waits until it is on disk.
+func save(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	bgsave.Lock()
+	running := bgsave.running
+	bgsave.Unlock()
+	if running {
+		fmt.Fprintf(conn, "-ERR Background save already in progress\r\n")
+		return
+	}
+	if err := writeSnapshot(SnapshotFile, s); err != nil {
+		fmt.Fprintf(conn, "-ERR %v\r\n", err)
+		return
+	}
+	written, _ := a.Offsets()
+	bgsave.Lock()
+	bgsave.savedOffset, bgsave.lastSave = written, time.Now()
+	bgsave.failed = false
+	bgsave.Unlock()
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// lastsave handles the LASTSAVE command, which replies with the Unix time of
+// the last successful snapshot, or of the server's start if none was taken
+// since, as Redis does.
+func lastsave(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	fmt.Fprintf(conn, ":%d\r\n", snapshotStatus(a).lastSave.Unix())
+}
+
+// bgsaveCmd handles the BGSAVE command. The dataset is copied while the
+// command holds the server lock, which makes the snapshot consistent, and
+// the copy is written by a goroutine of its own.
+func bgsaveCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	bgsave.Lock()
+	defer bgsave.Unlock()
+	if bgsave.running {
+		fmt.Fprintf(conn, "-ERR Background save already in progress\r\n")
+		return
+	}
+	startBGSave(s, a)
+	fmt.Fprintf(conn, "+Background saving started\r\n")
+}
+
+// startBGSave copies the dataset and writes the copy from a goroutine. The
+// caller must hold the server lock and bgsave's lock, and have checked that
+// no background save is running.
+func startBGSave(s *store.Store, a *aof.AOF) {
+	bgsave.running = true
+	bgsave.lastTry = time.Now()
+	snapshot := snapshotStore(s)
+	written, _ := a.Offsets()
+	path := SnapshotFile
+	go func() {
+		err := writeSnapshot(path, snapshot)
+		if err != nil {
+			log.Printf("Background save failed: %v", err)
+		}
+		bgsave.Lock()
+		defer bgsave.Unlock()
+		bgsave.running = false
+		bgsave.failed = err != nil
+		if err == nil {
+			bgsave.savedOffset, bgsave.lastSave = written, time.Now()
+		}
+	}()
+}
+
+// writeSnapshot writes the snapshot of s to a temporary file next to path,
+// then renames it over path, so path always holds a complete snapshot.
+func writeSnapshot(path string, s *store.Store) error {
+	start := time.Now()
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create the snapshot file: %w", err)
+	}
+	err = s.WriteSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write the snapshot: %w", err)
+	}
+	log.Printf("DB saved on disk in %s", time.Since(start))
+	return nil
+}
+
+// LoadSnapshot loads the snapshot SAVE and BGSAVE write into s, which is
+// meant to be empty, and returns how many keys it loaded. A missing file
+// loads nothing.
+func LoadSnapshot(s *store.Store) (int, error) {
+	f, err := os.Open(SnapshotFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return s.ReadRDB(f)
+}
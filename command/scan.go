@@ -0,0 +1,176 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// scanOptions holds the optional arguments shared by the SCAN command family.
+type scanOptions struct {
+	match    string
+	count    int
+	typeName string
+}
+
+// parseScanOptions parses the MATCH, COUNT and (when allowType is set) TYPE
+// options that follow the cursor. It writes an error reply and returns false
+// on bad input.
+func parseScanOptions(args []string, allowType bool, conn net.Conn) (scanOptions, bool) {
+	opts := scanOptions{count: 10}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return opts, false
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			opts.match = args[i+1]
+		case "COUNT":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+				return opts, false
+			}
+			if count < 1 {
+				fmt.Fprintf(conn, "-ERR syntax error\r\n")
+				return opts, false
+			}
+			opts.count = count
+		case "TYPE":
+			if !allowType {
+				fmt.Fprintf(conn, "-ERR syntax error\r\n")
+				return opts, false
+			}
+			opts.typeName = strings.ToLower(args[i+1])
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return opts, false
+		}
+	}
+	return opts, true
+}
+
+// parseCursor parses a SCAN cursor, writing an error reply on bad input.
+func parseCursor(arg string, conn net.Conn) (int, bool) {
+	cursor, err := strconv.Atoi(arg)
+	if err != nil || cursor < 0 {
+		fmt.Fprintf(conn, "-ERR invalid cursor\r\n")
+		return 0, false
+	}
+	return cursor, true
+}
+
+// writeScanReply writes the two-element [cursor, elements] reply used by the SCAN family.
+func writeScanReply(conn net.Conn, cursor int, elements []string) {
+	next := strconv.Itoa(cursor)
+	fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, len(elements))
+	for _, element := range elements {
+		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(element), element)
+	}
+}
+
+// scan handles the SCAN command, which incrementally iterates the keyspace.
+func scan(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cursor, ok := parseCursor(args[1], conn)
+	if !ok {
+		return
+	}
+	opts, ok := parseScanOptions(args[2:], true, conn)
+	if !ok {
+		return
+	}
+	// Namespaced users only see their own keys, without the prefix.
+	ns := ""
+	if c := clientOf(conn); c != nil {
+		ns = c.namespace()
+	}
+	if ns != "" {
+		match := opts.match
+		if match == "" {
+			match = "*"
+		}
+		opts.match = escapeGlob(ns) + match
+	}
+	keys, next := s.Scan(cursor, opts.count, opts.match, opts.typeName)
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], ns)
+	}
+	writeScanReply(conn, next, keys)
+}
+
+// sscan handles the SSCAN command, which incrementally iterates a set.
+func sscan(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cursor, ok := parseCursor(args[2], conn)
+	if !ok {
+		return
+	}
+	opts, ok := parseScanOptions(args[3:], false, conn)
+	if !ok {
+		return
+	}
+	page, next, err := s.SScan(args[1], cursor, opts.count)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	var members []string
+	for _, member := range page {
+		if opts.match == "" || store.MatchPattern(opts.match, member) {
+			members = append(members, member)
+		}
+	}
+	writeScanReply(conn, next, members)
+}
+
+// hscan handles the HSCAN command, which incrementally iterates a hash.
+func hscan(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cursor, ok := parseCursor(args[2], conn)
+	if !ok {
+		return
+	}
+	opts, ok := parseScanOptions(args[3:], false, conn)
+	if !ok {
+		return
+	}
+	page, next, err := s.HScan(args[1], cursor, opts.count)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	var pairs []string
+	for i := 0; i < len(page); i += 2 {
+		if opts.match == "" || store.MatchPattern(opts.match, page[i]) {
+			pairs = append(pairs, page[i], page[i+1])
+		}
+	}
+	writeScanReply(conn, next, pairs)
+}
+
+// zscan handles the ZSCAN command, which incrementally iterates a sorted set.
+func zscan(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cursor, ok := parseCursor(args[2], conn)
+	if !ok {
+		return
+	}
+	opts, ok := parseScanOptions(args[3:], false, conn)
+	if !ok {
+		return
+	}
+	page, next, err := s.ZScan(args[1], cursor, opts.count)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	var pairs []string
+	for _, m := range page {
+		if opts.match == "" || store.MatchPattern(opts.match, m.Member) {
+			pairs = append(pairs, m.Member, formatScore(m.Score))
+		}
+	}
+	writeScanReply(conn, next, pairs)
+}
@@ -0,0 +1,480 @@
+package command
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/lua"
+	"github.com/nazeeeef007/redis-clone/resp"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Scripts are Lua code run on the server, as in Redis: EVAL sends a script
+// with each call, or once with SCRIPT LOAD to be called by its SHA1 with
+// EVALSHA, and FUNCTION LOAD adds libraries of named functions, called with
+// FCALL. A script runs atomically, as no other command runs until it is
+// done, and reaches the dataset with redis.call, which runs a command as
+// the client calling the script would and returns its reply as a Lua value.
+// The commands it runs log their writes as usual, framed as a transaction
+// in the AOF, so scripts replicate as their effects rather than as the
+// script.
+
+// Scripts call Handlers through redis.call, so the scripting commands are
+// registered here rather than in its initializer.
+func init() {
+	Handlers["EVAL"] = eval
+	Handlers["EVALSHA"] = evalsha
+	Handlers["EVAL_RO"] = evalRO
+	Handlers["EVALSHA_RO"] = evalshaRO
+	Handlers["SCRIPT"] = script
+}
+
+// scriptTimeout bounds how long a script may run. A script running longer
+// is stopped, and the writes it made before stay made.
+const scriptTimeout = 5 * time.Second
+
+// noScriptCommands can't be run by scripts, as they change the connection,
+// wait for something or run scripts themselves.
+var noScriptCommands = map[string]bool{
+	"AUTH":         true,
+	"HELLO":        true,
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"MONITOR":      true,
+	"WAITAOF":      true,
+	"MULTI":        true,
+	"EXEC":         true,
+	"DISCARD":      true,
+	"WATCH":        true,
+	"UNWATCH":      true,
+	"PREPARE":      true,
+	"EXECUTE":      true,
+	"DEALLOCATE":   true,
+	"REPLICAOF":    true,
+	"SLAVEOF":      true,
+	"REPLCONF":     true,
+	"PSYNC":        true,
+	"BACKUP":       true,
+	"SAVE":         true,
+	"BGSAVE":       true,
+	"BGREWRITEAOF": true,
+	"EVAL":         true,
+	"EVALSHA":      true,
+	"EVAL_RO":      true,
+	"EVALSHA_RO":   true,
+	"SCRIPT":       true,
+	"FUNCTION":     true,
+	"FCALL":        true,
+	"FCALL_RO":     true,
+}
+
+// scripting holds the Lua state EVAL scripts run in, with the scripts
+// compiled in it by SHA1, and the script running, in it or in a library's
+// state. It is held while a script is loaded or runs.
+var scripting struct {
+	sync.Mutex
+	state   *lua.State
+	scripts map[string]*lua.Function
+	run     *scriptRun
+}
+
+// scriptRun is what the script running runs its commands against.
+type scriptRun struct {
+	conn net.Conn
+	s    *store.Store
+	a    *aof.AOF
+	// readOnly refuses write commands, for EVAL_RO and FCALL_RO and
+	// functions flagged no-writes.
+	readOnly bool
+}
+
+// scriptConn collects the reply of a command a script runs, for the script
+// rather than the client.
+type scriptConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *scriptConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+// newScriptState returns a Lua state with the redis library, in which
+// scripts can't create globals.
+func newScriptState() *lua.State {
+	L := lua.NewState()
+	L.SetStrict(true)
+	redis := lua.NewTable()
+	for name, fn := range map[string]lua.GoFunction{
+		"call": func(L *lua.State, args []lua.Value) []lua.Value {
+			reply := scriptCall(L, args)
+			if t, ok := reply.(*lua.Table); ok && t.GetString("err") != nil {
+				L.Raise(t)
+			}
+			return []lua.Value{reply}
+		},
+		"pcall": func(L *lua.State, args []lua.Value) []lua.Value {
+			return []lua.Value{scriptCall(L, args)}
+		},
+		"error_reply": func(L *lua.State, args []lua.Value) []lua.Value {
+			return []lua.Value{replyTable("err", L.CheckString(args, 1, "error_reply"))}
+		},
+		"status_reply": func(L *lua.State, args []lua.Value) []lua.Value {
+			return []lua.Value{replyTable("ok", L.CheckString(args, 1, "status_reply"))}
+		},
+		"sha1hex": func(L *lua.State, args []lua.Value) []lua.Value {
+			return []lua.Value{sha1hex(L.CheckString(args, 1, "sha1hex"))}
+		},
+		"log": func(L *lua.State, args []lua.Value) []lua.Value {
+			L.CheckNumber(args, 1, "log")
+			parts := make([]string, 0, len(args)-1)
+			for i := 2; i <= len(args); i++ {
+				parts = append(parts, L.CheckString(args, i, "log"))
+			}
+			log.Printf("Script: %s", strings.Join(parts, " "))
+			return nil
+		},
+		// Scripts always replicate as their effects, which scripts written
+		// for Redis before 5.0 ask for with this.
+		"replicate_commands": func(L *lua.State, args []lua.Value) []lua.Value {
+			return []lua.Value{true}
+		},
+	} {
+		redis.Set(name, lua.NewFunction(name, fn))
+	}
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.Set(level, float64(i))
+	}
+	L.Globals.Set("redis", redis)
+	return L
+}
+
+// replyTable returns the table a status or error reply is to a script:
+// {ok = text} or {err = text}.
+func replyTable(field, text string) *lua.Table {
+	t := lua.NewTable()
+	t.Set(field, text)
+	return t
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptCall runs the command redis.call or redis.pcall was given and
+// returns its reply, which is an error table if the command failed.
+func scriptCall(L *lua.State, args []lua.Value) lua.Value {
+	run := scripting.run
+	if run == nil {
+		L.Errorf("redis.call can only be called while a script runs")
+	}
+	if len(args) == 0 {
+		return replyTable("err", "ERR Please specify at least one argument for this redis lib call")
+	}
+	cmdArgs := make([]string, len(args))
+	for i, v := range args {
+		switch v := v.(type) {
+		case string:
+			cmdArgs[i] = v
+		case float64:
+			cmdArgs[i], _ = lua.ToString(v)
+		default:
+			return replyTable("err", "ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmd := strings.ToUpper(cmdArgs[0])
+	handler, ok := Handlers[cmd]
+	switch {
+	case !ok:
+		return replyTable("err", "ERR Unknown Redis command called from script")
+	case noScriptCommands[cmd]:
+		return replyTable("err", "ERR This Redis command is not allowed from script")
+	case writeCommands[cmd] && run.readOnly:
+		return replyTable("err", "ERR Write commands are not allowed from read-only scripts.")
+	}
+	if c := clientOf(run.conn); c != nil {
+		if writeCommands[cmd] && isReplica.Load() {
+			return replyTable("err", "READONLY You can't write against a read only replica.")
+		}
+		var denied string
+		if cmdArgs, denied = checkAccess(c, cmd, cmdArgs); denied != "" {
+			return replyTable("err", denied)
+		}
+	}
+	conn := &scriptConn{Conn: run.conn}
+	runCommand(cmd, handler, cmdArgs, conn, run.s, run.a)
+	reply, err := resp.NewDecoder(&conn.buf).Decode()
+	if err != nil {
+		return replyTable("err", "ERR the command's reply can't be read: "+err.Error())
+	}
+	return replyToLua(reply)
+}
+
+// replyToLua converts a command's reply to a Lua value as Redis does:
+// integers to numbers, bulk strings to strings, nulls to false, arrays to
+// tables, and status and error replies to {ok = text} and {err = text}.
+func replyToLua(v resp.Value) lua.Value {
+	switch v.Type {
+	case resp.Integer:
+		return float64(v.Integer)
+	case resp.SimpleString:
+		return replyTable("ok", v.String)
+	case resp.Error, resp.BulkError:
+		return replyTable("err", v.String)
+	case resp.Null:
+		return false
+	case resp.Boolean:
+		return v.Bool
+	case resp.Double:
+		return v.Double
+	case resp.Array, resp.Set, resp.Push, resp.Map:
+		if v.Null {
+			return false
+		}
+		t := lua.NewTable()
+		for _, element := range v.Array {
+			t.Append(replyToLua(element))
+		}
+		return t
+	}
+	if v.Null {
+		return false
+	}
+	return v.String
+}
+
+// replyLine makes text fit on the line of a status or error reply.
+var replyLine = strings.NewReplacer("\r", " ", "\n", " ")
+
+// writeScriptReply writes the value a script returned as the reply to its
+// call, converted as Redis does: strings to bulk strings, numbers to
+// integers, true to 1, false and nil to null, {ok = text} and {err = text}
+// to status and error replies, and other tables to arrays of their elements
+// up to the first nil.
+func writeScriptReply(conn net.Conn, v lua.Value) {
+	switch v := v.(type) {
+	case string:
+		writeBulk(conn, v)
+	case float64:
+		fmt.Fprintf(conn, ":%d\r\n", int64(v))
+	case bool:
+		if v {
+			fmt.Fprintf(conn, ":1\r\n")
+		} else {
+			fmt.Fprintf(conn, "$-1\r\n")
+		}
+	case *lua.Table:
+		if text, ok := v.GetString("err").(string); ok {
+			fmt.Fprintf(conn, "-%s\r\n", replyLine.Replace(text))
+			return
+		}
+		if text, ok := v.GetString("ok").(string); ok {
+			fmt.Fprintf(conn, "+%s\r\n", replyLine.Replace(text))
+			return
+		}
+		var elements []lua.Value
+		for i := 1; v.Get(float64(i)) != nil; i++ {
+			elements = append(elements, v.Get(float64(i)))
+		}
+		fmt.Fprintf(conn, "*%d\r\n", len(elements))
+		for _, element := range elements {
+			writeScriptReply(conn, element)
+		}
+	default:
+		fmt.Fprintf(conn, "$-1\r\n")
+	}
+}
+
+// scriptKeys splits the arguments following a script or function, numkeys
+// key [key ...] arg [arg ...], into the keys and the other arguments,
+// returning the error reply if numkeys is out of range.
+func scriptKeys(args []string) (keys, argv []string, refused string) {
+	numkeys, _ := strconv.Atoi(args[0])
+	switch {
+	case numkeys < 0:
+		return nil, nil, "ERR Number of keys can't be negative"
+	case numkeys > len(args)-1:
+		return nil, nil, "ERR Number of keys can't be greater than number of args"
+	}
+	return args[1 : 1+numkeys], args[1+numkeys:], ""
+}
+
+// stringsTable returns a Lua array of strings.
+func stringsTable(values []string) *lua.Table {
+	t := lua.NewTable()
+	for _, v := range values {
+		t.Append(v)
+	}
+	return t
+}
+
+// runScript calls fn with args in L and replies with what it returns. The
+// caller holds scripting.
+func runScript(L *lua.State, fn *lua.Function, args []lua.Value, run *scriptRun) {
+	result, err := callScript(L, fn, args, run)
+	if err != nil {
+		writeScriptError(run.conn, err)
+		return
+	}
+	writeScriptReply(run.conn, result)
+}
+
+// callScript calls fn with args in L, stopping it after scriptTimeout, and
+// returns its first result. The caller holds scripting.
+func callScript(L *lua.State, fn *lua.Function, args []lua.Value, run *scriptRun) (lua.Value, error) {
+	scripting.run = run
+	defer func() { scripting.run = nil }()
+	defer run.a.BeginTransaction()()
+	L.SetDeadline(time.Now().Add(scriptTimeout))
+	results, err := L.Call(fn, args...)
+	L.SetDeadline(time.Time{})
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// writeScriptError replies with the error a script raised.
+func writeScriptError(conn net.Conn, err error) {
+	switch e, _ := err.(*lua.Error); {
+	case lua.IsTimeout(err):
+		fmt.Fprintf(conn, "-ERR the script ran longer than %v and was stopped\r\n", scriptTimeout)
+	case e != nil && isErrorTable(e.Value):
+		writeScriptReply(conn, e.Value)
+	default:
+		fmt.Fprintf(conn, "-ERR %s\r\n", replyLine.Replace(err.Error()))
+	}
+}
+
+// isErrorTable reports whether v is an error reply, {err = text}, as
+// redis.call raises.
+func isErrorTable(v lua.Value) bool {
+	t, ok := v.(*lua.Table)
+	if !ok {
+		return false
+	}
+	_, ok = t.GetString("err").(string)
+	return ok
+}
+
+// loadScript compiles body in the scripting state, if it isn't already,
+// and returns it with its SHA1. The caller holds scripting.
+func loadScript(body string) (*lua.Function, string, error) {
+	if scripting.state == nil {
+		scripting.state = newScriptState()
+		scripting.scripts = make(map[string]*lua.Function)
+	}
+	sha := sha1hex(body)
+	if fn, ok := scripting.scripts[sha]; ok {
+		return fn, sha, nil
+	}
+	fn, err := scripting.state.Load(body, "user_script")
+	if err != nil {
+		return nil, "", err
+	}
+	scripting.scripts[sha] = fn
+	return fn, sha, nil
+}
+
+// evalScript runs a script given by its body, or its SHA1 if bySHA, for
+// EVAL script numkeys [key ...] [arg ...] and its variants.
+func evalScript(args []string, conn net.Conn, s *store.Store, a *aof.AOF, bySHA, readOnly bool) {
+	keys, argv, refused := scriptKeys(args[2:])
+	if refused != "" {
+		fmt.Fprintf(conn, "-%s\r\n", refused)
+		return
+	}
+	scripting.Lock()
+	defer scripting.Unlock()
+	var fn *lua.Function
+	if bySHA {
+		fn = scripting.scripts[strings.ToLower(args[1])]
+		if fn == nil {
+			fmt.Fprintf(conn, "-NOSCRIPT No matching script. Please use EVAL.\r\n")
+			return
+		}
+	} else {
+		var err error
+		if fn, _, err = loadScript(args[1]); err != nil {
+			fmt.Fprintf(conn, "-ERR Error compiling script (new function): %s\r\n", replyLine.Replace(err.Error()))
+			return
+		}
+	}
+	L := scripting.state
+	L.Globals.Set("KEYS", stringsTable(keys))
+	L.Globals.Set("ARGV", stringsTable(argv))
+	runScript(L, fn, nil, &scriptRun{conn: conn, s: s, a: a, readOnly: readOnly})
+}
+
+// eval handles EVAL script numkeys [key ...] [arg ...], running script
+// with the keys in KEYS and the other arguments in ARGV.
+func eval(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	evalScript(args, conn, s, a, false, false)
+}
+
+// evalsha handles EVALSHA sha1 numkeys [key ...] [arg ...], running the
+// script loaded with that SHA1.
+func evalsha(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	evalScript(args, conn, s, a, true, false)
+}
+
+// evalRO handles EVAL_RO, which runs a script that can't write.
+func evalRO(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	evalScript(args, conn, s, a, false, true)
+}
+
+// evalshaRO handles EVALSHA_RO, which runs a loaded script that can't
+// write.
+func evalshaRO(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	evalScript(args, conn, s, a, true, true)
+}
+
+// script handles SCRIPT LOAD script, SCRIPT EXISTS sha1 [sha1 ...], SCRIPT
+// FLUSH [ASYNC|SYNC] and SCRIPT KILL. Scripts are loaded in memory only:
+// they are lost on restart and aren't replicated, as EVALSHA callers are
+// expected to fall back to EVAL.
+func script(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	scripting.Lock()
+	defer scripting.Unlock()
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "LOAD" && len(args) == 3:
+		_, sha, err := loadScript(args[2])
+		if err != nil {
+			fmt.Fprintf(conn, "-ERR Error compiling script (new function): %s\r\n", replyLine.Replace(err.Error()))
+			return
+		}
+		writeBulk(conn, sha)
+	case sub == "EXISTS" && len(args) > 2:
+		fmt.Fprintf(conn, "*%d\r\n", len(args)-2)
+		for _, sha := range args[2:] {
+			if _, ok := scripting.scripts[strings.ToLower(sha)]; ok {
+				fmt.Fprintf(conn, ":1\r\n")
+			} else {
+				fmt.Fprintf(conn, ":0\r\n")
+			}
+		}
+	case sub == "FLUSH" && (len(args) == 2 || len(args) == 3 && (strings.EqualFold(args[2], "ASYNC") || strings.EqualFold(args[2], "SYNC"))):
+		scripting.state, scripting.scripts = nil, nil
+		fmt.Fprintf(conn, "+OK\r\n")
+	case sub == "KILL" && len(args) == 2:
+		// Scripts are stopped once they run for scriptTimeout, and no
+		// command runs alongside one to stop it sooner.
+		fmt.Fprintf(conn, "-NOTBUSY No scripts in execution right now.\r\n")
+	case sub == "LOAD" || sub == "EXISTS" || sub == "FLUSH" || sub == "KILL":
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'script|%s' command\r\n", strings.ToLower(sub))
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
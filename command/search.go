@@ -0,0 +1,808 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Search indexes are a subset of RediSearch's: an index covers the hashes
+// at keys with one of its prefixes, and indexes their TAG fields, sets of
+// exact-match tags, and NUMERIC fields, for range queries. FT.SEARCH
+// queries are a sequence of clauses that must all match:
+//
+//	*                   every document
+//	@field:{a | b}      a tag field holding a or b
+//	@field:[min max]    a numeric field in the range, "(" making a bound
+//	                    exclusive and -inf and +inf the open ends
+//	-@field:...         negates a clause
+//
+// Indexes are kept up to date from the write stream: the keys a write
+// touches are reindexed before the next query. Keys that expire aren't in
+// the write stream, so matches are checked against the live hash before
+// they are returned. Like hash schemas, indexes live in memory only and are
+// created again when the server starts, indexing the hashes already there.
+
+// searchIndexes holds the indexes by name.
+var searchIndexes = struct {
+	sync.Mutex
+	byName map[string]*searchIndex
+}{byName: make(map[string]*searchIndex)}
+
+// searchField is a field of an index's schema.
+type searchField struct {
+	name string
+	// typ is TAG or NUMERIC.
+	typ string
+	// separator splits the value of a TAG field into tags, which are
+	// lowercased unless caseSensitive is set.
+	separator     byte
+	caseSensitive bool
+}
+
+// searchDoc holds the values a hash has indexed, by field.
+type searchDoc struct {
+	tags    map[string][]string
+	numbers map[string]float64
+}
+
+// searchNumber is an entry of the sorted index of a NUMERIC field.
+type searchNumber struct {
+	value float64
+	key   string
+}
+
+// searchIndex is an index created with FT.CREATE.
+type searchIndex struct {
+	name     string
+	prefixes []string
+	fields   []*searchField
+	// docs holds what each indexed key has indexed, so it can be taken out
+	// of the index when it changes.
+	docs map[string]searchDoc
+	// tags maps each TAG field and tag to the keys holding it, and numbers
+	// each NUMERIC field to its values, sorted.
+	tags    map[string]map[string]map[string]struct{}
+	numbers map[string][]searchNumber
+	// dirty holds the keys written since the last refresh, and stale is
+	// set when a write's keys aren't known, such as a FLUSHALL, so every
+	// key has to be reindexed.
+	dirty map[string]struct{}
+	stale bool
+}
+
+// SetupSearch keeps the search indexes up to date from the write stream
+// of a.
+func SetupSearch(a *aof.AOF) {
+	a.AddFeed(markSearchDirty)
+}
+
+// markSearchDirty is the write-stream feed that marks the keys a command
+// wrote for reindexing.
+func markSearchDirty(args []string) {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	if len(searchIndexes.byName) == 0 {
+		return
+	}
+	spec, ok := keySpecs[strings.ToUpper(args[0])]
+	for _, idx := range searchIndexes.byName {
+		if !ok {
+			idx.stale = true
+			continue
+		}
+		for _, i := range spec.keyIndexes(args) {
+			if idx.covers(args[i]) {
+				idx.dirty[args[i]] = struct{}{}
+			}
+		}
+	}
+}
+
+// field returns the schema field called name, or nil.
+func (idx *searchIndex) field(name string) *searchField {
+	for _, f := range idx.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// covers reports whether the key has one of the index's prefixes.
+func (idx *searchIndex) covers(key string) bool {
+	for _, p := range idx.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTag returns a tag as the field indexes it.
+func (f *searchField) normalizeTag(tag string) string {
+	tag = strings.TrimSpace(tag)
+	if !f.caseSensitive {
+		tag = strings.ToLower(tag)
+	}
+	return tag
+}
+
+// doc returns the values of a hash the index indexes. Numeric fields that
+// don't hold a number aren't indexed.
+func (idx *searchIndex) doc(hash map[string]string) searchDoc {
+	doc := searchDoc{tags: make(map[string][]string), numbers: make(map[string]float64)}
+	for _, f := range idx.fields {
+		value, ok := hash[f.name]
+		if !ok {
+			continue
+		}
+		switch f.typ {
+		case "TAG":
+			for _, tag := range strings.Split(value, string(f.separator)) {
+				if tag = f.normalizeTag(tag); tag != "" {
+					doc.tags[f.name] = append(doc.tags[f.name], tag)
+				}
+			}
+		case "NUMERIC":
+			if n, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && !math.IsNaN(n) {
+				doc.numbers[f.name] = n
+			}
+		}
+	}
+	return doc
+}
+
+// add indexes a document.
+func (idx *searchIndex) add(key string, doc searchDoc) {
+	idx.docs[key] = doc
+	for field, tags := range doc.tags {
+		for _, tag := range tags {
+			keys := idx.tags[field][tag]
+			if keys == nil {
+				keys = make(map[string]struct{})
+				idx.tags[field][tag] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+	for field, n := range doc.numbers {
+		entries := idx.numbers[field]
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].value > n || entries[i].value == n && entries[i].key >= key
+		})
+		idx.numbers[field] = slices.Insert(entries, i, searchNumber{n, key})
+	}
+}
+
+// remove takes a key out of the index.
+func (idx *searchIndex) remove(key string) {
+	doc, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	delete(idx.docs, key)
+	for field, tags := range doc.tags {
+		for _, tag := range tags {
+			delete(idx.tags[field][tag], key)
+			if len(idx.tags[field][tag]) == 0 {
+				delete(idx.tags[field], tag)
+			}
+		}
+	}
+	for field, n := range doc.numbers {
+		entries := idx.numbers[field]
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].value > n || entries[i].value == n && entries[i].key >= key
+		})
+		if i < len(entries) && entries[i].key == key {
+			idx.numbers[field] = slices.Delete(entries, i, i+1)
+		}
+	}
+}
+
+// reindex indexes the hash at key again, or takes it out of the index if
+// it's gone.
+func (idx *searchIndex) reindex(s *store.Store, key string) {
+	idx.remove(key)
+	if hash := s.HGetAll(key); hash != nil && idx.covers(key) {
+		idx.add(key, idx.doc(hash))
+	}
+}
+
+// refresh brings the index up to date with the writes since the last one.
+func (idx *searchIndex) refresh(s *store.Store) {
+	if idx.stale {
+		idx.rebuild(s)
+		return
+	}
+	for key := range idx.dirty {
+		idx.reindex(s, key)
+	}
+	clear(idx.dirty)
+}
+
+// rebuild indexes every hash the index covers from scratch.
+func (idx *searchIndex) rebuild(s *store.Store) {
+	idx.docs = make(map[string]searchDoc)
+	idx.tags = make(map[string]map[string]map[string]struct{})
+	idx.numbers = make(map[string][]searchNumber)
+	for _, f := range idx.fields {
+		if f.typ == "TAG" {
+			idx.tags[f.name] = make(map[string]map[string]struct{})
+		}
+	}
+	idx.dirty = make(map[string]struct{})
+	idx.stale = false
+	for _, prefix := range idx.prefixes {
+		cursor := 0
+		for {
+			var keys []string
+			keys, cursor = s.Scan(cursor, 1000, escapeGlob(prefix)+"*", "hash")
+			for _, key := range keys {
+				if _, done := idx.docs[key]; !done {
+					idx.reindex(s, key)
+				}
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+}
+
+// searchClause is a clause of a query.
+type searchClause struct {
+	// all matches every document; otherwise field is matched, against tags
+	// for a TAG field and the range from min to max for a NUMERIC one.
+	all    bool
+	negate bool
+	field  *searchField
+	tags   []string
+	min    float64
+	max    float64
+	// minExclusive and maxExclusive exclude the bounds from the range.
+	minExclusive bool
+	maxExclusive bool
+}
+
+// parseSearchQuery parses a query against the index's schema, returning
+// the error reply (without the leading '-') if it's invalid.
+func parseSearchQuery(idx *searchIndex, q string) ([]searchClause, string) {
+	var clauses []searchClause
+	syntaxError := func(i int) ([]searchClause, string) {
+		return nil, fmt.Sprintf("Syntax error at offset %d near '%s'", i, q[i:])
+	}
+	for i := 0; i < len(q); {
+		if q[i] == ' ' || q[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		if q[i] == '*' {
+			clauses = append(clauses, searchClause{all: true})
+			i++
+			continue
+		}
+		var c searchClause
+		if q[i] == '-' {
+			c.negate = true
+			i++
+		}
+		if i == len(q) || q[i] != '@' {
+			return syntaxError(start)
+		}
+		colon := strings.IndexByte(q[i:], ':')
+		if colon < 0 {
+			return syntaxError(start)
+		}
+		name := q[i+1 : i+colon]
+		if c.field = idx.field(name); c.field == nil {
+			return nil, fmt.Sprintf("Unknown field '%s'", name)
+		}
+		i += colon + 1
+		if i == len(q) {
+			return syntaxError(start)
+		}
+		switch {
+		case c.field.typ == "TAG" && q[i] == '{':
+			end := i + 1
+			var tag strings.Builder
+			for ; end < len(q) && q[end] != '}'; end++ {
+				switch {
+				case q[end] == '\\' && end+1 < len(q):
+					end++
+					tag.WriteByte(q[end])
+				case q[end] == '|':
+					c.tags = append(c.tags, c.field.normalizeTag(tag.String()))
+					tag.Reset()
+				default:
+					tag.WriteByte(q[end])
+				}
+			}
+			if end == len(q) {
+				return syntaxError(start)
+			}
+			c.tags = append(c.tags, c.field.normalizeTag(tag.String()))
+			i = end + 1
+		case c.field.typ == "NUMERIC" && q[i] == '[':
+			end := strings.IndexByte(q[i:], ']')
+			if end < 0 {
+				return syntaxError(start)
+			}
+			bounds := strings.Fields(q[i+1 : i+end])
+			var ok1, ok2 bool
+			if len(bounds) == 2 {
+				c.min, c.minExclusive, ok1 = parseSearchBound(bounds[0])
+				c.max, c.maxExclusive, ok2 = parseSearchBound(bounds[1])
+			}
+			if !ok1 || !ok2 {
+				return nil, fmt.Sprintf("Bad numeric range at offset %d near '%s'", start, q[start:i+end+1])
+			}
+			i += end + 1
+		default:
+			return syntaxError(start)
+		}
+		clauses = append(clauses, c)
+	}
+	if len(clauses) == 0 {
+		return syntaxError(0)
+	}
+	return clauses, ""
+}
+
+// parseSearchBound parses a bound of a numeric range.
+func parseSearchBound(arg string) (n float64, exclusive bool, ok bool) {
+	if strings.HasPrefix(arg, "(") {
+		arg, exclusive = arg[1:], true
+	}
+	n, err := strconv.ParseFloat(arg, 64)
+	return n, exclusive, err == nil && !math.IsNaN(n)
+}
+
+// matches reports whether a document matches the clause.
+func (c *searchClause) matches(doc searchDoc) bool {
+	return c.matchesField(doc) != c.negate
+}
+
+// matchesField reports whether a document matches the clause, ignoring
+// its negation.
+func (c *searchClause) matchesField(doc searchDoc) bool {
+	if c.all {
+		return true
+	}
+	if c.field.typ == "TAG" {
+		for _, tag := range doc.tags[c.field.name] {
+			for _, want := range c.tags {
+				if tag == want {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	n, ok := doc.numbers[c.field.name]
+	return ok && c.inRange(n)
+}
+
+// inRange reports whether n is in the clause's numeric range.
+func (c *searchClause) inRange(n float64) bool {
+	if n < c.min || c.minExclusive && n == c.min {
+		return false
+	}
+	return n < c.max || !c.maxExclusive && n == c.max
+}
+
+// candidates returns the keys the index has for a positive clause.
+func (idx *searchIndex) candidates(c *searchClause) map[string]struct{} {
+	keys := make(map[string]struct{})
+	if c.field.typ == "TAG" {
+		for _, tag := range c.tags {
+			for key := range idx.tags[c.field.name][tag] {
+				keys[key] = struct{}{}
+			}
+		}
+		return keys
+	}
+	entries := idx.numbers[c.field.name]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].value >= c.min })
+	for ; i < len(entries) && entries[i].value <= c.max; i++ {
+		if c.inRange(entries[i].value) {
+			keys[entries[i].key] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// searchHit is a document matching a query.
+type searchHit struct {
+	key  string
+	hash map[string]string
+	doc  searchDoc
+}
+
+// search returns the documents matching every clause, sorted by key. The
+// smallest set of candidates a positive clause has in the index is checked
+// against the live hashes.
+func (idx *searchIndex) search(s *store.Store, clauses []searchClause) []searchHit {
+	idx.refresh(s)
+	var candidates map[string]struct{}
+	for i := range clauses {
+		if c := &clauses[i]; !c.all && !c.negate {
+			if keys := idx.candidates(c); candidates == nil || len(keys) < len(candidates) {
+				candidates = keys
+			}
+		}
+	}
+	if candidates == nil {
+		candidates = make(map[string]struct{}, len(idx.docs))
+		for key := range idx.docs {
+			candidates[key] = struct{}{}
+		}
+	}
+	var hits []searchHit
+	for key := range candidates {
+		hash := s.HGetAll(key)
+		if hash == nil {
+			// Expired since it was indexed.
+			idx.dirty[key] = struct{}{}
+			continue
+		}
+		doc := idx.doc(hash)
+		matched := true
+		for i := range clauses {
+			if !clauses[i].matches(doc) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			hits = append(hits, searchHit{key, hash, doc})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].key < hits[j].key })
+	return hits
+}
+
+// sortSearchHits sorts hits by a field, keeping the key order for equal
+// values, with documents lacking the field last.
+func sortSearchHits(hits []searchHit, f *searchField, desc bool) {
+	sort.SliceStable(hits, func(i, j int) bool {
+		a, b := hits[i].doc, hits[j].doc
+		var less, greater, aok, bok bool
+		if f.typ == "NUMERIC" {
+			var x, y float64
+			x, aok = a.numbers[f.name]
+			y, bok = b.numbers[f.name]
+			less, greater = x < y, x > y
+		} else {
+			var x, y string
+			x, aok = hits[i].hash[f.name]
+			y, bok = hits[j].hash[f.name]
+			less, greater = x < y, x > y
+		}
+		if aok != bok {
+			return aok
+		}
+		if desc {
+			return greater
+		}
+		return less
+	})
+}
+
+// lookupSearchIndex returns the index called name, writing the error reply
+// if there is none. searchIndexes must be locked.
+func lookupSearchIndex(conn net.Conn, name string) *searchIndex {
+	idx := searchIndexes.byName[name]
+	if idx == nil {
+		fmt.Fprintf(conn, "-ERR Unknown index name\r\n")
+	}
+	return idx
+}
+
+// ftcreate handles FT.CREATE index [ON HASH] [PREFIX count prefix ...]
+// SCHEMA field {TAG [SEPARATOR sep] [CASESENSITIVE] | NUMERIC} [SORTABLE]
+// [field ...], indexing the hashes already at the prefixes, which default
+// to every key.
+func ftcreate(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	idx := &searchIndex{name: args[1]}
+	i := 2
+	for i < len(args) && !strings.EqualFold(args[i], "SCHEMA") {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "ON" && i+1 < len(args):
+			if !strings.EqualFold(args[i+1], "HASH") {
+				fmt.Fprintf(conn, "-ERR only hashes can be indexed\r\n")
+				return
+			}
+			i += 2
+		case opt == "PREFIX" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 || i+2+n > len(args) {
+				fmt.Fprintf(conn, "-ERR Bad arguments for PREFIX\r\n")
+				return
+			}
+			idx.prefixes = append(idx.prefixes, args[i+2:i+2+n]...)
+			i += 2 + n
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+	if i+1 >= len(args) {
+		fmt.Fprintf(conn, "-ERR Fields arguments are missing\r\n")
+		return
+	}
+	for i++; i < len(args); {
+		f := &searchField{name: args[i], separator: ','}
+		if i+1 == len(args) {
+			fmt.Fprintf(conn, "-ERR Field '%s' has no type\r\n", f.name)
+			return
+		}
+		if idx.field(f.name) != nil {
+			fmt.Fprintf(conn, "-ERR Duplicate field in schema - %s\r\n", f.name)
+			return
+		}
+		f.typ = strings.ToUpper(args[i+1])
+		if f.typ != "TAG" && f.typ != "NUMERIC" {
+			fmt.Fprintf(conn, "-ERR field type '%s' is not supported, only TAG and NUMERIC are\r\n", args[i+1])
+			return
+		}
+		for i += 2; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); {
+			case opt == "SORTABLE":
+				// Every field can be sorted by.
+				continue
+			case opt == "SEPARATOR" && f.typ == "TAG" && i+1 < len(args):
+				if len(args[i+1]) != 1 {
+					fmt.Fprintf(conn, "-ERR Tag separator must be a single character\r\n")
+					return
+				}
+				f.separator = args[i+1][0]
+				i++
+				continue
+			case opt == "CASESENSITIVE" && f.typ == "TAG":
+				f.caseSensitive = true
+				continue
+			}
+			break
+		}
+		idx.fields = append(idx.fields, f)
+	}
+	if len(idx.prefixes) == 0 {
+		idx.prefixes = []string{""}
+	}
+
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	if searchIndexes.byName[idx.name] != nil {
+		fmt.Fprintf(conn, "-ERR Index already exists\r\n")
+		return
+	}
+	idx.rebuild(s)
+	searchIndexes.byName[idx.name] = idx
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// ftsearch handles FT.SEARCH index query [NOCONTENT] [RETURN count field
+// ...] [SORTBY field [ASC|DESC]] [LIMIT offset num], replying with the
+// number of matches followed by the key of each on the page, and its
+// fields unless NOCONTENT is given. Matches are ordered by key unless
+// sorted by a field; LIMIT defaults to the first 10.
+func ftsearch(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	idx := lookupSearchIndex(conn, args[1])
+	if idx == nil {
+		return
+	}
+	clauses, errMsg := parseSearchQuery(idx, args[2])
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-ERR %s\r\n", errMsg)
+		return
+	}
+	noContent := false
+	var returned []string
+	var sortBy *searchField
+	desc := false
+	offset, num := 0, 10
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NOCONTENT":
+			noContent = true
+		case opt == "RETURN" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || i+2+n > len(args) {
+				fmt.Fprintf(conn, "-ERR Bad arguments for RETURN\r\n")
+				return
+			}
+			returned = args[i+2 : i+2+n]
+			i += 1 + n
+		case opt == "SORTBY" && i+1 < len(args):
+			if sortBy = idx.field(args[i+1]); sortBy == nil {
+				fmt.Fprintf(conn, "-ERR Property `%s` not loaded nor in schema\r\n", args[i+1])
+				return
+			}
+			i++
+			if i+1 < len(args) {
+				switch strings.ToUpper(args[i+1]) {
+				case "ASC":
+					i++
+				case "DESC":
+					desc = true
+					i++
+				}
+			}
+		case opt == "LIMIT" && i+2 < len(args):
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1])
+			num, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil || offset < 0 || num < 0 {
+				fmt.Fprintf(conn, "-ERR Bad arguments for LIMIT\r\n")
+				return
+			}
+			i += 2
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+
+	hits := idx.search(s, clauses)
+	if sortBy != nil {
+		sortSearchHits(hits, sortBy, desc)
+	}
+	page := hits[min(offset, len(hits)):min(offset+num, len(hits))]
+	perHit := 2
+	if noContent {
+		perHit = 1
+	}
+	fmt.Fprintf(conn, "*%d\r\n:%d\r\n", 1+perHit*len(page), len(hits))
+	for _, hit := range page {
+		writeBulk(conn, hit.key)
+		if noContent {
+			continue
+		}
+		fields := returned
+		if fields == nil {
+			fields = make([]string, 0, len(hit.hash))
+			for field := range hit.hash {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+		}
+		var pairs []string
+		for _, field := range fields {
+			if value, ok := hit.hash[field]; ok {
+				pairs = append(pairs, field, value)
+			}
+		}
+		fmt.Fprintf(conn, "*%d\r\n", len(pairs))
+		for _, p := range pairs {
+			writeBulk(conn, p)
+		}
+	}
+}
+
+// ftdropindex handles FT.DROPINDEX index [DD], deleting the hashes it
+// indexes too with DD.
+func ftdropindex(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	deleteDocs := len(args) == 3
+	if deleteDocs && !strings.EqualFold(args[2], "DD") {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	searchIndexes.Lock()
+	idx := lookupSearchIndex(conn, args[1])
+	if idx == nil {
+		searchIndexes.Unlock()
+		return
+	}
+	delete(searchIndexes.byName, idx.name)
+	var keys []string
+	if deleteDocs {
+		idx.refresh(s)
+		for key := range idx.docs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	// The deletions are logged without the lock, as the write stream
+	// marks keys for the other indexes.
+	searchIndexes.Unlock()
+	for _, key := range keys {
+		if s.Del(key) {
+			LogEffects(a, "DEL", key)
+		}
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+}
+
+// ftinfo handles FT.INFO index.
+func ftinfo(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	idx := lookupSearchIndex(conn, args[1])
+	if idx == nil {
+		return
+	}
+	idx.refresh(s)
+	fmt.Fprintf(conn, "*8\r\n")
+	writeBulk(conn, "index_name")
+	writeBulk(conn, idx.name)
+	writeBulk(conn, "index_definition")
+	fmt.Fprintf(conn, "*4\r\n")
+	writeBulk(conn, "key_type")
+	writeBulk(conn, "HASH")
+	writeBulk(conn, "prefixes")
+	fmt.Fprintf(conn, "*%d\r\n", len(idx.prefixes))
+	for _, p := range idx.prefixes {
+		writeBulk(conn, p)
+	}
+	writeBulk(conn, "attributes")
+	fmt.Fprintf(conn, "*%d\r\n", len(idx.fields))
+	for _, f := range idx.fields {
+		attrs := []string{"identifier", f.name, "attribute", f.name, "type", f.typ}
+		if f.typ == "TAG" {
+			attrs = append(attrs, "SEPARATOR", string(f.separator))
+			if f.caseSensitive {
+				attrs = append(attrs, "CASESENSITIVE")
+			}
+		}
+		fmt.Fprintf(conn, "*%d\r\n", len(attrs))
+		for _, attr := range attrs {
+			writeBulk(conn, attr)
+		}
+	}
+	writeBulk(conn, "num_docs")
+	fmt.Fprintf(conn, ":%d\r\n", len(idx.docs))
+}
+
+// ftlist handles FT._LIST, replying with the names of the indexes.
+func ftlist(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	searchIndexes.Lock()
+	names := make([]string, 0, len(searchIndexes.byName))
+	for name := range searchIndexes.byName {
+		names = append(names, name)
+	}
+	searchIndexes.Unlock()
+	sort.Strings(names)
+	fmt.Fprintf(conn, "*%d\r\n", len(names))
+	for _, name := range names {
+		writeBulk(conn, name)
+	}
+}
+
+// fttagvals handles FT.TAGVALS index field, replying with the distinct
+// tags of a TAG field.
+func fttagvals(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	idx := lookupSearchIndex(conn, args[1])
+	if idx == nil {
+		return
+	}
+	f := idx.field(args[2])
+	if f == nil || f.typ != "TAG" {
+		fmt.Fprintf(conn, "-ERR No such tag field '%s'\r\n", args[2])
+		return
+	}
+	idx.refresh(s)
+	tags := make([]string, 0, len(idx.tags[f.name]))
+	for tag := range idx.tags[f.name] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(conn, "*%d\r\n", len(tags))
+	for _, tag := range tags {
+		writeBulk(conn, tag)
+	}
+}
@@ -0,0 +1,34 @@
+package command
+
+import "strings"
+
+// numSlots is the number of Redis Cluster hash slots.
+const numSlots = 16384
+
+// keyHashSlot returns the Redis Cluster hash slot of key. When the key
+// contains a non-empty {hashtag}, only the tag is hashed, so related keys
+// can be forced into the same slot.
+func keyHashSlot(key string) int {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			key = key[open+1 : open+1+end]
+		}
+	}
+	return int(crc16(key)) % numSlots
+}
+
+// crc16 computes CRC-16/XMODEM, the checksum Redis Cluster uses for slots.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
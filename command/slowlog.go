@@ -0,0 +1,135 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Limits on the arguments recorded in a slow log entry, as in Redis.
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is a command that took longer than the slow log threshold.
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+	traceID  string
+}
+
+// slowlog records the commands that ran longer than slowerThan, newest
+// first, keeping up to maxLen of them. A negative threshold disables it.
+var slowlog = struct {
+	sync.Mutex
+	entries    []slowlogEntry
+	nextID     int64
+	slowerThan time.Duration
+	maxLen     int
+}{slowerThan: 10 * time.Millisecond, maxLen: 128}
+
+// recordSlow adds a command to the slow log if it ran long enough. Its
+// arguments are redacted and shortened before they are kept.
+func recordSlow(c *Client, args []string, start time.Time, d time.Duration) {
+	slowlog.Lock()
+	defer slowlog.Unlock()
+	if slowlog.slowerThan < 0 || d < slowlog.slowerThan || slowlog.maxLen == 0 {
+		return
+	}
+	entry := slowlogEntry{id: slowlog.nextID, time: start, duration: d, args: shortenArgs(redactArgs(args))}
+	if c != nil {
+		entry.addr = c.RemoteAddr().String()
+		entry.name = c.LibName
+		entry.traceID = c.TraceID
+	}
+	slowlog.nextID++
+	slowlog.entries = append([]slowlogEntry{entry}, slowlog.entries...)
+	if len(slowlog.entries) > slowlog.maxLen {
+		slowlog.entries = slowlog.entries[:slowlog.maxLen]
+	}
+}
+
+// shortenArgs abbreviates the arguments of a command for the slow log and
+// other reports, as Redis does: at most slowlogMaxArgs of them, the last
+// standing for the rest, and each at most slowlogMaxArgLen bytes.
+func shortenArgs(args []string) []string {
+	kept := make([]string, 0, min(len(args), slowlogMaxArgs))
+	for i, arg := range args {
+		if i == slowlogMaxArgs-1 && len(args) > slowlogMaxArgs {
+			kept = append(kept, fmt.Sprintf("... (%d more arguments)", len(args)-i))
+			break
+		}
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		kept = append(kept, arg)
+	}
+	return kept
+}
+
+// SetupSlowlog changes the threshold and length of the slow log, dropping
+// the entries beyond the new length. A negative threshold disables it.
+func SetupSlowlog(slowerThan time.Duration, maxLen int) {
+	slowlog.Lock()
+	defer slowlog.Unlock()
+	slowlog.slowerThan, slowlog.maxLen = slowerThan, maxLen
+	if len(slowlog.entries) > maxLen {
+		slowlog.entries = slowlog.entries[:maxLen]
+	}
+}
+
+// slowlogCmd handles the SLOWLOG command:
+//
+//	SLOWLOG GET [count]    the newest count entries (10 by default, all if -1)
+//	SLOWLOG LEN            the number of entries
+//	SLOWLOG RESET          clear the slow log
+//
+// Entries are those of Redis followed by the trace ID the client set, or an
+// empty string.
+func slowlogCmd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	slowlog.Lock()
+	defer slowlog.Unlock()
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		count := 10
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < -1 {
+				fmt.Fprintf(conn, "-ERR count should be greater than or equal to -1\r\n")
+				return
+			}
+			count = n
+		}
+		if count < 0 || count > len(slowlog.entries) {
+			count = len(slowlog.entries)
+		}
+		fmt.Fprintf(conn, "*%d\r\n", count)
+		for _, e := range slowlog.entries[:count] {
+			fmt.Fprintf(conn, "*7\r\n:%d\r\n:%d\r\n:%d\r\n*%d\r\n", e.id, e.time.Unix(), e.duration.Microseconds(), len(e.args))
+			for _, arg := range e.args {
+				writeBulk(conn, arg)
+			}
+			writeBulk(conn, e.addr)
+			writeBulk(conn, e.name)
+			writeBulk(conn, e.traceID)
+		}
+	case "LEN":
+		fmt.Fprintf(conn, ":%d\r\n", len(slowlog.entries))
+	case "RESET":
+		slowlog.entries = nil
+		fmt.Fprintf(conn, "+OK\r\n")
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,280 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Stats is a machine-readable snapshot of the statistics INFO reports, for
+// dashboards and automation that would rather not parse the INFO format.
+type Stats struct {
+	Server struct {
+		GoVersion     string `json:"go_version"`
+		ProcessID     int    `json:"process_id"`
+		UptimeSeconds int64  `json:"uptime_in_seconds"`
+	} `json:"server"`
+	Clients struct {
+		Connected int `json:"connected_clients"`
+		// Libraries counts connections by "name ver" of the client library.
+		Libraries map[string]int `json:"client_libraries"`
+	} `json:"clients"`
+	Keyspace struct {
+		Keys          int   `json:"keys"`
+		ShardKeysMin  int   `json:"shard_keys_min"`
+		ShardKeysMax  int   `json:"shard_keys_max"`
+		LockContended int64 `json:"shard_lock_contended"`
+		LockWaitUsec  int64 `json:"shard_lock_wait_usec"`
+		Hits          int64 `json:"keyspace_hits"`
+		Misses        int64 `json:"keyspace_misses"`
+		Expired       int64 `json:"expired_keys"`
+		Evicted       int64 `json:"evicted_keys"`
+	} `json:"keyspace"`
+	ResultCache struct {
+		Entries int   `json:"entries"`
+		Hits    int64 `json:"hits"`
+		Misses  int64 `json:"misses"`
+	} `json:"result_cache"`
+	Persistence struct {
+		RDBChanges          int64 `json:"rdb_changes_since_last_save"`
+		RDBSaveRunning      bool  `json:"rdb_bgsave_in_progress"`
+		RDBLastSaveTime     int64 `json:"rdb_last_save_time"`
+		RDBLastSaveError    bool  `json:"rdb_last_bgsave_failed"`
+		AOFEnabled          bool  `json:"aof_enabled"`
+		AOFRewriteRunning   bool  `json:"aof_rewrite_in_progress"`
+		AOFLastRewriteError bool  `json:"aof_last_bgrewrite_failed"`
+	} `json:"persistence"`
+	Replication struct {
+		Role              string `json:"role"`
+		ConnectedReplicas int    `json:"connected_slaves"`
+		ReplID            string `json:"master_replid"`
+		Offset            int64  `json:"master_repl_offset"`
+	} `json:"replication"`
+	Watchdog struct {
+		StuckCommands       int64 `json:"stuck_commands"`
+		Goroutines          int   `json:"goroutines"`
+		LeakedClients       int   `json:"leaked_clients"`
+		LeakedConnections   int   `json:"leaked_connection_goroutines"`
+		LeakedOutboxWriters int   `json:"leaked_outbox_writers"`
+		LeakedWaiters       int   `json:"leaked_waiters"`
+	} `json:"watchdog"`
+}
+
+// CollectStats gathers the current statistics. Like INFO, it must be called
+// with the server lock held.
+func CollectStats(s *store.Store, a *aof.AOF) Stats {
+	var st Stats
+	st.Server.GoVersion = runtime.Version()
+	st.Server.ProcessID = os.Getpid()
+	st.Server.UptimeSeconds = int64(time.Since(startTime).Seconds())
+
+	connected := connectedClients()
+	st.Clients.Connected = len(connected)
+	st.Clients.Libraries = make(map[string]int)
+	for _, c := range connected {
+		if c.LibName != "" || c.LibVer != "" {
+			st.Clients.Libraries[strings.TrimSpace(c.LibName+" "+c.LibVer)]++
+		}
+	}
+
+	st.Keyspace.ShardKeysMin = -1
+	for _, sh := range s.ShardStats() {
+		st.Keyspace.Keys += sh.Keys
+		if st.Keyspace.ShardKeysMin < 0 || sh.Keys < st.Keyspace.ShardKeysMin {
+			st.Keyspace.ShardKeysMin = sh.Keys
+		}
+		st.Keyspace.ShardKeysMax = max(st.Keyspace.ShardKeysMax, sh.Keys)
+		st.Keyspace.LockContended += sh.Contended
+		st.Keyspace.LockWaitUsec += sh.LockWait.Microseconds()
+	}
+	keyspace := s.KeyspaceStats()
+	st.Keyspace.Hits = keyspace.Hits
+	st.Keyspace.Misses = keyspace.Misses
+	st.Keyspace.Expired = keyspace.Expired
+
+	resultCache.Lock()
+	st.ResultCache.Entries = len(resultCache.entries)
+	st.ResultCache.Hits = resultCache.hits
+	st.ResultCache.Misses = resultCache.misses
+	resultCache.Unlock()
+
+	snapshots := snapshotStatus(a)
+	st.Persistence.RDBChanges = snapshots.changes
+	st.Persistence.RDBSaveRunning = snapshots.running
+	st.Persistence.RDBLastSaveTime = snapshots.lastSave.Unix()
+	st.Persistence.RDBLastSaveError = snapshots.failed
+	aofStatus := a.Status()
+	st.Persistence.AOFEnabled = aofStatus.Enabled
+	st.Persistence.AOFRewriteRunning = aofStatus.Rewriting
+	st.Persistence.AOFLastRewriteError = aofStatus.LastRewriteErr != nil
+
+	replication.Lock()
+	st.Replication.Role = "master"
+	st.Replication.ConnectedReplicas = len(replication.replicas)
+	st.Replication.ReplID = replication.id
+	st.Replication.Offset = replication.offset
+	replication.Unlock()
+
+	flagged, _, _, audit := watchdogStats()
+	st.Watchdog.StuckCommands = flagged
+	st.Watchdog.Goroutines = runtime.NumGoroutine()
+	st.Watchdog.LeakedClients = audit.LeakedClients
+	st.Watchdog.LeakedConnections = audit.LeakedConnections
+	st.Watchdog.LeakedOutboxWriters = audit.LeakedOutboxWriters
+	st.Watchdog.LeakedWaiters = audit.LeakedWaiters
+	return st
+}
+
+// WriteJSON writes the statistics as a JSON object.
+func (st Stats) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(st)
+}
+
+// statMetric is one of the metrics the statistics are exported as, with an
+// optional label.
+type statMetric struct {
+	name, typ, help       string
+	value                 any
+	labelName, labelValue string
+}
+
+// metrics lists the statistics exported as metrics. Their type is "gauge"
+// or "counter", the latter only ever growing while the server runs.
+func (st Stats) metrics() []statMetric {
+	bool01 := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	return []statMetric{
+		{name: "uptime_seconds", typ: "gauge", help: "Seconds since the server started.", value: st.Server.UptimeSeconds},
+		{name: "connected_clients", typ: "gauge", help: "Number of client connections.", value: st.Clients.Connected},
+		{name: "keys", typ: "gauge", help: "Number of keys, including expired keys not yet reclaimed.", value: st.Keyspace.Keys},
+		{name: "shard_keys_min", typ: "gauge", help: "Keys in the emptiest shard.", value: st.Keyspace.ShardKeysMin},
+		{name: "shard_keys_max", typ: "gauge", help: "Keys in the fullest shard.", value: st.Keyspace.ShardKeysMax},
+		{name: "shard_lock_contended", typ: "counter", help: "Shard lock acquisitions that had to wait.", value: st.Keyspace.LockContended},
+		{name: "shard_lock_wait_seconds", typ: "counter", help: "Time spent waiting for shard locks.", value: float64(st.Keyspace.LockWaitUsec) / 1e6},
+		{name: "keyspace_hits", typ: "counter", help: "Lookups by reads of keys that existed.", value: st.Keyspace.Hits},
+		{name: "keyspace_misses", typ: "counter", help: "Lookups by reads of keys that didn't exist.", value: st.Keyspace.Misses},
+		{name: "expired_keys", typ: "counter", help: "Keys deleted because they expired.", value: st.Keyspace.Expired},
+		{name: "evicted_keys", typ: "counter", help: "Keys evicted to free memory, which never happens.", value: st.Keyspace.Evicted},
+		{name: "result_cache_entries", typ: "gauge", help: "Cached read replies.", value: st.ResultCache.Entries},
+		{name: "result_cache_hits", typ: "counter", help: "Read replies served from the result cache.", value: st.ResultCache.Hits},
+		{name: "result_cache_misses", typ: "counter", help: "Cacheable reads that missed the result cache.", value: st.ResultCache.Misses},
+		{name: "rdb_changes_since_last_save", typ: "gauge", help: "Write commands run since the last snapshot.", value: st.Persistence.RDBChanges},
+		{name: "rdb_bgsave_in_progress", typ: "gauge", help: "Whether a background save is running.", value: bool01(st.Persistence.RDBSaveRunning)},
+		{name: "rdb_last_save_timestamp_seconds", typ: "gauge", help: "Unix time of the last successful snapshot, or of the start if none was taken.", value: st.Persistence.RDBLastSaveTime},
+		{name: "rdb_last_bgsave_failed", typ: "gauge", help: "Whether the last background save failed.", value: bool01(st.Persistence.RDBLastSaveError)},
+		{name: "aof_enabled", typ: "gauge", help: "Whether the append-only file is enabled.", value: bool01(st.Persistence.AOFEnabled)},
+		{name: "aof_rewrite_in_progress", typ: "gauge", help: "Whether an AOF rewrite is running.", value: bool01(st.Persistence.AOFRewriteRunning)},
+		{name: "connected_replicas", typ: "gauge", help: "Number of connected replicas.", value: st.Replication.ConnectedReplicas},
+		{name: "repl_offset", typ: "gauge", help: "Replication offset of the master.", value: st.Replication.Offset,
+			labelName: "replid", labelValue: st.Replication.ReplID},
+		{name: "goroutines", typ: "gauge", help: "Number of live goroutines.", value: st.Watchdog.Goroutines},
+		{name: "watchdog_stuck_commands", typ: "counter", help: "Commands that ran past the watchdog threshold.", value: st.Watchdog.StuckCommands},
+		{name: "leaked_clients", typ: "gauge", help: "Registered clients without a connection goroutine, as of the last audit.", value: st.Watchdog.LeakedClients},
+		{name: "leaked_connection_goroutines", typ: "gauge", help: "Connection goroutines without a registered client, as of the last audit.", value: st.Watchdog.LeakedConnections},
+		{name: "leaked_outbox_writers", typ: "gauge", help: "Pub/Sub outbox writers beyond the open outboxes, as of the last audit.", value: st.Watchdog.LeakedOutboxWriters},
+		{name: "leaked_waiters", typ: "gauge", help: "Blocking waiters without a waiting client, as of the last audit.", value: st.Watchdog.LeakedWaiters},
+	}
+}
+
+// WriteOpenMetrics writes the statistics in the OpenMetrics text format, as
+// scraped by Prometheus.
+func (st Stats) WriteOpenMetrics(w io.Writer) error {
+	var b strings.Builder
+	for _, m := range st.metrics() {
+		fmt.Fprintf(&b, "# TYPE myredis_%s %s\n# HELP myredis_%s %s\n", m.name, m.typ, m.name, m.help)
+		sample := "myredis_" + m.name
+		if m.typ == "counter" {
+			sample += "_total"
+		}
+		if m.labelName != "" {
+			sample += fmt.Sprintf("{%s=%q}", m.labelName, m.labelValue)
+		}
+		fmt.Fprintf(&b, "%s %v\n", sample, m.value)
+	}
+	b.WriteString("# EOF\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// StatsDEncoder formats statistics as StatsD metrics, one line each, for
+// pushing to a StatsD or Datadog agent. Gauges are sent as they are, and
+// counters as the increase since the previous Encode, as StatsD expects.
+// Tags, in DogStatsD's "name:value" form, are added to every metric; the
+// labels of OpenMetrics are left out, as agents would turn their values
+// into tags of their own, and the replication ID changes on every restart.
+type StatsDEncoder struct {
+	// Prefix is prepended to the metric names, "myredis." if empty.
+	Prefix string
+	Tags   []string
+	// last holds the counter values sent up to the previous Encode.
+	last map[string]float64
+}
+
+// Encode returns the lines for the statistics.
+func (e *StatsDEncoder) Encode(st Stats) []string {
+	prefix := e.Prefix
+	if prefix == "" {
+		prefix = "myredis."
+	}
+	var tags string
+	if len(e.Tags) > 0 {
+		tags = "|#" + strings.Join(e.Tags, ",")
+	}
+	if e.last == nil {
+		e.last = make(map[string]float64)
+	}
+	var lines []string
+	for _, m := range st.metrics() {
+		value, _ := strconv.ParseFloat(fmt.Sprint(m.value), 64)
+		typ := "g"
+		if m.typ == "counter" {
+			// A counter that went down was reset, so all of it is new.
+			delta := value
+			if last := e.last[m.name]; value >= last {
+				delta = value - last
+			}
+			e.last[m.name] = value
+			if delta == 0 {
+				continue
+			}
+			value, typ = delta, "c"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s:%s|%s%s", prefix, m.name, strconv.FormatFloat(value, 'f', -1, 64), typ, tags))
+	}
+	return lines
+}
+
+// stats handles the STATS command: STATS [JSON|OPENMETRICS]. The statistics
+// are returned as a single bulk string, JSON by default.
+func stats(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	format := "JSON"
+	if len(args) == 2 {
+		format = strings.ToUpper(args[1])
+	}
+	var b strings.Builder
+	st := CollectStats(s, a)
+	switch format {
+	case "JSON":
+		st.WriteJSON(&b)
+	case "OPENMETRICS":
+		st.WriteOpenMetrics(&b)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown STATS format '%s', expected JSON or OPENMETRICS\r\n", args[1])
+		return
+	}
+	reply := b.String()
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(reply), reply)
+}
@@ -0,0 +1,244 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// writeStreamEntries writes stream entries as an array of [id, [field, value, ...]].
+func writeStreamEntries(conn net.Conn, entries []store.StreamEntry) {
+	fmt.Fprintf(conn, "*%d\r\n", len(entries))
+	for _, entry := range entries {
+		fmt.Fprintf(conn, "*2\r\n")
+		writeBulk(conn, entry.ID.String())
+		fmt.Fprintf(conn, "*%d\r\n", len(entry.Fields))
+		for _, field := range entry.Fields {
+			writeBulk(conn, field)
+		}
+	}
+}
+
+// xadd handles the XADD command: XADD key <* | ms-* | id> field value [field value ...].
+// The entry is persisted with the ID it was given.
+func xadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args)%2 != 1 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'xadd' command\r\n")
+		return
+	}
+	id, err := s.XAdd(args[1], args[2], args[3:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeBulk(conn, id.String())
+	LogEffects(a, "XADD", append([]string{args[1], id.String()}, args[3:]...)...)
+}
+
+// xlen handles the XLEN command.
+func xlen(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	n, err := s.XLen(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", n)
+}
+
+// xsetid handles XSETID key last-id [ENTRIESADDED n] [MAXDELETEDID id], which
+// restores the bookkeeping of a stream copied from a backup.
+func xsetid(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args)%2 != 1 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'xsetid' command\r\n")
+		return
+	}
+	id, err := store.ParseStreamID(args[2], 0)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	entriesAdded := int64(-1)
+	var maxDeletedID *store.StreamID
+	for i := 3; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "ENTRIESADDED":
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n < 0 {
+				fmt.Fprintf(conn, "-ERR entries_added must be positive\r\n")
+				return
+			}
+			entriesAdded = n
+		case "MAXDELETEDID":
+			deleted, err := store.ParseStreamID(args[i+1], 0)
+			if err != nil {
+				fmt.Fprintf(conn, "-%s\r\n", err)
+				return
+			}
+			maxDeletedID = &deleted
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+	if err := s.XSetID(args[1], id, entriesAdded, maxDeletedID); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "XSETID", args[1:]...)
+}
+
+// parseStreamBound parses an XRANGE bound: "-", "+" or an ID whose missing
+// sequence number is missingSeq.
+func parseStreamBound(arg string, missingSeq uint64) (store.StreamID, error) {
+	switch arg {
+	case "-":
+		return store.StreamID{}, nil
+	case "+":
+		return store.MaxStreamID, nil
+	}
+	return store.ParseStreamID(arg, missingSeq)
+}
+
+// xrange handles XRANGE key start end [COUNT n] and XREVRANGE key end start
+// [COUNT n].
+func xrange(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	name := strings.ToLower(args[0])
+	if len(args) != 4 && len(args) != 6 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for '%s' command\r\n", name)
+		return
+	}
+	rev := name == "xrevrange"
+	startArg, endArg := args[2], args[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, err := parseStreamBound(startArg, 0)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	end, err := parseStreamBound(endArg, store.MaxStreamID.Seq)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	count := -1
+	if len(args) == 6 {
+		n, err := strconv.Atoi(args[5])
+		if !strings.EqualFold(args[4], "COUNT") || err != nil {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		count = max(n, 0)
+	}
+	entries, err := s.XRange(args[1], start, end, count, rev)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeStreamEntries(conn, entries)
+}
+
+// xread handles XREAD [COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...].
+// An ID of "$" stands for the stream's last ID when the command is issued, so
+// a blocked reader only gets entries added after it started waiting.
+func xread(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	count := -1
+	var timeout time.Duration
+	blocking := false
+	i := 1
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt == "STREAMS" {
+			break
+		}
+		if (opt != "COUNT" && opt != "BLOCK") || i+1 >= len(args) {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+			return
+		}
+		if opt == "COUNT" {
+			// Like Redis, a count of zero or less means no limit.
+			if n > 0 {
+				count = int(n)
+			}
+		} else {
+			if n < 0 {
+				fmt.Fprintf(conn, "-ERR timeout is negative\r\n")
+				return
+			}
+			blocking, timeout = true, time.Duration(n)*time.Millisecond
+		}
+		i++
+	}
+	streams := args[min(i+1, len(args)):]
+	if i == len(args) || len(streams) == 0 || len(streams)%2 != 0 {
+		fmt.Fprintf(conn, "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n")
+		return
+	}
+	keys, idArgs := streams[:len(streams)/2], streams[len(streams)/2:]
+	after := make([]store.StreamID, len(keys))
+	for j, idArg := range idArgs {
+		var err error
+		if idArg == "$" {
+			after[j], err = s.XLastID(keys[j])
+		} else {
+			after[j], err = store.ParseStreamID(idArg, 0)
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "-%s\r\n", err)
+			return
+		}
+	}
+
+	c := clientOf(conn)
+	try := func() bool {
+		var replies [][]store.StreamEntry
+		var replyKeys []string
+		for j, key := range keys {
+			entries, err := s.XRead(key, after[j], count)
+			if err != nil {
+				fmt.Fprintf(conn, "-%s\r\n", err)
+				return true
+			}
+			if len(entries) > 0 {
+				replies = append(replies, entries)
+				replyKeys = append(replyKeys, key)
+			}
+		}
+		if len(replies) == 0 {
+			return false
+		}
+		fmt.Fprintf(conn, "*%d\r\n", len(replies))
+		for j, entries := range replies {
+			reply := replyKeys[j]
+			if c != nil {
+				reply = strings.TrimPrefix(reply, c.namespace())
+			}
+			fmt.Fprintf(conn, "*2\r\n")
+			writeBulk(conn, reply)
+			writeStreamEntries(conn, entries)
+		}
+		return true
+	}
+	if try() {
+		return
+	}
+	if !blocking {
+		fmt.Fprintf(conn, "*-1\r\n")
+		return
+	}
+	block(c, keys, timeout, try, func() {
+		fmt.Fprintf(conn, "*-1\r\n")
+	})
+}
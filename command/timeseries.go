@@ -0,0 +1,464 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The TS.* commands follow RedisTimeSeries', with TS.SCANDUMP and
+// TS.LOADCHUNK added like the CMS ones. Series are created with TS.CREATE,
+// or by the first TS.ADD, and written to the AOF with all their options,
+// so replaying them doesn't depend on defaults.
+
+// parseTSTimestamp parses a timestamp in milliseconds, "-" and "+" standing
+// for the earliest and latest ones, and "*" for the current time if now is
+// set.
+func parseTSTimestamp(arg string, now bool) (int64, bool) {
+	switch {
+	case arg == "-":
+		return 0, true
+	case arg == "+":
+		return math.MaxInt64, true
+	case arg == "*" && now:
+		return time.Now().UnixMilli(), true
+	}
+	ts, err := strconv.ParseInt(arg, 10, 64)
+	return ts, err == nil && ts >= 0
+}
+
+// parseTSValue parses the value of a sample.
+func parseTSValue(arg string) (float64, bool) {
+	v, err := strconv.ParseFloat(arg, 64)
+	return v, err == nil && !math.IsNaN(v)
+}
+
+// formatTSValue formats the value of a sample for a reply.
+func formatTSValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// parseTSOptions parses the options of TS.CREATE, and of TS.ADD if add is
+// set: RETENTION ms, DUPLICATE_POLICY policy, ON_DUPLICATE policy (TS.ADD
+// only) and LABELS name value [name value ...], which takes the rest of the
+// arguments. It returns the error reply (without the leading '-') for
+// invalid ones.
+func parseTSOptions(args []string, add bool) (opts store.TSOptions, onDuplicate string, errMsg string) {
+	policy := func(arg string) (string, bool) {
+		p := strings.ToLower(arg)
+		return p, slices.Contains(store.TSDuplicatePolicies, p)
+	}
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt == "LABELS" {
+			rest := args[i+1:]
+			if len(rest)%2 != 0 {
+				return opts, "", "ERR TSDB: wrong number of arguments for LABELS"
+			}
+			for j := 0; j < len(rest); j += 2 {
+				opts.Labels = append(opts.Labels, store.TSLabel{Name: rest[j], Value: rest[j+1]})
+			}
+			break
+		}
+		if i+1 == len(args) {
+			return opts, "", "ERR syntax error"
+		}
+		i++
+		var ok bool
+		switch {
+		case opt == "RETENTION":
+			opts.Retention, _ = strconv.ParseInt(args[i], 10, 64)
+			if _, err := strconv.ParseUint(args[i], 10, 63); err != nil {
+				return opts, "", "ERR TSDB: invalid RETENTION value"
+			}
+		case opt == "DUPLICATE_POLICY":
+			if opts.DuplicatePolicy, ok = policy(args[i]); !ok {
+				return opts, "", "ERR TSDB: Unknown DUPLICATE_POLICY"
+			}
+		case opt == "ON_DUPLICATE" && add:
+			if onDuplicate, ok = policy(args[i]); !ok {
+				return opts, "", "ERR TSDB: Unknown ON_DUPLICATE policy"
+			}
+		default:
+			return opts, "", "ERR syntax error"
+		}
+	}
+	if opts.DuplicatePolicy == "" {
+		opts.DuplicatePolicy = "block"
+	}
+	return opts, onDuplicate, ""
+}
+
+// parseTSAggregation parses the type and bucket duration that follow an
+// AGGREGATION option.
+func parseTSAggregation(typ, bucket string) (store.TSAggregation, string) {
+	agg := store.TSAggregation{Type: strings.ToLower(typ)}
+	if !slices.Contains(store.TSAggregationTypes, agg.Type) {
+		return agg, "ERR TSDB: Unknown aggregation type"
+	}
+	var err error
+	if agg.Bucket, err = strconv.ParseInt(bucket, 10, 64); err != nil || agg.Bucket <= 0 {
+		return agg, "ERR TSDB: bucketDuration must be greater than zero"
+	}
+	return agg, ""
+}
+
+// logTSCreate writes the creation of a series to the AOF with all its
+// options.
+func logTSCreate(a *aof.AOF, key string, opts store.TSOptions) {
+	args := []string{key, "RETENTION", strconv.FormatInt(opts.Retention, 10), "DUPLICATE_POLICY", opts.DuplicatePolicy}
+	if len(opts.Labels) > 0 {
+		args = append(args, "LABELS")
+		for _, l := range opts.Labels {
+			args = append(args, l.Name, l.Value)
+		}
+	}
+	LogEffects(a, "TS.CREATE", args...)
+}
+
+// tscreate handles TS.CREATE key [RETENTION ms] [DUPLICATE_POLICY policy]
+// [LABELS name value ...].
+func tscreate(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	opts, _, errMsg := parseTSOptions(args[2:], false)
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-%s\r\n", errMsg)
+		return
+	}
+	if err := s.TSCreate(args[1], opts); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	logTSCreate(a, args[1], opts)
+}
+
+// tsadd handles TS.ADD key timestamp value [options], with the options of
+// TS.CREATE used if the series is created, plus ON_DUPLICATE policy,
+// replying with the timestamp of the sample.
+func tsadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	opts, onDuplicate, errMsg := parseTSOptions(args[4:], true)
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-%s\r\n", errMsg)
+		return
+	}
+	if ts, ok := addTSSample(conn, s, a, args[1], args[2], args[3], onDuplicate, &opts); ok {
+		fmt.Fprintf(conn, ":%d\r\n", ts)
+	}
+}
+
+// addTSSample adds a sample for TS.ADD and TS.MADD, writing the error reply
+// if it can't be added, and returns its timestamp.
+func addTSSample(conn net.Conn, s *store.Store, a *aof.AOF, key, timestamp, value, onDuplicate string, create *store.TSOptions) (int64, bool) {
+	ts, ok := parseTSTimestamp(timestamp, true)
+	if !ok || timestamp == "-" || timestamp == "+" {
+		fmt.Fprintf(conn, "-ERR TSDB: invalid timestamp\r\n")
+		return 0, false
+	}
+	v, ok := parseTSValue(value)
+	if !ok {
+		fmt.Fprintf(conn, "-ERR TSDB: invalid value\r\n")
+		return 0, false
+	}
+	created, err := s.TSAdd(key, ts, v, onDuplicate, create)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return 0, false
+	}
+	if created {
+		logTSCreate(a, key, *create)
+	}
+	logged := []string{key, strconv.FormatInt(ts, 10), value}
+	if onDuplicate != "" {
+		logged = append(logged, "ON_DUPLICATE", onDuplicate)
+	}
+	LogEffects(a, "TS.ADD", logged...)
+	return ts, true
+}
+
+// tsmadd handles TS.MADD key timestamp value [key timestamp value ...],
+// replying with the timestamp of each sample, or the error adding it.
+func tsmadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if (len(args)-1)%3 != 0 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'ts.madd' command\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", (len(args)-1)/3)
+	for i := 1; i < len(args); i += 3 {
+		// Series have to exist, as TS.MADD has no options to create them with.
+		if ts, ok := addTSSample(conn, s, a, args[i], args[i+1], args[i+2], "", nil); ok {
+			fmt.Fprintf(conn, ":%d\r\n", ts)
+		}
+	}
+}
+
+// tsdel handles TS.DEL key from to, replying with the number of samples
+// deleted.
+func tsdel(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	from, ok1 := parseTSTimestamp(args[2], false)
+	to, ok2 := parseTSTimestamp(args[3], false)
+	if !ok1 || !ok2 {
+		fmt.Fprintf(conn, "-ERR TSDB: invalid timestamp\r\n")
+		return
+	}
+	n, err := s.TSDel(args[1], from, to)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", n)
+	if n > 0 {
+		LogEffects(a, "TS.DEL", args[1], strconv.FormatInt(from, 10), strconv.FormatInt(to, 10))
+	}
+}
+
+// tsget handles TS.GET key, replying with the last sample, or an empty
+// array if there is none.
+func tsget(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	sample, ok, err := s.TSGet(args[1])
+	switch {
+	case err != nil:
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	case !ok:
+		fmt.Fprintf(conn, "*0\r\n")
+	default:
+		fmt.Fprintf(conn, "*2\r\n:%d\r\n+%s\r\n", sample.Timestamp, formatTSValue(sample.Value))
+	}
+}
+
+// tsRangeQuery holds the arguments of the range commands.
+type tsRangeQuery struct {
+	from, to   int64
+	reverse    bool
+	count      int
+	agg        *store.TSAggregation
+	withLabels bool
+	filters    []store.TSFilter
+}
+
+// parseTSRange parses the arguments of the range commands from the
+// timestamps on: from to [COUNT n] [AGGREGATION type bucket], and for
+// multi, [WITHLABELS] and FILTER filter [filter ...], which takes the rest
+// of the arguments.
+func parseTSRange(args []string, multi bool) (q tsRangeQuery, errMsg string) {
+	var ok1, ok2 bool
+	q.from, ok1 = parseTSTimestamp(args[0], false)
+	q.to, ok2 = parseTSTimestamp(args[1], false)
+	if !ok1 || !ok2 {
+		return q, "ERR TSDB: invalid timestamp"
+	}
+	q.count = -1
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return q, "ERR TSDB: Couldn't parse COUNT"
+			}
+			q.count = n
+			i++
+		case opt == "AGGREGATION" && i+2 < len(args):
+			agg, errMsg := parseTSAggregation(args[i+1], args[i+2])
+			if errMsg != "" {
+				return q, errMsg
+			}
+			q.agg = &agg
+			i += 2
+		case opt == "WITHLABELS" && multi:
+			q.withLabels = true
+		case opt == "FILTER" && multi:
+			for _, arg := range args[i+1:] {
+				f, ok := parseTSFilter(arg)
+				if !ok {
+					return q, "ERR TSDB: failed parsing labels"
+				}
+				q.filters = append(q.filters, f)
+			}
+			i = len(args)
+		default:
+			return q, "ERR syntax error"
+		}
+	}
+	if multi && !slices.ContainsFunc(q.filters, func(f store.TSFilter) bool {
+		return !f.Negate && !slices.Contains(f.Values, "")
+	}) {
+		return q, "ERR TSDB: please provide at least one matcher"
+	}
+	return q, ""
+}
+
+// parseTSFilter parses a filter: label=value, label!=value, label=(v1,v2)
+// or label!=(v1,v2), an empty value standing for a missing label.
+func parseTSFilter(arg string) (store.TSFilter, bool) {
+	i := strings.IndexByte(arg, '=')
+	if i <= 0 {
+		return store.TSFilter{}, false
+	}
+	f := store.TSFilter{Label: arg[:i]}
+	if strings.HasSuffix(f.Label, "!") {
+		f.Label, f.Negate = f.Label[:len(f.Label)-1], true
+	}
+	value := arg[i+1:]
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		f.Values = strings.Split(value[1:len(value)-1], ",")
+	} else {
+		f.Values = []string{value}
+	}
+	return f, f.Label != ""
+}
+
+// limit orders samples as the query asks and applies its COUNT.
+func (q tsRangeQuery) limit(samples []store.TSSample) []store.TSSample {
+	if q.reverse {
+		slices.Reverse(samples)
+	}
+	if q.count >= 0 && q.count < len(samples) {
+		samples = samples[:q.count]
+	}
+	return samples
+}
+
+// writeTSSamples writes samples as an array of [timestamp, value] pairs.
+func writeTSSamples(conn net.Conn, samples []store.TSSample) {
+	fmt.Fprintf(conn, "*%d\r\n", len(samples))
+	for _, sample := range samples {
+		fmt.Fprintf(conn, "*2\r\n:%d\r\n+%s\r\n", sample.Timestamp, formatTSValue(sample.Value))
+	}
+}
+
+// tsrange handles TS.RANGE and TS.REVRANGE key from to [COUNT n]
+// [AGGREGATION type bucket].
+func tsrange(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	q, errMsg := parseTSRange(args[2:], false)
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-%s\r\n", errMsg)
+		return
+	}
+	q.reverse = cmd == "TS.REVRANGE"
+	samples, err := s.TSRange(args[1], q.from, q.to, q.agg)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeTSSamples(conn, q.limit(samples))
+}
+
+// tsmrange handles TS.MRANGE and TS.MREVRANGE from to [WITHLABELS]
+// [COUNT n] [AGGREGATION type bucket] FILTER filter [filter ...], replying
+// for each series matching every filter with its key, its labels if asked
+// for, and its samples.
+func tsmrange(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	q, errMsg := parseTSRange(args[1:], true)
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-%s\r\n", errMsg)
+		return
+	}
+	q.reverse = cmd == "TS.MREVRANGE"
+	series := s.TSMRange(q.from, q.to, q.agg, q.filters)
+	fmt.Fprintf(conn, "*%d\r\n", len(series))
+	for _, ts := range series {
+		fmt.Fprintf(conn, "*3\r\n")
+		writeBulk(conn, ts.Key)
+		if q.withLabels {
+			writeTSLabels(conn, ts.Labels)
+		} else {
+			fmt.Fprintf(conn, "*0\r\n")
+		}
+		writeTSSamples(conn, q.limit(ts.Samples))
+	}
+}
+
+// writeTSLabels writes labels as an array of [name, value] pairs.
+func writeTSLabels(conn net.Conn, labels []store.TSLabel) {
+	fmt.Fprintf(conn, "*%d\r\n", len(labels))
+	for _, l := range labels {
+		fmt.Fprintf(conn, "*2\r\n")
+		writeBulk(conn, l.Name)
+		writeBulk(conn, l.Value)
+	}
+}
+
+// tscreaterule handles TS.CREATERULE source destination AGGREGATION type
+// bucket, downsampling the samples added to source from then on into
+// destination.
+func tscreaterule(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if !strings.EqualFold(args[3], "AGGREGATION") {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	agg, errMsg := parseTSAggregation(args[4], args[5])
+	if errMsg != "" {
+		fmt.Fprintf(conn, "-%s\r\n", errMsg)
+		return
+	}
+	if err := s.TSCreateRule(args[1], args[2], agg); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "TS.CREATERULE", args[1], args[2], "AGGREGATION", agg.Type, strconv.FormatInt(agg.Bucket, 10))
+}
+
+// tsdeleterule handles TS.DELETERULE source destination.
+func tsdeleterule(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if err := s.TSDeleteRule(args[1], args[2]); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "TS.DELETERULE", args[1:]...)
+}
+
+// tsinfo handles TS.INFO key.
+func tsinfo(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	info, err := s.TSInfo(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*16\r\n")
+	writeBulk(conn, "totalSamples")
+	fmt.Fprintf(conn, ":%d\r\n", info.TotalSamples)
+	writeBulk(conn, "firstTimestamp")
+	fmt.Fprintf(conn, ":%d\r\n", info.FirstTimestamp)
+	writeBulk(conn, "lastTimestamp")
+	fmt.Fprintf(conn, ":%d\r\n", info.LastTimestamp)
+	writeBulk(conn, "retentionTime")
+	fmt.Fprintf(conn, ":%d\r\n", info.Retention)
+	writeBulk(conn, "duplicatePolicy")
+	writeBulk(conn, info.DuplicatePolicy)
+	writeBulk(conn, "labels")
+	writeTSLabels(conn, info.Labels)
+	writeBulk(conn, "sourceKey")
+	if info.SourceKey == "" {
+		fmt.Fprintf(conn, "$-1\r\n")
+	} else {
+		writeBulk(conn, info.SourceKey)
+	}
+	writeBulk(conn, "rules")
+	fmt.Fprintf(conn, "*%d\r\n", len(info.Rules))
+	for _, r := range info.Rules {
+		fmt.Fprintf(conn, "*3\r\n")
+		writeBulk(conn, r.Dest)
+		fmt.Fprintf(conn, ":%d\r\n", r.Aggregation.Bucket)
+		writeBulk(conn, strings.ToUpper(r.Aggregation.Type))
+	}
+}
+
+// tsscandump handles TS.SCANDUMP key iterator.
+func tsscandump(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	scanDump(args, conn, s.TSDump)
+}
+
+// tsloadchunk handles TS.LOADCHUNK key iterator data.
+func tsloadchunk(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	loadChunk(args, conn, a, s.TSLoad)
+}
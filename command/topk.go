@@ -0,0 +1,177 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The TOPK.* commands follow RedisBloom's, with TOPK.SCANDUMP and
+// TOPK.LOADCHUNK added like the CMS ones.
+
+// maxTopKIncrement caps the increments of TOPK.INCRBY, as each occurrence
+// may decay a counter in turn.
+const maxTopKIncrement = 100000
+
+// maxTopKCounters caps the counters of a sketch, width times depth, and k.
+const maxTopKCounters = 1 << 24
+
+// topkreserve handles TOPK.RESERVE key topk [width depth decay].
+func topkreserve(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args) != 3 && len(args) != 6 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'topk.reserve' command\r\n")
+		return
+	}
+	k, err := strconv.Atoi(args[2])
+	if err != nil || k < 1 || k > maxTopKCounters {
+		fmt.Fprintf(conn, "-TopK: invalid k\r\n")
+		return
+	}
+	width, depth, decay := store.DefaultTopKWidth, store.DefaultTopKDepth, store.DefaultTopKDecay
+	if len(args) == 6 {
+		if width, err = strconv.Atoi(args[3]); err != nil || width < 1 || width > maxTopKCounters {
+			fmt.Fprintf(conn, "-TopK: invalid width\r\n")
+			return
+		}
+		if depth, err = strconv.Atoi(args[4]); err != nil || depth < 1 || depth > maxTopKCounters/width {
+			fmt.Fprintf(conn, "-TopK: invalid depth\r\n")
+			return
+		}
+		if decay, err = strconv.ParseFloat(args[5], 64); err != nil || decay <= 0 || decay > 1 {
+			fmt.Fprintf(conn, "-TopK: invalid decay value. must be '<= 1' & '> 0'\r\n")
+			return
+		}
+	}
+	if err := s.TopKReserve(args[1], k, width, depth, decay); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "+OK\r\n")
+	LogEffects(a, "TOPK.RESERVE", args[1], args[2], strconv.Itoa(width), strconv.Itoa(depth),
+		strconv.FormatFloat(decay, 'g', -1, 64))
+}
+
+// topkadd handles TOPK.ADD key item [item ...] and TOPK.INCRBY key item
+// increment [item increment ...], replying for each item with the item its
+// addition pushed out of the list, or nil.
+func topkadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	if cmd == "TOPK.INCRBY" && len(args)%2 != 0 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(cmd))
+		return
+	}
+	var items []string
+	var increments []uint64
+	if cmd == "TOPK.ADD" {
+		items = args[2:]
+		increments = make([]uint64, len(items))
+		for i := range increments {
+			increments[i] = 1
+		}
+	} else {
+		for i := 2; i < len(args); i += 2 {
+			n, err := strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil || n < 1 || n > maxTopKIncrement {
+				fmt.Fprintf(conn, "-TopK: increment must be an integer greater or equal to 1 and less than or equal to %d\r\n", maxTopKIncrement)
+				return
+			}
+			items = append(items, args[i])
+			increments = append(increments, n)
+		}
+	}
+	dropped, expelled, err := s.TopKAdd(args[1], items, increments)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(dropped))
+	for i, item := range dropped {
+		if !expelled[i] {
+			fmt.Fprintf(conn, "$-1\r\n")
+			continue
+		}
+		writeBulk(conn, item)
+	}
+	LogEffects(a, cmd, args[1:]...)
+}
+
+// topkquery handles TOPK.QUERY key item [item ...], replying 1 for the items
+// in the list and 0 for the others.
+func topkquery(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	found, err := s.TopKQuery(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(found))
+	for _, ok := range found {
+		if ok {
+			fmt.Fprintf(conn, ":1\r\n")
+		} else {
+			fmt.Fprintf(conn, ":0\r\n")
+		}
+	}
+}
+
+// topkcount handles TOPK.COUNT key item [item ...], replying with the
+// estimated count of each item.
+func topkcount(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	counts, err := s.TopKCount(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeCounts(conn, counts)
+}
+
+// topklist handles TOPK.LIST key [WITHCOUNT], replying with the items of the
+// list, most frequent first, each followed by its count with WITHCOUNT.
+func topklist(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	withCount := len(args) == 3
+	if withCount && !strings.EqualFold(args[2], "WITHCOUNT") {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	items, err := s.TopKList(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if withCount {
+		fmt.Fprintf(conn, "*%d\r\n", 2*len(items))
+	} else {
+		fmt.Fprintf(conn, "*%d\r\n", len(items))
+	}
+	for _, item := range items {
+		writeBulk(conn, item.Item)
+		if withCount {
+			fmt.Fprintf(conn, ":%d\r\n", item.Count)
+		}
+	}
+}
+
+// topkinfo handles TOPK.INFO key.
+func topkinfo(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	info, err := s.TopKInfo(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*8\r\n$1\r\nk\r\n:%d\r\n$5\r\nwidth\r\n:%d\r\n$5\r\ndepth\r\n:%d\r\n$5\r\ndecay\r\n",
+		info.K, info.Width, info.Depth)
+	writeBulk(conn, strconv.FormatFloat(info.Decay, 'g', -1, 64))
+}
+
+// topkscandump handles TOPK.SCANDUMP key iterator.
+func topkscandump(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	scanDump(args, conn, s.TopKDump)
+}
+
+// topkloadchunk handles TOPK.LOADCHUNK key iterator data.
+func topkloadchunk(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	loadChunk(args, conn, a, s.TopKLoad)
+}
@@ -0,0 +1,278 @@
+package command
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients tag their commands with a trace ID, set with CLIENT TRACEID,
+// CLIENT SETINFO TRACE-ID or the TRACEID option of HELLO, to tie them back
+// to the application request they serve. Every command a client with a
+// trace ID runs becomes a span, which is exported in the background when a
+// SpanExporter is set up, so exporting never slows commands down.
+
+// spanQueueLimit caps the spans waiting to be exported. Spans are dropped
+// rather than queued beyond it while the exporter can't keep up.
+const spanQueueLimit = 4096
+
+// spanBatchSize caps the spans per Export.
+const spanBatchSize = 512
+
+// Span is a command run by a client with a trace ID.
+type Span struct {
+	TraceID  string
+	Command  string
+	Client   string
+	Start    time.Time
+	Duration time.Duration
+	// Failed is set if the command replied with an error.
+	Failed bool
+}
+
+// SpanExporter receives batches of spans. Export is called from a goroutine
+// of its own and may block; the spans of a failed batch are dropped.
+type SpanExporter interface {
+	Export(spans []Span) error
+}
+
+// tracing is the running span exporter.
+var tracing struct {
+	sync.Mutex
+	exporter SpanExporter
+	queue    []Span
+	wake     chan struct{}
+	// Counters for INFO.
+	exported, dropped int64
+}
+
+// SetupTracing starts exporting the spans of traced commands to exporter.
+func SetupTracing(exporter SpanExporter) {
+	tracing.Lock()
+	defer tracing.Unlock()
+	tracing.exporter = exporter
+	tracing.wake = make(chan struct{}, 1)
+	go exportSpans(exporter, tracing.wake)
+}
+
+// recordSpan queues the span of a command c ran, if c has a trace ID and
+// spans are exported.
+func recordSpan(c *Client, cmd string, start time.Time, d time.Duration, failed bool) {
+	if c.TraceID == "" {
+		return
+	}
+	tracing.Lock()
+	defer tracing.Unlock()
+	if tracing.exporter == nil {
+		return
+	}
+	if len(tracing.queue) >= spanQueueLimit {
+		tracing.dropped++
+		return
+	}
+	tracing.queue = append(tracing.queue, Span{
+		TraceID:  c.TraceID,
+		Command:  strings.ToLower(cmd),
+		Client:   c.RemoteAddr().String(),
+		Start:    start,
+		Duration: d,
+		Failed:   failed,
+	})
+	select {
+	case tracing.wake <- struct{}{}:
+	default:
+	}
+}
+
+// exportSpans hands the queued spans to exporter in batches as they come.
+// Failures are logged once until exporting works again, as collectors come
+// and go.
+func exportSpans(exporter SpanExporter, wake chan struct{}) {
+	failing := false
+	for range wake {
+		for {
+			tracing.Lock()
+			n := min(len(tracing.queue), spanBatchSize)
+			batch := tracing.queue[:n:n]
+			tracing.queue = tracing.queue[n:]
+			tracing.Unlock()
+			if n == 0 {
+				break
+			}
+
+			err := exporter.Export(batch)
+			tracing.Lock()
+			if err != nil {
+				tracing.dropped += int64(n)
+			} else {
+				tracing.exported += int64(n)
+			}
+			tracing.Unlock()
+			switch {
+			case err != nil && !failing:
+				log.Printf("Exporting spans failed: %v", err)
+			case err == nil && failing:
+				log.Printf("Exporting spans works again")
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// infoTracing renders the span fields of the stats section.
+func infoTracing() string {
+	tracing.Lock()
+	defer tracing.Unlock()
+	if tracing.exporter == nil {
+		return ""
+	}
+	return fmt.Sprintf("spans_pending:%d\r\nspans_exported:%d\r\nspans_dropped:%d\r\n",
+		len(tracing.queue), tracing.exported, tracing.dropped)
+}
+
+// OTLPExporter exports spans to an OpenTelemetry collector with OTLP over
+// HTTP, encoded as JSON, by POSTing them to URL, typically the collector's
+// http://host:4318/v1/traces.
+//
+// A trace ID given as a W3C traceparent header value makes the span a child
+// of the span it names, and a 32 digit hexadecimal one is used as it is.
+// Other trace IDs are hashed into an OpenTelemetry trace ID. The trace ID
+// the client gave is kept in the redis.trace_id attribute either way.
+type OTLPExporter struct {
+	URL string
+	// ServiceName is the service.name of the spans. Empty means "myredis".
+	ServiceName string
+	Client      *http.Client
+}
+
+// otlpAttribute is a key-value attribute of OTLP's JSON encoding.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// otlpSpan is a span of OTLP's JSON encoding.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// OTLP's span kind and status codes.
+const (
+	otlpKindServer  = 2
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// Export implements SpanExporter.
+func (e *OTLPExporter) Export(spans []Span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		traceID, parent := otlpTraceID(span.TraceID)
+		spanID := make([]byte, 8)
+		rand.Read(spanID)
+		s := otlpSpan{
+			TraceID:      traceID,
+			SpanID:       hex.EncodeToString(spanID),
+			ParentSpanID: parent,
+			Name:         span.Command,
+			Kind:         otlpKindServer,
+			Start:        strconv.FormatInt(span.Start.UnixNano(), 10),
+			End:          strconv.FormatInt(span.Start.Add(span.Duration).UnixNano(), 10),
+			Attributes: []otlpAttribute{
+				newOTLPAttribute("db.system", "redis"),
+				newOTLPAttribute("db.operation", span.Command),
+				newOTLPAttribute("client.address", span.Client),
+				newOTLPAttribute("redis.trace_id", span.TraceID),
+			},
+		}
+		s.Status.Code = otlpStatusOK
+		if span.Failed {
+			s.Status.Code = otlpStatusError
+		}
+		encoded = append(encoded, s)
+	}
+
+	service := e.ServiceName
+	if service == "" {
+		service = "myredis"
+	}
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{newOTLPAttribute("service.name", service)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "myredis"},
+				"spans": encoded,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
+
+// newOTLPAttribute returns a string attribute.
+func newOTLPAttribute(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+// otlpTraceID returns the OpenTelemetry trace ID of a client's trace ID, and
+// the parent span ID it names, if any.
+func otlpTraceID(id string) (traceID, parentSpanID string) {
+	// A traceparent is version-traceid-parentid-flags.
+	if parts := strings.Split(id, "-"); len(parts) == 4 && isHex(parts[1], 32) && isHex(parts[2], 16) {
+		return strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	}
+	if isHex(id, 32) {
+		return strings.ToLower(id), ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16]), ""
+}
+
+// isHex reports whether s is n hexadecimal digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,55 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// ttlBucketNames label the buckets of store.TTLBuckets, plus the final one.
+var ttlBucketNames = []string{"lt_1m", "lt_1h", "lt_1d", "lt_1w", "ge_1w"}
+
+// maxForecastIntervals bounds the size of a TTLREPORT forecast.
+const maxForecastIntervals = 1000
+
+// ttlreport handles TTLREPORT [FORECAST interval-seconds count], which replies
+// in the INFO format with the number of volatile keys, a histogram of their
+// remaining TTLs and how many keys expire in each of the next count intervals,
+// an hour each by default, to anticipate mass expiries and the refill load
+// they cause.
+func ttlreport(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	interval, intervals := time.Hour, 24
+	switch {
+	case len(args) == 1:
+	case len(args) == 4 && strings.EqualFold(args[1], "FORECAST"):
+		secs, err1 := strconv.Atoi(args[2])
+		n, err2 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil || secs <= 0 || n <= 0 || n > maxForecastIntervals {
+			fmt.Fprintf(conn, "-ERR value is out of range, must be positive\r\n")
+			return
+		}
+		interval, intervals = time.Duration(secs)*time.Second, n
+	default:
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+
+	r := s.TTLReport(interval, intervals)
+	var b strings.Builder
+	fmt.Fprintf(&b, "keys:%d\r\n", r.Keys)
+	fmt.Fprintf(&b, "volatile_keys:%d\r\n", r.Volatile)
+	for i, count := range r.Buckets {
+		fmt.Fprintf(&b, "ttl_%s:%d\r\n", ttlBucketNames[i], count)
+	}
+	secs := int64(interval / time.Second)
+	for i, count := range r.Forecast {
+		fmt.Fprintf(&b, "forecast%d:start=%d,end=%d,keys=%d\r\n", i, int64(i)*secs, int64(i+1)*secs, count)
+	}
+	reply := b.String()
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(reply), reply)
+}
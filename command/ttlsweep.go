@@ -0,0 +1,186 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// ttlSweep is a TTLSWEEP job. Jobs run in the background, a batch of keys at
+// a time, so that changing the TTL of millions of keys neither blocks other
+// clients nor floods the AOF in a single burst.
+type ttlSweep struct {
+	id       int64
+	pattern  string
+	action   string
+	examined atomic.Int64
+	changed  atomic.Int64
+	state    atomic.Value // "running", "done" or "cancelled"
+	cancel   chan struct{}
+}
+
+// ttlSweeps holds the jobs started since the server started.
+var ttlSweeps = struct {
+	sync.Mutex
+	nextID int64
+	jobs   map[int64]*ttlSweep
+}{jobs: make(map[int64]*ttlSweep)}
+
+// ttlsweep handles the TTLSWEEP command family:
+//
+//	TTLSWEEP START pattern SET|EXTEND milliseconds [BATCH count] [RATE keys-per-second]
+//	TTLSWEEP START pattern CLEAR [BATCH count] [RATE keys-per-second]
+//	TTLSWEEP STATUS
+//	TTLSWEEP CANCEL id
+//
+// START replies with the job ID. SET gives every matching key the TTL, EXTEND
+// adds it to keys that already expire, and CLEAR makes matching keys persistent.
+func ttlsweep(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	switch strings.ToUpper(args[1]) {
+	case "START":
+		startTTLSweep(args[2:], conn, s, a)
+	case "STATUS":
+		ttlSweeps.Lock()
+		ids := make([]int64, 0, len(ttlSweeps.jobs))
+		for id := range ttlSweeps.jobs {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		fmt.Fprintf(conn, "*%d\r\n", len(ids))
+		for _, id := range ids {
+			job := ttlSweeps.jobs[id]
+			writeBulk(conn, fmt.Sprintf("id=%d pattern=%s action=%s examined=%d changed=%d state=%s",
+				job.id, job.pattern, job.action, job.examined.Load(), job.changed.Load(), job.state.Load()))
+		}
+		ttlSweeps.Unlock()
+	case "CANCEL":
+		if len(args) != 3 {
+			fmt.Fprintf(conn, "-ERR wrong number of arguments for 'ttlsweep|cancel' command\r\n")
+			return
+		}
+		id, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+			return
+		}
+		ttlSweeps.Lock()
+		job, ok := ttlSweeps.jobs[id]
+		ttlSweeps.Unlock()
+		if !ok || !job.state.CompareAndSwap("running", "cancelled") {
+			fmt.Fprintf(conn, ":0\r\n")
+			return
+		}
+		close(job.cancel)
+		fmt.Fprintf(conn, ":1\r\n")
+	default:
+		fmt.Fprintf(conn, "-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// startTTLSweep parses TTLSWEEP START and launches the job.
+func startTTLSweep(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args) < 2 {
+		fmt.Fprintf(conn, "-ERR wrong number of arguments for 'ttlsweep|start' command\r\n")
+		return
+	}
+	job := &ttlSweep{pattern: args[0], action: strings.ToLower(args[1]), cancel: make(chan struct{})}
+	var action store.TTLAction
+	var ttl time.Duration
+	opts := args[2:]
+	switch job.action {
+	case "set", "extend":
+		action = store.TTLSet
+		if job.action == "extend" {
+			action = store.TTLExtend
+		}
+		if len(opts) == 0 {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		ms, err := strconv.ParseInt(opts[0], 10, 64)
+		if err != nil || ms <= 0 {
+			fmt.Fprintf(conn, "-ERR invalid expire time in 'ttlsweep' command\r\n")
+			return
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+		opts = opts[1:]
+	case "clear":
+		action = store.TTLClear
+	default:
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	batch, rate := 1000, 10000
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		n, err := strconv.Atoi(opts[i+1])
+		if err != nil || n < 0 {
+			fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+			return
+		}
+		switch strings.ToUpper(opts[i]) {
+		case "BATCH":
+			batch = max(n, 1)
+		case "RATE":
+			rate = n
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+	}
+
+	job.state.Store("running")
+	ttlSweeps.Lock()
+	ttlSweeps.nextID++
+	job.id = ttlSweeps.nextID
+	ttlSweeps.jobs[job.id] = job
+	ttlSweeps.Unlock()
+	go job.run(s, a, action, ttl, batch, rate)
+	fmt.Fprintf(conn, ":%d\r\n", job.id)
+}
+
+// run sweeps the keyspace in batches, pausing between batches so that no
+// more than rate keys are examined per second (0 means no limit). Every
+// change is written to the AOF as a PEXPIREAT or PERSIST.
+func (job *ttlSweep) run(s *store.Store, a *aof.AOF, action store.TTLAction, ttl time.Duration, batch, rate int) {
+	cursor := 0
+	for {
+		start := time.Now()
+		next, examined, changes := s.SweepTTL(cursor, batch, job.pattern, action, ttl)
+		for _, c := range changes {
+			if c.Expiration.IsZero() {
+				LogEffects(a, "PERSIST", c.Key)
+			} else {
+				LogEffects(a, "PEXPIREAT", c.Key, strconv.FormatInt(c.Expiration.UnixMilli(), 10))
+			}
+		}
+		job.examined.Add(int64(examined))
+		job.changed.Add(int64(len(changes)))
+		if next == 0 {
+			job.state.CompareAndSwap("running", "done")
+			return
+		}
+		cursor = next
+
+		var wait time.Duration
+		if rate > 0 {
+			wait = time.Duration(examined)*time.Second/time.Duration(rate) - time.Since(start)
+		}
+		select {
+		case <-job.cancel:
+			return
+		case <-time.After(max(wait, 0)):
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nazeeeef007/redis-clone/lua"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// ViewFunc computes the value of a virtual key on demand. It reports false
+// when the view currently has no value, which GET returns as nil.
+type ViewFunc func(s *store.Store) (string, bool)
+
+// views holds the registered virtual keys. They are never written to the
+// store, so they are read-only and never persisted or propagated.
+var views = struct {
+	sync.RWMutex
+	byKey map[string]ViewFunc
+}{byKey: make(map[string]ViewFunc)}
+
+// RegisterView makes key a read-only virtual key whose GET is answered by fn,
+// for example a sum of counters or a projection of a hash. Keys are matched
+// after namespace rewriting, so a view for a namespaced user must be
+// registered under the prefixed name. Any real value stored under key is
+// shadowed while the view exists.
+func RegisterView(key string, fn ViewFunc) {
+	views.Lock()
+	views.byKey[key] = fn
+	views.Unlock()
+}
+
+// UnregisterView removes a virtual key registered with RegisterView.
+func UnregisterView(key string) {
+	views.Lock()
+	delete(views.byKey, key)
+	views.Unlock()
+}
+
+// serveView handles commands that name a virtual key, registered with
+// RegisterView or by a function library. GET evaluates the view; every other
+// command is refused since views can't be written to or read as another
+// type. It reports false when no key argument is a view.
+func serveView(cmd string, args []string, conn net.Conn, s *store.Store) bool {
+	spec, ok := keySpecs[cmd]
+	if !ok {
+		return false
+	}
+	views.RLock()
+	registered := len(views.byKey)
+	views.RUnlock()
+	libraryViews := libraryViewsOf(conn, s)
+	if registered == 0 && len(libraryViews) == 0 {
+		return false
+	}
+	for _, i := range spec.keyIndexes(args) {
+		views.RLock()
+		fn, ok := views.byKey[args[i]]
+		views.RUnlock()
+		libraryView, fromLibrary := libraryViews[args[i]]
+		if !ok && !fromLibrary {
+			continue
+		}
+		if cmd != "GET" {
+			fmt.Fprintf(conn, "-ERR '%s' is a read-only computed key and can't be used with '%s'\r\n", args[i], strings.ToLower(cmd))
+			return true
+		}
+		if !ok {
+			serveLibraryView(libraryView, args[i], conn, s)
+			return true
+		}
+		value, ok := fn(s)
+		if !ok {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return true
+		}
+		fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+		return true
+	}
+	return false
+}
+
+// libraryViewsOf returns the views the function libraries of s registered,
+// by key. Commands run by scripts don't see them, as a view is a script
+// itself.
+func libraryViewsOf(conn net.Conn, s *store.Store) map[string]*luaFunction {
+	if _, ok := conn.(*scriptConn); ok {
+		return nil
+	}
+	set, ok := s.CachedFunctions()
+	if !ok {
+		if !s.HasFunctionLibraries() {
+			return nil
+		}
+		scripting.Lock()
+		set = functionsOf(s)
+		scripting.Unlock()
+	}
+	return set.(*functionSet).views
+}
+
+// serveLibraryView replies to GET key with what the view of a function
+// library returns when called with key as its only key. Views run read-only,
+// and as the client, so they can only read what the client can.
+func serveLibraryView(v *luaFunction, key string, conn net.Conn, s *store.Store) {
+	scripting.Lock()
+	defer scripting.Unlock()
+	run := &scriptRun{conn: conn, s: s, readOnly: true}
+	result, err := callScript(v.L, v.fn, []lua.Value{stringsTable([]string{key}), stringsTable(nil)}, run)
+	if err != nil {
+		writeScriptError(conn, err)
+		return
+	}
+	switch result := result.(type) {
+	case nil:
+		fmt.Fprintf(conn, "$-1\r\n")
+	case bool:
+		// As in script replies, true is 1 and false is nil.
+		if result {
+			writeBulk(conn, "1")
+		} else {
+			fmt.Fprintf(conn, "$-1\r\n")
+		}
+	case string:
+		writeBulk(conn, result)
+	case float64:
+		writeBulk(conn, strconv.FormatInt(int64(result), 10))
+	default:
+		if isErrorTable(result) {
+			writeScriptReply(conn, result)
+			return
+		}
+		fmt.Fprintf(conn, "-ERR View '%s' must return a string or a number\r\n", key)
+	}
+}
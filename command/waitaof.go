@@ -0,0 +1,160 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// waitAOFPoll is how often a blocked WAITAOF checks for new fsyncs and
+// replica acknowledgements.
+const waitAOFPoll = 10 * time.Millisecond
+
+// noteWrites records, once a client's command has run, how far the write
+// stream went if the command wrote anything, which is what WAITAOF waits
+// for. It runs under the server's command lock, so the writes since written
+// are the command's.
+func noteWrites(c *Client, a *aof.AOF, written int64) {
+	if now, _ := a.Offsets(); now != written {
+		c.aofOffset = now
+		replication.Lock()
+		c.replOffset = replication.offset
+		replication.Unlock()
+	}
+}
+
+// holdReplies starts holding the replies written to c when the fsync policy
+// is aof.FsyncAlways, so no write is acknowledged before it is on disk, and
+// returns the function that stops. If the AOF was written to meanwhile, the
+// replies are sent by RunDeferred once it is fsynced, so the wait happens
+// after the command lock is released and the clients writing meanwhile
+// share the fsync; otherwise they are sent right away.
+func holdReplies(c *Client, a *aof.AOF) (stop func()) {
+	if c.holding || a == nil || a.Fsync() != aof.FsyncAlways {
+		return func() {}
+	}
+	c.holding = true
+	written, _ := a.Offsets()
+	return func() {
+		c.holding = false
+		held := c.held
+		c.held = nil
+		if len(held) == 0 {
+			return
+		}
+		now, _ := a.Offsets()
+		if now == written {
+			c.Write(held)
+			return
+		}
+		c.release = func() {
+			if err := a.WaitSynced(now); err != nil {
+				log.Printf("Failed to write to AOF: %v", err)
+				fmt.Fprintf(c, "-ERR Write to the AOF failed, the change may be lost on restart: %v\r\n", err)
+				return
+			}
+			c.Write(held)
+		}
+	}
+}
+
+// waitAOF handles WAITAOF numlocal numreplicas timeout, which blocks until
+// the writes of the client are fsynced to the local AOF, when numlocal is 1,
+// and to the AOF of at least numreplicas replicas, or until timeout
+// milliseconds pass, 0 waiting forever. It replies with the number of local
+// AOFs and of replicas the writes are fsynced on. With appendfsync no, the
+// AOF is fsynced on demand so the wait doesn't last forever.
+func waitAOF(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	numLocal, _ := strconv.Atoi(args[1])
+	numReplicas, _ := strconv.Atoi(args[2])
+	timeoutMs, _ := strconv.ParseInt(args[3], 10, 64)
+	if numLocal < 0 || numReplicas < 0 {
+		fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+		return
+	}
+	if timeoutMs < 0 {
+		fmt.Fprintf(conn, "-ERR timeout is negative\r\n")
+		return
+	}
+	if numLocal > 1 {
+		fmt.Fprintf(conn, "-ERR WAITAOF numlocal can't be more than 1\r\n")
+		return
+	}
+	if numLocal > 0 && !a.Status().Enabled {
+		fmt.Fprintf(conn, "-ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.\r\n")
+		return
+	}
+
+	c := clientOf(conn)
+	var aofOffset, replOffset int64
+	if c != nil {
+		aofOffset, replOffset = c.aofOffset, c.replOffset
+	}
+	acked := func() (local, replicas int) {
+		if _, synced := a.Offsets(); synced >= aofOffset && a.Status().Enabled {
+			local = 1
+		}
+		replication.Lock()
+		defer replication.Unlock()
+		for r := range replication.replicas {
+			r.mu.Lock()
+			if r.fackOffset >= replOffset {
+				replicas++
+			}
+			r.mu.Unlock()
+		}
+		return local, replicas
+	}
+	reply := func(local, replicas int) {
+		fmt.Fprintf(conn, "*2\r\n:%d\r\n:%d\r\n", local, replicas)
+	}
+
+	local, replicas := acked()
+	// Like other blocking commands, WAITAOF doesn't wait inside a
+	// transaction.
+	if c == nil || c.inExec || (local >= numLocal && replicas >= numReplicas) {
+		reply(local, replicas)
+		return
+	}
+	c.deferred = func() {
+		if numLocal > 0 && a.Fsync() == aof.FsyncNo {
+			a.Sync()
+		}
+		if numReplicas > 0 {
+			// Ask the replicas to acknowledge now rather than on their
+			// next periodic acknowledgement.
+			propagate([]string{"REPLCONF", "GETACK", "*"})
+		}
+		var expired <-chan time.Time
+		if timeoutMs > 0 {
+			timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		poll := time.NewTicker(waitAOFPoll)
+		defer poll.Stop()
+		check := time.NewTicker(livenessInterval)
+		defer check.Stop()
+		for {
+			select {
+			case <-poll.C:
+				if local, replicas := acked(); local >= numLocal && replicas >= numReplicas {
+					reply(local, replicas)
+					return
+				}
+			case <-check.C:
+				if !c.alive() {
+					return
+				}
+			case <-expired:
+				reply(acked())
+				return
+			}
+		}
+	}
+}
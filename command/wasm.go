@@ -0,0 +1,436 @@
+//go:build wasmruntime
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WebAssembly modules add commands like Go plugins do, but run sandboxed:
+// they only reach the store through the host functions the "redis" import
+// module provides, and WASI gives them no files or sockets. A module
+// exports:
+//
+//	memory
+//	alloc(size i32) i32     returning size bytes of its memory
+//	commands() i64          returning its command table, ptr<<32 | len
+//	cmd_<name>()            for each command, its name in lower case
+//
+// The command table has one line per command, "name arity flags first last
+// step", with arity and key positions as in COMMAND INFO and flags a comma
+// separated list of write, readonly, admin and nokeys, or "-" for none.
+// Handlers read their arguments and reply with:
+//
+//	arg_count() i32
+//	arg_len(i i32) i32
+//	arg(i i32, ptr i32)                     copying argument i to ptr
+//	get(key i32, key_len i32, buf i32, cap i32) i32
+//	                                        the value's length, or -1 if the
+//	                                        key doesn't exist, copied to buf
+//	                                        if it fits in cap bytes
+//	set(key i32, key_len i32, val i32, val_len i32)
+//	del(key i32, key_len i32) i32
+//	exists(key i32, key_len i32) i32
+//	reply_status(ptr i32, len i32)
+//	reply_error(ptr i32, len i32)
+//	reply_bulk(ptr i32, len i32)
+//	reply_int(n i64)
+//	reply_nil()
+//	reply_array(n i32)                      followed by its n elements
+//	log(ptr i32, len i32)
+//
+// set and del are logged as SET and DEL, so what a command did is replayed
+// and replicated whatever the module. Writes made before a handler fails
+// stay made. For users confined to a namespace, the keys handlers get as
+// arguments and name to the host functions are relative to the namespace,
+// as the host functions confine them to it.
+
+// wasmCallTimeout bounds how long a module's handler may run. A handler
+// running longer is stopped, and its module instantiated again for the
+// next call.
+const wasmCallTimeout = 5 * time.Second
+
+// wasmMemoryLimitPages caps the memory of a module, in 64KiB pages.
+const wasmMemoryLimitPages = 1024
+
+// wasmRuntime is the runtime the modules are loaded into, with the host
+// modules they import, created by the first LoadWasmModule.
+var wasmRuntime struct {
+	once    sync.Once
+	runtime wazero.Runtime
+	err     error
+}
+
+// wasmModule is a loaded WebAssembly module. Its handlers run one at a time.
+type wasmModule struct {
+	mu       sync.Mutex
+	path     string
+	compiled wazero.CompiledModule
+	instance api.Module
+}
+
+// wasmCall is the state of a running handler, which the host functions
+// find in their context.
+type wasmCall struct {
+	args  []string
+	s     *store.Store
+	a     *aof.AOF
+	reply bytes.Buffer
+	// pending counts the replies still due: the handler's and the elements
+	// of the arrays it started.
+	pending int
+	// namespace is the namespace of the calling user, if any, which the
+	// keys the handler names are confined to.
+	namespace string
+}
+
+type wasmCallKey struct{}
+
+// LoadWasmModule loads the WebAssembly module at path and registers the
+// commands its command table lists.
+func LoadWasmModule(path string) error {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	wasmRuntime.once.Do(func() {
+		r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+			WithMemoryLimitPages(wasmMemoryLimitPages).
+			WithCloseOnContextDone(true))
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+			wasmRuntime.err = err
+			return
+		}
+		if _, err := wasmHostModule(r).Instantiate(ctx); err != nil {
+			wasmRuntime.err = err
+			return
+		}
+		wasmRuntime.runtime = r
+	})
+	if wasmRuntime.err != nil {
+		return wasmRuntime.err
+	}
+
+	compiled, err := wasmRuntime.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", path, err)
+	}
+	m := &wasmModule{path: path, compiled: compiled}
+	instance, err := m.instantiate(ctx)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", path, err)
+	}
+	table, err := callForString(ctx, instance, "commands")
+	if err != nil {
+		return fmt.Errorf("module %s: %w", path, err)
+	}
+	var cmds []Command
+	for _, line := range strings.Split(strings.TrimSpace(table), "\n") {
+		cmd, err := parseWasmCommand(line)
+		if err != nil {
+			return fmt.Errorf("module %s: %w", path, err)
+		}
+		export := "cmd_" + strings.ToLower(cmd.Name)
+		if instance.ExportedFunction(export) == nil {
+			return fmt.Errorf("module %s: command %s has no %s export", path, cmd.Name, export)
+		}
+		cmd.Handler = m.handler(export)
+		cmds = append(cmds, cmd)
+	}
+	return loadingModule(path, func() error {
+		for _, cmd := range cmds {
+			if err := RegisterCommand(cmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// parseWasmCommand parses a line of a module's command table.
+func parseWasmCommand(line string) (Command, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return Command{}, fmt.Errorf("command table line %q doesn't have 6 fields", line)
+	}
+	cmd := Command{Name: fields[0]}
+	var ints [4]int
+	for i, field := range []string{fields[1], fields[3], fields[4], fields[5]} {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return Command{}, fmt.Errorf("command table line %q: %q is not an integer", line, field)
+		}
+		ints[i] = n
+	}
+	cmd.Arity, cmd.FirstKey, cmd.LastKey, cmd.KeyStep = ints[0], ints[1], ints[2], ints[3]
+	if fields[2] != "-" {
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch strings.ToLower(flag) {
+			case "write":
+				cmd.Flags |= FlagWrite
+			case "readonly":
+				cmd.Flags |= FlagReadOnly
+			case "admin":
+				cmd.Flags |= FlagAdmin
+			case "nokeys":
+				cmd.Flags |= FlagNoKeys
+			default:
+				return Command{}, fmt.Errorf("command table line %q: unknown flag %q", line, flag)
+			}
+		}
+	}
+	return cmd, nil
+}
+
+// instantiate instantiates the module, anonymously so several can be,
+// initializing it as a WASI reactor or command, whichever it is.
+func (m *wasmModule) instantiate(ctx context.Context) (api.Module, error) {
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize", "_start")
+	instance, err := wasmRuntime.runtime.InstantiateModule(ctx, m.compiled, config)
+	if err != nil {
+		return nil, err
+	}
+	if instance.ExportedFunction("alloc") == nil || instance.Memory() == nil {
+		instance.Close(ctx)
+		return nil, fmt.Errorf("alloc or memory isn't exported")
+	}
+	m.instance = instance
+	return instance, nil
+}
+
+// handler returns the handler calling the module's export.
+func (m *wasmModule) handler(export string) func([]string, net.Conn, *store.Store, *aof.AOF) {
+	return func(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		call := &wasmCall{args: args, s: s, a: a, pending: 1}
+		if c := clientOf(conn); c != nil && c.namespace() != "" {
+			ns := c.namespace()
+			// The handler sees its keys as the client named them, and the
+			// host functions qualify the keys it names.
+			call.namespace = ns
+			call.args = slices.Clone(args)
+			for _, i := range keySpecs[strings.ToUpper(args[0])].keyIndexes(args) {
+				call.args[i] = strings.TrimPrefix(args[i], ns)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), wasmCallKey{}, call), wasmCallTimeout)
+		defer cancel()
+
+		if m.instance == nil || m.instance.IsClosed() {
+			if _, err := m.instantiate(context.Background()); err != nil {
+				fmt.Fprintf(conn, "-ERR module %s: %v\r\n", m.path, err)
+				return
+			}
+		}
+		_, err := m.instance.ExportedFunction(export).Call(ctx)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			fmt.Fprintf(conn, "-ERR %s ran longer than %v and was stopped\r\n", strings.ToLower(args[0]), wasmCallTimeout)
+		case err != nil:
+			fmt.Fprintf(conn, "-ERR %s failed: %s\r\n", strings.ToLower(args[0]), oneLine(err.Error()))
+		case call.reply.Len() == 0:
+			fmt.Fprintf(conn, "-ERR %s didn't reply\r\n", strings.ToLower(args[0]))
+		default:
+			// Arrays the handler didn't fill are padded, so the reply
+			// stays well formed.
+			for ; call.pending > 0; call.pending-- {
+				call.reply.WriteString("$-1\r\n")
+			}
+			conn.Write(call.reply.Bytes())
+		}
+	}
+}
+
+// oneLine keeps the first line of a message, for an error reply.
+func oneLine(msg string) string {
+	line, _, _ := strings.Cut(msg, "\n")
+	return strings.TrimSpace(line)
+}
+
+// callForString calls an export returning ptr<<32 | len and reads the
+// string it points to.
+func callForString(ctx context.Context, instance api.Module, export string) (string, error) {
+	f := instance.ExportedFunction(export)
+	if f == nil {
+		return "", fmt.Errorf("%s isn't exported", export)
+	}
+	results, err := f.Call(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(results) != 1 {
+		return "", fmt.Errorf("%s doesn't return an i64", export)
+	}
+	b, ok := instance.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return "", fmt.Errorf("%s returned memory out of range", export)
+	}
+	return string(b), nil
+}
+
+// wasmCallOf returns the call a host function runs for.
+func wasmCallOf(ctx context.Context) *wasmCall {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if call == nil {
+		panic("redis host functions can only be called by command handlers")
+	}
+	return call
+}
+
+// readGuest reads length bytes at ptr of the guest's memory, trapping if
+// they are out of range.
+func readGuest(m api.Module, ptr, length uint32) string {
+	b, ok := m.Memory().Read(ptr, length)
+	if !ok {
+		panic(fmt.Sprintf("memory range %d+%d is out of bounds", ptr, length))
+	}
+	return string(b)
+}
+
+// writeGuest writes b at ptr of the guest's memory, trapping if it is out
+// of range.
+func writeGuest(m api.Module, ptr uint32, b []byte) {
+	if !m.Memory().Write(ptr, b) {
+		panic(fmt.Sprintf("memory range %d+%d is out of bounds", ptr, len(b)))
+	}
+}
+
+// key reads a key the handler names, confined to the caller's namespace as
+// applyNamespace confines the keys of commands.
+func (call *wasmCall) key(m api.Module, ptr, length uint32) string {
+	key := readGuest(m, ptr, length)
+	if call.namespace == "" {
+		return key
+	}
+	args, _ := applyNamespace("GET", []string{"GET", key}, call.namespace)
+	return args[1]
+}
+
+// replied counts a reply of the handler, trapping if none is due.
+func (call *wasmCall) replied() {
+	if call.pending == 0 {
+		panic("reply after the handler's reply is complete")
+	}
+	call.pending--
+}
+
+// wasmHostModule builds the "redis" module of host functions.
+func wasmHostModule(r wazero.Runtime) wazero.HostModuleBuilder {
+	b := r.NewHostModuleBuilder("redis")
+	export := func(name string, f any) {
+		b.NewFunctionBuilder().WithFunc(f).Export(name)
+	}
+
+	export("arg_count", func(ctx context.Context) uint32 {
+		return uint32(len(wasmCallOf(ctx).args))
+	})
+	arg := func(ctx context.Context, i uint32) string {
+		call := wasmCallOf(ctx)
+		if int(i) >= len(call.args) {
+			panic(fmt.Sprintf("argument %d out of range", i))
+		}
+		return call.args[i]
+	}
+	export("arg_len", func(ctx context.Context, i uint32) uint32 {
+		return uint32(len(arg(ctx, i)))
+	})
+	export("arg", func(ctx context.Context, m api.Module, i, ptr uint32) {
+		writeGuest(m, ptr, []byte(arg(ctx, i)))
+	})
+
+	export("get", func(ctx context.Context, m api.Module, key, keyLen, buf, capacity uint32) int32 {
+		call := wasmCallOf(ctx)
+		val, ok := call.s.Get(call.key(m, key, keyLen))
+		if !ok {
+			return -1
+		}
+		if len(val) <= int(capacity) {
+			writeGuest(m, buf, []byte(val))
+		}
+		return int32(len(val))
+	})
+	export("set", func(ctx context.Context, m api.Module, key, keyLen, val, valLen uint32) {
+		call := wasmCallOf(ctx)
+		k := call.key(m, key, keyLen)
+		// Values of encrypted keys are stored and logged sealed, as SET does.
+		v, sealed := call.s.Seal(k, readGuest(m, val, valLen))
+		call.s.SetSealed(k, v, 0)
+		if sealed {
+			LogEffects(call.a, "SETSEALED", k, v)
+		} else {
+			LogEffects(call.a, "SET", k, v)
+		}
+	})
+	export("del", func(ctx context.Context, m api.Module, key, keyLen uint32) uint32 {
+		call := wasmCallOf(ctx)
+		k := call.key(m, key, keyLen)
+		if !call.s.Del(k) {
+			return 0
+		}
+		LogEffects(call.a, "DEL", k)
+		return 1
+	})
+	export("exists", func(ctx context.Context, m api.Module, key, keyLen uint32) uint32 {
+		call := wasmCallOf(ctx)
+		if call.s.Exists(call.key(m, key, keyLen)) {
+			return 1
+		}
+		return 0
+	})
+
+	export("reply_status", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		call := wasmCallOf(ctx)
+		call.replied()
+		fmt.Fprintf(&call.reply, "+%s\r\n", oneLine(readGuest(m, ptr, length)))
+	})
+	export("reply_error", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		call := wasmCallOf(ctx)
+		call.replied()
+		fmt.Fprintf(&call.reply, "-%s\r\n", oneLine(readGuest(m, ptr, length)))
+	})
+	export("reply_bulk", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		call := wasmCallOf(ctx)
+		call.replied()
+		val := readGuest(m, ptr, length)
+		fmt.Fprintf(&call.reply, "$%d\r\n%s\r\n", len(val), val)
+	})
+	export("reply_int", func(ctx context.Context, n int64) {
+		call := wasmCallOf(ctx)
+		call.replied()
+		fmt.Fprintf(&call.reply, ":%d\r\n", n)
+	})
+	export("reply_nil", func(ctx context.Context) {
+		call := wasmCallOf(ctx)
+		call.replied()
+		call.reply.WriteString("$-1\r\n")
+	})
+	export("reply_array", func(ctx context.Context, n uint32) {
+		call := wasmCallOf(ctx)
+		call.replied()
+		call.pending += int(n)
+		fmt.Fprintf(&call.reply, "*%d\r\n", n)
+	})
+
+	export("log", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		log.Printf("WASM %s", readGuest(m, ptr, length))
+	})
+	return b
+}
@@ -0,0 +1,11 @@
+//go:build !wasmruntime
+
+package command
+
+import "errors"
+
+// LoadWasmModule fails in servers built without the WebAssembly runtime,
+// which the wasmruntime build tag adds.
+func LoadWasmModule(path string) error {
+	return errors.New("WebAssembly modules need a server built with -tags wasmruntime")
+}
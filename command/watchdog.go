@@ -0,0 +1,323 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// The watchdog looks for two kinds of trouble that otherwise only show as a
+// server that stops answering or slowly grows: commands that run far longer
+// than any should, holding the command lock and stalling every client, and
+// goroutines leaked by connections, Pub/Sub writers and blocked clients.
+//
+// A command running past the threshold is logged once, with its client and
+// the stack of the goroutine running it. Every audit period, the live
+// goroutines are checked against the state that should own them:
+//
+//   - every registered client has its connection goroutine, and every
+//     connection goroutine a registered client
+//   - every open Pub/Sub or MONITOR outbox has one writer goroutine
+//   - every waiter registered by a blocked client has a goroutine waiting
+//
+// Leaks are logged, and the counts of the last audit are reported by INFO
+// and the metrics.
+
+// watchdogTick is how often running commands are checked.
+const watchdogTick = 100 * time.Millisecond
+
+// watchdog holds the watchdog's settings and findings.
+var watchdog struct {
+	sync.Mutex
+	// threshold is how long a command may run before it is flagged, 0 to
+	// not watch commands. auditPeriod is the time between audits, 0 for
+	// none.
+	threshold   time.Duration
+	auditPeriod time.Duration
+	started     bool
+	// running are the commands being executed, by client ID.
+	running map[int64]*runningCommand
+	// stuck counts the commands flagged.
+	stuck  int64
+	audits int64
+	last   WatchdogAudit
+	// connectionFuncs are the functions that serve connections, those that
+	// created clients, by name.
+	connectionFuncs map[string]bool
+}
+
+// runningCommand is a command being executed.
+type runningCommand struct {
+	client  *Client
+	args    []string
+	start   time.Time
+	flagged bool
+}
+
+// WatchdogAudit is the result of a goroutine audit.
+type WatchdogAudit struct {
+	// Goroutines is the number of live goroutines.
+	Goroutines int
+	// LeakedClients are registered clients whose connection goroutine has
+	// exited, and LeakedConnections connection goroutines that lost their
+	// client.
+	LeakedClients     int
+	LeakedConnections int
+	// LeakedOutboxWriters are writer goroutines beyond the open outboxes.
+	LeakedOutboxWriters int
+	// LeakedWaiters are registered waiters no blocked client waits on.
+	LeakedWaiters int
+}
+
+// openOutboxes counts the outboxes not yet closed.
+var openOutboxes atomic.Int64
+
+// SetupWatchdog starts the watchdog, flagging commands that run longer than
+// threshold and auditing the goroutines every auditPeriod. Either is off
+// when zero. The threshold can later be changed with CONFIG SET.
+func SetupWatchdog(threshold, auditPeriod time.Duration) {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	watchdog.threshold = threshold
+	watchdog.auditPeriod = auditPeriod
+	if watchdog.running == nil {
+		watchdog.running = make(map[int64]*runningCommand)
+	}
+	if !watchdog.started {
+		watchdog.started = true
+		go runWatchdog()
+	}
+}
+
+// goroutineID returns the ID of the calling goroutine.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	id, _ := parseGoroutineID(string(buf[:runtime.Stack(buf, false)]))
+	return id
+}
+
+// parseGoroutineID parses the ID in the header of a goroutine's stack, as in
+// "goroutine 18 [running]:".
+func parseGoroutineID(stack string) (int64, bool) {
+	rest, ok := strings.CutPrefix(stack, "goroutine ")
+	if !ok {
+		return 0, false
+	}
+	idPart, _, _ := strings.Cut(rest, " ")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	return id, err == nil
+}
+
+// goroutineStacks returns the stacks of every goroutine by ID.
+func goroutineStacks() map[int64]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := make(map[int64]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if id, ok := parseGoroutineID(stack); ok {
+			stacks[id] = stack
+		}
+	}
+	return stacks
+}
+
+// registerConnection records the goroutine serving a new client and the
+// function it runs, which is the caller of NewClient's caller.
+func registerConnection(c *Client) {
+	c.goroutine = goroutineID()
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return
+	}
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		watchdog.Lock()
+		if watchdog.connectionFuncs == nil {
+			watchdog.connectionFuncs = make(map[string]bool)
+		}
+		watchdog.connectionFuncs[fn.Name()] = true
+		watchdog.Unlock()
+	}
+}
+
+// watchCommand records that c started running a command, returning the
+// function that records its end.
+func watchCommand(c *Client, args []string) func() {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	if watchdog.threshold <= 0 || watchdog.running[c.ID] != nil {
+		return func() {}
+	}
+	watchdog.running[c.ID] = &runningCommand{client: c, args: args, start: time.Now()}
+	return func() {
+		watchdog.Lock()
+		delete(watchdog.running, c.ID)
+		watchdog.Unlock()
+	}
+}
+
+// runWatchdog checks running commands and audits goroutines until the
+// process exits.
+func runWatchdog() {
+	lastAudit := time.Now()
+	for now := range time.Tick(watchdogTick) {
+		flagStuckCommands(now)
+		watchdog.Lock()
+		period := watchdog.auditPeriod
+		watchdog.Unlock()
+		if period > 0 && now.Sub(lastAudit) >= period {
+			lastAudit = now
+			auditGoroutines()
+		}
+	}
+}
+
+// flagStuckCommands logs the commands that have run past the threshold and
+// weren't flagged yet.
+func flagStuckCommands(now time.Time) {
+	watchdog.Lock()
+	var stuck []runningCommand
+	for _, rc := range watchdog.running {
+		if !rc.flagged && watchdog.threshold > 0 && now.Sub(rc.start) > watchdog.threshold {
+			rc.flagged = true
+			watchdog.stuck++
+			stuck = append(stuck, *rc)
+		}
+	}
+	watchdog.Unlock()
+	if len(stuck) == 0 {
+		return
+	}
+	stacks := goroutineStacks()
+	for _, rc := range stuck {
+		stack, ok := stacks[rc.client.goroutine]
+		if !ok {
+			stack = "(goroutine not found)"
+		}
+		log.Printf("Watchdog: command from client id=%d addr=%s has been running for %s: %s\n%s",
+			rc.client.ID, rc.client.RemoteAddr(), now.Sub(rc.start).Round(time.Millisecond),
+			strings.Join(shortenArgs(redactArgs(rc.args)), " "), stack)
+	}
+}
+
+// auditGoroutines checks the goroutines against the clients, outboxes and
+// waiters that should own them, logging and recording what it finds.
+func auditGoroutines() WatchdogAudit {
+	// Clients registered throughout the audit are expected to have a
+	// goroutine, and any goroutine of a client registered at some point of
+	// it has an owner, so connections coming and going don't look leaked.
+	before := connectedClients()
+	stacks := goroutineStacks()
+	after := connectedClients()
+
+	audit := WatchdogAudit{Goroutines: len(stacks)}
+	owned := make(map[int64]bool)
+	stillThere := make(map[int64]bool)
+	for _, c := range after {
+		owned[c.goroutine] = true
+		stillThere[c.ID] = true
+	}
+	for _, c := range before {
+		owned[c.goroutine] = true
+		if _, ok := stacks[c.goroutine]; stillThere[c.ID] && !ok {
+			audit.LeakedClients++
+		}
+	}
+
+	watchdog.Lock()
+	connectionFuncs := make([]string, 0, len(watchdog.connectionFuncs))
+	for name := range watchdog.connectionFuncs {
+		connectionFuncs = append(connectionFuncs, name+"(")
+	}
+	watchdog.Unlock()
+	writers, waiting := 0, 0
+	for id, stack := range stacks {
+		if strings.Contains(stack, "command.newOutbox.func") {
+			writers++
+		}
+		if strings.Contains(stack, "command.block.func") {
+			waiting++
+		}
+		if owned[id] {
+			continue
+		}
+		for _, fn := range connectionFuncs {
+			if strings.Contains(stack, fn) {
+				audit.LeakedConnections++
+				break
+			}
+		}
+	}
+	audit.LeakedOutboxWriters = max(0, writers-int(openOutboxes.Load()))
+	audit.LeakedWaiters = max(0, registeredWaiters()-waiting)
+
+	watchdog.Lock()
+	watchdog.audits++
+	watchdog.last = audit
+	watchdog.Unlock()
+	if audit.LeakedClients+audit.LeakedConnections+audit.LeakedOutboxWriters+audit.LeakedWaiters > 0 {
+		log.Printf("Watchdog: leaks found among %d goroutines: %d clients without a connection goroutine, %d connection goroutines without a client, %d extra outbox writers, %d waiters without a blocked client",
+			audit.Goroutines, audit.LeakedClients, audit.LeakedConnections, audit.LeakedOutboxWriters, audit.LeakedWaiters)
+	}
+	return audit
+}
+
+// registeredWaiters counts the wake-up channels of blocked clients.
+func registeredWaiters() int {
+	waiters.Lock()
+	defer waiters.Unlock()
+	chans := make(map[chan struct{}]bool)
+	for _, byChan := range waiters.byKey {
+		for ch := range byChan {
+			chans[ch] = true
+		}
+	}
+	return len(chans)
+}
+
+// watchdogStats returns the number of commands flagged and running past the
+// threshold, and the last audit.
+func watchdogStats() (flagged, running int64, audits int64, last WatchdogAudit) {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	for _, rc := range watchdog.running {
+		if rc.flagged {
+			running++
+		}
+	}
+	return watchdog.stuck, running, watchdog.audits, watchdog.last
+}
+
+// infoWatchdog renders the watchdog section.
+func infoWatchdog(s *store.Store, a *aof.AOF) string {
+	flagged, running, audits, last := watchdogStats()
+	watchdog.Lock()
+	threshold, period := watchdog.threshold, watchdog.auditPeriod
+	watchdog.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "watchdog_threshold_ms:%d\r\n", threshold.Milliseconds())
+	fmt.Fprintf(&b, "watchdog_audit_period_sec:%d\r\n", int64(period.Seconds()))
+	fmt.Fprintf(&b, "watchdog_stuck_commands:%d\r\n", flagged)
+	fmt.Fprintf(&b, "watchdog_stuck_running:%d\r\n", running)
+	fmt.Fprintf(&b, "watchdog_audits:%d\r\n", audits)
+	fmt.Fprintf(&b, "goroutines:%d\r\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "leaked_clients:%d\r\n", last.LeakedClients)
+	fmt.Fprintf(&b, "leaked_connection_goroutines:%d\r\n", last.LeakedConnections)
+	fmt.Fprintf(&b, "leaked_outbox_writers:%d\r\n", last.LeakedOutboxWriters)
+	fmt.Fprintf(&b, "leaked_waiters:%d\r\n", last.LeakedWaiters)
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package command
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Write-behind forwards the keys written by commands to an external system
+// of record, such as a SQL database, in the background. Writes to the same
+// key are coalesced while they wait, and each forwarded record carries the
+// key's value at the time it is sent, so the sink always converges on the
+// latest value even if intermediate ones are skipped. Flushes aren't
+// forwarded.
+
+// WriteBehindRecord is the state of a key handed to a WriteBehindSink.
+type WriteBehindRecord struct {
+	Key string `json:"key"`
+	// Type is the key's type as reported by TYPE, or "none" if it was deleted.
+	Type string `json:"type"`
+	// Value is the key's value as returned by store.Export, or nil if it was
+	// deleted.
+	Value any `json:"value"`
+}
+
+// WriteBehindSink receives batches of changed keys. Write must apply all of
+// the records or return an error, in which case the whole batch is retried.
+type WriteBehindSink interface {
+	Write(records []WriteBehindRecord) error
+}
+
+// WriteBehind configures write-behind forwarding.
+type WriteBehind struct {
+	// Patterns selects the keys to forward by glob pattern.
+	Patterns []string
+	Sink     WriteBehindSink
+	// BatchSize caps the records per Write. Zero means 100.
+	BatchSize int
+	// MaxRetries is how often a failed batch is retried, waiting RetryDelay
+	// and doubling the wait each time, before its records are dead-lettered.
+	MaxRetries int
+	RetryDelay time.Duration
+	// DeadLetterKey, when set, is a list that records which exhausted their
+	// retries are pushed to as JSON, for inspection and replay. Otherwise
+	// they are only logged.
+	DeadLetterKey string
+}
+
+// writeBehind is the running forwarder.
+var writeBehind struct {
+	sync.Mutex
+	cfg     WriteBehind
+	pending map[string]struct{}
+	order   []string
+	wake    chan struct{}
+	// Counters for INFO.
+	forwarded, retries, deadLettered int64
+}
+
+// SetupWriteBehind starts forwarding the keys that commands write to s, as
+// seen in the write stream of a, to cfg.Sink.
+func SetupWriteBehind(s *store.Store, a *aof.AOF, cfg WriteBehind) {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	writeBehind.cfg = cfg
+	writeBehind.pending = make(map[string]struct{})
+	writeBehind.wake = make(chan struct{}, 1)
+	a.AddFeed(queueWriteBehind)
+	go forwardWriteBehind(s, a)
+}
+
+// queueWriteBehind is the write-stream feed that queues the matching keys a
+// command wrote.
+func queueWriteBehind(args []string) {
+	spec, ok := keySpecs[strings.ToUpper(args[0])]
+	if !ok {
+		return
+	}
+	writeBehind.Lock()
+	defer writeBehind.Unlock()
+	queued := false
+	for _, i := range spec.keyIndexes(args) {
+		key := args[i]
+		if key == writeBehind.cfg.DeadLetterKey || !matchesAny(writeBehind.cfg.Patterns, key) {
+			continue
+		}
+		if _, ok := writeBehind.pending[key]; !ok {
+			writeBehind.pending[key] = struct{}{}
+			writeBehind.order = append(writeBehind.order, key)
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case writeBehind.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// matchesAny reports whether key matches one of the glob patterns.
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if store.MatchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardWriteBehind sends the queued keys to the sink, batch by batch.
+func forwardWriteBehind(s *store.Store, a *aof.AOF) {
+	cfg := writeBehind.cfg
+	for range writeBehind.wake {
+		for {
+			writeBehind.Lock()
+			n := min(len(writeBehind.order), cfg.BatchSize)
+			keys := writeBehind.order[:n:n]
+			writeBehind.order = writeBehind.order[n:]
+			for _, key := range keys {
+				delete(writeBehind.pending, key)
+			}
+			writeBehind.Unlock()
+			if n == 0 {
+				break
+			}
+
+			records := make([]WriteBehindRecord, len(keys))
+			for i, key := range keys {
+				records[i] = WriteBehindRecord{Key: key, Type: "none"}
+				if typ, value, ok := s.Export(key); ok {
+					records[i].Type, records[i].Value = typ.String(), value
+				}
+			}
+			sendWriteBehind(s, a, cfg, records)
+		}
+	}
+}
+
+// sendWriteBehind writes a batch to the sink, retrying with backoff, and
+// dead-letters it if every attempt fails. Later batches wait meanwhile.
+func sendWriteBehind(s *store.Store, a *aof.AOF, cfg WriteBehind, records []WriteBehindRecord) {
+	delay := cfg.RetryDelay
+	err := cfg.Sink.Write(records)
+	for attempt := 0; err != nil && attempt < cfg.MaxRetries; attempt++ {
+		writeBehind.Lock()
+		writeBehind.retries++
+		writeBehind.Unlock()
+		time.Sleep(delay)
+		delay *= 2
+		err = cfg.Sink.Write(records)
+	}
+	writeBehind.Lock()
+	if err == nil {
+		writeBehind.forwarded += int64(len(records))
+	} else {
+		writeBehind.deadLettered += int64(len(records))
+	}
+	writeBehind.Unlock()
+	if err == nil {
+		return
+	}
+	log.Printf("Write-behind failed for %d keys, giving up: %v", len(records), err)
+	if cfg.DeadLetterKey == "" {
+		return
+	}
+	entries := make([]string, 0, len(records))
+	for _, r := range records {
+		b, _ := json.Marshal(r)
+		entries = append(entries, string(b))
+	}
+	// The push goes through the write stream like any command, so the
+	// dead letters are persisted and replicated.
+	if serverLock != nil {
+		serverLock.Lock()
+		defer serverLock.Unlock()
+	}
+	s.Rpush(cfg.DeadLetterKey, entries)
+	LogEffects(a, "RPUSH", append([]string{cfg.DeadLetterKey}, entries...)...)
+}
+
+// infoWriteBehind renders the write-behind fields of the persistence section.
+func infoWriteBehind() string {
+	writeBehind.Lock()
+	defer writeBehind.Unlock()
+	if writeBehind.cfg.Sink == nil {
+		return ""
+	}
+	return fmt.Sprintf("write_behind_pending:%d\r\nwrite_behind_forwarded:%d\r\nwrite_behind_retries:%d\r\nwrite_behind_dead_lettered:%d\r\n",
+		len(writeBehind.order), writeBehind.forwarded, writeBehind.retries, writeBehind.deadLettered)
+}
+
+// HTTPSink is a WriteBehindSink that POSTs each batch to URL as a JSON array
+// of records. Any status other than 2xx fails the batch.
+type HTTPSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Write implements WriteBehindSink.
+func (h *HTTPSink) Write(records []WriteBehindRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("write-behind sink returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SQLSink is a WriteBehindSink that stores records in a SQL table through a
+// database/sql driver, one row per key with its type and JSON-encoded value.
+// Each batch is applied in one transaction.
+type SQLSink struct {
+	DB *sql.DB
+	// Upsert inserts or replaces a row, given the key, type and value, and
+	// Delete removes the row of a key. Their placeholder syntax depends on
+	// the driver; the defaults suit drivers using "?", like SQLite's and
+	// MySQL's, and a table created with
+	//	CREATE TABLE kv (k TEXT PRIMARY KEY, type TEXT, value TEXT)
+	Upsert string
+	Delete string
+}
+
+// Write implements WriteBehindSink.
+func (q *SQLSink) Write(records []WriteBehindRecord) error {
+	upsert, del := q.Upsert, q.Delete
+	if upsert == "" {
+		upsert = "REPLACE INTO kv (k, type, value) VALUES (?, ?, ?)"
+	}
+	if del == "" {
+		del = "DELETE FROM kv WHERE k = ?"
+	}
+	tx, err := q.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Value == nil {
+			_, err = tx.Exec(del, r.Key)
+		} else {
+			var value []byte
+			if value, err = json.Marshal(r.Value); err == nil {
+				_, err = tx.Exec(upsert, r.Key, r.Type, string(value))
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,593 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// parseScore parses a sorted set score. Like Redis it accepts "inf", "+inf"
+// and "-inf" but rejects NaN.
+func parseScore(arg string) (float64, bool) {
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// formatScore formats a score the way Redis replies with it.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// writeBulk writes a bulk string reply.
+func writeBulk(conn net.Conn, s string) {
+	fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+}
+
+// zadd handles the ZADD command:
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...].
+func zadd(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	var flags store.ZAddFlags
+	var ch, incr bool
+	pairs := args[2:]
+options:
+	for len(pairs) > 0 {
+		switch strings.ToUpper(pairs[0]) {
+		case "NX":
+			flags.NX = true
+		case "XX":
+			flags.XX = true
+		case "GT":
+			flags.GT = true
+		case "LT":
+			flags.LT = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+		pairs = pairs[1:]
+	}
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return
+	}
+	if flags.NX && flags.XX {
+		fmt.Fprintf(conn, "-ERR XX and NX options at the same time are not compatible\r\n")
+		return
+	}
+	if (flags.GT && flags.NX) || (flags.LT && flags.NX) || (flags.GT && flags.LT) {
+		fmt.Fprintf(conn, "-ERR GT, LT, and/or NX options at the same time are not compatible\r\n")
+		return
+	}
+	if incr && len(pairs) != 2 {
+		fmt.Fprintf(conn, "-ERR INCR option supports a single increment-element pair\r\n")
+		return
+	}
+	members := make([]store.ZMember, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, ok := parseScore(pairs[i])
+		if !ok {
+			fmt.Fprintf(conn, "-ERR value is not a valid float\r\n")
+			return
+		}
+		members = append(members, store.ZMember{Member: pairs[i+1], Score: score})
+	}
+	if incr {
+		score, ok, err := s.ZIncrByIf(args[1], members[0].Member, members[0].Score, flags)
+		if err != nil {
+			fmt.Fprintf(conn, "-%s\r\n", err)
+			return
+		}
+		if !ok {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return
+		}
+		formatted := formatScore(score)
+		writeBulk(conn, formatted)
+		LogEffects(a, "ZADD", args[1], formatted, members[0].Member)
+		return
+	}
+	added, written, err := s.ZAddIf(args[1], members, flags)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if ch {
+		fmt.Fprintf(conn, ":%d\r\n", len(written))
+	} else {
+		fmt.Fprintf(conn, ":%d\r\n", added)
+	}
+	if len(written) == 0 {
+		return
+	}
+	// Only the members actually written are persisted, as a plain ZADD, so
+	// replaying the AOF doesn't depend on the options.
+	persisted := []string{args[1]}
+	for _, m := range written {
+		persisted = append(persisted, formatScore(m.Score), m.Member)
+	}
+	LogEffects(a, "ZADD", persisted...)
+}
+
+// zscore handles the ZSCORE command.
+func zscore(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	score, ok, err := s.ZScore(args[1], args[2])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	if !ok {
+		fmt.Fprintf(conn, "$-1\r\n")
+		return
+	}
+	writeBulk(conn, formatScore(score))
+}
+
+// zmscore handles the ZMSCORE command, which replies with the score of each
+// member, or a null for members that don't exist.
+func zmscore(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	// The first lookup reports a wrong type before any of the reply is written.
+	if _, err := s.ZCard(args[1]); err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "*%d\r\n", len(args)-2)
+	for _, member := range args[2:] {
+		score, ok, _ := s.ZScore(args[1], member)
+		if !ok {
+			fmt.Fprintf(conn, "$-1\r\n")
+			continue
+		}
+		writeBulk(conn, formatScore(score))
+	}
+}
+
+// zrandmember handles ZRANDMEMBER key [count [WITHSCORES]]. Without a count
+// it replies with a single member, or a null when the key doesn't exist.
+func zrandmember(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	if len(args) == 2 {
+		members, err := s.ZRandMember(args[1], 1)
+		if err != nil {
+			fmt.Fprintf(conn, "-%s\r\n", err)
+			return
+		}
+		if len(members) == 0 {
+			fmt.Fprintf(conn, "$-1\r\n")
+			return
+		}
+		writeBulk(conn, members[0].Member)
+		return
+	}
+	count, err := strconv.Atoi(args[2])
+	if err != nil {
+		fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+		return
+	}
+	withScores := false
+	if len(args) == 4 {
+		if !strings.EqualFold(args[3], "WITHSCORES") {
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return
+		}
+		withScores = true
+	}
+	members, err := s.ZRandMember(args[1], count)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeZMembers(conn, members, withScores)
+}
+
+// zcard handles the ZCARD command.
+func zcard(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	count, err := s.ZCard(args[1])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", count)
+}
+
+// zrem handles the ZREM command.
+func zrem(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	removed, err := s.ZRem(args[1], args[2:])
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", removed)
+	if removed > 0 {
+		LogEffects(a, args[0], args[1:]...)
+	}
+}
+
+// writeZMembers writes members as an array reply, interleaving the scores
+// when withScores is set.
+func writeZMembers(conn net.Conn, members []store.ZMember, withScores bool) {
+	if withScores {
+		fmt.Fprintf(conn, "*%d\r\n", len(members)*2)
+	} else {
+		fmt.Fprintf(conn, "*%d\r\n", len(members))
+	}
+	for _, m := range members {
+		writeBulk(conn, m.Member)
+		if withScores {
+			writeBulk(conn, formatScore(m.Score))
+		}
+	}
+}
+
+// parseScoreBound parses a score range bound such as "1.5", "(1.5" or "-inf".
+func parseScoreBound(arg string) (store.ScoreBound, bool) {
+	bound := store.ScoreBound{}
+	if strings.HasPrefix(arg, "(") {
+		bound.Exclusive = true
+		arg = arg[1:]
+	}
+	score, ok := parseScore(arg)
+	bound.Value = score
+	return bound, ok
+}
+
+// parseScoreRange parses the min and max arguments of a score range command,
+// writing an error reply on bad input.
+func parseScoreRange(minArg, maxArg string, conn net.Conn) (store.ScoreBound, store.ScoreBound, bool) {
+	min, ok1 := parseScoreBound(minArg)
+	max, ok2 := parseScoreBound(maxArg)
+	if !ok1 || !ok2 {
+		fmt.Fprintf(conn, "-ERR min or max is not a float\r\n")
+		return min, max, false
+	}
+	return min, max, true
+}
+
+// parseLexBound parses a lexicographic range bound: "[a", "(a", "-" or "+".
+func parseLexBound(arg string) (store.LexBound, bool) {
+	switch {
+	case arg == "-":
+		return store.LexBound{Inf: -1}, true
+	case arg == "+":
+		return store.LexBound{Inf: 1}, true
+	case strings.HasPrefix(arg, "["):
+		return store.LexBound{Value: arg[1:]}, true
+	case strings.HasPrefix(arg, "("):
+		return store.LexBound{Value: arg[1:], Exclusive: true}, true
+	}
+	return store.LexBound{}, false
+}
+
+// parseLexRange parses the min and max arguments of a lex range command,
+// writing an error reply on bad input.
+func parseLexRange(minArg, maxArg string, conn net.Conn) (store.LexBound, store.LexBound, bool) {
+	min, ok1 := parseLexBound(minArg)
+	max, ok2 := parseLexBound(maxArg)
+	if !ok1 || !ok2 {
+		fmt.Fprintf(conn, "-ERR min or max not valid string range item\r\n")
+		return min, max, false
+	}
+	return min, max, true
+}
+
+// zrange handles the ZRANGE family:
+//
+//	ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+//	ZREVRANGE key start stop [WITHSCORES]
+//	ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+//	ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+//	ZRANGEBYLEX key min max [LIMIT offset count]
+//	ZREVRANGEBYLEX key max min [LIMIT offset count]
+//
+// Without BYSCORE or BYLEX, start and stop are ranks. In reverse score and
+// lex ranges the first bound is the maximum, as in Redis.
+func zrange(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	cmd := strings.ToUpper(args[0])
+	members, withScores, ok := zrangeMembers(cmd, args[1:], conn, s)
+	if !ok {
+		return
+	}
+	writeZMembers(conn, members, withScores)
+}
+
+// zrangestore handles the ZRANGESTORE command, which stores the result of a
+// ZRANGE in dst instead of returning it:
+//
+//	ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+//
+// It is persisted as a DEL of dst followed by a ZADD of the stored members.
+func zrangestore(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	members, _, ok := zrangeMembers("ZRANGESTORE", args[2:], conn, s)
+	if !ok {
+		return
+	}
+	s.ZReplace(args[1], members)
+	fmt.Fprintf(conn, ":%d\r\n", len(members))
+
+	LogEffects(a, "DEL", args[1])
+	if len(members) > 0 {
+		zaddArgs := make([]string, 0, 1+2*len(members))
+		zaddArgs = append(zaddArgs, args[1])
+		for _, m := range members {
+			zaddArgs = append(zaddArgs, formatScore(m.Score), m.Member)
+		}
+		LogEffects(a, "ZADD", zaddArgs...)
+	}
+}
+
+// zrangeMembers runs the range query of a ZRANGE family command. args starts
+// at the source key: key, the two bounds, then the options cmd accepts. It
+// writes an error reply and returns false on bad input.
+func zrangeMembers(cmd string, args []string, conn net.Conn, s *store.Store) ([]store.ZMember, bool, bool) {
+	rev := strings.HasPrefix(cmd, "ZREV")
+	byScore := strings.HasSuffix(cmd, "BYSCORE")
+	byLex := strings.HasSuffix(cmd, "BYLEX")
+	generic := cmd == "ZRANGE" || cmd == "ZRANGESTORE"
+	withScores, limited := false, false
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "WITHSCORES" && !byLex && cmd != "ZRANGESTORE":
+			withScores = true
+		case opt == "REV" && generic:
+			rev = true
+		case opt == "BYSCORE" && generic:
+			byScore = true
+		case opt == "BYLEX" && generic:
+			byLex = true
+		case opt == "LIMIT" && cmd != "ZREVRANGE" && i+2 < len(args):
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1])
+			count, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+				return nil, false, false
+			}
+			limited = true
+			i += 2
+		default:
+			fmt.Fprintf(conn, "-ERR syntax error\r\n")
+			return nil, false, false
+		}
+	}
+	if byScore && byLex {
+		fmt.Fprintf(conn, "-ERR syntax error\r\n")
+		return nil, false, false
+	}
+	if byLex && withScores {
+		fmt.Fprintf(conn, "-ERR syntax error, WITHSCORES not supported in combination with BYLEX\r\n")
+		return nil, false, false
+	}
+
+	minArg, maxArg := args[1], args[2]
+	if rev {
+		minArg, maxArg = maxArg, minArg
+	}
+	var members []store.ZMember
+	var err error
+	switch {
+	case byScore:
+		min, max, ok := parseScoreRange(minArg, maxArg, conn)
+		if !ok {
+			return nil, false, false
+		}
+		members, err = s.ZRangeByScore(args[0], min, max, rev, offset, count)
+	case byLex:
+		min, max, ok := parseLexRange(minArg, maxArg, conn)
+		if !ok {
+			return nil, false, false
+		}
+		members, err = s.ZRangeByLex(args[0], min, max, rev, offset, count)
+	default:
+		if limited {
+			fmt.Fprintf(conn, "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n")
+			return nil, false, false
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			fmt.Fprintf(conn, "-ERR value is not an integer or out of range\r\n")
+			return nil, false, false
+		}
+		members, err = s.ZRange(args[0], start, stop, rev)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return nil, false, false
+	}
+	return members, withScores, true
+}
+
+// zcount handles the ZCOUNT command.
+func zcount(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	min, max, ok := parseScoreRange(args[2], args[3], conn)
+	if !ok {
+		return
+	}
+	count, err := s.ZCount(args[1], min, max)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", count)
+}
+
+// zremrangebyscore handles the ZREMRANGEBYSCORE command. The removal is
+// persisted as a ZREM of the members actually removed.
+func zremrangebyscore(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	min, max, ok := parseScoreRange(args[2], args[3], conn)
+	if !ok {
+		return
+	}
+	removed, err := s.ZRemRangeByScore(args[1], min, max)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", len(removed))
+	if len(removed) > 0 {
+		LogEffects(a, "ZREM", append([]string{args[1]}, removed...)...)
+	}
+}
+
+// zlexcount handles the ZLEXCOUNT command.
+func zlexcount(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	min, max, ok := parseLexRange(args[2], args[3], conn)
+	if !ok {
+		return
+	}
+	count, err := s.ZLexCount(args[1], min, max)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", count)
+}
+
+// zremrangebylex handles the ZREMRANGEBYLEX command. Like ZREMRANGEBYSCORE,
+// the removal is persisted as a ZREM of the members actually removed.
+func zremrangebylex(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	min, max, ok := parseLexRange(args[2], args[3], conn)
+	if !ok {
+		return
+	}
+	removed, err := s.ZRemRangeByLex(args[1], min, max)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(conn, ":%d\r\n", len(removed))
+	if len(removed) > 0 {
+		LogEffects(a, "ZREM", append([]string{args[1]}, removed...)...)
+	}
+}
+
+// zrank handles ZRANK and ZREVRANK key member [WITHSCORE].
+func zrank(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	withScore := len(args) == 4
+	rank, score, ok, err := s.ZRank(args[1], args[2], strings.EqualFold(args[0], "ZREVRANK"))
+	switch {
+	case err != nil:
+		fmt.Fprintf(conn, "-%s\r\n", err)
+	case !ok && withScore:
+		fmt.Fprintf(conn, "*-1\r\n")
+	case !ok:
+		fmt.Fprintf(conn, "$-1\r\n")
+	case withScore:
+		fmt.Fprintf(conn, "*2\r\n:%d\r\n", rank)
+		writeBulk(conn, formatScore(score))
+	default:
+		fmt.Fprintf(conn, ":%d\r\n", rank)
+	}
+}
+
+// zincrby handles the ZINCRBY command. It is persisted as a ZADD of the
+// resulting score, so replaying the AOF doesn't depend on float rounding.
+func zincrby(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	incr, ok := parseScore(args[2])
+	if !ok {
+		fmt.Fprintf(conn, "-ERR value is not a valid float\r\n")
+		return
+	}
+	score, err := s.ZIncrBy(args[1], args[3], incr)
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	formatted := formatScore(score)
+	writeBulk(conn, formatted)
+	LogEffects(a, "ZADD", args[1], formatted, args[3])
+}
+
+// zpop handles ZPOPMIN and ZPOPMAX, which remove and return the members with
+// the lowest or highest scores. The pops are persisted as a ZREM.
+func zpop(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	name := strings.ToLower(args[0])
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			fmt.Fprintf(conn, "-ERR value is out of range, must be positive\r\n")
+			return
+		}
+		count = n
+	}
+	popped, err := s.ZPop(args[1], count, name == "zpopmax")
+	if err != nil {
+		fmt.Fprintf(conn, "-%s\r\n", err)
+		return
+	}
+	writeZMembers(conn, popped, true)
+	persistZPop(a, args[1], popped)
+}
+
+// persistZPop writes the members a pop removed from key to the AOF.
+func persistZPop(a *aof.AOF, key string, popped []store.ZMember) {
+	if len(popped) == 0 {
+		return
+	}
+	members := make([]string, len(popped))
+	for i, m := range popped {
+		members[i] = m.Member
+	}
+	LogEffects(a, "ZREM", append([]string{key}, members...)...)
+}
+
+// bzpop handles BZPOPMIN and BZPOPMAX, the blocking variants of ZPOPMIN and
+// ZPOPMAX. It pops from the first non-empty key and replies with the key, the
+// member and its score; when every key is empty, it waits for one to be
+// written to, or replies with a null array once the timeout passes.
+func bzpop(args []string, conn net.Conn, s *store.Store, a *aof.AOF) {
+	name := strings.ToLower(args[0])
+	keys := args[1 : len(args)-1]
+	timeout, ok := parseTimeout(args[len(args)-1])
+	if !ok {
+		fmt.Fprintf(conn, "-ERR timeout is not a float or out of range\r\n")
+		return
+	}
+	c := clientOf(conn)
+	try := func() bool {
+		for _, key := range keys {
+			popped, err := s.ZPop(key, 1, name == "bzpopmax")
+			if err != nil {
+				fmt.Fprintf(conn, "-%s\r\n", err)
+				return true
+			}
+			if len(popped) == 0 {
+				continue
+			}
+			reply := key
+			if c != nil {
+				reply = strings.TrimPrefix(key, c.namespace())
+			}
+			fmt.Fprintf(conn, "*3\r\n")
+			writeBulk(conn, reply)
+			writeBulk(conn, popped[0].Member)
+			writeBulk(conn, formatScore(popped[0].Score))
+			persistZPop(a, key, popped)
+			return true
+		}
+		return false
+	}
+	if try() {
+		return
+	}
+	block(c, keys, timeout, try, func() {
+		fmt.Fprintf(conn, "*-1\r\n")
+	})
+}
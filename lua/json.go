@@ -0,0 +1,311 @@
+package lua
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxJSONDepth bounds the nesting of tables encoded and documents decoded.
+const maxJSONDepth = 1000
+
+// openJSON opens cjson, with the encode and decode that Redis scripts use.
+func openJSON(L *State) {
+	lib(L, "cjson", map[string]GoFunction{
+		"encode": func(L *State, args []Value) []Value {
+			if len(args) != 1 {
+				L.Errorf("bad argument #1 to 'encode' (expected 1 argument)")
+			}
+			var b strings.Builder
+			encodeJSON(L, &b, args[0], 0)
+			return []Value{b.String()}
+		},
+		"decode": func(L *State, args []Value) []Value {
+			d := &jsonDecoder{L: L, s: L.CheckString(args, 1, "decode")}
+			d.space()
+			v := d.value(0)
+			d.space()
+			if d.pos < len(d.s) {
+				d.errorf("the end of the document")
+			}
+			return []Value{v}
+		},
+	})
+}
+
+// encodeJSON writes v as JSON. Tables whose keys are all positive integers
+// are arrays, with nulls for the missing elements; the others are objects.
+// An empty table is an object, as cjson encodes it.
+func encodeJSON(L *State, b *strings.Builder, v Value, depth int) {
+	if depth > maxJSONDepth {
+		L.Errorf("Cannot serialise, excessive nesting (%d)", depth)
+	}
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			L.Errorf("Cannot serialise number: must not be NaN or Inf")
+		}
+		b.WriteString(FormatNumber(v))
+	case string:
+		encodeJSONString(b, v)
+	case *Table:
+		if n, ok := jsonArrayLength(v); ok && n > 0 {
+			b.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					b.WriteByte(',')
+				}
+				encodeJSON(L, b, v.Get(float64(i)), depth+1)
+			}
+			b.WriteByte(']')
+			return
+		}
+		b.WriteByte('{')
+		first := true
+		for k, val, _ := v.Next(nil); k != nil; k, val, _ = v.Next(k) {
+			if !first {
+				b.WriteByte(',')
+			}
+			first = false
+			switch k := k.(type) {
+			case string:
+				encodeJSONString(b, k)
+			case float64:
+				encodeJSONString(b, FormatNumber(k))
+			default:
+				L.Errorf("Cannot serialise %s: table key must be a number or string", TypeName(k))
+			}
+			b.WriteByte(':')
+			encodeJSON(L, b, val, depth+1)
+		}
+		b.WriteByte('}')
+	default:
+		L.Errorf("Cannot serialise %s: type not supported", TypeName(v))
+	}
+}
+
+// jsonArrayLength returns the largest key of t if all its keys are
+// positive integers.
+func jsonArrayLength(t *Table) (int, bool) {
+	n := 0
+	for k, _, _ := t.Next(nil); k != nil; k, _, _ = t.Next(k) {
+		i, ok := arrayIndex(k)
+		if !ok {
+			return 0, false
+		}
+		n = max(n, i)
+	}
+	return n, true
+}
+
+func encodeJSONString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '/':
+			b.WriteString(`\/`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				b.WriteString(`\u00`)
+				b.WriteByte("0123456789abcdef"[c>>4])
+				b.WriteByte("0123456789abcdef"[c&15])
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// jsonDecoder decodes a JSON document into Lua values: objects and arrays
+// to tables, and null to nil.
+type jsonDecoder struct {
+	L   *State
+	s   string
+	pos int
+}
+
+func (d *jsonDecoder) errorf(expected string) {
+	if d.pos >= len(d.s) {
+		d.L.Errorf("Expected %s but found T_END at character %d", expected, d.pos+1)
+	}
+	d.L.Errorf("Expected %s but found invalid token at character %d", expected, d.pos+1)
+}
+
+func (d *jsonDecoder) space() {
+	for d.pos < len(d.s) && strings.IndexByte(" \t\r\n", d.s[d.pos]) >= 0 {
+		d.pos++
+	}
+}
+
+func (d *jsonDecoder) value(depth int) Value {
+	if depth > maxJSONDepth {
+		d.L.Errorf("Found too many nested data structures (%d) at character %d", depth, d.pos+1)
+	}
+	if d.pos >= len(d.s) {
+		d.errorf("value")
+	}
+	switch c := d.s[d.pos]; {
+	case c == '{':
+		d.pos++
+		t := NewTable()
+		d.space()
+		if d.pos < len(d.s) && d.s[d.pos] == '}' {
+			d.pos++
+			return t
+		}
+		for {
+			d.space()
+			if d.pos >= len(d.s) || d.s[d.pos] != '"' {
+				d.errorf("object key string")
+			}
+			key := d.string()
+			d.space()
+			if d.pos >= len(d.s) || d.s[d.pos] != ':' {
+				d.errorf("colon")
+			}
+			d.pos++
+			d.space()
+			t.Set(key, d.value(depth+1))
+			d.space()
+			if d.pos < len(d.s) && d.s[d.pos] == ',' {
+				d.pos++
+				continue
+			}
+			if d.pos < len(d.s) && d.s[d.pos] == '}' {
+				d.pos++
+				return t
+			}
+			d.errorf("comma or object end")
+		}
+	case c == '[':
+		d.pos++
+		t := NewTable()
+		d.space()
+		if d.pos < len(d.s) && d.s[d.pos] == ']' {
+			d.pos++
+			return t
+		}
+		for i := 1; ; i++ {
+			d.space()
+			if v := d.value(depth + 1); v != nil {
+				t.Set(float64(i), v)
+			}
+			d.space()
+			if d.pos < len(d.s) && d.s[d.pos] == ',' {
+				d.pos++
+				continue
+			}
+			if d.pos < len(d.s) && d.s[d.pos] == ']' {
+				d.pos++
+				return t
+			}
+			d.errorf("comma or array end")
+		}
+	case c == '"':
+		return d.string()
+	case c == '-' || isDigit(c):
+		start := d.pos
+		for d.pos < len(d.s) && strings.IndexByte("+-.eE0123456789", d.s[d.pos]) >= 0 {
+			d.pos++
+		}
+		n, err := strconv.ParseFloat(d.s[start:d.pos], 64)
+		if err != nil {
+			d.pos = start
+			d.errorf("value")
+		}
+		return n
+	case strings.HasPrefix(d.s[d.pos:], "true"):
+		d.pos += 4
+		return true
+	case strings.HasPrefix(d.s[d.pos:], "false"):
+		d.pos += 5
+		return false
+	case strings.HasPrefix(d.s[d.pos:], "null"):
+		d.pos += 4
+		return nil
+	}
+	d.errorf("value")
+	return nil
+}
+
+// string decodes the string starting at the quote at d.pos.
+func (d *jsonDecoder) string() string {
+	d.pos++
+	var b strings.Builder
+	for {
+		if d.pos >= len(d.s) {
+			d.errorf("string end")
+		}
+		c := d.s[d.pos]
+		d.pos++
+		switch c {
+		case '"':
+			return b.String()
+		case '\\':
+			if d.pos >= len(d.s) {
+				d.errorf("escape")
+			}
+			e := d.s[d.pos]
+			d.pos++
+			switch e {
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				r := d.hex4()
+				if r >= 0xd800 && r < 0xdc00 && strings.HasPrefix(d.s[d.pos:], `\u`) {
+					d.pos += 2
+					lo := d.hex4()
+					r = 0x10000 + (r-0xd800)<<10 + (lo - 0xdc00)
+				}
+				b.WriteString(string(utf8.AppendRune(nil, r)))
+			default:
+				d.pos -= 2
+				d.errorf("valid escape")
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (d *jsonDecoder) hex4() rune {
+	if d.pos+4 > len(d.s) {
+		d.errorf("unicode escape")
+	}
+	n, err := strconv.ParseUint(d.s[d.pos:d.pos+4], 16, 32)
+	if err != nil {
+		d.errorf("unicode escape")
+	}
+	d.pos += 4
+	return rune(n)
+}
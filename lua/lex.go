@@ -0,0 +1,281 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Token kinds. Keywords and operators are tokens of kind tokOp whose text is
+// the keyword or operator.
+const (
+	tokEOF = iota
+	tokName
+	tokString
+	tokNumber
+	tokOp
+)
+
+// token is a lexical token of a chunk.
+type token struct {
+	kind int
+	text string
+	num  float64
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// lexer splits a chunk into tokens.
+type lexer struct {
+	chunk string
+	src   string
+	pos   int
+	line  int
+}
+
+// errorf raises a syntax error at the current line.
+func (lx *lexer) errorf(format string, args ...any) {
+	panic(&Error{Value: fmt.Sprintf("%s:%d: %s", lx.chunk, lx.line, fmt.Sprintf(format, args...))})
+}
+
+func (lx *lexer) peekByte(off int) byte {
+	if lx.pos+off < len(lx.src) {
+		return lx.src[lx.pos+off]
+	}
+	return 0
+}
+
+// next returns the next token.
+func (lx *lexer) next() token {
+	lx.skipSpace()
+	if lx.pos >= len(lx.src) {
+		return token{kind: tokEOF, line: lx.line}
+	}
+	line := lx.line
+	c := lx.src[lx.pos]
+	switch {
+	case isAlpha(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && (isAlpha(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		word := lx.src[start:lx.pos]
+		if keywords[word] {
+			return token{kind: tokOp, text: word, line: line}
+		}
+		return token{kind: tokName, text: word, line: line}
+	case isDigit(c) || c == '.' && isDigit(lx.peekByte(1)):
+		return token{kind: tokNumber, num: lx.number(), line: line}
+	case c == '"' || c == '\'':
+		return token{kind: tokString, text: lx.quoted(c), line: line}
+	case c == '[' && (lx.peekByte(1) == '[' || lx.peekByte(1) == '='):
+		if s, ok := lx.long(); ok {
+			return token{kind: tokString, text: s, line: line}
+		}
+	}
+	for _, op := range []string{"...", "..", "==", "~=", "<=", ">=", "::"} {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			return token{kind: tokOp, text: op, line: line}
+		}
+	}
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", c) < 0 {
+		lx.errorf("unexpected symbol near '%c'", c)
+	}
+	lx.pos++
+	return token{kind: tokOp, text: string(c), line: line}
+}
+
+// skipSpace skips whitespace and comments.
+func (lx *lexer) skipSpace() {
+	for lx.pos < len(lx.src) {
+		switch c := lx.src[lx.pos]; {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case c == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if lx.peekByte(0) == '[' {
+				if _, ok := lx.long(); ok {
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		case c == '#' && lx.pos == 0:
+			// A first line starting with # is a shebang, such as the
+			// "#!lua name=mylib" of function libraries.
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// long reads a long string or comment, [[...]] or [==[...]==], reporting
+// false without consuming anything if the bracket doesn't open one.
+func (lx *lexer) long() (string, bool) {
+	level := 0
+	for lx.peekByte(1+level) == '=' {
+		level++
+	}
+	if lx.peekByte(1+level) != '[' {
+		return "", false
+	}
+	lx.pos += level + 2
+	// A newline right after the opening bracket is skipped.
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.line++
+		lx.pos++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf("unfinished long string")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, true
+}
+
+// quoted reads a string between quote characters, with its escapes.
+func (lx *lexer) quoted(quote byte) string {
+	start := lx.pos
+	lx.pos++
+	var b strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			lx.errorf("unfinished string near '%s'", lx.src[start:])
+		}
+		c := lx.src[lx.pos]
+		switch c {
+		case quote:
+			lx.pos++
+			return b.String()
+		case '\n':
+			lx.errorf("unfinished string near '%s'", lx.src[start:lx.pos])
+		case '\\':
+			lx.pos++
+			b.WriteString(lx.escape())
+			continue
+		}
+		b.WriteByte(c)
+		lx.pos++
+	}
+}
+
+// escape reads the escape sequence following a backslash.
+func (lx *lexer) escape() string {
+	c := lx.peekByte(0)
+	lx.pos++
+	switch c {
+	case 'n':
+		return "\n"
+	case 't':
+		return "\t"
+	case 'r':
+		return "\r"
+	case 'a':
+		return "\a"
+	case 'b':
+		return "\b"
+	case 'f':
+		return "\f"
+	case 'v':
+		return "\v"
+	case '\\', '"', '\'':
+		return string(c)
+	case '\n':
+		lx.line++
+		return "\n"
+	case 'x':
+		if lx.pos+2 <= len(lx.src) {
+			if n, err := strconv.ParseUint(lx.src[lx.pos:lx.pos+2], 16, 8); err == nil {
+				lx.pos += 2
+				return string([]byte{byte(n)})
+			}
+		}
+		lx.errorf("hexadecimal digit expected")
+	case 'z':
+		for lx.pos < len(lx.src) && strings.IndexByte(" \t\r\n\f\v", lx.src[lx.pos]) >= 0 {
+			if lx.src[lx.pos] == '\n' {
+				lx.line++
+			}
+			lx.pos++
+		}
+		return ""
+	}
+	if isDigit(c) {
+		n := int(c - '0')
+		for i := 0; i < 2 && isDigit(lx.peekByte(0)); i++ {
+			n = 10*n + int(lx.peekByte(0)-'0')
+			lx.pos++
+		}
+		if n > 255 {
+			lx.errorf("escape sequence too large")
+		}
+		return string([]byte{byte(n)})
+	}
+	lx.errorf("invalid escape sequence '\\%c'", c)
+	return ""
+}
+
+// number reads a numeral.
+func (lx *lexer) number() float64 {
+	start := lx.pos
+	if lx.src[lx.pos] == '0' && (lx.peekByte(1) == 'x' || lx.peekByte(1) == 'X') {
+		lx.pos += 2
+		for lx.pos < len(lx.src) && isHex(lx.src[lx.pos]) {
+			lx.pos++
+		}
+	} else {
+		for lx.pos < len(lx.src) {
+			c := lx.src[lx.pos]
+			if (c == '+' || c == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') {
+				lx.pos++
+				continue
+			}
+			if !isDigit(c) && c != '.' && c != 'e' && c != 'E' {
+				break
+			}
+			lx.pos++
+		}
+	}
+	// A numeral running into letters, like 3x, is malformed.
+	for lx.pos < len(lx.src) && (isAlpha(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+		lx.pos++
+	}
+	n, ok := parseNumber(lx.src[start:lx.pos])
+	if !ok {
+		lx.errorf("malformed number near '%s'", lx.src[start:lx.pos])
+	}
+	return n
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
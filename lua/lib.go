@@ -0,0 +1,439 @@
+package lua
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lib sets the functions of a library table, or of the globals if name is
+// empty.
+func lib(L *State, name string, funcs map[string]GoFunction) *Table {
+	t := L.Globals
+	if name != "" {
+		t = NewTable()
+		L.Globals.Set(name, t)
+	}
+	for fname, fn := range funcs {
+		t.Set(fname, NewFunction(fname, fn))
+	}
+	return t
+}
+
+func openBase(L *State) {
+	lib(L, "", map[string]GoFunction{
+		"assert": func(L *State, args []Value) []Value {
+			if len(args) == 0 || !Truthy(args[0]) {
+				if len(args) > 1 {
+					L.Errorf("%s", L.CheckString(args, 2, "assert"))
+				}
+				L.Errorf("assertion failed!")
+			}
+			return args
+		},
+		"error": func(L *State, args []Value) []Value {
+			v := arg(args, 1)
+			if s, ok := v.(string); ok && L.optInt(args, 2, "error", 1) > 0 {
+				v = L.where + s
+			}
+			panic(&Error{Value: v})
+		},
+		"pcall": func(L *State, args []Value) []Value {
+			if len(args) == 0 {
+				L.ArgError(1, "pcall", "value expected")
+			}
+			results, err := L.protect(args[0], args[1:])
+			if err != nil {
+				return []Value{false, err.Value}
+			}
+			return append([]Value{true}, results...)
+		},
+		"xpcall": func(L *State, args []Value) []Value {
+			results, err := L.protect(arg(args, 1), nil)
+			if err != nil {
+				return append([]Value{false}, L.call(arg(args, 2), []Value{err.Value})...)
+			}
+			return append([]Value{true}, results...)
+		},
+		"select": func(L *State, args []Value) []Value {
+			if s, ok := arg(args, 1).(string); ok && s == "#" {
+				return []Value{float64(len(args) - 1)}
+			}
+			n := L.CheckInt(args, 1, "select")
+			switch {
+			case n < 0:
+				n += len(args)
+				if n < 1 {
+					L.ArgError(1, "select", "index out of range")
+				}
+			case n == 0:
+				L.ArgError(1, "select", "index out of range")
+			case n >= len(args):
+				return nil
+			}
+			return args[n:]
+		},
+		"type": func(L *State, args []Value) []Value {
+			if len(args) == 0 {
+				L.ArgError(1, "type", "value expected")
+			}
+			return []Value{TypeName(args[0])}
+		},
+		"tostring": func(L *State, args []Value) []Value {
+			if len(args) == 0 {
+				L.ArgError(1, "tostring", "value expected")
+			}
+			return []Value{tostring(args[0])}
+		},
+		"tonumber": func(L *State, args []Value) []Value {
+			base := L.optInt(args, 2, "tonumber", 10)
+			if base == 10 {
+				if n, ok := ToNumber(arg(args, 1)); ok {
+					return []Value{n}
+				}
+				return []Value{nil}
+			}
+			if base < 2 || base > 36 {
+				L.ArgError(2, "tonumber", "base out of range")
+			}
+			s := strings.ToLower(strings.TrimSpace(L.CheckString(args, 1, "tonumber")))
+			n, err := strconv.ParseInt(s, base, 64)
+			if err != nil {
+				return []Value{nil}
+			}
+			return []Value{float64(n)}
+		},
+		"ipairs": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "ipairs")
+			iter := NewFunction("ipairs_iterator", func(L *State, args []Value) []Value {
+				i := L.CheckNumber(args, 2, "ipairs_iterator") + 1
+				v := t.Get(i)
+				if v == nil {
+					return []Value{nil}
+				}
+				return []Value{i, v}
+			})
+			return []Value{iter, t, 0.0}
+		},
+		"pairs": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "pairs")
+			return []Value{L.Globals.Get("next"), t, nil}
+		},
+		"next": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "next")
+			k, v, ok := t.Next(arg(args, 2))
+			if !ok {
+				L.Errorf("invalid key to 'next'")
+			}
+			if k == nil {
+				return []Value{nil}
+			}
+			return []Value{k, v}
+		},
+		"rawget": func(L *State, args []Value) []Value {
+			return []Value{L.CheckTable(args, 1, "rawget").Get(arg(args, 2))}
+		},
+		"rawset": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "rawset")
+			L.setIndex(t, arg(args, 2), arg(args, 3))
+			return []Value{t}
+		},
+		"rawequal": func(L *State, args []Value) []Value {
+			return []Value{rawEqual(arg(args, 1), arg(args, 2))}
+		},
+		"unpack": unpack,
+	})
+}
+
+// protect calls fn, returning the error it raised rather than raising it.
+// Running past the deadline can't be caught.
+func (L *State) protect(fn Value, args []Value) (results []Value, err *Error) {
+	where := L.where
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok || e == errTimeout {
+				panic(r)
+			}
+			L.where = where
+			err = e
+		}
+	}()
+	return L.call(fn, args), nil
+}
+
+// unpack returns the elements of a table, from i to j.
+func unpack(L *State, args []Value) []Value {
+	t := L.CheckTable(args, 1, "unpack")
+	i := L.optInt(args, 2, "unpack", 1)
+	j := L.optInt(args, 3, "unpack", t.Len())
+	if i > j {
+		return nil
+	}
+	if j-i >= 1<<20 {
+		L.Errorf("too many results to unpack")
+	}
+	values := make([]Value, 0, j-i+1)
+	for ; i <= j; i++ {
+		values = append(values, t.Get(float64(i)))
+	}
+	return values
+}
+
+// maxStringSize bounds the strings string.rep and table.concat build, as
+// Redis bounds the strings it stores.
+const maxStringSize = 512 << 20
+
+// strIndex converts a Lua string index, which counts from 1 or from the end
+// if negative, to an offset in a string of length n.
+func strIndex(i, n int) int {
+	if i < 0 {
+		i += n + 1
+	}
+	return i
+}
+
+func openString(L *State) {
+	lib(L, "string", map[string]GoFunction{
+		"len": func(L *State, args []Value) []Value {
+			return []Value{float64(len(L.CheckString(args, 1, "len")))}
+		},
+		"sub": func(L *State, args []Value) []Value {
+			s := L.CheckString(args, 1, "sub")
+			i := max(strIndex(L.optInt(args, 2, "sub", 1), len(s)), 1)
+			j := min(strIndex(L.optInt(args, 3, "sub", -1), len(s)), len(s))
+			if i > j {
+				return []Value{""}
+			}
+			return []Value{s[i-1 : j]}
+		},
+		"upper": func(L *State, args []Value) []Value {
+			return []Value{strings.ToUpper(L.CheckString(args, 1, "upper"))}
+		},
+		"lower": func(L *State, args []Value) []Value {
+			return []Value{strings.ToLower(L.CheckString(args, 1, "lower"))}
+		},
+		"rep": func(L *State, args []Value) []Value {
+			s := L.CheckString(args, 1, "rep")
+			n := L.CheckInt(args, 2, "rep")
+			sep := ""
+			if len(args) > 2 {
+				sep = L.CheckString(args, 3, "rep")
+			}
+			if n <= 0 {
+				return []Value{""}
+			}
+			if (len(s)+len(sep))*n > maxStringSize {
+				L.Errorf("resulting string too large")
+			}
+			return []Value{strings.Repeat(s+sep, n-1) + s}
+		},
+		"reverse": func(L *State, args []Value) []Value {
+			b := []byte(L.CheckString(args, 1, "reverse"))
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			return []Value{string(b)}
+		},
+		"byte": func(L *State, args []Value) []Value {
+			s := L.CheckString(args, 1, "byte")
+			i := max(strIndex(L.optInt(args, 2, "byte", 1), len(s)), 1)
+			j := min(strIndex(L.optInt(args, 3, "byte", i), len(s)), len(s))
+			var codes []Value
+			for ; i <= j; i++ {
+				codes = append(codes, float64(s[i-1]))
+			}
+			return codes
+		},
+		"char": func(L *State, args []Value) []Value {
+			b := make([]byte, len(args))
+			for i := range args {
+				c := L.CheckInt(args, i+1, "char")
+				if c < 0 || c > 255 {
+					L.ArgError(i+1, "char", "invalid value")
+				}
+				b[i] = byte(c)
+			}
+			return []Value{string(b)}
+		},
+		"format": strFormat,
+		"find": func(L *State, args []Value) []Value {
+			return strFind(L, args, "find", true)
+		},
+		"match": func(L *State, args []Value) []Value {
+			return strFind(L, args, "match", false)
+		},
+		"gmatch": strGmatch,
+		"gsub":   strGsub,
+	})
+}
+
+func openTable(L *State) {
+	lib(L, "table", map[string]GoFunction{
+		"insert": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "insert")
+			n := t.Len()
+			switch len(args) {
+			case 2:
+				t.Set(float64(n+1), args[1])
+			case 3:
+				pos := L.CheckInt(args, 2, "insert")
+				if pos < 1 || pos > n+1 {
+					L.ArgError(2, "insert", "position out of bounds")
+				}
+				for i := n; i >= pos; i-- {
+					t.Set(float64(i+1), t.Get(float64(i)))
+				}
+				t.Set(float64(pos), args[2])
+			default:
+				L.Errorf("wrong number of arguments to 'insert'")
+			}
+			return nil
+		},
+		"remove": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "remove")
+			n := t.Len()
+			pos := L.optInt(args, 2, "remove", n)
+			if n == 0 && len(args) < 2 {
+				return []Value{nil}
+			}
+			if pos < 1 || pos > n+1 {
+				L.ArgError(2, "remove", "position out of bounds")
+			}
+			v := t.Get(float64(pos))
+			for i := pos; i < n; i++ {
+				t.Set(float64(i), t.Get(float64(i+1)))
+			}
+			if pos <= n {
+				t.Set(float64(n), nil)
+			}
+			return []Value{v}
+		},
+		"concat": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "concat")
+			sep := ""
+			if len(args) > 1 && args[1] != nil {
+				sep = L.CheckString(args, 2, "concat")
+			}
+			i := L.optInt(args, 3, "concat", 1)
+			j := L.optInt(args, 4, "concat", t.Len())
+			var b strings.Builder
+			for k := i; k <= j; k++ {
+				s, ok := ToString(t.Get(float64(k)))
+				if !ok {
+					L.Errorf("invalid value (at index %d) in table for 'concat'", k)
+				}
+				b.WriteString(s)
+				if k < j {
+					b.WriteString(sep)
+				}
+				if b.Len() > maxStringSize {
+					L.Errorf("resulting string too large")
+				}
+			}
+			return []Value{b.String()}
+		},
+		"sort": func(L *State, args []Value) []Value {
+			t := L.CheckTable(args, 1, "sort")
+			less := func(a, b Value) bool { return L.less(a, b) }
+			if cmp := arg(args, 2); cmp != nil {
+				less = func(a, b Value) bool {
+					results := L.call(cmp, []Value{a, b})
+					return len(results) > 0 && Truthy(results[0])
+				}
+			}
+			n := t.Len()
+			values := make([]Value, n)
+			for i := range values {
+				values[i] = t.Get(float64(i + 1))
+			}
+			sort.SliceStable(values, func(i, j int) bool { return less(values[i], values[j]) })
+			for i, v := range values {
+				t.Set(float64(i+1), v)
+			}
+			return nil
+		},
+		"getn": func(L *State, args []Value) []Value {
+			return []Value{float64(L.CheckTable(args, 1, "getn").Len())}
+		},
+		"unpack": unpack,
+	})
+}
+
+func openMath(L *State) {
+	// Scripts get the same random numbers on every run, so their writes
+	// are the same wherever they replay.
+	rng := rand.New(rand.NewSource(0))
+	one := func(name string, fn func(float64) float64) GoFunction {
+		return func(L *State, args []Value) []Value {
+			return []Value{fn(L.CheckNumber(args, 1, name))}
+		}
+	}
+	t := lib(L, "math", map[string]GoFunction{
+		"abs":   one("abs", math.Abs),
+		"ceil":  one("ceil", math.Ceil),
+		"floor": one("floor", math.Floor),
+		"sqrt":  one("sqrt", math.Sqrt),
+		"exp":   one("exp", math.Exp),
+		"log10": one("log10", math.Log10),
+		"sin":   one("sin", math.Sin),
+		"cos":   one("cos", math.Cos),
+		"tan":   one("tan", math.Tan),
+		"log": func(L *State, args []Value) []Value {
+			x := L.CheckNumber(args, 1, "log")
+			if len(args) > 1 {
+				return []Value{math.Log(x) / math.Log(L.CheckNumber(args, 2, "log"))}
+			}
+			return []Value{math.Log(x)}
+		},
+		"pow": func(L *State, args []Value) []Value {
+			return []Value{math.Pow(L.CheckNumber(args, 1, "pow"), L.CheckNumber(args, 2, "pow"))}
+		},
+		"fmod": func(L *State, args []Value) []Value {
+			return []Value{math.Mod(L.CheckNumber(args, 1, "fmod"), L.CheckNumber(args, 2, "fmod"))}
+		},
+		"modf": func(L *State, args []Value) []Value {
+			i, f := math.Modf(L.CheckNumber(args, 1, "modf"))
+			return []Value{i, f}
+		},
+		"max": func(L *State, args []Value) []Value {
+			m := L.CheckNumber(args, 1, "max")
+			for i := 2; i <= len(args); i++ {
+				m = math.Max(m, L.CheckNumber(args, i, "max"))
+			}
+			return []Value{m}
+		},
+		"min": func(L *State, args []Value) []Value {
+			m := L.CheckNumber(args, 1, "min")
+			for i := 2; i <= len(args); i++ {
+				m = math.Min(m, L.CheckNumber(args, i, "min"))
+			}
+			return []Value{m}
+		},
+		"random": func(L *State, args []Value) []Value {
+			switch len(args) {
+			case 0:
+				return []Value{rng.Float64()}
+			case 1:
+				m := L.CheckInt(args, 1, "random")
+				if m < 1 {
+					L.ArgError(1, "random", "interval is empty")
+				}
+				return []Value{float64(1 + rng.Intn(m))}
+			}
+			m, n := L.CheckInt(args, 1, "random"), L.CheckInt(args, 2, "random")
+			if m > n {
+				L.ArgError(2, "random", "interval is empty")
+			}
+			return []Value{float64(m + rng.Intn(n-m+1))}
+		},
+		"randomseed": func(L *State, args []Value) []Value {
+			rng.Seed(int64(L.CheckNumber(args, 1, "randomseed")))
+			return nil
+		},
+	})
+	t.Set("pi", math.Pi)
+	t.Set("huge", math.Inf(1))
+}
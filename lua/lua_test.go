@@ -0,0 +1,217 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// run runs chunk in a new state and returns its results as tostring would
+// print them, joined by spaces.
+func run(t *testing.T, chunk string) (string, error) {
+	t.Helper()
+	L := NewState()
+	fn, err := L.Load(chunk, "test")
+	if err != nil {
+		return "", err
+	}
+	results, err := L.Call(fn)
+	if err != nil {
+		return "", err
+	}
+	s := make([]string, len(results))
+	for i, v := range results {
+		s[i] = tostring(v)
+	}
+	return strings.Join(s, " "), nil
+}
+
+func TestChunks(t *testing.T) {
+	tests := []struct {
+		chunk, want string
+	}{
+		// Expressions.
+		{"return 1 + 2 * 3 ^ 2, 7 % 3, -7 % 3, 10 / 4", "19 1 2 2.5"},
+		{"return 2 ^ 3 ^ 2, -2 ^ 2", "512 -4"},
+		{"return 'a' .. 1 .. 2, '10' + 5, #'abc'", "a12 15 3"},
+		{"return 1 < 2, 'a' < 'b', 1 == 1.0, 'x' ~= 'x'", "true true true false"},
+		{"return nil and 1, false or 'x', 1 and 2, not nil", "nil x 2 true"},
+		{"return 0x10, 1e2, 3.5, 1/0, -1/0", "16 100 3.5 inf -inf"},
+		{"return 2^53, 1e15, 123456789012", "9.007199254741e+15 1e+15 123456789012"},
+		{`return "a\tb\65\x41\z
+		       c", [[x]], [==[a]]b]==]`, "a\tbAAc x a]]b"},
+
+		// Statements.
+		{"local s = 0 for i = 1, 10 do s = s + i end return s", "55"},
+		{"local s = 0 for i = 10, 1, -2 do s = s + i end return s", "30"},
+		{"local t = {} for i = 1, 3 do t[i] = function() return i end end return t[1](), t[3]()", "1 3"},
+		{"local i = 0 while true do i = i + 1 if i > 4 then break end end return i", "5"},
+		{"local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", "4"},
+		{"local x = 1 do local x = 2 end return x", "1"},
+		{"local a, b, c = (function() return 1, 2, 3 end)() return a, b, c", "1 2 3"},
+		{"local a, b = 1 return a, b", "1 nil"},
+		{"local a, b = 1, 2 a, b = b, a return a, b", "2 1"},
+		{"if false then return 1 elseif nil then return 2 else return 3 end", "3"},
+
+		// Functions and closures.
+		{"local function f(n) if n < 2 then return n end return f(n-1) + f(n-2) end return f(20)", "6765"},
+		{"local function counter() local n = 0 return function() n = n + 1 return n end end local c = counter() c() return c()", "2"},
+		{"local function f(...) return select('#', ...), ... end return f(1, nil, 3)", "3 1 nil 3"},
+		{"local function f(...) local a, b = ... return b end return f(1, 2)", "2"},
+		{"local t = {n = 1} function t.add(x) return x + 1 end function t:get() return self.n end return t.add(1), t:get()", "2 1"},
+		{"return (select(2, 'a', 'b', 'c'))", "b"},
+
+		// Tables.
+		{"local t = {1, 2, 3, x = 'y', [10] = 'z'} return #t, t.x, t[10]", "3 y z"},
+		{"local t = {} t[1] = 'a' t[2] = 'b' t[2] = nil return #t", "1"},
+		{"local t = {(function() return 1, 2 end)()} return #t", "2"},
+		{"local t = {(function() return 1, 2 end)(), 3} return #t", "2"},
+		{"local n = 0 for k, v in pairs({a = 1, b = 2, 3}) do n = n + 1 end return n", "3"},
+		{"local s = '' for i, v in ipairs({'a', 'b', nil, 'd'}) do s = s .. v end return s", "ab"},
+		{"local t = {a = 1, b = 2} for k in pairs(t) do t[k] = nil end return next(t)", "nil"},
+
+		// The base library.
+		{"return type(nil), type(1), type('s'), type({}), type(print or type)", "nil number string table function"},
+		{"return tonumber('0x1F'), tonumber('  12  '), tonumber('z', 36), tonumber('1e'), tostring(12)", "31 12 35 nil 12"},
+		{"return pcall(error, 'boom', 0)", "false boom"},
+		{"return type(select(2, pcall(error, {code = 1})))", "table"},
+		{"return select(2, pcall(function() local x = nil; return x.y end))", "test:1: attempt to index local 'x' (a nil value)"},
+		{"return unpack({1, 2, 3})", "1 2 3"},
+		{"return rawequal('a', 'a'), rawget({5}, 1)", "true 5"},
+		{"return xpcall(function() error('e', 0) end, function(m) return 'handled ' .. m end)", "false handled e"},
+
+		// The string library.
+		{"return ('abc'):upper(), string.len('abc'), ('abcdef'):sub(2, -2), ('x'):rep(3)", "ABC 3 bcde xxx"},
+		{"return string.byte('A'), string.char(72, 105), ('abc'):reverse()", "65 Hi cba"},
+		{"return string.find('hello world', 'o w'), string.find('hello', 'l+')", "5 3 4"},
+		{"return string.find('a.b', '.', 1, true), string.find('abc', 'x')", "2 nil"},
+		{"return string.match('key=value', '(%w+)=(%w+)')", "key value"},
+		{"return string.match('  trim  ', '^%s*(.-)%s*$')", "trim"},
+		{"return string.match('hello', '()ll()')", "3 5"},
+		{"return string.match('f(a(b)c)', '%b()'), string.match('THE (quick) fox', '%f[%a]%a+', 5)", "(a(b)c) quick"},
+		{"return string.match('abcabc', '(abc)%1')", "abc"},
+		{"return string.gsub('hello world', 'o', '0')", "hell0 w0rld 2"},
+		{"return string.gsub('hello world', '(%w+)', '<%1>')", "<hello> <world> 2"},
+		{"return string.gsub('abc', '%w', {a = 1, b = false})", "1bc 3"},
+		{"return string.gsub('abc', '%w', function(c) return c:upper() end, 2)", "ABc 2"},
+		{"return string.gsub('abc', '', '-')", "-a-b-c- 4"},
+		{"local s = '' for w in string.gmatch('one two three', '%a+') do s = s .. w .. ',' end return s", "one,two,three,"},
+		{"local s = '' for k, v in string.gmatch('a=1, b=2', '(%w+)=(%w+)') do s = s .. k .. v end return s", "a1b2"},
+		{"return string.format('%d %5.2f %s %x %q %%', 42, 3.14159, 'hi', 255, 'a\"b')", `42  3.14 hi ff "a\"b" %`},
+		{"return string.format('%-5s|%05d|%g', 'ab', 42, 0.1)", "ab   |00042|0.1"},
+
+		// The table library.
+		{"local t = {3, 1, 2} table.sort(t) return table.concat(t, ',')", "1,2,3"},
+		{"local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return table.concat(t, ',')", "3,2,1"},
+		{"local t = {1, 2} table.insert(t, 3) table.insert(t, 1, 0) return table.concat(t, ',')", "0,1,2,3"},
+		{"local t = {1, 2, 3} return table.remove(t), table.remove(t, 1), #t", "3 1 1"},
+		{"return table.getn({1, 2}), table.concat({1, 'a', 2}, '-', 2, 3)", "2 a-2"},
+
+		// The math library.
+		{"return math.floor(3.7), math.ceil(3.2), math.max(1, 5, 3), math.min(2, 0), math.abs(-4)", "3 4 5 0 4"},
+		{"return math.fmod(7, 3), math.sqrt(16), math.huge, math.pi > 3", "1 4 inf true"},
+		{"math.randomseed(1) local r = math.random(10) return r >= 1 and r <= 10", "true"},
+
+		// cjson.
+		{"return cjson.encode({1, 2, 'x'}), cjson.encode({}), cjson.encode({a = true})", `[1,2,"x"] {} {"a":true}`},
+		{"return cjson.encode('a/b\\n')", `"a\/b\n"`},
+		{`local t = cjson.decode('{"a":[1,2,{"b":null}],"c":"\\u00e9"}') return t.a[2], #t.a, t.c`, "2 3 é"},
+	}
+	for _, tt := range tests {
+		got, err := run(t, tt.chunk)
+		if err != nil {
+			t.Errorf("%s: %v", tt.chunk, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.chunk, got, tt.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		chunk, want string
+	}{
+		{"return 1 +", "test:1: unexpected symbol near '<eof>'"},
+		{"x = = 1", "test:1: unexpected symbol near '='"},
+		{"local t = {} \n return t.x.y", "test:2: attempt to index field 'x' (a nil value)"},
+		{"return nil + 1", "test:1: attempt to perform arithmetic on a nil value"},
+		{"return {} < {}", "test:1: attempt to compare two table values"},
+		{"return 1 < 'x'", "test:1: attempt to compare number with string"},
+		{"undefined()", "test:1: attempt to call global 'undefined' (a nil value)"},
+		{"error('boom')", "test:1: boom"},
+		{"error('boom', 0)", "boom"},
+		{"string.rep()", "test:1: bad argument #1 to 'rep' (string expected, got no value)"},
+		{"local function f() return f() + 1 end return f()", "test:1: stack overflow"},
+		{"return ('x'):find('[a')", "test:1: malformed pattern (missing ']')"},
+		{"break", "test:1: no loop to break near '<eof>'"},
+		{"return 'unfinished", "test:1: unfinished string near ''unfinished'"},
+	}
+	for _, tt := range tests {
+		_, err := run(t, tt.chunk)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: error %v, want %q", tt.chunk, err, tt.want)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	L := NewState()
+	L.SetStrict(true)
+	L.Globals.Set("KEYS", NewTable())
+	for chunk, want := range map[string]string{
+		"return undefined":   "test:1: Script attempted to access nonexistent global variable 'undefined'",
+		"x = 1":              "test:1: Script attempted to create global variable 'x'",
+		"return #KEYS":       "",
+		"local x = 1 return": "",
+	} {
+		fn, err := L.Load(chunk, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = L.Call(fn)
+		if got := ""; err != nil {
+			got = err.Error()
+			if got != want {
+				t.Errorf("%s: error %q, want %q", chunk, got, want)
+			}
+		} else if want != "" {
+			t.Errorf("%s: no error, want %q", chunk, want)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	L := NewState()
+	fn, err := L.Load("while true do end", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = L.Call(fn)
+	if !IsTimeout(err) {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+	// pcall doesn't catch the timeout.
+	fn, _ = L.Load("while true do pcall(function() while true do end end) end", "test")
+	L.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = L.Call(fn); !IsTimeout(err) {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+}
+
+func TestGoFunctions(t *testing.T) {
+	L := NewState()
+	L.Register("double", func(L *State, args []Value) []Value {
+		return []Value{L.CheckNumber(args, 1, "double") * 2}
+	})
+	fn, err := L.Load("return double(21)", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := L.Call(fn)
+	if err != nil || len(results) != 1 || results[0] != 42.0 {
+		t.Fatalf("results %v, %v, want 42", results, err)
+	}
+}
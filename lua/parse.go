@@ -0,0 +1,1066 @@
+package lua
+
+import (
+	"fmt"
+)
+
+// Chunks are compiled straight into Go closures as they are parsed: each
+// statement becomes a stmtFn and each expression an exprFn, which run
+// against the frame of the function call they are part of. Local variables
+// live in cells, so the closures of nested functions can share them; a
+// local gets a new cell each time its declaration runs, which gives every
+// iteration of a loop its own variables, as in Lua.
+
+// cell holds a local variable.
+type cell struct {
+	v Value
+}
+
+// frame is the state of a call of a Lua function.
+type frame struct {
+	L       *State
+	fn      *Function
+	slots   []*cell
+	varargs []Value
+	ret     []Value
+}
+
+// ctl tells the statements enclosing a statement how it ended.
+type ctl int
+
+const (
+	ctlNone ctl = iota
+	ctlBreak
+	ctlReturn
+)
+
+type (
+	stmtFn  func(f *frame) ctl
+	exprFn  func(f *frame) Value
+	multiFn func(f *frame) []Value
+)
+
+// funcProto is a compiled function.
+type funcProto struct {
+	nparams int
+	vararg  bool
+	nslots  int
+	body    stmtFn
+}
+
+// localVar is a local variable in scope and the slot it lives in.
+type localVar struct {
+	name string
+	slot int
+}
+
+// upvalDesc says where a function finds an upvalue when it is created: in
+// a local of the enclosing function, or in an upvalue of it.
+type upvalDesc struct {
+	name      string
+	fromLocal bool
+	index     int
+}
+
+// funcState is the compile state of a function.
+type funcState struct {
+	parent  *funcState
+	actives []localVar
+	free    int
+	nslots  int
+	upvals  []upvalDesc
+	vararg  bool
+	loops   int
+}
+
+// Kinds of variables a name resolves to.
+const (
+	varGlobal = iota
+	varLocal
+	varUpval
+)
+
+// declare makes a new local variable name active and returns its slot.
+func (fs *funcState) declare(name string) int {
+	slot := fs.free
+	fs.free++
+	fs.nslots = max(fs.nslots, fs.free)
+	fs.actives = append(fs.actives, localVar{name, slot})
+	return slot
+}
+
+// resolve finds the variable name refers to in fs.
+func (fs *funcState) resolve(name string) (kind, index int) {
+	for i := len(fs.actives) - 1; i >= 0; i-- {
+		if fs.actives[i].name == name {
+			return varLocal, fs.actives[i].slot
+		}
+	}
+	for i, u := range fs.upvals {
+		if u.name == name {
+			return varUpval, i
+		}
+	}
+	if fs.parent == nil {
+		return varGlobal, 0
+	}
+	kind, index = fs.parent.resolve(name)
+	if kind == varGlobal {
+		return varGlobal, 0
+	}
+	fs.upvals = append(fs.upvals, upvalDesc{name, kind == varLocal, index})
+	return varUpval, len(fs.upvals) - 1
+}
+
+// expr is a compiled expression. Calls and ... yield several values
+// through multi; variables and fields can be assigned through set.
+type expr struct {
+	eval  exprFn
+	multi multiFn
+	set   func(f *frame, v Value)
+	// desc names the expression for error messages, like "global 'x'".
+	desc string
+}
+
+// parser compiles a chunk.
+type parser struct {
+	lx    *lexer
+	tok   token
+	ahead *token
+	fs    *funcState
+}
+
+func newParser(chunk, name string) *parser {
+	p := &parser{lx: &lexer{chunk: name, src: chunk, line: 1}}
+	p.tok = p.lx.next()
+	return p
+}
+
+// chunk compiles the whole chunk as a vararg function.
+func (p *parser) chunk() *funcProto {
+	p.fs = &funcState{vararg: true}
+	body := p.block()
+	if p.tok.kind != tokEOF {
+		p.errorf("'<eof>' expected near '%s'", p.tokText())
+	}
+	return &funcProto{vararg: true, nslots: p.fs.nslots, body: body}
+}
+
+func (p *parser) errorf(format string, args ...any) {
+	p.lx.line = p.tok.line
+	p.lx.errorf(format, args...)
+}
+
+// tokText returns the current token as error messages show it.
+func (p *parser) tokText() string {
+	switch p.tok.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return FormatNumber(p.tok.num)
+	}
+	return p.tok.text
+}
+
+func (p *parser) next() {
+	if p.ahead != nil {
+		p.tok, p.ahead = *p.ahead, nil
+		return
+	}
+	p.tok = p.lx.next()
+}
+
+func (p *parser) peek() token {
+	if p.ahead == nil {
+		t := p.lx.next()
+		p.ahead = &t
+	}
+	return *p.ahead
+}
+
+// is reports whether the current token is the keyword or operator op.
+func (p *parser) is(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+// accept skips the keyword or operator op if it is the current token.
+func (p *parser) accept(op string) bool {
+	if p.is(op) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) {
+	if !p.accept(op) {
+		p.errorf("'%s' expected near '%s'", op, p.tokText())
+	}
+}
+
+// expectMatch expects op closing what opened at line.
+func (p *parser) expectMatch(op, opened string, line int) {
+	if p.accept(op) {
+		return
+	}
+	if line == p.tok.line {
+		p.errorf("'%s' expected near '%s'", op, p.tokText())
+	}
+	p.errorf("'%s' expected (to close '%s' at line %d) near '%s'", op, opened, line, p.tokText())
+}
+
+func (p *parser) name() string {
+	if p.tok.kind != tokName {
+		p.errorf("<name> expected near '%s'", p.tokText())
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+// where returns the prefix of the errors raised at line.
+func (p *parser) where(line int) string {
+	return fmt.Sprintf("%s:%d: ", p.lx.chunk, line)
+}
+
+// blockEnd reports whether the current token ends a block.
+func (p *parser) blockEnd() bool {
+	if p.tok.kind == tokEOF {
+		return true
+	}
+	if p.tok.kind != tokOp {
+		return false
+	}
+	switch p.tok.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+// block compiles statements up to the end of a block, in a scope of its
+// own.
+func (p *parser) block() stmtFn {
+	fs := p.fs
+	actives, free := len(fs.actives), fs.free
+	stmts := p.statements()
+	fs.actives, fs.free = fs.actives[:actives], free
+	return seq(stmts)
+}
+
+// statements compiles statements up to the end of a block.
+func (p *parser) statements() []stmtFn {
+	var stmts []stmtFn
+	for !p.blockEnd() {
+		if p.is("return") {
+			stmts = append(stmts, p.retstat())
+			break
+		}
+		if s := p.statement(); s != nil {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+// seq runs stmts in order.
+func seq(stmts []stmtFn) stmtFn {
+	switch len(stmts) {
+	case 0:
+		return func(*frame) ctl { return ctlNone }
+	case 1:
+		return stmts[0]
+	}
+	return func(f *frame) ctl {
+		for _, s := range stmts {
+			if c := s(f); c != ctlNone {
+				return c
+			}
+		}
+		return ctlNone
+	}
+}
+
+// statement compiles a statement, setting the position errors report
+// before it runs.
+func (p *parser) statement() stmtFn {
+	where := p.where(p.tok.line)
+	s := p.bareStatement()
+	if s == nil {
+		return nil
+	}
+	return func(f *frame) ctl {
+		f.L.where = where
+		return s(f)
+	}
+}
+
+func (p *parser) bareStatement() stmtFn {
+	line := p.tok.line
+	switch {
+	case p.accept(";"):
+		return nil
+	case p.accept("if"):
+		return p.ifstat(line)
+	case p.accept("while"):
+		return p.whilestat(line)
+	case p.accept("do"):
+		body := p.block()
+		p.expectMatch("end", "do", line)
+		return body
+	case p.accept("for"):
+		return p.forstat(line)
+	case p.accept("repeat"):
+		return p.repeatstat(line)
+	case p.accept("function"):
+		return p.funcstat(line)
+	case p.accept("local"):
+		if p.accept("function") {
+			return p.localfunc(line)
+		}
+		return p.localstat()
+	case p.accept("break"):
+		if p.fs.loops == 0 {
+			p.errorf("no loop to break near '%s'", p.tokText())
+		}
+		return func(*frame) ctl { return ctlBreak }
+	}
+	return p.exprstat()
+}
+
+func (p *parser) ifstat(line int) stmtFn {
+	var conds []exprFn
+	var blocks []stmtFn
+	cond := p.expr().single()
+	p.expect("then")
+	conds, blocks = append(conds, cond), append(blocks, p.block())
+	var otherwise stmtFn
+	for {
+		if p.accept("elseif") {
+			cond := p.expr().single()
+			p.expect("then")
+			conds, blocks = append(conds, cond), append(blocks, p.block())
+			continue
+		}
+		if p.accept("else") {
+			otherwise = p.block()
+		}
+		break
+	}
+	p.expectMatch("end", "if", line)
+	return func(f *frame) ctl {
+		for i, cond := range conds {
+			if Truthy(cond(f)) {
+				return blocks[i](f)
+			}
+		}
+		if otherwise != nil {
+			return otherwise(f)
+		}
+		return ctlNone
+	}
+}
+
+// loopBody compiles the block of a loop.
+func (p *parser) loopBody() stmtFn {
+	p.fs.loops++
+	body := p.block()
+	p.fs.loops--
+	return body
+}
+
+func (p *parser) whilestat(line int) stmtFn {
+	cond := p.expr().single()
+	p.expect("do")
+	body := p.loopBody()
+	p.expectMatch("end", "while", line)
+	return func(f *frame) ctl {
+		for Truthy(cond(f)) {
+			f.L.step()
+			switch body(f) {
+			case ctlBreak:
+				return ctlNone
+			case ctlReturn:
+				return ctlReturn
+			}
+		}
+		return ctlNone
+	}
+}
+
+func (p *parser) repeatstat(line int) stmtFn {
+	// The condition sees the locals of the body.
+	fs := p.fs
+	actives, free := len(fs.actives), fs.free
+	fs.loops++
+	body := seq(p.statements())
+	fs.loops--
+	p.expectMatch("until", "repeat", line)
+	cond := p.expr().single()
+	fs.actives, fs.free = fs.actives[:actives], free
+	return func(f *frame) ctl {
+		for {
+			f.L.step()
+			switch body(f) {
+			case ctlBreak:
+				return ctlNone
+			case ctlReturn:
+				return ctlReturn
+			}
+			if Truthy(cond(f)) {
+				return ctlNone
+			}
+		}
+	}
+}
+
+func (p *parser) forstat(line int) stmtFn {
+	first := p.name()
+	if p.is("=") {
+		return p.fornum(first, line)
+	}
+	return p.forin(first, line)
+}
+
+func (p *parser) fornum(name string, line int) stmtFn {
+	p.expect("=")
+	start := p.expr().single()
+	p.expect(",")
+	limit := p.expr().single()
+	var step exprFn
+	if p.accept(",") {
+		step = p.expr().single()
+	}
+	p.expect("do")
+	fs := p.fs
+	actives, free := len(fs.actives), fs.free
+	slot := fs.declare(name)
+	body := p.loopBody()
+	fs.actives, fs.free = fs.actives[:actives], free
+	p.expectMatch("end", "for", line)
+	return func(f *frame) ctl {
+		number := func(v Value, what string) float64 {
+			n, ok := ToNumber(v)
+			if !ok {
+				f.L.Errorf("'for' %s must be a number", what)
+			}
+			return n
+		}
+		i := number(start(f), "initial value")
+		stop := number(limit(f), "limit")
+		inc := 1.0
+		if step != nil {
+			inc = number(step(f), "step")
+		}
+		for ; inc > 0 && i <= stop || inc <= 0 && i >= stop; i += inc {
+			f.L.step()
+			f.slots[slot] = &cell{i}
+			switch body(f) {
+			case ctlBreak:
+				return ctlNone
+			case ctlReturn:
+				return ctlReturn
+			}
+		}
+		return ctlNone
+	}
+}
+
+func (p *parser) forin(first string, line int) stmtFn {
+	names := []string{first}
+	for p.accept(",") {
+		names = append(names, p.name())
+	}
+	p.expect("in")
+	exprs := p.exprList()
+	p.expect("do")
+	fs := p.fs
+	actives, free := len(fs.actives), fs.free
+	// Hidden locals hold the iterator, its state and the control
+	// variable, which the loop's variables can't be assigned to.
+	slots := make([]int, len(names))
+	for i, name := range names {
+		slots[i] = fs.declare(name)
+	}
+	body := p.loopBody()
+	fs.actives, fs.free = fs.actives[:actives], free
+	p.expectMatch("end", "for", line)
+	return func(f *frame) ctl {
+		init := adjust(evalList(f, exprs), 3)
+		fn, state, control := init[0], init[1], init[2]
+		for {
+			f.L.step()
+			results := f.L.call(fn, []Value{state, control})
+			if len(results) == 0 || results[0] == nil {
+				return ctlNone
+			}
+			control = results[0]
+			for i, slot := range slots {
+				var v Value
+				if i < len(results) {
+					v = results[i]
+				}
+				f.slots[slot] = &cell{v}
+			}
+			switch body(f) {
+			case ctlBreak:
+				return ctlNone
+			case ctlReturn:
+				return ctlReturn
+			}
+		}
+	}
+}
+
+func (p *parser) funcstat(line int) stmtFn {
+	// funcname: Name {'.' Name} [':' Name]
+	target := p.singleVar(p.name())
+	method := false
+	for p.is(".") || p.is(":") {
+		method = p.is(":")
+		p.next()
+		key := p.tok.text
+		p.name()
+		target = p.field(target, constant(key), fmt.Sprintf("field '%s'", key))
+		if method {
+			break
+		}
+	}
+	fn := p.body(method, line)
+	set := target.set
+	return func(f *frame) ctl {
+		set(f, fn(f))
+		return ctlNone
+	}
+}
+
+func (p *parser) localfunc(line int) stmtFn {
+	slot := p.fs.declare(p.name())
+	fn := p.body(false, line)
+	return func(f *frame) ctl {
+		c := &cell{}
+		f.slots[slot] = c
+		c.v = fn(f)
+		return ctlNone
+	}
+}
+
+func (p *parser) localstat() stmtFn {
+	var names []string
+	for {
+		names = append(names, p.name())
+		if !p.accept(",") {
+			break
+		}
+	}
+	var exprs []expr
+	if p.accept("=") {
+		exprs = p.exprList()
+	}
+	slots := make([]int, len(names))
+	for i, name := range names {
+		slots[i] = p.fs.declare(name)
+	}
+	return func(f *frame) ctl {
+		values := adjust(evalList(f, exprs), len(slots))
+		for i, slot := range slots {
+			f.slots[slot] = &cell{values[i]}
+		}
+		return ctlNone
+	}
+}
+
+func (p *parser) retstat() stmtFn {
+	where := p.where(p.tok.line)
+	p.next()
+	var exprs []expr
+	if !p.blockEnd() && !p.is(";") {
+		exprs = p.exprList()
+	}
+	p.accept(";")
+	if !p.blockEnd() {
+		p.errorf("'<eof>' expected near '%s'", p.tokText())
+	}
+	return func(f *frame) ctl {
+		f.L.where = where
+		f.ret = evalList(f, exprs)
+		return ctlReturn
+	}
+}
+
+// exprstat compiles an assignment or a function call.
+func (p *parser) exprstat() stmtFn {
+	e := p.suffixedExpr()
+	if p.is("=") || p.is(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.expect("=")
+		for _, t := range targets {
+			if t.set == nil {
+				p.errorf("syntax error near '%s'", p.tokText())
+			}
+		}
+		exprs := p.exprList()
+		if len(targets) == 1 && len(exprs) == 1 {
+			set, value := targets[0].set, exprs[0].single()
+			return func(f *frame) ctl {
+				set(f, value(f))
+				return ctlNone
+			}
+		}
+		return func(f *frame) ctl {
+			values := adjust(evalList(f, exprs), len(targets))
+			for i, t := range targets {
+				t.set(f, values[i])
+			}
+			return ctlNone
+		}
+	}
+	if e.multi == nil {
+		p.errorf("syntax error near '%s'", p.tokText())
+	}
+	call := e.multi
+	return func(f *frame) ctl {
+		call(f)
+		return ctlNone
+	}
+}
+
+// single returns the expression as a single value, the first of a call's.
+func (e expr) single() exprFn {
+	return e.eval
+}
+
+// exprList compiles a comma separated list of expressions.
+func (p *parser) exprList() []expr {
+	exprs := []expr{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+// evalList evaluates a list of expressions, the last of which yields all
+// its values.
+func evalList(f *frame, exprs []expr) []Value {
+	if len(exprs) == 0 {
+		return nil
+	}
+	last := exprs[len(exprs)-1]
+	values := make([]Value, 0, len(exprs))
+	for _, e := range exprs[:len(exprs)-1] {
+		values = append(values, e.eval(f))
+	}
+	if last.multi != nil {
+		return append(values, last.multi(f)...)
+	}
+	return append(values, last.eval(f))
+}
+
+// adjust pads or truncates values to n. Padding copies them, as they may
+// share their array with the values of another expression.
+func adjust(values []Value, n int) []Value {
+	if len(values) >= n {
+		return values[:n]
+	}
+	padded := make([]Value, n)
+	copy(padded, values)
+	return padded
+}
+
+// Binary operator priorities, left and right, as in Lua's parser.
+var binaryPriority = map[string][2]int{
+	"+": {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^":  {10, 9},
+	"..": {5, 4},
+	"==": {3, 3}, "~=": {3, 3}, "<": {3, 3}, "<=": {3, 3}, ">": {3, 3}, ">=": {3, 3},
+	"and": {2, 2},
+	"or":  {1, 1},
+}
+
+const unaryPriority = 8
+
+func (p *parser) expr() expr {
+	return p.subexpr(0)
+}
+
+func (p *parser) subexpr(limit int) expr {
+	var e expr
+	if p.tok.kind == tokOp && (p.tok.text == "not" || p.tok.text == "-" || p.tok.text == "#") {
+		op := p.tok.text
+		p.next()
+		e = unary(op, p.subexpr(unaryPriority).single())
+	} else {
+		e = p.simpleExpr()
+	}
+	for p.tok.kind == tokOp {
+		op := p.tok.text
+		prio, ok := binaryPriority[op]
+		if !ok || prio[0] <= limit {
+			break
+		}
+		p.next()
+		e = binary(op, e.single(), p.subexpr(prio[1]).single())
+	}
+	return e
+}
+
+func value(fn exprFn) expr {
+	return expr{eval: fn}
+}
+
+func constant(v Value) exprFn {
+	return func(*frame) Value { return v }
+}
+
+func unary(op string, x exprFn) expr {
+	switch op {
+	case "not":
+		return value(func(f *frame) Value { return !Truthy(x(f)) })
+	case "#":
+		return value(func(f *frame) Value { return f.L.length(x(f)) })
+	}
+	return value(func(f *frame) Value {
+		v := x(f)
+		if n, ok := v.(float64); ok {
+			return -n
+		}
+		n, ok := ToNumber(v)
+		if !ok {
+			f.L.Errorf("attempt to perform arithmetic on a %s value", TypeName(v))
+		}
+		return -n
+	})
+}
+
+func binary(op string, x, y exprFn) expr {
+	switch op {
+	case "and":
+		return value(func(f *frame) Value {
+			if v := x(f); !Truthy(v) {
+				return v
+			}
+			return y(f)
+		})
+	case "or":
+		return value(func(f *frame) Value {
+			if v := x(f); Truthy(v) {
+				return v
+			}
+			return y(f)
+		})
+	case "==":
+		return value(func(f *frame) Value { return rawEqual(x(f), y(f)) })
+	case "~=":
+		return value(func(f *frame) Value { return !rawEqual(x(f), y(f)) })
+	case "<":
+		return value(func(f *frame) Value { return f.L.less(x(f), y(f)) })
+	case "<=":
+		return value(func(f *frame) Value { return f.L.lessEqual(x(f), y(f)) })
+	case ">":
+		return value(func(f *frame) Value {
+			a, b := x(f), y(f)
+			return f.L.less(b, a)
+		})
+	case ">=":
+		return value(func(f *frame) Value {
+			a, b := x(f), y(f)
+			return f.L.lessEqual(b, a)
+		})
+	case "..":
+		return value(func(f *frame) Value { return f.L.concat(x(f), y(f)) })
+	case "+":
+		return value(func(f *frame) Value {
+			a, b := x(f), y(f)
+			if m, ok := a.(float64); ok {
+				if n, ok := b.(float64); ok {
+					return m + n
+				}
+			}
+			return f.L.arith(op, a, b)
+		})
+	}
+	return value(func(f *frame) Value { return f.L.arith(op, x(f), y(f)) })
+}
+
+func (p *parser) simpleExpr() expr {
+	line := p.tok.line
+	switch p.tok.kind {
+	case tokNumber:
+		n := p.tok.num
+		p.next()
+		return value(constant(n))
+	case tokString:
+		s := p.tok.text
+		p.next()
+		return value(constant(s))
+	}
+	switch {
+	case p.accept("nil"):
+		return value(constant(nil))
+	case p.accept("true"):
+		return value(constant(true))
+	case p.accept("false"):
+		return value(constant(false))
+	case p.accept("..."):
+		if !p.fs.vararg {
+			p.errorf("cannot use '...' outside a vararg function near '...'")
+		}
+		return expr{
+			eval: func(f *frame) Value {
+				if len(f.varargs) == 0 {
+					return nil
+				}
+				return f.varargs[0]
+			},
+			multi: func(f *frame) []Value { return f.varargs },
+		}
+	case p.is("{"):
+		return value(p.table())
+	case p.accept("function"):
+		return value(p.body(false, line))
+	}
+	return p.suffixedExpr()
+}
+
+// primaryExpr compiles a name or a parenthesized expression.
+func (p *parser) primaryExpr() expr {
+	if p.tok.kind == tokName {
+		return p.singleVar(p.name())
+	}
+	if p.is("(") {
+		line := p.tok.line
+		p.next()
+		e := p.expr()
+		p.expectMatch(")", "(", line)
+		// Parentheses truncate a call to its first value.
+		return value(e.single())
+	}
+	p.errorf("unexpected symbol near '%s'", p.tokText())
+	return expr{}
+}
+
+// singleVar compiles a reference to the variable name.
+func (p *parser) singleVar(name string) expr {
+	kind, index := p.fs.resolve(name)
+	switch kind {
+	case varLocal:
+		return expr{
+			eval: func(f *frame) Value { return f.slots[index].v },
+			set:  func(f *frame, v Value) { f.slots[index].v = v },
+			desc: fmt.Sprintf("local '%s'", name),
+		}
+	case varUpval:
+		return expr{
+			eval: func(f *frame) Value { return f.fn.upvals[index].v },
+			set:  func(f *frame, v Value) { f.fn.upvals[index].v = v },
+			desc: fmt.Sprintf("upvalue '%s'", name),
+		}
+	}
+	return expr{
+		eval: func(f *frame) Value { return f.L.getGlobal(name) },
+		set:  func(f *frame, v Value) { f.L.setGlobal(name, v) },
+		desc: fmt.Sprintf("global '%s'", name),
+	}
+}
+
+// field compiles obj[key].
+func (p *parser) field(obj expr, key exprFn, desc string) expr {
+	o := obj.single()
+	return expr{
+		eval: func(f *frame) Value {
+			t := o(f)
+			if _, ok := t.(*Table); !ok && obj.desc != "" {
+				if _, ok := t.(string); !ok {
+					f.L.Errorf("attempt to index %s (a %s value)", obj.desc, TypeName(t))
+				}
+			}
+			return f.L.getIndex(t, key(f))
+		},
+		set: func(f *frame, v Value) {
+			t := o(f)
+			if _, ok := t.(*Table); !ok && obj.desc != "" {
+				f.L.Errorf("attempt to index %s (a %s value)", obj.desc, TypeName(t))
+			}
+			f.L.setIndex(t, key(f), v)
+		},
+		desc: desc,
+	}
+}
+
+// suffixedExpr compiles a primary expression followed by field accesses,
+// method calls and calls.
+func (p *parser) suffixedExpr() expr {
+	e := p.primaryExpr()
+	for {
+		switch {
+		case p.is("."):
+			p.next()
+			key := p.name()
+			e = p.field(e, constant(key), fmt.Sprintf("field '%s'", key))
+		case p.is("["):
+			p.next()
+			key := p.expr().single()
+			p.expect("]")
+			e = p.field(e, key, "")
+		case p.is(":"):
+			p.next()
+			name := p.name()
+			args := p.args()
+			e = p.methodCall(e, name, args)
+		case p.is("(") || p.is("{") || p.tok.kind == tokString:
+			e = p.call(e, p.args())
+		default:
+			return e
+		}
+	}
+}
+
+// args compiles the arguments of a call.
+func (p *parser) args() []expr {
+	switch {
+	case p.tok.kind == tokString:
+		s := p.tok.text
+		p.next()
+		return []expr{value(constant(s))}
+	case p.is("{"):
+		return []expr{value(p.table())}
+	}
+	line := p.tok.line
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	args := p.exprList()
+	p.expectMatch(")", "(", line)
+	return args
+}
+
+// callResult makes a call expression from the function computing its
+// results.
+func callResult(call multiFn) expr {
+	return expr{
+		eval: func(f *frame) Value {
+			if results := call(f); len(results) > 0 {
+				return results[0]
+			}
+			return nil
+		},
+		multi: call,
+	}
+}
+
+func (p *parser) call(fnExpr expr, args []expr) expr {
+	fn, desc := fnExpr.single(), fnExpr.desc
+	return callResult(func(f *frame) []Value {
+		callee := fn(f)
+		if _, ok := callee.(*Function); !ok && desc != "" {
+			f.L.Errorf("attempt to call %s (a %s value)", desc, TypeName(callee))
+		}
+		return f.L.callFrom(callee, evalList(f, args))
+	})
+}
+
+func (p *parser) methodCall(obj expr, name string, args []expr) expr {
+	o := obj.single()
+	return callResult(func(f *frame) []Value {
+		self := o(f)
+		method := f.L.getIndex(self, name)
+		if _, ok := method.(*Function); !ok {
+			f.L.Errorf("attempt to call method '%s' (a %s value)", name, TypeName(method))
+		}
+		return f.L.callFrom(method, append([]Value{self}, evalList(f, args)...))
+	})
+}
+
+// callFrom calls fn from Lua code, keeping the position errors report for
+// the rest of the calling statement.
+func (L *State) callFrom(fn Value, args []Value) []Value {
+	where := L.where
+	results := L.call(fn, args)
+	L.where = where
+	return results
+}
+
+// table compiles a table constructor.
+func (p *parser) table() exprFn {
+	line := p.tok.line
+	p.expect("{")
+	type keyed struct{ key, value exprFn }
+	var fields []keyed
+	var items []expr
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.next()
+			key := p.expr().single()
+			p.expect("]")
+			p.expect("=")
+			fields = append(fields, keyed{key, p.expr().single()})
+		case p.tok.kind == tokName && p.peek().kind == tokOp && p.peek().text == "=":
+			key := p.name()
+			p.next()
+			fields = append(fields, keyed{constant(key), p.expr().single()})
+		default:
+			items = append(items, p.expr())
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expectMatch("}", "{", line)
+	return func(f *frame) Value {
+		t := NewTable()
+		for _, kv := range fields {
+			f.L.setIndex(t, kv.key(f), kv.value(f))
+		}
+		for i, v := range evalList(f, items) {
+			t.Set(float64(i+1), v)
+		}
+		return t
+	}
+}
+
+// body compiles the parameters and body of a function, returning the
+// expression that creates its closures.
+func (p *parser) body(method bool, line int) exprFn {
+	fs := &funcState{parent: p.fs}
+	p.fs = fs
+	if method {
+		fs.declare("self")
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				fs.vararg = true
+				break
+			}
+			fs.declare(p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	nparams := len(fs.actives)
+	body := p.block()
+	p.expectMatch("end", "function", line)
+	p.fs = fs.parent
+	proto := &funcProto{nparams: nparams, vararg: fs.vararg, nslots: fs.nslots, body: body}
+	upvals := fs.upvals
+	return func(f *frame) Value {
+		fn := &Function{proto: proto, upvals: make([]*cell, len(upvals))}
+		for i, u := range upvals {
+			if u.fromLocal {
+				fn.upvals[i] = f.slots[u.index]
+			} else {
+				fn.upvals[i] = f.fn.upvals[u.index]
+			}
+		}
+		return fn
+	}
+}
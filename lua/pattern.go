@@ -0,0 +1,600 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lua patterns, matched as Lua 5.1's lstrlib.c matches them.
+
+const maxCaptures = 32
+
+// Capture lengths with a special meaning.
+const (
+	capUnfinished = -1
+	capPosition   = -2
+)
+
+// matchState is the state of matching a pattern against a subject.
+type matchState struct {
+	L       *State
+	src     string
+	pat     string
+	level   int
+	capture [maxCaptures]struct{ start, len int }
+	depth   int
+}
+
+func (ms *matchState) classEnd(p int) int {
+	if p >= len(ms.pat) {
+		ms.L.Errorf("malformed pattern (ends with '%%')")
+	}
+	c := ms.pat[p]
+	p++
+	if c == '%' {
+		if p >= len(ms.pat) {
+			ms.L.Errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.L.Errorf("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+			if p >= len(ms.pat) {
+				ms.L.Errorf("malformed pattern (missing ']')")
+			}
+		}
+	}
+	return p
+}
+
+// matchClass reports whether c is in the class %cl.
+func matchClass(c byte, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isAlpha(c) && c != '_'
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = c > 32 && c < 127 && !isAlpha(c) && !isDigit(c) || c == '_'
+	case 's':
+		res = c == ' ' || c >= '\t' && c <= '\r'
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = (isAlpha(c) && c != '_') || isDigit(c)
+	case 'x':
+		res = isHex(c)
+	case 'z':
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass reports whether c is in the set [p..ec].
+func (ms *matchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case p+2 < ec && ms.pat[p+1] == '-':
+			if ms.pat[p] <= c && c <= ms.pat[p+2] {
+				return sig
+			}
+			p += 2
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+// singleMatch reports whether the character at s matches the class at p.
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match matches the pattern from p against the subject from s, returning
+// the end of the match or -1.
+func (ms *matchState) match(s, p int) int {
+	if ms.depth++; ms.depth > 200 {
+		ms.L.Errorf("pattern too complex")
+	}
+	defer func() { ms.depth-- }()
+	for {
+		ms.L.step()
+		if p >= len(ms.pat) {
+			return s
+		}
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 < len(ms.pat) {
+				switch c := ms.pat[p+1]; {
+				case c == 'b':
+					s = ms.matchBalance(s, p+2)
+					if s == -1 {
+						return -1
+					}
+					p += 4
+					continue
+				case c == 'f':
+					p += 2
+					if p >= len(ms.pat) || ms.pat[p] != '[' {
+						ms.L.Errorf("missing '[' after '%%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if ms.matchBracketClass(prev, p, ep-1) || !ms.matchBracketClass(cur, p, ep-1) {
+						return -1
+					}
+					p = ep
+					continue
+				case isDigit(c):
+					s = ms.matchCapture(s, c)
+					if s == -1 {
+						return -1
+					}
+					p += 2
+					continue
+				}
+			}
+		}
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if res := ms.match(s+1, ep+1); res != -1 {
+						return res
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s, p = s+1, ep
+	}
+}
+
+func (ms *matchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s, p, what int) int {
+	if ms.level >= maxCaptures {
+		ms.L.Errorf("too many captures")
+	}
+	ms.capture[ms.level].start = s
+	ms.capture[ms.level].len = what
+	ms.level++
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.level--
+	}
+	return res
+}
+
+func (ms *matchState) endCapture(s, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.L.Errorf("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].start
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.capture[l].len = capUnfinished
+	}
+	return res
+}
+
+func (ms *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.L.Errorf("missing arguments to '%%b'")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	open, closing := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		switch ms.src[i] {
+		case closing:
+			if cont--; cont == 0 {
+				return i + 1
+			}
+		case open:
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) matchCapture(s int, c byte) int {
+	l := int(c - '1')
+	if l < 0 || l >= ms.level || ms.capture[l].len == capUnfinished {
+		ms.L.Errorf("invalid capture index")
+	}
+	capture := ms.src[ms.capture[l].start : ms.capture[l].start+ms.capture[l].len]
+	if strings.HasPrefix(ms.src[s:], capture) {
+		return s + len(capture)
+	}
+	return -1
+}
+
+// getCapture returns capture i of a match from s to e; the whole match if
+// the pattern has no captures.
+func (ms *matchState) getCapture(i, s, e int) Value {
+	if i >= ms.level {
+		if i == 0 {
+			return ms.src[s:e]
+		}
+		ms.L.Errorf("invalid capture index")
+	}
+	c := ms.capture[i]
+	switch c.len {
+	case capUnfinished:
+		ms.L.Errorf("unfinished capture")
+	case capPosition:
+		return float64(c.start + 1)
+	}
+	return ms.src[c.start : c.start+c.len]
+}
+
+// captures returns the captures of a match, or the whole match if
+// wholeIfNone and the pattern has none.
+func (ms *matchState) captures(s, e int, wholeIfNone bool) []Value {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	values := make([]Value, n)
+	for i := range values {
+		values[i] = ms.getCapture(i, s, e)
+	}
+	return values
+}
+
+// specials are the characters that make a pattern more than a plain string.
+const specials = "^$*+?.([%-"
+
+// strFind implements string.find and string.match.
+func strFind(L *State, args []Value, name string, find bool) []Value {
+	s := L.CheckString(args, 1, name)
+	pat := L.CheckString(args, 2, name)
+	init := strIndex(L.optInt(args, 3, name, 1), len(s))
+	if init < 1 {
+		init = 1
+	}
+	if init > len(s)+1 {
+		return []Value{nil}
+	}
+	if find && (Truthy(arg(args, 4)) || !strings.ContainsAny(pat, specials)) {
+		i := strings.Index(s[init-1:], pat)
+		if i < 0 {
+			return []Value{nil}
+		}
+		start := init + i
+		return []Value{float64(start), float64(start + len(pat) - 1)}
+	}
+	ms := &matchState{L: L, src: s, pat: pat}
+	anchor := strings.HasPrefix(pat, "^")
+	p := 0
+	if anchor {
+		p = 1
+	}
+	for s1 := init - 1; ; s1++ {
+		ms.level = 0
+		if e := ms.match(s1, p); e != -1 {
+			if find {
+				return append([]Value{float64(s1 + 1), float64(e)}, ms.captures(-1, 0, false)...)
+			}
+			return ms.captures(s1, e, true)
+		}
+		if anchor || s1 >= len(s) {
+			return []Value{nil}
+		}
+	}
+}
+
+// strGmatch implements string.gmatch.
+func strGmatch(L *State, args []Value) []Value {
+	s := L.CheckString(args, 1, "gmatch")
+	pat := L.CheckString(args, 2, "gmatch")
+	pos := 0
+	return []Value{NewFunction("gmatch_iterator", func(L *State, _ []Value) []Value {
+		ms := &matchState{L: L, src: s, pat: pat}
+		for ; pos <= len(s); pos++ {
+			ms.level = 0
+			if e := ms.match(pos, 0); e != -1 {
+				start := pos
+				if e == pos {
+					// An empty match moves on by a character.
+					pos++
+				} else {
+					pos = e
+				}
+				return ms.captures(start, e, true)
+			}
+		}
+		return []Value{nil}
+	})}
+}
+
+// strGsub implements string.gsub.
+func strGsub(L *State, args []Value) []Value {
+	src := L.CheckString(args, 1, "gsub")
+	pat := L.CheckString(args, 2, "gsub")
+	repl := arg(args, 3)
+	switch repl.(type) {
+	case string, float64, *Table, *Function:
+	default:
+		L.ArgError(3, "gsub", "string/function/table expected")
+	}
+	maxN := L.optInt(args, 4, "gsub", len(src)+1)
+	anchor := strings.HasPrefix(pat, "^")
+	p := 0
+	if anchor {
+		p = 1
+	}
+	ms := &matchState{L: L, src: src, pat: pat}
+	var b strings.Builder
+	s, n := 0, 0
+	for n < maxN {
+		ms.level = 0
+		e := ms.match(s, p)
+		if e != -1 {
+			n++
+			ms.addValue(&b, s, e, repl)
+		}
+		switch {
+		case e != -1 && e > s:
+			s = e
+		case s < len(src):
+			b.WriteByte(src[s])
+			s++
+		default:
+			return []Value{b.String(), float64(n)}
+		}
+		if anchor {
+			break
+		}
+		if b.Len() > maxStringSize {
+			L.Errorf("resulting string too large")
+		}
+	}
+	b.WriteString(src[min(s, len(src)):])
+	return []Value{b.String(), float64(n)}
+}
+
+// addValue appends the replacement of the match from s to e.
+func (ms *matchState) addValue(b *strings.Builder, s, e int, repl Value) {
+	var v Value
+	switch r := repl.(type) {
+	case float64:
+		ms.addString(b, s, e, FormatNumber(r))
+		return
+	case string:
+		ms.addString(b, s, e, r)
+		return
+	case *Table:
+		v = r.Get(ms.getCapture(0, s, e))
+	case *Function:
+		results := ms.L.call(r, ms.captures(s, e, true))
+		if len(results) > 0 {
+			v = results[0]
+		}
+	}
+	if !Truthy(v) {
+		b.WriteString(ms.src[s:e])
+		return
+	}
+	str, ok := ToString(v)
+	if !ok {
+		ms.L.Errorf("invalid replacement value (a %s)", TypeName(v))
+	}
+	b.WriteString(str)
+}
+
+// addString appends a replacement string, with its %0 to %9 captures.
+func (ms *matchState) addString(b *strings.Builder, s, e int, repl string) {
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != '%' || i+1 == len(repl) {
+			b.WriteByte(repl[i])
+			continue
+		}
+		i++
+		c := repl[i]
+		switch {
+		case c == '0':
+			b.WriteString(ms.src[s:e])
+		case isDigit(c):
+			str, _ := ToString(ms.getCapture(int(c-'1'), s, e))
+			b.WriteString(str)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// strFormat implements string.format.
+func strFormat(L *State, args []Value) []Value {
+	format := L.CheckString(args, 1, "format")
+	var b strings.Builder
+	n := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		// The flags, width and precision, which Go's fmt reads as C does.
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && (isDigit(format[i]) || format[i] == '.') {
+			i++
+		}
+		if i >= len(format) {
+			L.Errorf("invalid option '%%' to 'format'")
+		}
+		spec := "%" + format[start:i]
+		n++
+		switch verb := format[i]; verb {
+		case 'd', 'i':
+			fmt.Fprintf(&b, spec+"d", int64(L.CheckNumber(args, n, "format")))
+		case 'u':
+			fmt.Fprintf(&b, spec+"d", uint64(L.CheckNumber(args, n, "format")))
+		case 'c':
+			b.WriteByte(byte(L.CheckNumber(args, n, "format")))
+		case 'x', 'X', 'o':
+			fmt.Fprintf(&b, spec+string(verb), int64(L.CheckNumber(args, n, "format")))
+		case 'e', 'E', 'f', 'g', 'G':
+			fmt.Fprintf(&b, spec+string(verb), L.CheckNumber(args, n, "format"))
+		case 's':
+			var s string
+			if n <= len(args) {
+				s = tostring(args[n-1])
+			} else {
+				L.ArgError(n, "format", "string expected, got no value")
+			}
+			fmt.Fprintf(&b, spec+"s", s)
+		case 'q':
+			b.WriteString(quoteString(L.CheckString(args, n, "format")))
+		default:
+			L.Errorf("invalid option '%%%c' to 'format'", verb)
+		}
+	}
+	return []Value{b.String()}
+}
+
+// quoteString quotes s as string.format's %q does, so Lua reads it back.
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\000")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,383 @@
+// Package lua runs scripts written in the subset of Lua 5.1 that Redis
+// scripts use: the whole language except metatables, coroutines and goto,
+// and the base, string, table and math libraries, plus cjson. The host
+// adds its own functions, such as Redis' redis.call, as Go functions.
+//
+// A State is not safe for concurrent use.
+package lua
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// maxCallDepth bounds the nesting of calls, so runaway recursion fails like
+// Lua's "stack overflow" rather than exhausting the Go stack.
+const maxCallDepth = 1000
+
+// State holds the globals of chunks and runs them.
+type State struct {
+	// Globals holds the global variables.
+	Globals *Table
+	// strict makes reading a global that doesn't exist and creating one
+	// errors, as Redis does for scripts.
+	strict bool
+	// deadline, when set, is when running code is stopped with
+	// errTimeout.
+	deadline time.Time
+	steps    int
+	depth    int
+	// where is the position of the call running, for error.
+	where string
+}
+
+// errTimeout is the value code running past the deadline is stopped with.
+var errTimeout = &Error{Value: "script ran past its deadline"}
+
+// NewState returns a state with the standard libraries loaded.
+func NewState() *State {
+	L := &State{Globals: NewTable()}
+	openBase(L)
+	openString(L)
+	openTable(L)
+	openMath(L)
+	openJSON(L)
+	return L
+}
+
+// SetStrict makes reading globals that don't exist and creating new ones
+// errors, so that scripts can't leak state into each other through the
+// globals. The host's own globals are set with Globals.Set.
+func (L *State) SetStrict(strict bool) {
+	L.strict = strict
+}
+
+// SetDeadline stops the code running after t, making the call fail with an
+// error IsTimeout reports. The zero time lets code run for as long as it
+// takes.
+func (L *State) SetDeadline(t time.Time) {
+	L.deadline = t
+}
+
+// IsTimeout reports whether err stopped code that ran past the deadline.
+func IsTimeout(err error) bool {
+	return err == errTimeout
+}
+
+// Register sets the global name to the Go function fn.
+func (L *State) Register(name string, fn GoFunction) {
+	L.Globals.Set(name, NewFunction(name, fn))
+}
+
+// Load compiles chunk, naming it name in error messages, and returns it as
+// a function taking no parameters.
+func (L *State) Load(chunk, name string) (fn *Function, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	p := newParser(chunk, name)
+	return &Function{name: name, proto: p.chunk()}, nil
+}
+
+// Call calls fn with args and returns its results, or the error it raised.
+func (L *State) Call(fn Value, args ...Value) (results []Value, err error) {
+	depth := L.depth
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			L.depth = depth
+			err = e
+		}
+	}()
+	return L.call(fn, args), nil
+}
+
+// Errorf raises an error with a formatted message, prefixed with the
+// position of the code calling the Go function raising it.
+func (L *State) Errorf(format string, args ...any) {
+	panic(&Error{Value: L.where + fmt.Sprintf(format, args...)})
+}
+
+// Raise raises an error with v as its value, as the error function does
+// with level 0.
+func (L *State) Raise(v Value) {
+	panic(&Error{Value: v})
+}
+
+// ArgError raises the error of a bad argument to the Go function name.
+func (L *State) ArgError(n int, name, msg string) {
+	L.Errorf("bad argument #%d to '%s' (%s)", n, name, msg)
+}
+
+// CheckString returns argument n (counting from 1) as a string, raising an
+// error if it is not a string or number.
+func (L *State) CheckString(args []Value, n int, name string) string {
+	var v Value
+	if n <= len(args) {
+		v = args[n-1]
+	}
+	s, ok := ToString(v)
+	if !ok {
+		L.ArgError(n, name, "string expected, got "+argType(v, n, args))
+	}
+	return s
+}
+
+// CheckNumber returns argument n as a number, raising an error if it is
+// not a number or numeric string.
+func (L *State) CheckNumber(args []Value, n int, name string) float64 {
+	var v Value
+	if n <= len(args) {
+		v = args[n-1]
+	}
+	f, ok := ToNumber(v)
+	if !ok {
+		L.ArgError(n, name, "number expected, got "+argType(v, n, args))
+	}
+	return f
+}
+
+// CheckInt returns argument n as an integer, truncating numbers.
+func (L *State) CheckInt(args []Value, n int, name string) int {
+	f := L.CheckNumber(args, n, name)
+	if math.IsNaN(f) {
+		return 0
+	}
+	return int(max(min(f, math.MaxInt32), math.MinInt32))
+}
+
+// CheckTable returns argument n as a table.
+func (L *State) CheckTable(args []Value, n int, name string) *Table {
+	var v Value
+	if n <= len(args) {
+		v = args[n-1]
+	}
+	t, ok := v.(*Table)
+	if !ok {
+		L.ArgError(n, name, "table expected, got "+argType(v, n, args))
+	}
+	return t
+}
+
+// optInt returns argument n as an integer, or def if it is absent or nil.
+func (L *State) optInt(args []Value, n int, name string, def int) int {
+	if n > len(args) || args[n-1] == nil {
+		return def
+	}
+	return L.CheckInt(args, n, name)
+}
+
+// argType names the type of an argument for an error, telling a missing
+// argument from a nil one.
+func argType(v Value, n int, args []Value) string {
+	if n > len(args) {
+		return "no value"
+	}
+	return TypeName(v)
+}
+
+// arg returns argument n, or nil if it is absent.
+func arg(args []Value, n int) Value {
+	if n <= len(args) {
+		return args[n-1]
+	}
+	return nil
+}
+
+// step counts work toward the deadline, which is checked every so often.
+func (L *State) step() {
+	if L.steps++; L.steps&1023 == 0 && !L.deadline.IsZero() && time.Now().After(L.deadline) {
+		panic(errTimeout)
+	}
+}
+
+// call calls fn with args.
+func (L *State) call(fn Value, args []Value) []Value {
+	f, ok := fn.(*Function)
+	if !ok {
+		L.Errorf("attempt to call a %s value", TypeName(fn))
+	}
+	if L.depth++; L.depth > maxCallDepth {
+		L.Errorf("stack overflow")
+	}
+	defer func() { L.depth-- }()
+	L.step()
+	if f.native != nil {
+		return f.native(L, args)
+	}
+	p := f.proto
+	fr := &frame{L: L, fn: f, slots: make([]*cell, p.nslots)}
+	for i := 0; i < p.nparams; i++ {
+		var v Value
+		if i < len(args) {
+			v = args[i]
+		}
+		fr.slots[i] = &cell{v}
+	}
+	if p.vararg && len(args) > p.nparams {
+		fr.varargs = args[p.nparams:]
+	}
+	if p.body(fr) == ctlReturn {
+		return fr.ret
+	}
+	return nil
+}
+
+// getIndex returns t[key], for a t of any type: strings index the string
+// library, as their metatable does in Lua.
+func (L *State) getIndex(t, key Value) Value {
+	switch t := t.(type) {
+	case *Table:
+		return t.Get(key)
+	case string:
+		if lib, ok := L.Globals.Get("string").(*Table); ok {
+			return lib.Get(key)
+		}
+		return nil
+	}
+	L.Errorf("attempt to index a %s value", TypeName(t))
+	return nil
+}
+
+// setIndex sets t[key] to v.
+func (L *State) setIndex(t, key, v Value) {
+	tab, ok := t.(*Table)
+	if !ok {
+		L.Errorf("attempt to index a %s value", TypeName(t))
+	}
+	switch k := key.(type) {
+	case nil:
+		L.Errorf("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			L.Errorf("table index is NaN")
+		}
+	}
+	tab.Set(key, v)
+}
+
+// getGlobal returns the global name.
+func (L *State) getGlobal(name string) Value {
+	v := L.Globals.Get(name)
+	if v == nil && L.strict {
+		L.Errorf("Script attempted to access nonexistent global variable '%s'", name)
+	}
+	return v
+}
+
+// setGlobal sets the global name.
+func (L *State) setGlobal(name string, v Value) {
+	if L.strict && L.Globals.Get(name) == nil {
+		L.Errorf("Script attempted to create global variable '%s'", name)
+	}
+	L.Globals.Set(name, v)
+}
+
+// arith applies the arithmetic operator op to a and b.
+func (L *State) arith(op string, a, b Value) float64 {
+	x, ok1 := ToNumber(a)
+	y, ok2 := ToNumber(b)
+	if !ok1 || !ok2 {
+		bad := a
+		if ok1 {
+			bad = b
+		}
+		L.Errorf("attempt to perform arithmetic on a %s value", TypeName(bad))
+	}
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		return x / y
+	case "%":
+		return x - math.Floor(x/y)*y
+	case "^":
+		return math.Pow(x, y)
+	}
+	panic("unknown operator " + op)
+}
+
+// less reports whether a < b, for numbers or strings.
+func (L *State) less(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	L.compareError(a, b)
+	return false
+}
+
+// lessEqual reports whether a <= b, for numbers or strings.
+func (L *State) lessEqual(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x <= y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x <= y
+		}
+	}
+	L.compareError(a, b)
+	return false
+}
+
+func (L *State) compareError(a, b Value) {
+	if ta, tb := TypeName(a), TypeName(b); ta == tb {
+		L.Errorf("attempt to compare two %s values", ta)
+	} else {
+		L.Errorf("attempt to compare %s with %s", ta, tb)
+	}
+}
+
+// concat concatenates a and b, which must be strings or numbers.
+func (L *State) concat(a, b Value) string {
+	x, ok1 := ToString(a)
+	y, ok2 := ToString(b)
+	if !ok1 || !ok2 {
+		bad := a
+		if ok1 {
+			bad = b
+		}
+		L.Errorf("attempt to concatenate a %s value", TypeName(bad))
+	}
+	return x + y
+}
+
+// length applies the # operator to v.
+func (L *State) length(v Value) float64 {
+	switch v := v.(type) {
+	case string:
+		return float64(len(v))
+	case *Table:
+		return float64(v.Len())
+	}
+	L.Errorf("attempt to get length of a %s value", TypeName(v))
+	return 0
+}
+
+// rawEqual reports whether a and b are the same value.
+func rawEqual(a, b Value) bool {
+	return a == b
+}
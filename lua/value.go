@@ -0,0 +1,334 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Value is a Lua value: nil, a bool, a float64 (Lua 5.1 numbers are all
+// floats), a string, a *Table or a *Function.
+type Value = any
+
+// GoFunction is a function written in Go. It raises errors with
+// State.Errorf or State.Raise rather than returning them.
+type GoFunction func(L *State, args []Value) []Value
+
+// Function is a Lua or Go function.
+type Function struct {
+	name   string
+	proto  *funcProto
+	upvals []*cell
+	native GoFunction
+}
+
+// NewFunction returns a Lua value calling fn, named name in error messages.
+func NewFunction(name string, fn GoFunction) *Function {
+	return &Function{name: name, native: fn}
+}
+
+// Error is an error raised by a chunk, with the value it was raised with:
+// usually a message string prefixed with the position it was raised at.
+type Error struct {
+	Value Value
+}
+
+func (e *Error) Error() string {
+	if s, ok := e.Value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("(error object is a %s value)", TypeName(e.Value))
+}
+
+// TypeName returns the Lua name of the type of v.
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Truthy reports whether v counts as true: anything but nil and false.
+func Truthy(v Value) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+// FormatNumber formats n as Lua's tostring does.
+func FormatNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// ToString converts strings and numbers to strings, as concatenation and the
+// string library do, reporting false for the other types.
+func ToString(v Value) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return FormatNumber(v), true
+	}
+	return "", false
+}
+
+// ToNumber converts numbers and numeric strings to numbers, as arithmetic
+// does, reporting false for anything else.
+func ToNumber(v Value) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseNumber(strings.TrimSpace(v))
+	}
+	return 0, false
+}
+
+// parseNumber parses a Lua numeral: a decimal number with an optional
+// exponent or a hexadecimal integer.
+func parseNumber(s string) (float64, bool) {
+	neg := false
+	body := s
+	if strings.HasPrefix(body, "-") {
+		neg, body = true, body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	if s == "" || strings.ContainsAny(s, "_xXpP") || strings.EqualFold(body, "inf") || strings.EqualFold(body, "infinity") || strings.EqualFold(body, "nan") {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil && !strings.Contains(err.Error(), "out of range") {
+		return 0, false
+	}
+	return n, true
+}
+
+// tostring converts any value to a string, as the tostring function does.
+func tostring(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return FormatNumber(v)
+	case string:
+		return v
+	case *Table:
+		return fmt.Sprintf("table: %p", v)
+	case *Function:
+		if v.native != nil {
+			return fmt.Sprintf("builtin: %p", v)
+		}
+		return fmt.Sprintf("function: %p", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// Table is a Lua table. Positive integer keys from 1 up live in an array
+// part; the others in a hash part that remembers the order keys were added
+// in, so next can walk it while fields are cleared.
+type Table struct {
+	arr   []Value
+	keys  []Value
+	vals  []Value
+	index map[Value]int
+	// holes counts the cleared fields still in keys.
+	holes int
+}
+
+// NewTable returns an empty table.
+func NewTable() *Table {
+	return &Table{}
+}
+
+// arrayIndex returns the array position of key, if it is an integer.
+func arrayIndex(key Value) (int, bool) {
+	n, ok := key.(float64)
+	if !ok || n != math.Trunc(n) || n < 1 || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// Get returns the value of key, or nil.
+func (t *Table) Get(key Value) Value {
+	if i, ok := arrayIndex(key); ok && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if i, ok := t.index[key]; ok {
+		return t.vals[i]
+	}
+	return nil
+}
+
+// GetString returns the value of the string key.
+func (t *Table) GetString(key string) Value {
+	return t.Get(key)
+}
+
+// Set sets the value of key, or clears it if value is nil. Keys must not
+// be nil or NaN; see State.setIndex for the checked form.
+func (t *Table) Set(key, value Value) {
+	if i, ok := arrayIndex(key); ok {
+		switch {
+		case i <= len(t.arr):
+			t.arr[i-1] = value
+			return
+		case i == len(t.arr)+1 && value != nil:
+			t.arr = append(t.arr, value)
+			t.setHash(key, nil)
+			// Keys that follow now extend the array.
+			for {
+				next := float64(len(t.arr) + 1)
+				v := t.hashGet(next)
+				if v == nil {
+					return
+				}
+				t.arr = append(t.arr, v)
+				t.setHash(next, nil)
+			}
+		}
+	}
+	t.setHash(key, value)
+}
+
+// SetString sets the value of the string key.
+func (t *Table) SetString(key string, value Value) {
+	t.Set(key, value)
+}
+
+func (t *Table) hashGet(key Value) Value {
+	if i, ok := t.index[key]; ok {
+		return t.vals[i]
+	}
+	return nil
+}
+
+func (t *Table) setHash(key, value Value) {
+	if i, ok := t.index[key]; ok {
+		switch {
+		case t.vals[i] == nil && value != nil:
+			t.holes--
+		case t.vals[i] != nil && value == nil:
+			t.holes++
+		}
+		t.vals[i] = value
+		return
+	}
+	if value == nil {
+		return
+	}
+	// Adding keys while walking a table is undefined in Lua, so this is
+	// when cleared fields can go.
+	if t.holes > 8 && t.holes > len(t.keys)/2 {
+		keys, vals := t.keys[:0], t.vals[:0]
+		for i, k := range t.keys {
+			if t.vals[i] != nil {
+				t.index[k] = len(keys)
+				keys, vals = append(keys, k), append(vals, t.vals[i])
+			} else {
+				delete(t.index, k)
+			}
+		}
+		clear(t.keys[len(keys):])
+		clear(t.vals[len(vals):])
+		t.keys, t.vals, t.holes = keys, vals, 0
+	}
+	if t.index == nil {
+		t.index = make(map[Value]int)
+	}
+	t.index[key] = len(t.keys)
+	t.keys = append(t.keys, key)
+	t.vals = append(t.vals, value)
+}
+
+// Len returns the length of the table as the # operator does: an n such
+// that t[n] is not nil and t[n+1] is.
+func (t *Table) Len() int {
+	n := len(t.arr)
+	if n == 0 || t.arr[n-1] != nil {
+		return n
+	}
+	// Cleared fields leave holes: binary search for a border.
+	lo, hi := 0, n
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if t.arr[mid-1] == nil {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return lo
+}
+
+// Append sets t[#t+1] to v.
+func (t *Table) Append(v Value) {
+	t.Set(float64(t.Len()+1), v)
+}
+
+// Next returns the key and value following key in the table's traversal
+// order, starting from a nil key; it returns a nil key once the traversal
+// is over, and false if key is not in the table.
+func (t *Table) Next(key Value) (Value, Value, bool) {
+	i := 0
+	if key != nil {
+		if j, ok := arrayIndex(key); ok && j <= len(t.arr) {
+			i = j
+		} else if j, ok := t.index[key]; ok {
+			i = len(t.arr) + j + 1
+		} else {
+			return nil, nil, false
+		}
+	}
+	for ; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for j := i - len(t.arr); j < len(t.keys); j++ {
+		if t.vals[j] != nil {
+			return t.keys[j], t.vals[j], true
+		}
+	}
+	return nil, nil, true
+}
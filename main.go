@@ -2,18 +2,342 @@
 package main
 
 import (
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/nazeeeef007/redis-clone/command"
 	"github.com/nazeeeef007/redis-clone/server"
 )
 
 func main() {
+	slabAlloc := flag.Bool("slab-alloc", false, "store small list and hash elements in per-shard slabs (experimental)")
+	port := flag.Int("port", 6379, "TCP port to accept clients on")
+	maxMemory := flag.String("maxmemory", "0", "dataset memory budget, e.g. 512mb (0 means unlimited)")
+	maxMemoryClients := flag.String("maxmemory-clients", "0", "memory the buffers of all clients may use together before the largest are disconnected, e.g. 64mb (0 means unlimited)")
+	headroom := flag.Int("maxmemory-headroom", 10, "percentage added to maxmemory to form the Go runtime memory limit")
+	appendFsync := flag.String("appendfsync", "everysec", "when the append-only file is fsynced: always, everysec or no")
+	appendOnly := flag.Bool("appendonly", true, "persist write commands to the append-only file")
+	flushProtection := flag.Duration("flush-protection", 0, "reject plain FLUSHALL/FLUSHDB and delay scheduled flushes by this window (0 disables)")
+	aclFile := flag.String("aclfile", "", "file defining ACL users, one 'user <name> <rules...>' per line")
+	hz := flag.Int("hz", 10, "background cycles (active expiration etc.) per second")
+	dynamicHz := flag.Bool("dynamic-hz", true, "adapt the background frequency to backlog and cycle cost")
+	backgroundCPU := flag.Int("background-cpu-percent", 25, "maximum share of CPU time spent in background cycles")
+	hashMaxEntries := flag.Int("hash-max-listpack-entries", 128, "largest number of fields stored in the compact hash encoding")
+	hashMaxValue := flag.Int("hash-max-listpack-value", 64, "longest field or value stored in the compact hash encoding")
+	resultCache := flag.String("result-cache", "", "comma-separated key patterns whose expensive read replies are cached")
+	resultCacheMax := flag.Int("result-cache-max-entries", 10000, "maximum number of cached read replies")
+	gcPercent := flag.Int("gogc", 0, "GOGC value for the server (0 keeps the default, -1 disables proportional GC)")
+	handshakeTimeout := flag.Duration("handshake-timeout", 0, "close connections that don't start a command within this time (0 disables)")
+	commandTimeout := flag.Duration("command-timeout", 0, "close connections that take longer than this to send a started command (0 disables)")
+	authURL := flag.String("auth-url", "", "validate AUTH by POSTing the credentials to this URL instead of checking ACL passwords")
+	authCacheTTL := flag.Duration("auth-cache-ttl", time.Minute, "how long credentials accepted by -auth-url are remembered")
+	authBackoff := flag.Duration("auth-backoff", time.Second, "how long AUTH fails fast after an -auth-url error, doubling on repeated errors")
+	metricsAddr := flag.String("metrics-addr", "", "serve statistics over HTTP on this address, as OpenMetrics or JSON")
+	statsdAddr := flag.String("statsd-addr", "", "push statistics to the StatsD or DogStatsD agent at this UDP address")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "how often statistics are pushed to -statsd-addr")
+	statsdTags := flag.String("statsd-tags", "", "comma-separated DogStatsD tags added to the metrics pushed to -statsd-addr, e.g. env:prod,service:cache")
+	writeBehindURL := flag.String("write-behind-url", "", "forward writes to -write-behind-keys to this HTTP endpoint in the background")
+	writeBehindKeys := flag.String("write-behind-keys", "*", "comma-separated key patterns forwarded to -write-behind-url")
+	writeBehindDLQ := flag.String("write-behind-dead-letter-key", "", "list receiving the records -write-behind-url kept rejecting")
+	memoryWatermarks := flag.String("memory-watermarks", "", "comma-separated percentages of maxmemory whose crossing is published on "+command.MemoryPressureChannel)
+	memoryWarnWrites := flag.Bool("memory-warn-writes", false, "warn RESP3 clients in a reply attribute when they write above a memory watermark")
+	tieringIdle := flag.Duration("tiering-idle", 0, "move values idle for this long to -tiering-file, loading them back on access (0 disables)")
+	tieringFile := flag.String("tiering-file", "spill.dat", "spill file for values moved out of memory by -tiering-idle")
+	encryptKeys := flag.String("encrypt-keys", "", "comma-separated key patterns whose string values are kept encrypted in memory and on disk")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "file holding the hex-encoded AES key for -encrypt-keys (default: the "+encryptionKeyEnv+" environment variable)")
+	redactCommands := flag.String("redact-commands", "", "comma-separated commands whose arguments, except keys, are redacted in SLOWLOG and MONITOR")
+	redactKeys := flag.String("redact-keys", "", "comma-separated key patterns whose commands' arguments, except keys, are redacted in SLOWLOG and MONITOR")
+	watchdogThreshold := flag.Duration("watchdog-threshold", 5*time.Second, "log commands running longer than this with their stack (0 disables)")
+	watchdogAudit := flag.Duration("watchdog-audit-period", time.Minute, "how often goroutines are audited for leaks (0 disables)")
+	offlineDir := flag.String("offline-dir", "", "directory of the RDB files clients may read from with OFFLINE SELECT (empty disables)")
+	dbFilename := flag.String("dbfilename", "dump.rdb", "file SAVE and BGSAVE write the snapshot to, loaded at startup when the append-only file holds nothing")
+	saveRules := flag.String("save", "", "save rules as 'seconds changes' pairs, e.g. '900 1 300 10': BGSAVE runs once changes writes ran and seconds passed since the last snapshot (empty disables)")
+	randomSeed := flag.Uint64("random-seed", 0, "seed randomized replies and data structure choices, for repeatable runs (0 seeds randomly)")
+	loadModules := flag.String("load-modules", "", "comma-separated Go plugins adding commands, each exporting "+command.ModuleInit+" func() error")
+	loadWasm := flag.String("load-wasm", "", "comma-separated WebAssembly modules adding sandboxed commands (needs a build with -tags wasmruntime)")
+	configFile := flag.String("config", "", "configuration file setting these options, one 'name value' per line; options given as flags take precedence")
+	slowlogSlowerThan := flag.Int64("slowlog-log-slower-than", 10000, "microseconds a command runs before SLOWLOG records it (-1 disables)")
+	slowlogMaxLen := flag.Int("slowlog-max-len", 128, "number of entries SLOWLOG keeps (disable it with -slowlog-log-slower-than -1)")
+	enableDebug := flag.String("enable-debug-command", "no", "allow the DEBUG subcommands for operational testing, such as DEBUG SLEEP: yes, no or local")
+	latencyThreshold := flag.Int64("latency-monitor-threshold", 0, "milliseconds an event such as a command or an AOF fsync lasts before LATENCY records it (0 disables)")
+	testConfig := flag.Bool("test-config", false, "check the configuration, report every problem found and exit without starting the server")
+	otlpTracesURL := flag.String("otlp-traces-url", "", "export a span for every command of clients with a trace ID to this OTLP/HTTP endpoint, e.g. http://collector:4318/v1/traces")
+	otlpServiceName := flag.String("otlp-service-name", "myredis", "service.name of the spans exported to -otlp-traces-url")
+	flag.Parse()
+
+	// Configuration problems are collected rather than fatal one by one, so
+	// they can all be reported, and fixed, at once.
+	var configErrs []error
+	invalid := func(option, format string, args ...any) {
+		configErrs = append(configErrs, fmt.Errorf("%s: %s", option, fmt.Sprintf(format, args...)))
+	}
+	if *configFile != "" {
+		for _, err := range applyConfigFile(*configFile) {
+			invalid("config", "%v", err)
+		}
+	}
+
+	maxMemoryBytes, err := command.ParseMemory(*maxMemory)
+	if err != nil {
+		invalid("maxmemory", "%v", err)
+	}
+	maxMemoryClientsBytes, err := command.ParseMemory(*maxMemoryClients)
+	if err != nil {
+		invalid("maxmemory-clients", "%v", err)
+	}
+
+	var cachePatterns []string
+	if *resultCache != "" {
+		cachePatterns = strings.Split(*resultCache, ",")
+	}
+
+	var watermarks []int
+	if *memoryWatermarks != "" {
+		for _, w := range strings.Split(*memoryWatermarks, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil {
+				invalid("memory-watermarks", "%q is not a percentage", w)
+				continue
+			}
+			watermarks = append(watermarks, n)
+		}
+	}
+
+	rules, err := command.ParseSaveRules(*saveRules)
+	if err != nil {
+		invalid("save", "%v", err)
+	}
+
+	var encryptionKey []byte
+	var encryptedKeys []string
+	if *encryptKeys != "" {
+		encryptedKeys = strings.Split(*encryptKeys, ",")
+		encryptionKey, err = loadEncryptionKey(*encryptionKeyFile)
+		if err != nil {
+			invalid("encryption-key-file", "%v", err)
+		}
+	} else if *encryptionKeyFile != "" {
+		invalid("encryption-key-file", "set without encrypt-keys, so nothing would be encrypted")
+	}
+	if *statsdAddr != "" && *statsdInterval <= 0 {
+		invalid("statsd-interval", "must be positive, got %v", *statsdInterval)
+	}
+	if *statsdAddr == "" && *statsdTags != "" {
+		invalid("statsd-tags", "set without statsd-addr, so nothing would be tagged")
+	}
+	if *writeBehindURL == "" && *writeBehindDLQ != "" {
+		invalid("write-behind-dead-letter-key", "set without write-behind-url, so nothing would be forwarded")
+	}
+
+	var writeBehind *command.WriteBehind
+	if *writeBehindURL != "" {
+		writeBehind = &command.WriteBehind{
+			Patterns:      strings.Split(*writeBehindKeys, ","),
+			Sink:          &command.HTTPSink{URL: *writeBehindURL},
+			MaxRetries:    5,
+			RetryDelay:    time.Second,
+			DeadLetterKey: *writeBehindDLQ,
+		}
+	}
+
+	var spanExporter command.SpanExporter
+	if *otlpTracesURL != "" {
+		spanExporter = &command.OTLPExporter{URL: *otlpTracesURL, ServiceName: *otlpServiceName}
+	}
+
+	cfg := server.Config{
+		SlabAllocation:          *slabAlloc,
+		MaxMemory:               maxMemoryBytes,
+		MaxMemoryClients:        maxMemoryClientsBytes,
+		MemoryHeadroomPercent:   *headroom,
+		MemoryWatermarks:        watermarks,
+		MemoryWarnWrites:        *memoryWarnWrites,
+		DisableAOF:              !*appendOnly,
+		FlushProtectionWindow:   *flushProtection,
+		ACLFile:                 *aclFile,
+		Hz:                      *hz,
+		DynamicHz:               *dynamicHz,
+		BackgroundCPUPercent:    *backgroundCPU,
+		HashMaxCompactEntries:   *hashMaxEntries,
+		HashMaxCompactValue:     *hashMaxValue,
+		ResultCachePatterns:     cachePatterns,
+		ResultCacheMaxEntries:   *resultCacheMax,
+		GCPercent:               *gcPercent,
+		AppendFsync:             *appendFsync,
+		SlowlogSlowerThan:       slowlogThreshold(*slowlogSlowerThan),
+		SlowlogMaxLen:           *slowlogMaxLen,
+		LatencyMonitorThreshold: time.Duration(*latencyThreshold) * time.Millisecond,
+		ConfigFile:              *configFile,
+		EnableDebugCommand:      *enableDebug,
+		HandshakeTimeout:        *handshakeTimeout,
+		CommandTimeout:          *commandTimeout,
+		TieringIdle:             *tieringIdle,
+		TieringFile:             *tieringFile,
+		EncryptionKey:           encryptionKey,
+		EncryptedKeys:           encryptedKeys,
+		RedactCommands:          splitList(*redactCommands),
+		RedactKeys:              splitList(*redactKeys),
+		RandomSeed:              *randomSeed,
+		WatchdogThreshold:       *watchdogThreshold,
+		WatchdogAuditPeriod:     *watchdogAudit,
+		OfflineDir:              *offlineDir,
+		DBFilename:              *dbFilename,
+		SaveRules:               rules,
+		WriteBehind:             writeBehind,
+		SpanExporter:            spanExporter,
+	}
+	configErrs = append(configErrs, cfg.Validate()...)
+	// Modules register their commands before the server starts serving.
+	for _, path := range splitList(*loadModules) {
+		if err := command.LoadModule(path); err != nil {
+			invalid("load-modules", "%v", err)
+		}
+	}
+	for _, path := range splitList(*loadWasm) {
+		if err := command.LoadWasmModule(path); err != nil {
+			invalid("load-wasm", "%v", err)
+		}
+	}
+	if *testConfig {
+		for _, err := range configErrs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(configErrs) > 0 {
+			fmt.Fprintf(os.Stderr, "Configuration has %d problem(s)\n", len(configErrs))
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
+	if len(configErrs) > 0 {
+		for _, err := range configErrs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		log.Fatalf("Not starting with %d configuration problem(s)", len(configErrs))
+	}
+
+	cfg.Handoff, err = server.HandoffFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to take over from the previous process: %v", err)
+	}
+
 	// Create a new server instance.
-	srv := server.NewServer()
+	srv := server.NewServer(cfg)
+	// SIGUSR2 upgrades the server to the binary now at its path.
+	srv.UpgradeOnSignal()
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := srv.ServeMetrics(*metricsAddr); err != nil {
+				log.Printf("Metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+	if *statsdAddr != "" {
+		go func() {
+			if err := srv.PushStatsD(*statsdAddr, *statsdInterval, splitList(*statsdTags)); err != nil {
+				log.Printf("Pushing metrics to StatsD stopped: %v", err)
+			}
+		}()
+	}
 
-	// Listen and serve on port 6379, the default Redis port.
-	log.Println("Starting myredis server on :6379...")
-	if err := srv.Listen(":6379"); err != nil {
+	var listenerOpts server.ListenerOptions
+	if *authURL != "" {
+		listenerOpts.AuthProvider = command.NewCachedAuthProvider(&command.HTTPAuthProvider{URL: *authURL}, *authCacheTTL, *authBackoff)
+	}
+
+	// Listen and serve on -port, 6379 by default, the default Redis port.
+	addr := fmt.Sprintf(":%d", *port)
+	log.Printf("Starting myredis server on %s...", addr)
+	if err := srv.ListenWith(addr, listenerOpts); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// encryptionKeyEnv is the environment variable the encryption key is read
+// from without -encryption-key-file, as secret managers and KMS agents
+// commonly inject it.
+const encryptionKeyEnv = "MYREDIS_ENCRYPTION_KEY"
+
+// loadEncryptionKey reads the hex-encoded encryption key from path, or from
+// the environment if path is empty.
+func loadEncryptionKey(path string) ([]byte, error) {
+	encoded := os.Getenv(encryptionKeyEnv)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if strings.TrimSpace(encoded) == "" {
+		return nil, fmt.Errorf("-encrypt-keys needs a key in -encryption-key-file or %s", encryptionKeyEnv)
+	}
+	return hex.DecodeString(strings.TrimSpace(encoded))
+}
+
+// splitList splits a comma-separated flag value, which may be empty.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// slowlogThreshold converts the slowlog-log-slower-than flag, in
+// microseconds, to the server's threshold: 0 logs every command and -1
+// disables the slow log.
+func slowlogThreshold(us int64) time.Duration {
+	switch {
+	case us < 0:
+		return -1
+	case us == 0:
+		// The server takes zero for its default, and a nanosecond
+		// threshold logs every command as well.
+		return time.Nanosecond
+	}
+	return time.Duration(us) * time.Microsecond
+}
+
+// applyConfigFile sets the flags the configuration file at path sets,
+// except those given on the command line, returning the problems found.
+// Boolean options take yes and no as well as the values flags take.
+func applyConfigFile(path string) []error {
+	directives, err := command.ReadConfigFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var errs []error
+	for _, d := range directives {
+		f := flag.Lookup(d.Name)
+		switch {
+		case f == nil || d.Name == "config" || d.Name == "test-config":
+			errs = append(errs, fmt.Errorf("%s:%d: unknown option '%s'", path, d.Line, d.Name))
+			continue
+		case explicit[d.Name]:
+			continue
+		}
+		value := d.Value
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			switch strings.ToLower(value) {
+			case "yes":
+				value = "true"
+			case "no":
+				value = "false"
+			}
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: invalid %s '%s': %v", path, d.Line, d.Name, d.Value, err))
+		}
+	}
+	return errs
+}
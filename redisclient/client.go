@@ -0,0 +1,250 @@
+// Package redisclient is a small Go client library for the myredis server.
+package redisclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Client is a connection to a myredis server. It is safe for concurrent use;
+// commands from different goroutines are serialized on the connection,
+// pipelined when the client was dialed with Options.AutoPipeline, or spread
+// over a pool of connections with Options.Pool.
+type Client struct {
+	// addr is the address the client was dialed with.
+	addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// pool, when set, holds the pooled connections used instead of conn.
+	pool *pool
+
+	// pipes are the auto-pipelined connections, used instead of conn when
+	// set, and next picks among them round-robin.
+	pipes []*pipeConn
+	next  atomic.Uint64
+
+	// replOffset is the highest replication offset seen in reply hints.
+	replOffset atomic.Int64
+
+	// failover, when set, holds the client of the current master, which
+	// every call is delegated to.
+	failover *failover
+}
+
+// Dial connects to the server at addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{addr: addr, conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	if c.failover != nil {
+		return c.failover.close()
+	}
+	if c.pool != nil {
+		return c.pool.close()
+	}
+	if c.conn == nil {
+		var err error
+		for _, p := range c.pipes {
+			if cerr := p.close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply. Replies are decoded as string
+// (simple and bulk strings), int64 (integers), bool (booleans),
+// []interface{} (arrays, and maps as alternating keys and values) or nil
+// (null bulk strings and arrays). Error replies are returned as an Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	if c.failover != nil {
+		return c.failover.do(args)
+	}
+	if c.pipes != nil {
+		return c.pipeline(args)
+	}
+	if c.pool != nil {
+		return c.pool.do(formatCommand(args), &c.replOffset)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := io.WriteString(c.conn, formatCommand(args)); err != nil {
+		return nil, err
+	}
+	return readHintedReply(c.reader, &c.replOffset)
+}
+
+// ReplOffset returns the highest replication offset the server reported in
+// the hints of replies so far, which a connection asks for with
+// "HELLO 3 HINTS". A replica that has processed the write stream up to this
+// offset has applied every write this client has seen, so reads routed to
+// it see them too.
+func (c *Client) ReplOffset() int64 {
+	if c.failover != nil {
+		return c.failover.current().ReplOffset()
+	}
+	return c.replOffset.Load()
+}
+
+// address returns the address of the server commands go to, which for a
+// client following the sentinels is the current master's.
+func (c *Client) address() string {
+	if c.failover != nil {
+		c.failover.mu.RLock()
+		defer c.failover.mu.RUnlock()
+		return c.failover.addr
+	}
+	return c.addr
+}
+
+// formatCommand encodes a command as a RESP array of bulk strings.
+func formatCommand(args []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// readReply reads a single RESP reply.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid reply line %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '#':
+		return line[1:] == "t", nil
+	case '*', '%', '|', '>':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		if line[0] == '%' || line[0] == '|' {
+			count *= 2
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			item, err := readReply(r)
+			if err != nil {
+				if _, isServerErr := err.(Error); !isServerErr {
+					return nil, err
+				}
+				item = err
+			}
+			items[i] = item
+		}
+		if line[0] == '|' {
+			// An attribute only annotates the reply that follows it.
+			return readReply(r)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply type %q", line[0])
+}
+
+// readReplies reads n replies, such as those of a pipeline, in order. Error
+// replies are returned as Error values in the slice; the error returned is
+// only set when the connection failed.
+func readReplies(r *bufio.Reader, n int, offset *atomic.Int64) ([]interface{}, error) {
+	replies := make([]interface{}, n)
+	for i := range replies {
+		reply, err := readHintedReply(r, offset)
+		if err != nil {
+			var serverErr Error
+			if !errors.As(err, &serverErr) {
+				return nil, err
+			}
+			reply = serverErr
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readHintedReply reads a reply like readReply, raising offset to the
+// replication offset of a hints attribute sent before the reply.
+func readHintedReply(r *bufio.Reader, offset *atomic.Int64) (interface{}, error) {
+	if b, err := r.Peek(1); err != nil || b[0] != '|' {
+		return readReply(r)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid attribute length %q", line)
+	}
+	for i := 0; i < count; i++ {
+		name, err := readReply(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readReply(r)
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := value.(int64); ok && name == "repl-offset" {
+			for {
+				cur := offset.Load()
+				if n <= cur || offset.CompareAndSwap(cur, n) {
+					break
+				}
+			}
+		}
+	}
+	return readReply(r)
+}
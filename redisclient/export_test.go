@@ -0,0 +1,8 @@
+package redisclient
+
+import "time"
+
+// SetRateLimiterClock replaces the clock of r, so tests control its windows.
+func SetRateLimiterClock(r *RateLimiter, now func() time.Time) {
+	r.now = now
+}
@@ -0,0 +1,224 @@
+package redisclient_test
+
+import (
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/redisclient"
+	"github.com/nazeeeef007/redis-clone/server"
+)
+
+// The tests are an external package, as the server imports redisclient.
+
+// testAddr is the address of the in-process server the tests run against.
+var testAddr string
+
+// TestMain starts a server without persistence in a temporary directory,
+// so the tests leave no files behind.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "redisclient")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testAddr = ln.Addr().String()
+	ln.Close()
+	srv := server.NewServer(server.Config{DisableAOF: true, Hz: 10})
+	go srv.Listen(testAddr)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", testAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Fatalf("the server didn't start: %v", err)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// dialTest connects to the test server and deletes keys once the test ends.
+func dialTest(t *testing.T, keys ...string) *redisclient.Client {
+	t.Helper()
+	c, err := redisclient.Dial(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if len(keys) > 0 {
+			c.Do(append([]string{"DEL"}, keys...)...)
+		}
+		c.Close()
+	})
+	return c
+}
+
+func TestSemaphore(t *testing.T) {
+	c := dialTest(t, "sem")
+	sem := c.NewSemaphore("sem", 2, time.Minute)
+	for i := range 2 {
+		if ok, err := sem.TryAcquire(); err != nil || !ok {
+			t.Fatalf("TryAcquire #%d = %v, %v, want true", i+1, ok, err)
+		}
+	}
+	if ok, err := sem.TryAcquire(); err != nil || ok {
+		t.Fatalf("TryAcquire beyond the limit = %v, %v, want false", ok, err)
+	}
+	if v, err := c.Do("GET", "sem"); err != nil || v != "2" {
+		t.Errorf("counter after a refused TryAcquire = %v, %v, want 2", v, err)
+	}
+
+	if err := sem.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := sem.TryAcquire(); err != nil || !ok {
+		t.Fatalf("TryAcquire after Release = %v, %v, want true", ok, err)
+	}
+}
+
+func TestSemaphoreLease(t *testing.T) {
+	c := dialTest(t, "sem:lease")
+	sem := c.NewSemaphore("sem:lease", 1, 50*time.Millisecond)
+	if ok, err := sem.TryAcquire(); err != nil || !ok {
+		t.Fatalf("TryAcquire = %v, %v, want true", ok, err)
+	}
+	// A holder that never releases its permit gives it back once the lease
+	// runs out.
+	time.Sleep(200 * time.Millisecond)
+	if ok, err := sem.TryAcquire(); err != nil || !ok {
+		t.Fatalf("TryAcquire after the lease = %v, %v, want true", ok, err)
+	}
+}
+
+func TestSemaphoreReleaseAfterExpiry(t *testing.T) {
+	c := dialTest(t, "sem:expired")
+	sem := c.NewSemaphore("sem:expired", 1, 0)
+	if ok, err := sem.TryAcquire(); err != nil || !ok {
+		t.Fatalf("TryAcquire = %v, %v, want true", ok, err)
+	}
+	// The counter expiring while the permit is held must not leave it
+	// negative once the permit is released.
+	if _, err := c.Do("DEL", "sem:expired"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sem.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do("EXISTS", "sem:expired"); err != nil || v != int64(0) {
+		t.Errorf("EXISTS after Release = %v, %v, want 0", v, err)
+	}
+}
+
+func TestSemaphoreWrongType(t *testing.T) {
+	c := dialTest(t, "sem:string")
+	if _, err := c.Do("SET", "sem:string", "not a number"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.NewSemaphore("sem:string", 1, 0).TryAcquire(); err == nil {
+		t.Errorf("TryAcquire on a non-integer key = %v, want an error", ok)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	// The windows are named after their index, so the keys are known.
+	const window = time.Second
+	start := time.Unix(1_000_000, 0)
+	c := dialTest(t, "rl:999999", "rl:1000000", "rl:1000001")
+	rl := c.NewRateLimiter("rl", 3, window)
+
+	redisclient.SetRateLimiterClock(rl, func() time.Time { return start })
+	for i := range 3 {
+		if ok, err := rl.Allow(); err != nil || !ok {
+			t.Fatalf("Allow #%d = %v, %v, want true", i+1, ok, err)
+		}
+	}
+	if ok, err := rl.Allow(); err != nil || ok {
+		t.Fatalf("Allow beyond the limit = %v, %v, want false", ok, err)
+	}
+	if v, err := c.Do("GET", "rl:1000000"); err != nil || v != "3" {
+		t.Errorf("counter after a refused Allow = %v, %v, want 3", v, err)
+	}
+
+	// Half way through the next window, half of the previous window's
+	// events still count: 3*0.5 + 1 fits, 3*0.5 + 2 doesn't.
+	redisclient.SetRateLimiterClock(rl, func() time.Time { return start.Add(window + window/2) })
+	if ok, err := rl.Allow(); err != nil || !ok {
+		t.Fatalf("Allow in the next window = %v, %v, want true", ok, err)
+	}
+	if ok, err := rl.Allow(); err != nil || ok {
+		t.Fatalf("Allow over the sliding estimate = %v, %v, want false", ok, err)
+	}
+}
+
+func TestRateLimiterExpiry(t *testing.T) {
+	const window = 50 * time.Millisecond
+	start := time.Unix(1_000_000, 0)
+	c := dialTest(t, "rl:expiry:20000000")
+	rl := c.NewRateLimiter("rl:expiry", 1, window)
+	redisclient.SetRateLimiterClock(rl, func() time.Time { return start })
+	if ok, err := rl.Allow(); err != nil || !ok {
+		t.Fatalf("Allow = %v, %v, want true", ok, err)
+	}
+	// Windows are kept until the end of the next one, then expire.
+	time.Sleep(4 * window)
+	if v, err := c.Do("EXISTS", "rl:expiry:20000000"); err != nil || v != int64(0) {
+		t.Errorf("EXISTS of an expired window = %v, %v, want 0", v, err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	c := dialTest(t, "ids")
+	first := c.NewIDGenerator("ids", 3)
+	second := c.NewIDGenerator("ids", 3)
+
+	seen := make(map[int64]bool)
+	var last int64
+	for range 7 {
+		id, err := first.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= last {
+			t.Fatalf("Next = %d after %d, want increasing IDs", id, last)
+		}
+		last = id
+		seen[id] = true
+		// Interleaving another generator on the same key must not hand out
+		// the same IDs.
+		other, err := second.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[other] {
+			t.Fatalf("ID %d handed out twice", other)
+		}
+		seen[other] = true
+	}
+	// Each generator reserved three blocks of three.
+	if v, err := c.Do("GET", "ids"); err != nil || v != "18" {
+		t.Errorf("counter = %v, %v, want 18", v, err)
+	}
+}
+
+func TestIDGeneratorBlockSize(t *testing.T) {
+	c := dialTest(t, "ids:single")
+	g := c.NewIDGenerator("ids:single", 0)
+	for want := int64(1); want <= 3; want++ {
+		if id, err := g.Next(); err != nil || id != want {
+			t.Fatalf("Next = %d, %v, want %d", id, err, want)
+		}
+	}
+}
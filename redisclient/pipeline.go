@@ -0,0 +1,307 @@
+package redisclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned by commands sent on a closed client.
+var ErrClosed = errors.New("redisclient: client is closed")
+
+// maxPipelineBatch caps the commands written to a connection in one go.
+const maxPipelineBatch = 512
+
+// Options configure a client created by DialWithOptions.
+type Options struct {
+	// AutoPipeline coalesces commands sent concurrently from many goroutines
+	// into pipelines: while a connection is busy writing, the commands that
+	// queue up behind it are written together and their replies read back
+	// in order. Callers still see one Do call per reply. Commands that block
+	// the connection on the server, such as BLPOP, stall every command
+	// pipelined behind them and shouldn't be sent on such a client.
+	AutoPipeline bool
+	// Conns is the number of connections commands are spread over when
+	// AutoPipeline is set. Zero means one.
+	Conns int
+
+	// Pool, unless AutoPipeline is set, runs each command on a connection
+	// of a pool, so that commands from different goroutines run
+	// concurrently and one blocked on the server, such as BLPOP, only holds
+	// up its own connection. Connections are dialed as needed and kept
+	// for reuse once their command is done.
+	Pool bool
+	// MaxActive limits the pooled connections in use at a time; commands
+	// wait for one to be free beyond it. Zero means no limit.
+	MaxActive int
+	// MaxIdle limits the pooled connections kept open while unused; those
+	// beyond it are closed when their command is done. Zero means no limit.
+	MaxIdle int
+	// IdleCheck is how long a pooled connection may be unused before it is
+	// checked with a PING when taken again, and replaced if the check
+	// fails. Zero means connections are never checked.
+	IdleCheck time.Duration
+}
+
+// DialWithOptions connects to the server at addr with opts. Without
+// AutoPipeline or Pool it is the same as Dial.
+func DialWithOptions(addr string, opts Options) (*Client, error) {
+	if !opts.AutoPipeline {
+		if opts.Pool {
+			return dialPool(addr, opts)
+		}
+		return Dial(addr)
+	}
+	c := &Client{addr: addr}
+	for i := 0; i < max(opts.Conns, 1); i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.pipes = append(c.pipes, newPipeConn(conn, &c.replOffset))
+	}
+	return c, nil
+}
+
+// call is a command waiting for its reply on an auto-pipelined connection,
+// or, when n is set, a batch of n commands waiting for theirs.
+type call struct {
+	cmd     string
+	n       int
+	reply   interface{}
+	replies []interface{}
+	err     error
+	done    chan struct{}
+}
+
+// pipeConn is one auto-pipelined connection. A writer goroutine batches the
+// queued commands onto the connection and hands them, in the order written,
+// to a reader goroutine that matches them with their replies.
+type pipeConn struct {
+	conn    net.Conn
+	queue   chan *call
+	pending chan *call
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newPipeConn(conn net.Conn, replOffset *atomic.Int64) *pipeConn {
+	p := &pipeConn{
+		conn:    conn,
+		queue:   make(chan *call, maxPipelineBatch),
+		pending: make(chan *call, maxPipelineBatch),
+	}
+	go p.writeLoop()
+	go p.readLoop(bufio.NewReader(conn), replOffset)
+	return p
+}
+
+// do queues a command and waits for its reply.
+func (p *pipeConn) do(cmd string) (interface{}, error) {
+	cl := &call{cmd: cmd, done: make(chan struct{})}
+	if err := p.send(cl); err != nil {
+		return nil, err
+	}
+	return cl.reply, cl.err
+}
+
+// doBatch queues n commands, written together, and waits for their replies.
+func (p *pipeConn) doBatch(cmds string, n int) ([]interface{}, error) {
+	cl := &call{cmd: cmds, n: n, done: make(chan struct{})}
+	if err := p.send(cl); err != nil {
+		return nil, err
+	}
+	return cl.replies, cl.err
+}
+
+// send queues a call and waits for it to be done.
+func (p *pipeConn) send(cl *call) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrClosed
+	}
+	p.queue <- cl
+	p.mu.RUnlock()
+	<-cl.done
+	return nil
+}
+
+// writeLoop writes queued commands, everything queued since the last write
+// going out in one batch.
+func (p *pipeConn) writeLoop() {
+	defer close(p.pending)
+	buf := make([]byte, 0, 4096)
+	for cl := range p.queue {
+		buf = append(buf[:0], cl.cmd...)
+		p.pending <- cl
+	batch:
+		for n := 1; n < maxPipelineBatch; n++ {
+			select {
+			case next, ok := <-p.queue:
+				if !ok {
+					break batch
+				}
+				buf = append(buf, next.cmd...)
+				p.pending <- next
+			default:
+				break batch
+			}
+		}
+		if _, err := p.conn.Write(buf); err != nil {
+			// The reader fails the pending calls once the connection is closed.
+			p.conn.Close()
+		}
+	}
+}
+
+// readLoop reads a reply for each written command. Once the connection
+// fails, every call still pending, or queued later, gets the error.
+func (p *pipeConn) readLoop(r *bufio.Reader, replOffset *atomic.Int64) {
+	var connErr error
+	for cl := range p.pending {
+		if connErr == nil {
+			if cl.n > 0 {
+				cl.replies, cl.err = readReplies(r, cl.n, replOffset)
+			} else {
+				cl.reply, cl.err = readHintedReply(r, replOffset)
+			}
+			var serverErr Error
+			if cl.err != nil && !errors.As(cl.err, &serverErr) {
+				connErr = cl.err
+				if connErr == io.EOF {
+					connErr = io.ErrUnexpectedEOF
+				}
+				p.conn.Close()
+			}
+		} else {
+			cl.err = connErr
+		}
+		close(cl.done)
+	}
+}
+
+// close stops accepting commands and closes the connection. Calls still
+// waiting for a reply fail.
+func (p *pipeConn) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.queue)
+	return p.conn.Close()
+}
+
+// pipeline sends a command on the next auto-pipelined connection.
+func (c *Client) pipeline(args []string) (interface{}, error) {
+	p := c.pipes[(c.next.Add(1)-1)%uint64(len(c.pipes))]
+	return p.do(formatCommand(args))
+}
+
+// ErrTxAborted is returned by the Exec of a TxPipeline when the transaction
+// didn't run because a key watched with WATCH changed.
+var ErrTxAborted = errors.New("redisclient: transaction aborted, a watched key changed")
+
+// Pipeline queues commands to be sent in a single write, their replies
+// being read back together, which saves a round trip per command:
+//
+//	p := c.Pipeline()
+//	p.Do("INCR", "hits")
+//	p.Do("EXPIRE", "hits", "60")
+//	replies, err := p.Exec()
+//
+// A Pipeline is not safe for concurrent use. The client it was made from is,
+// and the commands of a pipeline are never interleaved with others.
+type Pipeline struct {
+	c   *Client
+	tx  bool
+	buf strings.Builder
+	n   int
+}
+
+// Pipeline returns an empty pipeline sending its commands on c.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// TxPipeline returns an empty pipeline whose commands run as a transaction,
+// wrapped in MULTI and EXEC.
+func (c *Client) TxPipeline() *Pipeline {
+	return &Pipeline{c: c, tx: true}
+}
+
+// Do queues a command.
+func (p *Pipeline) Do(args ...string) {
+	p.buf.WriteString(formatCommand(args))
+	p.n++
+}
+
+// Len returns the number of commands queued.
+func (p *Pipeline) Len() int {
+	return p.n
+}
+
+// Exec sends the queued commands and returns their replies, in order, leaving
+// the pipeline empty. Error replies are returned as Error values among the
+// replies; the error is set when the replies couldn't be read. For a
+// TxPipeline it is also set when the transaction didn't run, to ErrTxAborted
+// or the error the server replied to EXEC with.
+func (p *Pipeline) Exec() ([]interface{}, error) {
+	if p.n == 0 {
+		return nil, nil
+	}
+	cmds, n := p.buf.String(), p.n
+	p.buf.Reset()
+	p.n = 0
+	if !p.tx {
+		return p.c.doBatch(cmds, n)
+	}
+	cmds = formatCommand([]string{"MULTI"}) + cmds + formatCommand([]string{"EXEC"})
+	replies, err := p.c.doBatch(cmds, n+2)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	switch exec := replies[n+1].(type) {
+	case []interface{}:
+		return exec, nil
+	case Error:
+		return nil, exec
+	case nil:
+		return nil, ErrTxAborted
+	}
+	return nil, fmt.Errorf("unexpected EXEC reply: %v", replies[n+1])
+}
+
+// doBatch sends n formatted commands in one write and reads their replies.
+func (c *Client) doBatch(cmds string, n int) ([]interface{}, error) {
+	if c.failover != nil {
+		return c.failover.current().doBatch(cmds, n)
+	}
+	if c.pipes != nil {
+		p := c.pipes[(c.next.Add(1)-1)%uint64(len(c.pipes))]
+		return p.doBatch(cmds, n)
+	}
+	if c.pool != nil {
+		return c.pool.doBatch(cmds, n, &c.replOffset)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := io.WriteString(c.conn, cmds); err != nil {
+		return nil, err
+	}
+	return readReplies(c.reader, n, &c.replOffset)
+}
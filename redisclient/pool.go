@@ -0,0 +1,172 @@
+package redisclient
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleCheckTimeout bounds the PING that checks an idle pooled connection.
+const idleCheckTimeout = time.Second
+
+// pool is the set of connections of a client dialed with Options.Pool.
+// Commands take an idle connection, or dial a new one, and put it back once
+// their reply is read; connections that failed are closed instead.
+type pool struct {
+	addr string
+	opts Options
+	// active holds a token for every connection in use when MaxActive is
+	// set, so taking one blocks at the limit.
+	active chan struct{}
+
+	mu     sync.Mutex
+	idle   []*poolConn
+	closed bool
+}
+
+// poolConn is a pooled connection and when its last command finished.
+type poolConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	used   time.Time
+}
+
+// dialPool creates a pooled client, dialing one connection to check that
+// the server is reachable.
+func dialPool(addr string, opts Options) (*Client, error) {
+	p := &pool{addr: addr, opts: opts}
+	if opts.MaxActive > 0 {
+		p.active = make(chan struct{}, opts.MaxActive)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p.idle = append(p.idle, &poolConn{conn: conn, reader: bufio.NewReader(conn), used: time.Now()})
+	return &Client{addr: addr, pool: p}, nil
+}
+
+// get takes an idle connection, checking it first if it was unused for
+// IdleCheck or more, or dials a new one.
+func (p *pool) get() (*poolConn, error) {
+	if p.active != nil {
+		p.active <- struct{}{}
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.release()
+			return nil, ErrClosed
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// The most recently used connection is the least likely to have
+		// been dropped.
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		if p.opts.IdleCheck > 0 && time.Since(pc.used) >= p.opts.IdleCheck && !pc.healthy() {
+			pc.conn.Close()
+			continue
+		}
+		return pc, nil
+	}
+	conn, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return &poolConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// put returns a connection taken by get to the pool, or closes it if its
+// command failed with something other than an error reply, or if MaxIdle
+// connections are already idle.
+func (p *pool) put(pc *poolConn, err error) {
+	defer p.release()
+	var serverErr Error
+	broken := err != nil && !errors.As(err, &serverErr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if broken || p.closed || (p.opts.MaxIdle > 0 && len(p.idle) >= p.opts.MaxIdle) {
+		pc.conn.Close()
+		return
+	}
+	pc.used = time.Now()
+	p.idle = append(p.idle, pc)
+}
+
+// release gives back the token of a connection taken by get.
+func (p *pool) release() {
+	if p.active != nil {
+		<-p.active
+	}
+}
+
+// healthy reports whether the connection still answers a PING.
+func (pc *poolConn) healthy() bool {
+	pc.conn.SetDeadline(time.Now().Add(idleCheckTimeout))
+	defer pc.conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(pc.conn, formatCommand([]string{"PING"})); err != nil {
+		return false
+	}
+	reply, err := readReply(pc.reader)
+	return err == nil && reply == "PONG"
+}
+
+// do runs a formatted command on a pooled connection.
+func (p *pool) do(cmd string, offset *atomic.Int64) (interface{}, error) {
+	pc, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	if _, err = io.WriteString(pc.conn, cmd); err == nil {
+		reply, err = readHintedReply(pc.reader, offset)
+	}
+	p.put(pc, err)
+	return reply, err
+}
+
+// doBatch runs n formatted commands, written together, on a pooled
+// connection.
+func (p *pool) doBatch(cmds string, n int, offset *atomic.Int64) ([]interface{}, error) {
+	pc, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	var replies []interface{}
+	if _, err = io.WriteString(pc.conn, cmds); err == nil {
+		replies, err = readReplies(pc.reader, n, offset)
+	}
+	p.put(pc, err)
+	return replies, err
+}
+
+// close closes the idle connections. Those in use are closed as their
+// commands finish.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	var err error
+	for _, pc := range p.idle {
+		if cerr := pc.conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	p.idle = nil
+	return err
+}
@@ -0,0 +1,254 @@
+package redisclient
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delays between attempts to reconnect a subscription, doubling from the
+// first to the last.
+const (
+	resubscribeDelay    = 100 * time.Millisecond
+	maxResubscribeDelay = 5 * time.Second
+)
+
+// Message is a message published to a channel a Subscription is subscribed
+// to.
+type Message struct {
+	// Pattern is the pattern the channel matched, for messages received
+	// through PSubscribe, and empty otherwise.
+	Pattern string
+	Channel string
+	Payload string
+}
+
+// Subscription is a connection of its own subscribed to channels and
+// patterns, whose messages it delivers on the channel Messages returns:
+//
+//	sub, err := c.Subscribe("news")
+//	...
+//	for msg := range sub.Messages() {
+//		fmt.Println(msg.Channel, msg.Payload)
+//	}
+//
+// When the connection breaks, the subscription reconnects, to the current
+// master for a client following the sentinels, and subscribes again to
+// everything it was subscribed to. Messages published while it was
+// disconnected are lost. Messages must be read, or the subscription closed,
+// for it to keep reading from the server.
+type Subscription struct {
+	addr     func() string
+	messages chan Message
+	done     chan struct{}
+
+	mu       sync.Mutex
+	conn     net.Conn
+	channels map[string]bool
+	patterns map[string]bool
+	closed   bool
+}
+
+// Subscribe opens a subscription to channels.
+func (c *Client) Subscribe(channels ...string) (*Subscription, error) {
+	return c.subscribe(channels, nil)
+}
+
+// PSubscribe opens a subscription to the channels matching patterns.
+func (c *Client) PSubscribe(patterns ...string) (*Subscription, error) {
+	return c.subscribe(nil, patterns)
+}
+
+// subscribe opens a subscription to channels and patterns.
+func (c *Client) subscribe(channels, patterns []string) (*Subscription, error) {
+	s := &Subscription{
+		addr:     c.address,
+		messages: make(chan Message, 100),
+		done:     make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+	for _, ch := range channels {
+		s.channels[ch] = true
+	}
+	for _, pattern := range patterns {
+		s.patterns[pattern] = true
+	}
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	go s.run(conn)
+	return s, nil
+}
+
+// Messages returns the channel messages are delivered on. It is closed when
+// the subscription is.
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Subscribe adds channels to the subscription.
+func (s *Subscription) Subscribe(channels ...string) error {
+	return s.send("SUBSCRIBE", s.channels, channels, true)
+}
+
+// PSubscribe adds the channels matching patterns to the subscription.
+func (s *Subscription) PSubscribe(patterns ...string) error {
+	return s.send("PSUBSCRIBE", s.patterns, patterns, true)
+}
+
+// Unsubscribe removes channels from the subscription. The subscription
+// stays open when none are left.
+func (s *Subscription) Unsubscribe(channels ...string) error {
+	return s.send("UNSUBSCRIBE", s.channels, channels, false)
+}
+
+// PUnsubscribe removes patterns from the subscription.
+func (s *Subscription) PUnsubscribe(patterns ...string) error {
+	return s.send("PUNSUBSCRIBE", s.patterns, patterns, false)
+}
+
+// send records a change to the subscription and sends it to the server. If
+// the connection is broken the change is made when it is reestablished, so
+// only a closed subscription fails.
+func (s *Subscription) send(cmd string, set map[string]bool, names []string, add bool) error {
+	if len(names) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, name := range names {
+		if add {
+			set[name] = true
+		} else {
+			delete(set, name)
+		}
+	}
+	io.WriteString(s.conn, formatCommand(append([]string{cmd}, names...)))
+	return nil
+}
+
+// Close closes the subscription and its connection.
+func (s *Subscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	return s.conn.Close()
+}
+
+// connect dials the server, subscribes to everything the subscription is
+// subscribed to and makes the connection the subscription's.
+func (s *Subscription) connect() (net.Conn, error) {
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	cmds := ""
+	if len(s.channels) > 0 {
+		cmds += formatCommand(append([]string{"SUBSCRIBE"}, sortedKeys(s.channels)...))
+	}
+	if len(s.patterns) > 0 {
+		cmds += formatCommand(append([]string{"PSUBSCRIBE"}, sortedKeys(s.patterns)...))
+	}
+	if _, err := io.WriteString(conn, cmds); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// run delivers the messages read from conn, reconnecting whenever the
+// connection fails, until the subscription is closed.
+func (s *Subscription) run(conn net.Conn) {
+	defer close(s.messages)
+	for {
+		s.read(conn)
+		conn.Close()
+		if conn = s.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// read delivers the messages read from conn until it fails or the
+// subscription is closed.
+func (s *Subscription) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			if _, isServerErr := err.(Error); isServerErr {
+				continue
+			}
+			return
+		}
+		// Other replies confirm subscriptions, which need no action.
+		var msg Message
+		switch fields, _ := reply.([]interface{}); {
+		case len(fields) == 3 && fields[0] == "message":
+			msg.Channel, _ = fields[1].(string)
+			msg.Payload, _ = fields[2].(string)
+		case len(fields) == 4 && fields[0] == "pmessage":
+			msg.Pattern, _ = fields[1].(string)
+			msg.Channel, _ = fields[2].(string)
+			msg.Payload, _ = fields[3].(string)
+		default:
+			continue
+		}
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reconnect connects the subscription again, waiting longer after each
+// failed attempt. It returns nil once the subscription is closed.
+func (s *Subscription) reconnect() net.Conn {
+	delay := resubscribeDelay
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(delay):
+		}
+		conn, err := s.connect()
+		if err == ErrClosed {
+			return nil
+		}
+		if err != nil {
+			delay = min(2*delay, maxResubscribeDelay)
+			continue
+		}
+		return conn
+	}
+}
+
+// sortedKeys returns the keys of a set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
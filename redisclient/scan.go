@@ -0,0 +1,132 @@
+package redisclient
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ScanOptions configures a SCAN-family iteration.
+type ScanOptions struct {
+	// Match restricts the results to elements matching a glob pattern.
+	Match string
+	// Count is a hint for how many elements the server returns per page.
+	Count int
+	// Type restricts SCAN to keys of the given type. It is ignored by the
+	// per-key variants.
+	Type string
+}
+
+// ScanIterator walks the results of SCAN, SSCAN, HSCAN or ZSCAN, fetching
+// pages from the server as needed so callers never handle cursors:
+//
+//	it := c.Scan(redisclient.ScanOptions{Match: "user:*"})
+//	for it.Next() {
+//		fmt.Println(it.Val())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// For HSCAN and ZSCAN the iterator yields field (or member) and value (or
+// score) as consecutive elements.
+type ScanIterator struct {
+	c    *Client
+	cmd  string
+	key  string
+	opts ScanOptions
+
+	cursor string
+	done   bool
+	page   []string
+	val    string
+	err    error
+}
+
+// Scan returns an iterator over the keyspace.
+func (c *Client) Scan(opts ScanOptions) *ScanIterator {
+	return &ScanIterator{c: c, cmd: "SCAN", opts: opts, cursor: "0"}
+}
+
+// SScan returns an iterator over the members of a set.
+func (c *Client) SScan(key string, opts ScanOptions) *ScanIterator {
+	return &ScanIterator{c: c, cmd: "SSCAN", key: key, opts: opts, cursor: "0"}
+}
+
+// HScan returns an iterator over the fields and values of a hash.
+func (c *Client) HScan(key string, opts ScanOptions) *ScanIterator {
+	return &ScanIterator{c: c, cmd: "HSCAN", key: key, opts: opts, cursor: "0"}
+}
+
+// ZScan returns an iterator over the members and scores of a sorted set.
+func (c *Client) ZScan(key string, opts ScanOptions) *ScanIterator {
+	return &ScanIterator{c: c, cmd: "ZSCAN", key: key, opts: opts, cursor: "0"}
+}
+
+// Next advances the iterator. It returns false when the iteration is
+// complete or an error occurred.
+func (it *ScanIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.err = it.fetch()
+	}
+	it.val = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+// Val returns the current element.
+func (it *ScanIterator) Val() string {
+	return it.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// fetch requests the next page from the server.
+func (it *ScanIterator) fetch() error {
+	args := []string{it.cmd}
+	if it.cmd != "SCAN" {
+		args = append(args, it.key)
+	}
+	args = append(args, it.cursor)
+	if it.opts.Match != "" {
+		args = append(args, "MATCH", it.opts.Match)
+	}
+	if it.opts.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(it.opts.Count))
+	}
+	if it.opts.Type != "" && it.cmd == "SCAN" {
+		args = append(args, "TYPE", it.opts.Type)
+	}
+
+	reply, err := it.c.Do(args...)
+	if err != nil {
+		return err
+	}
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) != 2 {
+		return fmt.Errorf("unexpected %s reply: %v", it.cmd, reply)
+	}
+	cursor, ok := parts[0].(string)
+	if !ok {
+		return fmt.Errorf("unexpected %s cursor: %v", it.cmd, parts[0])
+	}
+	elements, ok := parts[1].([]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected %s elements: %v", it.cmd, parts[1])
+	}
+	for _, element := range elements {
+		str, ok := element.(string)
+		if !ok {
+			return fmt.Errorf("unexpected %s element: %v", it.cmd, element)
+		}
+		it.page = append(it.page, str)
+	}
+	it.cursor = cursor
+	it.done = cursor == "0"
+	return nil
+}
@@ -0,0 +1,225 @@
+package redisclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sentinelRetryDelay is how long the failover watcher waits before trying
+// the next sentinel after losing its connection.
+const sentinelRetryDelay = time.Second
+
+// SentinelOptions configure a client created by DialSentinel.
+type SentinelOptions struct {
+	// Sentinels are the addresses of the sentinels to ask for the master,
+	// tried in order.
+	Sentinels []string
+	// MasterName is the name the sentinels monitor the master under.
+	MasterName string
+	// Options configure the connections to the master.
+	Options
+}
+
+// failover keeps a client connected to the master the sentinels currently
+// report. It follows +switch-master events on a subscription to one of the
+// sentinels, and also asks them again when a command fails in a way that
+// suggests the master changed, in case an event was missed.
+type failover struct {
+	opts SentinelOptions
+
+	mu     sync.RWMutex
+	master *Client
+	addr   string
+	closed bool
+	// sub is the connection the events are read from.
+	sub net.Conn
+}
+
+// DialSentinel asks the sentinels for the address of the master named in
+// opts and connects to it. Commands on the returned client go to whatever
+// the master is at the time: when the sentinels fail over, the connections
+// to the old master are replaced with ones to the new master, and a command
+// that fails because its connection broke or the old master was demoted is
+// retried there once.
+func DialSentinel(opts SentinelOptions) (*Client, error) {
+	if len(opts.Sentinels) == 0 {
+		return nil, errors.New("redisclient: no sentinels given")
+	}
+	f := &failover{opts: opts}
+	addr, err := f.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	if f.master, err = DialWithOptions(addr, opts.Options); err != nil {
+		return nil, err
+	}
+	f.addr = addr
+	go f.watch()
+	return &Client{failover: f}, nil
+}
+
+// masterAddr asks the sentinels for the master's address, returning the
+// first answer.
+func (f *failover) masterAddr() (string, error) {
+	var lastErr error
+	for _, sentinel := range f.opts.Sentinels {
+		c, err := Dial(sentinel)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := c.Do("SENTINEL", "get-master-addr-by-name", f.opts.MasterName)
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if pair, ok := reply.([]interface{}); ok && len(pair) == 2 {
+			host, _ := pair[0].(string)
+			port, _ := pair[1].(string)
+			return net.JoinHostPort(host, port), nil
+		}
+		lastErr = fmt.Errorf("sentinel %s doesn't know master %q", sentinel, f.opts.MasterName)
+	}
+	return "", fmt.Errorf("redisclient: no sentinel reported the master: %w", lastErr)
+}
+
+// current returns the client of the current master.
+func (f *failover) current() *Client {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.master
+}
+
+// switchTo connects to the master at addr, unless it already is the
+// current one, and closes the connections to the previous master.
+func (f *failover) switchTo(addr string) error {
+	f.mu.RLock()
+	same := f.addr == addr || f.closed
+	f.mu.RUnlock()
+	if same {
+		return nil
+	}
+	master, err := DialWithOptions(addr, f.opts.Options)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if f.closed || f.addr == addr {
+		f.mu.Unlock()
+		master.Close()
+		return nil
+	}
+	old := f.master
+	f.master, f.addr = master, addr
+	f.mu.Unlock()
+	old.Close()
+	return nil
+}
+
+// do sends a command to the master, retrying it once on the master the
+// sentinels report if it failed on a broken connection or a demoted master.
+func (f *failover) do(args []string) (interface{}, error) {
+	c := f.current()
+	reply, err := c.Do(args...)
+	if err == nil || !masterChanged(err) {
+		return reply, err
+	}
+	addr, aerr := f.masterAddr()
+	if aerr != nil {
+		return reply, err
+	}
+	if serr := f.switchTo(addr); serr != nil {
+		return reply, err
+	}
+	if next := f.current(); next != c {
+		return next.Do(args...)
+	}
+	return reply, err
+}
+
+// masterChanged reports whether a command error may be due to a failover.
+func masterChanged(err error) bool {
+	var serverErr Error
+	if errors.As(err, &serverErr) {
+		return strings.HasPrefix(string(serverErr), "READONLY")
+	}
+	return true
+}
+
+// watch follows the +switch-master events of the sentinels, moving to the
+// next sentinel whenever the subscription breaks, until the client is
+// closed. After connecting it checks for a failover it may have missed.
+func (f *failover) watch() {
+	for i := 0; ; i++ {
+		sentinel := f.opts.Sentinels[i%len(f.opts.Sentinels)]
+		if conn, err := net.Dial("tcp", sentinel); err == nil {
+			f.mu.Lock()
+			if f.closed {
+				f.mu.Unlock()
+				conn.Close()
+				return
+			}
+			f.sub = conn
+			f.mu.Unlock()
+			f.follow(conn)
+			conn.Close()
+		}
+		f.mu.RLock()
+		closed := f.closed
+		f.mu.RUnlock()
+		if closed {
+			return
+		}
+		time.Sleep(sentinelRetryDelay)
+	}
+}
+
+// follow subscribes to the failover events on conn and acts on those about
+// the master until the connection fails.
+func (f *failover) follow(conn net.Conn) error {
+	if _, err := io.WriteString(conn, formatCommand([]string{"SUBSCRIBE", "+switch-master"})); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	if _, err := readReply(r); err != nil {
+		return err
+	}
+	if addr, err := f.masterAddr(); err == nil {
+		f.switchTo(addr)
+	}
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+		// The message is "<master name> <old ip> <old port> <new ip> <new port>".
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+		fields := strings.Fields(payload)
+		if len(fields) == 5 && fields[0] == f.opts.MasterName {
+			f.switchTo(net.JoinHostPort(fields[3], fields[4]))
+		}
+	}
+}
+
+// close stops following the sentinels and closes the master connections.
+func (f *failover) close() error {
+	f.mu.Lock()
+	f.closed = true
+	if f.sub != nil {
+		f.sub.Close()
+	}
+	master := f.master
+	f.mu.Unlock()
+	return master.Close()
+}
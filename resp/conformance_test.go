@@ -0,0 +1,167 @@
+package resp
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// conformanceVector is a RESP value and its encoding. The decoder must read
+// wire as value, and the encoder must write value as wire, or as encoded
+// when set, for the forms the encoder doesn't produce, such as streamed
+// strings and aggregates.
+type conformanceVector struct {
+	name    string
+	wire    string
+	value   Value
+	encoded string
+}
+
+var conformanceVectors = []conformanceVector{
+	// RESP2.
+	{name: "simple string", wire: "+OK\r\n", value: Value{Type: SimpleString, String: "OK"}},
+	{name: "empty simple string", wire: "+\r\n", value: Value{Type: SimpleString}},
+	{name: "error", wire: "-ERR unknown command 'FOO'\r\n", value: Value{Type: Error, String: "ERR unknown command 'FOO'"}},
+	{name: "integer", wire: ":1000\r\n", value: Value{Type: Integer, Integer: 1000}},
+	{name: "negative integer", wire: ":-42\r\n", value: Value{Type: Integer, Integer: -42}},
+	{name: "bulk string", wire: "$5\r\nhello\r\n", value: Value{Type: BulkString, String: "hello"}},
+	{name: "empty bulk string", wire: "$0\r\n\r\n", value: Value{Type: BulkString}},
+	{name: "binary bulk string", wire: "$4\r\na\r\nb\r\n", value: Value{Type: BulkString, String: "a\r\nb"}},
+	{name: "null bulk string", wire: "$-1\r\n", value: Value{Type: BulkString, Null: true}},
+	{name: "array", wire: "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", value: Value{Type: Array, Array: []Value{
+		{Type: BulkString, String: "GET"},
+		{Type: BulkString, String: "k"},
+	}}},
+	{name: "empty array", wire: "*0\r\n", value: Value{Type: Array, Array: []Value{}}},
+	{name: "null array", wire: "*-1\r\n", value: Value{Type: Array, Null: true}},
+	{name: "nested array", wire: "*2\r\n*1\r\n:1\r\n$-1\r\n", value: Value{Type: Array, Array: []Value{
+		{Type: Array, Array: []Value{{Type: Integer, Integer: 1}}},
+		{Type: BulkString, Null: true},
+	}}},
+
+	// RESP3.
+	{name: "null", wire: "_\r\n", value: Value{Type: Null, Null: true}},
+	{name: "true", wire: "#t\r\n", value: Value{Type: Boolean, Bool: true}},
+	{name: "false", wire: "#f\r\n", value: Value{Type: Boolean}},
+	{name: "double", wire: ",1.5\r\n", value: Value{Type: Double, Double: 1.5}},
+	{name: "integral double", wire: ",10\r\n", value: Value{Type: Double, Double: 10}},
+	{name: "infinite double", wire: ",inf\r\n", value: Value{Type: Double, Double: math.Inf(1)}},
+	{name: "negative infinite double", wire: ",-inf\r\n", value: Value{Type: Double, Double: math.Inf(-1)}},
+	{name: "big number", wire: "(3492890328409238509324850943850943825024385\r\n", value: Value{Type: BigNumber, String: "3492890328409238509324850943850943825024385"}},
+	{name: "bulk error", wire: "!21\r\nSYNTAX invalid syntax\r\n", value: Value{Type: BulkError, String: "SYNTAX invalid syntax"}},
+	{name: "verbatim string", wire: "=15\r\ntxt:Some string\r\n", value: Value{Type: VerbatimString, String: "txt:Some string"}},
+	{name: "map", wire: "%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n", value: Value{Type: Map, Array: []Value{
+		{Type: SimpleString, String: "first"}, {Type: Integer, Integer: 1},
+		{Type: SimpleString, String: "second"}, {Type: Integer, Integer: 2},
+	}}},
+	{name: "set", wire: "~2\r\n+a\r\n+b\r\n", value: Value{Type: Set, Array: []Value{
+		{Type: SimpleString, String: "a"},
+		{Type: SimpleString, String: "b"},
+	}}},
+	{name: "push", wire: ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", value: Value{Type: Push, Array: []Value{
+		{Type: BulkString, String: "message"},
+		{Type: BulkString, String: "ch"},
+		{Type: BulkString, String: "hi"},
+	}}},
+	{name: "attribute", wire: "|1\r\n+ttl\r\n:3600\r\n$1\r\nv\r\n", value: Value{
+		Type:   BulkString,
+		String: "v",
+		Attrs:  []Value{{Type: SimpleString, String: "ttl"}, {Type: Integer, Integer: 3600}},
+	}},
+	{name: "streamed string", wire: "$?\r\n;4\r\nHell\r\n;6\r\no worl\r\n;1\r\nd\r\n;0\r\n",
+		value:   Value{Type: BulkString, String: "Hello world"},
+		encoded: "$11\r\nHello world\r\n"},
+	{name: "streamed array", wire: "*?\r\n:1\r\n:2\r\n.\r\n",
+		value:   Value{Type: Array, Array: []Value{{Type: Integer, Integer: 1}, {Type: Integer, Integer: 2}}},
+		encoded: "*2\r\n:1\r\n:2\r\n"},
+	{name: "streamed map", wire: "%?\r\n+a\r\n:1\r\n.\r\n",
+		value:   Value{Type: Map, Array: []Value{{Type: SimpleString, String: "a"}, {Type: Integer, Integer: 1}}},
+		encoded: "%1\r\n+a\r\n:1\r\n"},
+}
+
+// malformedVectors are encodings the decoder must refuse.
+var malformedVectors = []struct{ name, wire string }{
+	{"unknown type", "?x\r\n"},
+	{"bare LF", "+OK\n"},
+	{"invalid integer", ":12a\r\n"},
+	{"invalid boolean", "#x\r\n"},
+	{"invalid double", ",1.2.3\r\n"},
+	{"fractional big number", "(1.5\r\n"},
+	{"null with a body", "_x\r\n"},
+	{"invalid length", "$-2\r\n"},
+	{"truncated bulk string", "$5\r\nabc\r\n"},
+	{"unterminated bulk string", "$3\r\nabcde\r\n"},
+	{"short verbatim string", "=3\r\nabc\r\n"},
+	{"truncated array", "*2\r\n:1\r\n"},
+	{"streamed map with a dangling key", "%?\r\n+a\r\n.\r\n"},
+	{"invalid chunk", "$?\r\n:4\r\n"},
+}
+
+func TestDecoderConformance(t *testing.T) {
+	for _, v := range conformanceVectors {
+		t.Run(v.name, func(t *testing.T) {
+			got, err := NewDecoder(strings.NewReader(v.wire)).Decode()
+			if err != nil {
+				t.Fatalf("Decode(%q): %v", v.wire, err)
+			}
+			if !reflect.DeepEqual(got, v.value) {
+				t.Errorf("Decode(%q) = %+v, want %+v", v.wire, got, v.value)
+			}
+		})
+	}
+}
+
+// TestDecoderStream checks that values are read back to back without the
+// decoder reading into the next one.
+func TestDecoderStream(t *testing.T) {
+	var wire strings.Builder
+	for _, v := range conformanceVectors {
+		wire.WriteString(v.wire)
+	}
+	d := NewDecoder(strings.NewReader(wire.String()))
+	for _, v := range conformanceVectors {
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatalf("decoding %s: %v", v.name, err)
+		}
+		if !reflect.DeepEqual(got, v.value) {
+			t.Errorf("decoding %s: got %+v, want %+v", v.name, got, v.value)
+		}
+	}
+}
+
+func TestDecoderMalformed(t *testing.T) {
+	for _, v := range malformedVectors {
+		t.Run(v.name, func(t *testing.T) {
+			if got, err := NewDecoder(strings.NewReader(v.wire)).Decode(); err == nil {
+				t.Errorf("Decode(%q) = %+v, want an error", v.wire, got)
+			}
+		})
+	}
+}
+
+func TestEncoderConformance(t *testing.T) {
+	for _, v := range conformanceVectors {
+		t.Run(v.name, func(t *testing.T) {
+			want := v.wire
+			if v.encoded != "" {
+				want = v.encoded
+			}
+			if got := string(AppendValue(nil, v.value)); got != want {
+				t.Errorf("AppendValue(%+v) = %q, want %q", v.value, got, want)
+			}
+		})
+	}
+}
+
+// TestEncoderNaN covers NaN apart, as it isn't equal to itself.
+func TestEncoderNaN(t *testing.T) {
+	v, err := NewDecoder(strings.NewReader(",nan\r\n")).Decode()
+	if err != nil || !math.IsNaN(v.Double) {
+		t.Fatalf("Decode(\",nan\") = %+v, %v, want NaN", v, err)
+	}
+	if got := string(AppendValue(nil, v)); got != ",nan\r\n" {
+		t.Errorf("AppendValue(NaN) = %q, want \",nan\\r\\n\"", got)
+	}
+}
@@ -0,0 +1,209 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxBulkLength is the largest bulk string the decoder accepts, matching
+// Redis' default proto-max-bulk-len.
+const maxBulkLength = 512 << 20
+
+// Decoder reads RESP2 and RESP3 values of any type, such as server replies.
+type Decoder struct {
+	reader *bufio.Reader
+}
+
+// NewDecoder creates a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Decoder{reader: br}
+	}
+	return &Decoder{reader: bufio.NewReader(r)}
+}
+
+// Decode reads the next value. Streamed strings and aggregates are returned
+// as a single value, and an attribute is returned in the Attrs of the value
+// that follows it.
+func (d *Decoder) Decode() (Value, error) {
+	line, err := d.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	v := Value{Type: line[0]}
+	body := line[1:]
+
+	switch v.Type {
+	case SimpleString, Error:
+		v.String = body
+	case Integer:
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid integer %q", body)
+		}
+		v.Integer = int(n)
+	case Null:
+		if body != "" {
+			return v, fmt.Errorf("invalid null %q", line)
+		}
+		v.Null = true
+	case Boolean:
+		switch body {
+		case "t":
+			v.Bool = true
+		case "f":
+		default:
+			return v, fmt.Errorf("invalid boolean %q", body)
+		}
+	case Double:
+		v.Double, err = strconv.ParseFloat(body, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid double %q", body)
+		}
+	case BigNumber:
+		if _, err := strconv.ParseFloat(body, 64); err != nil || strings.ContainsAny(body, ".eE") {
+			return v, fmt.Errorf("invalid big number %q", body)
+		}
+		v.String = body
+	case BulkString, BulkError, VerbatimString:
+		if body == "?" {
+			v.String, err = d.readChunks()
+			return v, err
+		}
+		n, err := parseLength(body)
+		if err != nil {
+			return v, err
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		v.String, err = d.readBulk(n)
+		if err != nil {
+			return v, err
+		}
+		if v.Type == VerbatimString && (len(v.String) < 4 || v.String[3] != ':') {
+			return v, fmt.Errorf("invalid verbatim string %q", v.String)
+		}
+	case Array, Set, Push, Map, Attribute:
+		if body == "?" {
+			v.Array, err = d.readStreamed()
+			if v.Type == Map && len(v.Array)%2 != 0 {
+				return v, fmt.Errorf("streamed map has a key without a value")
+			}
+			return v, err
+		}
+		n, err := parseLength(body)
+		if err != nil {
+			return v, err
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		if v.Type == Map || v.Type == Attribute {
+			n *= 2
+		}
+		v.Array = make([]Value, n)
+		for i := range v.Array {
+			if v.Array[i], err = d.Decode(); err != nil {
+				return v, err
+			}
+		}
+		if v.Type == Attribute {
+			next, err := d.Decode()
+			next.Attrs = append(v.Array, next.Attrs...)
+			return next, err
+		}
+	default:
+		return v, fmt.Errorf("unknown RESP type '%c'", v.Type)
+	}
+	return v, nil
+}
+
+// readLine reads a CRLF-terminated line and returns it without the CRLF.
+func (d *Decoder) readLine() (string, error) {
+	line, err := d.reader.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid RESP line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// parseLength parses the length of a bulk string or aggregate, where -1
+// stands for null.
+func parseLength(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 || n > maxBulkLength {
+		return 0, fmt.Errorf("invalid length %q", s)
+	}
+	return n, nil
+}
+
+// readBulk reads n bytes of bulk data and the CRLF that follows it.
+func (d *Decoder) readBulk(n int) (string, error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(d.reader, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", fmt.Errorf("bulk data not terminated by CRLF")
+	}
+	return string(buf[:n]), nil
+}
+
+// readChunks reads the ";<len>" chunks of a streamed string up to the
+// zero-length chunk that ends it.
+func (d *Decoder) readChunks() (string, error) {
+	var b strings.Builder
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return "", err
+		}
+		if line[0] != ';' {
+			return "", fmt.Errorf("invalid streamed string chunk %q", line)
+		}
+		n, err := parseLength(line[1:])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid streamed string chunk %q", line)
+		}
+		if n == 0 {
+			return b.String(), nil
+		}
+		chunk, err := d.readBulk(n)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(chunk)
+	}
+}
+
+// readStreamed reads the elements of a streamed aggregate up to its "."
+// end marker.
+func (d *Decoder) readStreamed() ([]Value, error) {
+	var elements []Value
+	for {
+		if b, err := d.reader.Peek(3); err == nil && string(b) == ".\r\n" {
+			d.reader.Discard(3)
+			return elements, nil
+		}
+		v, err := d.Decode()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, v)
+	}
+}
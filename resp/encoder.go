@@ -0,0 +1,79 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+)
+
+// AppendValue appends the RESP encoding of v to b and returns the extended
+// buffer. Values decoded by Decoder encode back to the same bytes, except
+// that streamed strings and aggregates are written with explicit lengths.
+func AppendValue(b []byte, v Value) []byte {
+	if len(v.Attrs) > 0 {
+		b = appendHeader(b, Attribute, len(v.Attrs)/2)
+		for _, attr := range v.Attrs {
+			b = AppendValue(b, attr)
+		}
+	}
+	switch v.Type {
+	case SimpleString, Error:
+		b = append(b, v.Type)
+		b = append(b, v.String...)
+		return append(b, "\r\n"...)
+	case Integer:
+		b = append(b, v.Type)
+		b = strconv.AppendInt(b, int64(v.Integer), 10)
+		return append(b, "\r\n"...)
+	case Null:
+		return append(b, "_\r\n"...)
+	case Boolean:
+		if v.Bool {
+			return append(b, "#t\r\n"...)
+		}
+		return append(b, "#f\r\n"...)
+	case Double:
+		b = append(b, v.Type)
+		switch {
+		case math.IsInf(v.Double, 1):
+			b = append(b, "inf"...)
+		case math.IsInf(v.Double, -1):
+			b = append(b, "-inf"...)
+		case math.IsNaN(v.Double):
+			b = append(b, "nan"...)
+		default:
+			b = strconv.AppendFloat(b, v.Double, 'g', -1, 64)
+		}
+		return append(b, "\r\n"...)
+	case BigNumber:
+		b = append(b, v.Type)
+		b = append(b, v.String...)
+		return append(b, "\r\n"...)
+	case BulkString, BulkError, VerbatimString:
+		if v.Null {
+			return append(b, v.Type, '-', '1', '\r', '\n')
+		}
+		b = appendHeader(b, v.Type, len(v.String))
+		b = append(b, v.String...)
+		return append(b, "\r\n"...)
+	case Array, Set, Push, Map:
+		if v.Null {
+			return append(b, v.Type, '-', '1', '\r', '\n')
+		}
+		n := len(v.Array)
+		if v.Type == Map {
+			n /= 2
+		}
+		b = appendHeader(b, v.Type, n)
+		for _, element := range v.Array {
+			b = AppendValue(b, element)
+		}
+	}
+	return b
+}
+
+// appendHeader appends a type byte followed by a length line.
+func appendHeader(b []byte, typ byte, n int) []byte {
+	b = append(b, typ)
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, "\r\n"...)
+}
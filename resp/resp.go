@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 // The different types of RESP messages.
@@ -15,14 +16,37 @@ const (
 	Integer      = ':'
 	BulkString   = '$'
 	Array        = '*'
+
+	// RESP3 types.
+	Null           = '_'
+	Boolean        = '#'
+	Double         = ','
+	BigNumber      = '('
+	BulkError      = '!'
+	VerbatimString = '='
+	Map            = '%'
+	Set            = '~'
+	Attribute      = '|'
+	Push           = '>'
 )
 
 // Value represents a generic RESP value.
+//
+// Strings of every kind, errors and big numbers are held in String; a verbatim
+// string keeps its "fmt:" prefix. Arrays, sets and pushes hold their elements
+// in Array, and maps hold alternating keys and values there. The RESP2 null
+// bulk string and null array are their type with Null set.
 type Value struct {
 	Type    byte
 	String  string
 	Array   []Value
 	Integer int // Added a field to store integer values.
+	Null    bool
+	Bool    bool
+	Double  float64
+	// Attrs holds the alternating keys and values of the RESP3 attribute
+	// that preceded the value, if any.
+	Attrs []Value
 }
 
 // RESP is a parser and serializer for the Redis Serialization Protocol.
@@ -40,10 +64,35 @@ func NewRESP(rw io.ReadWriter) *RESP {
 	}
 }
 
+// WaitForCommand blocks until the first byte of the next command has
+// arrived, so the caller can tell an idle connection from one in the middle
+// of sending a command.
+func (r *RESP) WaitForCommand() error {
+	_, err := r.reader.Peek(1)
+	return err
+}
+
+// readHeader reads an array or bulk string header line. Header lines are
+// short, so one that doesn't fit the read buffer is rejected rather than
+// accumulated, which keeps a client from growing it without bound.
+func (r *RESP) readHeader() (string, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("protocol error: too big header line")
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 {
+		return "", fmt.Errorf("invalid RESP format: short line %q", line)
+	}
+	return string(line), nil
+}
+
 // ReadArray reads and parses a RESP Array message, which is the typical format
 // for client commands.
 func (r *RESP) ReadArray() ([]string, error) {
-	line, err := r.reader.ReadString('\n')
+	line, err := r.readHeader()
 	if err != nil {
 		return nil, err
 	}
@@ -58,14 +107,19 @@ func (r *RESP) ReadArray() ([]string, error) {
 	if num == -1 {
 		return nil, nil
 	}
+	if num < 0 {
+		return nil, fmt.Errorf("invalid array length: %d", num)
+	}
 
-	args := make([]string, num)
+	// The length is only a claim until the arguments arrive, so it doesn't
+	// size the allocation up front.
+	args := make([]string, 0, min(num, 1024))
 	for i := 0; i < num; i++ {
 		val, err := r.ReadBulkString()
 		if err != nil {
 			return nil, err
 		}
-		args[i] = val
+		args = append(args, val)
 	}
 
 	return args, nil
@@ -73,7 +127,7 @@ func (r *RESP) ReadArray() ([]string, error) {
 
 // ReadBulkString reads and parses a RESP Bulk String.
 func (r *RESP) ReadBulkString() (string, error) {
-	line, err := r.reader.ReadString('\n')
+	line, err := r.readHeader()
 	if err != nil {
 		return "", err
 	}
@@ -88,17 +142,26 @@ func (r *RESP) ReadBulkString() (string, error) {
 	if length == -1 {
 		return "", nil
 	}
+	if length < 0 || length > maxBulkLength {
+		return "", fmt.Errorf("invalid bulk string length: %d", length)
+	}
 
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r.reader, buf); err != nil {
+	// Like the array length, a large bulk length isn't trusted with an
+	// allocation before the data shows up.
+	var buf strings.Builder
+	buf.Grow(min(length, 64<<10))
+	if _, err := io.CopyN(&buf, r.reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return "", err
 	}
 
-	if _, err := r.reader.ReadString('\n'); err != nil {
+	if _, err := r.reader.ReadSlice('\n'); err != nil {
 		return "", err
 	}
 
-	return string(buf), nil
+	return buf.String(), nil
 }
 
 // WriteString writes a simple string response.
@@ -160,19 +223,10 @@ func (r *RESP) WriteArray(vals []Value) error {
 	return r.writer.Flush()
 }
 
-// WriteValue writes a single RESP value.
+// WriteValue writes a single RESP value of any type.
 func (r *RESP) WriteValue(v Value) error {
-	switch v.Type {
-	case SimpleString:
-		return r.WriteString(v.String)
-	case Error:
-		return r.WriteError(v.String)
-	case Integer:
-		return r.WriteInteger(v.Integer)
-	case BulkString:
-		return r.WriteBulkString(v.String)
-	case Array:
-		return r.WriteArray(v.Array)
-	}
-	return nil
+	if _, err := r.writer.Write(AppendValue(nil, v)); err != nil {
+		return err
+	}
+	return r.writer.Flush()
 }
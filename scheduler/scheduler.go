@@ -0,0 +1,134 @@
+// Package scheduler runs the server's periodic background work (active
+// expiration and friends) at an adaptive frequency, so that background cycles
+// never take more than a bounded share of CPU time away from clients.
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// Task is a unit of background work run once per cycle. It should stop after
+// roughly budget worth of work and report whether work was left over.
+type Task func(budget time.Duration) (more bool)
+
+// maxHz caps the effective frequency when dynamic hz speeds up a backlog.
+const maxHz = 500
+
+// Scheduler runs registered tasks in cycles of 1/hz seconds. Each cycle gets a
+// time budget of cpuPercent of the period, split evenly between the tasks.
+// With dynamic hz enabled the effective frequency is raised while tasks report
+// a backlog and lowered again when cycles overrun their budget or the backlog
+// clears, always keeping the measured background CPU share under cpuPercent.
+type Scheduler struct {
+	mu          sync.Mutex
+	hz          int
+	dynamic     bool
+	cpuPercent  int
+	effectiveHz int
+	lastCycle   time.Duration
+	tasks       []Task
+}
+
+// New creates a scheduler running at hz cycles per second.
+func New(hz int, dynamic bool, cpuPercent int) *Scheduler {
+	s := &Scheduler{}
+	s.Configure(hz, dynamic, cpuPercent)
+	return s
+}
+
+// Configure changes the scheduler's settings. Invalid values are clamped: hz
+// to 1..maxHz and cpuPercent to 1..100.
+func (s *Scheduler) Configure(hz int, dynamic bool, cpuPercent int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hz = clamp(hz, 1, maxHz)
+	s.dynamic = dynamic
+	s.cpuPercent = clamp(cpuPercent, 1, 100)
+	s.effectiveHz = s.hz
+}
+
+// Register adds a task to every future cycle.
+func (s *Scheduler) Register(task Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, task)
+}
+
+// Stats reports the configured and effective frequency and the duration of the
+// most recent cycle.
+func (s *Scheduler) Stats() (configuredHz, effectiveHz int, dynamic bool, lastCycle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hz, s.effectiveHz, s.dynamic, s.lastCycle
+}
+
+// Run executes cycles forever. It is meant to run in its own goroutine.
+func (s *Scheduler) Run() {
+	for {
+		s.mu.Lock()
+		period := time.Second / time.Duration(s.effectiveHz)
+		budget := period * time.Duration(s.cpuPercent) / 100
+		tasks := s.tasks
+		s.mu.Unlock()
+
+		start := time.Now()
+		more := false
+		if len(tasks) > 0 {
+			share := budget / time.Duration(len(tasks))
+			for _, task := range tasks {
+				if task(share) {
+					more = true
+				}
+			}
+		}
+		elapsed := time.Since(start)
+		s.adapt(elapsed, budget, more)
+
+		if wait := period - elapsed; wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// adapt updates the effective frequency after a cycle.
+func (s *Scheduler) adapt(elapsed, budget time.Duration, more bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCycle = elapsed
+	if !s.dynamic {
+		s.effectiveHz = s.hz
+		return
+	}
+
+	next := s.effectiveHz
+	switch {
+	case elapsed > budget+budget/2:
+		// The cycle clearly overran: slow down so the CPU share stays bounded.
+		next = s.effectiveHz / 2
+	case more:
+		next = s.effectiveHz * 2
+	default:
+		// No backlog: drift back toward the configured frequency.
+		next = s.hz + (s.effectiveHz-s.hz)/2
+	}
+
+	// Never exceed what the observed cycle cost allows.
+	if elapsed > 0 {
+		limit := int(time.Second * time.Duration(s.cpuPercent) / 100 / elapsed)
+		if next > limit {
+			next = limit
+		}
+	}
+	s.effectiveHz = clamp(next, 1, maxHz)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
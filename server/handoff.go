@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+)
+
+// A server upgrades to a new binary without refusing connections by handing
+// its listening sockets and its dataset over to a process it starts from the
+// new executable with the same arguments. The old process stops accepting
+// and waits for the command in flight to finish, then sends the dataset
+// over a pipe as the commands of an AOF rewrite. Connections arriving
+// meanwhile wait in the sockets' backlog. Once the new process has loaded
+// the dataset and is about to accept, the old one exits, closing the
+// connections it still had; clients reconnect to the new process. If the
+// new process fails before that, the old one resumes serving.
+//
+// The new process finds the handed over files through handoffEnv, which
+// lists the listeners' addresses. Its file descriptor 3 reads the dataset,
+// 4 reports readiness and 5 onwards are the listeners, in that order.
+
+// handoffEnv is the environment variable telling a process it was started
+// by a handoff.
+const handoffEnv = "MYREDIS_HANDOFF"
+
+// handoffTimeout is how long the old process waits for the new one to load
+// the dataset.
+const handoffTimeout = 5 * time.Minute
+
+// listener is a listener being served by ListenWith. While a handoff runs
+// it is closed; if the handoff fails, a new listener on the same socket is
+// sent on resume.
+type listener struct {
+	addr   string
+	ln     net.Listener
+	resume chan net.Listener
+}
+
+// listen returns a listener on addr, the one handed over for it if any.
+func (s *Server) listen(addr string) (*listener, error) {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	ln, ok := s.inherited[addr]
+	if ok {
+		delete(s.inherited, addr)
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	l := &listener{addr: addr, ln: ln, resume: make(chan net.Listener, 1)}
+	s.listeners = append(s.listeners, l)
+	return l, nil
+}
+
+// unlisten stops serving l.
+func (s *Server) unlisten(l *listener) {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	for i, other := range s.listeners {
+		if other == l {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+	l.ln.Close()
+}
+
+// Handoff is what a process started by Upgrade takes over from the process
+// that started it.
+type Handoff struct {
+	dataset   *os.File
+	readyPipe *os.File
+	listeners map[string]net.Listener
+}
+
+// HandoffFromEnv returns the handoff the process was started for by
+// Upgrade, or nil if it wasn't.
+func HandoffFromEnv() (*Handoff, error) {
+	addrs, ok := os.LookupEnv(handoffEnv)
+	if !ok {
+		return nil, nil
+	}
+	// A later upgrade sets it afresh.
+	os.Unsetenv(handoffEnv)
+	h := &Handoff{
+		dataset:   os.NewFile(3, "handoff-dataset"),
+		readyPipe: os.NewFile(4, "handoff-ready"),
+		listeners: make(map[string]net.Listener),
+	}
+	for i, addr := range strings.Split(addrs, ",") {
+		if addr == "" {
+			continue
+		}
+		f := os.NewFile(uintptr(5+i), "handoff-listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting the listener on %s: %w", addr, err)
+		}
+		h.listeners[addr] = ln
+	}
+	return h, nil
+}
+
+// receive loads the dataset sent by the previous process into s.
+func (h *Handoff) receive(s *Server) error {
+	defer h.dataset.Close()
+	log.Println("Receiving the dataset from the previous process...")
+	if err := aof.Replay(h.dataset, s.replay); err != nil {
+		return err
+	}
+	s.listenMu.Lock()
+	s.inherited = h.listeners
+	s.listenMu.Unlock()
+	return nil
+}
+
+// ready tells the previous process to exit.
+func (h *Handoff) ready() {
+	h.readyPipe.Write([]byte{1})
+	h.readyPipe.Close()
+}
+
+// Upgrade hands the server over to a new process started from the current
+// executable with the same arguments, as described above. It only returns
+// if the handoff failed, in which case the server keeps serving; on success
+// the process exits.
+func (s *Server) Upgrade() error {
+	if s.aof.Status().Rewriting {
+		return errors.New("an AOF rewrite is in progress")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range s.listeners {
+		fl, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("the listener on %s can't be handed over", l.addr)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, l.addr)
+		files = append(files, f)
+	}
+	datasetR, datasetW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		datasetR.Close()
+		datasetW.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), handoffEnv+"="+strings.Join(addrs, ","))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append([]*os.File{datasetR, readyW}, files...)
+	err = cmd.Start()
+	datasetR.Close()
+	readyW.Close()
+	if err != nil {
+		datasetW.Close()
+		return err
+	}
+	log.Printf("Handing off to process %d...", cmd.Process.Pid)
+
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		l.ln.Close()
+	}
+	err = s.sendDataset(datasetW)
+	if err == nil {
+		readyR.SetReadDeadline(time.Now().Add(handoffTimeout))
+		if _, err = readyR.Read(make([]byte, 1)); err != nil {
+			err = fmt.Errorf("the new process didn't become ready: %w", err)
+		}
+	}
+	if err == nil {
+		log.Printf("Handed off to process %d, exiting", cmd.Process.Pid)
+		s.aof.Close()
+		os.Exit(0)
+	}
+
+	cmd.Process.Kill()
+	go cmd.Wait()
+	for i, l := range s.listeners {
+		ln, lerr := net.FileListener(files[i])
+		if lerr != nil {
+			log.Fatalf("Failed to resume listening on %s after a failed handoff: %v", l.addr, lerr)
+		}
+		l.resume <- ln
+	}
+	s.mu.Unlock()
+	return fmt.Errorf("handoff failed: %w", err)
+}
+
+// sendDataset writes the dataset to w as RESP commands and closes it. The
+// caller must hold the command lock.
+func (s *Server) sendDataset(w *os.File) error {
+	defer w.Close()
+	bw := bufio.NewWriter(w)
+	err := s.store.RewriteCommands(func(args []string) error {
+		fmt.Fprintf(bw, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(bw, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
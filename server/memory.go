@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/command"
+)
+
+// memoryLimiter keeps the Go runtime's soft memory limit in step with maxmemory.
+// The runtime limit is set to maxmemory plus a configurable headroom, so the
+// collector works harder as the dataset approaches its budget instead of
+// letting the heap grow into the container's hard limit.
+type memoryLimiter struct {
+	mu              sync.Mutex
+	maxMemory       int64
+	headroomPercent int
+}
+
+// set updates maxmemory and the headroom and applies the resulting limit.
+func (m *memoryLimiter) set(maxMemory int64, headroomPercent int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxMemory = maxMemory
+	m.headroomPercent = headroomPercent
+	m.apply()
+}
+
+// apply pushes the current limit to the runtime. A zero maxmemory removes the limit.
+func (m *memoryLimiter) apply() {
+	if m.maxMemory <= 0 {
+		debug.SetMemoryLimit(math.MaxInt64)
+		return
+	}
+	limit := m.maxMemory + m.maxMemory*int64(m.headroomPercent)/100
+	debug.SetMemoryLimit(limit)
+	log.Printf("Go runtime memory limit set to %d bytes (maxmemory %d, headroom %d%%)", limit, m.maxMemory, m.headroomPercent)
+}
+
+// clientEvictionCycle evicts clients over maxmemory-clients.
+func (s *Server) clientEvictionCycle(time.Duration) bool {
+	command.ClientEvictionCycle()
+	return false
+}
+
+// memoryCycle reports the heap in use to the memory pressure watcher.
+func (s *Server) memoryCycle(time.Duration) bool {
+	s.memory.mu.Lock()
+	maxMemory := s.memory.maxMemory
+	s.memory.mu.Unlock()
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	command.UpdateMemoryPressure(int64(sample[0].Value.Uint64()), maxMemory)
+	return false
+}
+
+// SetMaxMemory changes maxmemory at runtime and retunes the runtime memory limit.
+func (s *Server) SetMaxMemory(bytes int64) {
+	s.memory.mu.Lock()
+	headroom := s.memory.headroomPercent
+	s.memory.mu.Unlock()
+	s.memory.set(bytes, headroom)
+}
@@ -1,80 +1,450 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nazeeeef007/redis-clone/aof"
 	"github.com/nazeeeef007/redis-clone/command"
 	"github.com/nazeeeef007/redis-clone/resp"
+	"github.com/nazeeeef007/redis-clone/scheduler"
 	"github.com/nazeeeef007/redis-clone/store"
 )
 
 // Server holds the state of our Redis clone.
 type Server struct {
-	store *store.Store
-	aof   *aof.AOF
-	mu    sync.RWMutex
+	store  *store.Store
+	aof    *aof.AOF
+	mu     sync.RWMutex
+	memory memoryLimiter
+	cron   *scheduler.Scheduler
+
+	// handshakeTimeout and commandTimeout hold durations, read by every
+	// connection and changed by CONFIG SET.
+	handshakeTimeout atomic.Int64
+	commandTimeout   atomic.Int64
+
+	// standbys are the attached hot standbys. standbyMu guards it and the
+	// store pointer for readers that don't hold mu, like the expire cycle.
+	standbyMu sync.Mutex
+	standbys  map[*Standby]struct{}
+
+	// listeners are the listeners being served, in the order they were
+	// started, and inherited those handed over by a previous process.
+	listenMu  sync.Mutex
+	listeners []*listener
+	inherited map[string]net.Listener
+}
+
+// Config holds the startup options for a Server.
+type Config struct {
+	// SlabAllocation enables the experimental slab allocator for small list
+	// and hash elements.
+	SlabAllocation bool
+	// MaxMemory is the dataset memory budget in bytes. Zero means unlimited.
+	MaxMemory int64
+	// MaxMemoryClients is the memory the buffers of all clients may use
+	// together, in bytes, before the largest are evicted. Zero means
+	// unlimited.
+	MaxMemoryClients int64
+	// MemoryHeadroomPercent is added on top of MaxMemory to form the Go
+	// runtime's soft memory limit.
+	MemoryHeadroomPercent int
+	// MemoryWatermarks are percentages of MaxMemory; whenever memory use
+	// crosses one, an event is published on command.MemoryPressureChannel.
+	// MemoryWarnWrites additionally warns RESP3 clients writing above a
+	// watermark in a reply attribute.
+	MemoryWatermarks []int
+	MemoryWarnWrites bool
+	// DisableAOF turns off append-only file persistence for this server.
+	DisableAOF bool
+	// FlushProtectionWindow, when non-zero, rejects plain FLUSHALL/FLUSHDB and
+	// delays scheduled flushes by this long so they can be aborted.
+	FlushProtectionWindow time.Duration
+	// ACLFile, when set, is loaded at startup to define ACL users.
+	ACLFile string
+	// Hz is how many background cycles (active expiration and similar
+	// housekeeping) run per second.
+	Hz int
+	// DynamicHz lets the scheduler raise the frequency while background work
+	// is backlogged and lower it when cycles overrun their CPU budget.
+	DynamicHz bool
+	// BackgroundCPUPercent bounds the share of each cycle period that
+	// background work may use.
+	BackgroundCPUPercent int
+	// HashMaxCompactEntries and HashMaxCompactValue are the thresholds up to
+	// which hashes use the compact pair-slice encoding. Zero keeps the defaults.
+	HashMaxCompactEntries int
+	HashMaxCompactValue   int
+	// ResultCachePatterns enables reply caching of expensive reads on keys
+	// matching any of these glob patterns. ResultCacheMaxEntries bounds the
+	// number of cached replies.
+	ResultCachePatterns   []string
+	ResultCacheMaxEntries int
+	// GCPercent sets GOGC when non-zero. A negative value disables the
+	// proportional collector so that only the memory limit triggers GC.
+	GCPercent int
+	// HandshakeTimeout is how long a new connection may take to start its
+	// first command, and CommandTimeout how long a command may take to
+	// arrive in full once it has started. Connections that exceed them are
+	// closed. Zero disables either limit.
+	HandshakeTimeout time.Duration
+	CommandTimeout   time.Duration
+	// TieringIdle, when non-zero, enables tiering: values not accessed for
+	// this long are moved to the spill file TieringFile and loaded back on
+	// access.
+	TieringIdle time.Duration
+	TieringFile string
+	// EncryptionKey, when set, encrypts the string values of keys matching
+	// EncryptedKeys in memory and in persistence files, with AES-GCM.
+	EncryptionKey []byte
+	EncryptedKeys []string
+	// RedactCommands and RedactKeys list the commands and key patterns
+	// whose arguments are redacted in the slow log and MONITOR feeds.
+	RedactCommands []string
+	RedactKeys     []string
+	// Handoff, when set, takes over the listeners and dataset of the
+	// process that started this one to upgrade itself. See HandoffFromEnv.
+	Handoff *Handoff
+	// RandomSeed, when non-zero, seeds the store's randomized choices so
+	// they repeat from run to run, for tests and bug reproductions.
+	RandomSeed uint64
+	// WatchdogThreshold is how long a command may run before the watchdog
+	// logs it with its stack, and WatchdogAuditPeriod how often goroutines
+	// are audited for leaks. Zero disables either.
+	WatchdogThreshold   time.Duration
+	WatchdogAuditPeriod time.Duration
+	// OfflineDir, when set, is the directory OFFLINE SELECT serves reads
+	// from snapshot files in.
+	OfflineDir string
+	// DBFilename is the file SAVE and BGSAVE write the snapshot of the
+	// dataset to, and the server loads at startup when the AOF holds
+	// nothing. Empty means "dump.rdb".
+	DBFilename string
+	// SaveRules trigger a background save once enough writes have run for
+	// long enough. None means snapshots are only taken on demand.
+	SaveRules []command.SaveRule
+	// WriteBehind, when set, forwards writes to matching keys to an external
+	// sink in the background.
+	WriteBehind *command.WriteBehind
+	// SpanExporter, when set, receives a span for every command run by a
+	// client that set a trace ID.
+	SpanExporter command.SpanExporter
+	// AppendFsync is the AOF fsync policy, one of aof.FsyncAlways,
+	// aof.FsyncEverySec and aof.FsyncNo. Empty means aof.FsyncNo.
+	AppendFsync string
+	// ConfigFile is the configuration file the server was started with,
+	// which CONFIG REWRITE updates. Empty when there is none.
+	ConfigFile string
+	// SlowlogSlowerThan is how long a command runs before the slow log
+	// records it, negative to disable it, and SlowlogMaxLen how many
+	// entries it keeps. Zero keeps the defaults, 10ms and 128 entries.
+	SlowlogSlowerThan time.Duration
+	SlowlogMaxLen     int
+	// LatencyMonitorThreshold is how long an event such as a command or an
+	// fsync must take for LATENCY to record it. Zero disables the monitor.
+	LatencyMonitorThreshold time.Duration
+	// EnableDebugCommand is whether the DEBUG subcommands for operational
+	// testing, such as DEBUG SLEEP, may be run: "yes", "local" for local
+	// connections only, or "no". Empty means "no".
+	EnableDebugCommand string
+	// Middleware wraps the execution of every client command, the first
+	// outermost, for embedders to audit, measure, limit or rewrite commands.
+	Middleware []command.Middleware
+}
+
+// ServeMetrics serves the server statistics over HTTP on addr. Clients
+// asking for JSON, by an Accept header or ?format=json, get the STATS JSON
+// document; everyone else gets OpenMetrics, as scraped by Prometheus.
+func (s *Server) ServeMetrics(addr string) error {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		st := command.CollectStats(s.store, s.aof)
+		s.mu.Unlock()
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			st.WriteJSON(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		st.WriteOpenMetrics(w)
+	})
+	log.Printf("Serving metrics on %s", addr)
+	return http.ListenAndServe(addr, handler)
 }
 
 // NewServer creates a new Server instance.
-func NewServer() *Server {
+func NewServer(cfg Config) *Server {
 	s := &Server{
-		store: store.NewStore(),
+		store:    store.NewStore(),
+		cron:     scheduler.New(cfg.Hz, cfg.DynamicHz, cfg.BackgroundCPUPercent),
+		standbys: make(map[*Standby]struct{}),
+	}
+	s.SetTimeouts(cfg.HandshakeTimeout, cfg.CommandTimeout)
+	s.cron.Register(s.expireCycle)
+	s.cron.Register(s.memoryCycle)
+	s.cron.Register(s.saveCycle)
+	command.ServerInfo = s.serverInfo
+	command.SetMaxMemory = s.SetMaxMemory
+	command.ConnTimeouts = s.Timeouts
+	command.SetConnTimeouts = s.SetTimeouts
+	command.ConfigFile = cfg.ConfigFile
+	if cfg.SlabAllocation {
+		s.store.EnableSlabAllocation()
+	}
+	s.store.SetHashCompactLimits(cfg.HashMaxCompactEntries, cfg.HashMaxCompactValue)
+	if len(cfg.EncryptionKey) > 0 {
+		if err := s.store.EnableEncryption(cfg.EncryptionKey, cfg.EncryptedKeys); err != nil {
+			log.Fatalf("Invalid encryption key: %v", err)
+		}
+	}
+	if cfg.Handoff != nil {
+		// The previous process still reads its spill file while sending the
+		// dataset, so tiering, which recreates the file, starts afterwards.
+		if err := cfg.Handoff.receive(s); err != nil {
+			log.Fatalf("Failed to receive the dataset from the previous process: %v", err)
+		}
+	}
+	if cfg.TieringIdle > 0 {
+		if err := s.store.EnableTiering(cfg.TieringFile, cfg.TieringIdle); err != nil {
+			log.Fatalf("Failed to create the tiering spill file: %v", err)
+		}
+		s.cron.Register(s.store.TieringCycle)
+	}
+	if cfg.RandomSeed != 0 {
+		store.Seed(cfg.RandomSeed)
+	}
+	if cfg.GCPercent != 0 {
+		debug.SetGCPercent(cfg.GCPercent)
+	}
+	s.memory.set(cfg.MaxMemory, cfg.MemoryHeadroomPercent)
+	command.SetupMemoryPressure(cfg.MemoryWatermarks, cfg.MemoryWarnWrites)
+	if cfg.SpanExporter != nil {
+		command.SetupTracing(cfg.SpanExporter)
+	}
+	command.SetupClientEviction(cfg.MaxMemoryClients)
+	command.FlushProtectionWindow = cfg.FlushProtectionWindow
+	command.OfflineDir = cfg.OfflineDir
+	if cfg.DBFilename != "" {
+		command.SnapshotFile = cfg.DBFilename
+	}
+	command.SetupSnapshots(cfg.SaveRules)
+	command.EnableDebugCommand = cfg.EnableDebugCommand
+	command.SetupRedaction(cfg.RedactCommands, cfg.RedactKeys)
+	command.SetupWatchdog(cfg.WatchdogThreshold, cfg.WatchdogAuditPeriod)
+	if cfg.SlowlogSlowerThan != 0 || cfg.SlowlogMaxLen != 0 {
+		slowerThan, maxLen := 10*time.Millisecond, 128
+		if cfg.SlowlogSlowerThan != 0 {
+			slowerThan = cfg.SlowlogSlowerThan
+		}
+		if cfg.SlowlogMaxLen != 0 {
+			maxLen = cfg.SlowlogMaxLen
+		}
+		command.SetupSlowlog(slowerThan, maxLen)
+	}
+	if cfg.ACLFile != "" {
+		if err := command.LoadACLFile(cfg.ACLFile); err != nil {
+			log.Fatalf("Failed to load ACL file: %v", err)
+		}
 	}
 
-	// Initialize and load the AOF.
-	var err error
-	s.aof, err = aof.NewAOF("myredis.aof", s.store)
-	if err != nil {
-		log.Fatalf("Failed to initialize AOF: %v", err)
+	// Initialize and load the AOF. With persistence disabled it has no file
+	// but still carries the write stream to standbys.
+	path := "myredis.aof"
+	if cfg.DisableAOF {
+		// The AOF can still be turned on with CONFIG SET appendonly yes.
+		log.Println("AOF persistence is disabled.")
+		s.aof = aof.NewDisabledAOF(path, s.store)
+	} else {
+		var err error
+		s.aof, err = aof.NewAOF(path, s.store)
+		if err != nil {
+			log.Fatalf("Failed to initialize AOF: %v", err)
+		}
+	}
+	if cfg.AppendFsync != "" {
+		if err := s.aof.SetFsync(cfg.AppendFsync); err != nil {
+			log.Fatalf("Invalid appendfsync: %v", err)
+		}
 	}
-	if err := s.aof.Load(); err != nil {
-		log.Fatalf("Failed to load AOF: %v", err)
+	// After a handoff the store already holds the dataset that was received.
+	if cfg.Handoff == nil {
+		s.loadDataset()
 	}
+	command.SetupBlocking(&s.mu, s.aof)
+	// Client eviction takes the server lock SetupBlocking installs.
+	s.cron.Register(s.clientEvictionCycle)
+	command.SetupReplication(s.aof)
+	command.SetupDelayedQueues(s.store, s.aof)
+	command.SetupSearch(s.aof)
+	command.SetupWatch(s.aof)
+	command.SetupLatencyMonitor(s.aof, cfg.LatencyMonitorThreshold)
+	if cfg.WriteBehind != nil {
+		command.SetupWriteBehind(s.store, s.aof, *cfg.WriteBehind)
+	}
+	command.Use(cfg.Middleware...)
+	if len(cfg.ResultCachePatterns) > 0 {
+		command.EnableResultCache(cfg.ResultCachePatterns, cfg.ResultCacheMaxEntries, s.aof)
+	}
+	if cfg.Handoff != nil {
+		cfg.Handoff.ready()
+	}
+	// Background cycles read the state set up above, such as the AOF and
+	// the dataset, so they only start once it's all in place.
+	go s.cron.Run()
 
 	return s
 }
 
+// loadDataset loads the dataset at startup. An AOF holding anything is the
+// most complete record of the dataset, so it is replayed on its own, as
+// Redis does; otherwise the snapshot is loaded. An enabled AOF is then
+// rewritten from the snapshot, or the next start would find only the writes
+// made after it there.
+func (s *Server) loadDataset() {
+	if s.aof.HasData() {
+		if err := s.aof.Load(s.replay); err != nil {
+			log.Fatalf("Failed to load AOF: %v", err)
+		}
+		return
+	}
+	start := time.Now()
+	n, err := command.LoadSnapshot(s.store)
+	if err != nil {
+		log.Fatalf("Failed to load the snapshot %s: %v", command.SnapshotFile, err)
+	}
+	if n == 0 {
+		return
+	}
+	log.Printf("Loaded %d keys from the snapshot %s in %s", n, command.SnapshotFile, time.Since(start))
+	if s.aof.Status().Enabled {
+		if err := s.aof.Rewrite(); err != nil {
+			log.Fatalf("Failed to rewrite the AOF from the snapshot: %v", err)
+		}
+	}
+}
+
+// saveCycle starts a background save when a save rule asks for one. The
+// scheduler only starts once the dataset is loaded, so a save can't replace
+// the snapshot with the empty dataset of a server that is still starting.
+func (s *Server) saveCycle(time.Duration) bool {
+	command.SaveCycle(s.store, s.aof)
+	return false
+}
+
+// replay runs a command read back from the AOF, or from the dataset a
+// previous process handed off, through the same handlers as clients'
+// commands. A nil AOF keeps it out of the write stream.
+func (s *Server) replay(args []string) {
+	command.Handle(args, replayConn{cmd: args[0]}, s.store, nil)
+}
+
+// replayConn is the connection commands replayed from the AOF are run with.
+// Replies are discarded, except errors, which are logged since the command
+// wasn't restored.
+type replayConn struct {
+	net.Conn
+	cmd string
+}
+
+func (c replayConn) Write(b []byte) (int, error) {
+	if len(b) > 0 && b[0] == '-' {
+		log.Printf("Failed to replay %s from the AOF: %s", c.cmd, strings.TrimSpace(string(b[1:])))
+	}
+	return len(b), nil
+}
+
+// serverInfo reports the server-level fields of the INFO server section.
+func (s *Server) serverInfo() string {
+	configuredHz, hz, dynamic, lastCycle := s.cron.Stats()
+	dynamicHz := 0
+	if dynamic {
+		dynamicHz = 1
+	}
+	return fmt.Sprintf("hz:%d\r\nconfigured_hz:%d\r\ndynamic_hz:%d\r\nlast_background_cycle_usec:%d\r\n",
+		hz, configuredHz, dynamicHz, lastCycle.Microseconds())
+}
+
+// ListenerOptions configures the connections accepted on one listener.
+type ListenerOptions struct {
+	// AuthProvider, when set, validates AUTH on this listener instead of the
+	// ACL passwords, e.g. a command.CachedAuthProvider around an external
+	// directory.
+	AuthProvider command.AuthProvider
+}
+
 // Listen starts the TCP server on the given address.
 func (s *Server) Listen(addr string) error {
-	listener, err := net.Listen("tcp", addr)
+	return s.ListenWith(addr, ListenerOptions{})
+}
+
+// ListenWith starts the TCP server on the given address, configuring the
+// connections it accepts with opts. A server may listen on several addresses
+// with different options, such as an internal port trusting ACL passwords
+// next to a public one checking tokens.
+func (s *Server) ListenWith(addr string, opts ListenerOptions) error {
+	l, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
+	defer s.unlisten(l)
 
+	// Replicas announce the first port the server listens on to masters.
+	if _, port, err := net.SplitHostPort(l.ln.Addr().String()); err == nil && command.ListeningPort == "" {
+		command.ListeningPort = port
+	}
 	log.Printf("myredis server listening on %s", addr)
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The listener was closed for a handoff, and comes back
+				// if the handoff fails. Otherwise the process exits.
+				l.ln = <-l.resume
+				continue
+			}
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
 		// Handle each connection in a new goroutine.
-		go s.handleConnection(conn)
+		go s.handleConnection(conn, opts)
 	}
 }
 
 // handleConnection manages a single client connection.
-func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) handleConnection(conn net.Conn, opts ListenerOptions) {
+	client := command.NewClient(conn)
+	client.AuthProvider = opts.AuthProvider
+	defer client.Close()
 	log.Printf("New client connected: %s", conn.RemoteAddr())
 
 	// Create a new RESP parser for this connection.
-	parser := resp.NewRESP(conn)
+	// Commands are read through the client, which may hold bytes consumed
+	// while a blocking command was checking the connection.
+	parser := resp.NewRESP(client)
 
-	for {
+	for first := true; ; first = false {
 		// Read RESP command from the client. The parser handles the entire command.
-		args, err := parser.ReadArray()
+		args, err := s.readCommand(parser, conn, first)
 		if err != nil {
-			if err == io.EOF {
+			var netErr net.Error
+			switch {
+			case err == io.EOF:
 				log.Printf("Client disconnected: %s", conn.RemoteAddr())
-			} else {
+			case errors.As(err, &netErr) && netErr.Timeout():
+				log.Printf("Closing connection %s: command not received in time", conn.RemoteAddr())
+			default:
 				log.Printf("RESP parse error: %v", err)
 				conn.Write([]byte(fmt.Sprintf("-(error) %v\r\n", err)))
 			}
@@ -85,9 +455,43 @@ func (s *Server) handleConnection(conn net.Conn) {
 		s.mu.Lock()
 
 		// Use the new command handler to process the request.
-		command.Handle(args, conn, s.store, s.aof)
+		command.Handle(args, client, s.store, s.aof)
 
 		// Unlock when done.
 		s.mu.Unlock()
+		client.RunDeferred()
 	}
 }
+
+// readCommand reads the next command from conn. A connection may idle between
+// commands for as long as it likes, except before its first one; once a
+// command starts arriving it must complete within the command timeout, so
+// slow writers can't hold a connection and its buffers open with a command
+// that never ends.
+func (s *Server) readCommand(parser *resp.RESP, conn net.Conn, first bool) ([]string, error) {
+	handshakeTimeout, commandTimeout := s.Timeouts()
+	var deadline time.Time
+	if first && handshakeTimeout > 0 {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+	if err := parser.WaitForCommand(); err != nil {
+		return nil, err
+	}
+	if commandTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(commandTimeout))
+	}
+	return parser.ReadArray()
+}
+
+// Timeouts returns the handshake and command timeouts of connections.
+func (s *Server) Timeouts() (handshake, command time.Duration) {
+	return time.Duration(s.handshakeTimeout.Load()), time.Duration(s.commandTimeout.Load())
+}
+
+// SetTimeouts changes the handshake and command timeouts of connections,
+// which apply from the next command they read.
+func (s *Server) SetTimeouts(handshake, command time.Duration) {
+	s.handshakeTimeout.Store(int64(handshake))
+	s.commandTimeout.Store(int64(command))
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/command"
+	"github.com/nazeeeef007/redis-clone/store"
+)
+
+// Standby is a secondary Store that follows the server's write stream
+// in-process. It lets embedders keep a hot copy of the dataset, for instance
+// one built with different store options, and swap it in without TCP
+// replication or an AOF reload.
+type Standby struct {
+	srv    *Server
+	store  *store.Store
+	remove func()
+}
+
+// discardConn is the connection standby commands are applied with. Replies
+// are thrown away, and since it is not a command.Client the commands run
+// without ACL checks or namespace rewriting: the write stream already carries
+// fully qualified keys.
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// AttachStandby copies the current dataset into st and keeps it in sync with
+// every subsequent write until it is detached or promoted. Any existing
+// contents of st are replaced.
+func (s *Server) AttachStandby(st *store.Store) *Standby {
+	// Holding the command lock while copying and subscribing ensures no
+	// write lands between the copy and the first streamed command.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store.CopyTo(st)
+	sb := &Standby{srv: s, store: st}
+	sb.remove = s.aof.AddFeed(func(args []string) {
+		// A nil AOF keeps the standby's writes out of the write stream.
+		command.Handle(args, discardConn{}, st, nil)
+	})
+
+	s.standbyMu.Lock()
+	s.standbys[sb] = struct{}{}
+	s.standbyMu.Unlock()
+	return sb
+}
+
+// Store returns the standby's Store. It must be treated as read-only while
+// the standby is attached.
+func (sb *Standby) Store() *store.Store {
+	return sb.store
+}
+
+// Detach stops the standby from following the write stream. Its Store keeps
+// the data it had at that point.
+func (sb *Standby) Detach() {
+	sb.srv.mu.Lock()
+	defer sb.srv.mu.Unlock()
+	sb.detach()
+}
+
+// detach unsubscribes the standby. The caller must hold the server's command lock.
+func (sb *Standby) detach() {
+	sb.remove()
+	sb.srv.standbyMu.Lock()
+	delete(sb.srv.standbys, sb)
+	sb.srv.standbyMu.Unlock()
+}
+
+// Promote atomically makes the standby's Store the one serving commands and
+// returns the previous primary Store, which stops receiving writes. No
+// command observes a state between the two. The old Store can be attached
+// again with AttachStandby to swap back later.
+func (sb *Standby) Promote() *store.Store {
+	s := sb.srv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb.detach()
+
+	s.standbyMu.Lock()
+	old := s.store
+	s.store = sb.store
+	s.standbyMu.Unlock()
+	return old
+}
+
+// expireCycle runs active expiration on the primary and on every attached
+// standby, splitting the budget between them. Standbys expire keys on their
+// own because the write stream does not carry expirations. It does nothing
+// while DEBUG SET-ACTIVE-EXPIRE 0 has stopped background expiration.
+func (s *Server) expireCycle(budget time.Duration) bool {
+	if !command.ActiveExpireEnabled() {
+		return false
+	}
+	s.standbyMu.Lock()
+	stores := make([]*store.Store, 0, len(s.standbys)+1)
+	stores = append(stores, s.store)
+	for sb := range s.standbys {
+		stores = append(stores, sb.store)
+	}
+	s.standbyMu.Unlock()
+
+	start := time.Now()
+	defer func() { command.LatencyEvent("expire-cycle", time.Since(start)) }()
+
+	share := budget / time.Duration(len(stores))
+	more := false
+	for _, st := range stores {
+		if st.ActiveExpireCycle(share) {
+			more = true
+		}
+	}
+	return more
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/command"
+)
+
+// statsdMaxPacket is the largest datagram PushStatsD sends, keeping clear
+// of IP fragmentation on a standard Ethernet MTU.
+const statsdMaxPacket = 1432
+
+// PushStatsD sends the server statistics to the StatsD or DogStatsD agent
+// listening on the UDP address addr every interval, tagged with tags, for
+// fleets that collect metrics by push rather than by scraping. It only
+// returns if addr can't be resolved; failed sends are logged, once until
+// sending works again, as agents come and go.
+func (s *Server) PushStatsD(addr string, interval time.Duration, tags []string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("Pushing metrics to StatsD at %s every %v", addr, interval)
+
+	enc := &command.StatsDEncoder{Tags: tags}
+	failing := false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		st := command.CollectStats(s.store, s.aof)
+		s.mu.Unlock()
+
+		err := sendStatsD(conn, enc.Encode(st))
+		switch {
+		case err != nil && !failing:
+			log.Printf("Pushing metrics to StatsD failed: %v", err)
+		case err == nil && failing:
+			log.Printf("Pushing metrics to StatsD works again")
+		}
+		failing = err != nil
+	}
+	return nil
+}
+
+// sendStatsD sends metric lines, as many to a datagram as fit.
+func sendStatsD(conn net.Conn, lines []string) error {
+	var packet strings.Builder
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write([]byte(packet.String()))
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
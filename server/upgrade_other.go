@@ -0,0 +1,7 @@
+//go:build !unix
+
+package server
+
+// UpgradeOnSignal does nothing on platforms without SIGUSR2; Upgrade can
+// still be called directly.
+func (s *Server) UpgradeOnSignal() {}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package server
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// UpgradeOnSignal makes the server hand itself over to a new process, as
+// Upgrade does, when it receives SIGUSR2.
+func (s *Server) UpgradeOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			if err := s.Upgrade(); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nazeeeef007/redis-clone/aof"
+	"github.com/nazeeeef007/redis-clone/command"
+)
+
+// Validate checks the configuration, each option and how the options fit
+// together, returning every problem found rather than the first, so a bad
+// configuration can be fixed in one go before a restart. Options are named
+// as the server's flags name them. NewServer doesn't call it: values it can
+// work with, like an out of range hz it clamps, are accepted there.
+func (cfg Config) Validate() []error {
+	var errs []error
+	fail := func(option, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", option, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.MemoryHeadroomPercent < 0 {
+		fail("maxmemory-headroom", "must not be negative, got %d", cfg.MemoryHeadroomPercent)
+	}
+	if len(cfg.MemoryWatermarks) > 0 && cfg.MaxMemory == 0 {
+		fail("memory-watermarks", "watermarks are percentages of maxmemory, which isn't set")
+	}
+	for _, w := range cfg.MemoryWatermarks {
+		if w <= 0 || w > 100 {
+			fail("memory-watermarks", "%d is not a percentage", w)
+		}
+	}
+	if cfg.MemoryWarnWrites && len(cfg.MemoryWatermarks) == 0 {
+		fail("memory-warn-writes", "writes are warned about above a memory watermark, and none is set")
+	}
+	switch cfg.AppendFsync {
+	case "", aof.FsyncAlways, aof.FsyncEverySec, aof.FsyncNo:
+	default:
+		fail("appendfsync", "must be always, everysec or no, got %q", cfg.AppendFsync)
+	}
+	switch cfg.EnableDebugCommand {
+	case "", "yes", "no", "local":
+	default:
+		fail("enable-debug-command", "must be yes, no or local, got %q", cfg.EnableDebugCommand)
+	}
+	if cfg.Hz < 1 || cfg.Hz > 500 {
+		fail("hz", "must be between 1 and 500, got %d", cfg.Hz)
+	}
+	if cfg.BackgroundCPUPercent < 1 || cfg.BackgroundCPUPercent > 100 {
+		fail("background-cpu-percent", "must be between 1 and 100, got %d", cfg.BackgroundCPUPercent)
+	}
+	if cfg.HashMaxCompactEntries < 0 {
+		fail("hash-max-listpack-entries", "must not be negative, got %d", cfg.HashMaxCompactEntries)
+	}
+	if cfg.HashMaxCompactValue < 0 {
+		fail("hash-max-listpack-value", "must not be negative, got %d", cfg.HashMaxCompactValue)
+	}
+	if len(cfg.ResultCachePatterns) > 0 && cfg.ResultCacheMaxEntries <= 0 {
+		fail("result-cache-max-entries", "must be positive for result-cache to cache anything, got %d", cfg.ResultCacheMaxEntries)
+	}
+	if cfg.SlowlogMaxLen < 0 {
+		fail("slowlog-max-len", "must not be negative, got %d", cfg.SlowlogMaxLen)
+	}
+	if cfg.GCPercent < -1 {
+		fail("gogc", "must be -1 or more, got %d", cfg.GCPercent)
+	}
+	for _, d := range []struct {
+		option string
+		value  time.Duration
+	}{
+		{"flush-protection", cfg.FlushProtectionWindow},
+		{"handshake-timeout", cfg.HandshakeTimeout},
+		{"command-timeout", cfg.CommandTimeout},
+		{"tiering-idle", cfg.TieringIdle},
+		{"watchdog-threshold", cfg.WatchdogThreshold},
+		{"latency-monitor-threshold", cfg.LatencyMonitorThreshold},
+		{"watchdog-audit-period", cfg.WatchdogAuditPeriod},
+	} {
+		if d.value < 0 {
+			fail(d.option, "must not be negative, got %v", d.value)
+		}
+	}
+	if cfg.TieringIdle > 0 {
+		if err := checkDir(filepath.Dir(cfg.TieringFile)); err != nil {
+			fail("tiering-file", "%v", err)
+		}
+	}
+	if len(cfg.EncryptedKeys) > 0 {
+		switch len(cfg.EncryptionKey) {
+		case 16, 24, 32:
+		default:
+			fail("encryption-key-file", "AES keys are 16, 24 or 32 bytes, got %d", len(cfg.EncryptionKey))
+		}
+	}
+	if cfg.ACLFile != "" {
+		for _, err := range command.CheckACLFile(cfg.ACLFile) {
+			fail("aclfile", "%v", err)
+		}
+	}
+	if cfg.OfflineDir != "" {
+		if err := checkDir(cfg.OfflineDir); err != nil {
+			fail("offline-dir", "%v", err)
+		}
+	}
+	if cfg.DBFilename != "" {
+		if err := command.CheckSnapshotFile(cfg.DBFilename); err != nil {
+			fail("dbfilename", "%v", err)
+		}
+	}
+	return errs
+}
+
+// checkDir checks that path is an existing directory.
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// TypeBloom values are stored as a *bloomValue: a scalable Bloom filter in
+// the manner of RedisBloom. It is a stack of sub-filters, each sized for a
+// capacity at an error rate. Once the last one holds its capacity, a new one
+// is added with expansion times the capacity and half the error rate, so the
+// error rate of the whole stack stays below the one asked for however many
+// items are added. A non-scaling filter, with an expansion of 0, refuses
+// items past its capacity instead.
+type bloomValue struct {
+	errorRate float64
+	expansion int
+	filters   []*bloomFilter
+}
+
+// bloomFilter is one sub-filter of a scalable Bloom filter.
+type bloomFilter struct {
+	capacity int64
+	count    int64
+	hashes   int
+	nbits    uint64
+	bits     []uint64
+}
+
+// The defaults of filters created by BF.ADD and BF.MADD, which are
+// RedisBloom's.
+const (
+	DefaultBloomErrorRate = 0.01
+	DefaultBloomCapacity  = 100
+	DefaultBloomExpansion = 2
+)
+
+// bloomTightening is the ratio of the error rate of each sub-filter to that
+// of the one before.
+const bloomTightening = 0.5
+
+var (
+	// ErrBloomExists is returned by BFReserve for a key that already exists.
+	ErrBloomExists = errors.New("ERR item exists")
+	// ErrBloomFull is returned when adding to a non-scaling filter that
+	// holds its capacity.
+	ErrBloomFull = errors.New("ERR non scaling filter is full")
+	// ErrBloomCorrupt is returned by BFLoad and CFLoad for data they can't
+	// decode.
+	ErrBloomCorrupt = errors.New("ERR received bad data")
+)
+
+// BloomInfo describes a Bloom filter, as BF.INFO reports it.
+type BloomInfo struct {
+	// Capacity is the number of items the filter holds before scaling, the
+	// sum of the capacities of its sub-filters.
+	Capacity int64
+	// Size is the memory taken by the bit arrays, in bytes.
+	Size int64
+	// Filters is the number of sub-filters.
+	Filters int
+	// Items is the number of items added.
+	Items int64
+	// Expansion is the growth of each sub-filter's capacity, 0 for a
+	// non-scaling filter.
+	Expansion int
+}
+
+// newBloomFilter sizes a sub-filter for capacity items at an error rate.
+func newBloomFilter(capacity int64, errorRate float64) *bloomFilter {
+	bitsPerItem := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	nbits := uint64(math.Ceil(float64(capacity) * bitsPerItem))
+	nbits = max(64, (nbits+63)/64*64)
+	return &bloomFilter{
+		capacity: capacity,
+		hashes:   max(1, int(math.Ceil(math.Ln2*bitsPerItem))),
+		nbits:    nbits,
+		bits:     make([]uint64, nbits/64),
+	}
+}
+
+// filterHash returns two hashes of an item, which Bloom filters derive its
+// bit positions from and cuckoo filters its buckets and fingerprint: its
+// FNV-1a hash, whose low bits are poorly mixed for short items, run through
+// two rounds of the SplitMix64 finalizer.
+func filterHash(item string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	mix := func(x uint64) uint64 {
+		x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		x = (x ^ x>>27) * 0x94d049bb133111eb
+		return x ^ x>>31
+	}
+	h1 := mix(h.Sum64())
+	return h1, mix(h1+0x9e3779b97f4a7c15) | 1
+}
+
+// test reports whether all the item's bits are set.
+func (f *bloomFilter) test(h1, h2 uint64) bool {
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// set sets the item's bits.
+func (f *bloomFilter) set(h1, h2 uint64) {
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.nbits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+// newBloomValue returns an empty filter with one sub-filter.
+func newBloomValue(errorRate float64, capacity int64, expansion int) *bloomValue {
+	return &bloomValue{
+		errorRate: errorRate,
+		expansion: expansion,
+		filters:   []*bloomFilter{newBloomFilter(capacity, errorRate*bloomTightening)},
+	}
+}
+
+// contains reports whether the item may have been added.
+func (v *bloomValue) contains(h1, h2 uint64) bool {
+	for _, f := range v.filters {
+		if f.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds an item, reporting false if it may already have been added.
+func (v *bloomValue) add(item string) (bool, error) {
+	h1, h2 := filterHash(item)
+	if v.contains(h1, h2) {
+		return false, nil
+	}
+	last := v.filters[len(v.filters)-1]
+	if last.count >= last.capacity {
+		if v.expansion == 0 {
+			return false, ErrBloomFull
+		}
+		errorRate := v.errorRate * math.Pow(bloomTightening, float64(len(v.filters)+1))
+		last = newBloomFilter(last.capacity*int64(v.expansion), errorRate)
+		v.filters = append(v.filters, last)
+	}
+	last.set(h1, h2)
+	return true, nil
+}
+
+// info describes the filter.
+func (v *bloomValue) info() BloomInfo {
+	info := BloomInfo{Filters: len(v.filters), Expansion: v.expansion}
+	for _, f := range v.filters {
+		info.Capacity += f.capacity
+		info.Size += int64(len(f.bits)) * 8
+		info.Items += f.count
+	}
+	return info
+}
+
+// clone returns a copy of the filter sharing no state with it.
+func (v *bloomValue) clone() *bloomValue {
+	clone := *v
+	clone.filters = make([]*bloomFilter, len(v.filters))
+	for i, f := range v.filters {
+		copied := *f
+		copied.bits = append([]uint64(nil), f.bits...)
+		clone.filters[i] = &copied
+	}
+	return &clone
+}
+
+// encode serializes the filter for BF.SCANDUMP and the spill file.
+func (v *bloomValue) encode() []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v.errorRate))
+	b = binary.AppendUvarint(b, uint64(v.expansion))
+	b = binary.AppendUvarint(b, uint64(len(v.filters)))
+	for _, f := range v.filters {
+		b = binary.AppendUvarint(b, uint64(f.capacity))
+		b = binary.AppendUvarint(b, uint64(f.count))
+		b = binary.AppendUvarint(b, uint64(f.hashes))
+		b = binary.AppendUvarint(b, uint64(len(f.bits)))
+		for _, word := range f.bits {
+			b = binary.LittleEndian.AppendUint64(b, word)
+		}
+	}
+	return b
+}
+
+// decodeBloom decodes a filter encoded by encode.
+func decodeBloom(b []byte) (*bloomValue, error) {
+	r := &spillReader{b: b}
+	v := &bloomValue{errorRate: math.Float64frombits(r.uint64()), expansion: int(r.uvarint())}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		f := &bloomFilter{capacity: int64(r.uvarint()), count: int64(r.uvarint()), hashes: int(r.uvarint())}
+		f.bits = make([]uint64, min(r.uvarint(), uint64(len(r.b))/8))
+		for i := range f.bits {
+			f.bits[i] = r.uint64()
+		}
+		f.nbits = uint64(len(f.bits)) * 64
+		if f.nbits == 0 || f.hashes == 0 {
+			return nil, errCorruptSpill
+		}
+		v.filters = append(v.filters, f)
+	}
+	if r.err == nil && (len(v.filters) == 0 || len(r.b) > 0) {
+		r.err = errCorruptSpill
+	}
+	return v, r.err
+}
+
+// liveBloom returns the Bloom filter stored at key, nil if there is none, or
+// ErrWrongType.
+func (s *Store) liveBloom(sh *shard, key string) (*bloomValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, nil
+	}
+	if item.Type != TypeBloom {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*bloomValue), nil
+}
+
+// BFReserve creates an empty Bloom filter at key for capacity items at an
+// error rate, growing by expansion once full or refusing more items if
+// expansion is 0. It returns ErrBloomExists if the key exists.
+func (s *Store) BFReserve(key string, errorRate float64, capacity int64, expansion int) error {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if item, ok := sh.items[key]; ok && !s.isExpired(item) {
+		return ErrBloomExists
+	}
+	sh.items[key] = Item{Value: newBloomValue(errorRate, capacity, expansion), Type: TypeBloom}
+	return nil
+}
+
+// BFAdd adds items to the Bloom filter at key, creating it with the default
+// error rate, capacity and expansion if it doesn't exist. It reports for
+// each item whether it was new, or rather not already possibly there. On
+// ErrBloomFull it returns the results of the items before the one refused.
+func (s *Store) BFAdd(key string, items []string) ([]bool, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	bloom, err := s.liveBloom(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	if bloom == nil {
+		bloom = newBloomValue(DefaultBloomErrorRate, DefaultBloomCapacity, DefaultBloomExpansion)
+		sh.items[key] = Item{Value: bloom, Type: TypeBloom}
+	}
+	added := make([]bool, 0, len(items))
+	for _, item := range items {
+		ok, err := bloom.add(item)
+		if err != nil {
+			return added, err
+		}
+		added = append(added, ok)
+	}
+	return added, nil
+}
+
+// BFExists reports for each item whether it may have been added to the
+// Bloom filter at key. Items are never there if the key doesn't exist.
+func (s *Store) BFExists(key string, items []string) ([]bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	bloom, err := s.liveBloom(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(items))
+	if bloom == nil {
+		return found, nil
+	}
+	for i, item := range items {
+		found[i] = bloom.contains(filterHash(item))
+	}
+	return found, nil
+}
+
+// BFInfo describes the Bloom filter at key, reporting false if there is
+// none.
+func (s *Store) BFInfo(key string) (BloomInfo, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	bloom, err := s.liveBloom(sh, key)
+	if bloom == nil {
+		return BloomInfo{}, false, err
+	}
+	return bloom.info(), true, nil
+}
+
+// BFDump serializes the Bloom filter at key for BFLoad, reporting false if
+// there is none.
+func (s *Store) BFDump(key string) ([]byte, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	bloom, err := s.liveBloom(sh, key)
+	if bloom == nil {
+		return nil, false, err
+	}
+	return bloom.encode(), true, nil
+}
+
+// BFLoad replaces the value at key with a Bloom filter serialized by
+// BFDump.
+func (s *Store) BFLoad(key string, data []byte) error {
+	bloom, err := decodeBloom(data)
+	if err != nil {
+		return ErrBloomCorrupt
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.items[key] = Item{Value: bloom, Type: TypeBloom}
+	return nil
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// TypeCMS values are stored as a *cmsValue: a count-min sketch in the manner
+// of RedisBloom, counting how often items occur in a fixed amount of memory.
+// Each of its depth rows has width counters, and an item adds to one counter
+// per row. Other items adding to the same counters only ever inflate them,
+// so the smallest of an item's counters is an estimate that never falls
+// short of its true count and overshoots it by more than error times the
+// total count with a probability under 0.5^depth, error being 2/width.
+type cmsValue struct {
+	width, depth uint64
+	// count is the total of all increments.
+	count    uint64
+	counters []uint64
+}
+
+var (
+	// ErrCMSExists is returned when initializing a sketch at a key that
+	// already exists.
+	ErrCMSExists = errors.New("CMS: key already exists")
+	// ErrCMSNotFound is returned for a sketch that doesn't exist.
+	ErrCMSNotFound = errors.New("CMS: key does not exist")
+	// ErrCMSDimensions is returned when merging sketches of different sizes.
+	ErrCMSDimensions = errors.New("CMS: width/depth is not equal")
+	// ErrCMSOverflow is returned when a counter would overflow.
+	ErrCMSOverflow = errors.New("CMS: counter overflow")
+)
+
+// CMSInfo describes a count-min sketch, as CMS.INFO reports it.
+type CMSInfo struct {
+	Width, Depth uint64
+	Count        uint64
+}
+
+// CMSDimensions returns the width and depth of a sketch whose estimates
+// overshoot by at most errorRate times the total count, with the given
+// probability of exceeding that.
+func CMSDimensions(errorRate, probability float64) (uint64, uint64) {
+	width := uint64(math.Ceil(2 / errorRate))
+	depth := uint64(math.Ceil(math.Log10(probability) / math.Log10(0.5)))
+	return max(width, 1), max(depth, 1)
+}
+
+// newCMSValue returns an empty sketch.
+func newCMSValue(width, depth uint64) *cmsValue {
+	return &cmsValue{width: width, depth: depth, counters: make([]uint64, width*depth)}
+}
+
+// indexes returns the counter of an item in each row.
+func (v *cmsValue) indexes(item string) []uint64 {
+	h1, h2 := filterHash(item)
+	indexes := make([]uint64, v.depth)
+	for row := range indexes {
+		indexes[row] = uint64(row)*v.width + (h1+uint64(row)*h2)%v.width
+	}
+	return indexes
+}
+
+// query returns the estimated count of an item.
+func (v *cmsValue) query(item string) uint64 {
+	estimate := uint64(math.MaxUint64)
+	for _, i := range v.indexes(item) {
+		estimate = min(estimate, v.counters[i])
+	}
+	return estimate
+}
+
+// clone returns a copy of the sketch sharing no state with it.
+func (v *cmsValue) clone() *cmsValue {
+	clone := *v
+	clone.counters = append([]uint64(nil), v.counters...)
+	return &clone
+}
+
+// encode serializes the sketch for CMS.SCANDUMP and the spill file.
+func (v *cmsValue) encode() []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, v.width)
+	b = binary.AppendUvarint(b, v.depth)
+	b = binary.AppendUvarint(b, v.count)
+	for _, c := range v.counters {
+		b = binary.AppendUvarint(b, c)
+	}
+	return b
+}
+
+// decodeCMS decodes a sketch encoded by encode.
+func decodeCMS(b []byte) (*cmsValue, error) {
+	r := &spillReader{b: b}
+	width, depth := r.uvarint(), r.uvarint()
+	hi, size := bits.Mul64(width, depth)
+	// Every counter takes at least a byte.
+	if r.err != nil || width == 0 || depth == 0 || hi != 0 || size > uint64(len(r.b)) {
+		return nil, errCorruptSpill
+	}
+	v := newCMSValue(width, depth)
+	v.count = r.uvarint()
+	for i := range v.counters {
+		v.counters[i] = r.uvarint()
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errCorruptSpill
+	}
+	return v, r.err
+}
+
+// liveCMS returns the sketch stored at key, or ErrCMSNotFound or
+// ErrWrongType.
+func (s *Store) liveCMS(sh *shard, key string) (*cmsValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, ErrCMSNotFound
+	}
+	if item.Type != TypeCMS {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*cmsValue), nil
+}
+
+// CMSInit creates an empty count-min sketch at key with width counters in
+// each of depth rows. It returns ErrCMSExists if the key exists.
+func (s *Store) CMSInit(key string, width, depth uint64) error {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if item, ok := sh.items[key]; ok && !s.isExpired(item) {
+		return ErrCMSExists
+	}
+	sh.items[key] = Item{Value: newCMSValue(width, depth), Type: TypeCMS}
+	return nil
+}
+
+// CMSIncrBy adds increments[i] to the count of items[i] in the sketch at
+// key and returns the new estimated counts. Nothing is added if a counter
+// would overflow.
+func (s *Store) CMSIncrBy(key string, items []string, increments []uint64) ([]uint64, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	cms, err := s.liveCMS(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	// Check every counter first, with the increments of repeated items
+	// summed, so the command is applied in full or not at all.
+	pending := make(map[uint64]uint64)
+	total := cms.count
+	for i, item := range items {
+		var carry uint64
+		if total, carry = bits.Add64(total, increments[i], 0); carry != 0 {
+			return nil, ErrCMSOverflow
+		}
+		for _, j := range cms.indexes(item) {
+			sum, carry := bits.Add64(pending[j], increments[i], 0)
+			if _, over := bits.Add64(cms.counters[j], sum, 0); carry != 0 || over != 0 {
+				return nil, ErrCMSOverflow
+			}
+			pending[j] = sum
+		}
+	}
+	counts := make([]uint64, len(items))
+	for i, item := range items {
+		for _, j := range cms.indexes(item) {
+			cms.counters[j] += increments[i]
+		}
+		counts[i] = cms.query(item)
+	}
+	cms.count = total
+	return counts, nil
+}
+
+// CMSQuery returns the estimated counts of items in the sketch at key.
+func (s *Store) CMSQuery(key string, items []string) ([]uint64, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	cms, err := s.liveCMS(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]uint64, len(items))
+	for i, item := range items {
+		counts[i] = cms.query(item)
+	}
+	return counts, nil
+}
+
+// CMSMerge replaces the counters of the sketch at dst with the sums of
+// those of the sketches at srcs, each multiplied by its weight. The sketches
+// must all have the same dimensions; dst may be one of the sources.
+func (s *Store) CMSMerge(dst string, srcs []string, weights []uint64) error {
+	unlock := s.lockShards(append([]string{dst}, srcs...)...)
+	defer unlock()
+
+	target, err := s.liveCMS(&s.shards[s.shardIndex(dst)], dst)
+	if err != nil {
+		return err
+	}
+	merged := newCMSValue(target.width, target.depth)
+	for i, src := range srcs {
+		cms, err := s.liveCMS(&s.shards[s.shardIndex(src)], src)
+		if err != nil {
+			return err
+		}
+		if cms.width != merged.width || cms.depth != merged.depth {
+			return ErrCMSDimensions
+		}
+		if err := merged.addWeighted(cms, weights[i]); err != nil {
+			return err
+		}
+	}
+	target.count, target.counters = merged.count, merged.counters
+	return nil
+}
+
+// addWeighted adds the counters of another sketch of the same dimensions,
+// multiplied by weight.
+func (v *cmsValue) addWeighted(other *cmsValue, weight uint64) error {
+	add := func(a, b uint64) (uint64, error) {
+		hi, product := bits.Mul64(b, weight)
+		sum, carry := bits.Add64(a, product, 0)
+		if hi != 0 || carry != 0 {
+			return 0, ErrCMSOverflow
+		}
+		return sum, nil
+	}
+	var err error
+	if v.count, err = add(v.count, other.count); err != nil {
+		return err
+	}
+	for i, c := range other.counters {
+		if v.counters[i], err = add(v.counters[i], c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CMSInfo describes the sketch at key.
+func (s *Store) CMSInfo(key string) (CMSInfo, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	cms, err := s.liveCMS(sh, key)
+	if err != nil {
+		return CMSInfo{}, err
+	}
+	return CMSInfo{Width: cms.width, Depth: cms.depth, Count: cms.count}, nil
+}
+
+// CMSDump serializes the sketch at key for CMSLoad.
+func (s *Store) CMSDump(key string) ([]byte, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	cms, err := s.liveCMS(sh, key)
+	if err == ErrCMSNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return cms.encode(), true, nil
+}
+
+// CMSLoad replaces the value at key with a sketch serialized by CMSDump.
+func (s *Store) CMSLoad(key string, data []byte) error {
+	cms, err := decodeCMS(data)
+	if err != nil {
+		return ErrBloomCorrupt
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.items[key] = Item{Value: cms, Type: TypeCMS}
+	return nil
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"time"
+)
+
+// CopyTo replaces the contents of dst with a deep copy of every live key in s,
+// including TTLs and hash field TTLs, and of the function libraries. Each source shard is copied under its
+// read lock, so callers that need a point-in-time copy must stop writers
+// themselves.
+func (s *Store) CopyTo(dst *Store) {
+	dst.Flush()
+	dst.setFunctionLibraries(s.FunctionLibraries())
+	// The copy holds sealed values, which it tells apart with the sealer.
+	dst.sealer = s.sealer
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		for key, item := range sh.items {
+			if s.isExpired(item) {
+				continue
+			}
+			item, ok := s.materialize(key, item)
+			if !ok {
+				continue
+			}
+			dsh := dst.getShard(key)
+			dsh.Lock()
+			item = cloneItem(item)
+			item.Value = dst.getSlab(key).internValue(item.Value)
+			dsh.items[key] = item
+			dsh.Unlock()
+		}
+		sh.RUnlock()
+	}
+}
+
+// cloneItem returns a copy of item that shares no mutable state with it.
+func cloneItem(item Item) Item {
+	switch v := item.Value.(type) {
+	case []string:
+		item.Value = slices.Clone(v)
+	case map[string]struct{}:
+		item.Value = maps.Clone(v)
+	case *hashValue:
+		item.Value = &hashValue{pairs: slices.Clone(v.pairs), m: maps.Clone(v.m)}
+	case *zsetValue:
+		item.Value = v.clone()
+	case *streamValue:
+		item.Value = v.clone()
+	case *bloomValue:
+		item.Value = v.clone()
+	case *cuckooValue:
+		item.Value = v.clone()
+	case *cmsValue:
+		item.Value = v.clone()
+	case *topKValue:
+		item.Value = v.clone()
+	case *jsonValue:
+		item.Value = &jsonValue{root: cloneJSON(v.root)}
+	case *tsValue:
+		item.Value = v.clone()
+	}
+	if item.FieldExpirations != nil {
+		item.FieldExpirations = maps.Clone(item.FieldExpirations)
+	}
+	return item
+}
+
+// Export returns a copy of the value stored at key as plain Go values, for
+// handing to code outside the store: a string, a []string for lists, a
+// sorted []string for sets, a map[string]string for hashes, a []ZMember in
+// score order for sorted sets, a []StreamEntry for streams or the []byte
+// BFDump, CFDump, CMSDump, TopKDump and TSDump return for Bloom and cuckoo
+// filters, count-min and Top-K sketches and time series, or a
+// json.RawMessage for JSON documents. It reports false if the key doesn't exist.
+func (s *Store) Export(key string) (DataType, any, bool) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return 0, nil, false
+	}
+	return item.Type, s.exportValue(key, item), true
+}
+
+// exportValue converts the value of item as Export does. A sealed string
+// that can't be opened is exported as empty.
+func (s *Store) exportValue(key string, item Item) any {
+	switch v := item.Value.(type) {
+	case string:
+		plain, _ := s.openString(key, v)
+		return plain
+	case []string:
+		return slices.Clone(v)
+	case map[string]struct{}:
+		return slices.Sorted(maps.Keys(v))
+	case *hashValue:
+		now := time.Now()
+		fields := make(map[string]string, v.len())
+		v.each(func(field, value string) bool {
+			if !fieldExpired(item, field, now) {
+				fields[field] = value
+			}
+			return true
+		})
+		return fields
+	case *zsetValue:
+		members := make([]ZMember, 0, v.zsl.length)
+		for x := v.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+		return members
+	case *streamValue:
+		entries := make([]StreamEntry, 0, v.length)
+		v.each(func(entry StreamEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		return entries
+	case *bloomValue:
+		return v.encode()
+	case *cuckooValue:
+		return v.encode()
+	case *cmsValue:
+		return v.encode()
+	case *topKValue:
+		return v.encode()
+	case *jsonValue:
+		return json.RawMessage(v.String())
+	case *tsValue:
+		return v.encode()
+	}
+	return item.Value
+}
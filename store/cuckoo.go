@@ -0,0 +1,430 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// TypeCuckoo values are stored as a *cuckooValue: a cuckoo filter in the
+// manner of RedisBloom. Unlike a Bloom filter it can delete items and count
+// how often one was added, at the cost of a fingerprint per addition. Items
+// are kept as 8-bit fingerprints in one of two buckets, the second derived
+// from the first and the fingerprint, so either can be found from the other
+// when a full bucket's fingerprint is kicked to its alternate. When no room
+// is found within the allowed kicks, a new sub-filter is added with
+// expansion times the buckets, or the filter is full if expansion is 0.
+type cuckooValue struct {
+	bucketSize    int
+	maxIterations int
+	expansion     int
+	filters       []*cuckooFilter
+	items         int64
+	deletes       int64
+}
+
+// cuckooFilter is one sub-filter, its buckets laid out one after another.
+// A zero fingerprint marks an empty slot.
+type cuckooFilter struct {
+	numBuckets uint64
+	slots      []uint8
+}
+
+// The defaults of filters created by CF.RESERVE without options and by
+// CF.ADD, which are RedisBloom's.
+const (
+	DefaultCuckooCapacity      = 1024
+	DefaultCuckooBucketSize    = 2
+	DefaultCuckooMaxIterations = 20
+	DefaultCuckooExpansion     = 1
+)
+
+// ErrCuckooFull is returned when adding to a filter with no room left that
+// can't expand.
+var ErrCuckooFull = errors.New("ERR Filter is full")
+
+// CuckooInfo describes a cuckoo filter, as CF.INFO reports it.
+type CuckooInfo struct {
+	// Size is the memory taken by the buckets, in bytes.
+	Size          int64
+	Buckets       int64
+	Filters       int
+	Items         int64
+	Deletes       int64
+	BucketSize    int
+	Expansion     int
+	MaxIterations int
+}
+
+// newCuckooFilter returns a sub-filter with numBuckets buckets, rounded up
+// to a power of two so bucket indexes can be masked.
+func newCuckooFilter(numBuckets uint64, bucketSize int) *cuckooFilter {
+	numBuckets = max(1, numBuckets)
+	if numBuckets&(numBuckets-1) != 0 {
+		numBuckets = 1 << bits.Len64(numBuckets)
+	}
+	return &cuckooFilter{numBuckets: numBuckets, slots: make([]uint8, numBuckets*uint64(bucketSize))}
+}
+
+// newCuckooValue returns an empty filter sized for capacity items.
+func newCuckooValue(capacity int64, bucketSize, maxIterations, expansion int) *cuckooValue {
+	numBuckets := (uint64(capacity) + uint64(bucketSize) - 1) / uint64(bucketSize)
+	return &cuckooValue{
+		bucketSize:    bucketSize,
+		maxIterations: maxIterations,
+		expansion:     expansion,
+		filters:       []*cuckooFilter{newCuckooFilter(numBuckets, bucketSize)},
+	}
+}
+
+// cuckooHash returns an item's fingerprint, never zero, and the hash its
+// first bucket is taken from.
+func cuckooHash(item string) (uint8, uint64) {
+	h1, h2 := filterHash(item)
+	return uint8(h2%255 + 1), h1
+}
+
+// bucket returns the slots of bucket i.
+func (f *cuckooFilter) bucket(i uint64, bucketSize int) []uint8 {
+	start := i * uint64(bucketSize)
+	return f.slots[start : start+uint64(bucketSize)]
+}
+
+// altIndex returns the other bucket of a fingerprint in bucket i. Applied
+// twice it returns i.
+func (f *cuckooFilter) altIndex(i uint64, fp uint8) uint64 {
+	return (i ^ uint64(fp)*0x5bd1e995) & (f.numBuckets - 1)
+}
+
+// indexes returns the two buckets of an item in the sub-filter.
+func (f *cuckooFilter) indexes(fp uint8, h uint64) (uint64, uint64) {
+	i := h & (f.numBuckets - 1)
+	return i, f.altIndex(i, fp)
+}
+
+// place puts a fingerprint in a free slot of bucket i, reporting whether
+// there was one.
+func (f *cuckooFilter) place(i uint64, fp uint8, bucketSize int) bool {
+	b := f.bucket(i, bucketSize)
+	for j := range b {
+		if b[j] == 0 {
+			b[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// count returns how many times a fingerprint is in bucket i.
+func (f *cuckooFilter) count(i uint64, fp uint8, bucketSize int) int {
+	n := 0
+	for _, slot := range f.bucket(i, bucketSize) {
+		if slot == fp {
+			n++
+		}
+	}
+	return n
+}
+
+// remove deletes a fingerprint from bucket i, reporting whether it was there.
+func (f *cuckooFilter) remove(i uint64, fp uint8, bucketSize int) bool {
+	b := f.bucket(i, bucketSize)
+	for j := range b {
+		if b[j] == fp {
+			b[j] = 0
+			return true
+		}
+	}
+	return false
+}
+
+// kick makes room for a fingerprint that belongs in bucket i by moving the
+// fingerprints in its way to their other buckets, at most maxIterations
+// times. The slots kicked from are chosen in turn rather than at random, so
+// replaying the same additions builds the same filter. If no room is found,
+// the moves are undone and kick returns false.
+func (f *cuckooFilter) kick(i uint64, fp uint8, bucketSize, maxIterations int) bool {
+	type move struct {
+		bucket uint64
+		slot   int
+	}
+	path := make([]move, 0, maxIterations)
+	for n := 0; n < maxIterations; n++ {
+		slot := n % bucketSize
+		b := f.bucket(i, bucketSize)
+		path = append(path, move{i, slot})
+		fp, b[slot] = b[slot], fp
+		i = f.altIndex(i, fp)
+		if f.place(i, fp, bucketSize) {
+			return true
+		}
+	}
+	for n := len(path) - 1; n >= 0; n-- {
+		b := f.bucket(path[n].bucket, bucketSize)
+		fp, b[path[n].slot] = b[path[n].slot], fp
+	}
+	return false
+}
+
+// count returns how many times the item may have been added, less deletes.
+func (v *cuckooValue) count(item string) int {
+	fp, h := cuckooHash(item)
+	n := 0
+	for _, f := range v.filters {
+		i1, i2 := f.indexes(fp, h)
+		n += f.count(i1, fp, v.bucketSize)
+		if i2 != i1 {
+			n += f.count(i2, fp, v.bucketSize)
+		}
+	}
+	return n
+}
+
+// add adds an item, even if it may be there already.
+func (v *cuckooValue) add(item string) error {
+	fp, h := cuckooHash(item)
+	// Any sub-filter with room will do, newest first.
+	for k := len(v.filters) - 1; k >= 0; k-- {
+		f := v.filters[k]
+		i1, i2 := f.indexes(fp, h)
+		if f.place(i1, fp, v.bucketSize) || f.place(i2, fp, v.bucketSize) {
+			v.items++
+			return nil
+		}
+	}
+	last := v.filters[len(v.filters)-1]
+	i1, _ := last.indexes(fp, h)
+	if !last.kick(i1, fp, v.bucketSize, v.maxIterations) {
+		if v.expansion == 0 {
+			return ErrCuckooFull
+		}
+		last = newCuckooFilter(last.numBuckets*uint64(v.expansion), v.bucketSize)
+		v.filters = append(v.filters, last)
+		i1, _ = last.indexes(fp, h)
+		last.place(i1, fp, v.bucketSize)
+	}
+	v.items++
+	return nil
+}
+
+// del deletes one addition of an item, reporting whether it was found.
+func (v *cuckooValue) del(item string) bool {
+	fp, h := cuckooHash(item)
+	for k := len(v.filters) - 1; k >= 0; k-- {
+		f := v.filters[k]
+		i1, i2 := f.indexes(fp, h)
+		if f.remove(i1, fp, v.bucketSize) || f.remove(i2, fp, v.bucketSize) {
+			v.items--
+			v.deletes++
+			return true
+		}
+	}
+	return false
+}
+
+// info describes the filter.
+func (v *cuckooValue) info() CuckooInfo {
+	info := CuckooInfo{
+		Filters:       len(v.filters),
+		Items:         v.items,
+		Deletes:       v.deletes,
+		BucketSize:    v.bucketSize,
+		Expansion:     v.expansion,
+		MaxIterations: v.maxIterations,
+	}
+	for _, f := range v.filters {
+		info.Size += int64(len(f.slots))
+		info.Buckets += int64(f.numBuckets)
+	}
+	return info
+}
+
+// clone returns a copy of the filter sharing no state with it.
+func (v *cuckooValue) clone() *cuckooValue {
+	clone := *v
+	clone.filters = make([]*cuckooFilter, len(v.filters))
+	for i, f := range v.filters {
+		clone.filters[i] = &cuckooFilter{numBuckets: f.numBuckets, slots: append([]uint8(nil), f.slots...)}
+	}
+	return &clone
+}
+
+// encode serializes the filter for CF.SCANDUMP and the spill file.
+func (v *cuckooValue) encode() []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(v.bucketSize))
+	b = binary.AppendUvarint(b, uint64(v.maxIterations))
+	b = binary.AppendUvarint(b, uint64(v.expansion))
+	b = binary.AppendUvarint(b, uint64(v.items))
+	b = binary.AppendUvarint(b, uint64(v.deletes))
+	b = binary.AppendUvarint(b, uint64(len(v.filters)))
+	for _, f := range v.filters {
+		b = binary.AppendUvarint(b, f.numBuckets)
+		b = append(b, f.slots...)
+	}
+	return b
+}
+
+// decodeCuckoo decodes a filter encoded by encode.
+func decodeCuckoo(b []byte) (*cuckooValue, error) {
+	r := &spillReader{b: b}
+	v := &cuckooValue{
+		bucketSize:    int(r.uvarint()),
+		maxIterations: int(r.uvarint()),
+		expansion:     int(r.uvarint()),
+		items:         int64(r.uvarint()),
+		deletes:       int64(r.uvarint()),
+	}
+	if v.bucketSize == 0 || v.bucketSize > 255 {
+		return nil, errCorruptSpill
+	}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		numBuckets := r.uvarint()
+		size := numBuckets * uint64(v.bucketSize)
+		if numBuckets == 0 || numBuckets&(numBuckets-1) != 0 || size > uint64(len(r.b)) {
+			return nil, errCorruptSpill
+		}
+		v.filters = append(v.filters, &cuckooFilter{numBuckets: numBuckets, slots: append([]uint8(nil), r.b[:size]...)})
+		r.b = r.b[size:]
+	}
+	if r.err == nil && (len(v.filters) == 0 || len(r.b) > 0) {
+		r.err = errCorruptSpill
+	}
+	return v, r.err
+}
+
+// liveCuckoo returns the cuckoo filter stored at key, nil if there is none,
+// or ErrWrongType.
+func (s *Store) liveCuckoo(sh *shard, key string) (*cuckooValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, nil
+	}
+	if item.Type != TypeCuckoo {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*cuckooValue), nil
+}
+
+// CFReserve creates an empty cuckoo filter at key for capacity items, with
+// bucketSize fingerprints per bucket, at most maxIterations kicks per
+// addition and room for expansion times more buckets each time it fills,
+// or no more items if expansion is 0. It returns ErrBloomExists if the key
+// exists.
+func (s *Store) CFReserve(key string, capacity int64, bucketSize, maxIterations, expansion int) error {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if item, ok := sh.items[key]; ok && !s.isExpired(item) {
+		return ErrBloomExists
+	}
+	sh.items[key] = Item{Value: newCuckooValue(capacity, bucketSize, maxIterations, expansion), Type: TypeCuckoo}
+	return nil
+}
+
+// CFAdd adds an item to the cuckoo filter at key, creating it with the
+// defaults if it doesn't exist. With nx, an item that may already be there
+// isn't added again. It reports whether the item was added.
+func (s *Store) CFAdd(key, item string, nx bool) (bool, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	cuckoo, err := s.liveCuckoo(sh, key)
+	if err != nil {
+		return false, err
+	}
+	if cuckoo == nil {
+		cuckoo = newCuckooValue(DefaultCuckooCapacity, DefaultCuckooBucketSize, DefaultCuckooMaxIterations, DefaultCuckooExpansion)
+		sh.items[key] = Item{Value: cuckoo, Type: TypeCuckoo}
+	}
+	if nx && cuckoo.count(item) > 0 {
+		return false, nil
+	}
+	if err := cuckoo.add(item); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CFCount returns for each item how many times it may have been added to
+// the cuckoo filter at key, less the times it was deleted.
+func (s *Store) CFCount(key string, items []string) ([]int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	cuckoo, err := s.liveCuckoo(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int, len(items))
+	if cuckoo == nil {
+		return counts, nil
+	}
+	for i, item := range items {
+		counts[i] = cuckoo.count(item)
+	}
+	return counts, nil
+}
+
+// CFDel deletes one addition of an item from the cuckoo filter at key. It
+// reports whether the item was found, and whether the filter exists.
+func (s *Store) CFDel(key, item string) (bool, bool, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	cuckoo, err := s.liveCuckoo(sh, key)
+	if cuckoo == nil {
+		return false, false, err
+	}
+	return cuckoo.del(item), true, nil
+}
+
+// CFInfo describes the cuckoo filter at key, reporting false if there is
+// none.
+func (s *Store) CFInfo(key string) (CuckooInfo, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	cuckoo, err := s.liveCuckoo(sh, key)
+	if cuckoo == nil {
+		return CuckooInfo{}, false, err
+	}
+	return cuckoo.info(), true, nil
+}
+
+// CFDump serializes the cuckoo filter at key for CFLoad, reporting false if
+// there is none.
+func (s *Store) CFDump(key string) ([]byte, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	cuckoo, err := s.liveCuckoo(sh, key)
+	if cuckoo == nil {
+		return nil, false, err
+	}
+	return cuckoo.encode(), true, nil
+}
+
+// CFLoad replaces the value at key with a cuckoo filter serialized by
+// CFDump.
+func (s *Store) CFLoad(key string, data []byte) error {
+	cuckoo, err := decodeCuckoo(data)
+	if err != nil {
+		return ErrBloomCorrupt
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.items[key] = Item{Value: cuckoo, Type: TypeCuckoo}
+	return nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// String values of keys matching the encryption patterns are kept sealed
+// with AES-GCM, as sealPrefix followed by the nonce and the ciphertext, and
+// only opened when read. The sealed form is what ends up in snapshots, AOF
+// rewrites, the spill file and memory dumps, so a restart needs the same key
+// but never sees the plaintext. Every value written to such a key is sealed,
+// whatever it looks like, and a value is only taken for sealed when its key
+// matches a pattern, so clients can neither forge nor hide a sealed value.
+// The AOF tells sealed values apart out of band, by logging them with
+// SETSEALED, which SetSealed replays. Values of other types are not
+// encrypted.
+
+// sealPrefix marks a sealed string value in memory.
+const sealPrefix = "\x00sealed:v1:"
+
+// ErrSealed is returned when a sealed value can't be opened, because another
+// key is configured or the value was tampered with.
+var ErrSealed = errors.New("ERR value is encrypted and can't be decrypted with the configured key")
+
+// sealer encrypts the values of keys matching its patterns.
+type sealer struct {
+	aead     cipher.AEAD
+	patterns []string
+}
+
+// EnableEncryption encrypts the string values of keys matching any of the
+// glob patterns with key, which must be 16, 24 or 32 bytes long for
+// AES-128, AES-192 or AES-256. It must be called before any data is loaded.
+func (s *Store) EnableEncryption(key []byte, patterns []string) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.sealer = &sealer{aead: aead, patterns: patterns}
+	return nil
+}
+
+// Seal returns value as it is stored under key, and reports whether it is
+// sealed, which it is when key matches an encryption pattern. Commands use it
+// to store and log the same sealed form, with SetSealed and SETSEALED.
+func (s *Store) Seal(key, value string) (string, bool) {
+	if !s.encrypts(key) {
+		return value, false
+	}
+	nonce := make([]byte, s.sealer.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("reading random nonce: %v", err))
+	}
+	return sealPrefix + string(s.sealer.aead.Seal(nonce, nonce, []byte(value), nil)), true
+}
+
+// encrypts reports whether the string values of key are sealed.
+func (s *Store) encrypts(key string) bool {
+	if s.sealer == nil {
+		return false
+	}
+	for _, pattern := range s.sealer.patterns {
+		if MatchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// open returns the plaintext of the value of key, which is returned as it is
+// unless key is encrypted and the value sealed. A value loaded from before
+// the key was encrypted isn't sealed yet.
+func (s *Store) open(key, value string) (string, error) {
+	if !s.encrypts(key) || !strings.HasPrefix(value, sealPrefix) {
+		return value, nil
+	}
+	sealed := value[len(sealPrefix):]
+	n := s.sealer.aead.NonceSize()
+	if len(sealed) < n {
+		return "", ErrSealed
+	}
+	plain, err := s.sealer.aead.Open(nil, []byte(sealed[:n]), []byte(sealed[n:]), nil)
+	if err != nil {
+		return "", ErrSealed
+	}
+	return string(plain), nil
+}
+
+// sealed reports whether value, stored under key, is sealed, so that rewrites
+// log it with SETSEALED.
+func (s *Store) sealed(key, value string) bool {
+	return s.encrypts(key) && strings.HasPrefix(value, sealPrefix)
+}
+
+// openString opens a string value read from the store, logging a value that
+// can't be opened, which is then treated as missing.
+func (s *Store) openString(key, value string) (string, bool) {
+	plain, err := s.open(key, value)
+	if err != nil {
+		log.Printf("Encryption: can't decrypt the value of '%s': %v", key, err)
+		return "", false
+	}
+	return plain, true
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// functionLibraries holds the libraries of functions loaded with FUNCTION
+// LOAD, by name. The store keeps their code, persisting it with the keys,
+// but leaves running it to the caller, which caches what it compiled from
+// them until they change. Flush leaves them alone, as FLUSHALL does in
+// Redis.
+type functionLibraries struct {
+	sync.Mutex
+	code map[string]string
+	// version counts the changes to the libraries.
+	version uint64
+	// compiled is what the caller built from the libraries at
+	// compiledVersion.
+	compiled        any
+	compiledVersion uint64
+}
+
+// ParseLibraryHeader parses the first line of the code of a function
+// library, such as "#!lua name=mylib", returning the engine and the
+// library's name.
+func ParseLibraryHeader(code string) (engine, name string, err error) {
+	line, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(line, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return "", "", errors.New("Missing library metadata")
+	}
+	engine = fields[0]
+	for _, field := range fields[1:] {
+		value, ok := strings.CutPrefix(field, "name=")
+		if !ok {
+			return "", "", errors.New("Invalid metadata value given: " + field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return "", "", errors.New("Library name must only contain letters, numbers, or underscores(_)")
+		}
+	}
+	return engine, name, nil
+}
+
+// SetFunctionLibrary adds the library name with code, replacing any
+// library of that name.
+func (s *Store) SetFunctionLibrary(name, code string) {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	if s.functions.code == nil {
+		s.functions.code = make(map[string]string)
+	}
+	s.functions.code[name] = code
+	s.functions.version++
+}
+
+// DeleteFunctionLibrary removes the library name, reporting false if there
+// is none.
+func (s *Store) DeleteFunctionLibrary(name string) bool {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	if _, ok := s.functions.code[name]; !ok {
+		return false
+	}
+	delete(s.functions.code, name)
+	s.functions.version++
+	return true
+}
+
+// FlushFunctionLibraries removes every library.
+func (s *Store) FlushFunctionLibraries() {
+	s.setFunctionLibraries(nil)
+}
+
+// setFunctionLibraries replaces the libraries with code.
+func (s *Store) setFunctionLibraries(code map[string]string) {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	s.functions.code = code
+	s.functions.version++
+}
+
+// FunctionLibraries returns a copy of the code of every library, by name.
+func (s *Store) FunctionLibraries() map[string]string {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	code := make(map[string]string, len(s.functions.code))
+	maps.Copy(code, s.functions.code)
+	return code
+}
+
+// CompiledFunctions returns what build made of the libraries, given their
+// code by name, calling it again only if they changed since it last did.
+func (s *Store) CompiledFunctions(build func(code map[string]string) any) any {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	if s.functions.compiled == nil || s.functions.compiledVersion != s.functions.version {
+		code := make(map[string]string, len(s.functions.code))
+		maps.Copy(code, s.functions.code)
+		s.functions.compiled = build(code)
+		s.functions.compiledVersion = s.functions.version
+	}
+	return s.functions.compiled
+}
+
+// CachedFunctions returns what CompiledFunctions last built, reporting
+// false if the libraries changed since, for callers that can't build.
+func (s *Store) CachedFunctions() (any, bool) {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	if s.functions.compiled == nil || s.functions.compiledVersion != s.functions.version {
+		return nil, false
+	}
+	return s.functions.compiled, true
+}
+
+// HasFunctionLibraries reports whether any library is loaded.
+func (s *Store) HasFunctionLibraries() bool {
+	s.functions.Lock()
+	defer s.functions.Unlock()
+	return len(s.functions.code) > 0
+}
+
+// DumpFunctionLibraries returns the libraries in the payload format of
+// Redis' FUNCTION DUMP: each library's code as an RDB FUNCTION2 entry,
+// followed by the RDB version and a checksum.
+func (s *Store) DumpFunctionLibraries() []byte {
+	var buf bytes.Buffer
+	rw := &rdbWriter{w: bufio.NewWriter(&buf)}
+	code := s.FunctionLibraries()
+	for _, name := range slices.Sorted(maps.Keys(code)) {
+		rw.byte(rdbOpFunction2)
+		rw.string(code[name])
+	}
+	rw.write([]byte{rdbVersion, 0})
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, rw.crc)
+	rw.w.Write(checksum)
+	rw.w.Flush()
+	return buf.Bytes()
+}
+
+// ReadFunctionDump returns the code of the libraries in a payload
+// DumpFunctionLibraries returned, by name.
+func ReadFunctionDump(payload []byte) (map[string]string, error) {
+	if len(payload) < 10 {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+	body, trailer := payload[:len(payload)-10], payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(trailer)
+	sum := ^crc64.Update(^uint64(0), crcJones, payload[:len(payload)-8])
+	if version > 12 || binary.LittleEndian.Uint64(trailer[2:]) != sum {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+	rr := &rdbReader{r: bufio.NewReader(bytes.NewReader(body))}
+	code := make(map[string]string)
+	for {
+		op, err := rr.byte()
+		if err != nil {
+			return code, nil
+		}
+		if op != rdbOpFunction2 {
+			return nil, errors.New("given type is not a function")
+		}
+		library, err := rr.string()
+		if err != nil {
+			return nil, errors.New("failed loading library payload")
+		}
+		_, name, err := ParseLibraryHeader(library)
+		if err != nil {
+			return nil, err
+		}
+		code[name] = library
+	}
+}
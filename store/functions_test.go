@@ -0,0 +1,74 @@
+package store
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+)
+
+const testLibrary = "#!lua name=mylib\nredis.register_function('f', function() return 1 end)"
+
+func TestParseLibraryHeader(t *testing.T) {
+	tests := []struct {
+		code, engine, name, err string
+	}{
+		{testLibrary, "lua", "mylib", ""},
+		{"#!LUA   name=a_1\n", "LUA", "a_1", ""},
+		{"return 1", "", "", "Missing library metadata"},
+		{"#!lua\n", "", "", "Library name was not given"},
+		{"#!lua name=x other=y\n", "", "", "Invalid metadata value given: other=y"},
+		{"#!lua name=a-b\n", "", "", "Library name must only contain letters, numbers, or underscores(_)"},
+	}
+	for _, tt := range tests {
+		engine, name, err := ParseLibraryHeader(tt.code)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: error %v, want %q", tt.code, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || engine != tt.engine || name != tt.name {
+			t.Errorf("%q = %q, %q, %v, want %q, %q", tt.code, engine, name, err, tt.engine, tt.name)
+		}
+	}
+}
+
+func TestFunctionDump(t *testing.T) {
+	s := NewStore()
+	s.SetFunctionLibrary("mylib", testLibrary)
+	s.SetFunctionLibrary("other", "#!lua name=other\n")
+	payload := s.DumpFunctionLibraries()
+	code, err := ReadFunctionDump(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(code, s.FunctionLibraries()) {
+		t.Errorf("restored %v, want %v", code, s.FunctionLibraries())
+	}
+	payload[3] ^= 1
+	if _, err := ReadFunctionDump(payload); err == nil || err.Error() != "payload version or checksum are wrong" {
+		t.Errorf("corrupt payload: error %v", err)
+	}
+}
+
+func TestFunctionsRDB(t *testing.T) {
+	s := NewStore()
+	s.Set("k", "v", 0)
+	s.SetFunctionLibrary("mylib", testLibrary)
+	var buf bytes.Buffer
+	if err := s.WriteRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewStore()
+	if _, err := loaded.ReadRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if code := loaded.FunctionLibraries(); code["mylib"] != testLibrary || len(code) != 1 {
+		t.Errorf("loaded libraries %v", code)
+	}
+	// FLUSHALL leaves the libraries alone.
+	loaded.Flush()
+	if len(loaded.FunctionLibraries()) != 1 {
+		t.Errorf("Flush removed the libraries")
+	}
+}
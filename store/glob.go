@@ -0,0 +1,83 @@
+package store
+
+// MatchPattern reports whether str matches the Redis-style glob pattern.
+// It supports '*', '?', character classes such as [abc], [^a] and [a-z], and
+// backslash escapes, following the semantics of Redis' stringmatch.
+func MatchPattern(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Collapse consecutive stars, then try every possible split point.
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if MatchPattern(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					if pattern[1] == str[0] {
+						matched = true
+					}
+					pattern = pattern[2:]
+				case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if str[0] >= lo && str[0] <= hi {
+						matched = true
+					}
+					pattern = pattern[3:]
+				default:
+					if pattern[0] == str[0] {
+						matched = true
+					}
+					pattern = pattern[1:]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			str = str[1:]
+			if len(pattern) == 0 {
+				// Unterminated class: treat the end of the pattern as its close.
+				return len(str) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
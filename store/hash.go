@@ -0,0 +1,402 @@
+package store
+
+import (
+	"time"
+)
+
+// Result codes reported per field by HEXPIRE, HPERSIST and HTTL, matching Redis.
+const (
+	FieldMissing        = -2 // the field (or the whole key) does not exist
+	FieldNoTTL          = -1 // HTTL/HPERSIST: the field has no expiration
+	FieldConditionUnmet = 0  // HEXPIRE: the NX/XX/GT/LT condition was not met
+	FieldUpdated        = 1  // HEXPIRE: the expiration was set; HPERSIST: it was removed
+	FieldDeleted        = 2  // HEXPIRE: the time was in the past, so the field was deleted
+)
+
+// fieldExpired reports whether a hash field's TTL has passed. Like isExpired,
+// it does not handle locking.
+func fieldExpired(item Item, field string, now time.Time) bool {
+	at, ok := item.FieldExpirations[field]
+	return ok && now.After(at)
+}
+
+// liveHash returns the hash stored at key for reading, or nil if the key is
+// missing, expired or not a hash. The caller must hold the shard's lock and
+// must skip fields for which fieldExpired is true.
+func (s *Store) liveHash(sh *shard, key string) (Item, *hashValue) {
+	item, ok := sh.items[key]
+	if !ok || item.Type != TypeHash || s.isExpired(item) {
+		return item, nil
+	}
+	return item, item.Value.(*hashValue)
+}
+
+// writableHash returns the hash stored at key for modification with expired
+// fields already removed. A missing or expired key yields a new, empty hash
+// that the caller stores with sh.items[key] = item. The caller must hold the
+// shard's write lock.
+func (s *Store) writableHash(sh *shard, key string) (Item, *hashValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		hash := &hashValue{}
+		return Item{Value: hash, Type: TypeHash}, hash, nil
+	}
+	if item.Type != TypeHash {
+		return item, nil, ErrWrongType
+	}
+	hash := item.Value.(*hashValue)
+	if len(item.FieldExpirations) > 0 {
+		now := time.Now()
+		for field, at := range item.FieldExpirations {
+			if now.After(at) {
+				hash.del(field)
+				delete(item.FieldExpirations, field)
+			}
+		}
+	}
+	return item, hash, nil
+}
+
+// storeHash writes back a modified hash, deleting the key once it is empty.
+func (s *Store) storeHash(sh *shard, key string, item Item, hash *hashValue) {
+	if hash.len() == 0 {
+		delete(sh.items, key)
+		return
+	}
+	if len(item.FieldExpirations) == 0 {
+		item.FieldExpirations = nil
+	}
+	item.Value = hash
+	sh.items[key] = item
+}
+
+// HSet sets fields in a hash stored at key, from fieldValues, a list of
+// field-value pairs, and returns how many fields were added.
+// Overwriting a field clears its TTL.
+func (s *Store) HSet(key string, fieldValues []string) int {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, hash, err := s.writableHash(sh, key)
+	if err != nil {
+		// If key exists but is not a hash, delete it and start a new hash.
+		delete(sh.items, key)
+		item, hash, _ = s.writableHash(sh, key)
+	}
+
+	// Check if the fields already exist to return the correct count.
+	addedCount := 0
+	for i := 0; i+1 < len(fieldValues); i += 2 {
+		field, value := fieldValues[i], fieldValues[i+1]
+		if !hash.has(field) {
+			addedCount++
+			field = s.getSlab(key).internOne(field)
+		}
+		hash.set(field, s.getSlab(key).internOne(value), s.hashLimits)
+		delete(item.FieldExpirations, field)
+	}
+	s.storeHash(sh, key, item, hash)
+	return addedCount
+}
+
+// HSetNX sets field in the hash stored at key only if the field does not exist yet.
+// It reports whether the field was set.
+func (s *Store) HSetNX(key string, field string, value string) (bool, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, hash, err := s.writableHash(sh, key)
+	if err != nil {
+		return false, err
+	}
+	if hash.has(field) {
+		return false, nil
+	}
+
+	hash.set(s.getSlab(key).internOne(field), s.getSlab(key).internOne(value), s.hashLimits)
+	s.storeHash(sh, key, item, hash)
+	return true, nil
+}
+
+// HGet retrieves the value associated with field in the hash stored at key.
+func (s *Store) HGet(key string, field string) (string, bool) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, hash := s.liveHash(sh, key)
+	if hash == nil || fieldExpired(item, field, time.Now()) {
+		return "", false
+	}
+	return hash.get(field)
+}
+
+// HDel deletes one or more fields from the hash stored at key.
+func (s *Store) HDel(key string, fields []string) int {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, hash, err := s.writableHash(sh, key)
+	if err != nil {
+		return 0
+	}
+
+	deletedCount := 0
+	for _, field := range fields {
+		if hash.del(field) {
+			delete(item.FieldExpirations, field)
+			deletedCount++
+		}
+	}
+
+	// If the hash becomes empty, storeHash deletes the key itself.
+	s.storeHash(sh, key, item, hash)
+	return deletedCount
+}
+
+// HGetAll retrieves all fields and values of the hash stored at key.
+func (s *Store) HGetAll(key string) map[string]string {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, hash := s.liveHash(sh, key)
+	if hash == nil {
+		return nil
+	}
+
+	// Return a copy to prevent external modifications.
+	now := time.Now()
+	newHash := make(map[string]string, hash.len())
+	hash.each(func(k, v string) bool {
+		if !fieldExpired(item, k, now) {
+			newHash[k] = v
+		}
+		return true
+	})
+	return newHash
+}
+
+// HExists reports whether field exists in the hash stored at key.
+func (s *Store) HExists(key string, field string) bool {
+	_, exists := s.HGet(key, field)
+	return exists
+}
+
+// HLen returns the number of fields in the hash stored at key.
+func (s *Store) HLen(key string) int {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, hash := s.liveHash(sh, key)
+	if hash == nil {
+		return 0
+	}
+	count := hash.len()
+	now := time.Now()
+	for field := range item.FieldExpirations {
+		if fieldExpired(item, field, now) {
+			count--
+		}
+	}
+	return count
+}
+
+// HKeys returns all field names of the hash stored at key.
+func (s *Store) HKeys(key string) []string {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, hash := s.liveHash(sh, key)
+	if hash == nil {
+		return nil
+	}
+
+	now := time.Now()
+	fields := make([]string, 0, hash.len())
+	hash.each(func(field, _ string) bool {
+		if !fieldExpired(item, field, now) {
+			fields = append(fields, field)
+		}
+		return true
+	})
+	return fields
+}
+
+// HVals returns all values of the hash stored at key.
+func (s *Store) HVals(key string) []string {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, hash := s.liveHash(sh, key)
+	if hash == nil {
+		return nil
+	}
+
+	now := time.Now()
+	values := make([]string, 0, hash.len())
+	hash.each(func(field, value string) bool {
+		if !fieldExpired(item, field, now) {
+			values = append(values, value)
+		}
+		return true
+	})
+	return values
+}
+
+// HExpire sets the expiration time of the given hash fields. The condition is
+// one of "", "NX" (only fields without a TTL), "XX" (only fields with a TTL),
+// "GT" (only if later than the current TTL) or "LT" (only if earlier). It
+// returns one of the Field* result codes per field.
+func (s *Store) HExpire(key string, at time.Time, condition string, fields []string) ([]int, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	results := make([]int, len(fields))
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		for i := range results {
+			results[i] = FieldMissing
+		}
+		return results, nil
+	}
+	item, hash, err := s.writableHash(sh, key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i, field := range fields {
+		if !hash.has(field) {
+			results[i] = FieldMissing
+			continue
+		}
+		current, hasTTL := item.FieldExpirations[field]
+		met := true
+		switch condition {
+		case "NX":
+			met = !hasTTL
+		case "XX":
+			met = hasTTL
+		case "GT":
+			met = hasTTL && at.After(current)
+		case "LT":
+			met = !hasTTL || at.Before(current)
+		}
+		if !met {
+			results[i] = FieldConditionUnmet
+			continue
+		}
+		if !at.After(now) {
+			hash.del(field)
+			delete(item.FieldExpirations, field)
+			results[i] = FieldDeleted
+			continue
+		}
+		if item.FieldExpirations == nil {
+			item.FieldExpirations = make(map[string]time.Time)
+		}
+		item.FieldExpirations[field] = at
+		results[i] = FieldUpdated
+	}
+	s.storeHash(sh, key, item, hash)
+	return results, nil
+}
+
+// HPersist removes the expiration of the given hash fields, returning one of
+// FieldMissing, FieldNoTTL or FieldUpdated per field.
+func (s *Store) HPersist(key string, fields []string) ([]int, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	results := make([]int, len(fields))
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		for i := range results {
+			results[i] = FieldMissing
+		}
+		return results, nil
+	}
+	item, hash, err := s.writableHash(sh, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, field := range fields {
+		if !hash.has(field) {
+			results[i] = FieldMissing
+		} else if _, hasTTL := item.FieldExpirations[field]; !hasTTL {
+			results[i] = FieldNoTTL
+		} else {
+			delete(item.FieldExpirations, field)
+			results[i] = FieldUpdated
+		}
+	}
+	s.storeHash(sh, key, item, hash)
+	return results, nil
+}
+
+// HTTL returns the remaining time to live of the given hash fields in
+// milliseconds, or FieldNoTTL / FieldMissing for fields without a TTL or that
+// don't exist.
+func (s *Store) HTTL(key string, fields []string) ([]int64, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, ok := sh.items[key]
+	if ok && !s.isExpired(item) && item.Type != TypeHash {
+		return nil, ErrWrongType
+	}
+	item, hash := s.liveHash(sh, key)
+	now := time.Now()
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		exists := hash != nil && hash.has(field)
+		at, hasTTL := item.FieldExpirations[field]
+		switch {
+		case !exists || (hasTTL && now.After(at)):
+			results[i] = FieldMissing
+		case !hasTTL:
+			results[i] = FieldNoTTL
+		default:
+			results[i] = at.Sub(now).Milliseconds()
+		}
+	}
+	return results, nil
+}
+
+// expireHashFields removes the expired fields of every hash in the shard and
+// returns how many keys became empty and were deleted. The caller must hold
+// the shard's write lock.
+func (s *Store) expireHashFields(sh *shard) int {
+	deleted := 0
+	for key, item := range sh.items {
+		if item.Type != TypeHash || len(item.FieldExpirations) == 0 {
+			continue
+		}
+		item, hash, err := s.writableHash(sh, key)
+		if err != nil {
+			continue
+		}
+		s.storeHash(sh, key, item, hash)
+		if hash.len() == 0 {
+			deleted++
+		}
+	}
+	return deleted
+}
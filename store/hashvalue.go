@@ -0,0 +1,146 @@
+package store
+
+// Default limits for the compact hash encoding, matching Redis'
+// hash-max-listpack-entries and hash-max-listpack-value.
+const (
+	defaultHashMaxCompactEntries = 128
+	defaultHashMaxCompactValue   = 64
+)
+
+// hashValue is the in-memory representation of a hash. Small hashes use a
+// compact encoding: a flat slice of alternating fields and values, which
+// avoids the per-entry bucket overhead of a Go map and is faster to scan than
+// to hash for a handful of fields. Once a hash grows past the configured
+// entry count or stores a field or value longer than the configured length,
+// it is converted to a map for good.
+type hashValue struct {
+	pairs []string          // compact encoding: field0, value0, field1, value1, ...
+	m     map[string]string // hashtable encoding; nil while compact
+}
+
+// hashLimits holds the thresholds at which a compact hash is converted.
+type hashLimits struct {
+	maxEntries int
+	maxValue   int
+}
+
+// SetHashCompactLimits sets the thresholds up to which hashes use the compact
+// encoding; a non-positive value keeps the current setting. Existing hashes
+// are converted lazily on their next write.
+func (s *Store) SetHashCompactLimits(maxEntries, maxValue int) {
+	if maxEntries > 0 {
+		s.hashLimits.maxEntries = maxEntries
+	}
+	if maxValue > 0 {
+		s.hashLimits.maxValue = maxValue
+	}
+}
+
+// encoding returns the OBJECT ENCODING style name of the representation.
+func (h *hashValue) encoding() string {
+	if h.m != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+// len returns the number of fields.
+func (h *hashValue) len() int {
+	if h.m != nil {
+		return len(h.m)
+	}
+	return len(h.pairs) / 2
+}
+
+// index returns the position of field in the compact pairs, or -1.
+func (h *hashValue) index(field string) int {
+	for i := 0; i < len(h.pairs); i += 2 {
+		if h.pairs[i] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// get returns the value of field.
+func (h *hashValue) get(field string) (string, bool) {
+	if h.m != nil {
+		v, ok := h.m[field]
+		return v, ok
+	}
+	if i := h.index(field); i >= 0 {
+		return h.pairs[i+1], true
+	}
+	return "", false
+}
+
+// has reports whether field exists.
+func (h *hashValue) has(field string) bool {
+	_, ok := h.get(field)
+	return ok
+}
+
+// set stores value under field, converting to the map encoding when the
+// limits are exceeded. It reports whether the field was newly added.
+func (h *hashValue) set(field, value string, limits hashLimits) bool {
+	if h.m == nil {
+		if i := h.index(field); i >= 0 {
+			if len(value) <= limits.maxValue {
+				h.pairs[i+1] = value
+				return false
+			}
+		} else if h.len() < limits.maxEntries && len(field) <= limits.maxValue && len(value) <= limits.maxValue {
+			h.pairs = append(h.pairs, field, value)
+			return true
+		}
+		h.convert()
+	}
+	_, exists := h.m[field]
+	h.m[field] = value
+	return !exists
+}
+
+// del removes field and reports whether it existed.
+func (h *hashValue) del(field string) bool {
+	if h.m != nil {
+		_, ok := h.m[field]
+		delete(h.m, field)
+		return ok
+	}
+	i := h.index(field)
+	if i < 0 {
+		return false
+	}
+	// Move the last pair into the hole; field order is not significant.
+	last := len(h.pairs) - 2
+	h.pairs[i], h.pairs[i+1] = h.pairs[last], h.pairs[last+1]
+	h.pairs[last], h.pairs[last+1] = "", ""
+	h.pairs = h.pairs[:last]
+	return true
+}
+
+// each calls fn for every field until fn returns false.
+func (h *hashValue) each(fn func(field, value string) bool) {
+	if h.m != nil {
+		for f, v := range h.m {
+			if !fn(f, v) {
+				return
+			}
+		}
+		return
+	}
+	for i := 0; i < len(h.pairs); i += 2 {
+		if !fn(h.pairs[i], h.pairs[i+1]) {
+			return
+		}
+	}
+}
+
+// convert switches the hash to the map encoding.
+func (h *hashValue) convert() {
+	h.m = make(map[string]string, h.len()+1)
+	for i := 0; i < len(h.pairs); i += 2 {
+		h.m[h.pairs[i]] = h.pairs[i+1]
+	}
+	h.pairs = nil
+}
@@ -0,0 +1,75 @@
+package store
+
+import "time"
+
+// The view functions give read access to large values without copying
+// them, so a reply to HGETALL, SMEMBERS or LRANGE can be written out as the
+// value is walked instead of being built in full first. A view reads the
+// live value: it is only consistent while no command writes to the key,
+// which callers ensure by holding the server's command lock for as long as
+// they use it. Background work such as expiration and tiering replaces or
+// removes the key's entry but never changes a value in place, so it doesn't
+// disturb a view.
+
+// ListView returns the elements of the list at key, or nil if there is
+// none. The slice is the list itself and must not be modified.
+func (s *Store) ListView(key string) []string {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	if !ok || item.Type != TypeList || s.isExpired(item) {
+		return nil
+	}
+	return item.Value.([]string)
+}
+
+// SetView returns the number of members of the set at key and a function
+// calling fn with each of them.
+func (s *Store) SetView(key string) (int, func(fn func(member string))) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	if !ok || item.Type != TypeSet || s.isExpired(item) {
+		return 0, func(func(string)) {}
+	}
+	set := item.Value.(map[string]struct{})
+	return len(set), func(fn func(string)) {
+		for member := range set {
+			fn(member)
+		}
+	}
+}
+
+// HashView returns the number of fields of the hash at key and a function
+// calling fn with each of them and its value. Fields that expired by the
+// time of the call are left out of both.
+func (s *Store) HashView(key string) (int, func(fn func(field, value string))) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+	item, hash := s.liveHash(sh, key)
+	if hash == nil {
+		return 0, func(func(string, string)) {}
+	}
+	now := time.Now()
+	n := 0
+	hash.each(func(field, _ string) bool {
+		if !fieldExpired(item, field, now) {
+			n++
+		}
+		return true
+	})
+	return n, func(fn func(string, string)) {
+		hash.each(func(field, value string) bool {
+			if !fieldExpired(item, field, now) {
+				fn(field, value)
+			}
+			return true
+		})
+	}
+}
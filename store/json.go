@@ -0,0 +1,669 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TypeJSON values are stored as a *jsonValue: a JSON document in the manner
+// of RedisJSON, held as a tree whose nodes are:
+//
+//	*jsonObject   an object, which keeps its members in insertion order
+//	*jsonArray    an array
+//	json.Number   a number, kept as written so integers stay integers
+//	string, bool  strings and booleans
+//	nil           null
+//
+// Containers are pointers so that paths can update them in place.
+type jsonValue struct {
+	root any
+}
+
+// jsonObject is an object node, its keys in insertion order.
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+// jsonArray is an array node.
+type jsonArray struct {
+	elems []any
+}
+
+// maxJSONDepth caps how deeply documents can nest, as RedisJSON does.
+const maxJSONDepth = 128
+
+var (
+	// ErrJSONNoKey is returned when updating a document that doesn't exist.
+	ErrJSONNoKey = errors.New("ERR could not perform this operation on a key that doesn't exist")
+	// ErrJSONRoot is returned when creating a document at a path other than
+	// the root.
+	ErrJSONRoot = errors.New("ERR new objects must be created at the root")
+	// ErrJSONIndex is returned for an array index out of range.
+	ErrJSONIndex = errors.New("ERR index out of bounds")
+	// ErrJSONNaN is returned when an increment doesn't give a finite number.
+	ErrJSONNaN = errors.New("ERR result is not a number or is infinite")
+	// ErrJSONDepth is returned for documents nested deeper than maxJSONDepth.
+	ErrJSONDepth = errors.New("ERR the JSON value is nested too deeply")
+)
+
+// JSONMember is a member of an object as JSONValues returns it.
+type JSONMember struct {
+	Key   string
+	Value any
+}
+
+// JSONFormat holds the INDENT, NEWLINE and SPACE strings JSON.GET formats
+// documents with. The zero value formats them compactly.
+type JSONFormat struct {
+	Indent, Newline, Space string
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: make(map[string]any)}
+}
+
+// set sets a member, appending it if it is new.
+func (o *jsonObject) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// del removes a member.
+func (o *jsonObject) del(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	o.keys = slices.DeleteFunc(o.keys, func(k string) bool { return k == key })
+}
+
+// parseJSON parses a document, with its numbers kept as json.Number.
+func parseJSON(text string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	v, err := decodeJSON(dec, 0)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			return v, nil
+		}
+		err = errors.New("trailing characters after the value")
+	}
+	if err == ErrJSONDepth {
+		return nil, err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("unexpected end of input")
+	}
+	return nil, fmt.Errorf("ERR invalid JSON: %v", err)
+}
+
+// decodeJSON decodes the next value from dec, depth containers deep.
+func decodeJSON(dec *json.Decoder, depth int) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	if depth == maxJSONDepth {
+		return nil, ErrJSONDepth
+	}
+	switch delim {
+	case '{':
+		obj := newJSONObject()
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSON(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(tok.(string), value)
+		}
+		_, err = dec.Token()
+		return obj, err
+	case '[':
+		arr := &jsonArray{}
+		for dec.More() {
+			value, err := decodeJSON(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			arr.elems = append(arr.elems, value)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+	return nil, fmt.Errorf("unexpected '%c'", delim)
+}
+
+// cloneJSON returns a deep copy of a node.
+func cloneJSON(v any) any {
+	switch v := v.(type) {
+	case *jsonObject:
+		obj := &jsonObject{keys: slices.Clone(v.keys), values: make(map[string]any, len(v.values))}
+		for key, value := range v.values {
+			obj.values[key] = cloneJSON(value)
+		}
+		return obj
+	case *jsonArray:
+		arr := &jsonArray{elems: make([]any, len(v.elems))}
+		for i, elem := range v.elems {
+			arr.elems[i] = cloneJSON(elem)
+		}
+		return arr
+	}
+	return v
+}
+
+// plainJSON converts a node to the values JSONValues returns: objects become
+// []JSONMember and arrays []any.
+func plainJSON(v any) any {
+	switch v := v.(type) {
+	case *jsonObject:
+		members := make([]JSONMember, len(v.keys))
+		for i, key := range v.keys {
+			members[i] = JSONMember{Key: key, Value: plainJSON(v.values[key])}
+		}
+		return members
+	case *jsonArray:
+		elems := make([]any, len(v.elems))
+		for i, elem := range v.elems {
+			elems[i] = plainJSON(elem)
+		}
+		return elems
+	}
+	return v
+}
+
+// jsonTypeName returns the type of a node as JSON.TYPE reports it.
+func jsonTypeName(v any) string {
+	switch v := v.(type) {
+	case *jsonObject:
+		return "object"
+	case *jsonArray:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return "null"
+}
+
+// formatJSON serializes a node.
+func formatJSON(v any, f JSONFormat) string {
+	return string(appendJSON(nil, v, f, 0))
+}
+
+// appendJSON appends a node to b, level containers deep.
+func appendJSON(b []byte, v any, f JSONFormat, level int) []byte {
+	// open starts a container member on a line of its own.
+	open := func(i int) {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, f.Newline...)
+		for range level + 1 {
+			b = append(b, f.Indent...)
+		}
+	}
+	// close ends a non-empty container.
+	close := func(c byte) {
+		b = append(b, f.Newline...)
+		for range level {
+			b = append(b, f.Indent...)
+		}
+		b = append(b, c)
+	}
+	switch v := v.(type) {
+	case *jsonObject:
+		b = append(b, '{')
+		for i, key := range v.keys {
+			open(i)
+			b = appendJSONString(b, key)
+			b = append(b, ':')
+			b = append(b, f.Space...)
+			b = appendJSON(b, v.values[key], f, level+1)
+		}
+		if len(v.keys) == 0 {
+			return append(b, '}')
+		}
+		close('}')
+	case *jsonArray:
+		b = append(b, '[')
+		for i, elem := range v.elems {
+			open(i)
+			b = appendJSON(b, elem, f, level+1)
+		}
+		if len(v.elems) == 0 {
+			return append(b, ']')
+		}
+		close(']')
+	case string:
+		b = appendJSONString(b, v)
+	case json.Number:
+		b = append(b, v...)
+	case bool:
+		b = strconv.AppendBool(b, v)
+	default:
+		b = append(b, "null"...)
+	}
+	return b
+}
+
+// appendJSONString appends s as a JSON string, escaping only what JSON
+// requires, unlike encoding/json which also escapes HTML.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			b = utf8.AppendRune(b, r)
+			i += size
+			continue
+		}
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c == '\n':
+			b = append(b, '\\', 'n')
+		case c == '\r':
+			b = append(b, '\\', 'r')
+		case c == '\t':
+			b = append(b, '\\', 't')
+		case c < 0x20:
+			b = fmt.Appendf(b, `\u%04x`, c)
+		default:
+			b = append(b, c)
+		}
+		i++
+	}
+	return append(b, '"')
+}
+
+// addJSONNumbers adds two numbers, as integers if both are and the sum
+// fits, or else as floats.
+func addJSONNumbers(x, y json.Number) (json.Number, error) {
+	if a, err := x.Int64(); err == nil {
+		if b, err := y.Int64(); err == nil {
+			if sum := a + b; (sum > a) == (b > 0) {
+				return json.Number(strconv.FormatInt(sum, 10)), nil
+			}
+		}
+	}
+	a, _ := x.Float64()
+	b, _ := y.Float64()
+	sum := a + b
+	if math.IsNaN(sum) || math.IsInf(sum, 0) {
+		return "", ErrJSONNaN
+	}
+	s := strconv.FormatFloat(sum, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		// Keep it a float, as RedisJSON does.
+		s += ".0"
+	}
+	return json.Number(s), nil
+}
+
+// liveJSON returns the document stored at key, or nil if there is none.
+func (s *Store) liveJSON(sh *shard, key string) (*jsonValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, nil
+	}
+	if item.Type != TypeJSON {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*jsonValue), nil
+}
+
+// JSONSet sets the value at path in the document at key to the JSON text
+// value. A document can only be created at the root path; otherwise path
+// must match existing values to replace, or name a new member of existing
+// objects. With nx only new members are added, and with xx only existing
+// values replaced. It reports false if nothing was set.
+func (s *Store) JSONSet(key, path, value string, nx, xx bool) (bool, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+	v, err := parseJSON(value)
+	if err != nil {
+		return false, err
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	doc, err := s.liveJSON(sh, key)
+	if err != nil {
+		return false, err
+	}
+	if len(p.steps) == 0 {
+		if doc == nil && xx || doc != nil && nx {
+			return false, nil
+		}
+		if doc == nil {
+			sh.items[key] = Item{Value: &jsonValue{root: v}, Type: TypeJSON}
+		} else {
+			doc.root = v
+		}
+		return true, nil
+	}
+	if doc == nil {
+		return false, ErrJSONRoot
+	}
+	set := false
+	last := p.steps[len(p.steps)-1]
+	if !last.descent && len(last.keys) > 0 {
+		// A member path may add members to the objects it ends in.
+		for _, parent := range evalJSONPath(&doc.root, p.steps[:len(p.steps)-1]) {
+			obj, ok := parent.value.(*jsonObject)
+			if !ok {
+				continue
+			}
+			for _, k := range last.keys {
+				if _, exists := obj.values[k]; exists && nx || !exists && xx {
+					continue
+				}
+				obj.set(k, cloneJSON(v))
+				set = true
+			}
+		}
+		return set, nil
+	}
+	if nx {
+		return false, nil
+	}
+	for _, m := range evalJSONPath(&doc.root, p.steps) {
+		m.replace(cloneJSON(v))
+		set = true
+	}
+	return set, nil
+}
+
+// JSONGet returns the values at paths in the document at key, serialized
+// with f. A single legacy path gives its first value, and a single JSONPath
+// an array of all its values; several paths give an object mapping each to
+// what it would give on its own, with every path treated as a JSONPath if
+// any is. It reports false if the key doesn't exist.
+func (s *Store) JSONGet(key string, paths []string, f JSONFormat) (string, bool, error) {
+	parsed := make([]jsonPath, len(paths))
+	legacy := true
+	for i, path := range paths {
+		p, err := parseJSONPath(path)
+		if err != nil {
+			return "", false, err
+		}
+		parsed[i] = p
+		legacy = legacy && p.legacy
+	}
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	doc, err := s.liveJSON(sh, key)
+	if doc == nil || err != nil {
+		return "", false, err
+	}
+	// result gives what path i alone would.
+	result := func(i int) (any, error) {
+		matches := evalJSONPath(&doc.root, parsed[i].steps)
+		if !legacy {
+			arr := &jsonArray{elems: make([]any, len(matches))}
+			for j, m := range matches {
+				arr.elems[j] = m.value
+			}
+			return arr, nil
+		}
+		if len(matches) == 0 {
+			return nil, jsonPathMissing(paths[i])
+		}
+		return matches[0].value, nil
+	}
+	if len(paths) == 1 {
+		v, err := result(0)
+		if err != nil {
+			return "", false, err
+		}
+		return formatJSON(v, f), true, nil
+	}
+	obj := newJSONObject()
+	for i, path := range paths {
+		v, err := result(i)
+		if err != nil {
+			return "", false, err
+		}
+		obj.set(path, v)
+	}
+	return formatJSON(obj, f), true, nil
+}
+
+// jsonPathMissing returns the error for a legacy path matching nothing.
+func jsonPathMissing(path string) error {
+	return fmt.Errorf("ERR Path '%s' does not exist", path)
+}
+
+// jsonRead calls fn on each value at path in the document at key under the
+// shard's read lock, returning what it returns. For a legacy path only the
+// first value counts, and it is an error if there is none. It reports false
+// if the key doesn't exist.
+func (s *Store) jsonRead(key, path string, fn func(v any) any) ([]any, bool, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	doc, err := s.liveJSON(sh, key)
+	if doc == nil || err != nil {
+		return nil, false, err
+	}
+	matches := evalJSONPath(&doc.root, p.steps)
+	if p.legacy {
+		if len(matches) == 0 {
+			return nil, false, jsonPathMissing(path)
+		}
+		matches = matches[:1]
+	}
+	results := make([]any, len(matches))
+	for i, m := range matches {
+		results[i] = fn(m.value)
+	}
+	return results, true, nil
+}
+
+// JSONValues returns copies of the values at path in the document at key:
+// nil, a bool, a json.Number, a string, a []any for an array or a
+// []JSONMember for an object. A legacy path gives its first value alone.
+// It reports false if the key doesn't exist.
+func (s *Store) JSONValues(key, path string) ([]any, bool, error) {
+	return s.jsonRead(key, path, plainJSON)
+}
+
+// JSONTypes returns the types of the values at path in the document at
+// key, like JSONValues.
+func (s *Store) JSONTypes(key, path string) ([]string, bool, error) {
+	results, ok, err := s.jsonRead(key, path, func(v any) any { return jsonTypeName(v) })
+	types := make([]string, len(results))
+	for i, t := range results {
+		types[i] = t.(string)
+	}
+	return types, ok, err
+}
+
+// JSONArrLen returns the lengths of the arrays at path in the document at
+// key, like JSONValues, with nil for values that aren't arrays.
+func (s *Store) JSONArrLen(key, path string) ([]any, bool, error) {
+	return s.jsonRead(key, path, func(v any) any {
+		if arr, ok := v.(*jsonArray); ok {
+			return int64(len(arr.elems))
+		}
+		return nil
+	})
+}
+
+// jsonUpdate calls fn on each value at path in the document at key under
+// the shard's write lock, or on the first for a legacy path, which must
+// match one, returning the results it gives. The changes fn returns are
+// only applied once every call succeeded, so commands are applied in full
+// or not at all.
+func (s *Store) jsonUpdate(key, path string, fn func(m jsonMatch) (any, func(), error)) ([]any, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	doc, err := s.liveJSON(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrJSONNoKey
+	}
+	matches := evalJSONPath(&doc.root, p.steps)
+	if p.legacy {
+		if len(matches) == 0 {
+			return nil, jsonPathMissing(path)
+		}
+		matches = matches[:1]
+	}
+	results := make([]any, len(matches))
+	var changes []func()
+	for i, m := range matches {
+		var change func()
+		if results[i], change, err = fn(m); err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+	for _, change := range changes {
+		change()
+	}
+	return results, nil
+}
+
+// JSONNumIncrBy adds the number incr to the numbers at path in the document
+// at key and returns their new values, as json.Number, with nil for values
+// that aren't numbers.
+func (s *Store) JSONNumIncrBy(key, path, incr string) ([]any, error) {
+	v, err := parseJSON(incr)
+	by, ok := v.(json.Number)
+	if err != nil || !ok {
+		return nil, errors.New("ERR the increment must be a number")
+	}
+	return s.jsonUpdate(key, path, func(m jsonMatch) (any, func(), error) {
+		n, ok := m.value.(json.Number)
+		if !ok {
+			return nil, nil, nil
+		}
+		sum, err := addJSONNumbers(n, by)
+		return sum, func() { m.replace(sum) }, err
+	})
+}
+
+// JSONArrAppend appends the JSON texts values to the arrays at path in the
+// document at key and returns their new lengths, with nil for values that
+// aren't arrays.
+func (s *Store) JSONArrAppend(key, path string, values []string) ([]any, error) {
+	return s.JSONArrInsert(key, path, math.MaxInt, values)
+}
+
+// JSONArrInsert inserts the JSON texts values before index in the arrays at
+// path in the document at key, or at the end for math.MaxInt, and returns
+// their new lengths, with nil for values that aren't arrays. A negative
+// index counts from the end. It returns ErrJSONIndex if index is out of
+// range for any of the arrays, which are then left alone.
+func (s *Store) JSONArrInsert(key, path string, index int, values []string) ([]any, error) {
+	elems := make([]any, len(values))
+	for i, value := range values {
+		v, err := parseJSON(value)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = v
+	}
+	return s.jsonUpdate(key, path, func(m jsonMatch) (any, func(), error) {
+		arr, ok := m.value.(*jsonArray)
+		if !ok {
+			return nil, nil, nil
+		}
+		i := index
+		switch {
+		case i == math.MaxInt:
+			i = len(arr.elems)
+		case i < 0:
+			i += len(arr.elems)
+		}
+		if i < 0 || i > len(arr.elems) {
+			return nil, nil, ErrJSONIndex
+		}
+		insert := func() {
+			arr.elems = slices.Insert(arr.elems, i, cloneJSON(&jsonArray{elems: elems}).(*jsonArray).elems...)
+		}
+		return int64(len(arr.elems) + len(elems)), insert, nil
+	})
+}
+
+// JSONDel deletes the values at path in the document at key, or the key
+// itself for the root path, and returns how many were deleted.
+func (s *Store) JSONDel(key, path string) (int, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	doc, err := s.liveJSON(sh, key)
+	if doc == nil || err != nil {
+		return 0, err
+	}
+	if len(p.steps) == 0 {
+		delete(sh.items, key)
+		return 1, nil
+	}
+	matches := evalJSONPath(&doc.root, p.steps)
+	// Going backwards deletes later elements of an array first, so the
+	// indexes of the earlier ones still hold.
+	for i := len(matches) - 1; i >= 0; i-- {
+		matches[i].delete()
+	}
+	return len(matches), nil
+}
+
+// String serializes the document compactly.
+func (v *jsonValue) String() string {
+	return formatJSON(v.root, JSONFormat{})
+}
@@ -0,0 +1,300 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed path into a JSON document. Paths starting with '$'
+// are JSONPath, and may match any number of values. Others are legacy
+// RedisJSON paths such as ".a.b[0]", which commands treat as naming a
+// single value; "." is the root.
+type jsonPath struct {
+	steps  []jsonStep
+	legacy bool
+}
+
+// jsonStep is one step of a path, selecting children of the values the
+// steps before it matched: the members or elements with the given keys or
+// indexes, those in a slice, or all of them for a wildcard. A descent step
+// applies to the values matched so far and all their descendants, as ".."
+// does.
+type jsonStep struct {
+	descent  bool
+	wildcard bool
+	keys     []string
+	indexes  []int
+	// slice is set for [start:end:step], where start and end may be
+	// missing.
+	slice              bool
+	start, end, stride int
+	hasStart, hasEnd   bool
+}
+
+// jsonMatch is a value a path matched, with where it sits in the document.
+type jsonMatch struct {
+	value any
+	// parent is the *jsonObject or *jsonArray holding value at key or
+	// index, or nil if value is the root, held by root.
+	parent any
+	key    string
+	index  int
+	root   *any
+}
+
+// replace replaces the matched value.
+func (m jsonMatch) replace(v any) {
+	switch p := m.parent.(type) {
+	case *jsonObject:
+		p.values[m.key] = v
+	case *jsonArray:
+		p.elems[m.index] = v
+	default:
+		*m.root = v
+	}
+}
+
+// delete removes the matched value from its parent.
+func (m jsonMatch) delete() {
+	switch p := m.parent.(type) {
+	case *jsonObject:
+		p.del(m.key)
+	case *jsonArray:
+		if m.index < len(p.elems) {
+			p.elems = append(p.elems[:m.index], p.elems[m.index+1:]...)
+		}
+	}
+}
+
+// parseJSONPath parses a JSONPath or legacy path.
+func parseJSONPath(path string) (jsonPath, error) {
+	p := jsonPath{legacy: !strings.HasPrefix(path, "$")}
+	rest := path
+	switch {
+	case !p.legacy:
+		rest = path[1:]
+	case path == ".":
+		return p, nil
+	case !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "["):
+		rest = "." + path
+	}
+	fail := func() (jsonPath, error) {
+		return jsonPath{}, fmt.Errorf("ERR invalid JSON path '%s' at offset %d", path, len(path)-len(rest))
+	}
+	for rest != "" {
+		var step jsonStep
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.descent = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				break
+			}
+			fallthrough
+		case rest[0] == '.':
+			if !step.descent {
+				rest = rest[1:]
+			}
+			if strings.HasPrefix(rest, "*") {
+				step.wildcard = true
+				rest = rest[1:]
+				break
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return fail()
+			}
+			step.keys = []string{rest[:end]}
+			rest = rest[end:]
+		}
+		if !step.wildcard && step.keys == nil {
+			if !strings.HasPrefix(rest, "[") {
+				return fail()
+			}
+			var ok bool
+			if rest, ok = parseJSONBracket(rest[1:], &step); !ok {
+				return fail()
+			}
+		}
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+// parseJSONBracket parses what follows the '[' of a bracketed step into
+// step, returning the rest of the path after the ']'.
+func parseJSONBracket(s string, step *jsonStep) (string, bool) {
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, "*") {
+		step.wildcard = true
+		s = strings.TrimLeft(s[1:], " ")
+		return strings.CutPrefix(s, "]")
+	}
+	if strings.HasPrefix(s, "'") || strings.HasPrefix(s, `"`) {
+		for {
+			key, rest, ok := parseJSONPathString(s)
+			if !ok {
+				return "", false
+			}
+			step.keys = append(step.keys, key)
+			s = strings.TrimLeft(rest, " ")
+			if s, ok = strings.CutPrefix(s, ","); !ok {
+				return strings.CutPrefix(s, "]")
+			}
+			s = strings.TrimLeft(s, " ")
+		}
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return "", false
+	}
+	inner, rest := s[:end], s[end+1:]
+	if strings.Contains(inner, ":") {
+		parts := strings.Split(inner, ":")
+		if len(parts) > 3 {
+			return "", false
+		}
+		step.slice, step.stride = true, 1
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return "", false
+			}
+			switch i {
+			case 0:
+				step.start, step.hasStart = n, true
+			case 1:
+				step.end, step.hasEnd = n, true
+			case 2:
+				step.stride = n
+			}
+		}
+		return rest, step.stride > 0
+	}
+	for _, part := range strings.Split(inner, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return "", false
+		}
+		step.indexes = append(step.indexes, n)
+	}
+	return rest, true
+}
+
+// parseJSONPathString parses a quoted member name, returning the rest of s
+// after it.
+func parseJSONPathString(s string) (string, string, bool) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == quote:
+			return b.String(), s[i+1:], true
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
+
+// evalJSONPath returns the values steps match in the document held by root,
+// in document order.
+func evalJSONPath(root *any, steps []jsonStep) []jsonMatch {
+	matches := []jsonMatch{{value: *root, root: root}}
+	for _, step := range steps {
+		var next []jsonMatch
+		for _, m := range matches {
+			if step.descent {
+				eachJSONDescendant(m, func(d jsonMatch) {
+					next = step.apply(d, next)
+				})
+			} else {
+				next = step.apply(m, next)
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// eachJSONDescendant calls fn on m and every value below it, parents first.
+func eachJSONDescendant(m jsonMatch, fn func(jsonMatch)) {
+	fn(m)
+	switch v := m.value.(type) {
+	case *jsonObject:
+		for _, key := range v.keys {
+			eachJSONDescendant(jsonMatch{value: v.values[key], parent: v, key: key}, fn)
+		}
+	case *jsonArray:
+		for i, elem := range v.elems {
+			eachJSONDescendant(jsonMatch{value: elem, parent: v, index: i}, fn)
+		}
+	}
+}
+
+// apply appends the children of m the step selects to matches.
+func (step *jsonStep) apply(m jsonMatch, matches []jsonMatch) []jsonMatch {
+	switch v := m.value.(type) {
+	case *jsonObject:
+		if step.wildcard {
+			for _, key := range v.keys {
+				matches = append(matches, jsonMatch{value: v.values[key], parent: v, key: key})
+			}
+		}
+		for _, key := range step.keys {
+			if value, ok := v.values[key]; ok {
+				matches = append(matches, jsonMatch{value: value, parent: v, key: key})
+			}
+		}
+	case *jsonArray:
+		n := len(v.elems)
+		elem := func(i int) {
+			matches = append(matches, jsonMatch{value: v.elems[i], parent: v, index: i})
+		}
+		switch {
+		case step.wildcard:
+			for i := range n {
+				elem(i)
+			}
+		case step.slice:
+			start, end := 0, n
+			if step.hasStart {
+				start = clampJSONIndex(step.start, n)
+			}
+			if step.hasEnd {
+				end = clampJSONIndex(step.end, n)
+			}
+			for i := start; i < end; i += step.stride {
+				elem(i)
+			}
+		}
+		for _, i := range step.indexes {
+			if i < 0 {
+				i += n
+			}
+			if i >= 0 && i < n {
+				elem(i)
+			}
+		}
+	}
+	return matches
+}
+
+// clampJSONIndex resolves a slice bound against an array of n elements.
+func clampJSONIndex(i, n int) int {
+	if i < 0 {
+		i += n
+	}
+	return min(max(i, 0), n)
+}
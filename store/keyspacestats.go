@@ -0,0 +1,46 @@
+package store
+
+import "sync/atomic"
+
+// keyspaceStats counts the lookups of keys by reads and the keys expired,
+// as INFO stats reports them. The counters are atomic since reads only hold
+// their shard's read lock.
+type keyspaceStats struct {
+	hits, misses, expired atomic.Int64
+}
+
+// KeyspaceStats is a snapshot of the keyspace counters.
+type KeyspaceStats struct {
+	// Hits and Misses count the lookups by read commands of keys that
+	// existed, whatever their type, and of keys that didn't.
+	Hits, Misses int64
+	// Expired counts the keys deleted because they expired, when looked up
+	// or by the active expire cycle.
+	Expired int64
+}
+
+// KeyspaceStats returns the keyspace counters.
+func (s *Store) KeyspaceStats() KeyspaceStats {
+	return KeyspaceStats{
+		Hits:    s.stats.hits.Load(),
+		Misses:  s.stats.misses.Load(),
+		Expired: s.stats.expired.Load(),
+	}
+}
+
+// ResetKeyspaceStats zeroes the keyspace counters.
+func (s *Store) ResetKeyspaceStats() {
+	s.stats.hits.Store(0)
+	s.stats.misses.Store(0)
+	s.stats.expired.Store(0)
+}
+
+// countLookup counts a read of key as a hit if it holds a live value, or a
+// miss. The caller must hold the shard's lock.
+func (s *Store) countLookup(sh *shard, key string) {
+	if item, ok := sh.items[key]; ok && !s.isExpired(item) {
+		s.stats.hits.Add(1)
+	} else {
+		s.stats.misses.Add(1)
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"strconv"
+	"time"
+)
+
+// ObjectInfo describes how a key is stored, as reported by DEBUG OBJECT.
+type ObjectInfo struct {
+	Type DataType
+	// Encoding names the representation of the value, using Redis' names
+	// where there is an equivalent.
+	Encoding string
+	// SerializedLength is the length of the arguments of the commands that
+	// recreate the key in a rewritten AOF.
+	SerializedLength int
+	Expiration       time.Time
+	// Idle is how long ago the key was last looked up, or -1 if accesses
+	// aren't tracked, which they only are while tiering is enabled.
+	Idle time.Duration
+	// Cold is set when the value is spilled to disk.
+	Cold bool
+}
+
+// Object describes the key without counting as an access to it, so a value
+// spilled to disk stays there.
+func (s *Store) Object(key string) (ObjectInfo, bool) {
+	sh := &s.shards[s.shardIndex(key)]
+	sh.RLock()
+	defer sh.RUnlock()
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return ObjectInfo{}, false
+	}
+	info := ObjectInfo{Type: item.Type, Expiration: item.Expiration, Idle: -1}
+	if s.tier != nil && item.accessed != 0 {
+		info.Idle = time.Since(time.Unix(0, item.accessed))
+	}
+	if _, cold := item.Value.(*coldValue); cold {
+		info.Cold = true
+		if item, ok = s.materialize(key, item); !ok {
+			return ObjectInfo{}, false
+		}
+	}
+	info.Encoding = encoding(item.Value)
+	s.rewriteItem(key, item, func(args []string) error {
+		for _, arg := range args {
+			info.SerializedLength += len(arg)
+		}
+		return nil
+	})
+	return info, true
+}
+
+// encoding names the representation of a value.
+func encoding(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return "int"
+		}
+		if len(v) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case []string:
+		return "quicklist"
+	case map[string]struct{}:
+		return "hashtable"
+	case *hashValue:
+		if v.m == nil {
+			return "listpack"
+		}
+		return "hashtable"
+	case *zsetValue:
+		return "skiplist"
+	case *streamValue:
+		return "stream"
+	}
+	// Probabilistic structures, JSON documents and time series are module
+	// types in Redis.
+	return "module"
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// random is the source of every randomized choice the store makes, such as
+// skiplist levels and ZRANDMEMBER picks. It is seeded randomly unless Seed
+// fixes it, which makes those choices repeat from run to run for tests and
+// bug reproductions. Go's map iteration order stays random regardless.
+var random = struct {
+	sync.Mutex
+	r *rand.Rand
+}{r: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}
+
+// Seed makes the store's randomized choices deterministic, starting from seed.
+func Seed(seed uint64) {
+	random.Lock()
+	random.r = rand.New(rand.NewPCG(seed, seed))
+	random.Unlock()
+}
+
+// randIntN returns a random int in [0, n).
+func randIntN(n int) int {
+	random.Lock()
+	defer random.Unlock()
+	return random.r.IntN(n)
+}
+
+// randFloat64 returns a random float64 in [0, 1).
+func randFloat64() float64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.r.Float64()
+}
+
+// randShuffle shuffles n elements with swap.
+func randShuffle(n int, swap func(i, j int)) {
+	random.Lock()
+	defer random.Unlock()
+	random.r.Shuffle(n, swap)
+}
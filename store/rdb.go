@@ -0,0 +1,242 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// RDB format constants, from Redis' rdb.h. Files are written as version 9,
+// which every Redis since 5.0 can load, using only the plain (non-ziplist,
+// non-listpack) value encodings.
+const (
+	rdbVersion = 9
+
+	rdbTypeString = 0
+	rdbTypeList   = 1
+	rdbTypeSet    = 2
+	rdbTypeHash   = 4
+	rdbTypeZSet2  = 5
+
+	// rdbTypeNative is this server's own type, far above Redis' types,
+	// for the values WriteSnapshot writes that RDB has no encoding for: a
+	// data type, the value as the tiering spill file encodes it and the
+	// hash field expirations.
+	rdbTypeNative = 0xC8
+
+	rdbOpFunction2    = 0xF5
+	rdbOpAux          = 0xFA
+	rdbOpExpireTimeMs = 0xFC
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+)
+
+// crcJones is the reflected form of the CRC-64/Jones polynomial Redis uses
+// for the RDB checksum.
+var crcJones = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// rdbWriter writes RDB primitives and keeps the running checksum. Redis' CRC
+// starts from zero without a final xor, unlike hash/crc64, so the state is
+// complemented around each update.
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+	// native is set to write the values RDB can't hold as rdbTypeNative
+	// rather than skipping them.
+	native bool
+}
+
+func (rw *rdbWriter) write(b []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = ^crc64.Update(^rw.crc, crcJones, b)
+	_, rw.err = rw.w.Write(b)
+}
+
+func (rw *rdbWriter) byte(b byte) {
+	rw.write([]byte{b})
+}
+
+// length writes an RDB length: 6, 14, 32 or 64 bits depending on its size.
+func (rw *rdbWriter) length(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.byte(byte(n))
+	case n < 1<<14:
+		rw.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		buf := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		rw.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		rw.write(buf)
+	}
+}
+
+func (rw *rdbWriter) string(s string) {
+	rw.length(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+// WriteRDB writes the live keys of the store to w as an RDB file, with the
+// function libraries, which only Redis 7 and later can load. Hash field
+// TTLs have no representation in this RDB version and are not written, and
+// neither are streams, which Redis only encodes as listpacks, or Bloom and
+// cuckoo filters, count-min and Top-K sketches, JSON documents and time
+// series, which are module types there.
+// Callers wanting a consistent snapshot of a store that is still being
+// written to should encode a copy made with CopyTo.
+func (s *Store) WriteRDB(w io.Writer) error {
+	return s.writeRDB(w, false)
+}
+
+// WriteSnapshot writes the live keys of the store to w as an RDB file that
+// keeps everything WriteRDB leaves out, for SAVE and BGSAVE. Only ReadRDB
+// can load the values RDB has no encoding for; files without any load in
+// Redis too. As with WriteRDB, callers wanting a consistent snapshot should
+// encode a copy.
+func (s *Store) WriteSnapshot(w io.Writer) error {
+	return s.writeRDB(w, true)
+}
+
+// writeRDB writes the live keys of the store to w as an RDB file, with the
+// values RDB can't hold if native is set.
+func (s *Store) writeRDB(w io.Writer, native bool) error {
+	rw := &rdbWriter{w: bufio.NewWriter(w), native: native}
+	rw.write([]byte("REDIS000" + strconv.Itoa(rdbVersion)))
+	for _, aux := range [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	} {
+		rw.byte(rdbOpAux)
+		rw.string(aux[0])
+		rw.string(aux[1])
+	}
+	for _, code := range s.FunctionLibraries() {
+		rw.byte(rdbOpFunction2)
+		rw.string(code)
+	}
+	rw.byte(rdbOpSelectDB)
+	rw.length(0)
+
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		for key, item := range sh.items {
+			if s.isExpired(item) {
+				continue
+			}
+			if item, ok := s.materialize(key, item); ok {
+				rw.item(key, item)
+			}
+		}
+		sh.RUnlock()
+		if rw.err != nil {
+			return rw.err
+		}
+	}
+
+	rw.byte(rdbOpEOF)
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, rw.crc)
+	rw.write(checksum)
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.w.Flush()
+}
+
+// item writes one key with its expiration, type and value.
+func (rw *rdbWriter) item(key string, item Item) {
+	plain := item.Type != TypeStream && item.Type != TypeBloom && item.Type != TypeCuckoo && item.Type != TypeCMS && item.Type != TypeTopK && item.Type != TypeJSON && item.Type != TypeTimeSeries
+	if !plain && !rw.native {
+		return
+	}
+	if !item.Expiration.IsZero() {
+		buf := make([]byte, 9)
+		buf[0] = rdbOpExpireTimeMs
+		binary.LittleEndian.PutUint64(buf[1:], uint64(item.Expiration.UnixMilli()))
+		rw.write(buf)
+	}
+	if !plain || (rw.native && len(item.FieldExpirations) > 0) {
+		rw.nativeItem(key, item)
+		return
+	}
+	now := time.Now()
+	switch v := item.Value.(type) {
+	case string:
+		rw.byte(rdbTypeString)
+		rw.string(key)
+		rw.string(v)
+	case []string:
+		rw.byte(rdbTypeList)
+		rw.string(key)
+		rw.length(uint64(len(v)))
+		for _, element := range v {
+			rw.string(element)
+		}
+	case map[string]struct{}:
+		rw.byte(rdbTypeSet)
+		rw.string(key)
+		rw.length(uint64(len(v)))
+		for member := range v {
+			rw.string(member)
+		}
+	case *hashValue:
+		// Fields whose TTL has passed are skipped, so count them first.
+		live := 0
+		v.each(func(field, _ string) bool {
+			if !fieldExpired(item, field, now) {
+				live++
+			}
+			return true
+		})
+		rw.byte(rdbTypeHash)
+		rw.string(key)
+		rw.length(uint64(live))
+		v.each(func(field, value string) bool {
+			if !fieldExpired(item, field, now) {
+				rw.string(field)
+				rw.string(value)
+			}
+			return true
+		})
+	case *zsetValue:
+		rw.byte(rdbTypeZSet2)
+		rw.string(key)
+		rw.length(uint64(v.zsl.length))
+		score := make([]byte, 8)
+		for x := v.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+			rw.string(x.member)
+			binary.LittleEndian.PutUint64(score, math.Float64bits(x.score))
+			rw.write(score)
+		}
+	}
+}
+
+// nativeItem writes one key as rdbTypeNative. Hash fields whose TTL has
+// passed are written along with their expirations, which keeps them expired
+// once loaded.
+func (rw *rdbWriter) nativeItem(key string, item Item) {
+	rw.byte(rdbTypeNative)
+	rw.string(key)
+	rw.length(uint64(item.Type))
+	rw.string(string(encodeValue(item.Value)))
+	rw.length(uint64(len(item.FieldExpirations)))
+	at := make([]byte, 8)
+	for field, expiration := range item.FieldExpirations {
+		rw.string(field)
+		binary.LittleEndian.PutUint64(at, uint64(expiration.UnixMilli()))
+		rw.write(at)
+	}
+}
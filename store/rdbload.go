@@ -0,0 +1,633 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// More RDB constants, for the files ReadRDB loads, which may come from
+// Redis itself and so use the compact encodings WriteRDB doesn't.
+const (
+	rdbTypeZSet          = 3
+	rdbTypeSetIntset     = 11
+	rdbTypeHashListpack  = 16
+	rdbTypeZSetListpack  = 17
+	rdbTypeListQuicklist = 18
+	rdbTypeSetListpack   = 20
+
+	rdbOpModuleAux  = 0xF7
+	rdbOpIdle       = 0xF8
+	rdbOpFreq       = 0xF9
+	rdbOpResizeDB   = 0xFB
+	rdbOpExpireTime = 0xFD
+
+	// The special string encodings, given in place of a length.
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// rdbQuicklistPacked marks a quicklist node holding a listpack rather
+	// than a single element.
+	rdbQuicklistPacked = 2
+)
+
+// errBadRDB is wrapped by the errors ReadRDB returns for malformed files.
+var errBadRDB = errors.New("bad RDB file")
+
+// rdbReader reads RDB primitives and keeps the running checksum.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (rr *rdbReader) read(n uint64) ([]byte, error) {
+	// Lengths come from the file, so large ones are read in pieces rather
+	// than trusted with an allocation up front.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, rr.r, int64(n)); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRDB, err)
+	}
+	rr.crc = ^crc64.Update(^rr.crc, crcJones, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+func (rr *rdbReader) byte() (byte, error) {
+	b, err := rr.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// length reads an RDB length. For the special string encodings it returns
+// the encoding with encoded set.
+func (rr *rdbReader) length() (n uint64, encoded bool, err error) {
+	b, err := rr.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := rr.byte()
+		return uint64(b&0x3F)<<8 | uint64(next), false, err
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := rr.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := rr.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, fmt.Errorf("%w: unknown length encoding %#x", errBadRDB, b)
+	}
+	return uint64(b & 0x3F), true, nil
+}
+
+// count reads a length that isn't a string encoding.
+func (rr *rdbReader) count() (uint64, error) {
+	n, encoded, err := rr.length()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: unexpected string encoding", errBadRDB)
+	}
+	return n, err
+}
+
+// string reads a string in any of its encodings.
+func (rr *rdbReader) string() (string, error) {
+	n, encoded, err := rr.length()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := rr.read(n)
+		return string(b), err
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := rr.read(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case rdbEncInt16:
+		b, err := rr.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case rdbEncInt32:
+		b, err := rr.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case rdbEncLZF:
+		compressed, err := rr.count()
+		if err != nil {
+			return "", err
+		}
+		size, err := rr.count()
+		if err != nil {
+			return "", err
+		}
+		b, err := rr.read(compressed)
+		if err != nil {
+			return "", err
+		}
+		return lzfDecompress(b, size)
+	}
+	return "", fmt.Errorf("%w: unknown string encoding %d", errBadRDB, n)
+}
+
+// lzfDecompress expands LZF-compressed data to its size.
+func lzfDecompress(in []byte, size uint64) (string, error) {
+	if size > uint64(len(in))*256 {
+		return "", fmt.Errorf("%w: implausible LZF length", errBadRDB)
+	}
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// A run of ctrl+1 literal bytes.
+			if i+ctrl+1 > len(in) {
+				return "", fmt.Errorf("%w: truncated LZF literal", errBadRDB)
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+		// A back reference of length (ctrl >> 5) + 2, extended by the next
+		// byte when the 3 bits are all set.
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return "", fmt.Errorf("%w: truncated LZF reference", errBadRDB)
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return "", fmt.Errorf("%w: truncated LZF reference", errBadRDB)
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return "", fmt.Errorf("%w: LZF reference out of range", errBadRDB)
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if uint64(len(out)) != size {
+		return "", fmt.Errorf("%w: LZF length mismatch", errBadRDB)
+	}
+	return string(out), nil
+}
+
+// listpackEntries decodes the entries of a listpack, integers formatted as
+// strings.
+func listpackEntries(lp string) ([]string, error) {
+	bad := fmt.Errorf("%w: malformed listpack", errBadRDB)
+	if len(lp) < 7 {
+		return nil, bad
+	}
+	b := []byte(lp[6:])
+	var entries []string
+	for len(b) > 0 && b[0] != 0xFF {
+		var entry string
+		var size int
+		switch c := b[0]; {
+		case c&0x80 == 0:
+			entry, size = strconv.Itoa(int(c)), 1
+		case c&0xC0 == 0x80:
+			n := int(c & 0x3F)
+			if 1+n > len(b) {
+				return nil, bad
+			}
+			entry, size = string(b[1:1+n]), 1+n
+		case c&0xE0 == 0xC0:
+			if len(b) < 2 {
+				return nil, bad
+			}
+			v := int(c&0x1F)<<8 | int(b[1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry, size = strconv.Itoa(v), 2
+		case c&0xF0 == 0xE0:
+			if len(b) < 2 {
+				return nil, bad
+			}
+			n := int(c&0x0F)<<8 | int(b[1])
+			if 2+n > len(b) {
+				return nil, bad
+			}
+			entry, size = string(b[2:2+n]), 2+n
+		case c == 0xF0:
+			if len(b) < 5 {
+				return nil, bad
+			}
+			n := int(binary.LittleEndian.Uint32(b[1:5]))
+			if n < 0 || 5+n > len(b) {
+				return nil, bad
+			}
+			entry, size = string(b[5:5+n]), 5+n
+		case c >= 0xF1 && c <= 0xF4:
+			width := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[c]
+			if 1+width > len(b) {
+				return nil, bad
+			}
+			var raw [8]byte
+			copy(raw[:], b[1:1+width])
+			v := int64(binary.LittleEndian.Uint64(raw[:]))
+			if shift := 64 - 8*width; shift > 0 {
+				v = v << shift >> shift
+			}
+			entry, size = strconv.FormatInt(v, 10), 1+width
+		default:
+			return nil, bad
+		}
+		// Each entry is followed by its length, encoded backwards in
+		// 7-bit groups.
+		backlen := 1
+		for l := size; l >= 128; l >>= 7 {
+			backlen++
+		}
+		if size+backlen > len(b) {
+			return nil, bad
+		}
+		b = b[size+backlen:]
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// intsetMembers decodes the members of an intset.
+func intsetMembers(is string) ([]string, error) {
+	if len(is) < 8 {
+		return nil, fmt.Errorf("%w: malformed intset", errBadRDB)
+	}
+	width := int(binary.LittleEndian.Uint32([]byte(is[:4])))
+	n := int(binary.LittleEndian.Uint32([]byte(is[4:8])))
+	if width != 2 && width != 4 && width != 8 || n < 0 || len(is) != 8+n*width {
+		return nil, fmt.Errorf("%w: malformed intset", errBadRDB)
+	}
+	members := make([]string, n)
+	for i := range members {
+		var raw [8]byte
+		copy(raw[:], is[8+i*width:8+(i+1)*width])
+		v := int64(binary.LittleEndian.Uint64(raw[:]))
+		shift := 64 - 8*width
+		members[i] = strconv.FormatInt(v<<shift>>shift, 10)
+	}
+	return members, nil
+}
+
+// ReadRDB loads the keys of database 0 of an RDB file, and its function
+// libraries, into the store, which
+// is meant to be empty, and returns how many it loaded. It reads the plain encodings WriteRDB writes as well
+// as the listpack and intset ones of recent Redis versions, and the values
+// of every type WriteSnapshot writes; files with other encodings, Redis
+// streams or module types are refused. Keys whose TTL has passed
+// are skipped, as Redis skips them when loading.
+func (s *Store) ReadRDB(r io.Reader) (int, error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+	header, err := rr.read(9)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(header, []byte("REDIS")) {
+		return 0, fmt.Errorf("%w: not an RDB file", errBadRDB)
+	}
+	if version, err := strconv.Atoi(string(header[5:])); err != nil || version < 1 || version > 12 {
+		return 0, fmt.Errorf("%w: unsupported RDB version %q", errBadRDB, header[5:])
+	}
+
+	loaded := 0
+	db := uint64(0)
+	var expireAt time.Time
+	for {
+		op, err := rr.byte()
+		if err != nil {
+			return loaded, err
+		}
+		switch op {
+		case rdbOpEOF:
+			sum := rr.crc
+			stored := make([]byte, 8)
+			if _, err := io.ReadFull(rr.r, stored); err != nil {
+				// Files from before version 5 have no checksum.
+				return loaded, nil
+			}
+			if v := binary.LittleEndian.Uint64(stored); v != 0 && v != sum {
+				return loaded, fmt.Errorf("%w: checksum mismatch", errBadRDB)
+			}
+			return loaded, nil
+		case rdbOpAux:
+			if _, err := rr.string(); err != nil {
+				return loaded, err
+			}
+			if _, err := rr.string(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpSelectDB:
+			if db, err = rr.count(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpResizeDB:
+			if _, err := rr.count(); err != nil {
+				return loaded, err
+			}
+			if _, err := rr.count(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpExpireTimeMs:
+			b, err := rr.read(8)
+			if err != nil {
+				return loaded, err
+			}
+			expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+			continue
+		case rdbOpExpireTime:
+			b, err := rr.read(4)
+			if err != nil {
+				return loaded, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			continue
+		case rdbOpIdle:
+			if _, err := rr.count(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpFreq:
+			if _, err := rr.byte(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpFunction2:
+			code, err := rr.string()
+			if err != nil {
+				return loaded, err
+			}
+			_, name, err := ParseLibraryHeader(code)
+			if err != nil {
+				return loaded, fmt.Errorf("%w: function library: %v", errBadRDB, err)
+			}
+			s.SetFunctionLibrary(name, code)
+			continue
+		case rdbOpModuleAux:
+			return loaded, fmt.Errorf("%w: module data is not supported", errBadRDB)
+		}
+
+		key, err := rr.string()
+		if err != nil {
+			return loaded, err
+		}
+		item, err := rr.value(op)
+		if err != nil {
+			return loaded, fmt.Errorf("key '%s': %w", key, err)
+		}
+		item.Expiration, expireAt = expireAt, time.Time{}
+		if db != 0 || s.isExpired(item) {
+			continue
+		}
+		sh := s.getShard(key)
+		sh.Lock()
+		item.Value = s.getSlab(key).internValue(item.Value)
+		sh.items[key] = item
+		sh.Unlock()
+		loaded++
+	}
+}
+
+// value reads a value of the given RDB type.
+func (rr *rdbReader) value(typ byte) (Item, error) {
+	strs := func(n uint64) ([]string, error) {
+		var values []string
+		for ; n > 0; n-- {
+			v, err := rr.string()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	pairs := func(values []string) (Item, error) {
+		if len(values)%2 != 0 {
+			return Item{}, fmt.Errorf("%w: odd number of hash entries", errBadRDB)
+		}
+		h := &hashValue{m: make(map[string]string, len(values)/2)}
+		for i := 0; i < len(values); i += 2 {
+			h.m[values[i]] = values[i+1]
+		}
+		return Item{Value: h, Type: TypeHash}, nil
+	}
+	zset := func(members []ZMember) Item {
+		z := newZSetValue()
+		for _, m := range members {
+			z.add(m.Member, m.Score)
+		}
+		return Item{Value: z, Type: TypeZSet}
+	}
+	set := func(members []string) Item {
+		m := make(map[string]struct{}, len(members))
+		for _, member := range members {
+			m[member] = struct{}{}
+		}
+		return Item{Value: m, Type: TypeSet}
+	}
+
+	switch typ {
+	case rdbTypeString:
+		v, err := rr.string()
+		return Item{Value: v, Type: TypeString}, err
+	case rdbTypeList, rdbTypeSet, rdbTypeHash:
+		n, err := rr.count()
+		if err != nil {
+			return Item{}, err
+		}
+		if typ == rdbTypeHash {
+			n *= 2
+		}
+		values, err := strs(n)
+		if err != nil {
+			return Item{}, err
+		}
+		switch typ {
+		case rdbTypeList:
+			return Item{Value: values, Type: TypeList}, nil
+		case rdbTypeSet:
+			return set(values), nil
+		}
+		return pairs(values)
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := rr.count()
+		if err != nil {
+			return Item{}, err
+		}
+		var members []ZMember
+		for ; n > 0; n-- {
+			member, err := rr.string()
+			if err != nil {
+				return Item{}, err
+			}
+			var score float64
+			if typ == rdbTypeZSet2 {
+				b, err := rr.read(8)
+				if err != nil {
+					return Item{}, err
+				}
+				score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+			} else {
+				// An old-style score is a length-prefixed decimal string,
+				// with 253 to 255 standing for NaN and the infinities.
+				size, err := rr.byte()
+				if err != nil {
+					return Item{}, err
+				}
+				switch size {
+				case 253:
+					score = math.NaN()
+				case 254:
+					score = math.Inf(1)
+				case 255:
+					score = math.Inf(-1)
+				default:
+					b, err := rr.read(uint64(size))
+					if err != nil {
+						return Item{}, err
+					}
+					if score, err = strconv.ParseFloat(string(b), 64); err != nil {
+						return Item{}, fmt.Errorf("%w: bad score", errBadRDB)
+					}
+				}
+			}
+			members = append(members, ZMember{Member: member, Score: score})
+		}
+		return zset(members), nil
+	case rdbTypeSetIntset:
+		is, err := rr.string()
+		if err != nil {
+			return Item{}, err
+		}
+		members, err := intsetMembers(is)
+		return set(members), err
+	case rdbTypeSetListpack, rdbTypeHashListpack, rdbTypeZSetListpack:
+		lp, err := rr.string()
+		if err != nil {
+			return Item{}, err
+		}
+		entries, err := listpackEntries(lp)
+		if err != nil {
+			return Item{}, err
+		}
+		switch typ {
+		case rdbTypeSetListpack:
+			return set(entries), nil
+		case rdbTypeHashListpack:
+			return pairs(entries)
+		}
+		if len(entries)%2 != 0 {
+			return Item{}, fmt.Errorf("%w: odd number of sorted set entries", errBadRDB)
+		}
+		members := make([]ZMember, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			score, err := strconv.ParseFloat(entries[i+1], 64)
+			if err != nil {
+				return Item{}, fmt.Errorf("%w: bad score", errBadRDB)
+			}
+			members = append(members, ZMember{Member: entries[i], Score: score})
+		}
+		return zset(members), nil
+	case rdbTypeNative:
+		return rr.nativeValue()
+	case rdbTypeListQuicklist:
+		nodes, err := rr.count()
+		if err != nil {
+			return Item{}, err
+		}
+		var list []string
+		for ; nodes > 0; nodes-- {
+			container, err := rr.count()
+			if err != nil {
+				return Item{}, err
+			}
+			data, err := rr.string()
+			if err != nil {
+				return Item{}, err
+			}
+			if container != rdbQuicklistPacked {
+				// A plain node holds one large element as is.
+				list = append(list, data)
+				continue
+			}
+			entries, err := listpackEntries(data)
+			if err != nil {
+				return Item{}, err
+			}
+			list = append(list, entries...)
+		}
+		return Item{Value: list, Type: TypeList}, nil
+	}
+	return Item{}, fmt.Errorf("%w: unsupported value type %d", errBadRDB, typ)
+}
+
+// nativeValue reads a value written as rdbTypeNative.
+func (rr *rdbReader) nativeValue() (Item, error) {
+	typ, err := rr.count()
+	if err != nil {
+		return Item{}, err
+	}
+	encoded, err := rr.string()
+	if err != nil {
+		return Item{}, err
+	}
+	value, err := decodeValue([]byte(encoded))
+	if err != nil {
+		return Item{}, fmt.Errorf("%w: %v", errBadRDB, err)
+	}
+	item := Item{Value: value, Type: DataType(typ)}
+	fields, err := rr.count()
+	if err != nil {
+		return Item{}, err
+	}
+	for ; fields > 0; fields-- {
+		field, err := rr.string()
+		if err != nil {
+			return Item{}, err
+		}
+		at, err := rr.read(8)
+		if err != nil {
+			return Item{}, err
+		}
+		if item.FieldExpirations == nil {
+			item.FieldExpirations = make(map[string]time.Time)
+		}
+		item.FieldExpirations[field] = time.UnixMilli(int64(binary.LittleEndian.Uint64(at)))
+	}
+	return item, nil
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// rewriteItemsPerCommand caps the elements emitted per command when a
+// collection is rewritten, like Redis' AOF_REWRITE_ITEMS_PER_CMD, so a huge
+// key doesn't become one huge command.
+const rewriteItemsPerCommand = 64
+
+// RewriteCommands calls emit with a sequence of commands that rebuilds the
+// live keys of the store, such as for the base file of an AOF rewrite,
+// preceded by the FUNCTION LOAD of every function library.
+// Expirations are emitted as absolute PEXPIREAT and HPEXPIREAT commands. It
+// stops at the first error emit returns. Callers wanting a consistent
+// snapshot of a store that is still being written to should rewrite a copy
+// made with CopyTo.
+func (s *Store) RewriteCommands(emit func(args []string) error) error {
+	for _, code := range s.FunctionLibraries() {
+		if err := emit([]string{"FUNCTION", "LOAD", "REPLACE", code}); err != nil {
+			return err
+		}
+	}
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		var err error
+		for key, item := range sh.items {
+			if s.isExpired(item) {
+				continue
+			}
+			item, ok := s.materialize(key, item)
+			if !ok {
+				continue
+			}
+			if err = s.rewriteItem(key, item, emit); err != nil {
+				break
+			}
+		}
+		sh.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteKey calls emit with the commands that rebuild key, as
+// RewriteCommands does for every key, and reports false if the key doesn't
+// exist.
+func (s *Store) RewriteKey(key string, emit func(args []string) error) (bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return false, nil
+	}
+	return true, s.rewriteItem(key, item, emit)
+}
+
+// rewriteItem emits the commands that recreate one key.
+func (s *Store) rewriteItem(key string, item Item, emit func(args []string) error) error {
+	// batch emits cmd with the elements in groups of rewriteItemsPerCommand,
+	// each element being width arguments long.
+	batch := func(cmd string, elements []string, width int) error {
+		per := rewriteItemsPerCommand * width
+		for start := 0; start < len(elements); start += per {
+			end := min(start+per, len(elements))
+			if err := emit(append([]string{cmd, key}, elements[start:end]...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	now := time.Now()
+	switch v := item.Value.(type) {
+	case string:
+		if s.sealed(key, v) {
+			err = emit([]string{"SETSEALED", key, v})
+		} else {
+			err = emit([]string{"SET", key, v})
+		}
+	case []string:
+		err = batch("RPUSH", v, 1)
+	case map[string]struct{}:
+		members := make([]string, 0, len(v))
+		for member := range v {
+			members = append(members, member)
+		}
+		err = batch("SADD", members, 1)
+	case *hashValue:
+		var pairs []string
+		v.each(func(field, value string) bool {
+			if !fieldExpired(item, field, now) {
+				pairs = append(pairs, field, value)
+			}
+			return true
+		})
+		if len(pairs) == 0 {
+			// Every field has expired, so the key is as good as gone.
+			return nil
+		}
+		if err = batch("HSET", pairs, 2); err != nil {
+			return err
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			at, ok := item.FieldExpirations[pairs[i]]
+			if !ok {
+				continue
+			}
+			ms := strconv.FormatInt(at.UnixMilli(), 10)
+			if err = emit([]string{"HPEXPIREAT", key, ms, "FIELDS", "1", pairs[i]}); err != nil {
+				return err
+			}
+		}
+	case *zsetValue:
+		pairs := make([]string, 0, 2*v.zsl.length)
+		for x := v.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+			pairs = append(pairs, formatRewriteScore(x.score), x.member)
+		}
+		err = batch("ZADD", pairs, 2)
+	case *streamValue:
+		v.each(func(entry StreamEntry) bool {
+			err = emit(append([]string{"XADD", key, entry.ID.String()}, entry.Fields...))
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		// Entries may have been added and deleted since, which only XSETID
+		// brings back.
+		if last, ok := v.lastEntryID(); ok && (v.lastID != last ||
+			v.entriesAdded != uint64(v.length) || v.maxDeletedID != StreamID{}) {
+			err = emit([]string{"XSETID", key, v.lastID.String(),
+				"ENTRIESADDED", strconv.FormatUint(v.entriesAdded, 10), "MAXDELETEDID", v.maxDeletedID.String()})
+		}
+	case *bloomValue:
+		err = emit([]string{"BF.LOADCHUNK", key, "1", string(v.encode())})
+	case *cuckooValue:
+		err = emit([]string{"CF.LOADCHUNK", key, "1", string(v.encode())})
+	case *cmsValue:
+		err = emit([]string{"CMS.LOADCHUNK", key, "1", string(v.encode())})
+	case *topKValue:
+		err = emit([]string{"TOPK.LOADCHUNK", key, "1", string(v.encode())})
+	case *jsonValue:
+		err = emit([]string{"JSON.SET", key, "$", v.String()})
+	case *tsValue:
+		err = emit([]string{"TS.LOADCHUNK", key, "1", string(v.encode())})
+	}
+	if err != nil || item.Expiration.IsZero() {
+		return err
+	}
+	return emit([]string{"PEXPIREAT", key, strconv.FormatInt(item.Expiration.UnixMilli(), 10)})
+}
+
+// formatRewriteScore formats a sorted set score the way ZADD parses it.
+func formatRewriteScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
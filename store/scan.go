@@ -0,0 +1,260 @@
+package store
+
+import (
+	"cmp"
+	"hash/fnv"
+	"iter"
+	"slices"
+	"time"
+)
+
+// Cursors of the SCAN family hold a position in a fixed order of the
+// elements, that of a hash of each element, rather than an offset, which
+// elements added or removed would shift. Keyspace cursors hold the index of
+// the shard in the bits above scanBits and the position within it in the
+// bits below; the cursors of sets, hashes and sorted sets hold the position
+// alone.
+
+// scanBits is the width of the position held by a cursor.
+const scanBits = 48
+
+// scanMask selects the position of a cursor.
+const scanMask = 1<<scanBits - 1
+
+// scanPosition returns the position of an element in the order of a scan.
+func scanPosition(element string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	return h.Sum64() & scanMask
+}
+
+// scanPage returns, in scan order, the first count elements at or after
+// position pos, and the position the next page starts at, or 0 once none are
+// left. Elements sharing a position are never split over two pages, so a
+// page may hold a few more than count. Every page walks all the elements, as
+// Go maps can't be iterated from a position.
+func scanPage(elements iter.Seq[string], pos uint64, count int) ([]string, uint64) {
+	type positioned struct {
+		pos     uint64
+		element string
+	}
+	var rest []positioned
+	for element := range elements {
+		if p := scanPosition(element); p >= pos {
+			rest = append(rest, positioned{p, element})
+		}
+	}
+	slices.SortFunc(rest, func(a, b positioned) int {
+		return cmp.Or(cmp.Compare(a.pos, b.pos), cmp.Compare(a.element, b.element))
+	})
+	n := min(count, len(rest))
+	for n > 0 && n < len(rest) && rest[n].pos == rest[n-1].pos {
+		n++
+	}
+	page := make([]string, n)
+	for i := range page {
+		page[i] = rest[i].element
+	}
+	if n == len(rest) {
+		return page, 0
+	}
+	return page, rest[n-1].pos + 1
+}
+
+// liveKeys yields the keys of sh that haven't expired. The caller must hold
+// the shard's lock.
+func (s *Store) liveKeys(sh *shard) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key, item := range sh.items {
+			if !s.isExpired(item) && !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// scanKeys calls fn with each page of the keyspace from cursor on, under the
+// read lock of its shard, until count keys were visited or the keyspace
+// ends, and returns the cursor of the next call, or 0 once the iteration is
+// complete.
+func (s *Store) scanKeys(cursor, count int, fn func(sh *shard, keys []string)) int {
+	if count <= 0 {
+		count = 10
+	}
+	index, pos := cursor>>scanBits, uint64(cursor)&scanMask
+	for visited := 0; index < len(s.shards) && visited < count; {
+		sh := &s.shards[index]
+		sh.RLock()
+		keys, next := scanPage(s.liveKeys(sh), pos, count-visited)
+		fn(sh, keys)
+		sh.RUnlock()
+		visited += len(keys)
+		if pos = next; next == 0 {
+			index++
+		}
+	}
+	if index >= len(s.shards) {
+		return 0
+	}
+	return index<<scanBits | int(pos)
+}
+
+// Scan iterates the keyspace, visiting count keys per call. It returns the
+// keys visited that match the optional glob pattern and type name, so a page
+// may hold fewer than count keys or none, and the cursor for the next call,
+// or 0 once the iteration is complete. A key that exists for the entire
+// iteration is reported exactly once, and keys added or removed meanwhile
+// may or may not be reported — the same guarantees Redis gives for SCAN.
+//
+// ScanShards gives the number of shards and ScanShard the shard a cursor
+// continues in, for reporting a cursor as progress.
+func (s *Store) Scan(cursor int, count int, match string, typeName string) ([]string, int) {
+	var keys []string
+	next := s.scanKeys(cursor, count, func(sh *shard, page []string) {
+		for _, key := range page {
+			if match != "" && !MatchPattern(match, key) {
+				continue
+			}
+			if typeName != "" && sh.items[key].Type.String() != typeName {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	})
+	return keys, next
+}
+
+// ScanShards returns the number of shards Scan iterates over.
+func (s *Store) ScanShards() int {
+	return len(s.shards)
+}
+
+// ScanShard returns the index of the shard a Scan cursor continues in, which
+// is ScanShards once the iteration is complete.
+func (s *Store) ScanShard(cursor int) int {
+	if cursor == 0 {
+		return len(s.shards)
+	}
+	return cursor >> scanBits
+}
+
+// SScan iterates the members of the set stored at key, visiting count
+// members per call, with the cursors and guarantees of Scan. A missing key
+// is an empty set.
+func (s *Store) SScan(key string, cursor, count int) ([]string, int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, 0, nil
+	}
+	if item.Type != TypeSet {
+		return nil, 0, ErrWrongType
+	}
+	set := item.Value.(map[string]struct{})
+	members, next := scanPage(func(yield func(string) bool) {
+		for member := range set {
+			if !yield(member) {
+				return
+			}
+		}
+	}, uint64(cursor)&scanMask, count)
+	return members, int(next), nil
+}
+
+// HScan iterates the fields of the hash stored at key, visiting count fields
+// per call, with the cursors and guarantees of Scan. It returns the fields
+// visited along with their values, as field0, value0, field1, value1, ... A
+// missing key is an empty hash.
+func (s *Store) HScan(key string, cursor, count int) ([]string, int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, 0, nil
+	}
+	if item.Type != TypeHash {
+		return nil, 0, ErrWrongType
+	}
+	hash := item.Value.(*hashValue)
+	now := time.Now()
+	fields, next := scanPage(func(yield func(string) bool) {
+		hash.each(func(field, _ string) bool {
+			return fieldExpired(item, field, now) || yield(field)
+		})
+	}, uint64(cursor)&scanMask, count)
+	pairs := make([]string, 0, 2*len(fields))
+	for _, field := range fields {
+		value, _ := hash.get(field)
+		pairs = append(pairs, field, value)
+	}
+	return pairs, int(next), nil
+}
+
+// ZScan iterates the members of the sorted set stored at key, visiting count
+// members per call, with the cursors and guarantees of Scan. A missing key
+// is an empty sorted set.
+func (s *Store) ZScan(key string, cursor, count int) ([]ZMember, int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil {
+		return nil, 0, err
+	}
+	names, next := scanPage(func(yield func(string) bool) {
+		for member := range zset.dict {
+			if !yield(member) {
+				return
+			}
+		}
+	}, uint64(cursor)&scanMask, count)
+	members := make([]ZMember, len(names))
+	for i, name := range names {
+		members[i] = ZMember{Member: name, Score: zset.dict[name]}
+	}
+	return members, int(next), nil
+}
+
+// ForEachPage calls fn with the type and exported value, as Export returns
+// them, of the next limit keys of the keyspace and returns the cursor of the
+// page after it, or 0 once the iteration is complete. Cursors and pages work
+// as for Scan, with the same guarantees, so a job can spread a full pass
+// over many calls without ever locking more than one shard at a time.
+//
+// Each shard's values are copied under its read lock and handed to fn after
+// the lock is released, so fn may use the store. Spilled values are read
+// without being loaded back into memory. If fn returns an error, the
+// iteration stops and ForEachPage returns it along with cursor, so calling
+// it again retries the page.
+func (s *Store) ForEachPage(cursor, limit int, fn func(key string, typ DataType, value any) error) (int, error) {
+	type exported struct {
+		key   string
+		typ   DataType
+		value any
+	}
+	var page []exported
+	next := s.scanKeys(cursor, limit, func(sh *shard, keys []string) {
+		for _, key := range keys {
+			item, ok := s.materialize(key, sh.items[key])
+			if !ok {
+				continue
+			}
+			page = append(page, exported{key, item.Type, s.exportValue(key, item)})
+		}
+	})
+	for _, e := range page {
+		if err := fn(e.key, e.typ, e.value); err != nil {
+			return cursor, err
+		}
+	}
+	return next, nil
+}
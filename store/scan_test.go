@@ -0,0 +1,165 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+// scanFunc fetches the page of a scan at cursor, returning its elements and
+// the next cursor.
+type scanFunc func(cursor int) ([]string, int)
+
+// checkScan runs a scan to the end with count elements per page, calling
+// churn between pages, and checks the guarantees of SCAN: every element of
+// stable, which churn must leave alone, is returned exactly once, no page
+// holds more than count elements, and the cursor reaches 0 in at most as
+// many pages as the elements could fill.
+func checkScan(t *testing.T, stable []string, count int, scan scanFunc, churn func(page int)) {
+	t.Helper()
+	seen := make(map[string]int)
+	maxPages := 2 * (len(stable) + 1000) / count
+	cursor, pages := 0, 0
+	for {
+		elements, next := scan(cursor)
+		if len(elements) > count {
+			t.Fatalf("page %d holds %d elements, COUNT is %d", pages, len(elements), count)
+		}
+		for _, element := range elements {
+			seen[element]++
+		}
+		if pages++; next == 0 {
+			break
+		}
+		if pages > maxPages {
+			t.Fatalf("the cursor didn't reach 0 after %d pages", pages)
+		}
+		cursor = next
+		churn(pages)
+	}
+	for _, element := range stable {
+		if n := seen[element]; n != 1 {
+			t.Errorf("%q returned %d times, want once", element, n)
+		}
+	}
+}
+
+// elements returns n names with prefix.
+func elements(prefix string, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s:%d", prefix, i)
+	}
+	return names
+}
+
+func TestScan(t *testing.T) {
+	s := NewStore()
+	stable := elements("stable", 500)
+	for _, key := range stable {
+		s.Set(key, "v", 0)
+	}
+	churned := elements("churn", 500)
+	for _, key := range churned[:250] {
+		s.Set(key, "v", 0)
+	}
+	checkScan(t, stable, 10, func(cursor int) ([]string, int) {
+		return s.Scan(cursor, 10, "", "")
+	}, func(page int) {
+		// Keys come and go while the scan runs.
+		s.Del(churned[page%250])
+		s.Set(churned[250+page%250], "v", 0)
+	})
+}
+
+func TestScanMatchAndType(t *testing.T) {
+	s := NewStore()
+	for _, key := range elements("str", 100) {
+		s.Set(key, "v", 0)
+	}
+	sets := elements("set", 100)
+	for _, key := range sets {
+		s.Sadd(key, []string{"m"})
+	}
+	// Filtered pages count the keys visited, so they may be short or empty.
+	checkScan(t, sets, 20, func(cursor int) ([]string, int) {
+		return s.Scan(cursor, 20, "set:*", "set")
+	}, func(int) {})
+}
+
+func TestSScan(t *testing.T) {
+	s := NewStore()
+	stable := elements("stable", 500)
+	s.Sadd("set", stable)
+	churned := elements("churn", 500)
+	checkScan(t, stable, 7, func(cursor int) ([]string, int) {
+		members, next, err := s.SScan("set", cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return members, next
+	}, func(page int) {
+		s.Sadd("set", []string{churned[page%500]})
+		s.Srem("set", []string{churned[(page+250)%500]})
+	})
+}
+
+func TestHScan(t *testing.T) {
+	s := NewStore()
+	stable := elements("stable", 500)
+	for _, field := range stable {
+		s.HSet("hash", []string{field, "v:" + field})
+	}
+	churned := elements("churn", 500)
+	checkScan(t, stable, 7, func(cursor int) ([]string, int) {
+		pairs, next, err := s.HScan("hash", cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields []string
+		for i := 0; i < len(pairs); i += 2 {
+			if pairs[i+1] != "v:"+pairs[i] {
+				t.Fatalf("field %q has value %q", pairs[i], pairs[i+1])
+			}
+			fields = append(fields, pairs[i])
+		}
+		return fields, next
+	}, func(page int) {
+		s.HSet("hash", []string{churned[page%500], "v:" + churned[page%500]})
+		s.HDel("hash", []string{churned[(page+250)%500]})
+	})
+}
+
+func TestZScan(t *testing.T) {
+	s := NewStore()
+	stable := elements("stable", 500)
+	for i, member := range stable {
+		if _, err := s.ZAdd("zset", []ZMember{{Member: member, Score: float64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkScan(t, stable, 7, func(cursor int) ([]string, int) {
+		page, next, err := s.ZScan("zset", cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members := make([]string, len(page))
+		for i, m := range page {
+			members[i] = m.Member
+		}
+		return members, next
+	}, func(int) {})
+}
+
+func TestScanWrongType(t *testing.T) {
+	s := NewStore()
+	s.Set("str", "v", 0)
+	if _, _, err := s.SScan("str", 0, 10); err != ErrWrongType {
+		t.Errorf("SScan of a string = %v, want ErrWrongType", err)
+	}
+	if _, _, err := s.HScan("str", 0, 10); err != ErrWrongType {
+		t.Errorf("HScan of a string = %v, want ErrWrongType", err)
+	}
+	if _, _, err := s.ZScan("str", 0, 10); err != ErrWrongType {
+		t.Errorf("ZScan of a string = %v, want ErrWrongType", err)
+	}
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hotKeySampleRate is how many shard lookups there are per hot key sample.
+// It must be a power of two.
+const hotKeySampleRate = 64
+
+// hotKeyCapacity is the number of hot key candidates tracked per shard.
+const hotKeyCapacity = 8
+
+// shardMetrics counts how a shard is used. The counters are updated
+// atomically so that taking them doesn't add contention of its own.
+type shardMetrics struct {
+	ops       atomic.Int64 // key lookups routed to the shard
+	contended atomic.Int64 // lock acquisitions that had to wait
+	waitNanos atomic.Int64 // total time spent waiting for the lock
+
+	// hot approximates the most accessed keys with the Space-Saving
+	// algorithm over a sample of the lookups.
+	hotMu sync.Mutex
+	hot   map[string]int
+}
+
+// Lock write-locks the shard, recording the wait if the lock was held.
+func (sh *shard) Lock() {
+	if sh.RWMutex.TryLock() {
+		return
+	}
+	start := time.Now()
+	sh.RWMutex.Lock()
+	sh.metrics.contended.Add(1)
+	sh.metrics.waitNanos.Add(int64(time.Since(start)))
+}
+
+// RLock read-locks the shard, recording the wait if a writer held the lock.
+func (sh *shard) RLock() {
+	if sh.RWMutex.TryRLock() {
+		return
+	}
+	start := time.Now()
+	sh.RWMutex.RLock()
+	sh.metrics.contended.Add(1)
+	sh.metrics.waitNanos.Add(int64(time.Since(start)))
+}
+
+// recordAccess counts a lookup of key and samples it for hot key tracking.
+func (m *shardMetrics) recordAccess(key string) {
+	if m.ops.Add(1)&(hotKeySampleRate-1) != 0 {
+		return
+	}
+	m.hotMu.Lock()
+	defer m.hotMu.Unlock()
+	if m.hot == nil {
+		m.hot = make(map[string]int, hotKeyCapacity)
+	}
+	if _, ok := m.hot[key]; ok || len(m.hot) < hotKeyCapacity {
+		m.hot[key]++
+		return
+	}
+	// Replace the least sampled candidate, inheriting its count so that
+	// counts remain upper bounds of the true sample counts.
+	minKey, minCount := "", 0
+	for k, c := range m.hot {
+		if minKey == "" || c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	delete(m.hot, minKey)
+	m.hot[key] = minCount + 1
+}
+
+// HotKey is a frequently accessed key and its approximate number of samples.
+type HotKey struct {
+	Key     string
+	Samples int
+}
+
+// ShardStats describes the load on one shard.
+type ShardStats struct {
+	// Keys includes expired keys not collected yet.
+	Keys      int
+	Ops       int64
+	Contended int64
+	LockWait  time.Duration
+	// HotKeys lists the most sampled keys, busiest first.
+	HotKeys []HotKey
+}
+
+// ShardStats returns the statistics of every shard, indexed by shard.
+func (s *Store) ShardStats() []ShardStats {
+	stats := make([]ShardStats, len(s.shards))
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RWMutex.RLock()
+		stats[i].Keys = len(sh.items)
+		sh.RWMutex.RUnlock()
+
+		m := &sh.metrics
+		stats[i].Ops = m.ops.Load()
+		stats[i].Contended = m.contended.Load()
+		stats[i].LockWait = time.Duration(m.waitNanos.Load())
+		m.hotMu.Lock()
+		for key, samples := range m.hot {
+			stats[i].HotKeys = append(stats[i].HotKeys, HotKey{Key: key, Samples: samples})
+		}
+		m.hotMu.Unlock()
+		sort.Slice(stats[i].HotKeys, func(a, b int) bool {
+			return stats[i].HotKeys[a].Samples > stats[i].HotKeys[b].Samples
+		})
+	}
+	return stats
+}
@@ -0,0 +1,266 @@
+package store
+
+// Skiplist parameters, as in Redis: a node gets another level with
+// probability 1/4, up to 32 levels.
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+// skiplistNode is one member of a skiplist. Each level records how many
+// nodes its forward pointer skips, which is what makes rank lookups and
+// index-based access O(log n).
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+// skiplist keeps sorted set members ordered by score, then by member.
+type skiplist struct {
+	head   *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+// randomLevel returns a level for a new node.
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && randFloat64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// less reports whether (score, member) sorts before node.
+func (n *skiplistNode) less(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a member, which must not already be in the list.
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.head
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.head {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// unlink removes x given the nodes preceding it on every level.
+func (zsl *skiplist) unlink(x *skiplistNode, update *[skiplistMaxLevel]*skiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.head.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// delete removes the member with the given score, reporting whether it was found.
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.unlink(x, &update)
+	return true
+}
+
+// rank returns the 0-based position of the member with the given score, or
+// -1 if it is not in the list.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && (x.level[i].forward.less(score, member) ||
+			(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.head && x.member == member {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// byRank returns the node at the 0-based position, or nil if out of range.
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	if rank < 0 || rank >= zsl.length {
+		return nil
+	}
+	traversed := 0
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank+1 {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// ScoreBound is one end of a score range. An exclusive bound excludes its
+// own value, like "(1.5" in ZRANGEBYSCORE.
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// LexBound is one end of a lexicographic range: "[a" (inclusive), "(a"
+// (exclusive), or the infinite bounds "-" and "+".
+type LexBound struct {
+	Value     string
+	Exclusive bool
+	// Inf is -1 for "-", 1 for "+" and 0 for a bound with a value.
+	Inf int
+}
+
+// zrange selects a contiguous run of the skiplist. Both predicates must be
+// monotonic in list order: aboveMin false then true, belowMax true then false.
+type zrange struct {
+	aboveMin func(n *skiplistNode) bool
+	belowMax func(n *skiplistNode) bool
+}
+
+// scoreRange selects the members with scores between min and max.
+func scoreRange(min, max ScoreBound) zrange {
+	return zrange{
+		aboveMin: func(n *skiplistNode) bool {
+			return n.score > min.Value || !min.Exclusive && n.score == min.Value
+		},
+		belowMax: func(n *skiplistNode) bool {
+			return n.score < max.Value || !max.Exclusive && n.score == max.Value
+		},
+	}
+}
+
+// lexRange selects the members between min and max by byte-wise comparison.
+// Like in Redis, it is only meaningful when all members share one score.
+func lexRange(min, max LexBound) zrange {
+	return zrange{
+		aboveMin: func(n *skiplistNode) bool {
+			switch {
+			case min.Inf != 0:
+				return min.Inf < 0
+			case min.Exclusive:
+				return n.member > min.Value
+			}
+			return n.member >= min.Value
+		},
+		belowMax: func(n *skiplistNode) bool {
+			switch {
+			case max.Inf != 0:
+				return max.Inf > 0
+			case max.Exclusive:
+				return n.member < max.Value
+			}
+			return n.member <= max.Value
+		},
+	}
+}
+
+// firstInRange returns the lowest-ranked node within the range, or nil.
+func (zsl *skiplist) firstInRange(r zrange) *skiplistNode {
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the highest-ranked node within the range, or nil.
+func (zsl *skiplist) lastInRange(r zrange) *skiplistNode {
+	x := zsl.head
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.head || !r.aboveMin(x) {
+		return nil
+	}
+	return x
+}
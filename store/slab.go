@@ -0,0 +1,101 @@
+package store
+
+import "unsafe"
+
+// slabChunkSize is the size of each backing array a slab hands out memory from.
+const slabChunkSize = 64 << 10
+
+// slabMaxElement is the largest element copied into a slab. Bigger strings keep
+// their own allocation so a single large value can't pin a mostly empty chunk.
+const slabMaxElement = 256
+
+// slab is an experimental bump allocator for small list and hash elements.
+// Elements are copied into large pointer-free byte chunks, so the garbage
+// collector scans one chunk instead of thousands of tiny string allocations.
+// A chunk is released once no element points into it any more.
+//
+// Elements are copied into a slab when LPUSH, RPUSH, HSET and HSETNX write
+// them, and when whole lists and hashes are loaded from a snapshot or the
+// spill file, or copied from another store. Elements of other types, such
+// as set members and sorted set members, aren't, as the experiment is about
+// the many small elements of lists and hashes.
+//
+// Each shard owns one slab, and a slab must only be used while holding
+// that shard's write lock.
+type slab struct {
+	chunk []byte
+	used  int
+}
+
+// intern copies v into the slab and returns a string backed by slab memory.
+func (sl *slab) intern(v string) string {
+	if len(v) == 0 || len(v) > slabMaxElement {
+		return v
+	}
+	if len(sl.chunk)-sl.used < len(v) {
+		sl.chunk = make([]byte, slabChunkSize)
+		sl.used = 0
+	}
+	b := sl.chunk[sl.used : sl.used+len(v)]
+	copy(b, v)
+	sl.used += len(v)
+	return unsafe.String(&b[0], len(b))
+}
+
+// EnableSlabAllocation turns on the slab allocator for list and hash elements.
+// It must be called before the store starts serving commands.
+func (s *Store) EnableSlabAllocation() {
+	s.slabs = make([]slab, len(s.shards))
+}
+
+// getSlab returns the slab for the shard that owns key, or nil when slab
+// allocation is disabled.
+func (s *Store) getSlab(key string) *slab {
+	if s.slabs == nil {
+		return nil
+	}
+	return &s.slabs[s.shardIndex(key)]
+}
+
+// internAll copies values into sl when slab allocation is enabled.
+func (sl *slab) internAll(values []string) []string {
+	if sl == nil {
+		return values
+	}
+	interned := make([]string, len(values))
+	for i, v := range values {
+		interned[i] = sl.intern(v)
+	}
+	return interned
+}
+
+// internValue copies the elements of a list or hash value into sl when slab
+// allocation is enabled, for values that weren't built by the write
+// commands. Values of other types are returned as they are.
+func (sl *slab) internValue(value interface{}) interface{} {
+	if sl == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case []string:
+		return sl.internAll(v)
+	case *hashValue:
+		if v.m == nil {
+			return &hashValue{pairs: sl.internAll(v.pairs)}
+		}
+		m := make(map[string]string, len(v.m))
+		for field, value := range v.m {
+			m[sl.intern(field)] = sl.intern(value)
+		}
+		return &hashValue{m: m}
+	}
+	return value
+}
+
+// internOne copies v into sl when slab allocation is enabled.
+func (sl *slab) internOne(v string) string {
+	if sl == nil {
+		return v
+	}
+	return sl.intern(v)
+}
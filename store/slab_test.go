@@ -0,0 +1,77 @@
+package store
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// newBenchStore returns a store with slab allocation enabled or not.
+func newBenchStore(slab bool) *Store {
+	s := NewStore()
+	if slab {
+		s.EnableSlabAllocation()
+	}
+	return s
+}
+
+// benchValue returns a freshly allocated small element, as parsing a
+// command's arguments produces.
+func benchValue(i int) string {
+	return "value:" + strconv.Itoa(i)
+}
+
+func BenchmarkSlabRpush(b *testing.B) {
+	for _, slab := range []bool{false, true} {
+		b.Run(slabName(slab), func(b *testing.B) {
+			s := newBenchStore(slab)
+			b.ReportAllocs()
+			for i := 0; b.Loop(); i++ {
+				s.Rpush("list:"+strconv.Itoa(i%64), []string{benchValue(i)})
+			}
+		})
+	}
+}
+
+func BenchmarkSlabHSet(b *testing.B) {
+	for _, slab := range []bool{false, true} {
+		b.Run(slabName(slab), func(b *testing.B) {
+			s := newBenchStore(slab)
+			b.ReportAllocs()
+			for i := 0; b.Loop(); i++ {
+				s.HSet("hash:"+strconv.Itoa(i%1024), []string{"field:" + strconv.Itoa(i), benchValue(i)})
+			}
+		})
+	}
+}
+
+// BenchmarkSlabGC measures a full collection with a million small list
+// elements live, the cost the slab is meant to cut, and the heap they use.
+func BenchmarkSlabGC(b *testing.B) {
+	const elements = 1 << 20
+	for _, slab := range []bool{false, true} {
+		b.Run(slabName(slab), func(b *testing.B) {
+			s := newBenchStore(slab)
+			for i := range elements {
+				s.Rpush("list:"+strconv.Itoa(i%1024), []string{benchValue(i)})
+			}
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for b.Loop() {
+				runtime.GC()
+			}
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.HeapObjects), "heap-objects")
+			b.ReportMetric(float64(after.HeapAlloc)/elements, "heap-B/element")
+			runtime.KeepAlive(s)
+		})
+	}
+}
+
+func slabName(slab bool) string {
+	if slab {
+		return "slab"
+	}
+	return "plain"
+}
@@ -2,8 +2,12 @@
 package store
 
 import (
-	"log"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,48 +18,178 @@ const (
 	TypeString DataType = iota
 	TypeList
 	TypeSet
-	TypeHash // A hash map from string fields to string values.
+	TypeHash       // A hash map from string fields to string values.
+	TypeZSet       // A sorted set of members ordered by score.
+	TypeStream     // An append-only log of entries ordered by ID.
+	TypeBloom      // A scalable Bloom filter.
+	TypeCuckoo     // A cuckoo filter.
+	TypeCMS        // A count-min sketch.
+	TypeTopK       // A Top-K sketch.
+	TypeJSON       // A JSON document.
+	TypeTimeSeries // A time series.
 )
 
+// String returns the type name reported by commands such as TYPE and SCAN.
+func (t DataType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeHash:
+		return "hash"
+	case TypeZSet:
+		return "zset"
+	case TypeStream:
+		return "stream"
+	case TypeBloom:
+		// RedisBloom's name for the type, which clients may check for.
+		return "MBbloom--"
+	case TypeCuckoo:
+		return "MBbloomCF"
+	case TypeCMS:
+		return "CMSk-TYPE"
+	case TypeTopK:
+		return "TopK-TYPE"
+	case TypeJSON:
+		return "ReJSON-RL"
+	case TypeTimeSeries:
+		return "TSDB-TYPE"
+	}
+	return "none"
+}
+
+// ErrWrongType is returned when an operation targets a key holding a value of another type.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ErrNotInteger is returned when a value cannot be interpreted as an integer.
+var ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+
+// ErrOverflow is returned when an increment would overflow a 64-bit integer.
+var ErrOverflow = errors.New("ERR increment or decrement would overflow")
+
 // Item holds the value and optional expiration time.
 type Item struct {
 	Value      interface{}
 	Type       DataType
 	Expiration time.Time
+	// FieldExpirations holds the expiration times of individual hash fields.
+	// It is nil when no field has a TTL.
+	FieldExpirations map[string]time.Time
+	// accessed is when the key was last looked up, in Unix nanoseconds, as
+	// tracked for tiering. Zero means not since it was written.
+	accessed int64
+}
+
+// shard is one partition of the keyspace. Each shard owns its items and the
+// read-write mutex that protects them, so writers on different shards never
+// touch the same map.
+type shard struct {
+	sync.RWMutex
+	items   map[string]Item
+	metrics shardMetrics
 }
 
-// Store is our in-memory data store. It now uses a slice of RWMutexes for fine-grained locking.
+// Store is our in-memory data store. Keys are spread over a fixed number of shards for fine-grained locking.
 type Store struct {
-	items map[string]Item
-	// locks is a slice of read-write mutexes used to protect individual keys.
+	*storeState
+	// noTouch is set on the views WithoutTouch returns, whose lookups don't
+	// count as accesses.
+	noTouch bool
+}
+
+// storeState is the state of a Store, shared by its views.
+type storeState struct {
+	// shards partitions the keyspace by key hash.
 	// Using a fixed size prevents an unbounded number of mutexes.
-	locks []sync.RWMutex
+	shards []shard
+	// expireCursor is the shard the next active expire cycle continues from.
+	expireCursor uint32
+	// hashLimits are the thresholds for the compact hash encoding.
+	hashLimits hashLimits
+	// slabs holds one allocator per shard when slab allocation is enabled.
+	slabs []slab
+	// tier is the tiering state when idle values are spilled to disk.
+	tier *tiering
+	// sealer encrypts the values of sensitive keys when enabled.
+	sealer *sealer
+	// stats counts keyspace hits, misses and expirations.
+	stats keyspaceStats
+	// functions holds the function libraries.
+	functions functionLibraries
 }
 
-// NewStore creates a new Store instance. It initializes the map and the array of locks.
+// NewStore creates a new Store instance. It initializes the shards and their maps.
+// Expired keys are only collected when the caller runs ActiveExpireCycle,
+// normally from the server's background scheduler.
 func NewStore() *Store {
-	const numLocks = 256 // A common practice, provides a good balance between memory and contention.
-	locks := make([]sync.RWMutex, numLocks)
-
-	s := &Store{
-		items: make(map[string]Item),
-		locks: locks,
+	const numShards = 256 // A common practice, provides a good balance between memory and contention.
+	shards := make([]shard, numShards)
+	for i := range shards {
+		shards[i].items = make(map[string]Item)
 	}
 
-	// Start the background worker for active expiration.
-	go s.activeExpirationWorker()
+	s := &Store{storeState: &storeState{
+		shards:     shards,
+		hashLimits: hashLimits{maxEntries: defaultHashMaxCompactEntries, maxValue: defaultHashMaxCompactValue},
+	}}
+
 	return s
 }
 
-// getLock returns the correct RWMutex for a given key by hashing the key.
-// This ensures that all operations on a specific key use the same lock.
-func (s *Store) getLock(key string) *sync.RWMutex {
+// shardIndex hashes a key to the index of the shard that owns it.
+func (s *Store) shardIndex(key string) int {
 	// Simple non-cryptographic hash for performance.
 	var hash uint32
 	for _, char := range key {
 		hash = 31*hash + uint32(char)
 	}
-	return &s.locks[hash%uint32(len(s.locks))]
+	return int(hash % uint32(len(s.shards)))
+}
+
+// getShard returns the shard that owns a given key by hashing the key.
+// This ensures that all operations on a specific key use the same lock and map.
+func (s *Store) getShard(key string) *shard {
+	sh := &s.shards[s.shardIndex(key)]
+	if !s.noTouch {
+		sh.metrics.recordAccess(key)
+	}
+	if s.tier != nil {
+		s.touch(sh, key)
+	}
+	return sh
+}
+
+// lockShards write-locks the shards owning all given keys and returns a function
+// that releases them. Shards are locked in index order so that two multi-key
+// operations can never deadlock, and a shard shared by several keys is locked once.
+func (s *Store) lockShards(keys ...string) func() {
+	indexes := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		idx := s.shardIndex(key)
+		if !s.noTouch {
+			s.shards[idx].metrics.recordAccess(key)
+		}
+		if s.tier != nil {
+			s.touch(&s.shards[idx], key)
+		}
+		if !seen[idx] {
+			seen[idx] = true
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Ints(indexes)
+	for _, idx := range indexes {
+		s.shards[idx].Lock()
+	}
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			s.shards[indexes[i]].Unlock()
+		}
+	}
 }
 
 // isExpired checks if an item has expired. This function
@@ -64,37 +198,118 @@ func (s *Store) isExpired(item Item) bool {
 	return !item.Expiration.IsZero() && time.Now().After(item.Expiration)
 }
 
+// deleteExpired deletes key, found expired by a lookup, unless it was
+// written again since.
+func (s *Store) deleteExpired(key string) {
+	sh := &s.shards[s.shardIndex(key)]
+	sh.Lock()
+	defer sh.Unlock()
+	if item, ok := sh.items[key]; ok && s.isExpired(item) {
+		if s.tier != nil {
+			s.forget(item)
+		}
+		delete(sh.items, key)
+		s.stats.expired.Add(1)
+	}
+}
+
 // Set sets a key-value pair with an optional time-to-live (TTL).
 func (s *Store) Set(key string, value string, ttl time.Duration) {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	value, _ = s.Seal(key, value)
+	s.SetSealed(key, value, ttl)
+}
+
+// SetSealed sets key to a value Seal returned, which is stored as it is.
+func (s *Store) SetSealed(key string, value string, ttl time.Duration) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
 	var expiration time.Time
 	if ttl > 0 {
 		expiration = time.Now().Add(ttl)
 	}
 
-	s.items[key] = Item{
+	sh.items[key] = Item{
 		Value:      value,
 		Type:       TypeString,
 		Expiration: expiration,
 	}
 }
 
+// SetOptions are the options of SET that depend on what the key holds.
+type SetOptions struct {
+	NX      bool // only set the key if it doesn't exist
+	XX      bool // only set the key if it exists
+	KeepTTL bool // keep the key's TTL instead of replacing it
+	Get     bool // return the string the key held
+}
+
+// SetResult is the outcome of SetWith.
+type SetResult struct {
+	// Set reports whether the value was stored, and Expiration is the
+	// expiration of the key then, zero if it has none.
+	Set        bool
+	Expiration time.Time
+	// Old is the string the key held when SetOptions.Get was given, and
+	// Existed whether it held one.
+	Old     string
+	Existed bool
+}
+
+// SetWith sets key to a value Seal returned, like SetSealed, subject to the
+// options of SET. With opts.Get, a key holding something other than a string
+// is left alone and ErrWrongType returned.
+func (s *Store) SetWith(key, value string, ttl time.Duration, opts SetOptions) (SetResult, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	var res SetResult
+	item, exists := sh.items[key]
+	if exists && s.isExpired(item) {
+		exists = false
+	}
+	if opts.Get && exists {
+		old, ok := item.Value.(string)
+		if !ok || item.Type != TypeString {
+			return res, ErrWrongType
+		}
+		var err error
+		if res.Old, err = s.open(key, old); err != nil {
+			return res, err
+		}
+		res.Existed = true
+	}
+	if opts.NX && exists || opts.XX && !exists {
+		return res, nil
+	}
+
+	switch {
+	case opts.KeepTTL && exists:
+		res.Expiration = item.Expiration
+	case ttl > 0:
+		res.Expiration = time.Now().Add(ttl)
+	}
+	sh.items[key] = Item{Value: value, Type: TypeString, Expiration: res.Expiration}
+	res.Set = true
+	return res, nil
+}
+
 // Get retrieves a value for a given key, performing passive expiration.
 func (s *Store) Get(key string) (string, bool) {
-	lock := s.getLock(key)
-	lock.RLock()
-	item, ok := s.items[key]
-	lock.RUnlock()
+	sh := s.getShard(key)
+	sh.RLock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	sh.RUnlock()
 
 	if !ok {
 		return "", false
 	}
 
 	if s.isExpired(item) {
-		s.Del(key) // This call to Del handles its own locking.
+		s.deleteExpired(key)
 		return "", false
 	}
 
@@ -102,51 +317,146 @@ func (s *Store) Get(key string) (string, bool) {
 	if !ok || item.Type != TypeString {
 		return "", false // Key exists but is of the wrong type.
 	}
-	return strVal, true
+	return s.openString(key, strVal)
 }
 
 // Del deletes a key from the store.
 func (s *Store) Del(key string) bool {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
-	if _, ok := s.items[key]; ok {
-		delete(s.items, key)
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.items[key]; ok {
+		delete(sh.items, key)
 		return true
 	}
 	return false
 }
 
+// IncrBy increments the integer stored at key by delta and returns the new value.
+// A missing key is treated as 0. The key's expiration is preserved.
+func (s *Store) IncrBy(key string, delta int64) (int64, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	var current int64
+	item, ok := sh.items[key]
+	if ok && s.isExpired(item) {
+		ok = false
+		item = Item{}
+	}
+	if ok {
+		if item.Type != TypeString {
+			return 0, ErrWrongType
+		}
+		value, err := s.open(key, item.Value.(string))
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		current = n
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	current += delta
+	value, _ := s.Seal(key, strconv.FormatInt(current, 10))
+	sh.items[key] = Item{Value: value, Type: TypeString, Expiration: item.Expiration}
+	return current, nil
+}
+
+// Expire sets a time-to-live on an existing key and reports whether the key
+// exists. A non-positive ttl deletes the key immediately.
+func (s *Store) Expire(key string, ttl time.Duration) bool {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return false
+	}
+	if ttl <= 0 {
+		delete(sh.items, key)
+		return true
+	}
+	item.Expiration = time.Now().Add(ttl)
+	sh.items[key] = item
+	return true
+}
+
 // Exists checks if a key exists and has not expired.
 func (s *Store) Exists(key string) bool {
-	lock := s.getLock(key)
-	lock.RLock()
-	item, ok := s.items[key]
-	lock.RUnlock()
+	sh := s.getShard(key)
+	sh.RLock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	sh.RUnlock()
 
 	if !ok {
 		return false
 	}
 
 	if s.isExpired(item) {
-		s.Del(key)
+		s.deleteExpired(key)
 		return false
 	}
 
 	return true
 }
 
+// NextExpiration returns the earliest time at which the value of key changes
+// on its own, either because the key expires or because one of its hash
+// fields does. The zero time means nothing about the key is due to expire.
+func (s *Store) NextExpiration(key string) time.Time {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	item, ok := sh.items[key]
+	if !ok {
+		return time.Time{}
+	}
+	next := item.Expiration
+	for _, at := range item.FieldExpirations {
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// Flush removes every key from the store and returns how many were removed.
+func (s *Store) Flush() int {
+	removed := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.Lock()
+		removed += len(sh.items)
+		if s.tier != nil {
+			for _, item := range sh.items {
+				s.forget(item)
+			}
+		}
+		sh.items = make(map[string]Item)
+		sh.Unlock()
+	}
+	return removed
+}
+
 // Lpush adds elements to the beginning of a list.
 func (s *Store) Lpush(key string, values []string) int {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
-	item, ok := s.items[key]
+	item, ok := sh.items[key]
 	var list []string
 	if ok {
 		if item.Type != TypeList {
-			delete(s.items, key)
+			delete(sh.items, key)
 			list = []string{}
 		} else {
 			list = item.Value.([]string)
@@ -155,24 +465,25 @@ func (s *Store) Lpush(key string, values []string) int {
 		list = []string{}
 	}
 
+	values = s.getSlab(key).internAll(values)
 	newlist := make([]string, len(values)+len(list))
 	copy(newlist, values)
 	copy(newlist[len(values):], list)
-	s.items[key] = Item{Value: newlist, Type: TypeList, Expiration: item.Expiration}
+	sh.items[key] = Item{Value: newlist, Type: TypeList, Expiration: item.Expiration}
 	return len(newlist)
 }
 
 // Rpush adds elements to the end of a list.
 func (s *Store) Rpush(key string, values []string) int {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
-	item, ok := s.items[key]
+	item, ok := sh.items[key]
 	var list []string
 	if ok {
 		if item.Type != TypeList {
-			delete(s.items, key)
+			delete(sh.items, key)
 			list = []string{}
 		} else {
 			list = item.Value.([]string)
@@ -180,18 +491,18 @@ func (s *Store) Rpush(key string, values []string) int {
 	} else {
 		list = []string{}
 	}
-	newlist := append(list, values...)
-	s.items[key] = Item{Value: newlist, Type: TypeList, Expiration: item.Expiration}
+	newlist := append(list, s.getSlab(key).internAll(values)...)
+	sh.items[key] = Item{Value: newlist, Type: TypeList, Expiration: item.Expiration}
 	return len(newlist)
 }
 
 // Lpop removes and returns the first element of a list.
 func (s *Store) Lpop(key string) (string, bool) {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
-	item, ok := s.items[key]
+	item, ok := sh.items[key]
 	if !ok || item.Type != TypeList || s.isExpired(item) {
 		return "", false
 	}
@@ -202,20 +513,20 @@ func (s *Store) Lpop(key string) (string, bool) {
 	}
 	val := list[0]
 	if len(list[1:]) == 0 {
-		delete(s.items, key)
+		delete(sh.items, key)
 	} else {
-		s.items[key] = Item{Value: list[1:], Type: TypeList, Expiration: item.Expiration}
+		sh.items[key] = Item{Value: list[1:], Type: TypeList, Expiration: item.Expiration}
 	}
 	return val, true
 }
 
 // Rpop removes and returns the last element of a list.
 func (s *Store) Rpop(key string) (string, bool) {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
-	item, ok := s.items[key]
+	item, ok := sh.items[key]
 	if !ok || item.Type != TypeList || s.isExpired(item) {
 		return "", false
 	}
@@ -226,19 +537,20 @@ func (s *Store) Rpop(key string) (string, bool) {
 	}
 	val := list[len(list)-1]
 	if len(list[:len(list)-1]) == 0 {
-		delete(s.items, key)
+		delete(sh.items, key)
 	} else {
-		s.items[key] = Item{Value: list[:len(list)-1], Type: TypeList, Expiration: item.Expiration}
+		sh.items[key] = Item{Value: list[:len(list)-1], Type: TypeList, Expiration: item.Expiration}
 	}
 	return val, true
 }
 
 // Llen returns the length of a list.
 func (s *Store) Llen(key string) int {
-	lock := s.getLock(key)
-	lock.RLock()
-	item, ok := s.items[key]
-	lock.RUnlock()
+	sh := s.getShard(key)
+	sh.RLock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	sh.RUnlock()
 
 	if !ok || item.Type != TypeList || s.isExpired(item) {
 		return 0
@@ -249,10 +561,11 @@ func (s *Store) Llen(key string) int {
 
 // Lrange returns a slice of a list. For simplicity, we return the whole list.
 func (s *Store) Lrange(key string) []string {
-	lock := s.getLock(key)
-	lock.RLock()
-	item, ok := s.items[key]
-	lock.RUnlock()
+	sh := s.getShard(key)
+	sh.RLock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	sh.RUnlock()
 
 	if !ok || item.Type != TypeList || s.isExpired(item) {
 		return nil
@@ -266,15 +579,15 @@ func (s *Store) Lrange(key string) []string {
 
 // Sadd adds one or more members to a set.
 func (s *Store) Sadd(key string, members []string) int {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
-	item, ok := s.items[key]
+	item, ok := sh.items[key]
 	var set map[string]struct{}
 	if ok {
 		if item.Type != TypeSet {
-			delete(s.items, key)
+			delete(sh.items, key)
 			set = make(map[string]struct{})
 		} else {
 			set = item.Value.(map[string]struct{})
@@ -289,17 +602,17 @@ func (s *Store) Sadd(key string, members []string) int {
 			addedCount++
 		}
 	}
-	s.items[key] = Item{Value: set, Type: TypeSet, Expiration: item.Expiration}
+	sh.items[key] = Item{Value: set, Type: TypeSet, Expiration: item.Expiration}
 	return addedCount
 }
 
 // Srem removes one or more members from a set.
 func (s *Store) Srem(key string, members []string) int {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
 
-	item, ok := s.items[key]
+	item, ok := sh.items[key]
 	if !ok || item.Type != TypeSet || s.isExpired(item) {
 		return 0
 	}
@@ -313,19 +626,20 @@ func (s *Store) Srem(key string, members []string) int {
 		}
 	}
 	if len(set) == 0 {
-		delete(s.items, key)
+		delete(sh.items, key)
 	} else {
-		s.items[key] = Item{Value: set, Type: TypeSet, Expiration: item.Expiration}
+		sh.items[key] = Item{Value: set, Type: TypeSet, Expiration: item.Expiration}
 	}
 	return removedCount
 }
 
 // Smembers returns all members of the set.
 func (s *Store) Smembers(key string) []string {
-	lock := s.getLock(key)
-	lock.RLock()
-	item, ok := s.items[key]
-	lock.RUnlock()
+	sh := s.getShard(key)
+	sh.RLock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	sh.RUnlock()
 
 	if !ok || item.Type != TypeSet || s.isExpired(item) {
 		return nil
@@ -341,10 +655,11 @@ func (s *Store) Smembers(key string) []string {
 
 // Sismember checks if a member exists in a set.
 func (s *Store) Sismember(key string, member string) bool {
-	lock := s.getLock(key)
-	lock.RLock()
-	item, ok := s.items[key]
-	lock.RUnlock()
+	sh := s.getShard(key)
+	sh.RLock()
+	s.countLookup(sh, key)
+	item, ok := sh.items[key]
+	sh.RUnlock()
 
 	if !ok || item.Type != TypeSet || s.isExpired(item) {
 		return false
@@ -355,149 +670,77 @@ func (s *Store) Sismember(key string, member string) bool {
 	return exists
 }
 
-// HSet sets a value for a field in a hash stored at key.
-func (s *Store) HSet(key string, field string, value string) int {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
+// Smove atomically moves member from the set at src to the set at dst.
+// It reports whether the member was moved.
+func (s *Store) Smove(src, dst, member string) (bool, error) {
+	unlock := s.lockShards(src, dst)
+	defer unlock()
 
-	item, ok := s.items[key]
-	var hash map[string]string
-	if ok {
-		if item.Type != TypeHash {
-			// If key exists but is not a hash, delete it and start a new hash.
-			delete(s.items, key)
-			hash = make(map[string]string)
-		} else {
-			// Key exists and is a hash, so get it.
-			hash = item.Value.(map[string]string)
-		}
-	} else {
-		// Key doesn't exist, create a new hash.
-		hash = make(map[string]string)
-	}
+	// getShard would lock the shards again to load spilled values, which
+	// lockShards has already done.
+	srcItems := s.shards[s.shardIndex(src)].items
+	dstItems := s.shards[s.shardIndex(dst)].items
 
-	// Check if the field already exists to return the correct count.
-	addedCount := 0
-	if _, exists := hash[field]; !exists {
-		addedCount = 1
+	srcItem, ok := srcItems[src]
+	if !ok || s.isExpired(srcItem) {
+		return false, nil
 	}
-
-	hash[field] = value
-	s.items[key] = Item{Value: hash, Type: TypeHash, Expiration: item.Expiration}
-	return addedCount
-}
-
-// HGet retrieves the value associated with field in the hash stored at key.
-func (s *Store) HGet(key string, field string) (string, bool) {
-	lock := s.getLock(key)
-	lock.RLock()
-	defer lock.RUnlock()
-
-	item, ok := s.items[key]
-	if !ok || item.Type != TypeHash || s.isExpired(item) {
-		return "", false
+	if srcItem.Type != TypeSet {
+		return false, ErrWrongType
 	}
-
-	hash := item.Value.(map[string]string)
-	value, exists := hash[field]
-	return value, exists
-}
-
-// HDel deletes one or more fields from the hash stored at key.
-func (s *Store) HDel(key string, fields []string) int {
-	lock := s.getLock(key)
-	lock.Lock()
-	defer lock.Unlock()
-
-	item, ok := s.items[key]
-	if !ok || item.Type != TypeHash || s.isExpired(item) {
-		return 0
+	dstItem, dstOk := dstItems[dst]
+	if dstOk && s.isExpired(dstItem) {
+		dstOk = false
 	}
-
-	hash := item.Value.(map[string]string)
-	deletedCount := 0
-	for _, field := range fields {
-		if _, exists := hash[field]; exists {
-			delete(hash, field)
-			deletedCount++
-		}
+	if dstOk && dstItem.Type != TypeSet {
+		return false, ErrWrongType
 	}
 
-	// If the hash becomes empty, delete the key itself.
-	if len(hash) == 0 {
-		delete(s.items, key)
-	} else {
-		s.items[key] = Item{Value: hash, Type: TypeHash, Expiration: item.Expiration}
+	srcSet := srcItem.Value.(map[string]struct{})
+	if _, exists := srcSet[member]; !exists {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
 	}
 
-	return deletedCount
-}
-
-// HGetAll retrieves all fields and values of the hash stored at key.
-func (s *Store) HGetAll(key string) map[string]string {
-	lock := s.getLock(key)
-	lock.RLock()
-	defer lock.RUnlock()
-
-	item, ok := s.items[key]
-	if !ok || item.Type != TypeHash || s.isExpired(item) {
-		return nil
+	delete(srcSet, member)
+	if len(srcSet) == 0 {
+		delete(srcItems, src)
 	}
 
-	hash := item.Value.(map[string]string)
-	// Return a copy to prevent external modifications.
-	newHash := make(map[string]string, len(hash))
-	for k, v := range hash {
-		newHash[k] = v
+	if !dstOk {
+		dstItem = Item{Value: make(map[string]struct{}), Type: TypeSet}
 	}
-	return newHash
+	dstItem.Value.(map[string]struct{})[member] = struct{}{}
+	dstItems[dst] = dstItem
+	return true, nil
 }
 
-// activeExpirationWorker performs active expiration in the background.
-// It wakes up periodically to sample and delete expired keys.
-func (s *Store) activeExpirationWorker() {
-	ticker := time.NewTicker(time.Second * 5)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		keysToDelete := []string{}
-
-		// To safely iterate over the map while other goroutines are writing,
-		// we must acquire a lock for each shard before iterating over the items in that shard.
-		// Since the user's current implementation uses a single map, a full lock is needed for iteration.
-		// However, a range over the map is a problem. The most correct way to fix this with
-		// the user's code is to add a global lock to protect the entire map during iteration.
-		// The `Del` method will handle its own locking.
-
-		// Acquire write locks for all shards to ensure no concurrent writes occur during iteration.
-		for i := range s.locks {
-			s.locks[i].Lock()
+// ActiveExpireCycle deletes expired keys and hash fields, sweeping shards
+// round-robin until budget is used up. It reports whether the sweep stopped
+// early, i.e. whether there may be expired keys left to collect. It is meant
+// to be registered with the server's background scheduler.
+func (s *Store) ActiveExpireCycle(budget time.Duration) bool {
+	start := time.Now()
+	for swept := 0; swept < len(s.shards); swept++ {
+		if swept > 0 && time.Since(start) >= budget {
+			return true
 		}
-
-		// Now it's safe to iterate the entire map.
-		for key, item := range s.items {
+		idx := int(atomic.AddUint32(&s.expireCursor, 1)) % len(s.shards)
+		sh := &s.shards[idx]
+		sh.Lock()
+		for key, item := range sh.items {
 			if s.isExpired(item) {
-				keysToDelete = append(keysToDelete, key)
+				if s.tier != nil {
+					s.forget(item)
+				}
+				delete(sh.items, key)
+				s.stats.expired.Add(1)
 			}
 		}
-
-		// Release all the locks.
-		for i := range s.locks {
-			s.locks[i].Unlock()
-		}
-
-		// Delete the expired keys. The `s.Del(key)` call inside this loop
-		// will acquire the specific key's lock, ensuring safety.
-		deletedCount := 0
-		for _, key := range keysToDelete {
-			if s.Del(key) {
-				deletedCount++
-			}
-		}
-
-		if deletedCount > 0 {
-			log.Printf("Active expiration worker: deleted %d expired keys.", deletedCount)
-		}
+		s.expireHashFields(sh)
+		sh.Unlock()
 	}
+	return false
 }
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamID identifies a stream entry: the millisecond time it was added at
+// and a sequence number among the entries of that millisecond.
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+// String formats the ID as "<ms>-<seq>".
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Less reports whether id sorts before other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// MaxStreamID is the largest possible stream ID.
+var MaxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// ParseStreamID parses "<ms>-<seq>" or "<ms>". A missing sequence number is
+// taken to be missingSeq, which lets range starts default to 0 and range
+// ends to the largest sequence number.
+func ParseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{Ms: ms, Seq: missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// StreamEntry is a stream entry: its ID and field-value pairs.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// TypeStream values are stored as a *streamValue: the entries in ID order,
+// packed into chunks, and the largest ID ever added, which new IDs must exceed even after the
+// entry holding it is gone, along with how many entries were ever added and
+// the largest ID deleted, which XSETID restores from backups.
+type streamValue struct {
+	chunks       []*streamChunk
+	length       int
+	lastID       StreamID
+	entriesAdded uint64
+	maxDeletedID StreamID
+}
+
+var (
+	// ErrInvalidStreamID is returned for IDs that can't be parsed.
+	ErrInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+	// ErrStreamIDTooSmall is returned by XAdd for an ID that doesn't exceed
+	// the stream's last ID.
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	// ErrStreamIDZero is returned by XAdd for the ID 0-0, which is reserved.
+	ErrStreamIDZero = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	// ErrNoSuchKey is returned by XSetID for a missing stream.
+	ErrNoSuchKey = errors.New("ERR no such key")
+	// ErrXSetIDTooSmall, ErrEntriesAddedTooSmall and ErrXSetIDBelowDeleted
+	// are returned by XSetID for a state the stream's entries contradict.
+	ErrXSetIDTooSmall       = errors.New("ERR The ID specified in XSETID is smaller than the target stream top item")
+	ErrEntriesAddedTooSmall = errors.New("ERR The entries_added specified in XSETID is smaller than the target stream length")
+	ErrXSetIDBelowDeleted   = errors.New("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+)
+
+// liveStream returns the stream stored at key for reading, nil if the key is
+// missing or expired, and ErrWrongType if it holds another type. The caller
+// must hold the shard's lock.
+func (s *Store) liveStream(sh *shard, key string) (*streamValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, nil
+	}
+	if item.Type != TypeStream {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*streamValue), nil
+}
+
+// nextStreamID returns the ID XADD assigns for the ID argument spec: "*" for
+// an automatic one, "<ms>-*" for the next sequence number of a given
+// millisecond, or an explicit ID.
+func nextStreamID(spec string, last StreamID) (StreamID, error) {
+	if spec == "*" {
+		ms := uint64(time.Now().UnixMilli())
+		if ms > last.Ms {
+			return StreamID{Ms: ms}, nil
+		}
+		if last.Seq == math.MaxUint64 {
+			if last.Ms == math.MaxUint64 {
+				return StreamID{}, ErrStreamIDTooSmall
+			}
+			return StreamID{Ms: last.Ms + 1}, nil
+		}
+		return StreamID{Ms: last.Ms, Seq: last.Seq + 1}, nil
+	}
+	if msPart, ok := strings.CutSuffix(spec, "-*"); ok {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+		id := StreamID{Ms: ms}
+		if ms == last.Ms {
+			if last.Seq == math.MaxUint64 {
+				return StreamID{}, ErrStreamIDTooSmall
+			}
+			id.Seq = last.Seq + 1
+		}
+		if id.Ms == 0 && id.Seq == 0 {
+			id.Seq = 1
+		}
+		if id.Less(last) {
+			return StreamID{}, ErrStreamIDTooSmall
+		}
+		return id, nil
+	}
+	id, err := ParseStreamID(spec, 0)
+	if err != nil {
+		return StreamID{}, err
+	}
+	if id == (StreamID{}) {
+		return StreamID{}, ErrStreamIDZero
+	}
+	if !last.Less(id) {
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// XAdd appends an entry with the given field-value pairs to the stream stored
+// at key, creating the stream if needed, and returns the ID it was given.
+// idSpec is "*", "<ms>-*" or an explicit ID, as in XADD.
+func (s *Store) XAdd(key, idSpec string, fields []string) (StreamID, error) {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return StreamID{}, fmt.Errorf("ERR wrong number of arguments for 'xadd' command")
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	stream, err := s.liveStream(sh, key)
+	if err != nil {
+		return StreamID{}, err
+	}
+	item := sh.items[key]
+	if stream == nil {
+		stream = &streamValue{}
+		item = Item{Value: stream, Type: TypeStream}
+	}
+	id, err := nextStreamID(idSpec, stream.lastID)
+	if err != nil {
+		return StreamID{}, err
+	}
+	stream.add(id, fields)
+	stream.lastID = id
+	stream.entriesAdded++
+	sh.items[key] = item
+	return id, nil
+}
+
+// XLen returns the number of entries in the stream stored at key.
+func (s *Store) XLen(key string) (int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	stream, err := s.liveStream(sh, key)
+	if stream == nil {
+		return 0, err
+	}
+	return stream.length, nil
+}
+
+// XRange returns up to count entries (all if count is negative) of the stream
+// stored at key with IDs from start to end inclusive, in ID order, or in
+// reverse order when rev is set.
+func (s *Store) XRange(key string, start, end StreamID, count int, rev bool) ([]StreamEntry, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	stream, err := s.liveStream(sh, key)
+	if stream == nil || end.Less(start) {
+		return nil, err
+	}
+	return stream.rangeEntries(start, end, count, rev), nil
+}
+
+// XRead returns up to count entries (all if count is negative) of the stream
+// stored at key with IDs greater than after.
+func (s *Store) XRead(key string, after StreamID, count int) ([]StreamEntry, error) {
+	if after == MaxStreamID {
+		return nil, nil
+	}
+	start := StreamID{Ms: after.Ms, Seq: after.Seq + 1}
+	if after.Seq == math.MaxUint64 {
+		start = StreamID{Ms: after.Ms + 1}
+	}
+	return s.XRange(key, start, MaxStreamID, count, false)
+}
+
+// XLastID returns the largest ID ever added to the stream stored at key, or
+// 0-0 if there is no stream.
+func (s *Store) XLastID(key string) (StreamID, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+
+	stream, err := s.liveStream(sh, key)
+	if stream == nil {
+		return StreamID{}, err
+	}
+	return stream.lastID, nil
+}
+
+// XSetID sets the last ID of the stream stored at key, which may be lowered
+// but not below its last entry. A non-negative entriesAdded also sets the
+// count of entries ever added, and a non-nil maxDeletedID the largest ID
+// deleted.
+func (s *Store) XSetID(key string, id StreamID, entriesAdded int64, maxDeletedID *StreamID) error {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	stream, err := s.liveStream(sh, key)
+	if err != nil {
+		return err
+	}
+	if stream == nil {
+		return ErrNoSuchKey
+	}
+	if last, ok := stream.lastEntryID(); ok && id.Less(last) {
+		return ErrXSetIDTooSmall
+	}
+	if entriesAdded >= 0 && uint64(entriesAdded) < uint64(stream.length) {
+		return ErrEntriesAddedTooSmall
+	}
+	if maxDeletedID != nil && id.Less(*maxDeletedID) {
+		return ErrXSetIDBelowDeleted
+	}
+	stream.lastID = id
+	if entriesAdded >= 0 {
+		stream.entriesAdded = uint64(entriesAdded)
+	}
+	if maxDeletedID != nil {
+		stream.maxDeletedID = *maxDeletedID
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"encoding/binary"
+	"slices"
+	"sort"
+)
+
+// Stream entries are packed into chunks rather than kept as a slice of
+// structs, so a large stream costs a few bytes per entry on top of its field
+// data instead of a slice header per entry and a string header per field.
+// A chunk holds up to streamChunkEntries consecutive entries, encoded one
+// after the other in a byte slice:
+//
+//	ms delta   uvarint, from the previous entry (or the chunk's first ID)
+//	seq        uvarint, a delta from the previous entry's if ms didn't change
+//	header     uvarint, the number of fields << 1 | 1 if the field names
+//	           are those of the previous entry
+//	fields     uvarint length and bytes of each field name and value, or of
+//	           the values alone when the names are repeated
+//
+// Producers usually write entries of the same shape, so the names are
+// stored once per chunk. Only the last chunk is ever appended to; the
+// others are immutable and shared between copies of the stream.
+
+// streamChunkEntries and streamChunkBytes bound the size of a chunk, which
+// is decoded in full to read any of its entries.
+const (
+	streamChunkEntries = 128
+	streamChunkBytes   = 4096
+)
+
+// streamChunk is a run of consecutive stream entries.
+type streamChunk struct {
+	first, last StreamID
+	count       int
+	data        []byte
+	// lastFields are the fields of the last entry, which the next one may
+	// repeat the names of.
+	lastFields []string
+}
+
+// sameFieldNames reports whether two field-value lists have the same names.
+func sameFieldNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i += 2 {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// append encodes an entry at the end of the chunk.
+func (c *streamChunk) append(id StreamID, fields []string) {
+	prev := c.last
+	if c.count == 0 {
+		c.first, prev = id, id
+	}
+	seq := id.Seq
+	if id.Ms == prev.Ms {
+		seq -= prev.Seq
+	}
+	same := c.count > 0 && sameFieldNames(fields, c.lastFields)
+	header := uint64(len(fields)) << 1
+	if same {
+		header |= 1
+	}
+	c.data = binary.AppendUvarint(c.data, id.Ms-prev.Ms)
+	c.data = binary.AppendUvarint(c.data, seq)
+	c.data = binary.AppendUvarint(c.data, header)
+	for i, field := range fields {
+		if same && i%2 == 0 {
+			continue
+		}
+		c.data = binary.AppendUvarint(c.data, uint64(len(field)))
+		c.data = append(c.data, field...)
+	}
+	c.last = id
+	c.count++
+	c.lastFields = fields
+}
+
+// entries decodes the chunk.
+func (c *streamChunk) entries() []StreamEntry {
+	entries := make([]StreamEntry, 0, c.count)
+	b := c.data
+	next := func() uint64 {
+		n, size := binary.Uvarint(b)
+		b = b[size:]
+		return n
+	}
+	prev := StreamEntry{ID: c.first}
+	for len(b) > 0 {
+		var entry StreamEntry
+		entry.ID.Ms = prev.ID.Ms + next()
+		entry.ID.Seq = next()
+		if entry.ID.Ms == prev.ID.Ms {
+			entry.ID.Seq += prev.ID.Seq
+		}
+		header := next()
+		entry.Fields = make([]string, header>>1)
+		for i := range entry.Fields {
+			if header&1 == 1 && i%2 == 0 {
+				entry.Fields[i] = prev.Fields[i]
+				continue
+			}
+			n := next()
+			entry.Fields[i] = string(b[:n])
+			b = b[n:]
+		}
+		entries = append(entries, entry)
+		prev = entry
+	}
+	return entries
+}
+
+// full reports whether the next entry should start a new chunk.
+func (c *streamChunk) full() bool {
+	return c.count >= streamChunkEntries || len(c.data) >= streamChunkBytes
+}
+
+// add appends an entry to the stream.
+func (v *streamValue) add(id StreamID, fields []string) {
+	if len(v.chunks) == 0 || v.chunks[len(v.chunks)-1].full() {
+		v.chunks = append(v.chunks, &streamChunk{})
+	}
+	v.chunks[len(v.chunks)-1].append(id, slices.Clone(fields))
+	v.length++
+}
+
+// lastEntryID returns the ID of the stream's last entry, if it has any.
+func (v *streamValue) lastEntryID() (StreamID, bool) {
+	if len(v.chunks) == 0 {
+		return StreamID{}, false
+	}
+	return v.chunks[len(v.chunks)-1].last, true
+}
+
+// each calls fn for the entries in ID order until it returns false.
+func (v *streamValue) each(fn func(StreamEntry) bool) {
+	for _, c := range v.chunks {
+		for _, entry := range c.entries() {
+			if !fn(entry) {
+				return
+			}
+		}
+	}
+}
+
+// rangeEntries returns up to count entries (all if count is negative) with
+// IDs from start to end inclusive, in ID order or in reverse when rev is
+// set. Only the chunks overlapping the range are decoded.
+func (v *streamValue) rangeEntries(start, end StreamID, count int, rev bool) []StreamEntry {
+	// Chunks lo to hi-1 may hold IDs in the range.
+	lo := sort.Search(len(v.chunks), func(i int) bool { return !v.chunks[i].last.Less(start) })
+	hi := sort.Search(len(v.chunks), func(i int) bool { return end.Less(v.chunks[i].first) })
+	var result []StreamEntry
+	for i := lo; i < hi && (count < 0 || len(result) < count); i++ {
+		c := v.chunks[i]
+		if rev {
+			c = v.chunks[hi-1-(i-lo)]
+		}
+		entries := c.entries()
+		for j := range entries {
+			entry := entries[j]
+			if rev {
+				entry = entries[len(entries)-1-j]
+			}
+			if entry.ID.Less(start) || end.Less(entry.ID) {
+				continue
+			}
+			if count >= 0 && len(result) >= count {
+				break
+			}
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// clone returns a copy of the stream that can be appended to independently.
+// Full chunks are shared; the last one is copied, as it may still grow.
+func (v *streamValue) clone() *streamValue {
+	clone := *v
+	clone.chunks = slices.Clone(v.chunks)
+	if n := len(clone.chunks); n > 0 {
+		last := *clone.chunks[n-1]
+		last.data = slices.Clip(last.data)
+		clone.chunks[n-1] = &last
+	}
+	return &clone
+}
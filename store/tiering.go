@@ -0,0 +1,524 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tiering moves values that haven't been accessed for a while to a spill
+// file on local disk, leaving a stub in their place that keeps the key, its
+// type and its TTLs in memory. Looking a key up loads its value back, so
+// every operation works as before, at the cost of a disk read on the first
+// access to a cold key. With tiering enabled, each lookup also takes the
+// shard's write lock to record the access time.
+//
+// The spill file is append-only. Loaded and deleted values leave garbage
+// behind, which is reclaimed by copying the live values to a new file once
+// garbage makes up most of it.
+
+// minSpillBytes is the smallest encoded value worth spilling; smaller ones
+// would save less memory than their stub costs.
+const minSpillBytes = 128
+
+// compactMinBytes is the spill file size below which garbage isn't
+// reclaimed.
+const compactMinBytes = 64 << 20
+
+// spillFile is one generation of the spill file.
+type spillFile struct {
+	f    *os.File
+	size int64        // where the next value is appended
+	live atomic.Int64 // bytes of values still referenced by stubs
+}
+
+// coldValue is the stub that replaces a spilled value.
+type coldValue struct {
+	file *spillFile
+	off  int64
+	n    int
+}
+
+// tiering is the state of a store's tiering mode.
+type tiering struct {
+	idle time.Duration
+	path string
+
+	mu     sync.Mutex // guards cur and appends to it
+	cur    *spillFile
+	cursor int // the shard the next cycle continues from
+
+	coldKeys, spilled, loaded atomic.Int64
+}
+
+// TieringStats describes the tiering mode of a store.
+type TieringStats struct {
+	// ColdKeys is the number of keys whose value is on disk.
+	ColdKeys int64
+	// FileBytes is the size of the spill file and LiveBytes how much of it
+	// holds values still in use.
+	FileBytes, LiveBytes int64
+	// Spilled and Loaded count the values moved to and from disk.
+	Spilled, Loaded int64
+}
+
+// EnableTiering turns on tiering, spilling values idle for longer than idle
+// to a file at path, which is truncated. Values are only spilled by
+// TieringCycle, which the caller must run periodically.
+func (s *Store) EnableTiering(path string, idle time.Duration) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	s.tier = &tiering{idle: idle, path: path, cur: &spillFile{f: f}}
+	return nil
+}
+
+// TieringStats reports on the tiering mode; ok is false when it's disabled.
+func (s *Store) TieringStats() (st TieringStats, ok bool) {
+	t := s.tier
+	if t == nil {
+		return st, false
+	}
+	t.mu.Lock()
+	st.FileBytes, st.LiveBytes = t.cur.size, t.cur.live.Load()
+	t.mu.Unlock()
+	st.ColdKeys, st.Spilled, st.Loaded = t.coldKeys.Load(), t.spilled.Load(), t.loaded.Load()
+	return st, true
+}
+
+// touch records an access to key and loads its value if it was spilled. It
+// is called on every lookup, before the shard is locked by the caller.
+func (s *Store) touch(sh *shard, key string) {
+	sh.Lock()
+	defer sh.Unlock()
+	item, ok := sh.items[key]
+	if !ok {
+		return
+	}
+	if cold, ok := item.Value.(*coldValue); ok {
+		value, err := s.tier.read(cold)
+		if err != nil {
+			// The value is lost; dropping the key beats failing every access.
+			log.Printf("Tiering: loading the value of '%s' failed, deleting the key: %v", key, err)
+			delete(sh.items, key)
+			return
+		}
+		item.Value = s.getSlab(key).internValue(value)
+		s.tier.loaded.Add(1)
+	}
+	if !s.noTouch {
+		item.accessed = time.Now().UnixNano()
+	}
+	sh.items[key] = item
+}
+
+// WithoutTouch returns a view of the store whose lookups don't count as
+// accesses of their keys, neither for tiering nor for hot key tracking, which
+// keeps keys that are only scanned, by a backup for instance, from looking
+// recently used. Values spilled to disk are loaded either way. The view shares
+// the store's data, and its writes are the store's.
+func (s *Store) WithoutTouch() *Store {
+	return &Store{storeState: s.storeState, noTouch: true}
+}
+
+// materialize returns item with its value loaded if it was spilled, leaving
+// the stub in place, for snapshots that shouldn't warm up every key. It
+// reports false if the value can't be read, and the key should be skipped.
+func (s *Store) materialize(key string, item Item) (Item, bool) {
+	cold, ok := item.Value.(*coldValue)
+	if !ok {
+		return item, true
+	}
+	value, err := s.tier.decode(cold)
+	if err != nil {
+		log.Printf("Tiering: reading the value of '%s' failed: %v", key, err)
+		return item, false
+	}
+	item.Value = value
+	return item, true
+}
+
+// forget accounts for a stub being deleted without its value being loaded.
+func (s *Store) forget(item Item) {
+	if cold, ok := item.Value.(*coldValue); ok {
+		cold.file.live.Add(-int64(cold.n))
+		s.tier.coldKeys.Add(-1)
+	}
+}
+
+// read loads a spilled value, whose space in the file becomes garbage.
+func (t *tiering) read(cold *coldValue) (interface{}, error) {
+	value, err := t.decode(cold)
+	cold.file.live.Add(-int64(cold.n))
+	t.coldKeys.Add(-1)
+	return value, err
+}
+
+// decode reads and decodes a spilled value.
+func (t *tiering) decode(cold *coldValue) (interface{}, error) {
+	buf := make([]byte, cold.n)
+	if _, err := cold.file.f.ReadAt(buf, cold.off); err != nil {
+		return nil, err
+	}
+	return decodeValue(buf)
+}
+
+// write appends an encoded value to the current spill file.
+func (t *tiering) write(buf []byte) (*coldValue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.cur
+	if _, err := f.f.WriteAt(buf, f.size); err != nil {
+		return nil, err
+	}
+	cold := &coldValue{file: f, off: f.size, n: len(buf)}
+	f.size += int64(len(buf))
+	f.live.Add(int64(len(buf)))
+	return cold, nil
+}
+
+// TieringCycle spills the values that have been idle for too long, visiting
+// shards round-robin until budget is used up, and reports whether it stopped
+// early. Keys written since the last visit are stamped as accessed now. It is
+// meant to be registered with the server's background scheduler.
+func (s *Store) TieringCycle(budget time.Duration) bool {
+	t := s.tier
+	if t == nil {
+		return false
+	}
+	start := time.Now()
+	for visited := 0; visited < len(s.shards); visited++ {
+		if visited > 0 && time.Since(start) >= budget {
+			return true
+		}
+		t.cursor = (t.cursor + 1) % len(s.shards)
+		if err := s.spillShard(&s.shards[t.cursor], start); err != nil {
+			log.Printf("Tiering: spilling failed: %v", err)
+			return false
+		}
+	}
+	if err := s.compactSpillFile(); err != nil {
+		log.Printf("Tiering: compacting the spill file failed: %v", err)
+	}
+	return false
+}
+
+// spillShard spills the idle values of one shard.
+func (s *Store) spillShard(sh *shard, now time.Time) error {
+	sh.Lock()
+	defer sh.Unlock()
+	cutoff := now.Add(-s.tier.idle).UnixNano()
+	for key, item := range sh.items {
+		if _, cold := item.Value.(*coldValue); cold || s.isExpired(item) {
+			continue
+		}
+		if item.accessed == 0 {
+			item.accessed = now.UnixNano()
+			sh.items[key] = item
+			continue
+		}
+		// Hashes with field TTLs stay in memory, where the expire cycle
+		// collects their fields.
+		if item.accessed > cutoff || len(item.FieldExpirations) > 0 {
+			continue
+		}
+		buf := encodeValue(item.Value)
+		if len(buf) < minSpillBytes {
+			continue
+		}
+		cold, err := s.tier.write(buf)
+		if err != nil {
+			return err
+		}
+		item.Value = cold
+		sh.items[key] = item
+		s.tier.spilled.Add(1)
+		s.tier.coldKeys.Add(1)
+	}
+	return nil
+}
+
+// compactSpillFile copies the live values to a new spill file once garbage
+// makes up most of the current one. Stubs are moved shard by shard, so the
+// old file stays readable until none refers to it.
+func (s *Store) compactSpillFile() error {
+	t := s.tier
+	t.mu.Lock()
+	old := t.cur
+	if old.size < compactMinBytes || old.live.Load()*2 > old.size {
+		t.mu.Unlock()
+		return nil
+	}
+	tmp := t.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	// The new file takes the path of the old one right away; the old one
+	// stays open until its values are copied.
+	if err := os.Rename(tmp, t.path); err != nil {
+		f.Close()
+		t.mu.Unlock()
+		return err
+	}
+	t.cur = &spillFile{f: f}
+	t.mu.Unlock()
+
+	// Should copying fail, the old file stays open for the stubs still
+	// referring to it.
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.Lock()
+		for key, item := range sh.items {
+			cold, ok := item.Value.(*coldValue)
+			if !ok || cold.file != old {
+				continue
+			}
+			buf := make([]byte, cold.n)
+			if _, err := old.f.ReadAt(buf, cold.off); err != nil {
+				sh.Unlock()
+				return fmt.Errorf("reading '%s': %w", key, err)
+			}
+			moved, err := t.write(buf)
+			if err != nil {
+				sh.Unlock()
+				return err
+			}
+			item.Value = moved
+			sh.items[key] = item
+		}
+		sh.Unlock()
+	}
+	return old.f.Close()
+}
+
+// Spilled values are encoded as a type byte followed by uvarint lengths and
+// counts, strings as their length and bytes, and floats and IDs as fixed
+// 64-bit words.
+const (
+	spillString byte = iota
+	spillList
+	spillSet
+	spillCompactHash
+	spillHash
+	spillZSet
+	spillStream
+	spillBloom
+	spillCuckoo
+	spillCMS
+	spillTopK
+	spillJSON
+	spillTimeSeries
+)
+
+// errCorruptSpill is returned for spilled values that can't be decoded.
+var errCorruptSpill = errors.New("corrupt spilled value")
+
+// encodeValue encodes an in-memory value for the spill file.
+func encodeValue(value interface{}) []byte {
+	var b []byte
+	str := func(s string) {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	strs := func(ss []string) {
+		b = binary.AppendUvarint(b, uint64(len(ss)))
+		for _, s := range ss {
+			str(s)
+		}
+	}
+	id := func(id StreamID) {
+		b = binary.LittleEndian.AppendUint64(b, id.Ms)
+		b = binary.LittleEndian.AppendUint64(b, id.Seq)
+	}
+	switch v := value.(type) {
+	case string:
+		b = append(b, spillString)
+		str(v)
+	case []string:
+		b = append(b, spillList)
+		strs(v)
+	case map[string]struct{}:
+		b = append(b, spillSet)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for member := range v {
+			str(member)
+		}
+	case *hashValue:
+		if v.m == nil {
+			b = append(b, spillCompactHash)
+			strs(v.pairs)
+			break
+		}
+		b = append(b, spillHash)
+		b = binary.AppendUvarint(b, uint64(len(v.m)))
+		for field, value := range v.m {
+			str(field)
+			str(value)
+		}
+	case *zsetValue:
+		b = append(b, spillZSet)
+		b = binary.AppendUvarint(b, uint64(v.zsl.length))
+		for x := v.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+			str(x.member)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(x.score))
+		}
+	case *streamValue:
+		b = append(b, spillStream)
+		id(v.lastID)
+		id(v.maxDeletedID)
+		b = binary.AppendUvarint(b, v.entriesAdded)
+		b = binary.AppendUvarint(b, uint64(v.length))
+		v.each(func(entry StreamEntry) bool {
+			id(entry.ID)
+			strs(entry.Fields)
+			return true
+		})
+	case *bloomValue:
+		b = append(b, spillBloom)
+		b = append(b, v.encode()...)
+	case *cuckooValue:
+		b = append(b, spillCuckoo)
+		b = append(b, v.encode()...)
+	case *cmsValue:
+		b = append(b, spillCMS)
+		b = append(b, v.encode()...)
+	case *topKValue:
+		b = append(b, spillTopK)
+		b = append(b, v.encode()...)
+	case *jsonValue:
+		b = append(b, spillJSON)
+		str(v.String())
+	case *tsValue:
+		b = append(b, spillTimeSeries)
+		b = append(b, v.encode()...)
+	}
+	return b
+}
+
+// spillReader decodes a spilled value, remembering the first error.
+type spillReader struct {
+	b   []byte
+	err error
+}
+
+func (r *spillReader) uvarint() uint64 {
+	n, size := binary.Uvarint(r.b)
+	if size <= 0 {
+		r.err, r.b = errCorruptSpill, nil
+		return 0
+	}
+	r.b = r.b[size:]
+	return n
+}
+
+func (r *spillReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.err, r.b = errCorruptSpill, nil
+		return 0
+	}
+	n := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return n
+}
+
+func (r *spillReader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.err, r.b = errCorruptSpill, nil
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// count reads a count, capped by the bytes left so corrupt input can't
+// cause huge allocations.
+func (r *spillReader) count() int {
+	return int(min(r.uvarint(), uint64(len(r.b))))
+}
+
+func (r *spillReader) strings() []string {
+	ss := make([]string, r.count())
+	for i := range ss {
+		ss[i] = r.string()
+	}
+	return ss
+}
+
+func (r *spillReader) id() StreamID {
+	return StreamID{Ms: r.uint64(), Seq: r.uint64()}
+}
+
+// decodeValue decodes a value encoded by encodeValue.
+func decodeValue(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, errCorruptSpill
+	}
+	r := &spillReader{b: b[1:]}
+	var value interface{}
+	switch b[0] {
+	case spillString:
+		value = r.string()
+	case spillList:
+		value = r.strings()
+	case spillSet:
+		set := make(map[string]struct{})
+		for n := r.count(); n > 0; n-- {
+			set[r.string()] = struct{}{}
+		}
+		value = set
+	case spillCompactHash:
+		value = &hashValue{pairs: r.strings()}
+	case spillHash:
+		m := make(map[string]string)
+		for n := r.count(); n > 0; n-- {
+			field := r.string()
+			m[field] = r.string()
+		}
+		value = &hashValue{m: m}
+	case spillZSet:
+		zset := newZSetValue()
+		for n := r.count(); n > 0; n-- {
+			member := r.string()
+			zset.add(member, math.Float64frombits(r.uint64()))
+		}
+		value = zset
+	case spillStream:
+		stream := &streamValue{lastID: r.id(), maxDeletedID: r.id()}
+		stream.entriesAdded = r.uvarint()
+		for n := r.count(); n > 0 && r.err == nil; n-- {
+			id := r.id()
+			stream.add(id, r.strings())
+		}
+		value = stream
+	case spillBloom:
+		return decodeBloom(b[1:])
+	case spillCuckoo:
+		return decodeCuckoo(b[1:])
+	case spillCMS:
+		return decodeCMS(b[1:])
+	case spillTopK:
+		return decodeTopK(b[1:])
+	case spillJSON:
+		root, err := parseJSON(r.string())
+		if err != nil && r.err == nil {
+			r.err = errCorruptSpill
+		}
+		value = &jsonValue{root: root}
+	case spillTimeSeries:
+		return decodeTimeSeries(b[1:])
+	default:
+		return nil, errCorruptSpill
+	}
+	return value, r.err
+}
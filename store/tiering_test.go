@@ -0,0 +1,94 @@
+package store
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTieredStore returns a store that spills every value as soon as a
+// cycle has seen it idle.
+func newTieredStore(t *testing.T) *Store {
+	t.Helper()
+	s := NewStore()
+	if err := s.EnableTiering(filepath.Join(t.TempDir(), "spill"), 0); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// spillAll runs tiering cycles until the values of keys are on disk: the
+// first cycle stamps new keys as accessed, the next spills them.
+func spillAll(t *testing.T, s *Store, keys int) {
+	t.Helper()
+	for range 2 {
+		time.Sleep(time.Millisecond)
+		s.TieringCycle(time.Hour)
+	}
+	if st, _ := s.TieringStats(); st.ColdKeys != int64(keys) {
+		t.Fatalf("%d cold keys after spilling, want %d", st.ColdKeys, keys)
+	}
+}
+
+// withDeadline fails the test if f doesn't return in time, as a store
+// operation that locks a shard twice never does.
+func withDeadline(t *testing.T, name string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s deadlocked", name)
+	}
+}
+
+func TestTieringSmove(t *testing.T) {
+	s := newTieredStore(t)
+	// Members long enough for the sets to be worth spilling.
+	a, b := strings.Repeat("a", minSpillBytes), strings.Repeat("b", minSpillBytes)
+	s.Sadd("src", []string{a, b})
+	s.Sadd("dst", []string{b})
+	spillAll(t, s, 2)
+
+	var moved bool
+	var err error
+	withDeadline(t, "SMOVE", func() { moved, err = s.Smove("src", "dst", a) })
+	if err != nil || !moved {
+		t.Fatalf("Smove = %v, %v, want true", moved, err)
+	}
+	if got := s.Smembers("src"); !slices.Equal(got, []string{b}) {
+		t.Errorf("src = %q, want [b...]", got)
+	}
+	got := s.Smembers("dst")
+	slices.Sort(got)
+	if !slices.Equal(got, []string{a, b}) {
+		t.Errorf("dst = %q, want [a... b...]", got)
+	}
+}
+
+func TestTieringCMSMerge(t *testing.T) {
+	s := newTieredStore(t)
+	for _, key := range []string{"cms:a", "cms:b", "cms:sum"} {
+		if err := s.CMSInit(key, 64, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.CMSIncrBy("cms:a", []string{"x"}, []uint64{2})
+	s.CMSIncrBy("cms:b", []string{"x"}, []uint64{3})
+	spillAll(t, s, 3)
+
+	var err error
+	withDeadline(t, "CMS.MERGE", func() { err = s.CMSMerge("cms:sum", []string{"cms:a", "cms:b"}, []uint64{1, 2}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts, err := s.CMSQuery("cms:sum", []string{"x"}); err != nil || counts[0] != 8 {
+		t.Errorf("CMSQuery = %v, %v, want [8]", counts, err)
+	}
+}
@@ -0,0 +1,668 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+)
+
+// TypeTimeSeries values are stored as a *tsValue: a time series in the
+// manner of RedisTimeSeries, holding samples ordered by their millisecond
+// timestamp. Samples are expected to arrive mostly in order, which only
+// appends to the slice; older ones are inserted in place. Compaction rules
+// downsample the series into other series as its samples arrive.
+type tsValue struct {
+	samples []TSSample
+	// retention is how far behind the latest sample older ones are kept,
+	// in milliseconds, or 0 to keep them all.
+	retention int64
+	// policy is how a sample at an existing timestamp is handled.
+	policy string
+	labels []TSLabel
+	// source is the series compacted into this one, if any.
+	source string
+	rules  []*tsRule
+}
+
+// tsRule is a compaction rule, aggregating the samples of each bucket of
+// the source series into one sample of the destination. The bucket still
+// receiving samples is aggregated in agg until a sample in a later bucket
+// closes it; samples that arrive late, for a bucket already closed, aren't
+// compacted.
+type tsRule struct {
+	dest        string
+	aggregation TSAggregation
+	open        bool
+	start       int64
+	agg         tsAggregator
+}
+
+// TSSample is a sample of a time series.
+type TSSample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// TSLabel is a label of a time series, matched by TS.MRANGE filters.
+type TSLabel struct {
+	Name, Value string
+}
+
+// TSAggregation aggregates the samples of each bucket of Bucket
+// milliseconds, buckets starting at multiples of it, with Type being one of
+// TSAggregationTypes.
+type TSAggregation struct {
+	Type   string
+	Bucket int64
+}
+
+// TSAggregationTypes are the supported aggregation types.
+var TSAggregationTypes = []string{"avg", "sum", "min", "max", "range", "count", "first", "last"}
+
+// TSDuplicatePolicies are the policies for samples at a timestamp a series
+// already has a sample at: refusing them, keeping the first or last value,
+// the smaller or larger one, or their sum.
+var TSDuplicatePolicies = []string{"block", "first", "last", "min", "max", "sum"}
+
+// TSOptions are the options of a new series.
+type TSOptions struct {
+	Retention       int64
+	DuplicatePolicy string
+	Labels          []TSLabel
+}
+
+// TSFilter matches the series whose label Label has one of Values, or none
+// of them if Negate is set. A missing label has the empty value, so "l="
+// matches series without l and "l!=" those with it.
+type TSFilter struct {
+	Label  string
+	Values []string
+	Negate bool
+}
+
+// TSSeries is a series TSMRange matched.
+type TSSeries struct {
+	Key     string
+	Labels  []TSLabel
+	Samples []TSSample
+}
+
+// TSInfo describes a series, as TS.INFO reports it.
+type TSInfo struct {
+	TotalSamples                  int
+	FirstTimestamp, LastTimestamp int64
+	Retention                     int64
+	DuplicatePolicy               string
+	Labels                        []TSLabel
+	SourceKey                     string
+	Rules                         []TSRuleInfo
+}
+
+// TSRuleInfo describes a compaction rule of a series.
+type TSRuleInfo struct {
+	Dest        string
+	Aggregation TSAggregation
+}
+
+var (
+	// ErrTSExists is returned when creating a series at a key that exists.
+	ErrTSExists = errors.New("ERR TSDB: key already exists")
+	// ErrTSNotFound is returned for a series that doesn't exist.
+	ErrTSNotFound = errors.New("ERR TSDB: the key does not exist")
+	// ErrTSDuplicate is returned for a sample at an existing timestamp of a
+	// series with the block policy.
+	ErrTSDuplicate = errors.New("ERR TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+	// ErrTSTooOld is returned for a sample older than the retention period
+	// allows.
+	ErrTSTooOld = errors.New("ERR TSDB: Timestamp is older than retention")
+	// ErrTSSameKey is returned for a rule compacting a series into itself.
+	ErrTSSameKey = errors.New("ERR TSDB: the source key and destination key should be different")
+	// ErrTSRuleExists is returned for a rule whose destination already has
+	// a source, or that would chain compactions, which aren't supported.
+	ErrTSRuleExists = errors.New("ERR TSDB: the destination key already has a src rule")
+	// ErrTSRuleNotFound is returned when deleting a rule that doesn't exist.
+	ErrTSRuleNotFound = errors.New("ERR TSDB: compaction rule does not exist")
+)
+
+// tsAggregator aggregates the samples of a bucket.
+type tsAggregator struct {
+	count                      int64
+	sum, min, max, first, last float64
+}
+
+func (a *tsAggregator) add(v float64) {
+	if a.count == 0 {
+		a.min, a.max, a.first = v, v, v
+	}
+	a.count++
+	a.sum += v
+	a.min, a.max, a.last = min(a.min, v), max(a.max, v), v
+}
+
+// result returns the aggregate of the samples added.
+func (a *tsAggregator) result(typ string) float64 {
+	switch typ {
+	case "avg":
+		return a.sum / float64(a.count)
+	case "sum":
+		return a.sum
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "range":
+		return a.max - a.min
+	case "count":
+		return float64(a.count)
+	case "first":
+		return a.first
+	}
+	return a.last
+}
+
+// bucketStart returns the start of the bucket holding ts.
+func (agg TSAggregation) bucketStart(ts int64) int64 {
+	return ts - ts%agg.Bucket
+}
+
+// aggregate downsamples samples, which must be in order.
+func (agg TSAggregation) aggregate(samples []TSSample) []TSSample {
+	var out []TSSample
+	var a tsAggregator
+	var start int64
+	for i, sample := range samples {
+		if b := agg.bucketStart(sample.Timestamp); i == 0 || b != start {
+			if i > 0 {
+				out = append(out, TSSample{start, a.result(agg.Type)})
+			}
+			start, a = b, tsAggregator{}
+		}
+		a.add(sample.Value)
+	}
+	if len(samples) > 0 {
+		out = append(out, TSSample{start, a.result(agg.Type)})
+	}
+	return out
+}
+
+// add adds a sample, resolving a duplicate timestamp with policy, and
+// drops the samples retention no longer keeps. It reports whether the
+// sample was appended after the previous last one.
+func (v *tsValue) add(ts int64, value float64, policy string) (bool, error) {
+	n := len(v.samples)
+	if n > 0 && v.retention > 0 && ts < v.samples[n-1].Timestamp-v.retention {
+		return false, ErrTSTooOld
+	}
+	if n == 0 || ts > v.samples[n-1].Timestamp {
+		v.samples = append(v.samples, TSSample{ts, value})
+		v.trim()
+		return true, nil
+	}
+	i := sort.Search(n, func(i int) bool { return v.samples[i].Timestamp >= ts })
+	if v.samples[i].Timestamp != ts {
+		v.samples = slices.Insert(v.samples, i, TSSample{ts, value})
+		return false, nil
+	}
+	old := &v.samples[i].Value
+	switch policy {
+	case "block":
+		return false, ErrTSDuplicate
+	case "last":
+		*old = value
+	case "min":
+		*old = min(*old, value)
+	case "max":
+		*old = max(*old, value)
+	case "sum":
+		*old += value
+	}
+	return false, nil
+}
+
+// trim drops the samples older than the retention period.
+func (v *tsValue) trim() {
+	if v.retention <= 0 || len(v.samples) == 0 {
+		return
+	}
+	oldest := v.samples[len(v.samples)-1].Timestamp - v.retention
+	// Reslicing rather than copying keeps appends cheap; the dropped
+	// samples are let go of when append next reallocates.
+	i := sort.Search(len(v.samples), func(i int) bool { return v.samples[i].Timestamp >= oldest })
+	v.samples = v.samples[i:]
+}
+
+// between returns the samples from from to to, inclusive.
+func (v *tsValue) between(from, to int64) []TSSample {
+	lo := sort.Search(len(v.samples), func(i int) bool { return v.samples[i].Timestamp >= from })
+	hi := sort.Search(len(v.samples), func(i int) bool { return v.samples[i].Timestamp > to })
+	if lo >= hi {
+		return nil
+	}
+	return slices.Clone(v.samples[lo:hi])
+}
+
+// label returns the value of a label, or "" if the series doesn't have it.
+func (v *tsValue) label(name string) string {
+	for _, l := range v.labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// matches reports whether the series matches every filter.
+func (v *tsValue) matches(filters []TSFilter) bool {
+	for _, f := range filters {
+		if slices.Contains(f.Values, v.label(f.Label)) == f.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// clone returns a copy of the series sharing no state with it.
+func (v *tsValue) clone() *tsValue {
+	clone := *v
+	clone.samples = slices.Clone(v.samples)
+	clone.labels = slices.Clone(v.labels)
+	clone.rules = make([]*tsRule, len(v.rules))
+	for i, r := range v.rules {
+		rule := *r
+		clone.rules[i] = &rule
+	}
+	return &clone
+}
+
+// encode serializes the series for TS.SCANDUMP and the spill file.
+func (v *tsValue) encode() []byte {
+	var b []byte
+	str := func(s string) {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	float := func(f float64) {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+	}
+	b = binary.AppendVarint(b, v.retention)
+	str(v.policy)
+	b = binary.AppendUvarint(b, uint64(len(v.labels)))
+	for _, l := range v.labels {
+		str(l.Name)
+		str(l.Value)
+	}
+	str(v.source)
+	b = binary.AppendUvarint(b, uint64(len(v.rules)))
+	for _, r := range v.rules {
+		str(r.dest)
+		str(r.aggregation.Type)
+		b = binary.AppendVarint(b, r.aggregation.Bucket)
+		if r.open {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		b = binary.AppendVarint(b, r.start)
+		b = binary.AppendVarint(b, r.agg.count)
+		for _, f := range []float64{r.agg.sum, r.agg.min, r.agg.max, r.agg.first, r.agg.last} {
+			float(f)
+		}
+	}
+	// Timestamps are stored as deltas, which in-order samples keep small.
+	b = binary.AppendUvarint(b, uint64(len(v.samples)))
+	var prev int64
+	for _, sample := range v.samples {
+		b = binary.AppendVarint(b, sample.Timestamp-prev)
+		prev = sample.Timestamp
+		float(sample.Value)
+	}
+	return b
+}
+
+// decodeTimeSeries decodes a series encoded by encode.
+func decodeTimeSeries(b []byte) (*tsValue, error) {
+	r := &spillReader{b: b}
+	varint := func() int64 {
+		n, size := binary.Varint(r.b)
+		if size <= 0 {
+			r.err, r.b = errCorruptSpill, nil
+			return 0
+		}
+		r.b = r.b[size:]
+		return n
+	}
+	float := func() float64 {
+		return math.Float64frombits(r.uint64())
+	}
+	v := &tsValue{retention: varint(), policy: r.string()}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		v.labels = append(v.labels, TSLabel{Name: r.string(), Value: r.string()})
+	}
+	v.source = r.string()
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		rule := &tsRule{dest: r.string()}
+		rule.aggregation = TSAggregation{Type: r.string(), Bucket: varint()}
+		if len(r.b) == 0 {
+			return nil, errCorruptSpill
+		}
+		rule.open, r.b = r.b[0] == 1, r.b[1:]
+		rule.start = varint()
+		rule.agg.count = varint()
+		rule.agg.sum, rule.agg.min, rule.agg.max, rule.agg.first, rule.agg.last = float(), float(), float(), float(), float()
+		if rule.aggregation.Bucket <= 0 || !slices.Contains(TSAggregationTypes, rule.aggregation.Type) {
+			return nil, errCorruptSpill
+		}
+		v.rules = append(v.rules, rule)
+	}
+	var prev int64
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		ts := prev + varint()
+		if ts < prev || ts < 0 {
+			return nil, errCorruptSpill
+		}
+		v.samples = append(v.samples, TSSample{ts, float()})
+		prev = ts
+	}
+	if r.err == nil && (len(r.b) > 0 || !slices.Contains(TSDuplicatePolicies, v.policy)) {
+		r.err = errCorruptSpill
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return v, nil
+}
+
+// liveTS returns the series stored at key, or ErrTSNotFound or
+// ErrWrongType.
+func (s *Store) liveTS(sh *shard, key string) (*tsValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, ErrTSNotFound
+	}
+	if item.Type != TypeTimeSeries {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*tsValue), nil
+}
+
+// TSCreate creates an empty series at key. It returns ErrTSExists if the
+// key exists.
+func (s *Store) TSCreate(key string, opts TSOptions) error {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if item, ok := sh.items[key]; ok && !s.isExpired(item) {
+		return ErrTSExists
+	}
+	sh.items[key] = Item{Value: newTSValue(opts), Type: TypeTimeSeries}
+	return nil
+}
+
+func newTSValue(opts TSOptions) *tsValue {
+	policy := opts.DuplicatePolicy
+	if policy == "" {
+		policy = "block"
+	}
+	return &tsValue{retention: opts.Retention, policy: policy, labels: slices.Clone(opts.Labels)}
+}
+
+// TSAdd adds a sample to the series at key, resolving a duplicate
+// timestamp with onDuplicate, or the series' policy if empty. If the key
+// doesn't exist, a series is created with create, or ErrTSNotFound
+// returned if it is nil. It reports whether a series was created. The
+// sample is compacted into the destinations of the series' rules.
+func (s *Store) TSAdd(key string, ts int64, value float64, onDuplicate string, create *TSOptions) (bool, error) {
+	// The destinations of the rules are locked along with the series. They
+	// are only known once it is, so they are looked up first and locked
+	// with it; a rule added in between isn't applied to this sample.
+	var dests []string
+	sh := s.getShard(key)
+	sh.RLock()
+	if v, err := s.liveTS(sh, key); err == nil {
+		for _, r := range v.rules {
+			dests = append(dests, r.dest)
+		}
+	}
+	sh.RUnlock()
+	unlock := s.lockShards(append([]string{key}, dests...)...)
+	defer unlock()
+
+	created := false
+	v, err := s.liveTS(sh, key)
+	if err == ErrTSNotFound && create != nil {
+		v, created = newTSValue(*create), true
+	} else if err != nil {
+		return false, err
+	}
+	policy := onDuplicate
+	if policy == "" {
+		policy = v.policy
+	}
+	appended, err := v.add(ts, value, policy)
+	if err != nil {
+		return false, err
+	}
+	if created {
+		sh.items[key] = Item{Value: v, Type: TypeTimeSeries}
+	}
+	if appended {
+		for _, r := range v.rules {
+			if slices.Contains(dests, r.dest) {
+				s.compact(r, ts, value)
+			}
+		}
+	}
+	return created, nil
+}
+
+// compact feeds a sample appended to a series to one of its rules, adding
+// the aggregate of the bucket it closes, if any, to the destination. The
+// destination's shard must be locked.
+func (s *Store) compact(r *tsRule, ts int64, value float64) {
+	start := r.aggregation.bucketStart(ts)
+	if r.open && start > r.start {
+		dsh := &s.shards[s.shardIndex(r.dest)]
+		if dest, err := s.liveTS(dsh, r.dest); err == nil {
+			dest.add(r.start, r.agg.result(r.aggregation.Type), "last")
+		}
+		r.open = false
+	}
+	if !r.open {
+		r.open, r.start, r.agg = true, start, tsAggregator{}
+	}
+	if start == r.start {
+		r.agg.add(value)
+	}
+}
+
+// TSDel deletes the samples from from to to, inclusive, and returns how
+// many were deleted.
+func (s *Store) TSDel(key string, from, to int64) (int, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	v, err := s.liveTS(sh, key)
+	if err != nil {
+		return 0, err
+	}
+	lo := sort.Search(len(v.samples), func(i int) bool { return v.samples[i].Timestamp >= from })
+	hi := sort.Search(len(v.samples), func(i int) bool { return v.samples[i].Timestamp > to })
+	if lo >= hi {
+		return 0, nil
+	}
+	v.samples = slices.Delete(v.samples, lo, hi)
+	return hi - lo, nil
+}
+
+// TSGet returns the last sample of the series at key, reporting false if
+// it has none.
+func (s *Store) TSGet(key string) (TSSample, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	v, err := s.liveTS(sh, key)
+	if err != nil || len(v.samples) == 0 {
+		return TSSample{}, false, err
+	}
+	return v.samples[len(v.samples)-1], true, nil
+}
+
+// TSRange returns the samples of the series at key from from to to,
+// inclusive, aggregated if agg isn't nil.
+func (s *Store) TSRange(key string, from, to int64, agg *TSAggregation) ([]TSSample, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	v, err := s.liveTS(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	samples := v.between(from, to)
+	if agg != nil {
+		samples = agg.aggregate(samples)
+	}
+	return samples, nil
+}
+
+// TSMRange returns, like TSRange, the samples of every series matching all
+// filters, in key order.
+func (s *Store) TSMRange(from, to int64, agg *TSAggregation, filters []TSFilter) []TSSeries {
+	var series []TSSeries
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		for key, item := range sh.items {
+			if item.Type != TypeTimeSeries || s.isExpired(item) {
+				continue
+			}
+			item, ok := s.materialize(key, item)
+			if !ok {
+				continue
+			}
+			v := item.Value.(*tsValue)
+			if !v.matches(filters) {
+				continue
+			}
+			samples := v.between(from, to)
+			if agg != nil {
+				samples = agg.aggregate(samples)
+			}
+			series = append(series, TSSeries{Key: key, Labels: slices.Clone(v.labels), Samples: samples})
+		}
+		sh.RUnlock()
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Key < series[j].Key })
+	return series
+}
+
+// TSCreateRule adds a rule compacting the series at src into the one at
+// dest, which must both exist.
+func (s *Store) TSCreateRule(src, dest string, agg TSAggregation) error {
+	if src == dest {
+		return ErrTSSameKey
+	}
+	unlock := s.lockShards(src, dest)
+	defer unlock()
+
+	v, err := s.liveTS(&s.shards[s.shardIndex(src)], src)
+	if err != nil {
+		return err
+	}
+	d, err := s.liveTS(&s.shards[s.shardIndex(dest)], dest)
+	if err != nil {
+		return err
+	}
+	if d.source != "" || v.source != "" || len(d.rules) > 0 {
+		return ErrTSRuleExists
+	}
+	d.source = src
+	v.rules = append(v.rules, &tsRule{dest: dest, aggregation: agg})
+	return nil
+}
+
+// TSDeleteRule deletes the rule compacting the series at src into dest.
+func (s *Store) TSDeleteRule(src, dest string) error {
+	unlock := s.lockShards(src, dest)
+	defer unlock()
+
+	v, err := s.liveTS(&s.shards[s.shardIndex(src)], src)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(v.rules, func(r *tsRule) bool { return r.dest == dest })
+	if i < 0 {
+		return ErrTSRuleNotFound
+	}
+	v.rules = slices.Delete(v.rules, i, i+1)
+	if d, err := s.liveTS(&s.shards[s.shardIndex(dest)], dest); err == nil && d.source == src {
+		d.source = ""
+	}
+	return nil
+}
+
+// TSInfo describes the series at key.
+func (s *Store) TSInfo(key string) (TSInfo, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	v, err := s.liveTS(sh, key)
+	if err != nil {
+		return TSInfo{}, err
+	}
+	info := TSInfo{
+		TotalSamples:    len(v.samples),
+		Retention:       v.retention,
+		DuplicatePolicy: v.policy,
+		Labels:          slices.Clone(v.labels),
+		SourceKey:       v.source,
+	}
+	if len(v.samples) > 0 {
+		info.FirstTimestamp, info.LastTimestamp = v.samples[0].Timestamp, v.samples[len(v.samples)-1].Timestamp
+	}
+	for _, r := range v.rules {
+		info.Rules = append(info.Rules, TSRuleInfo{Dest: r.dest, Aggregation: r.aggregation})
+	}
+	return info, nil
+}
+
+// TSDump serializes the series at key for TS.SCANDUMP. It reports false if
+// the key doesn't exist.
+func (s *Store) TSDump(key string) ([]byte, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	v, err := s.liveTS(sh, key)
+	if err == ErrTSNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return v.encode(), true, nil
+}
+
+// TSLoad replaces the value at key with a series serialized by TSDump.
+func (s *Store) TSLoad(key string, data []byte) error {
+	v, err := decodeTimeSeries(data)
+	if err != nil {
+		return ErrBloomCorrupt
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.items[key] = Item{Value: v, Type: TypeTimeSeries}
+	return nil
+}
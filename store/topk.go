@@ -0,0 +1,414 @@
+package store
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// TypeTopK values are stored as a *topKValue: a Top-K sketch in the manner
+// of RedisBloom, which follows HeavyKeeper. It tracks the k items added most
+// often with a fixed amount of memory, in a grid of depth rows of width
+// counters, each owned by one item's fingerprint at a time. An item adds to
+// its counter in every row it owns; where another item owns the counter, the
+// item instead decays it, with a probability of decay^count, and takes the
+// counter over once it reaches zero. Counters of frequent items are thus
+// large and hard to take over, while those of the many rare items keep
+// replacing each other. A heap keeps the k items with the largest counts.
+//
+// The decays are decided by a random number generator kept with the sketch,
+// so replaying the same additions, as loading the AOF does, builds the same
+// sketch.
+type topKValue struct {
+	k, width, depth int
+	decay           float64
+	buckets         []topKBucket
+	heap            topKHeap
+	// rng is the state of the SplitMix64 generator deciding decays.
+	rng uint64
+}
+
+// topKBucket is one counter of the grid.
+type topKBucket struct {
+	fp    uint32
+	count uint64
+}
+
+// The defaults of sketches created by TOPK.RESERVE without dimensions,
+// which are RedisBloom's.
+const (
+	DefaultTopKWidth = 8
+	DefaultTopKDepth = 7
+	DefaultTopKDecay = 0.9
+)
+
+var (
+	// ErrTopKExists is returned when reserving a sketch at a key that
+	// already exists.
+	ErrTopKExists = errors.New("TopK: key already exists")
+	// ErrTopKNotFound is returned for a sketch that doesn't exist.
+	ErrTopKNotFound = errors.New("TopK: key does not exist")
+)
+
+// TopKItem is an item of a Top-K list and its estimated count.
+type TopKItem struct {
+	Item  string
+	Count uint64
+}
+
+// TopKInfo describes a Top-K sketch, as TOPK.INFO reports it.
+type TopKInfo struct {
+	K, Width, Depth int
+	Decay           float64
+}
+
+// topKHeap is a min-heap of the top items by count, which also indexes
+// them by item.
+type topKHeap struct {
+	entries []TopKItem
+	index   map[string]int
+}
+
+func (h *topKHeap) Len() int           { return len(h.entries) }
+func (h *topKHeap) Less(i, j int) bool { return h.entries[i].Count < h.entries[j].Count }
+func (h *topKHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].Item] = i
+	h.index[h.entries[j].Item] = j
+}
+func (h *topKHeap) Push(x any) {
+	entry := x.(TopKItem)
+	h.index[entry.Item] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+func (h *topKHeap) Pop() any {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, last.Item)
+	return last
+}
+
+// newTopKValue returns an empty sketch.
+func newTopKValue(k, width, depth int, decay float64) *topKValue {
+	return &topKValue{
+		k:       k,
+		width:   width,
+		depth:   depth,
+		decay:   decay,
+		buckets: make([]topKBucket, width*depth),
+		heap:    topKHeap{index: make(map[string]int)},
+		rng:     uint64(k)<<32 | uint64(width)<<16 | uint64(depth),
+	}
+}
+
+// random returns the next number of the sketch's generator, in [0, 1).
+func (v *topKValue) random() float64 {
+	v.rng += 0x9e3779b97f4a7c15
+	x := v.rng
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+// hash returns an item's fingerprint, never zero, and the hashes its
+// counter in each row is derived from.
+func topKHash(item string) (uint32, uint64, uint64) {
+	h1, h2 := filterHash(item)
+	return uint32(h2>>32) | 1, h1, h2
+}
+
+// add adds incr occurrences of an item. It returns the item the addition
+// pushed out of the top k, if any.
+func (v *topKValue) add(item string, incr uint64) (string, bool) {
+	fp, h1, h2 := topKHash(item)
+	var maxCount uint64
+	for row := 0; row < v.depth; row++ {
+		b := &v.buckets[row*v.width+int((h1+uint64(row)*h2)%uint64(v.width))]
+		switch {
+		case b.count == 0:
+			b.fp, b.count = fp, incr
+		case b.fp == fp:
+			b.count += incr
+		default:
+			// Each occurrence decays the counter in turn, and the rest go
+			// to the item once it takes the counter over.
+			for left := incr; left > 0; left-- {
+				if v.random() < math.Pow(v.decay, float64(b.count)) {
+					b.count--
+					if b.count == 0 {
+						b.fp, b.count = fp, left
+						break
+					}
+				}
+			}
+		}
+		if b.fp == fp {
+			maxCount = max(maxCount, b.count)
+		}
+	}
+
+	if i, ok := v.heap.index[item]; ok {
+		v.heap.entries[i].Count = max(v.heap.entries[i].Count, maxCount)
+		heap.Fix(&v.heap, i)
+		return "", false
+	}
+	if v.heap.Len() < v.k {
+		if maxCount > 0 {
+			heap.Push(&v.heap, TopKItem{Item: item, Count: maxCount})
+		}
+		return "", false
+	}
+	if maxCount <= v.heap.entries[0].Count {
+		return "", false
+	}
+	expelled := heap.Pop(&v.heap).(TopKItem)
+	heap.Push(&v.heap, TopKItem{Item: item, Count: maxCount})
+	return expelled.Item, true
+}
+
+// count returns the estimated count of an item: the largest of the
+// counters it owns.
+func (v *topKValue) count(item string) uint64 {
+	fp, h1, h2 := topKHash(item)
+	var count uint64
+	for row := 0; row < v.depth; row++ {
+		b := v.buckets[row*v.width+int((h1+uint64(row)*h2)%uint64(v.width))]
+		if b.fp == fp {
+			count = max(count, b.count)
+		}
+	}
+	return count
+}
+
+// list returns the top items, most frequent first.
+func (v *topKValue) list() []TopKItem {
+	items := append([]TopKItem(nil), v.heap.entries...)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Item < items[j].Item
+	})
+	return items
+}
+
+// clone returns a copy of the sketch sharing no state with it.
+func (v *topKValue) clone() *topKValue {
+	clone := *v
+	clone.buckets = append([]topKBucket(nil), v.buckets...)
+	clone.heap = topKHeap{entries: append([]TopKItem(nil), v.heap.entries...), index: make(map[string]int, len(v.heap.index))}
+	for item, i := range v.heap.index {
+		clone.heap.index[item] = i
+	}
+	return &clone
+}
+
+// encode serializes the sketch for TOPK.SCANDUMP and the spill file.
+func (v *topKValue) encode() []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(v.k))
+	b = binary.AppendUvarint(b, uint64(v.width))
+	b = binary.AppendUvarint(b, uint64(v.depth))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v.decay))
+	b = binary.LittleEndian.AppendUint64(b, v.rng)
+	for _, bucket := range v.buckets {
+		b = binary.AppendUvarint(b, uint64(bucket.fp))
+		b = binary.AppendUvarint(b, bucket.count)
+	}
+	b = binary.AppendUvarint(b, uint64(len(v.heap.entries)))
+	for _, entry := range v.heap.entries {
+		b = binary.AppendUvarint(b, uint64(len(entry.Item)))
+		b = append(b, entry.Item...)
+		b = binary.AppendUvarint(b, entry.Count)
+	}
+	return b
+}
+
+// decodeTopK decodes a sketch encoded by encode.
+func decodeTopK(b []byte) (*topKValue, error) {
+	r := &spillReader{b: b}
+	k, width, depth := r.uvarint(), r.uvarint(), r.uvarint()
+	// Every counter takes at least two bytes.
+	if r.err != nil || k == 0 || width == 0 || depth == 0 || k > uint64(len(b)) ||
+		width > uint64(len(b)) || depth > uint64(len(b))/width/2 {
+		return nil, errCorruptSpill
+	}
+	v := newTopKValue(int(k), int(width), int(depth), math.Float64frombits(r.uint64()))
+	v.rng = r.uint64()
+	for i := range v.buckets {
+		fp, count := r.uvarint(), r.uvarint()
+		if fp > math.MaxUint32 {
+			return nil, errCorruptSpill
+		}
+		v.buckets[i] = topKBucket{fp: uint32(fp), count: count}
+	}
+	n := r.count()
+	if n > v.k {
+		return nil, errCorruptSpill
+	}
+	for ; n > 0 && r.err == nil; n-- {
+		item := r.string()
+		if _, dup := v.heap.index[item]; dup {
+			return nil, errCorruptSpill
+		}
+		v.heap.Push(TopKItem{Item: item, Count: r.uvarint()})
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errCorruptSpill
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	heap.Init(&v.heap)
+	return v, nil
+}
+
+// liveTopK returns the sketch stored at key, or ErrTopKNotFound or
+// ErrWrongType.
+func (s *Store) liveTopK(sh *shard, key string) (*topKValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, ErrTopKNotFound
+	}
+	if item.Type != TypeTopK {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*topKValue), nil
+}
+
+// TopKReserve creates an empty Top-K sketch at key tracking the k most
+// frequent items, with width counters in each of depth rows, which decay
+// with the probability decay^count. It returns ErrTopKExists if the key
+// exists.
+func (s *Store) TopKReserve(key string, k, width, depth int, decay float64) error {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if item, ok := sh.items[key]; ok && !s.isExpired(item) {
+		return ErrTopKExists
+	}
+	sh.items[key] = Item{Value: newTopKValue(k, width, depth, decay), Type: TypeTopK}
+	return nil
+}
+
+// TopKAdd adds increments[i] occurrences of items[i] to the sketch at key.
+// For each item it returns the item its addition pushed out of the top k,
+// with expelled[i] reporting whether there was one.
+func (s *Store) TopKAdd(key string, items []string, increments []uint64) (dropped []string, expelled []bool, err error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	topk, err := s.liveTopK(sh, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	dropped = make([]string, len(items))
+	expelled = make([]bool, len(items))
+	for i, item := range items {
+		if increments[i] > 0 {
+			dropped[i], expelled[i] = topk.add(item, increments[i])
+		}
+	}
+	return dropped, expelled, nil
+}
+
+// TopKQuery reports whether each item is among the top k of the sketch at
+// key.
+func (s *Store) TopKQuery(key string, items []string) ([]bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	topk, err := s.liveTopK(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(items))
+	for i, item := range items {
+		_, found[i] = topk.heap.index[item]
+	}
+	return found, nil
+}
+
+// TopKCount returns the estimated counts of items in the sketch at key.
+func (s *Store) TopKCount(key string, items []string) ([]uint64, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	topk, err := s.liveTopK(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]uint64, len(items))
+	for i, item := range items {
+		counts[i] = topk.count(item)
+	}
+	return counts, nil
+}
+
+// TopKList returns the top items of the sketch at key, most frequent first.
+func (s *Store) TopKList(key string) ([]TopKItem, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	topk, err := s.liveTopK(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	return topk.list(), nil
+}
+
+// TopKInfo describes the sketch at key.
+func (s *Store) TopKInfo(key string) (TopKInfo, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	topk, err := s.liveTopK(sh, key)
+	if err != nil {
+		return TopKInfo{}, err
+	}
+	return TopKInfo{K: topk.k, Width: topk.width, Depth: topk.depth, Decay: topk.decay}, nil
+}
+
+// TopKDump serializes the sketch at key for TopKLoad.
+func (s *Store) TopKDump(key string) ([]byte, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	topk, err := s.liveTopK(sh, key)
+	if err == ErrTopKNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return topk.encode(), true, nil
+}
+
+// TopKLoad replaces the value at key with a sketch serialized by TopKDump.
+func (s *Store) TopKLoad(key string, data []byte) error {
+	topk, err := decodeTopK(data)
+	if err != nil {
+		return ErrBloomCorrupt
+	}
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.items[key] = Item{Value: topk, Type: TypeTopK}
+	return nil
+}
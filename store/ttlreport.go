@@ -0,0 +1,55 @@
+package store
+
+import "time"
+
+// TTLBuckets are the upper bounds of the TTL histogram buckets of a TTLReport,
+// in increasing order.
+var TTLBuckets = []time.Duration{time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// TTLReport summarizes the expirations across the keyspace.
+type TTLReport struct {
+	Keys     int // live keys
+	Volatile int // live keys with an expiration
+	// Buckets counts the volatile keys by remaining TTL: Buckets[i] counts
+	// those below TTLBuckets[i] and not below the previous bound, and the
+	// extra last entry counts the rest.
+	Buckets []int
+	// Forecast counts the keys due to expire in each upcoming interval.
+	Forecast []int
+}
+
+// TTLReport builds a TTLReport, forecasting expirations over the given number
+// of intervals. Each shard is examined under its own read lock, so the report
+// is not a point-in-time view of a store that is being written to.
+func (s *Store) TTLReport(interval time.Duration, intervals int) TTLReport {
+	r := TTLReport{
+		Buckets:  make([]int, len(TTLBuckets)+1),
+		Forecast: make([]int, intervals),
+	}
+	now := time.Now()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		for _, item := range sh.items {
+			if s.isExpired(item) {
+				continue
+			}
+			r.Keys++
+			if item.Expiration.IsZero() {
+				continue
+			}
+			r.Volatile++
+			ttl := item.Expiration.Sub(now)
+			bucket := 0
+			for bucket < len(TTLBuckets) && ttl >= TTLBuckets[bucket] {
+				bucket++
+			}
+			r.Buckets[bucket]++
+			if slot := int(ttl / interval); slot < intervals {
+				r.Forecast[slot]++
+			}
+		}
+		sh.RUnlock()
+	}
+	return r
+}
@@ -0,0 +1,78 @@
+package store
+
+import "time"
+
+// TTLAction is what a TTL sweep does to each matching key.
+type TTLAction int
+
+const (
+	TTLSet    TTLAction = iota // expire the key after the given duration
+	TTLExtend                  // push an existing expiration back; keys without one are left alone
+	TTLClear                   // remove the expiration
+)
+
+// TTLChange records the new expiration of a key changed by a sweep. A zero
+// Expiration means the key no longer expires.
+type TTLChange struct {
+	Key        string
+	Expiration time.Time
+}
+
+// Persist removes the expiration of key, reporting whether it had one.
+func (s *Store) Persist(key string) bool {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) || item.Expiration.IsZero() {
+		return false
+	}
+	item.Expiration = time.Time{}
+	sh.items[key] = item
+	return true
+}
+
+// SweepTTL applies action to the keys matching pattern, one shard at a time
+// like Scan: starting at cursor, it processes whole shards until at least
+// count keys were examined. It returns the cursor to continue from (0 when
+// the sweep is complete), the number of keys examined, and the keys whose
+// expiration changed. Each shard is updated under its own lock, so a sweep
+// can run alongside normal traffic in batches.
+func (s *Store) SweepTTL(cursor, count int, pattern string, action TTLAction, d time.Duration) (int, int, []TTLChange) {
+	examined := 0
+	var changes []TTLChange
+	now := time.Now()
+	for cursor < len(s.shards) && examined < count {
+		sh := &s.shards[cursor]
+		sh.Lock()
+		for key, item := range sh.items {
+			examined++
+			if s.isExpired(item) || (pattern != "" && !MatchPattern(pattern, key)) {
+				continue
+			}
+			switch action {
+			case TTLSet:
+				item.Expiration = now.Add(d)
+			case TTLExtend:
+				if item.Expiration.IsZero() {
+					continue
+				}
+				item.Expiration = item.Expiration.Add(d)
+			case TTLClear:
+				if item.Expiration.IsZero() {
+					continue
+				}
+				item.Expiration = time.Time{}
+			}
+			sh.items[key] = item
+			changes = append(changes, TTLChange{Key: key, Expiration: item.Expiration})
+		}
+		sh.Unlock()
+		cursor++
+	}
+	if cursor >= len(s.shards) {
+		cursor = 0
+	}
+	return cursor, examined, changes
+}
@@ -0,0 +1,523 @@
+package store
+
+import (
+	"errors"
+	"math"
+)
+
+// TypeZSet values are stored as a *zsetValue: a skiplist ordered by score and
+// member for range and rank queries, plus a member→score map for O(1) lookups.
+type zsetValue struct {
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func newZSetValue() *zsetValue {
+	return &zsetValue{dict: make(map[string]float64), zsl: newSkiplist()}
+}
+
+// ZMember is a sorted set member together with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// add inserts member or moves it to a new score. It reports whether the
+// member is new.
+func (z *zsetValue) add(member string, score float64) bool {
+	current, ok := z.dict[member]
+	if ok {
+		if current != score {
+			z.zsl.delete(current, member)
+			z.zsl.insert(score, member)
+			z.dict[member] = score
+		}
+		return false
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	return true
+}
+
+// remove deletes member, reporting whether it was present.
+func (z *zsetValue) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// clone returns a deep copy of the sorted set.
+func (z *zsetValue) clone() *zsetValue {
+	c := newZSetValue()
+	for x := z.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+		c.add(x.member, x.score)
+	}
+	return c
+}
+
+// liveZSet returns the sorted set stored at key for reading. It returns nil
+// if the key is missing or expired, and ErrWrongType if it holds another type.
+// The caller must hold the shard's lock.
+func (s *Store) liveZSet(sh *shard, key string) (*zsetValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		return nil, nil
+	}
+	if item.Type != TypeZSet {
+		return nil, ErrWrongType
+	}
+	return item.Value.(*zsetValue), nil
+}
+
+// writableZSet returns the sorted set stored at key for modification. A
+// missing or expired key yields a new, empty set that the caller stores with
+// storeZSet. The caller must hold the shard's write lock.
+func (s *Store) writableZSet(sh *shard, key string) (Item, *zsetValue, error) {
+	item, ok := sh.items[key]
+	if !ok || s.isExpired(item) {
+		zset := newZSetValue()
+		return Item{Value: zset, Type: TypeZSet}, zset, nil
+	}
+	if item.Type != TypeZSet {
+		return item, nil, ErrWrongType
+	}
+	return item, item.Value.(*zsetValue), nil
+}
+
+// storeZSet writes back a modified sorted set, deleting the key once it is empty.
+func (s *Store) storeZSet(sh *shard, key string, item Item, zset *zsetValue) {
+	if len(zset.dict) == 0 {
+		delete(sh.items, key)
+		return
+	}
+	item.Value = zset
+	sh.items[key] = item
+}
+
+// ZAdd adds members to the sorted set stored at key, updating the score of
+// members that already exist. It returns the number of new members.
+func (s *Store) ZAdd(key string, members []ZMember) (int, error) {
+	added, _, err := s.ZAddIf(key, members, ZAddFlags{})
+	return added, err
+}
+
+// ZAddFlags are the ZADD conditions deciding which members are written.
+type ZAddFlags struct {
+	// NX only adds new members, XX only updates existing ones.
+	NX, XX bool
+	// GT and LT only update a member when its new score is greater or less
+	// than the current one. New members are added regardless.
+	GT, LT bool
+}
+
+// allows reports whether a member with the current score cur, if exists, may
+// be set to score.
+func (f ZAddFlags) allows(cur float64, exists bool, score float64) bool {
+	if exists {
+		return !f.NX && (!f.GT || score > cur) && (!f.LT || score < cur)
+	}
+	return !f.XX
+}
+
+// ZAddIf adds or updates the members of the sorted set stored at key that
+// flags allow. It returns the number of new members and the members whose
+// score was written, new ones included.
+func (s *Store) ZAddIf(key string, members []ZMember, flags ZAddFlags) (int, []ZMember, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, zset, err := s.writableZSet(sh, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	added := 0
+	var written []ZMember
+	for _, m := range members {
+		cur, exists := zset.dict[m.Member]
+		if !flags.allows(cur, exists, m.Score) || (exists && cur == m.Score) {
+			continue
+		}
+		if zset.add(m.Member, m.Score) {
+			added++
+		}
+		written = append(written, m)
+	}
+	s.storeZSet(sh, key, item, zset)
+	return added, written, nil
+}
+
+// ZIncrByIf increments the score of member like ZIncrBy, provided flags
+// allow the new score. It reports whether the member was written.
+func (s *Store) ZIncrByIf(key, member string, incr float64, flags ZAddFlags) (float64, bool, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, zset, err := s.writableZSet(sh, key)
+	if err != nil {
+		return 0, false, err
+	}
+	cur, exists := zset.dict[member]
+	score := cur + incr
+	if math.IsNaN(score) {
+		return 0, false, ErrScoreNaN
+	}
+	if !flags.allows(cur, exists, score) {
+		return 0, false, nil
+	}
+	zset.add(member, score)
+	s.storeZSet(sh, key, item, zset)
+	return score, true, nil
+}
+
+// ZReplace replaces whatever is stored at key with a sorted set of members,
+// dropping any TTL. An empty members deletes the key.
+func (s *Store) ZReplace(key string, members []ZMember) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	zset := newZSetValue()
+	for _, m := range members {
+		zset.add(m.Member, m.Score)
+	}
+	s.storeZSet(sh, key, Item{Type: TypeZSet}, zset)
+}
+
+// ZScore returns the score of member in the sorted set stored at key.
+func (s *Store) ZScore(key, member string) (float64, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil {
+		return 0, false, err
+	}
+	score, ok := zset.dict[member]
+	return score, ok, nil
+}
+
+// ZCard returns the number of members in the sorted set stored at key.
+func (s *Store) ZCard(key string) (int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil {
+		return 0, err
+	}
+	return len(zset.dict), nil
+}
+
+// ZRem removes members from the sorted set stored at key and returns how many
+// were removed.
+func (s *Store) ZRem(key string, members []string) (int, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, zset, err := s.writableZSet(sh, key)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, member := range members {
+		if zset.remove(member) {
+			removed++
+		}
+	}
+	s.storeZSet(sh, key, item, zset)
+	return removed, nil
+}
+
+// ZRange returns the members with ranks start through stop, inclusive, in
+// ascending score order, or descending when rev is set. Negative ranks count
+// from the end, as in Redis. Only the first member is located by rank, so the
+// cost is O(log n) plus the number of members returned.
+func (s *Store) ZRange(key string, start, stop int, rev bool) ([]ZMember, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil {
+		return nil, err
+	}
+	length := zset.zsl.length
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return nil, nil
+	}
+
+	members := make([]ZMember, 0, stop-start+1)
+	if rev {
+		for x := zset.zsl.byRank(length - 1 - start); len(members) < cap(members); x = x.backward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+	} else {
+		for x := zset.zsl.byRank(start); len(members) < cap(members); x = x.level[0].forward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+	}
+	return members, nil
+}
+
+// ZRangeByScore returns the members whose scores lie between min and max in
+// ascending order, or descending when rev is set, skipping the first offset
+// matches and returning at most count of them; a negative count means no
+// limit.
+func (s *Store) ZRangeByScore(key string, min, max ScoreBound, rev bool, offset, count int) ([]ZMember, error) {
+	return s.zrangeBy(key, scoreRange(min, max), rev, offset, count)
+}
+
+// ZRangeByLex is like ZRangeByScore but selects members lexicographically.
+func (s *Store) ZRangeByLex(key string, min, max LexBound, rev bool, offset, count int) ([]ZMember, error) {
+	return s.zrangeBy(key, lexRange(min, max), rev, offset, count)
+}
+
+// ZCount returns the number of members whose scores lie between min and max.
+func (s *Store) ZCount(key string, min, max ScoreBound) (int, error) {
+	return s.zcountBy(key, scoreRange(min, max))
+}
+
+// ZLexCount returns the number of members between min and max lexicographically.
+func (s *Store) ZLexCount(key string, min, max LexBound) (int, error) {
+	return s.zcountBy(key, lexRange(min, max))
+}
+
+// ZRemRangeByScore removes the members whose scores lie between min and max
+// and returns them.
+func (s *Store) ZRemRangeByScore(key string, min, max ScoreBound) ([]string, error) {
+	return s.zremRangeBy(key, scoreRange(min, max))
+}
+
+// ZRemRangeByLex removes the members between min and max lexicographically
+// and returns them.
+func (s *Store) ZRemRangeByLex(key string, min, max LexBound) ([]string, error) {
+	return s.zremRangeBy(key, lexRange(min, max))
+}
+
+// zrangeBy returns the members in r. The starting member is found by rank,
+// so offsets cost O(log n) rather than a walk over the skipped members.
+func (s *Store) zrangeBy(key string, r zrange, rev bool, offset, count int) ([]ZMember, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil || offset < 0 || count == 0 {
+		return nil, err
+	}
+	var x *skiplistNode
+	if rev {
+		if x = zset.zsl.lastInRange(r); x != nil && offset > 0 {
+			x = zset.zsl.byRank(zset.zsl.rank(x.score, x.member) - offset)
+		}
+	} else {
+		if x = zset.zsl.firstInRange(r); x != nil && offset > 0 {
+			x = zset.zsl.byRank(zset.zsl.rank(x.score, x.member) + offset)
+		}
+	}
+
+	var members []ZMember
+	for x != nil && (count < 0 || len(members) < count) {
+		if rev {
+			if !r.aboveMin(x) {
+				break
+			}
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+			x = x.backward
+		} else {
+			if !r.belowMax(x) {
+				break
+			}
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+			x = x.level[0].forward
+		}
+	}
+	return members, nil
+}
+
+// zcountBy counts the members in r from the ranks of its first and last member.
+func (s *Store) zcountBy(key string, r zrange) (int, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil {
+		return 0, err
+	}
+	first := zset.zsl.firstInRange(r)
+	if first == nil {
+		return 0, nil
+	}
+	last := zset.zsl.lastInRange(r)
+	return zset.zsl.rank(last.score, last.member) - zset.zsl.rank(first.score, first.member) + 1, nil
+}
+
+// zremRangeBy removes the members in r and returns them.
+func (s *Store) zremRangeBy(key string, r zrange) ([]string, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, zset, err := s.writableZSet(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for x := zset.zsl.firstInRange(r); x != nil && r.belowMax(x); x = x.level[0].forward {
+		removed = append(removed, x.member)
+	}
+	for _, member := range removed {
+		zset.remove(member)
+	}
+	s.storeZSet(sh, key, item, zset)
+	return removed, nil
+}
+
+// ZRank returns the 0-based rank of member in the sorted set stored at key,
+// counted from the highest score when rev is set, along with its score. It
+// costs O(log n) through the skiplist spans.
+func (s *Store) ZRank(key, member string, rev bool) (int, float64, bool, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil {
+		return 0, 0, false, err
+	}
+	score, ok := zset.dict[member]
+	if !ok {
+		return 0, 0, false, nil
+	}
+	rank := zset.zsl.rank(score, member)
+	if rev {
+		rank = zset.zsl.length - 1 - rank
+	}
+	return rank, score, true, nil
+}
+
+// ErrScoreNaN is returned when an increment would make a score NaN, such as
+// adding -inf to +inf.
+var ErrScoreNaN = errors.New("ERR resulting score is not a number (NaN)")
+
+// ZIncrBy adds incr to the score of member in the sorted set stored at key,
+// adding the member with incr as its score if it is absent, and returns the
+// new score.
+func (s *Store) ZIncrBy(key, member string, incr float64) (float64, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, zset, err := s.writableZSet(sh, key)
+	if err != nil {
+		return 0, err
+	}
+	score := zset.dict[member] + incr
+	if math.IsNaN(score) {
+		return 0, ErrScoreNaN
+	}
+	zset.add(member, score)
+	s.storeZSet(sh, key, item, zset)
+	return score, nil
+}
+
+// ZPop removes and returns up to count members with the lowest scores, or
+// the highest when max is set, in pop order.
+func (s *Store) ZPop(key string, count int, max bool) ([]ZMember, error) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	item, zset, err := s.writableZSet(sh, key)
+	if err != nil {
+		return nil, err
+	}
+	var popped []ZMember
+	for len(popped) < count && zset.zsl.length > 0 {
+		x := zset.zsl.head.level[0].forward
+		if max {
+			x = zset.zsl.tail
+		}
+		popped = append(popped, ZMember{Member: x.member, Score: x.score})
+		zset.remove(x.member)
+	}
+	s.storeZSet(sh, key, item, zset)
+	return popped, nil
+}
+
+// ZRandMember returns random members of the sorted set stored at key. A
+// positive count returns up to count distinct members; a negative count
+// returns exactly -count members, which may repeat.
+func (s *Store) ZRandMember(key string, count int) ([]ZMember, error) {
+	sh := s.getShard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	s.countLookup(sh, key)
+
+	zset, err := s.liveZSet(sh, key)
+	if zset == nil || count == 0 {
+		return nil, err
+	}
+	length := zset.zsl.length
+	pick := func(rank int) ZMember {
+		x := zset.zsl.byRank(rank)
+		return ZMember{Member: x.member, Score: x.score}
+	}
+	if count < 0 {
+		members := make([]ZMember, -count)
+		for i := range members {
+			members[i] = pick(randIntN(length))
+		}
+		return members, nil
+	}
+
+	// Small samples pick random ranks until enough are distinct; large ones
+	// shuffle the ranks and take a prefix.
+	count = min(count, length)
+	if count*3 <= length {
+		members := make([]ZMember, 0, count)
+		seen := make(map[int]struct{}, count)
+		for len(members) < count {
+			rank := randIntN(length)
+			if _, ok := seen[rank]; !ok {
+				seen[rank] = struct{}{}
+				members = append(members, pick(rank))
+			}
+		}
+		return members, nil
+	}
+	all := make([]ZMember, 0, length)
+	for x := zset.zsl.head.level[0].forward; x != nil; x = x.level[0].forward {
+		all = append(all, ZMember{Member: x.member, Score: x.score})
+	}
+	randShuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	return all[:count], nil
+}